@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -23,7 +24,12 @@ import (
 
 	syncv3 "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
 )
 
 var GitCommit string
@@ -56,6 +62,58 @@ const (
 	EnvIdleTimeoutSecs        = "SYNCV3_DB_IDLE_TIMEOUT_SECS"
 	EnvHTTPTimeoutSecs        = "SYNCV3_HTTP_TIMEOUT_SECS"
 	EnvHTTPInitialTimeoutSecs = "SYNCV3_HTTP_INITIAL_TIMEOUT_SECS"
+	EnvMinPollIntervalMSecs   = "SYNCV3_MIN_POLL_INTERVAL_MS"
+	EnvPollLoadThreshold      = "SYNCV3_POLL_LOAD_THRESHOLD"
+	EnvAuthCacheTTLSecs       = "SYNCV3_AUTH_CACHE_TTL_SECS"
+	EnvMaxTrackedRooms        = "SYNCV3_MAX_TRACKED_ROOMS"
+	EnvPollTimelineLimit      = "SYNCV3_POLL_TIMELINE_LIMIT"
+	EnvEventRetentionHours    = "SYNCV3_EVENT_RETENTION_HOURS"
+	EnvMaxEventsPerRoom       = "SYNCV3_MAX_EVENTS_PER_ROOM"
+	EnvMaxEventSize           = "SYNCV3_MAX_EVENT_SIZE"
+	EnvMaxExtensionBytes      = "SYNCV3_MAX_EXTENSION_BYTES"
+	EnvAdminToken             = "SYNCV3_ADMIN_TOKEN"
+	EnvLargeRoomThreshold     = "SYNCV3_LARGE_ROOM_THRESHOLD"
+	EnvCountThrottleMSecs     = "SYNCV3_COUNT_THROTTLE_MS"
+	EnvCountThrottleMinRooms  = "SYNCV3_COUNT_THROTTLE_MIN_ROOMS"
+	EnvMaxBufferedResponses   = "SYNCV3_MAX_BUFFERED_RESPONSES"
+	EnvMaxBufferedBytes       = "SYNCV3_MAX_BUFFERED_BYTES"
+	EnvMaxBufferedAgeSecs     = "SYNCV3_MAX_BUFFERED_AGE_SECS"
+	EnvFeatureGates           = "SYNCV3_FEATURE_GATES"
+	EnvMaxConnSetupRate       = "SYNCV3_MAX_CONN_SETUP_RATE"
+	EnvConnSetupMaxWaitMSecs  = "SYNCV3_CONN_SETUP_MAX_WAIT_MS"
+	EnvMaxConnRequestRate     = "SYNCV3_MAX_CONN_REQUEST_RATE"
+	EnvConnRequestBurst       = "SYNCV3_CONN_REQUEST_BURST"
+	EnvUserConnSetupRate      = "SYNCV3_MAX_USER_CONN_SETUP_RATE"
+	EnvUserConnSetupBurst     = "SYNCV3_USER_CONN_SETUP_BURST"
+	EnvDeviceConnSetupRate    = "SYNCV3_MAX_DEVICE_CONN_SETUP_RATE"
+	EnvDeviceConnSetupBurst   = "SYNCV3_DEVICE_CONN_SETUP_BURST"
+	EnvMaxInitialSyncs        = "SYNCV3_MAX_CONCURRENT_INITIAL_SYNCS"
+	EnvInitialSyncMaxWaitMS   = "SYNCV3_INITIAL_SYNC_MAX_WAIT_MS"
+	EnvCompressBuffered       = "SYNCV3_COMPRESS_BUFFERED_RESPONSES"
+	EnvMinTimeoutMSecs        = "SYNCV3_MIN_TIMEOUT_MS"
+	EnvMaxTimeoutMSecs        = "SYNCV3_MAX_TIMEOUT_MS"
+	EnvDefaultTimeoutMSecs    = "SYNCV3_DEFAULT_TIMEOUT_MS"
+	EnvPersistConns           = "SYNCV3_PERSIST_CONNS"
+	EnvPresence               = "SYNCV3_PRESENCE"
+	EnvConnIdleTimeoutSecs    = "SYNCV3_CONN_IDLE_TIMEOUT_SECS"
+	EnvConnMaxLifetimeSecs    = "SYNCV3_CONN_MAX_LIFETIME_SECS"
+	EnvDrainTimeoutSecs       = "SYNCV3_DRAIN_TIMEOUT_SECS"
+	EnvCompressResponses      = "SYNCV3_COMPRESS_RESPONSES"
+	EnvToDeviceRetentionHours = "SYNCV3_TO_DEVICE_RETENTION_HOURS"
+	EnvMaxToDeviceMessages    = "SYNCV3_MAX_TO_DEVICE_MESSAGES"
+	EnvBackfill               = "SYNCV3_BACKFILL"
+	EnvBackfillRetentionHours = "SYNCV3_BACKFILL_RETENTION_HOURS"
+	EnvOIDCIntrospectionURL   = "SYNCV3_OIDC_INTROSPECTION_URL"
+	EnvOIDCClientID           = "SYNCV3_OIDC_CLIENT_ID"
+	EnvOIDCClientSecret       = "SYNCV3_OIDC_CLIENT_SECRET"
+	EnvOIDCServerName         = "SYNCV3_OIDC_SERVER_NAME"
+	EnvHomeservers            = "SYNCV3_HOMESERVERS"
+	EnvAppserviceHSToken      = "SYNCV3_APPSERVICE_HS_TOKEN"
+	EnvAppserviceUsers        = "SYNCV3_APPSERVICE_USERS"
+	EnvWarmUpWorkers          = "SYNCV3_WARM_UP_WORKERS"
+	EnvRoomRetention          = "SYNCV3_ROOM_RETENTION"
+	EnvDBReplica              = "SYNCV3_DB_REPLICA"
+	EnvConnDebugResponses     = "SYNCV3_CONN_DEBUG_RESPONSES"
 )
 
 var helpMsg = fmt.Sprintf(`
@@ -77,8 +135,73 @@ Environment var
 %s Default: 3600. The maximum amount of time a database connection may be idle, in seconds. 0 means no limit.
 %s Default: 300. The timeout in seconds for normal HTTP requests.
 %s Default: 1800. The timeout in seconds for initial sync requests.
+%s Default: 0. The minimum interval in milliseconds between requests that clients are advised to use. 0 means no advice is given.
+%s Default: 0. The number of requests per second above which the suggested poll interval is scaled up. 0 means never scale.
+%s Default: 60. How long in seconds to remember access tokens validated by the homeserver. 0 means no caching.
+%s Default: 0. The maximum number of joined rooms to track per connection, most recently active first. This only bounds per-connection memory: every joined room is still polled and cached. 0 means no limit.
+%s Default: 50. The timeline limit to request from the upstream homeserver when polling. Lower values reduce load but make timelines more likely to have gaps.
+%s Default: 0. How long in hours to keep timeline events for. Older events are purged, apart from state events and the most recent 50 events in each room. 0 means keep forever.
+%s Default: 0. The number of timeline events to keep per room. Older events are purged, apart from state events. 0 means no limit.
+%s Default: 65536. The size in bytes above which timeline events are replaced with a placeholder event of type org.matrix.sliding_sync.skipped_event. 0 means no limit.
+%s Default: unset. Comma separated limits on the size in bytes of extensions in each response e.g 'total=1048576,to_device=524288'. Remaining to-device messages are sent in later responses, other extensions over the limit are omitted and listed in 'truncated'.
+%s Default: unset. The access token for admin endpoints, which report the state of pollers and connections, and can evict them. If unset, admin endpoints are disabled.
+%s Default: 10000. The number of joined members at which rooms are large. Large rooms have approximate joined counts and only return lazy loaded members in required_state, to avoid loading every member. 0 means rooms are never large.
+%s Default: 0. How long in milliseconds to hold updates which only change unread counts, to batch them into fewer responses for users in many rooms. Count changes which add highlights are sent immediately. 0 means no throttling.
+%s Default: 1000. The number of joined rooms at which users have their count updates throttled.
+%s Default: 0. The maximum number of responses to buffer for a connection which is not acknowledging them, after which the client must start a new connection. 0 means no limit.
+%s Default: 0. The maximum approximate size in bytes of responses to buffer for a connection which is not acknowledging them, after which the client must start a new connection. 0 means no limit.
+%s Default: 0. The maximum time in seconds to buffer responses for a connection which is not acknowledging them, after which the client must start a new connection. 0 means no limit.
+%s Default: unset. Comma separated rules which enable features for only some devices e.g 'include_indexes=10%%,include_indexes=DEVICEA|DEVICEB'. A rule is a percentage of devices chosen by hashing their device ID, or a | separated list of device IDs. Features without rules are enabled for every device.
+%s Default: 0. The maximum number of new connections to set up per second, to smooth out reconnect storms e.g after the homeserver restarts. Requests on existing connections are not limited. 0 means no limit.
+%s Default: 1000. How long in milliseconds new connections wait to be set up when over the rate, before the client is told to retry.
+%s Default: 0. The maximum average number of requests per second on each connection which are not answered from buffered responses, to protect against clients requesting in a tight loop. 0 means no limit.
+%s Default: 10. The number of requests a connection can make at once before the request rate applies.
+%s Default: 0. The maximum average number of new connections per second each user can set up, to stop one user's clients crowding out everyone else. Setups over the limit are told to retry. 0 means no limit.
+%s Default: 10. The number of new connections a user can set up at once before the per-user rate applies.
+%s Default: 0. The maximum average number of new connections per second each device can set up, to protect against clients which keep starting again. Setups over the limit are told to retry. 0 means no limit.
+%s Default: 3. The number of new connections a device can set up at once before the per-device rate applies.
+%s Default: 0. The maximum number of initial syncs to calculate at once, as they are expensive for users in many rooms. Others wait their turn. 0 means no limit.
+%s Default: 10000. How long in milliseconds initial syncs wait for their turn when at the maximum, before the client is told to retry.
+%s Default: false. If true, responses buffered for clients are held compressed apart from the first, which uses less memory for idle connections at the cost of CPU when a response has to be resent.
+%s Default: 0. The minimum long-poll timeout in milliseconds. Clients asking for less wait this long. 0 means no minimum.
+%s Default: 0. The maximum long-poll timeout in milliseconds. Clients asking for more wait this long. 0 means no maximum.
+%s Default: 0. The long-poll timeout in milliseconds for clients which ask for 0 or don't ask for one. 0 means clients asking for 0 return immediately and clients which don't ask wait 10s.
+%s Default: false. If true, connection positions and buffered responses are saved in the database after every response, so clients can carry on from their pos after a restart instead of starting again.
+%s Default: false. If true, presence is requested from the homeserver and sent to clients using the presence extension. This increases the load on the homeserver and the proxy, as every poller receives the presence of every user it shares a room with.
+%s Default: 1800. How long in seconds a connection can go without a request before it is expired and the client must start a new connection. Must be more than 0.
+%s Default: 0. How long in seconds after it was created a connection is expired, even if it is in use, which bounds how long a connection's state is kept at the cost of clients resyncing. 0 means no limit.
+%s Default: 5. How long in seconds to wait on shutdown for requests to finish before cancelling them, and then how long to wait for the pollers to store the data they are processing.
+%s Default: true. If true, responses are gzipped for clients which send Accept-Encoding: gzip. Disable this if a reverse proxy already compresses responses.
+%s Default: 0. How long in hours to keep to-device messages for devices which have not received them, after which they are purged. 0 means keep them until they are received.
+%s Default: 0. The number of to-device messages to keep for each device, oldest first, for devices which stop syncing. 0 means no limit.
+%s Default: false. If true, clients can page back through timeline history older than the proxy has stored, which the proxy fetches from the homeserver's /messages as the user.
+%s Default: 24. How long in hours to keep history fetched for clients when backfill is enabled, after which it is fetched again. 0 means keep it forever.
+%s Default: unset. For homeservers which delegate authentication to an OpenID Connect provider (MSC3861), the provider's token introspection endpoint. If set, access tokens are checked with the provider instead of the homeserver's /whoami.
+%s Default: unset. The client ID the proxy uses for token introspection. Required if the introspection endpoint is set.
+%s Default: unset. The client secret the proxy uses for token introspection.
+%s Default: unset. The homeserver's server name e.g 'example.com', which user IDs are made from. Required if the introspection endpoint is set.
+%s Default: unset. For serving users of more than one homeserver, a comma separated list of their server names, each optionally with the base URL of its client-server API e.g 'example.com=https://matrix.example.com,example.org'. Base URLs which are left out are looked up with .well-known. Clients must connect to the proxy at the server name or a subdomain of it e.g 'syncv3.example.com', which is how the proxy knows which homeserver to ask about new access tokens. If set, SYNCV3_SERVER is ignored and need not be set.
+%s Default: unset. The hs_token of an application service, e.g a bridge, which the homeserver sends transactions to the proxy for. Register the proxy's URL as the application service's URL. Users in its namespace are never polled: their rooms are updated from its transactions instead.
+%s Default: unset. The regex for the application service's user namespace, as in its registration file e.g '@telegram_.*:example.com'. Required if the hs_token is set.
+%s Default: 0. The number of users to warm up at once after their first poll, which loads their rooms in the background so their first request is fast. Warmed up users stay in memory. 0 disables warming up.
+%s Default: unset. Comma separated retention policies for rooms which keep timeline events for a different time or number than the defaults above, each as 'room ID=hours/events' e.g '!abc:example.com=72/1000'. 0 means no limit, so '!abc:example.com=0/0' keeps the room's events forever.
+%s Default: unset. The postgres connection string of a read-only replica of the database. Timeline and room state loads are sent to the replica once it has replicated the events they need, and to the primary database until then.
+%s Default: 0. The number of responses to summarise for each connection, which users can see along with the lists and room subscriptions of the connections on their devices at /_debug/connections/{deviceID}. 0 disables the endpoint.
+
+Run 'syncv3 compact' to remove inaccessible state snapshots and purge anything past its retention once and exit, instead of waiting for the hourly job. It uses %s and the retention settings above.
 `, EnvServer, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvOTLP, EnvOTLPUsername, EnvOTLPPassword,
-	EnvSentryDsn, EnvLogLevel, EnvMaxConns, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs)
+	EnvSentryDsn, EnvLogLevel, EnvMaxConns, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs, EnvMinPollIntervalMSecs,
+	EnvPollLoadThreshold, EnvAuthCacheTTLSecs, EnvMaxTrackedRooms, EnvPollTimelineLimit,
+	EnvEventRetentionHours, EnvMaxEventsPerRoom, EnvMaxEventSize, EnvMaxExtensionBytes, EnvAdminToken,
+	EnvLargeRoomThreshold, EnvCountThrottleMSecs, EnvCountThrottleMinRooms, EnvMaxBufferedResponses, EnvMaxBufferedBytes,
+	EnvMaxBufferedAgeSecs, EnvFeatureGates, EnvMaxConnSetupRate, EnvConnSetupMaxWaitMSecs,
+	EnvMaxConnRequestRate, EnvConnRequestBurst, EnvUserConnSetupRate, EnvUserConnSetupBurst, EnvDeviceConnSetupRate,
+	EnvDeviceConnSetupBurst, EnvMaxInitialSyncs, EnvInitialSyncMaxWaitMS, EnvCompressBuffered,
+	EnvMinTimeoutMSecs, EnvMaxTimeoutMSecs, EnvDefaultTimeoutMSecs, EnvPersistConns, EnvPresence,
+	EnvConnIdleTimeoutSecs, EnvConnMaxLifetimeSecs, EnvDrainTimeoutSecs, EnvCompressResponses,
+	EnvToDeviceRetentionHours, EnvMaxToDeviceMessages, EnvBackfill, EnvBackfillRetentionHours,
+	EnvOIDCIntrospectionURL, EnvOIDCClientID, EnvOIDCClientSecret, EnvOIDCServerName, EnvHomeservers,
+	EnvAppserviceHSToken, EnvAppserviceUsers, EnvWarmUpWorkers, EnvRoomRetention, EnvDBReplica, EnvConnDebugResponses, EnvDB)
 
 func defaulting(in, dft string) string {
 	if in == "" {
@@ -116,8 +239,68 @@ func main() {
 		EnvIdleTimeoutSecs:        defaulting(os.Getenv(EnvIdleTimeoutSecs), "3600"),
 		EnvHTTPTimeoutSecs:        defaulting(os.Getenv(EnvHTTPTimeoutSecs), "300"),
 		EnvHTTPInitialTimeoutSecs: defaulting(os.Getenv(EnvHTTPInitialTimeoutSecs), "1800"),
+		EnvMinPollIntervalMSecs:   defaulting(os.Getenv(EnvMinPollIntervalMSecs), "0"),
+		EnvPollLoadThreshold:      defaulting(os.Getenv(EnvPollLoadThreshold), "0"),
+		EnvAuthCacheTTLSecs:       defaulting(os.Getenv(EnvAuthCacheTTLSecs), "60"),
+		EnvMaxTrackedRooms:        defaulting(os.Getenv(EnvMaxTrackedRooms), "0"),
+		EnvPollTimelineLimit:      defaulting(os.Getenv(EnvPollTimelineLimit), "50"),
+		EnvEventRetentionHours:    defaulting(os.Getenv(EnvEventRetentionHours), "0"),
+		EnvMaxEventsPerRoom:       defaulting(os.Getenv(EnvMaxEventsPerRoom), "0"),
+		EnvMaxEventSize:           defaulting(os.Getenv(EnvMaxEventSize), "65536"),
+		EnvMaxExtensionBytes:      defaulting(os.Getenv(EnvMaxExtensionBytes), ""),
+		EnvAdminToken:             os.Getenv(EnvAdminToken),
+		EnvLargeRoomThreshold:     defaulting(os.Getenv(EnvLargeRoomThreshold), "10000"),
+		EnvCountThrottleMSecs:     defaulting(os.Getenv(EnvCountThrottleMSecs), "0"),
+		EnvCountThrottleMinRooms:  defaulting(os.Getenv(EnvCountThrottleMinRooms), "1000"),
+		EnvMaxBufferedResponses:   defaulting(os.Getenv(EnvMaxBufferedResponses), "0"),
+		EnvMaxBufferedBytes:       defaulting(os.Getenv(EnvMaxBufferedBytes), "0"),
+		EnvMaxBufferedAgeSecs:     defaulting(os.Getenv(EnvMaxBufferedAgeSecs), "0"),
+		EnvFeatureGates:           os.Getenv(EnvFeatureGates),
+		EnvMaxConnSetupRate:       defaulting(os.Getenv(EnvMaxConnSetupRate), "0"),
+		EnvConnSetupMaxWaitMSecs:  defaulting(os.Getenv(EnvConnSetupMaxWaitMSecs), "1000"),
+		EnvMaxConnRequestRate:     defaulting(os.Getenv(EnvMaxConnRequestRate), "0"),
+		EnvConnRequestBurst:       defaulting(os.Getenv(EnvConnRequestBurst), "10"),
+		EnvUserConnSetupRate:      defaulting(os.Getenv(EnvUserConnSetupRate), "0"),
+		EnvUserConnSetupBurst:     defaulting(os.Getenv(EnvUserConnSetupBurst), "10"),
+		EnvDeviceConnSetupRate:    defaulting(os.Getenv(EnvDeviceConnSetupRate), "0"),
+		EnvDeviceConnSetupBurst:   defaulting(os.Getenv(EnvDeviceConnSetupBurst), "3"),
+		EnvMaxInitialSyncs:        defaulting(os.Getenv(EnvMaxInitialSyncs), "0"),
+		EnvInitialSyncMaxWaitMS:   defaulting(os.Getenv(EnvInitialSyncMaxWaitMS), "10000"),
+		EnvCompressBuffered:       defaulting(os.Getenv(EnvCompressBuffered), "false"),
+		EnvMinTimeoutMSecs:        defaulting(os.Getenv(EnvMinTimeoutMSecs), "0"),
+		EnvMaxTimeoutMSecs:        defaulting(os.Getenv(EnvMaxTimeoutMSecs), "0"),
+		EnvDefaultTimeoutMSecs:    defaulting(os.Getenv(EnvDefaultTimeoutMSecs), "0"),
+		EnvPersistConns:           defaulting(os.Getenv(EnvPersistConns), "false"),
+		EnvPresence:               defaulting(os.Getenv(EnvPresence), "false"),
+		EnvConnIdleTimeoutSecs:    defaulting(os.Getenv(EnvConnIdleTimeoutSecs), "1800"),
+		EnvConnMaxLifetimeSecs:    defaulting(os.Getenv(EnvConnMaxLifetimeSecs), "0"),
+		EnvDrainTimeoutSecs:       defaulting(os.Getenv(EnvDrainTimeoutSecs), "5"),
+		EnvCompressResponses:      defaulting(os.Getenv(EnvCompressResponses), "true"),
+		EnvToDeviceRetentionHours: defaulting(os.Getenv(EnvToDeviceRetentionHours), "0"),
+		EnvMaxToDeviceMessages:    defaulting(os.Getenv(EnvMaxToDeviceMessages), "0"),
+		EnvBackfill:               defaulting(os.Getenv(EnvBackfill), "false"),
+		EnvBackfillRetentionHours: defaulting(os.Getenv(EnvBackfillRetentionHours), "24"),
+		EnvOIDCIntrospectionURL:   os.Getenv(EnvOIDCIntrospectionURL),
+		EnvOIDCClientID:           os.Getenv(EnvOIDCClientID),
+		EnvOIDCClientSecret:       os.Getenv(EnvOIDCClientSecret),
+		EnvOIDCServerName:         os.Getenv(EnvOIDCServerName),
+		EnvHomeservers:            os.Getenv(EnvHomeservers),
+		EnvAppserviceHSToken:      os.Getenv(EnvAppserviceHSToken),
+		EnvAppserviceUsers:        os.Getenv(EnvAppserviceUsers),
+		EnvWarmUpWorkers:          defaulting(os.Getenv(EnvWarmUpWorkers), "0"),
+		EnvRoomRetention:          os.Getenv(EnvRoomRetention),
+		EnvDBReplica:              os.Getenv(EnvDBReplica),
+		EnvConnDebugResponses:     defaulting(os.Getenv(EnvConnDebugResponses), "0"),
 	}
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		executeCompaction(args)
+		return
+	}
+
 	requiredEnvVars := []string{EnvServer, EnvDB, EnvSecret, EnvBindAddr}
+	if args[EnvHomeservers] != "" {
+		requiredEnvVars = requiredEnvVars[1:]
+	}
 	for _, requiredEnvVar := range requiredEnvVars {
 		if args[requiredEnvVar] == "" {
 			fmt.Print(helpMsg)
@@ -131,6 +314,16 @@ func main() {
 		fmt.Printf("\nboth %s and %s must be set together\n", EnvTLSCert, EnvTLSKey)
 		os.Exit(1)
 	}
+	if args[EnvOIDCIntrospectionURL] != "" && (args[EnvOIDCClientID] == "" || args[EnvOIDCServerName] == "") {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s and %s must be set along with %s\n", EnvOIDCClientID, EnvOIDCServerName, EnvOIDCIntrospectionURL)
+		os.Exit(1)
+	}
+	if (args[EnvAppserviceHSToken] != "" || args[EnvAppserviceUsers] != "") && (args[EnvAppserviceHSToken] == "" || args[EnvAppserviceUsers] == "") {
+		fmt.Print(helpMsg)
+		fmt.Printf("\nboth %s and %s must be set together\n", EnvAppserviceHSToken, EnvAppserviceUsers)
+		os.Exit(1)
+	}
 	// pprof
 	if args[EnvPPROF] != "" {
 		go func() {
@@ -210,15 +403,252 @@ func main() {
 	if err != nil {
 		panic("invalid value for " + EnvHTTPInitialTimeoutSecs + ": " + args[EnvHTTPInitialTimeoutSecs])
 	}
+	minPollIntervalMSecs, err := strconv.Atoi(args[EnvMinPollIntervalMSecs])
+	if err != nil {
+		panic("invalid value for " + EnvMinPollIntervalMSecs + ": " + args[EnvMinPollIntervalMSecs])
+	}
+	pollLoadThreshold, err := strconv.Atoi(args[EnvPollLoadThreshold])
+	if err != nil {
+		panic("invalid value for " + EnvPollLoadThreshold + ": " + args[EnvPollLoadThreshold])
+	}
+	authCacheTTLSecs, err := strconv.Atoi(args[EnvAuthCacheTTLSecs])
+	if err != nil {
+		panic("invalid value for " + EnvAuthCacheTTLSecs + ": " + args[EnvAuthCacheTTLSecs])
+	}
+	maxTrackedRooms, err := strconv.Atoi(args[EnvMaxTrackedRooms])
+	if err != nil {
+		panic("invalid value for " + EnvMaxTrackedRooms + ": " + args[EnvMaxTrackedRooms])
+	}
+	pollTimelineLimit, err := strconv.Atoi(args[EnvPollTimelineLimit])
+	if err != nil || pollTimelineLimit <= 0 {
+		panic("invalid value for " + EnvPollTimelineLimit + ": " + args[EnvPollTimelineLimit])
+	}
+	retention := parseRetention(args)
+	backfill, err := strconv.ParseBool(args[EnvBackfill])
+	if err != nil {
+		panic("invalid value for " + EnvBackfill + ": " + args[EnvBackfill])
+	}
+	maxEventSize, err := strconv.Atoi(args[EnvMaxEventSize])
+	if err != nil || maxEventSize < 0 {
+		panic("invalid value for " + EnvMaxEventSize + ": " + args[EnvMaxEventSize])
+	}
+	if maxEventSize == 0 {
+		maxEventSize = -1 // no limit
+	}
+	largeRoomThreshold, err := strconv.Atoi(args[EnvLargeRoomThreshold])
+	if err != nil || largeRoomThreshold < 0 {
+		panic("invalid value for " + EnvLargeRoomThreshold + ": " + args[EnvLargeRoomThreshold])
+	}
+	if largeRoomThreshold == 0 {
+		largeRoomThreshold = -1 // rooms are never large
+	}
+	countThrottleMSecs, err := strconv.Atoi(args[EnvCountThrottleMSecs])
+	if err != nil || countThrottleMSecs < 0 {
+		panic("invalid value for " + EnvCountThrottleMSecs + ": " + args[EnvCountThrottleMSecs])
+	}
+	countThrottleMinRooms, err := strconv.Atoi(args[EnvCountThrottleMinRooms])
+	if err != nil || countThrottleMinRooms < 0 {
+		panic("invalid value for " + EnvCountThrottleMinRooms + ": " + args[EnvCountThrottleMinRooms])
+	}
+	maxBufferedResponses, err := strconv.Atoi(args[EnvMaxBufferedResponses])
+	if err != nil || maxBufferedResponses < 0 {
+		panic("invalid value for " + EnvMaxBufferedResponses + ": " + args[EnvMaxBufferedResponses])
+	}
+	maxBufferedBytes, err := strconv.Atoi(args[EnvMaxBufferedBytes])
+	if err != nil || maxBufferedBytes < 0 {
+		panic("invalid value for " + EnvMaxBufferedBytes + ": " + args[EnvMaxBufferedBytes])
+	}
+	maxBufferedAgeSecs, err := strconv.Atoi(args[EnvMaxBufferedAgeSecs])
+	if err != nil || maxBufferedAgeSecs < 0 {
+		panic("invalid value for " + EnvMaxBufferedAgeSecs + ": " + args[EnvMaxBufferedAgeSecs])
+	}
+	extensionSizeLimits, err := extensions.ParseSizeLimits(args[EnvMaxExtensionBytes])
+	if err != nil {
+		panic("invalid value for " + EnvMaxExtensionBytes + ": " + args[EnvMaxExtensionBytes])
+	}
+	maxConnSetupRate, err := strconv.ParseFloat(args[EnvMaxConnSetupRate], 64)
+	if err != nil || maxConnSetupRate < 0 {
+		panic("invalid value for " + EnvMaxConnSetupRate + ": " + args[EnvMaxConnSetupRate])
+	}
+	connSetupMaxWaitMSecs, err := strconv.Atoi(args[EnvConnSetupMaxWaitMSecs])
+	if err != nil || connSetupMaxWaitMSecs < 0 {
+		panic("invalid value for " + EnvConnSetupMaxWaitMSecs + ": " + args[EnvConnSetupMaxWaitMSecs])
+	}
+	maxConnRequestRate, err := strconv.ParseFloat(args[EnvMaxConnRequestRate], 64)
+	if err != nil || maxConnRequestRate < 0 {
+		panic("invalid value for " + EnvMaxConnRequestRate + ": " + args[EnvMaxConnRequestRate])
+	}
+	connRequestBurst, err := strconv.Atoi(args[EnvConnRequestBurst])
+	if err != nil || connRequestBurst < 0 {
+		panic("invalid value for " + EnvConnRequestBurst + ": " + args[EnvConnRequestBurst])
+	}
+	userConnSetupRate, err := strconv.ParseFloat(args[EnvUserConnSetupRate], 64)
+	if err != nil || userConnSetupRate < 0 {
+		panic("invalid value for " + EnvUserConnSetupRate + ": " + args[EnvUserConnSetupRate])
+	}
+	userConnSetupBurst, err := strconv.Atoi(args[EnvUserConnSetupBurst])
+	if err != nil || userConnSetupBurst < 0 {
+		panic("invalid value for " + EnvUserConnSetupBurst + ": " + args[EnvUserConnSetupBurst])
+	}
+	deviceConnSetupRate, err := strconv.ParseFloat(args[EnvDeviceConnSetupRate], 64)
+	if err != nil || deviceConnSetupRate < 0 {
+		panic("invalid value for " + EnvDeviceConnSetupRate + ": " + args[EnvDeviceConnSetupRate])
+	}
+	deviceConnSetupBurst, err := strconv.Atoi(args[EnvDeviceConnSetupBurst])
+	if err != nil || deviceConnSetupBurst < 0 {
+		panic("invalid value for " + EnvDeviceConnSetupBurst + ": " + args[EnvDeviceConnSetupBurst])
+	}
+	maxInitialSyncs, err := strconv.Atoi(args[EnvMaxInitialSyncs])
+	if err != nil || maxInitialSyncs < 0 {
+		panic("invalid value for " + EnvMaxInitialSyncs + ": " + args[EnvMaxInitialSyncs])
+	}
+	warmUpWorkers, err := strconv.Atoi(args[EnvWarmUpWorkers])
+	if err != nil || warmUpWorkers < 0 {
+		panic("invalid value for " + EnvWarmUpWorkers + ": " + args[EnvWarmUpWorkers])
+	}
+	connDebugResponses, err := strconv.Atoi(args[EnvConnDebugResponses])
+	if err != nil || connDebugResponses < 0 {
+		panic("invalid value for " + EnvConnDebugResponses + ": " + args[EnvConnDebugResponses])
+	}
+	initialSyncMaxWaitMSecs, err := strconv.Atoi(args[EnvInitialSyncMaxWaitMS])
+	if err != nil || initialSyncMaxWaitMSecs < 0 {
+		panic("invalid value for " + EnvInitialSyncMaxWaitMS + ": " + args[EnvInitialSyncMaxWaitMS])
+	}
+	compressBuffered, err := strconv.ParseBool(args[EnvCompressBuffered])
+	if err != nil {
+		panic("invalid value for " + EnvCompressBuffered + ": " + args[EnvCompressBuffered])
+	}
+	minTimeoutMSecs, err := strconv.Atoi(args[EnvMinTimeoutMSecs])
+	if err != nil || minTimeoutMSecs < 0 {
+		panic("invalid value for " + EnvMinTimeoutMSecs + ": " + args[EnvMinTimeoutMSecs])
+	}
+	maxTimeoutMSecs, err := strconv.Atoi(args[EnvMaxTimeoutMSecs])
+	if err != nil || maxTimeoutMSecs < 0 || (maxTimeoutMSecs > 0 && maxTimeoutMSecs < minTimeoutMSecs) {
+		panic("invalid value for " + EnvMaxTimeoutMSecs + ": " + args[EnvMaxTimeoutMSecs])
+	}
+	defaultTimeoutMSecs, err := strconv.Atoi(args[EnvDefaultTimeoutMSecs])
+	if err != nil || defaultTimeoutMSecs < 0 {
+		panic("invalid value for " + EnvDefaultTimeoutMSecs + ": " + args[EnvDefaultTimeoutMSecs])
+	}
+	persistConns, err := strconv.ParseBool(args[EnvPersistConns])
+	if err != nil {
+		panic("invalid value for " + EnvPersistConns + ": " + args[EnvPersistConns])
+	}
+	presence, err := strconv.ParseBool(args[EnvPresence])
+	if err != nil {
+		panic("invalid value for " + EnvPresence + ": " + args[EnvPresence])
+	}
+	connIdleTimeoutSecs, err := strconv.Atoi(args[EnvConnIdleTimeoutSecs])
+	if err != nil || connIdleTimeoutSecs <= 0 {
+		panic("invalid value for " + EnvConnIdleTimeoutSecs + ": " + args[EnvConnIdleTimeoutSecs])
+	}
+	connMaxLifetimeSecs, err := strconv.Atoi(args[EnvConnMaxLifetimeSecs])
+	if err != nil || connMaxLifetimeSecs < 0 {
+		panic("invalid value for " + EnvConnMaxLifetimeSecs + ": " + args[EnvConnMaxLifetimeSecs])
+	}
+	compressResponses, err := strconv.ParseBool(args[EnvCompressResponses])
+	if err != nil {
+		panic("invalid value for " + EnvCompressResponses + ": " + args[EnvCompressResponses])
+	}
+	drainTimeoutSecs, err := strconv.Atoi(args[EnvDrainTimeoutSecs])
+	if err != nil || drainTimeoutSecs < 0 {
+		panic("invalid value for " + EnvDrainTimeoutSecs + ": " + args[EnvDrainTimeoutSecs])
+	}
+	featureGates, err := sync3.ParseFeatureGates(args[EnvFeatureGates])
+	if err != nil {
+		panic("invalid value for " + EnvFeatureGates + ": " + args[EnvFeatureGates])
+	}
+	homeservers, err := sync2.ParseHomeservers(args[EnvHomeservers])
+	if err != nil {
+		panic("invalid value for " + EnvHomeservers + ": " + args[EnvHomeservers])
+	}
+	var appservice *handler2.Appservice
+	if args[EnvAppserviceHSToken] != "" {
+		appservice, err = handler2.NewAppservice(args[EnvAppserviceHSToken], args[EnvAppserviceUsers])
+		if err != nil {
+			panic("invalid value for " + EnvAppserviceUsers + ": " + args[EnvAppserviceUsers])
+		}
+	}
+	var authenticator handler.Authenticator
+	if args[EnvOIDCIntrospectionURL] != "" {
+		authenticator = &handler.IntrospectionAuthenticator{
+			Client:       &http.Client{Timeout: time.Duration(httpTimeoutSecs) * time.Second},
+			URL:          args[EnvOIDCIntrospectionURL],
+			ClientID:     args[EnvOIDCClientID],
+			ClientSecret: args[EnvOIDCClientSecret],
+			ServerName:   args[EnvOIDCServerName],
+		}
+	}
 	h2, h3 := syncv3.Setup(args[EnvServer], args[EnvDB], args[EnvSecret], syncv3.Opts{
-		AddPrometheusMetrics:  args[EnvPrometheus] != "",
-		DBMaxConns:            maxConnsInt,
-		DBConnMaxIdleTime:     time.Duration(idleTimeSecs) * time.Second,
-		MaxTransactionIDDelay: time.Second,
-		HTTPTimeout:           time.Duration(httpTimeoutSecs) * time.Second,
-		HTTPLongTimeout:       time.Duration(httpLongTimeoutSecs) * time.Second,
+		AddPrometheusMetrics:        args[EnvPrometheus] != "",
+		DBMaxConns:                  maxConnsInt,
+		DBReadReplicaURI:            args[EnvDBReplica],
+		DBConnMaxIdleTime:           time.Duration(idleTimeSecs) * time.Second,
+		MaxTransactionIDDelay:       time.Second,
+		MaxCoalesceWindow:           time.Second,
+		HTTPTimeout:                 time.Duration(httpTimeoutSecs) * time.Second,
+		HTTPLongTimeout:             time.Duration(httpLongTimeoutSecs) * time.Second,
+		MinPollInterval:             time.Duration(minPollIntervalMSecs) * time.Millisecond,
+		PollLoadThreshold:           pollLoadThreshold,
+		Homeservers:                 homeservers,
+		Appservice:                  appservice,
+		Authenticator:               authenticator,
+		AuthCacheTTL:                time.Duration(authCacheTTLSecs) * time.Second,
+		MaxTrackedRooms:             maxTrackedRooms,
+		PollTimelineLimit:           pollTimelineLimit,
+		Presence:                    presence,
+		EventRetention:              retention.eventRetention,
+		MaxEventsPerRoom:            retention.maxEventsPerRoom,
+		RoomRetention:               retention.roomRetention,
+		ToDeviceRetention:           retention.toDeviceRetention,
+		MaxToDeviceMessages:         retention.maxToDeviceMessages,
+		Backfill:                    backfill,
+		BackfillRetention:           retention.backfillRetention,
+		MaxEventSize:                maxEventSize,
+		ExtensionSizeLimits:         extensionSizeLimits,
+		LargeRoomThreshold:          largeRoomThreshold,
+		CountUpdateThrottle:         time.Duration(countThrottleMSecs) * time.Millisecond,
+		CountUpdateThrottleMinRooms: countThrottleMinRooms,
+		ConnBufferLimits: sync3.BufferLimits{
+			MaxResponses: maxBufferedResponses,
+			MaxBytes:     maxBufferedBytes,
+			MaxAge:       time.Duration(maxBufferedAgeSecs) * time.Second,
+		},
+		FeatureGates:     featureGates,
+		ConnSetupRate:    maxConnSetupRate,
+		ConnSetupMaxWait: time.Duration(connSetupMaxWaitMSecs) * time.Millisecond,
+		ConnRateLimit: sync3.RateLimit{
+			Rate:           maxConnRequestRate,
+			Burst:          connRequestBurst,
+			ExemptBuffered: true,
+		},
+		UserConnSetupRateLimit: sync3.RateLimit{
+			Rate:  userConnSetupRate,
+			Burst: userConnSetupBurst,
+		},
+		DeviceConnSetupRateLimit: sync3.RateLimit{
+			Rate:  deviceConnSetupRate,
+			Burst: deviceConnSetupBurst,
+		},
+		MaxConcurrentInitialSyncs: maxInitialSyncs,
+		InitialSyncMaxWait:        time.Duration(initialSyncMaxWaitMSecs) * time.Millisecond,
+		WarmUpWorkers:             warmUpWorkers,
+		ConnDebugResponses:        connDebugResponses,
+		CompressBufferedResponses: compressBuffered,
+		CompressResponses:         compressResponses,
+		ConnTimeoutLimits: sync3.TimeoutLimits{
+			Min:     time.Duration(minTimeoutMSecs) * time.Millisecond,
+			Max:     time.Duration(maxTimeoutMSecs) * time.Millisecond,
+			Default: time.Duration(defaultTimeoutMSecs) * time.Millisecond,
+		},
+		PersistConnPositions: persistConns,
+		ConnExpiry: sync3.ExpiryPolicy{
+			IdleTimeout: time.Duration(connIdleTimeoutSecs) * time.Second,
+			MaxLifetime: time.Duration(connMaxLifetimeSecs) * time.Second,
+		},
 	})
 
+	syncHandler := h3.(*handler.SyncLiveHandler)
 	go h2.StartV2Pollers()
 	go h2.Store.Cleaner(time.Hour)
 	if args[EnvOTLP] != "" {
@@ -233,13 +663,23 @@ func main() {
 		h3 = sentryHandler.Handle(h3)
 	}
 
-	syncv3.RunSyncV3Server(h3, args[EnvBindAddr], args[EnvServer], args[EnvTLSCert], args[EnvTLSKey])
-	WaitForShutdown(args[EnvSentryDsn] != "")
+	var admin http.Handler
+	if args[EnvAdminToken] != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle(handler2.AdminPollerPath, h2.AdminHandler(args[EnvAdminToken]))
+		adminMux.Handle(handler.AdminConnsPath, syncHandler.AdminHandler(args[EnvAdminToken]))
+		admin = adminMux
+	}
+
+	httpServer := syncv3.RunSyncV3Server(h3, admin, h2.AppserviceHandler(), args[EnvBindAddr], args[EnvServer], args[EnvTLSCert], args[EnvTLSKey])
+	WaitForShutdown(args[EnvSentryDsn] != "", httpServer, h2, syncHandler, time.Duration(drainTimeoutSecs)*time.Second)
 }
 
 // WaitForShutdown blocks until the process receives a SIGINT or SIGTERM signal
-// (see `man 7 signal`). It performs any last cleanup tasks and then exits.
-func WaitForShutdown(sentryInUse bool) {
+// (see `man 7 signal`). It stops accepting requests, waits for up to drainTimeout for requests in
+// flight to finish before cancelling them, then stops the pollers once they have stored what they
+// have received, again waiting for up to drainTimeout.
+func WaitForShutdown(sentryInUse bool, httpServer *http.Server, h2 *handler2.Handler, syncHandler *handler.SyncLiveHandler, drainTimeout time.Duration) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	select {
@@ -249,6 +689,30 @@ func WaitForShutdown(sentryInUse bool) {
 
 	fmt.Printf("Shutdown signal received...")
 
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	// answer long-polling clients so they don't see their connections reset, whilst no longer
+	// accepting new requests
+	connsShutdown := make(chan error, 1)
+	go func() {
+		connsShutdown <- syncHandler.Shutdown(ctx)
+	}()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		fmt.Printf("Failed to finish all requests, cancelling them: %s", err)
+		httpServer.Close()
+	}
+	if err := <-connsShutdown; err != nil {
+		fmt.Printf("Failed to shut down all connections: %s", err)
+	}
+	cancel()
+
+	// the pollers go last, as requests which started new connections were waiting for them
+	fmt.Printf("Stopping pollers...")
+	ctx, cancel = context.WithTimeout(context.Background(), drainTimeout)
+	if err := h2.Shutdown(ctx); err != nil {
+		fmt.Printf("Failed to stop all pollers: %s", err)
+	}
+	cancel()
+
 	if sentryInUse {
 		fmt.Printf("Flushing sentry events...")
 		if !sentry.Flush(time.Second * 5) {
@@ -305,6 +769,74 @@ func executeMigrations() {
 	}
 }
 
+// retention is how long the proxy keeps data for before it is purged.
+type retention struct {
+	eventRetention      time.Duration
+	maxEventsPerRoom    int
+	roomRetention       map[string]state.RetentionPolicy
+	toDeviceRetention   time.Duration
+	maxToDeviceMessages int
+	backfillRetention   time.Duration
+}
+
+func parseRetention(args map[string]string) retention {
+	eventRetentionHours, err := strconv.Atoi(args[EnvEventRetentionHours])
+	if err != nil || eventRetentionHours < 0 {
+		panic("invalid value for " + EnvEventRetentionHours + ": " + args[EnvEventRetentionHours])
+	}
+	maxEventsPerRoom, err := strconv.Atoi(args[EnvMaxEventsPerRoom])
+	if err != nil || maxEventsPerRoom < 0 {
+		panic("invalid value for " + EnvMaxEventsPerRoom + ": " + args[EnvMaxEventsPerRoom])
+	}
+	roomRetention, err := state.ParseRoomRetention(args[EnvRoomRetention])
+	if err != nil {
+		panic("invalid value for " + EnvRoomRetention + ": " + err.Error())
+	}
+	toDeviceRetentionHours, err := strconv.Atoi(args[EnvToDeviceRetentionHours])
+	if err != nil || toDeviceRetentionHours < 0 {
+		panic("invalid value for " + EnvToDeviceRetentionHours + ": " + args[EnvToDeviceRetentionHours])
+	}
+	maxToDeviceMessages, err := strconv.Atoi(args[EnvMaxToDeviceMessages])
+	if err != nil || maxToDeviceMessages < 0 {
+		panic("invalid value for " + EnvMaxToDeviceMessages + ": " + args[EnvMaxToDeviceMessages])
+	}
+	backfillRetentionHours, err := strconv.Atoi(args[EnvBackfillRetentionHours])
+	if err != nil || backfillRetentionHours < 0 {
+		panic("invalid value for " + EnvBackfillRetentionHours + ": " + args[EnvBackfillRetentionHours])
+	}
+	return retention{
+		eventRetention:      time.Duration(eventRetentionHours) * time.Hour,
+		maxEventsPerRoom:    maxEventsPerRoom,
+		roomRetention:       roomRetention,
+		toDeviceRetention:   time.Duration(toDeviceRetentionHours) * time.Hour,
+		maxToDeviceMessages: maxToDeviceMessages,
+		backfillRetention:   time.Duration(backfillRetentionHours) * time.Hour,
+	}
+}
+
+// executeCompaction runs the retention jobs which the proxy runs hourly once, then exits. The
+// database must have been set up by the proxy.
+func executeCompaction(args map[string]string) {
+	if args[EnvDB] == "" {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s is not set\n", EnvDB)
+		os.Exit(1)
+	}
+	retention := parseRetention(args)
+	store := state.NewStorage(args[EnvDB])
+	defer store.Teardown()
+	store.EventRetention = retention.eventRetention
+	store.MaxEventsPerRoom = retention.maxEventsPerRoom
+	store.RoomRetention = retention.roomRetention
+	store.ToDeviceRetention = retention.toDeviceRetention
+	store.MaxToDeviceMessages = retention.maxToDeviceMessages
+	store.BackfillRetention = retention.backfillRetention
+	if err := store.Compact(time.Now()); err != nil {
+		log.Fatalf("compact: %v", err)
+	}
+	fmt.Println("compact: done")
+}
+
 const gitRevLen = 7 // 7 matches the displayed characters on github.com
 func init() {
 	// Try to get the revision sliding-sync was build from.
@@ -13,7 +13,8 @@ import (
 type ctx string
 
 var (
-	ctxData ctx = "syncv3_data"
+	ctxData             ctx = "syncv3_data"
+	ctxCancellableLoads ctx = "syncv3_cancellable_loads"
 )
 
 // logging metadata for a single request
@@ -35,6 +36,7 @@ type data struct {
 	numLists             int
 	roomSubs             int
 	roomUnsubs           int
+	servedFrom           string
 }
 
 // prepare a request context so it can contain syncv3 info
@@ -100,6 +102,28 @@ func SetRequestContextResponseInfo(
 	da.roomUnsubs = roomUnsubs
 }
 
+// SetRequestContextServedFrom records how the response to this request was served, e.g from a
+// buffer or freshly calculated.
+func SetRequestContextServedFrom(ctx context.Context, servedFrom string) {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return
+	}
+	da := d.(*data)
+	da.servedFrom = servedFrom
+}
+
+// RequestContextServedFrom returns how the response to this request was served, or "" if there
+// was no response.
+func RequestContextServedFrom(ctx context.Context) string {
+	d := ctx.Value(ctxData)
+	if d == nil {
+		return ""
+	}
+	da := d.(*data)
+	return da.servedFrom
+}
+
 func DecorateLogger(ctx context.Context, l *zerolog.Event) *zerolog.Event {
 	d := ctx.Value(ctxData)
 	if d == nil {
@@ -148,6 +172,9 @@ func DecorateLogger(ctx context.Context, l *zerolog.Event) *zerolog.Event {
 	if da.numLists > 0 {
 		l = l.Int("l", da.numLists)
 	}
+	if da.servedFrom != "" {
+		l = l.Str("from", da.servedFrom)
+	}
 	// always log the connection ID so we know when it isn't set
 	l = l.Str("c", da.connID)
 	return l
@@ -179,3 +206,29 @@ func RequestContextDurations(ctx context.Context) (setup time.Duration, processi
 	da := d.(*data)
 	return da.setupTime, da.processingTime
 }
+
+// WithCancellableLoads marks ctx so that database loads made with LoadContext are cancelled with
+// it. Only use this if nothing loaded is kept when ctx is cancelled part way through, as the
+// loads return no data.
+func WithCancellableLoads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxCancellableLoads, true)
+}
+
+// LoadContext returns the context to load data from the database with for a request with this
+// context. Loads are only cancelled with ctx if it was marked with WithCancellableLoads: otherwise
+// they carry on, so that the request still has all its data when it finishes.
+func LoadContext(ctx context.Context) context.Context {
+	if cancellable, _ := ctx.Value(ctxCancellableLoads).(bool); cancellable {
+		return ctx
+	}
+	return uncancellableContext{ctx}
+}
+
+// uncancellableContext has the values of the context it wraps, but is never done.
+type uncancellableContext struct {
+	context.Context
+}
+
+func (uncancellableContext) Deadline() (deadline time.Time, ok bool) { return }
+func (uncancellableContext) Done() <-chan struct{}                   { return nil }
+func (uncancellableContext) Err() error                              { return nil }
@@ -48,6 +48,19 @@ func (dl DeviceLists) Combine(newer DeviceLists) DeviceLists {
 	}
 }
 
+// SentAndNew returns the changes in Sent and New, with New taking precedence. These are the changes
+// a client may not have if it did not receive the last response which had device lists.
+func (dl DeviceLists) SentAndNew() MapStringInt {
+	m := make(MapStringInt, len(dl.Sent)+len(dl.New))
+	for k, v := range dl.Sent {
+		m[k] = v
+	}
+	for k, v := range dl.New {
+		m[k] = v
+	}
+	return m
+}
+
 func ToDeviceListChangesMap(changed, left []string) map[string]int {
 	if len(changed) == 0 && len(left) == 0 {
 		return nil
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 
@@ -20,7 +21,18 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 type HandlerError struct {
 	StatusCode int
 	Err        error
-	ErrCode    string
+	// The Matrix errcode to return to the client, which clients use to decide how to recover. If
+	// unset, M_UNKNOWN is returned.
+	ErrCode string
+	// If set, how long the client should wait before retrying, returned as `retry_after_ms` and
+	// the Retry-After header.
+	RetryAfter time.Duration
+	// If set when returned while handling a request, the connection is torn down and every later
+	// request on it gets this error.
+	TeardownConn bool
+	// Set with M_UNKNOWN_TOKEN when the access token expired but the device was not logged out, so
+	// the client should refresh its token rather than discard its data. Returned as `soft_logout`.
+	SoftLogout bool
 }
 
 func (e *HandlerError) Error() string {
@@ -32,19 +44,30 @@ func (e *HandlerError) Unwrap() error {
 }
 
 type jsonError struct {
-	Err  string `json:"error"`
-	Code string `json:"errcode,omitempty"`
+	Err          string `json:"error"`
+	Code         string `json:"errcode"`
+	RetryAfterMS int64  `json:"retry_after_ms,omitempty"`
+	SoftLogout   bool   `json:"soft_logout,omitempty"`
 }
 
+// JSON returns the error as a Matrix error response body e.g {"errcode":"M_UNKNOWN","error":"..."}.
 func (e HandlerError) JSON() []byte {
 	je := jsonError{
-		Err:  e.Error(),
-		Code: e.ErrCode,
+		Err:          e.Error(),
+		Code:         e.ErrCode,
+		RetryAfterMS: e.RetryAfter.Milliseconds(),
+		SoftLogout:   e.SoftLogout,
+	}
+	if je.Code == "" {
+		je.Code = "M_UNKNOWN"
 	}
 	b, _ := json.Marshal(je)
 	return b
 }
 
+// ExpiredSessionError is returned when the client's position is unknown, e.g because the
+// connection expired or the position was made up. Clients must discard their position and start a
+// new connection without one.
 func ExpiredSessionError() *HandlerError {
 	return &HandlerError{
 		StatusCode: 400,
@@ -53,6 +76,34 @@ func ExpiredSessionError() *HandlerError {
 	}
 }
 
+// StatusClientClosedRequest is the status of requests which the client gave up on before they
+// finished. It is nonstandard, but a) the client has gone, so it only shows up in our logs and b)
+// nginx uses 499 to mean "Client Closed Request", see e.g
+// https://www.nginx.com/resources/wiki/extending/api/http/#http-return-codes
+const StatusClientClosedRequest = 499
+
+// ClientCancelledError is returned when the client cancelled the request, e.g it disconnected
+// whilst long-polling or made a newer request on the connection. This is normal, so it is not
+// logged as an error.
+func ClientCancelledError(err error) *HandlerError {
+	return &HandlerError{
+		StatusCode: StatusClientClosedRequest,
+		Err:        err,
+	}
+}
+
+// ConnTornDownError is returned when a connection is no longer valid mid-request, e.g because the
+// device was logged out whilst long-polling. It tears down the connection, so the client keeps
+// getting this error rather than M_UNKNOWN_POS on that connection.
+func ConnTornDownError(err error) *HandlerError {
+	return &HandlerError{
+		StatusCode:   401,
+		Err:          err,
+		ErrCode:      "M_UNKNOWN_TOKEN",
+		TeardownConn: true,
+	}
+}
+
 // Assert that the expression is true, similar to assert() in C. If expr is false, print or panic.
 //
 // If expr is false and SYNCV3_DEBUG=1 then the program panics.
@@ -1,8 +1,10 @@
 package internal
 
 import (
+	"fmt"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestAssertion(t *testing.T) {
@@ -44,3 +46,54 @@ func try(t *testing.T, shouldPanic bool, fn func()) {
 	}()
 	fn()
 }
+
+func TestHandlerErrorJSON(t *testing.T) {
+	testCases := []struct {
+		herr     HandlerError
+		wantJSON string
+	}{
+		{
+			herr:     *ExpiredSessionError(),
+			wantJSON: `{"error":"HTTP 400 : session expired","errcode":"M_UNKNOWN_POS"}`,
+		},
+		{
+			herr: HandlerError{
+				StatusCode: 400,
+				Err:        fmt.Errorf("missing param"),
+				ErrCode:    "M_MISSING_PARAM",
+			},
+			wantJSON: `{"error":"HTTP 400 : missing param","errcode":"M_MISSING_PARAM"}`,
+		},
+		{
+			// errors without a code are still Matrix errors
+			herr: HandlerError{
+				StatusCode: 500,
+				Err:        fmt.Errorf("db down"),
+			},
+			wantJSON: `{"error":"HTTP 500 : db down","errcode":"M_UNKNOWN"}`,
+		},
+		{
+			herr: HandlerError{
+				StatusCode: 429,
+				Err:        fmt.Errorf("slow down"),
+				ErrCode:    "M_LIMIT_EXCEEDED",
+				RetryAfter: 1500 * time.Millisecond,
+			},
+			wantJSON: `{"error":"HTTP 429 : slow down","errcode":"M_LIMIT_EXCEEDED","retry_after_ms":1500}`,
+		},
+		{
+			herr: HandlerError{
+				StatusCode: 401,
+				Err:        fmt.Errorf("expired"),
+				ErrCode:    "M_UNKNOWN_TOKEN",
+				SoftLogout: true,
+			},
+			wantJSON: `{"error":"HTTP 401 : expired","errcode":"M_UNKNOWN_TOKEN","soft_logout":true}`,
+		},
+	}
+	for _, tc := range testCases {
+		if got := string(tc.herr.JSON()); got != tc.wantJSON {
+			t.Errorf("JSON(): got %s want %s", got, tc.wantJSON)
+		}
+	}
+}
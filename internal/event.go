@@ -1,6 +1,32 @@
 package internal
 
-import "github.com/tidwall/gjson"
+import (
+	"encoding/json"
+
+	"github.com/tidwall/gjson"
+)
+
+// DefaultMaxEventSize is the maximum size of an event in bytes, as per the federation PDU size limit.
+const DefaultMaxEventSize = 65536
+
+// SkippedEventType is the type of the placeholder event which replaces events the proxy cannot
+// serve. Placeholders are never state events, so skipping an event never changes room state.
+// The content of a placeholder is:
+//
+//	{
+//	  "reason": "too_large" | "malformed",
+//	  "original_type": "m.room.message", // if known
+//	  "size": 70000 // the size of the original event in bytes
+//	}
+//
+// Clients can show that an event was skipped, and fetch it from the homeserver if they need it.
+const SkippedEventType = "org.matrix.sliding_sync.skipped_event"
+
+// Reasons for skipping an event.
+const (
+	SkippedReasonTooLarge  = "too_large"
+	SkippedReasonMalformed = "malformed"
+)
 
 func IsMembershipChange(eventJSON gjson.Result) bool {
 	// membership event possibly, make sure the membership has changed else
@@ -17,3 +43,45 @@ func IsMembershipChange(eventJSON gjson.Result) bool {
 	}
 	return prevMembership != currMembership // membership was changed
 }
+
+// SkipReason returns why this event should be replaced with a placeholder, or the empty string if
+// the event is fine. Events are malformed if they are not valid JSON, or are not an object with
+// object content. If maxSize is more than 0, events larger than maxSize bytes are too large.
+func SkipReason(eventJSON []byte, maxSize int) string {
+	if !gjson.ValidBytes(eventJSON) {
+		return SkippedReasonMalformed
+	}
+	parsed := gjson.ParseBytes(eventJSON)
+	if !parsed.IsObject() || !parsed.Get("content").IsObject() {
+		return SkippedReasonMalformed
+	}
+	if maxSize > 0 && len(eventJSON) > maxSize {
+		return SkippedReasonTooLarge
+	}
+	return ""
+}
+
+// NewSkippedEvent returns a placeholder of type SkippedEventType for this event. The event ID,
+// sender and timestamp of the original event are kept if they can be found, so the placeholder
+// stays in the same place in the timeline.
+func NewSkippedEvent(eventJSON []byte, roomID, reason string) json.RawMessage {
+	// gjson is lenient, so will find fields in most malformed JSON
+	parsed := gjson.ParseBytes(eventJSON)
+	content := map[string]interface{}{
+		"reason": reason,
+		"size":   len(eventJSON),
+	}
+	if evType := parsed.Get("type"); evType.Type == gjson.String {
+		content["original_type"] = evType.Str
+	}
+	placeholder := map[string]interface{}{
+		"type":             SkippedEventType,
+		"event_id":         parsed.Get("event_id").Str,
+		"room_id":          roomID,
+		"sender":           parsed.Get("sender").Str,
+		"origin_server_ts": parsed.Get("origin_server_ts").Int(),
+		"content":          content,
+	}
+	placeholderJSON, _ := json.Marshal(placeholder) // cannot fail: all values are strings and numbers
+	return placeholderJSON
+}
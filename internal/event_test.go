@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestSkipReason(t *testing.T) {
+	large := `{"type":"m.room.message","content":{"body":"` + strings.Repeat("a", 100) + `"}}`
+	testCases := []struct {
+		name    string
+		event   string
+		maxSize int
+		want    string
+	}{
+		{name: "valid", event: `{"type":"m.room.message","content":{"body":"hi"}}`, maxSize: 100, want: ""},
+		{name: "invalid JSON", event: `{"type":"m.room.message","content":{"body":"hi"`, want: SkippedReasonMalformed},
+		{name: "not an object", event: `["m.room.message"]`, want: SkippedReasonMalformed},
+		{name: "content not an object", event: `{"type":"m.room.message","content":"hi"}`, want: SkippedReasonMalformed},
+		{name: "missing content", event: `{"type":"m.room.message"}`, want: SkippedReasonMalformed},
+		{name: "too large", event: large, maxSize: 100, want: SkippedReasonTooLarge},
+		{name: "no limit", event: large, maxSize: 0, want: ""},
+	}
+	for _, tc := range testCases {
+		if got := SkipReason([]byte(tc.event), tc.maxSize); got != tc.want {
+			t.Errorf("%s: got %q want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewSkippedEvent(t *testing.T) {
+	original := `{"type":"m.room.message","event_id":"$a","sender":"@alice:localhost","origin_server_ts":123,"state_key":"","content":{"body":"hi"`
+	placeholder := gjson.ParseBytes(NewSkippedEvent([]byte(original), "!room:localhost", SkippedReasonMalformed))
+	want := map[string]interface{}{
+		"type":                  SkippedEventType,
+		"event_id":              "$a",
+		"room_id":               "!room:localhost",
+		"sender":                "@alice:localhost",
+		"origin_server_ts":      int64(123),
+		"content.reason":        SkippedReasonMalformed,
+		"content.original_type": "m.room.message",
+		"content.size":          int64(len(original)),
+	}
+	for path, wantVal := range want {
+		var got interface{}
+		switch wantVal.(type) {
+		case int64:
+			got = placeholder.Get(path).Int()
+		default:
+			got = placeholder.Get(path).Str
+		}
+		if got != wantVal {
+			t.Errorf("%s: got %v want %v", path, got, wantVal)
+		}
+	}
+	// placeholders are never state events
+	if placeholder.Get("state_key").Exists() {
+		t.Errorf("placeholder has a state_key: %s", placeholder.Raw)
+	}
+	if SkipReason([]byte(placeholder.Raw), DefaultMaxEventSize) != "" {
+		t.Errorf("placeholder should not be skipped: %s", placeholder.Raw)
+	}
+}
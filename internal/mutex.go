@@ -0,0 +1,55 @@
+package internal
+
+import "context"
+
+// ContextMutex is a mutex which can give up waiting for the lock when a context is done, which
+// sync.Mutex cannot. Use NewContextMutex to make one.
+type ContextMutex struct {
+	// holds a value whilst locked
+	ch chan struct{}
+}
+
+func NewContextMutex() *ContextMutex {
+	return &ContextMutex{
+		ch: make(chan struct{}, 1),
+	}
+}
+
+// Lock blocks until the mutex is locked.
+func (m *ContextMutex) Lock() {
+	m.ch <- struct{}{}
+}
+
+// TryLock locks the mutex if it is not already locked, and reports whether it did.
+func (m *ContextMutex) TryLock() bool {
+	select {
+	case m.ch <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// LockContext blocks until the mutex is locked or ctx is done. Returns ctx.Err() if the mutex was
+// not locked.
+func (m *ContextMutex) LockContext(ctx context.Context) error {
+	if m.TryLock() {
+		return nil
+	}
+	select {
+	case m.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Unlock unlocks the mutex. Like sync.Mutex, it may be unlocked by a different goroutine to the
+// one which locked it. Panics if the mutex is not locked.
+func (m *ContextMutex) Unlock() {
+	select {
+	case <-m.ch:
+	default:
+		panic("internal.ContextMutex: unlock of unlocked mutex")
+	}
+}
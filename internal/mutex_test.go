@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestContextMutex(t *testing.T) {
+	m := NewContextMutex()
+	if !m.TryLock() {
+		t.Fatalf("TryLock failed on an unlocked mutex")
+	}
+	if m.TryLock() {
+		t.Fatalf("TryLock succeeded on a locked mutex")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.LockContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("LockContext on a locked mutex: got %v want %v", err, context.DeadlineExceeded)
+	}
+
+	// the mutex is handed over once unlocked
+	locked := make(chan error)
+	go func() {
+		locked <- m.LockContext(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	m.Unlock()
+	if err := <-locked; err != nil {
+		t.Fatalf("LockContext: %s", err)
+	}
+	m.Unlock()
+	m.Lock()
+	m.Unlock()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("unlocking an unlocked mutex did not panic")
+		}
+	}()
+	m.Unlock()
+}
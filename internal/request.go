@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"strings"
@@ -14,3 +15,17 @@ func ExtractAccessToken(req *http.Request) (accessToken string, err error) {
 	accessToken = strings.TrimPrefix(ah, "Bearer ")
 	return accessToken, nil
 }
+
+// CheckAdminToken returns an error unless the request's access token is adminToken. Always returns
+// an error if adminToken is empty.
+func CheckAdminToken(req *http.Request, adminToken string) *HandlerError {
+	accessToken, err := ExtractAccessToken(req)
+	if err != nil || adminToken == "" || subtle.ConstantTimeCompare([]byte(accessToken), []byte(adminToken)) != 1 {
+		return &HandlerError{
+			StatusCode: 401,
+			Err:        fmt.Errorf("missing or invalid admin token"),
+			ErrCode:    "M_UNKNOWN_TOKEN",
+		}
+	}
+	return nil
+}
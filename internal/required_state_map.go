@@ -8,6 +8,7 @@ type RequiredStateMap struct {
 	eventTypeToStateKeys            map[string][]string
 	allState                        bool
 	lazyLoading                     bool
+	excludeMembers                  bool
 }
 
 func NewRequiredStateMap(eventTypesWithWildcardStateKeys map[string]struct{},
@@ -28,6 +29,9 @@ func (rsm *RequiredStateMap) IsLazyLoading() bool {
 }
 
 func (rsm *RequiredStateMap) Include(evType, stateKey string) bool {
+	if rsm.excludeMembers && evType == "m.room.member" {
+		return false
+	}
 	if rsm.allState {
 		// "additional entries FILTER OUT the returned set of state events. These additional entries cannot use '*' themselves."
 		includedStateKeys := rsm.eventTypeToStateKeys[evType]
@@ -62,6 +66,50 @@ func (rsm *RequiredStateMap) Include(evType, stateKey string) bool {
 	return false
 }
 
+// WithoutMembers returns a copy of this map which never includes m.room.member events, for rooms
+// with too many members to load them all. The caller loads members separately: the members with
+// the returned state keys and, if lazyLoadMembers is true, the members which are lazy loaded.
+// Requests for every member are lazy loaded instead.
+func (rsm *RequiredStateMap) WithoutMembers() (withoutMembers *RequiredStateMap, memberStateKeys []string, lazyLoadMembers bool) {
+	withoutMembers = &RequiredStateMap{
+		eventTypesWithWildcardStateKeys: make(map[string]struct{}, len(rsm.eventTypesWithWildcardStateKeys)),
+		stateKeysForWildcardEventType:   rsm.stateKeysForWildcardEventType,
+		eventTypeToStateKeys:            make(map[string][]string, len(rsm.eventTypeToStateKeys)),
+		allState:                        rsm.allState,
+		excludeMembers:                  true,
+	}
+	lazyLoadMembers = rsm.lazyLoading
+	for evType := range rsm.eventTypesWithWildcardStateKeys {
+		if evType == "m.room.member" {
+			lazyLoadMembers = true
+			continue
+		}
+		withoutMembers.eventTypesWithWildcardStateKeys[evType] = struct{}{}
+	}
+	for evType, stateKeys := range rsm.eventTypeToStateKeys {
+		if evType != "m.room.member" {
+			withoutMembers.eventTypeToStateKeys[evType] = stateKeys
+			continue
+		}
+		for _, sk := range stateKeys {
+			if sk != StateKeyLazy {
+				memberStateKeys = append(memberStateKeys, sk)
+			}
+		}
+	}
+	// all state includes every member unless the members are filtered by state key
+	if rsm.allState && len(rsm.eventTypeToStateKeys["m.room.member"]) == 0 {
+		lazyLoadMembers = true
+	}
+	// wildcard event types include members with these state keys
+	for _, sk := range rsm.stateKeysForWildcardEventType {
+		if sk != "*" {
+			memberStateKeys = append(memberStateKeys, sk)
+		}
+	}
+	return withoutMembers, memberStateKeys, lazyLoadMembers
+}
+
 func (rsm *RequiredStateMap) Empty() bool {
 	return !rsm.allState && !rsm.lazyLoading &&
 		len(rsm.eventTypeToStateKeys) == 0 &&
@@ -4,6 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 )
 
 // EventMetadata holds timing information about an event, to be used when sorting room
@@ -34,6 +40,10 @@ type RoomMetadata struct {
 	CanonicalAlias string
 	JoinCount      int
 	InviteCount    int
+	// Large is true if the room has so many joined members that it is handled in a degraded mode
+	// to avoid loading its membership: see caches.DefaultLargeRoomThreshold. JoinCount is
+	// approximate for large rooms.
+	Large bool
 	// LastMessageTimestamp is the origin_server_ts of the event most recently seen in
 	// this room. Because events arrive at the upstream homeserver out-of-order (and
 	// because origin_server_ts is an untrusted event field), this timestamp can
@@ -43,11 +53,15 @@ type RoomMetadata struct {
 	// grouped by event type.
 	LatestEventsByType map[string]EventMetadata
 	Encrypted          bool
-	PredecessorRoomID  *string
-	UpgradedRoomID     *string
-	RoomType           *string
+	// GuestAccess is true if the room's m.room.guest_access allows guests to join i.e "can_join".
+	GuestAccess       bool
+	PredecessorRoomID *string
+	UpgradedRoomID    *string
+	RoomType          *string
 	// if this room is a space, which rooms are m.space.child state events. This is the same for all users hence is global.
 	ChildSpaceRooms map[string]struct{}
+	// the spaces this room claims to be part of with m.space.parent state events. Also global.
+	ParentSpaceRooms map[string]struct{}
 	// The latest m.typing ephemeral event for this room.
 	TypingEvent json.RawMessage
 }
@@ -57,6 +71,7 @@ func NewRoomMetadata(roomID string) *RoomMetadata {
 		RoomID:             roomID,
 		LatestEventsByType: make(map[string]EventMetadata),
 		ChildSpaceRooms:    make(map[string]struct{}),
+		ParentSpaceRooms:   make(map[string]struct{}),
 	}
 }
 
@@ -91,6 +106,10 @@ func (m *RoomMetadata) DeepCopy() *RoomMetadata {
 	for k, v := range m.ChildSpaceRooms {
 		newMetadata.ChildSpaceRooms[k] = v
 	}
+	newMetadata.ParentSpaceRooms = make(map[string]struct{})
+	for k, v := range m.ParentSpaceRooms {
+		newMetadata.ParentSpaceRooms[k] = v
+	}
 
 	// ⚠️ NB: there are other pointer fields (e.g. PredecessorRoomID *string)
 	// and pointer-backed fields which are not deepcopied here, because they do not
@@ -210,6 +229,19 @@ func CalculateRoomName(heroInfo *RoomMetadata, maxNumNamesPerRoom int) (name str
 	return fmt.Sprintf("Empty Room (was %s)", calculatedRoomName), true
 }
 
+// NormaliseForSearch returns the name in a form for case-insensitive searching: case folded, with
+// compatibility characters decomposed, diacritics removed and whitespace collapsed. For example,
+// "Ｃafé  Crème" becomes "cafe creme".
+func NormaliseForSearch(name string) string {
+	// transformers are stateful, so make new ones for each call
+	t := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), cases.Fold(), norm.NFC)
+	normalised, _, err := transform.String(t, name)
+	if err != nil {
+		normalised = strings.ToLower(name)
+	}
+	return strings.Join(strings.Fields(normalised), " ")
+}
+
 func disambiguate(heroes []Hero) []string {
 	displayNames := make(map[string][]int)
 	for i, h := range heroes {
@@ -303,3 +303,21 @@ func assertSliceIDs(t *testing.T, desc string, h []Hero, ids []string) {
 		}
 	}
 }
+
+func TestNormaliseForSearch(t *testing.T) {
+	testCases := map[string]string{
+		"My Room":          "my room",
+		"  My \t Room\n":   "my room",
+		"Café Crème":       "cafe creme",
+		"Ｃａｆé":             "cafe",
+		"Straße":           "strasse",
+		"ΌΣΟΣ":             "οσοσ",
+		"#alias:localhost": "#alias:localhost",
+		"":                 "",
+	}
+	for name, want := range testCases {
+		if got := NormaliseForSearch(name); got != want {
+			t.Errorf("NormaliseForSearch(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a rate limiter which allows `rate` events per second on average, with bursts of
+// up to `burst` events. It is safe to use from multiple goroutines.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu sync.Mutex
+	// the number of events which can happen immediately, negative if events are waiting.
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewTokenBucket returns a full bucket. The burst is at least 1.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	b := math.Max(1, float64(burst))
+	return &TokenBucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		now:    time.Now,
+	}
+}
+
+// Reserve takes a token and returns how long to wait before the event can happen. Call Release if
+// the event does not happen after all.
+func (b *TokenBucket) Reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Release returns a reserved token which was not used.
+func (b *TokenBucket) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// Allow takes a token if the event can happen now. If it can't, returns false and how long to wait
+// before trying again.
+func (b *TokenBucket) Allow() (retryAfter time.Duration, ok bool) {
+	wait := b.Reserve()
+	if wait > 0 {
+		b.Release()
+		return wait, false
+	}
+	return 0, true
+}
+
+// full returns true if the bucket would have refilled completely by now.
+func (b *TokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// TokenBuckets limits events for each key separately, e.g per user, with a TokenBucket per key
+// which all have the same rate and burst. Buckets which have refilled are forgotten, so only keys
+// with recent events use memory. It is safe to use from multiple goroutines.
+type TokenBuckets struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*TokenBucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+// NewTokenBuckets returns a set of buckets which are full for every key.
+func NewTokenBuckets(rate float64, burst int) *TokenBuckets {
+	return &TokenBuckets{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*TokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key if the event can happen now. If it can't, returns
+// false and how long to wait before trying again.
+func (b *TokenBuckets) Allow(key string) (retryAfter time.Duration, ok bool) {
+	b.mu.Lock()
+	now := b.now()
+	// a bucket which has been idle for the time it takes to refill could be replaced by a new one
+	if refill := time.Duration(math.Max(1, float64(b.burst)) / b.rate * float64(time.Second)); now.Sub(b.lastPrune) >= refill {
+		b.lastPrune = now
+		for k, bucket := range b.buckets {
+			if bucket.full(now) {
+				delete(b.buckets, k)
+			}
+		}
+	}
+	bucket, exists := b.buckets[key]
+	if !exists {
+		bucket = NewTokenBucket(b.rate, b.burst)
+		bucket.now = b.now
+		b.buckets[key] = bucket
+	}
+	b.mu.Unlock()
+	return bucket.Allow()
+}
+
+// Len returns the number of keys with buckets which may not have refilled yet.
+func (b *TokenBuckets) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buckets)
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := NewTokenBucket(2, 2)
+	b.now = func() time.Time { return now }
+
+	// the burst can happen immediately
+	for i := 0; i < 2; i++ {
+		if wait := b.Reserve(); wait != 0 {
+			t.Fatalf("event %d: got wait %v want 0", i, wait)
+		}
+	}
+	// then events are spaced out at the rate
+	if wait := b.Reserve(); wait != 500*time.Millisecond {
+		t.Fatalf("got wait %v want 500ms", wait)
+	}
+	if wait := b.Reserve(); wait != time.Second {
+		t.Fatalf("got wait %v want 1s", wait)
+	}
+	// releasing an unused reservation gives the turn to the next event
+	b.Release()
+	if wait := b.Reserve(); wait != time.Second {
+		t.Fatalf("got wait %v want 1s after release", wait)
+	}
+	// tokens refill over time, up to the burst
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if wait := b.Reserve(); wait != 0 {
+			t.Fatalf("event %d after refill: got wait %v want 0", i, wait)
+		}
+	}
+	// Allow does not take a token when the event must wait
+	for i := 0; i < 3; i++ {
+		retryAfter, ok := b.Allow()
+		if ok || retryAfter != 500*time.Millisecond {
+			t.Fatalf("Allow: got %v,%v want 500ms,false", retryAfter, ok)
+		}
+	}
+	now = now.Add(500 * time.Millisecond)
+	if _, ok := b.Allow(); !ok {
+		t.Fatalf("Allow: got false after the bucket refilled")
+	}
+}
+
+func TestTokenBucketMinimumBurst(t *testing.T) {
+	b := NewTokenBucket(0.5, 0)
+	if wait := b.Reserve(); wait != 0 {
+		t.Fatalf("got wait %v want 0 for the first event", wait)
+	}
+	if _, ok := b.Allow(); ok {
+		t.Fatalf("Allow: got true for the second event")
+	}
+}
+
+func TestTokenBuckets(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := NewTokenBuckets(1, 2)
+	b.now = func() time.Time { return now }
+
+	// each key has its own burst
+	for _, key := range []string{"alice", "alice", "bob", "bob"} {
+		if _, ok := b.Allow(key); !ok {
+			t.Fatalf("Allow(%s): got false within the burst", key)
+		}
+	}
+	retryAfter, ok := b.Allow("alice")
+	if ok || retryAfter != time.Second {
+		t.Fatalf("Allow(alice): got %v,%v want 1s,false", retryAfter, ok)
+	}
+	if _, ok := b.Allow("charlie"); !ok {
+		t.Fatalf("Allow(charlie): got false when only alice and bob are limited")
+	}
+	if b.Len() != 3 {
+		t.Fatalf("got %d buckets want 3", b.Len())
+	}
+
+	// buckets which have refilled are forgotten
+	now = now.Add(time.Second)
+	if _, ok := b.Allow("alice"); !ok {
+		t.Fatalf("Allow(alice): got false after a token refilled")
+	}
+	now = now.Add(1500 * time.Millisecond)
+	if _, ok := b.Allow("dave"); !ok {
+		t.Fatalf("Allow(dave): got false")
+	}
+	if b.Len() != 2 {
+		t.Fatalf("got %d buckets want 2: alice and dave", b.Len())
+	}
+}
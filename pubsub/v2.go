@@ -21,6 +21,7 @@ type V2Listener interface {
 	OnInitialSyncComplete(p *V2InitialSyncComplete)
 	OnDeviceData(p *V2DeviceData)
 	OnTyping(p *V2Typing)
+	OnPresence(p *V2Presence)
 	OnReceipt(p *V2Receipt)
 	OnDeviceMessages(p *V2DeviceMessages)
 	OnExpiredToken(p *V2ExpiredToken)
@@ -39,6 +40,9 @@ type V2Accumulate struct {
 	RoomID    string
 	PrevBatch string
 	EventNIDs []int64
+	// True if the homeserver skipped events before the first of EventNIDs, which the proxy does
+	// not know.
+	MissingPrevious bool
 }
 
 func (*V2Accumulate) Type() string { return "V2Accumulate" }
@@ -110,6 +114,13 @@ type V2Typing struct {
 
 func (*V2Typing) Type() string { return "V2Typing" }
 
+// V2Presence contains m.presence events which have changed since they were last seen by any poller.
+type V2Presence struct {
+	Events []json.RawMessage
+}
+
+func (*V2Presence) Type() string { return "V2Presence" }
+
 type V2Receipt struct {
 	RoomID   string
 	Receipts []internal.Receipt
@@ -127,6 +138,8 @@ func (*V2DeviceMessages) Type() string { return "V2DeviceMessages" }
 type V2ExpiredToken struct {
 	UserID   string
 	DeviceID string
+	// True if only the access token expired, rather than the device being logged out.
+	SoftLogout bool
 }
 
 func (*V2ExpiredToken) Type() string { return "V2ExpiredToken" }
@@ -188,6 +201,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnDeviceData(pl)
 	case *V2Typing:
 		v.receiver.OnTyping(pl)
+	case *V2Presence:
+		v.receiver.OnPresence(pl)
 	case *V2DeviceMessages:
 		v.receiver.OnDeviceMessages(pl)
 	case *V2ExpiredToken:
@@ -6,6 +6,7 @@ const ChanV3 = "v3ch"
 // V3Listener describes the messages that incoming sliding sync requests will publish.
 type V3Listener interface {
 	EnsurePolling(p *V3EnsurePolling)
+	UpdateAccessToken(p *V3UpdateAccessToken)
 }
 
 type V3EnsurePolling struct {
@@ -18,6 +19,16 @@ type V3EnsurePolling struct {
 
 func (*V3EnsurePolling) Type() string { return "V3EnsurePolling" }
 
+// V3UpdateAccessToken is sent when a device uses an access token for the first time, e.g after
+// refreshing its token, so a running poller for the device switches to it.
+type V3UpdateAccessToken struct {
+	UserID          string
+	DeviceID        string
+	AccessTokenHash string
+}
+
+func (*V3UpdateAccessToken) Type() string { return "V3UpdateAccessToken" }
+
 type V3Sub struct {
 	listener Listener
 	receiver V3Listener
@@ -38,6 +49,8 @@ func (v *V3Sub) onMessage(p Payload) {
 	switch pl := p.(type) {
 	case *V3EnsurePolling:
 		v.receiver.EnsurePolling(pl)
+	case *V3UpdateAccessToken:
+		v.receiver.UpdateAccessToken(pl)
 	default:
 		logger.Warn().Str("type", p.Type()).Msg("V3Sub: unhandled payload type")
 	}
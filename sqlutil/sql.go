@@ -4,9 +4,14 @@ import (
 	"context"
 	"fmt"
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"os"
+	"runtime"
 	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -16,11 +21,73 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 	TimeFormat: "15:04:05",
 })
 
+// txnDuration observes how long transactions take, labelled by the function which ran them. Nil
+// unless RegisterMetrics has been called.
+var txnDuration atomic.Pointer[prometheus.HistogramVec]
+
+// RegisterMetrics starts timing the transactions run by WithTransaction, as a Prometheus histogram.
+func RegisterMetrics() {
+	hist := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "db",
+		Name:      "txn_duration_secs",
+		Help:      "Time taken in seconds to run and commit database transactions, labelled by the function which ran them.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	}, []string{"func"})
+	if txnDuration.CompareAndSwap(nil, hist) {
+		prometheus.MustRegister(hist)
+	}
+}
+
+// UnregisterMetrics stops timing transactions. Useful in tests.
+func UnregisterMetrics() {
+	if hist := txnDuration.Swap(nil); hist != nil {
+		prometheus.Unregister(hist)
+	}
+}
+
+// callerName returns the name of the function which called WithTransaction or
+// WithTransactionContext, without the module path e.g. "state.(*Accumulator).Accumulate". Must be
+// called from withTransaction.
+func callerName() string {
+	pc, _, _, ok := runtime.Caller(3)
+	if !ok {
+		return "unknown"
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return "unknown"
+	}
+	name := fn.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
 // WithTransaction runs a block of code passing in an SQL transaction
 // If the code returns an error or panics then the transactions is rolled back
 // Otherwise the transaction is committed.
 func WithTransaction(db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
-	txn, err := db.Beginx()
+	return withTransaction(context.Background(), db, fn)
+}
+
+// WithTransactionContext is WithTransaction for a transaction which is rolled back if ctx is done
+// first. Queries in fn should be made with ctx as well, using the *Context methods of the
+// transaction, so that the query which is running is cancelled too.
+func WithTransactionContext(ctx context.Context, db *sqlx.DB, fn func(txn *sqlx.Tx) error) error {
+	return withTransaction(ctx, db, fn)
+}
+
+func withTransaction(ctx context.Context, db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
+	if hist := txnDuration.Load(); hist != nil {
+		start := time.Now()
+		caller := callerName()
+		defer func() {
+			hist.WithLabelValues(caller).Observe(time.Since(start).Seconds())
+		}()
+	}
+	txn, err := db.BeginTxx(ctx, nil)
 	if err != nil {
 		return fmt.Errorf("WithTransaction.Begin: %w", err)
 	}
@@ -28,8 +95,6 @@ func WithTransaction(db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
 	defer func() {
 		panicErr := recover()
 		if err == nil && panicErr != nil {
-			// TODO: thread a context through to here?
-			ctx := context.Background()
 			logger.Error().Msg(string(debug.Stack()))
 			internal.GetSentryHubFromContextOrDefault(ctx).RecoverWithContext(ctx, panicErr)
 			err = fmt.Errorf("panic: %v", panicErr)
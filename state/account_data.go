@@ -77,14 +77,27 @@ func (t *AccountDataTable) SelectWithType(txn *sqlx.Tx, userID, evType string) (
 	return
 }
 
-func (t *AccountDataTable) SelectMany(txn *sqlx.Tx, userID string, roomIDs ...string) (datas []AccountData, err error) {
+// SelectMany returns the user's account data in these rooms, or their global account data if no
+// rooms are given. If eventTypes is non-empty, only account data of those types is returned.
+func (t *AccountDataTable) SelectMany(txn *sqlx.Tx, userID string, eventTypes []string, roomIDs ...string) (datas []AccountData, err error) {
 	if len(roomIDs) == 0 {
-		err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
-		WHERE user_id=$1 AND room_id = $2`, userID, AccountDataGlobalRoom)
-		return
+		roomIDs = []string{AccountDataGlobalRoom}
 	}
-	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
-	WHERE user_id=$1 AND room_id=ANY($2)`, userID, pq.StringArray(roomIDs))
+	query := `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
+	WHERE user_id=$1 AND room_id=ANY($2)`
+	args := []interface{}{userID, pq.StringArray(roomIDs)}
+	if len(eventTypes) > 0 {
+		query += ` AND type=ANY($3)`
+		args = append(args, pq.StringArray(eventTypes))
+	}
+	err = txn.Select(&datas, query, args...)
+	return
+}
+
+// SelectLatestID returns the ID of the most recently changed account data for this user, or 0 if
+// the user has no account data. IDs change every time account data is updated.
+func (t *AccountDataTable) SelectLatestID(txn *sqlx.Tx, userID string) (id int64, err error) {
+	err = txn.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM syncv3_account_data WHERE user_id=$1`, userID).Scan(&id)
 	return
 }
 
@@ -124,7 +124,7 @@ func TestAccountData(t *testing.T) {
 	wantDatas := []AccountData{
 		accountData[4], accountData[5],
 	}
-	gotDatas, err := table.SelectMany(txn, alice)
+	gotDatas, err := table.SelectMany(txn, alice, nil)
 	if err != nil {
 		t.Fatalf("SelectMany: %s", err)
 	}
@@ -134,14 +134,14 @@ func TestAccountData(t *testing.T) {
 	wantDatas = []AccountData{
 		accountData[6],
 	}
-	gotDatas, err = table.SelectMany(txn, alice, roomA)
+	gotDatas, err = table.SelectMany(txn, alice, nil, roomA)
 	if err != nil {
 		t.Fatalf("SelectMany: %s", err)
 	}
 	assertAccountDatasEqual(t, "SelectMany", gotDatas, wantDatas)
 
 	// Select all room events for unknown user
-	gotDatas, err = table.SelectMany(txn, "@someone-else:localhost", roomA)
+	gotDatas, err = table.SelectMany(txn, "@someone-else:localhost", nil, roomA)
 	if err != nil {
 		t.Fatalf("SelectMany: %s", err)
 	}
@@ -149,6 +149,16 @@ func TestAccountData(t *testing.T) {
 		t.Fatalf("SelectMany: got %d account data, want 0", len(gotDatas))
 	}
 
+	// Select room events of one type for alice
+	wantDatas = []AccountData{
+		accountData[2],
+	}
+	gotDatas, err = table.SelectMany(txn, alice, []string{"dummy"}, roomA, roomB)
+	if err != nil {
+		t.Fatalf("SelectMany: %s", err)
+	}
+	assertAccountDatasEqual(t, "SelectMany with types", gotDatas, wantDatas)
+
 	// Select all room account data matching eventType
 	gotDatas, err = table.SelectWithType(txn, alice, eventType)
 	if err != nil {
@@ -204,7 +214,7 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	gots, err = table.Select(txn, alice, []string{eventType}, roomA)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "Select", gots, []AccountData{data})
-	gots, err = table.SelectMany(txn, alice, roomA)
+	gots, err = table.SelectMany(txn, alice, nil, roomA)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "SelectMany", gots, []AccountData{data})
 	// now replace the data, which should update the id
@@ -220,7 +230,7 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	}
 	data.ID = gots[0].ID
 	assertAccountDatasEqual(t, "Select", gots, []AccountData{data})
-	gots, err = table.SelectMany(txn, alice, roomA)
+	gots, err = table.SelectMany(txn, alice, nil, roomA)
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "SelectMany", gots, []AccountData{data})
 	gots, err = table.SelectWithType(txn, alice, eventType)
@@ -29,7 +29,10 @@ type Accumulator struct {
 	snapshotTable *SnapshotTable
 	spacesTable   *SpacesTable
 	invitesTable  *InvitesTable
+	threadTable   *ThreadTable
 	entityName    string
+	// Timeline events larger than this many bytes are replaced with placeholders. 0 means no limit.
+	MaxEventSize int
 }
 
 func NewAccumulator(db *sqlx.DB) *Accumulator {
@@ -40,7 +43,9 @@ func NewAccumulator(db *sqlx.DB) *Accumulator {
 		snapshotTable: NewSnapshotsTable(db),
 		spacesTable:   NewSpacesTable(db),
 		invitesTable:  NewInvitesTable(db),
+		threadTable:   NewThreadTable(db),
 		entityName:    "server",
+		MaxEventSize:  internal.DefaultMaxEventSize,
 	}
 }
 
@@ -330,6 +335,12 @@ type AccumulateResult struct {
 	// IncludesStateRedaction is set to true when we have accumulated a redaction to a
 	// piece of room state.
 	IncludesStateRedaction bool
+	// NumDuplicates is the number of events dropped because their event ID appeared
+	// earlier in the same sync v2 timeline.
+	NumDuplicates int
+	// MissingPrevious is true when the timeline was limited and the proxy did not know the
+	// event before TimelineNIDs[0], so there is a gap in the timeline.
+	MissingPrevious bool
 }
 
 // Accumulate internal state from a user's sync response. The timeline order MUST be in the order
@@ -349,14 +360,15 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	// - there to be no duplicate events
 	// - if there are new events, they are always new.
 	// Both of these assumptions can be false for different reasons
-	incomingEvents := parseAndDeduplicateTimelineEvents(roomID, timeline)
+	timeline.Events = quarantineTimelineEvents(roomID, timeline.Events, a.MaxEventSize)
+	incomingEvents, numDuplicates := parseAndDeduplicateTimelineEvents(roomID, timeline)
 	newEvents, err := a.filterToNewTimelineEvents(txn, incomingEvents)
 	if err != nil {
 		err = fmt.Errorf("filterTimelineEvents: %w", err)
 		return AccumulateResult{}, err
 	}
 	if len(newEvents) == 0 {
-		return AccumulateResult{}, nil // nothing to do
+		return AccumulateResult{NumDuplicates: numDuplicates}, nil // nothing to do
 	}
 
 	// If this timeline was limited and we don't recognise its first event E, mark it
@@ -429,11 +441,12 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	}
 	if len(eventIDToNID) == 0 {
 		// nothing to do, we already know about these events
-		return AccumulateResult{}, nil
+		return AccumulateResult{NumDuplicates: numDuplicates}, nil
 	}
 
 	result := AccumulateResult{
-		NumNew: len(eventIDToNID),
+		NumNew:        len(eventIDToNID),
+		NumDuplicates: numDuplicates,
 	}
 
 	var latestNID int64
@@ -469,6 +482,9 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 			}
 			postInsertEvents = append(postInsertEvents, ev)
 			result.TimelineNIDs = append(result.TimelineNIDs, ev.NID)
+			if i == 0 && ev.MissingPrevious {
+				result.MissingPrevious = true
+			}
 		}
 	}
 
@@ -557,6 +573,10 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 		return AccumulateResult{}, fmt.Errorf("HandleSpaceUpdates: %s", err)
 	}
 
+	if err = a.threadTable.Insert(txn, postInsertEvents); err != nil {
+		return AccumulateResult{}, fmt.Errorf("ThreadTable.Insert: %w", err)
+	}
+
 	// the last fetched snapshot ID is the current one
 	info := a.roomInfoDelta(roomID, postInsertEvents)
 	if err = a.roomsTable.Upsert(txn, info, snapID, latestNID); err != nil {
@@ -565,10 +585,38 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	return result, nil
 }
 
+// quarantineTimelineEvents replaces events which are malformed or larger than maxEventSize bytes
+// with placeholders of type internal.SkippedEventType, so one bad event cannot stop the rest of the
+// timeline being served. Returns a copy if any events were replaced.
+func quarantineTimelineEvents(roomID string, events []json.RawMessage, maxEventSize int) []json.RawMessage {
+	result := events
+	copied := false
+	for i, ev := range events {
+		reason := internal.SkipReason(ev, maxEventSize)
+		if reason == "" {
+			continue
+		}
+		logger.Warn().Str("event_id", gjson.GetBytes(ev, "event_id").Str).Str("room_id", roomID).Str("reason", reason).Int("size", len(ev)).Msg(
+			"Accumulator: replacing timeline event with a placeholder",
+		)
+		if !copied {
+			// don't modify the caller's timeline
+			result = append([]json.RawMessage{}, events...)
+			copied = true
+		}
+		result[i] = internal.NewSkippedEvent(ev, roomID, reason)
+	}
+	return result
+}
+
 // - parses it and returns Event structs.
-// - removes duplicate events: this is just a bug which has been seen on Synapse on matrix.org
-func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineResponse) []Event {
-	dedupedEvents := make([]Event, 0, len(timeline.Events))
+// - removes duplicate events: this is just a bug which has been seen on Synapse on matrix.org, and
+//   can happen over federation. Events are duplicates only if they have the same event ID: distinct
+//   events which happen to have the same type, sender, content, etc are all kept.
+//
+// Returns the deduplicated events along with the number of duplicate events removed.
+func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineResponse) (dedupedEvents []Event, numDuplicates int) {
+	dedupedEvents = make([]Event, 0, len(timeline.Events))
 	seenEvents := make(map[string]struct{})
 	for i, rawEvent := range timeline.Events {
 		e := Event{
@@ -585,6 +633,7 @@ func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineRes
 			logger.Warn().Str("event_id", e.ID).Str("room_id", roomID).Msg(
 				"Accumulator.filterToNewTimelineEvents: seen the same event ID twice, ignoring",
 			)
+			numDuplicates++
 			continue
 		}
 		if i == 0 && timeline.PrevBatch != "" {
@@ -597,7 +646,15 @@ func parseAndDeduplicateTimelineEvents(roomID string, timeline sync2.TimelineRes
 		dedupedEvents = append(dedupedEvents, e)
 		seenEvents[e.ID] = struct{}{}
 	}
-	return dedupedEvents
+	if len(dedupedEvents) > 0 && timeline.NextBatch != "" {
+		// tag the last timeline event with the next batch token, so events near the end of the
+		// timeline still have a token to paginate from.
+		dedupedEvents[len(dedupedEvents)-1].NextBatch = sql.NullString{
+			String: timeline.NextBatch,
+			Valid:  true,
+		}
+	}
+	return dedupedEvents, numDuplicates
 }
 
 // filterToNewTimelineEvents takes a raw timeline array from sync v2 and applies sanity to it:
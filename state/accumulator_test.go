@@ -6,16 +6,19 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/testutils"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 var (
@@ -404,7 +407,7 @@ func TestAccumulatorMembershipLogs(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		gotEvents, err := accumulator.eventsTable.SelectEventsWithTypeStateKey(
-			"m.room.member", tc.target, tc.startExcl, tc.endIncl,
+			context.Background(), "m.room.member", tc.target, tc.startExcl, tc.endIncl,
 		)
 		if err != nil {
 			t.Fatalf("failed to MembershipsBetween: %s", err)
@@ -880,3 +883,170 @@ func currentSnapshotNIDs(t *testing.T, snapshotTable *SnapshotTable, roomID stri
 	})
 	return events
 }
+
+// Test that duplicate timeline events are only accumulated once, and that distinct events which
+// happen to have identical fields other than the event ID are all kept.
+func TestAccumulatorDropsDuplicateTimelineEvents(t *testing.T) {
+	roomID := "!TestAccumulatorDropsDuplicateTimelineEvents:localhost"
+	create := testutils.NewStateEvent(t, "m.room.create", "", userID, map[string]interface{}{})
+	msgA := testutils.NewMessageEvent(t, userID, "hello")
+	msgB := testutils.NewMessageEvent(t, userID, "same")
+	// identical to B apart from the event ID
+	msgC, err := sjson.SetBytes(msgB, "event_id", "$TestAccumulatorDropsDuplicateTimelineEvents_c")
+	if err != nil {
+		t.Fatalf("failed to set event ID: %s", err)
+	}
+	timeline := sync2.TimelineResponse{
+		Events: []json.RawMessage{msgA, msgB, msgA, msgC, msgB},
+	}
+
+	deduped, numDuplicates := parseAndDeduplicateTimelineEvents(roomID, timeline)
+	if numDuplicates != 2 {
+		t.Errorf("got %d duplicates, want 2", numDuplicates)
+	}
+	var gotIDs []string
+	for _, ev := range deduped {
+		gotIDs = append(gotIDs, ev.ID)
+	}
+	wantIDs := []string{
+		gjson.GetBytes(msgA, "event_id").Str, gjson.GetBytes(msgB, "event_id").Str, gjson.GetBytes(msgC, "event_id").Str,
+	}
+	if !reflect.DeepEqual(gotIDs, wantIDs) {
+		t.Fatalf("got event IDs %v want %v", gotIDs, wantIDs)
+	}
+
+	db, close := connectToDB(t)
+	defer close()
+	accumulator := NewAccumulator(db)
+	if _, err = accumulator.Initialise(roomID, []json.RawMessage{create}); err != nil {
+		t.Fatalf("failed to Initialise accumulator: %s", err)
+	}
+	var result AccumulateResult
+	err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+		result, err = accumulator.Accumulate(txn, userID, roomID, timeline)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+	if result.NumNew != 3 || len(result.TimelineNIDs) != 3 {
+		t.Fatalf("got %d new events and %d NIDs, want 3", result.NumNew, len(result.TimelineNIDs))
+	}
+	if result.NumDuplicates != 2 {
+		t.Fatalf("got %d duplicates, want 2", result.NumDuplicates)
+	}
+
+	// seeing the same timeline again (e.g from another poller) must not deliver anything new
+	err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+		result, err = accumulator.Accumulate(txn, userID, roomID, timeline)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+	if result.NumNew != 0 {
+		t.Fatalf("re-accumulating returned %d new events, want 0", result.NumNew)
+	}
+}
+
+// Test that oversized and malformed timeline events are replaced with placeholders, and the rest
+// of the timeline is accumulated as normal.
+func TestAccumulatorQuarantinesBadTimelineEvents(t *testing.T) {
+	roomID := "!TestAccumulatorQuarantinesBadTimelineEvents:localhost"
+	create := testutils.NewStateEvent(t, "m.room.create", "", userID, map[string]interface{}{})
+	msgA := testutils.NewMessageEvent(t, userID, "hello")
+	oversized := testutils.NewMessageEvent(t, userID, strings.Repeat("a", 500))
+	malformed, err := sjson.SetBytes(testutils.NewMessageEvent(t, userID, "bad"), "content", "not an object")
+	if err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	msgB := testutils.NewMessageEvent(t, userID, "world")
+	events := []json.RawMessage{msgA, oversized, malformed, msgB}
+
+	quarantined := quarantineTimelineEvents(roomID, events, 400)
+	if !reflect.DeepEqual(events[1], oversized) {
+		t.Fatalf("quarantineTimelineEvents modified the input timeline")
+	}
+	wantReasons := []string{"", internal.SkippedReasonTooLarge, internal.SkippedReasonMalformed, ""}
+	for i, ev := range quarantined {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("event_id").Str != gjson.GetBytes(events[i], "event_id").Str {
+			t.Errorf("event %d: event ID changed to %s", i, parsed.Get("event_id").Str)
+		}
+		if wantReasons[i] == "" {
+			if !reflect.DeepEqual(ev, events[i]) {
+				t.Errorf("event %d was modified: %s", i, ev)
+			}
+			continue
+		}
+		if parsed.Get("type").Str != internal.SkippedEventType || parsed.Get("content.reason").Str != wantReasons[i] {
+			t.Errorf("event %d: got %s want a placeholder with reason %s", i, ev, wantReasons[i])
+		}
+	}
+
+	db, close := connectToDB(t)
+	defer close()
+	accumulator := NewAccumulator(db)
+	accumulator.MaxEventSize = 400
+	if _, err = accumulator.Initialise(roomID, []json.RawMessage{create}); err != nil {
+		t.Fatalf("failed to Initialise accumulator: %s", err)
+	}
+	var result AccumulateResult
+	err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+		result, err = accumulator.Accumulate(txn, userID, roomID, sync2.TimelineResponse{Events: events})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to Accumulate: %s", err)
+	}
+	if result.NumNew != 4 {
+		t.Fatalf("got %d new events want 4", result.NumNew)
+	}
+	var stored []Event
+	err = sqlutil.WithTransaction(accumulator.db, func(txn *sqlx.Tx) error {
+		stored, err = accumulator.eventsTable.SelectByNIDs(txn, true, result.TimelineNIDs)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to select events: %s", err)
+	}
+	for i, ev := range stored {
+		if !reflect.DeepEqual(gjson.ParseBytes(ev.JSON).Value(), gjson.ParseBytes(quarantined[i]).Value()) {
+			t.Errorf("stored event %d: got %s want %s", i, ev.JSON, quarantined[i])
+		}
+	}
+}
+
+func TestParseTimelineEventsTagsBatchTokens(t *testing.T) {
+	roomID := "!TestParseTimelineEventsTagsBatchTokens:localhost"
+	msgA := testutils.NewMessageEvent(t, "@alice:localhost", "a")
+	msgB := testutils.NewMessageEvent(t, "@alice:localhost", "b")
+	msgC := testutils.NewMessageEvent(t, "@alice:localhost", "c")
+	events, _ := parseAndDeduplicateTimelineEvents(roomID, sync2.TimelineResponse{
+		Events:    []json.RawMessage{msgA, msgB, msgC},
+		PrevBatch: "prev",
+		NextBatch: "next",
+	})
+	if len(events) != 3 {
+		t.Fatalf("got %d events want 3", len(events))
+	}
+	// the prev_batch is the position before the first event, the next_batch after the last
+	if events[0].PrevBatch.String != "prev" || events[0].NextBatch.Valid {
+		t.Errorf("first event: got prev_batch=%v next_batch=%v", events[0].PrevBatch, events[0].NextBatch)
+	}
+	if events[1].PrevBatch.Valid || events[1].NextBatch.Valid {
+		t.Errorf("middle event: got prev_batch=%v next_batch=%v", events[1].PrevBatch, events[1].NextBatch)
+	}
+	if events[2].PrevBatch.Valid || events[2].NextBatch.String != "next" {
+		t.Errorf("last event: got prev_batch=%v next_batch=%v", events[2].PrevBatch, events[2].NextBatch)
+	}
+	// a single event has both
+	events, _ = parseAndDeduplicateTimelineEvents(roomID, sync2.TimelineResponse{
+		Events:    []json.RawMessage{msgA},
+		PrevBatch: "prev",
+		NextBatch: "next",
+	})
+	if events[0].PrevBatch.String != "prev" || events[0].NextBatch.String != "next" {
+		t.Errorf("single event: got prev_batch=%v next_batch=%v", events[0].PrevBatch, events[0].NextBatch)
+	}
+}
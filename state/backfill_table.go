@@ -0,0 +1,98 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// BackfillPage is a page of timeline history fetched from the homeserver's /messages.
+type BackfillPage struct {
+	ID     int64  `db:"page_id"`
+	UserID string `db:"user_id"`
+	RoomID string `db:"room_id"`
+	// The upstream token the page was fetched from, and the upstream token for the page before it.
+	// End is empty if there is no more history.
+	From string `db:"from_token"`
+	End  string `db:"end_token"`
+	// JSON array of events, newest first, as returned by /messages.
+	Events []byte `db:"events"`
+}
+
+// BackfillTable stores timeline history which the proxy fetched on behalf of a user. Pages are
+// stored per user, as the history a user can see depends on their membership. Backfilled events
+// are not stored in the events table, as event NIDs are in timeline order and older events
+// would be assigned the newest NIDs.
+type BackfillTable struct {
+	db *sqlx.DB
+}
+
+func NewBackfillTable(db *sqlx.DB) *BackfillTable {
+	db.MustExec(`
+	CREATE SEQUENCE IF NOT EXISTS syncv3_backfill_page_seq;
+	CREATE TABLE IF NOT EXISTS syncv3_backfill (
+		page_id BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('syncv3_backfill_page_seq'),
+		user_id TEXT NOT NULL,
+		room_id TEXT NOT NULL,
+		from_token TEXT NOT NULL,
+		end_token TEXT NOT NULL,
+		events BYTEA NOT NULL,
+		inserted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+		UNIQUE(user_id, room_id, from_token)
+	);
+	`)
+	return &BackfillTable{db}
+}
+
+// Insert stores the page fetched from the `from` token, replacing any page already fetched from it.
+// Returns the ID of the page.
+func (t *BackfillTable) Insert(userID, roomID, from, end string, events []json.RawMessage) (pageID int64, err error) {
+	if events == nil {
+		events = []json.RawMessage{}
+	}
+	eventsJSON, err := json.Marshal(events)
+	if err != nil {
+		return 0, err
+	}
+	err = t.db.QueryRow(`
+		INSERT INTO syncv3_backfill (user_id, room_id, from_token, end_token, events) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, room_id, from_token) DO UPDATE SET end_token=$4, events=$5, inserted_at=NOW()
+		RETURNING page_id`,
+		userID, roomID, from, end, eventsJSON,
+	).Scan(&pageID)
+	return pageID, err
+}
+
+// SelectByFrom returns the page the user fetched from the `from` token in this room, or nil if there
+// is none.
+func (t *BackfillTable) SelectByFrom(userID, roomID, from string) (*BackfillPage, error) {
+	var page BackfillPage
+	err := t.db.Get(&page, `SELECT page_id, user_id, room_id, from_token, end_token, events FROM syncv3_backfill
+		WHERE user_id=$1 AND room_id=$2 AND from_token=$3`, userID, roomID, from)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &page, err
+}
+
+// SelectByID returns the page with this ID, or nil if there is none.
+func (t *BackfillTable) SelectByID(pageID int64) (*BackfillPage, error) {
+	var page BackfillPage
+	err := t.db.Get(&page, `SELECT page_id, user_id, room_id, from_token, end_token, events FROM syncv3_backfill
+		WHERE page_id=$1`, pageID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &page, err
+}
+
+// Purge removes pages which were fetched before olderThan. Returns the number of pages removed.
+func (t *BackfillTable) Purge(olderThan time.Time) (int64, error) {
+	res, err := t.db.Exec(`DELETE FROM syncv3_backfill WHERE inserted_at < $1`, olderThan)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,60 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBackfillTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewBackfillTable(db)
+	userID := "@alice:backfill"
+	roomID := "!backfill:localhost"
+
+	got, err := table.SelectByFrom(userID, roomID, "t1")
+	assertNoError(t, err)
+	if got != nil {
+		t.Fatalf("SelectByFrom: got %+v want nil", got)
+	}
+
+	events := []json.RawMessage{json.RawMessage(`{"event_id":"$b"}`), json.RawMessage(`{"event_id":"$a"}`)}
+	pageID, err := table.Insert(userID, roomID, "t1", "t2", events)
+	assertNoError(t, err)
+	otherPageID, err := table.Insert("@bob:backfill", roomID, "t1", "t3", nil)
+	assertNoError(t, err)
+	if pageID == otherPageID {
+		t.Fatalf("pages for different users got the same ID %d", pageID)
+	}
+
+	got, err = table.SelectByFrom(userID, roomID, "t1")
+	assertNoError(t, err)
+	assertVal(t, "page ID", got.ID, pageID)
+	assertVal(t, "end", got.End, "t2")
+	assertVal(t, "events", string(got.Events), `[{"event_id":"$b"},{"event_id":"$a"}]`)
+	got, err = table.SelectByID(otherPageID)
+	assertNoError(t, err)
+	assertVal(t, "other user", got.UserID, "@bob:backfill")
+	assertVal(t, "no events", string(got.Events), `[]`)
+
+	// refetching a page replaces it, keeping its ID
+	replacedID, err := table.Insert(userID, roomID, "t1", "", events[:1])
+	assertNoError(t, err)
+	assertVal(t, "replaced page ID", replacedID, pageID)
+	got, err = table.SelectByID(pageID)
+	assertNoError(t, err)
+	assertVal(t, "replaced end", got.End, "")
+	assertVal(t, "replaced events", string(got.Events), `[{"event_id":"$b"}]`)
+
+	numPurged, err := table.Purge(time.Now().Add(-time.Hour))
+	assertNoError(t, err)
+	assertVal(t, "purged recent pages", numPurged, int64(0))
+	_, err = table.Purge(time.Now().Add(time.Hour))
+	assertNoError(t, err)
+	got, err = table.SelectByID(pageID)
+	assertNoError(t, err)
+	if got != nil {
+		t.Fatalf("SelectByID after purge: got %+v want nil", got)
+	}
+}
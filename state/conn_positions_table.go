@@ -0,0 +1,57 @@
+package state
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ConnPositionsTable saves the positions of sliding sync connections, so clients can resume them
+// after the proxy restarts. The position is opaque to the table.
+type ConnPositionsTable struct {
+	db *sqlx.DB
+}
+
+func NewConnPositionsTable(db *sqlx.DB) *ConnPositionsTable {
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_conn_positions (
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		conn_id TEXT NOT NULL,
+		data BYTEA NOT NULL,
+		ts BIGINT NOT NULL,
+		UNIQUE(user_id, device_id, conn_id)
+	);
+	`)
+	return &ConnPositionsTable{db}
+}
+
+// Upsert replaces the saved position of the connection.
+func (t *ConnPositionsTable) Upsert(userID, deviceID, connID string, data []byte) error {
+	_, err := t.db.Exec(`
+		INSERT INTO syncv3_conn_positions (user_id, device_id, conn_id, data, ts) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, device_id, conn_id) DO UPDATE SET data=$4, ts=$5`,
+		userID, deviceID, connID, data, time.Now().UnixMilli(),
+	)
+	return err
+}
+
+// Select returns the saved position of the connection, or nil if there is none.
+func (t *ConnPositionsTable) Select(userID, deviceID, connID string) ([]byte, error) {
+	var data []byte
+	err := t.db.QueryRow(
+		`SELECT data FROM syncv3_conn_positions WHERE user_id=$1 AND device_id=$2 AND conn_id=$3`,
+		userID, deviceID, connID,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Clean removes positions which were last saved before boundaryTime.
+func (t *ConnPositionsTable) Clean(boundaryTime time.Time) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_conn_positions WHERE ts <= $1`, boundaryTime.UnixMilli())
+	return err
+}
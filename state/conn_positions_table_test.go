@@ -0,0 +1,32 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnPositionsTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewConnPositionsTable(db)
+	userID := "@alice:conn_positions"
+
+	got, err := table.Select(userID, "A", "")
+	assertNoError(t, err)
+	assertVal(t, "missing position", got, []byte(nil))
+
+	assertNoError(t, table.Upsert(userID, "A", "", []byte("1")))
+	assertNoError(t, table.Upsert(userID, "A", "room-list", []byte("2")))
+	assertNoError(t, table.Upsert(userID, "A", "", []byte("3")))
+	got, err = table.Select(userID, "A", "")
+	assertNoError(t, err)
+	assertVal(t, "replaced position", got, []byte("3"))
+	got, err = table.Select(userID, "A", "room-list")
+	assertNoError(t, err)
+	assertVal(t, "other conn position", got, []byte("2"))
+
+	assertNoError(t, table.Clean(time.Now()))
+	got, err = table.Select(userID, "A", "")
+	assertNoError(t, err)
+	assertVal(t, "cleaned position", got, []byte(nil))
+}
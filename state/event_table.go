@@ -1,6 +1,7 @@
 package state
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -28,6 +29,8 @@ type Event struct {
 	Membership string `db:"membership"`
 	// whether this was part of a v2 state response and hence not part of the timeline
 	IsState bool `db:"is_state"`
+	// whether this is a state event, as StateKey is also empty for message events. Set on Insert.
+	HasStateKey bool `db:"has_state_key"`
 	// This is a snapshot ID which corresponds to some room state BEFORE this event has been applied.
 	BeforeStateSnapshotID int64  `db:"before_state_snapshot_id"`
 	ReplacesNID           int64  `db:"event_replaces_nid"`
@@ -37,6 +40,9 @@ type Event struct {
 	// event in a timeline has a prev_batch attached), but we'll look for the 'closest' prev batch
 	// when returning these tokens to the caller (closest = next newest, assume clients de-dupe)
 	PrevBatch sql.NullString `db:"prev_batch"`
+	// The upstream next_batch of the sync response this event was the last timeline event in, which
+	// is a token for the position just after this event.
+	NextBatch sql.NullString `db:"next_batch"`
 	// stripped events will be missing this field
 	JSON []byte `db:"event"`
 	// MissingPrevious is true iff the previous timeline event is not known to the proxy.
@@ -125,8 +131,11 @@ func NewEventTable(db *sqlx.DB) *EventTable {
 		event_type TEXT NOT NULL,
 		state_key TEXT NOT NULL,
 		prev_batch TEXT,
+		next_batch TEXT,
 		membership TEXT,
 		is_state BOOLEAN NOT NULL, -- is this event part of the v2 state response?
+		-- does this event have a state_key, even an empty one? Timeline events without one can be purged.
+		has_state_key BOOLEAN NOT NULL DEFAULT TRUE,
 		event BYTEA NOT NULL,
 		-- True iff this event was seen at the start of the timeline in a limited sync
 		-- (i.e. the preceding timeline event was not known to the proxy).
@@ -165,6 +174,7 @@ func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map
 	}
 	result := make(map[string]int64)
 	for i := range events {
+		events[i].HasStateKey = gjson.GetBytes(events[i].JSON, "state_key").Exists()
 		if !gjson.GetBytes(events[i].JSON, "unsigned.txn_id").Exists() {
 			continue
 		}
@@ -174,13 +184,13 @@ func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map
 		}
 		events[i].JSON = js
 	}
-	chunks := sqlutil.Chunkify(9, MaxPostgresParameters, EventChunker(events))
+	chunks := sqlutil.Chunkify(11, MaxPostgresParameters, EventChunker(events))
 	var eventID string
 	var eventNID int64
 	for _, chunk := range chunks {
 		rows, err := txn.NamedQuery(`
-		INSERT INTO syncv3_events (event_id, event, event_type, state_key, room_id, membership, prev_batch, is_state, missing_previous)
-        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :is_state, :missing_previous)
+		INSERT INTO syncv3_events (event_id, event, event_type, state_key, room_id, membership, prev_batch, next_batch, is_state, has_state_key, missing_previous)
+        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :next_batch, :is_state, :has_state_key, :missing_previous)
         ON CONFLICT (event_id) DO NOTHING
         RETURNING event_id, event_nid`, chunk)
 		if err != nil {
@@ -313,10 +323,10 @@ func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, eventNID, snapID, repl
 }
 
 // query the latest events in each of the room IDs given, using highestNID as the highest event.
-func (t *EventTable) LatestEventInRooms(txn *sqlx.Tx, roomIDs []string, highestNID int64) (events []Event, err error) {
+func (t *EventTable) LatestEventInRooms(ctx context.Context, txn *sqlx.Tx, roomIDs []string, highestNID int64) (events []Event, err error) {
 	// the position (event nid) may be for a random different room, so we need to find the highest nid <= this position for this room
-	err = txn.Select(
-		&events,
+	err = txn.SelectContext(
+		ctx, &events,
 		`SELECT event_nid, room_id, event_replaces_nid, before_state_snapshot_id, event_type, state_key, event FROM syncv3_events
 		WHERE event_nid IN (SELECT max(event_nid) FROM syncv3_events WHERE event_nid <= $1 AND room_id = ANY($2) GROUP BY room_id)`,
 		highestNID, pq.StringArray(roomIDs),
@@ -327,11 +337,11 @@ func (t *EventTable) LatestEventInRooms(txn *sqlx.Tx, roomIDs []string, highestN
 	return
 }
 
-func (t *EventTable) LatestEventNIDInRooms(txn *sqlx.Tx, roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
+func (t *EventTable) LatestEventNIDInRooms(ctx context.Context, txn *sqlx.Tx, roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
 	// the position (event nid) may be for a random different room, so we need to find the highest nid <= this position for this room
 	var events []Event
-	err = txn.Select(
-		&events,
+	err = txn.SelectContext(
+		ctx, &events,
 		`SELECT event_nid, room_id FROM syncv3_events
 		WHERE event_nid IN (SELECT max(event_nid) FROM syncv3_events WHERE event_nid <= $1 AND room_id = ANY($2) GROUP BY room_id)`,
 		highestNID, pq.StringArray(roomIDs),
@@ -384,10 +394,10 @@ func (t *EventTable) Redact(txn *sqlx.Tx, roomVer string, redacteeEventIDToRedac
 	return nil
 }
 
-func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int) ([]Event, error) {
+func (t *EventTable) SelectLatestEventsBetween(ctx context.Context, txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int) ([]Event, error) {
 	var events []Event
 	// do not pull in events which were in the v2 state block
-	err := txn.Select(&events, `SELECT event_nid, event, missing_previous FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND room_id = $3 AND is_state=FALSE ORDER BY event_nid DESC LIMIT $4`,
+	err := txn.SelectContext(ctx, &events, `SELECT event_nid, event, missing_previous FROM syncv3_events WHERE event_nid > $1 AND event_nid <= $2 AND room_id = $3 AND is_state=FALSE ORDER BY event_nid DESC LIMIT $4`,
 		lowerExclusive, upperInclusive, roomID, limit,
 	)
 	if err != nil {
@@ -437,9 +447,9 @@ func (t *EventTable) selectLatestEventByTypeInAllRooms(txn *sqlx.Tx) ([]Event, e
 
 // Select all events between the bounds matching the type, state_key given.
 // Used to work out which rooms the user was joined to at a given point in time.
-func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
+func (t *EventTable) SelectEventsWithTypeStateKey(ctx context.Context, eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
 	var events []Event
-	err := t.db.Select(&events,
+	err := t.db.SelectContext(ctx, &events,
 		`SELECT event_nid, room_id, event FROM syncv3_events
 		WHERE event_nid > $1 AND event_nid <= $2 AND event_type = $3 AND state_key = $4
 		ORDER BY event_nid ASC`,
@@ -450,7 +460,7 @@ func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lo
 
 // Select all events between the bounds matching the type, state_key given, in the rooms specified only.
 // Used to work out which rooms the user was joined to at a given point in time.
-func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(roomIDs []string, eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
+func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(ctx context.Context, roomIDs []string, eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
 	var events []Event
 	query, args, err := sqlx.In(
 		`SELECT event_nid, room_id, event FROM syncv3_events
@@ -461,7 +471,7 @@ func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(roomIDs []string, event
 		return nil, err
 	}
 
-	err = t.db.Select(&events,
+	err = t.db.SelectContext(ctx, &events,
 		t.db.Rebind(query), args...,
 	)
 	return events, err
@@ -479,9 +489,10 @@ func (t *EventTable) SelectEventNIDsWithTypeInRoom(txn *sqlx.Tx, eventType strin
 // SelectClosestPrevBatchByID is the same as SelectClosestPrevBatch but works on event IDs not NIDs
 func (t *EventTable) SelectClosestPrevBatchByID(roomID string, eventID string) (prevBatch string, err error) {
 	err = t.db.QueryRow(
-		`SELECT prev_batch FROM syncv3_events WHERE prev_batch IS NOT NULL AND room_id=$1 AND event_nid >= (
+		`SELECT COALESCE(prev_batch, next_batch) FROM syncv3_events
+		WHERE (prev_batch IS NOT NULL OR next_batch IS NOT NULL) AND room_id=$1 AND event_nid >= (
 			SELECT event_nid FROM syncv3_events WHERE event_id = $2
-		) LIMIT 1`, roomID, eventID,
+		) ORDER BY event_nid ASC LIMIT 1`, roomID, eventID,
 	).Scan(&prevBatch)
 	if err == sql.ErrNoRows {
 		err = nil
@@ -491,9 +502,17 @@ func (t *EventTable) SelectClosestPrevBatchByID(roomID string, eventID string) (
 
 // Select the closest prev batch token for the provided event NID. Returns the empty string if there
 // is no closest.
-func (t *EventTable) SelectClosestPrevBatch(txn *sqlx.Tx, roomID string, eventNID int64) (prevBatch string, err error) {
-	err = txn.QueryRow(
-		`SELECT prev_batch FROM syncv3_events WHERE prev_batch IS NOT NULL AND room_id=$1 AND event_nid >= $2 LIMIT 1`, roomID, eventNID,
+//
+// The token is always an upstream token, so it can be used with the homeserver's /messages. Tokens
+// are only known for some events: the prev_batch of the first event and the next_batch of the last
+// event in each upstream timeline. Paginating backwards from a token at or after this event never
+// skips events, so the nearest token for an event at or after this one is returned, preferring a
+// prev_batch. This may return events the client already has, which clients de-duplicate.
+func (t *EventTable) SelectClosestPrevBatch(ctx context.Context, txn *sqlx.Tx, roomID string, eventNID int64) (prevBatch string, err error) {
+	err = txn.QueryRowContext(
+		ctx, `SELECT COALESCE(prev_batch, next_batch) FROM syncv3_events
+		WHERE (prev_batch IS NOT NULL OR next_batch IS NOT NULL) AND room_id=$1 AND event_nid >= $2
+		ORDER BY event_nid ASC LIMIT 1`, roomID, eventNID,
 	).Scan(&prevBatch)
 	if err == sql.ErrNoRows {
 		err = nil
@@ -501,6 +520,15 @@ func (t *EventTable) SelectClosestPrevBatch(txn *sqlx.Tx, roomID string, eventNI
 	return
 }
 
+// UpdateMissingPreviousAfter marks the oldest timeline event in this room with an NID greater than
+// `eventNID` as missing its previous event. Used when older timeline events have been purged.
+func (t *EventTable) UpdateMissingPreviousAfter(txn *sqlx.Tx, roomID string, eventNID int64) error {
+	_, err := txn.Exec(`UPDATE syncv3_events SET missing_previous = TRUE WHERE event_nid = (
+		SELECT MIN(event_nid) FROM syncv3_events WHERE room_id = $1 AND event_nid > $2 AND is_state = FALSE
+	)`, roomID, eventNID)
+	return err
+}
+
 func (t *EventTable) SelectCreateEvent(txn *sqlx.Tx, roomID string) (json.RawMessage, error) {
 	var evJSON []byte
 	// there is only 1 create event
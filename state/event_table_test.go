@@ -2,6 +2,7 @@ package state
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -96,7 +97,7 @@ func TestEventTable(t *testing.T) {
 		}
 	}
 	// query the snapshot
-	latestEvents, err := table.LatestEventInRooms(txn, []string{roomID}, idToNIDs["101"])
+	latestEvents, err := table.LatestEventInRooms(context.Background(), txn, []string{roomID}, idToNIDs["101"])
 	le := latestEvents[0]
 	if err != nil {
 		t.Fatalf("BeforeStateSnapshotIDForEventNID: %s", err)
@@ -109,7 +110,7 @@ func TestEventTable(t *testing.T) {
 		t.Fatalf("BeforeStateSnapshotIDForEventNID: didn't return last inserted event, got %d want %d", le.NID, idToNIDs["101"])
 	}
 	// try again with a much higher pos
-	latestEvents, err = table.LatestEventInRooms(txn, []string{roomID}, 999999)
+	latestEvents, err = table.LatestEventInRooms(context.Background(), txn, []string{roomID}, 999999)
 	le = latestEvents[0]
 	if err != nil {
 		t.Fatalf("BeforeStateSnapshotIDForEventNID: %s", err)
@@ -472,7 +473,7 @@ func TestEventTableSelectEventsWithTypeStateKey(t *testing.T) {
 		t.Fatalf("failed to select highest nid: %s", err)
 	}
 
-	gotEvents, err := table.SelectEventsWithTypeStateKey("m.room.member", userID, 0, latest)
+	gotEvents, err := table.SelectEventsWithTypeStateKey(context.Background(), "m.room.member", userID, 0, latest)
 	if err != nil {
 		t.Fatalf("SelectEventsWithTypeStateKey: %s", err)
 	}
@@ -494,7 +495,7 @@ func TestEventTableSelectEventsWithTypeStateKey(t *testing.T) {
 		t.Fatalf("SelectEventsWithTypeStateKey missed rooms: %v", wantRooms)
 	}
 
-	gotEvents, err = table.SelectEventsWithTypeStateKeyInRooms([]string{roomA, roomB, roomD}, "m.room.member", userID, 0, latest)
+	gotEvents, err = table.SelectEventsWithTypeStateKeyInRooms(context.Background(), []string{roomA, roomB, roomD}, "m.room.member", userID, 0, latest)
 	if err != nil {
 		t.Fatalf("SelectEventsWithTypeStateKeyInRooms: %s", err)
 	}
@@ -662,7 +663,7 @@ func TestEventTablePrevBatch(t *testing.T) {
 	assertPrevBatch := func(roomID string, index int, wantPrevBatch string) {
 		var gotPrevBatch string
 		_ = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
-			gotPrevBatch, err = table.SelectClosestPrevBatch(txn, roomID, int64(idToNID[events[index].ID]))
+			gotPrevBatch, err = table.SelectClosestPrevBatch(context.Background(), txn, roomID, int64(idToNID[events[index].ID]))
 			if err != nil {
 				t.Fatalf("failed to SelectClosestPrevBatch: %s", err)
 			}
@@ -835,7 +836,7 @@ func TestLatestEventNIDInRooms(t *testing.T) {
 	for _, tc := range testCases {
 		var gotRoomToNID map[string]int64
 		err = sqlutil.WithTransaction(table.db, func(txn *sqlx.Tx) error {
-			gotRoomToNID, err = table.LatestEventNIDInRooms(txn, tc.roomIDs, int64(tc.highestNID))
+			gotRoomToNID, err = table.LatestEventNIDInRooms(context.Background(), txn, tc.roomIDs, int64(tc.highestNID))
 			return err
 		})
 		assertNoError(t, err)
@@ -1218,7 +1219,7 @@ func TestEventTable_SelectLatestEventsBetween_MissingPrevious(t *testing.T) {
 		// We're using the notation (X, Y] for a half-open interval excluding X but including Y.
 		idRange := fmt.Sprintf("(%s, %s]", tc.FromIDExclusive, tc.ToIDInclusive)
 		t.Log(idRange + " " + tc.Desc)
-		fetched, err := table.SelectLatestEventsBetween(txn, roomID, nids[prefix+tc.FromIDExclusive], nids[prefix+tc.ToIDInclusive], 10)
+		fetched, err := table.SelectLatestEventsBetween(context.Background(), txn, roomID, nids[prefix+tc.FromIDExclusive], nids[prefix+tc.ToIDInclusive], 10)
 		assertNoError(t, err)
 		fetchedIDs := make([]string, 0, len(fetched))
 		for _, ev := range fetched {
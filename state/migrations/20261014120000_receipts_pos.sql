@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE SEQUENCE IF NOT EXISTS syncv3_receipts_seq;
+ALTER TABLE IF EXISTS syncv3_receipts
+    ADD COLUMN IF NOT EXISTS pos BIGINT NOT NULL DEFAULT nextval('syncv3_receipts_seq');
+ALTER TABLE IF EXISTS syncv3_receipts_private
+    ADD COLUMN IF NOT EXISTS pos BIGINT NOT NULL DEFAULT nextval('syncv3_receipts_seq');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE IF EXISTS syncv3_receipts DROP COLUMN IF EXISTS pos;
+ALTER TABLE IF EXISTS syncv3_receipts_private DROP COLUMN IF EXISTS pos;
+DROP SEQUENCE IF EXISTS syncv3_receipts_seq;
+-- +goose StatementEnd
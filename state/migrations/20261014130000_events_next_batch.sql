@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_events
+    ADD COLUMN IF NOT EXISTS next_batch TEXT;
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_events
+    DROP COLUMN IF EXISTS next_batch;
@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    ADD COLUMN IF NOT EXISTS inserted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_to_device_messages
+    DROP COLUMN IF EXISTS inserted_at;
@@ -0,0 +1,6 @@
+-- +goose Up
+-- positions are replaced on most requests, so allow for HOT updates
+ALTER TABLE IF EXISTS syncv3_conn_positions SET (fillfactor = 90);
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_conn_positions RESET (fillfactor);
@@ -0,0 +1,12 @@
+-- +goose Up
+ALTER TABLE IF EXISTS syncv3_events
+    ADD COLUMN IF NOT EXISTS has_state_key BOOLEAN NOT NULL DEFAULT TRUE;
+
+-- Only events with an empty state_key column can be message events, so only those need their JSON
+-- checking. This is done once here, so purging timeline events never has to parse them.
+UPDATE syncv3_events SET has_state_key = FALSE
+    WHERE state_key = '' AND NOT (convert_from(event, 'UTF8')::jsonb ? 'state_key');
+
+-- +goose Down
+ALTER TABLE IF EXISTS syncv3_events
+    DROP COLUMN IF EXISTS has_state_key;
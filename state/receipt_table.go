@@ -36,6 +36,8 @@ func NewReceiptTable(db *sqlx.DB) *ReceiptTable {
 	tableNames := []string{
 		"syncv3_receipts", "syncv3_receipts_private",
 	}
+	// both tables share a sequence so `pos` orders all receipt changes
+	db.MustExec(`CREATE SEQUENCE IF NOT EXISTS syncv3_receipts_seq;`)
 	schema := `
 	CREATE TABLE IF NOT EXISTS %s (
 		room_id TEXT NOT NULL,
@@ -43,15 +45,18 @@ func NewReceiptTable(db *sqlx.DB) *ReceiptTable {
 		thread_id TEXT NOT NULL,
 		event_id TEXT NOT NULL,
 		ts BIGINT NOT NULL,
+		pos BIGINT NOT NULL DEFAULT nextval('syncv3_receipts_seq'),
 		UNIQUE(room_id, user_id, thread_id)
 	);
 	-- for querying by events in the timeline, need to search by event id
 	CREATE INDEX IF NOT EXISTS %s_by_event_idx ON %s(room_id, event_id);
 	-- for querying all receipts for a user in a room, need to search by user id
 	CREATE INDEX IF NOT EXISTS %s_by_user_idx ON %s(room_id, user_id);
+	-- for querying a user's receipts in every room
+	CREATE INDEX IF NOT EXISTS %s_by_user_all_rooms_idx ON %s(user_id);
 	`
 	for _, tableName := range tableNames {
-		db.MustExec(fmt.Sprintf(schema, tableName, tableName, tableName, tableName, tableName))
+		db.MustExec(fmt.Sprintf(schema, tableName, tableName, tableName, tableName, tableName, tableName, tableName))
 	}
 	return &ReceiptTable{db}
 }
@@ -93,22 +98,45 @@ func (t *ReceiptTable) Insert(roomID string, ephEvent json.RawMessage) (receipts
 // The parsed receipts are returned so callers can use information in the receipts in further queries
 // e.g to pull out profile information for users read receipts. Call PackReceiptsIntoEDU when sending to clients.
 func (t *ReceiptTable) SelectReceiptsForEvents(roomID string, eventIDs []string) (receipts []internal.Receipt, err error) {
+	return t.SelectReceiptsForEventsSince(roomID, eventIDs, 0)
+}
+
+// SelectReceiptsForEventsSince is like SelectReceiptsForEvents but only returns receipts which
+// changed after the position `since`.
+func (t *ReceiptTable) SelectReceiptsForEventsSince(roomID string, eventIDs []string, since int64) (receipts []internal.Receipt, err error) {
 	err = t.db.Select(&receipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts
-		WHERE room_id=$1 AND event_id = ANY($2)`, roomID, pq.StringArray(eventIDs))
+		WHERE room_id=$1 AND event_id = ANY($2) AND pos > $3`, roomID, pq.StringArray(eventIDs), since)
 	return
 }
 
 // Select all (including private) receipts for this user in these rooms.
 func (t *ReceiptTable) SelectReceiptsForUser(roomIDs []string, userID string) (receiptsByRoom map[string][]internal.Receipt, err error) {
+	return t.SelectReceiptsForUserSince(roomIDs, userID, 0)
+}
+
+// SelectReceiptsForUserSince is like SelectReceiptsForUser but only returns receipts which changed
+// after the position `since`.
+func (t *ReceiptTable) SelectReceiptsForUserSince(roomIDs []string, userID string, since int64) (receiptsByRoom map[string][]internal.Receipt, err error) {
+	return t.selectReceiptsForUser(`room_id=ANY($1) AND user_id = $2 AND pos > $3`, pq.StringArray(roomIDs), userID, since)
+}
+
+// SelectReceiptsForUserInAllRoomsSince returns all (including private) receipts for this user in
+// every room which changed after the position `since`.
+func (t *ReceiptTable) SelectReceiptsForUserInAllRoomsSince(userID string, since int64) (receiptsByRoom map[string][]internal.Receipt, err error) {
+	return t.selectReceiptsForUser(`user_id = $1 AND pos > $2`, userID, since)
+}
+
+// selectReceiptsForUser returns the public and private receipts matching the WHERE clause, bucketed by room.
+func (t *ReceiptTable) selectReceiptsForUser(where string, args ...interface{}) (receiptsByRoom map[string][]internal.Receipt, err error) {
 	var receipts []internal.Receipt
 	err = t.db.Select(&receipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts
-	WHERE room_id=ANY($1) AND user_id = $2`, pq.StringArray(roomIDs), userID)
+	WHERE `+where, args...)
 	if err != nil {
 		return nil, err
 	}
 	var privReceipts []internal.Receipt
 	err = t.db.Select(&privReceipts, `SELECT room_id, event_id, user_id, ts, thread_id FROM syncv3_receipts_private
-	WHERE room_id=ANY($1) AND user_id = $2`, pq.StringArray(roomIDs), userID)
+	WHERE `+where, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -125,6 +153,12 @@ func (t *ReceiptTable) SelectReceiptsForUser(roomIDs []string, userID string) (r
 	return receiptsByRoom, nil
 }
 
+// LatestPos returns the position of the most recent receipt change, or 0 if there are no receipts.
+func (t *ReceiptTable) LatestPos() (pos int64, err error) {
+	err = t.db.QueryRow(`SELECT CASE WHEN is_called THEN last_value ELSE 0 END FROM syncv3_receipts_seq`).Scan(&pos)
+	return
+}
+
 func (t *ReceiptTable) bulkInsert(tableName string, txn *sqlx.Tx, receipts []internal.Receipt) (newReceipts []internal.Receipt, err error) {
 	if len(receipts) == 0 {
 		return
@@ -138,7 +172,7 @@ func (t *ReceiptTable) bulkInsert(tableName string, txn *sqlx.Tx, receipts []int
 	for _, chunk := range chunks {
 		rows, err := txn.NamedQuery(`
 			INSERT INTO `+tableName+` AS old (room_id, event_id, user_id, ts, thread_id)
-			VALUES (:room_id, :event_id, :user_id, :ts, :thread_id) ON CONFLICT (room_id, user_id, thread_id) DO UPDATE SET event_id=excluded.event_id, ts=excluded.ts WHERE old.event_id <> excluded.event_id
+			VALUES (:room_id, :event_id, :user_id, :ts, :thread_id) ON CONFLICT (room_id, user_id, thread_id) DO UPDATE SET event_id=excluded.event_id, ts=excluded.ts, pos=nextval('syncv3_receipts_seq') WHERE old.event_id <> excluded.event_id
 			RETURNING room_id, user_id, thread_id, event_id, ts`, chunk)
 		if err != nil {
 			return nil, err
@@ -388,3 +388,130 @@ func TestReceiptTable(t *testing.T) {
 		},
 	})
 }
+
+func TestReceiptTableSince(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	roomID := "!A:ReceiptTableSince"
+	table := NewReceiptTable(db)
+	_, err := table.Insert(roomID, json.RawMessage(`{
+		"content": {
+		  "$first": {
+			"m.read": {"@alice:localhost": {"ts": 1}},
+			"m.read.private": {"@bob:localhost": {"ts": 1}}
+		  }
+		},
+		"type": "m.receipt"
+	  }`))
+	assertNoError(t, err)
+	since, err := table.LatestPos()
+	assertNoError(t, err)
+	if since == 0 {
+		t.Fatalf("LatestPos: got 0 after inserting receipts")
+	}
+	// nothing has changed since the latest position
+	got, err := table.SelectReceiptsForEventsSince(roomID, []string{"$first", "$second"}, since)
+	assertNoError(t, err)
+	parsedReceiptsEqual(t, got, nil)
+
+	// alice's receipt moves and bob's private receipt is unchanged
+	_, err = table.Insert(roomID, json.RawMessage(`{
+		"content": {
+		  "$second": {
+			"m.read": {"@alice:localhost": {"ts": 2}},
+			"m.read.private": {"@bob:localhost": {"ts": 1}}
+		  }
+		},
+		"type": "m.receipt"
+	  }`))
+	assertNoError(t, err)
+	_, err = table.Insert(roomID, json.RawMessage(`{
+		"content": {
+		  "$first": {
+			"m.read.private": {"@bob:localhost": {"ts": 1}}
+		  }
+		},
+		"type": "m.receipt"
+	  }`))
+	assertNoError(t, err)
+	got, err = table.SelectReceiptsForEventsSince(roomID, []string{"$first", "$second"}, since)
+	assertNoError(t, err)
+	parsedReceiptsEqual(t, got, []internal.Receipt{
+		{RoomID: roomID, EventID: "$second", UserID: "@alice:localhost", TS: 2},
+	})
+	byRoom, err := table.SelectReceiptsForUserSince([]string{roomID}, "@bob:localhost", since)
+	assertNoError(t, err)
+	parsedReceiptsEqual(t, byRoom[roomID], nil)
+	// without a position, everything is returned
+	byRoom, err = table.SelectReceiptsForUserSince([]string{roomID}, "@bob:localhost", 0)
+	assertNoError(t, err)
+	parsedReceiptsEqual(t, byRoom[roomID], []internal.Receipt{
+		{RoomID: roomID, EventID: "$first", UserID: "@bob:localhost", TS: 1, IsPrivate: true},
+	})
+	latest, err := table.LatestPos()
+	assertNoError(t, err)
+	if latest <= since {
+		t.Fatalf("LatestPos: got %d want more than %d", latest, since)
+	}
+}
+
+func TestReceiptTableUserInAllRooms(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	roomA := "!A:ReceiptTableUserInAllRooms"
+	roomB := "!B:ReceiptTableUserInAllRooms"
+	alice := "@alice:ReceiptTableUserInAllRooms"
+	table := NewReceiptTable(db)
+	_, err := table.Insert(roomA, json.RawMessage(`{
+		"content": {
+		  "$a": {
+			"m.read": {"@alice:ReceiptTableUserInAllRooms": {"ts": 1}, "@bob:localhost": {"ts": 1}},
+			"m.read.private": {"@bob:localhost": {"ts": 1}}
+		  }
+		},
+		"type": "m.receipt"
+	  }`))
+	assertNoError(t, err)
+	_, err = table.Insert(roomB, json.RawMessage(`{
+		"content": {
+		  "$b": {
+			"m.read.private": {"@alice:ReceiptTableUserInAllRooms": {"ts": 2}}
+		  }
+		},
+		"type": "m.receipt"
+	  }`))
+	assertNoError(t, err)
+	// only alice's receipts are returned, including her private receipts
+	byRoom, err := table.SelectReceiptsForUserInAllRoomsSince(alice, 0)
+	assertNoError(t, err)
+	if len(byRoom) != 2 {
+		t.Fatalf("got receipts for %d rooms, want 2: %+v", len(byRoom), byRoom)
+	}
+	parsedReceiptsEqual(t, byRoom[roomA], []internal.Receipt{
+		{RoomID: roomA, EventID: "$a", UserID: alice, TS: 1},
+	})
+	parsedReceiptsEqual(t, byRoom[roomB], []internal.Receipt{
+		{RoomID: roomB, EventID: "$b", UserID: alice, TS: 2, IsPrivate: true},
+	})
+
+	// only changed receipts are returned after a position
+	since, err := table.LatestPos()
+	assertNoError(t, err)
+	_, err = table.Insert(roomA, json.RawMessage(`{
+		"content": {
+		  "$a2": {
+			"m.read": {"@alice:ReceiptTableUserInAllRooms": {"ts": 3}}
+		  }
+		},
+		"type": "m.receipt"
+	  }`))
+	assertNoError(t, err)
+	byRoom, err = table.SelectReceiptsForUserInAllRoomsSince(alice, since)
+	assertNoError(t, err)
+	if len(byRoom) != 1 {
+		t.Fatalf("got receipts for %d rooms, want 1: %+v", len(byRoom), byRoom)
+	}
+	parsedReceiptsEqual(t, byRoom[roomA], []internal.Receipt{
+		{RoomID: roomA, EventID: "$a2", UserID: alice, TS: 3},
+	})
+}
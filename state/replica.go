@@ -0,0 +1,83 @@
+package state
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// how long after finding the replica behind a position before asking it again, so that requests
+// for the latest position don't all query the replica while it catches up.
+const replicaPositionCheckInterval = 100 * time.Millisecond
+
+// readReplica is a read-only replica of the database which reads at or before an event position
+// are sent to, to take load off the primary. Replication lags behind the primary, so reads are
+// only sent to the replica once it has the events up to their position. Until then they go to the
+// primary, so that events which were just written are never missing.
+//
+// Event NIDs are allocated before their transaction commits, so they can commit out of order: a
+// replica may have NID 101 without NID 100. Instead, the replica is compared with the primary by
+// their WAL positions, so the replica must be a physical streaming replica. Once the replica has
+// replayed the WAL up to where the primary had written it, it has every event the primary had then.
+type readReplica struct {
+	db *sqlx.DB
+
+	mu *sync.Mutex
+	// the latest event NID the primary had when the replica was last found to have caught up
+	pos       int64
+	checkedAt time.Time
+}
+
+// SetReadReplica sends event reads which are at or before a position to this read-only replica of
+// the database, once it has replicated up to that position. See readDB.
+func (s *Storage) SetReadReplica(db *sqlx.DB) {
+	s.replica = &readReplica{
+		db: db,
+		mu: &sync.Mutex{},
+	}
+}
+
+// readDB returns the database to read events at or before pos from: the replica if there is one and
+// it has replicated up to pos, else the primary.
+func (s *Storage) readDB(pos int64) *sqlx.DB {
+	r := s.replica
+	if r == nil {
+		return s.DB
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if pos <= r.pos {
+		return r.db
+	}
+	if time.Since(r.checkedAt) < replicaPositionCheckInterval {
+		return s.DB
+	}
+	r.checkedAt = time.Now()
+	// the latest event NID and the WAL position of the primary, from the same snapshot
+	var primaryPos int64
+	var primaryLSN string
+	err := s.DB.QueryRow(`SELECT COALESCE(MAX(event_nid), 0), pg_current_wal_lsn() FROM syncv3_events`).Scan(&primaryPos, &primaryLSN)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to check primary position, reading from primary")
+		return s.DB
+	}
+	// a server which isn't replaying WAL is taken to be the primary itself e.g in tests
+	var caughtUp bool
+	err = r.db.QueryRow(
+		`SELECT CASE WHEN pg_is_in_recovery() THEN COALESCE(pg_last_wal_replay_lsn() >= $1::pg_lsn, FALSE) ELSE TRUE END`,
+		primaryLSN,
+	).Scan(&caughtUp)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to check read replica position, reading from primary")
+		return s.DB
+	}
+	if !caughtUp {
+		return s.DB
+	}
+	r.pos = primaryPos
+	if pos <= r.pos {
+		return r.db
+	}
+	return s.DB
+}
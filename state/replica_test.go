@@ -0,0 +1,50 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Test that reads go to the replica only once it has the events up to their position.
+func TestStorageReadReplica(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	// a second connection to the same database stands in for the replica. It isn't replaying WAL,
+	// so it is always caught up with the primary, and only positions the primary has are read from it.
+	replica, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open replica: %s", err)
+	}
+	store.SetReadReplica(replica)
+	roomID := "!TestStorageReadReplica:localhost"
+	mustPersistEvents(t, roomID, store, persistOpts{withInitialEvents: true, numTimelineEvents: 1})
+	latestNID, err := store.LatestEventNID()
+	mustNotError(t, err)
+
+	if got := store.readDB(latestNID); got != replica {
+		t.Errorf("readDB at the latest position did not use the replica")
+	}
+	// the replica doesn't have events beyond the latest yet
+	if got := store.readDB(latestNID + 1); got != store.DB {
+		t.Errorf("readDB beyond the replica's position did not use the primary")
+	}
+	// once the replica has them, reads use it again
+	mustPersistEvents(t, roomID, store, persistOpts{numTimelineEvents: 1})
+	time.Sleep(replicaPositionCheckInterval)
+	if got := store.readDB(latestNID + 1); got != replica {
+		t.Errorf("readDB did not use the replica once it caught up")
+	}
+	// reads through the replica return the same events as the primary
+	got, err := store.LatestEventsInRooms(context.Background(), userID, []string{roomID}, latestNID+1, 10)
+	mustNotError(t, err)
+	store.replica = nil
+	want, err := store.LatestEventsInRooms(context.Background(), userID, []string{roomID}, latestNID+1, 10)
+	mustNotError(t, err)
+	if len(got[roomID].Timeline) == 0 || len(got[roomID].Timeline) != len(want[roomID].Timeline) {
+		t.Errorf("LatestEventsInRooms: got %d events from the replica want %d", len(got[roomID].Timeline), len(want[roomID].Timeline))
+	}
+	mustNotError(t, replica.Close())
+}
@@ -0,0 +1,79 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy is how long timeline events are kept for in a room, and how many are kept. The
+// zero value keeps events forever.
+type RetentionPolicy struct {
+	// MaxAge is how long timeline events are kept for. 0 means no limit.
+	MaxAge time.Duration
+	// MaxEvents is the number of timeline events to keep. 0 means no limit.
+	MaxEvents int
+}
+
+func (p RetentionPolicy) keepsForever() bool {
+	return p.MaxAge <= 0 && p.MaxEvents <= 0
+}
+
+// ParseRoomRetention parses a comma separated list of room IDs, each followed by =hours/events
+// e.g "!a:example.com=72/1000,!b:example.com=0/200". Hours or events of 0 mean no limit, so
+// "!c:example.com=0/0" keeps the room's events forever.
+func ParseRoomRetention(s string) (map[string]RetentionPolicy, error) {
+	if s == "" {
+		return nil, nil
+	}
+	policies := make(map[string]RetentionPolicy)
+	for _, entry := range strings.Split(s, ",") {
+		roomID, limits, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || !strings.HasPrefix(roomID, "!") {
+			return nil, fmt.Errorf("invalid room ID in %q", entry)
+		}
+		hours, events, ok := strings.Cut(limits, "/")
+		if !ok {
+			return nil, fmt.Errorf("missing /events in %q", entry)
+		}
+		maxAgeHours, err := strconv.Atoi(hours)
+		if err != nil || maxAgeHours < 0 {
+			return nil, fmt.Errorf("invalid hours in %q", entry)
+		}
+		maxEvents, err := strconv.Atoi(events)
+		if err != nil || maxEvents < 0 {
+			return nil, fmt.Errorf("invalid events in %q", entry)
+		}
+		if _, exists := policies[roomID]; exists {
+			return nil, fmt.Errorf("room %s is listed more than once", roomID)
+		}
+		policies[roomID] = RetentionPolicy{
+			MaxAge:    time.Duration(maxAgeHours) * time.Hour,
+			MaxEvents: maxEvents,
+		}
+	}
+	return policies, nil
+}
+
+// Compact runs each of the retention jobs once: it removes inaccessible state snapshots, then
+// purges timeline events, to-device messages and backfilled history according to the configured
+// retention. A job which fails does not stop the others from running. Returns the errors of the
+// jobs which failed.
+func (s *Storage) Compact(now time.Time) error {
+	var errs []error
+	if err := s.RemoveInaccessibleStateSnapshots(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := s.PurgeTimelineEvents(now); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := s.PurgeToDeviceMessages(now); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := s.PurgeBackfill(now); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,41 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRoomRetention(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    map[string]RetentionPolicy
+		wantErr bool
+	}{
+		{input: "", want: nil},
+		{
+			input: "!a:example.com=72/1000, !b:example.com=0/200,!c:example.com=0/0",
+			want: map[string]RetentionPolicy{
+				"!a:example.com": {MaxAge: 72 * time.Hour, MaxEvents: 1000},
+				"!b:example.com": {MaxEvents: 200},
+				"!c:example.com": {},
+			},
+		},
+		{input: "!a:example.com", wantErr: true},
+		{input: "!a:example.com=72", wantErr: true},
+		{input: "#a:example.com=72/1000", wantErr: true},
+		{input: "!a:example.com=-1/1000", wantErr: true},
+		{input: "!a:example.com=72/lots", wantErr: true},
+		{input: "!a:example.com=72/1000,,!b:example.com=0/200", wantErr: true},
+		{input: "!a:example.com=72/1000,!a:example.com=0/200", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseRoomRetention(tc.input)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseRoomRetention(%q): got err %v want err %v", tc.input, err, tc.wantErr)
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseRoomRetention(%q): got %v want %v", tc.input, got, tc.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package state
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -68,10 +69,36 @@ type Storage struct {
 	TransactionsTable *TransactionsTable
 	DeviceDataTable   *DeviceDataTable
 	ReceiptTable      *ReceiptTable
-	DB                *sqlx.DB
-	MaxTimelineLimit  int
-	shutdownCh        chan struct{}
-	shutdown          bool
+	ThreadTable       *ThreadTable
+	BackfillTable     *BackfillTable
+	// ConnPositionsTable saves connection positions, if the proxy is configured to.
+	ConnPositionsTable *ConnPositionsTable
+	DB                 *sqlx.DB
+	MaxTimelineLimit   int
+	// EventRetention is how long timeline events are kept for before they can be purged. 0 means
+	// events are kept forever, unless MaxEventsPerRoom is set.
+	EventRetention time.Duration
+	// ToDeviceRetention is how long to-device messages are kept for, whether or not they have
+	// been sent. 0 means messages are kept until the device acknowledges them.
+	ToDeviceRetention time.Duration
+	// MaxToDeviceMessages is the number of to-device messages to keep per device before older
+	// messages are purged. 0 means no limit.
+	MaxToDeviceMessages int
+	// BackfillRetention is how long pages of history fetched from the homeserver are kept for.
+	// 0 means pages are kept forever.
+	BackfillRetention time.Duration
+	// MaxEventsPerRoom is the number of timeline events to keep per room before older events can
+	// be purged. 0 means no limit. This is never less than MaxTimelineLimit.
+	MaxEventsPerRoom int
+	// RoomRetention are the retention policies of rooms which do not use EventRetention and
+	// MaxEventsPerRoom.
+	RoomRetention map[string]RetentionPolicy
+	// nil if reads all go to DB, see SetReadReplica
+	replica    *readReplica
+	shutdownCh chan struct{}
+	shutdown   bool
+	// true if this storage registered the DB metrics, so should unregister them
+	metricsRegistered bool
 }
 
 func NewStorage(postgresURI string) *Storage {
@@ -85,6 +112,9 @@ func NewStorage(postgresURI string) *Storage {
 }
 
 func NewStorageWithDB(db *sqlx.DB, addPrometheusMetrics bool) *Storage {
+	if addPrometheusMetrics {
+		sqlutil.RegisterMetrics()
+	}
 	acc := &Accumulator{
 		db:            db,
 		roomsTable:    NewRoomsTable(db),
@@ -92,22 +122,28 @@ func NewStorageWithDB(db *sqlx.DB, addPrometheusMetrics bool) *Storage {
 		snapshotTable: NewSnapshotsTable(db),
 		spacesTable:   NewSpacesTable(db),
 		invitesTable:  NewInvitesTable(db),
+		threadTable:   NewThreadTable(db),
 		entityName:    "server",
+		MaxEventSize:  internal.DefaultMaxEventSize,
 	}
 
 	return &Storage{
-		Accumulator:       acc,
-		ToDeviceTable:     NewToDeviceTable(db),
-		UnreadTable:       NewUnreadTable(db),
-		EventsTable:       acc.eventsTable,
-		AccountDataTable:  NewAccountDataTable(db),
-		InvitesTable:      acc.invitesTable,
-		TransactionsTable: NewTransactionsTable(db),
-		DeviceDataTable:   NewDeviceDataTable(db),
-		ReceiptTable:      NewReceiptTable(db),
-		DB:                db,
-		MaxTimelineLimit:  50,
-		shutdownCh:        make(chan struct{}),
+		Accumulator:        acc,
+		ToDeviceTable:      NewToDeviceTable(db),
+		UnreadTable:        NewUnreadTable(db),
+		EventsTable:        acc.eventsTable,
+		AccountDataTable:   NewAccountDataTable(db),
+		InvitesTable:       acc.invitesTable,
+		TransactionsTable:  NewTransactionsTable(db),
+		DeviceDataTable:    NewDeviceDataTable(db),
+		ReceiptTable:       NewReceiptTable(db),
+		ThreadTable:        acc.threadTable,
+		BackfillTable:      NewBackfillTable(db),
+		ConnPositionsTable: NewConnPositionsTable(db),
+		DB:                 db,
+		MaxTimelineLimit:   50,
+		shutdownCh:         make(chan struct{}),
+		metricsRegistered:  addPrometheusMetrics,
 	}
 }
 
@@ -115,6 +151,39 @@ func (s *Storage) LatestEventNID() (int64, error) {
 	return s.Accumulator.eventsTable.SelectHighestNID()
 }
 
+// ThreadSummaries returns summaries of the `limit` most recently active threads in each room, with
+// unread counts based on userID's read receipts. Rooms without threads are omitted.
+func (s *Storage) ThreadSummaries(roomIDs []string, userID string, limit int) (map[string][]ThreadSummary, error) {
+	receiptsByRoom, err := s.ReceiptTable.SelectReceiptsForUser(roomIDs, userID)
+	if err != nil {
+		return nil, fmt.Errorf("SelectReceiptsForUser: %w", err)
+	}
+	result := make(map[string][]ThreadSummary)
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		for _, roomID := range roomIDs {
+			receipts := receiptsByRoom[roomID]
+			eventIDs := make([]string, len(receipts))
+			for i := range receipts {
+				eventIDs[i] = receipts[i].EventID
+			}
+			eventNIDs, err := s.EventsTable.SelectNIDsByIDs(txn, eventIDs)
+			if err != nil {
+				return fmt.Errorf("SelectNIDsByIDs: %w", err)
+			}
+			readNIDs, unthreadedNID := ThreadReadNIDs(receipts, eventNIDs)
+			summaries, err := s.ThreadTable.SelectThreadSummaries(txn, roomID, userID, limit, readNIDs, unthreadedNID)
+			if err != nil {
+				return fmt.Errorf("SelectThreadSummaries: %w", err)
+			}
+			if len(summaries) > 0 {
+				result[roomID] = summaries
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
 func (s *Storage) AccountData(userID, roomID string, eventTypes []string) (data []AccountData, err error) {
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
 		data, err = s.AccountDataTable.Select(txn, userID, eventTypes, roomID)
@@ -132,10 +201,20 @@ func (s *Storage) RoomAccountDatasWithType(userID, eventType string) (data []Acc
 }
 
 // Pull out all account data for this user. If roomIDs is empty, global account data is returned.
-// If roomIDs is non-empty, all account data for these rooms are extracted.
-func (s *Storage) AccountDatas(userID string, roomIDs ...string) (datas []AccountData, err error) {
+// If roomIDs is non-empty, all account data for these rooms are extracted. If eventTypes is
+// non-empty, only account data of those types is returned.
+func (s *Storage) AccountDatas(userID string, eventTypes []string, roomIDs ...string) (datas []AccountData, err error) {
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
-		datas, err = s.AccountDataTable.SelectMany(txn, userID, roomIDs...)
+		datas, err = s.AccountDataTable.SelectMany(txn, userID, eventTypes, roomIDs...)
+		return err
+	})
+	return
+}
+
+// LatestAccountDataID returns the ID of the most recently changed account data for this user.
+func (s *Storage) LatestAccountDataID(userID string) (id int64, err error) {
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		id, err = s.AccountDataTable.SelectLatestID(txn, userID)
 		return err
 	})
 	return
@@ -244,7 +323,7 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 
 	// Select the name / canonical alias for all rooms
 	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInAllRooms(txn, []string{
-		"m.room.name", "m.room.canonical_alias", "m.room.avatar",
+		"m.room.name", "m.room.canonical_alias", "m.room.avatar", "m.room.guest_access",
 	})
 	if err != nil {
 		return fmt.Errorf("failed to load state events for all rooms: %s", err)
@@ -258,6 +337,8 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 				metadata.CanonicalAlias = gjson.ParseBytes(ev.JSON).Get("content.alias").Str
 			} else if ev.Type == "m.room.avatar" && ev.StateKey == "" {
 				metadata.AvatarEvent = gjson.ParseBytes(ev.JSON).Get("content.url").Str
+			} else if ev.Type == "m.room.guest_access" && ev.StateKey == "" {
+				metadata.GuestAccess = gjson.ParseBytes(ev.JSON).Get("content.guest_access").Str == "can_join"
 			}
 		}
 		result[roomID] = metadata
@@ -295,21 +376,35 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 		metadata := loadMetadata(roomID)
 		metadata.ChildSpaceRooms = make(map[string]struct{}, len(relations))
 		for _, r := range relations {
-			// For now we only honour child state events, but we store all the mappings just in case.
 			if r.Relation == RelationMSpaceChild {
 				metadata.ChildSpaceRooms[r.Child] = struct{}{}
 			}
 		}
 		result[roomID] = metadata
 	}
+	// rooms claiming to be in these spaces, which are only loaded if the child room is known
+	for _, relations := range spaceRoomToRelations {
+		for _, r := range relations {
+			if _, exists := result[r.Child]; !exists || r.Relation != RelationMSpaceParent {
+				continue
+			}
+			metadata := result[r.Child]
+			if metadata.ParentSpaceRooms == nil {
+				metadata.ParentSpaceRooms = make(map[string]struct{})
+			}
+			metadata.ParentSpaceRooms[r.Parent] = struct{}{}
+			result[r.Child] = metadata
+		}
+	}
 	return nil
 }
 
 // ResetMetadataState updates the given metadata in-place to reflect the current state
 // of the room. This is only safe to call from the subscriber goroutine; it is not safe
-// to call from the connection goroutines.
+// to call from the connection goroutines. If skipMembers is true, membership events are not
+// loaded and the heroes, join and invite counts in the metadata are left as they are.
 // TODO: could have this create a new RoomMetadata and get the caller to assign it.
-func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
+func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata, skipMembers bool) error {
 	var events []Event
 	err := s.DB.Select(&events, `
 	WITH snapshot(events, membership_events) AS (
@@ -322,17 +417,19 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 	FROM syncv3_events JOIN snapshot ON (
 		event_nid = ANY (ARRAY_CAT(events, membership_events))
 	)
-	WHERE (event_type IN ('m.room.name', 'm.room.avatar', 'm.room.canonical_alias', 'm.room.encryption') AND state_key = '')
-	   OR (event_type = 'm.room.member' AND membership IN ('join', '_join', 'invite', '_invite'))
+	WHERE (event_type IN ('m.room.name', 'm.room.avatar', 'm.room.canonical_alias', 'm.room.encryption', 'm.room.guest_access') AND state_key = '')
+	   OR (event_type = 'm.room.member' AND membership IN ('join', '_join', 'invite', '_invite') AND NOT $2)
 	ORDER BY event_nid ASC
-	;`, metadata.RoomID)
+	;`, metadata.RoomID, skipMembers)
 	if err != nil {
 		return fmt.Errorf("ResetMetadataState[%s]: %w", metadata.RoomID, err)
 	}
 
 	heroMemberships := circularSlice[*Event]{max: 6}
-	metadata.JoinCount = 0
-	metadata.InviteCount = 0
+	if !skipMembers {
+		metadata.JoinCount = 0
+		metadata.InviteCount = 0
+	}
 	metadata.ChildSpaceRooms = make(map[string]struct{})
 
 	for i, ev := range events {
@@ -345,6 +442,8 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 			metadata.CanonicalAlias = gjson.GetBytes(ev.JSON, "content.alias").Str
 		case "m.room.encryption":
 			metadata.Encrypted = true
+		case "m.room.guest_access":
+			metadata.GuestAccess = gjson.GetBytes(ev.JSON, "content.guest_access").Str == "can_join"
 		case "m.room.member":
 			heroMemberships.append(&events[i])
 			switch ev.Membership {
@@ -362,6 +461,9 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 		}
 	}
 
+	if skipMembers {
+		return nil
+	}
 	metadata.Heroes = make([]internal.Hero, 0, len(heroMemberships.vals))
 	for _, ev := range heroMemberships.vals {
 		parsed := gjson.ParseBytes(ev.JSON)
@@ -519,7 +621,7 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 	defer span.End()
 	roomToEvents = make(map[string][]Event, len(roomIDs))
 	roomIndex := make(map[string]int, len(roomIDs))
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithTransactionContext(ctx, s.readDB(pos), func(txn *sqlx.Tx) error {
 		// we have 2 ways to pull the latest events:
 		//  - superfast rooms table (which races as it can be updated before the new state hits the dispatcher)
 		//  - slower events table query
@@ -546,7 +648,7 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 		}
 		if len(slowRooms) > 0 {
 			logger.Warn().Int("slow_rooms", len(slowRooms)).Msg("RoomStateAfterEventPosition: pos value provided is far behind the database copy, performance degraded")
-			latestSlowEvents, err := s.Accumulator.eventsTable.LatestEventInRooms(txn, slowRooms, pos)
+			latestSlowEvents, err := s.Accumulator.eventsTable.LatestEventInRooms(ctx, txn, slowRooms, pos)
 			if err != nil {
 				return err
 			}
@@ -662,7 +764,7 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 			if err != nil {
 				return fmt.Errorf("failed to form sql query: %s", err)
 			}
-			rows, err := txn.Query(txn.Rebind(query), args...)
+			rows, err := txn.QueryContext(ctx, txn.Rebind(query), args...)
 			if err != nil {
 				return fmt.Errorf("failed to execute query: %s", err)
 			}
@@ -712,8 +814,8 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 // - that the user has permission to see
 // - with NIDs <= `to`.
 // Up to `limit` events are chosen per room. This limit be itself be limited according to MaxTimelineLimit.
-func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*LatestEvents, error) {
-	roomIDToRange, err := s.visibleEventNIDsBetweenForRooms(userID, roomIDs, 0, to)
+func (s *Storage) LatestEventsInRooms(ctx context.Context, userID string, roomIDs []string, to int64, limit int) (map[string]*LatestEvents, error) {
+	roomIDToRange, err := s.visibleEventNIDsBetweenForRooms(ctx, userID, roomIDs, 0, to)
 	if err != nil {
 		return nil, err
 	}
@@ -721,13 +823,13 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 		limit = s.MaxTimelineLimit
 	}
 	result := make(map[string]*LatestEvents, len(roomIDs))
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithTransactionContext(ctx, s.readDB(to), func(txn *sqlx.Tx) error {
 		for roomID, r := range roomIDToRange {
 			var earliestEventNID int64
 			var latestEventNID int64
 			var roomEvents []json.RawMessage
 			// the most recent event will be first
-			events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit)
+			events, err := s.EventsTable.SelectLatestEventsBetween(ctx, txn, roomID, r[0]-1, r[1], limit)
 			if err != nil {
 				return fmt.Errorf("room %s failed to SelectEventsBetween: %s", roomID, err)
 			}
@@ -749,7 +851,7 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 			}
 			if earliestEventNID != 0 {
 				// the oldest event needs a prev batch token, so find one now
-				prevBatch, err := s.EventsTable.SelectClosestPrevBatch(txn, roomID, earliestEventNID)
+				prevBatch, err := s.EventsTable.SelectClosestPrevBatch(ctx, txn, roomID, earliestEventNID)
 				if err != nil {
 					return fmt.Errorf("failed to select prev_batch for room %s : %s", roomID, err)
 				}
@@ -793,7 +895,10 @@ func (s *Storage) RemoveInaccessibleStateSnapshots() error {
 	  )
 	  DELETE FROM syncv3_snapshots USING ranked_snapshots
 	  WHERE syncv3_snapshots.snapshot_id = ranked_snapshots.snapshot_id
-	  AND ranked_snapshots.row_num > %d;`, numToKeep)
+	  AND ranked_snapshots.row_num > %d
+	  AND NOT EXISTS (
+		SELECT 1 FROM syncv3_rooms WHERE syncv3_rooms.current_snapshot_id = syncv3_snapshots.snapshot_id
+	  );`, numToKeep)
 
 	result, err := s.DB.Exec(awfulQuery)
 	if err != nil {
@@ -806,11 +911,176 @@ func (s *Storage) RemoveInaccessibleStateSnapshots() error {
 	return nil
 }
 
-func (s *Storage) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string) {
+// purgeTimelineEventsBatchSize is the most events PurgeTimelineEvents deletes in one transaction.
+const purgeTimelineEventsBatchSize = 1000
+
+// PurgeTimelineEvents removes old timeline events according to EventRetention and MaxEventsPerRoom,
+// or the room's RoomRetention policy if it has one. Which events are purged:
+//   - Only timeline events without a state_key. State events are never purged, as they may be
+//     referenced by snapshots.
+//   - Never the most recent MaxTimelineLimit timeline events in each room, so the proxy can always
+//     serve the largest timeline_limit.
+//   - Only events older than the room's max age (based on origin_server_ts), or beyond the
+//     room's most recent max events. When a room has both, events are purged if either applies.
+//
+// Rooms are purged one at a time, in batches of purgeTimelineEventsBatchSize events with a
+// transaction per batch, so the events table is never locked for long. The oldest remaining
+// timeline event in each purged room is marked as missing_previous, so timelines stop at the gap
+// and clients backfill from the prev_batch token via the homeserver. Returns the number of events
+// purged.
+func (s *Storage) PurgeTimelineEvents(now time.Time) (int64, error) {
+	defaultPolicy := RetentionPolicy{
+		MaxAge:    s.EventRetention,
+		MaxEvents: s.MaxEventsPerRoom,
+	}
+	if defaultPolicy.keepsForever() && len(s.RoomRetention) == 0 {
+		return 0, nil
+	}
+	var roomIDs []string
+	if defaultPolicy.keepsForever() {
+		// only rooms with their own policy can have events to purge
+		for roomID := range s.RoomRetention {
+			roomIDs = append(roomIDs, roomID)
+		}
+	} else if err := s.DB.Select(&roomIDs, `SELECT room_id FROM syncv3_rooms`); err != nil {
+		return 0, fmt.Errorf("failed to PurgeTimelineEvents: failed to select rooms: %s", err)
+	}
+	var numPurged int64
+	for _, roomID := range roomIDs {
+		policy, ok := s.RoomRetention[roomID]
+		if !ok {
+			policy = defaultPolicy
+		}
+		if policy.keepsForever() {
+			continue
+		}
+		purged, err := s.purgeTimelineEvents(policy, now, roomID)
+		numPurged += purged
+		if err != nil {
+			return numPurged, fmt.Errorf("failed to PurgeTimelineEvents in room %s: %s", roomID, err)
+		}
+	}
+	logger.Info().Int64("rows_affected", numPurged).Msg("PurgeTimelineEvents: deleted rows")
+	return numPurged, nil
+}
+
+// purgeTimelineEvents deletes the timeline events in the room which the policy does not keep.
+// Returns the number of events purged.
+func (s *Storage) purgeTimelineEvents(policy RetentionPolicy, now time.Time, roomID string) (int64, error) {
+	numToKeep := s.MaxTimelineLimit
+	if numToKeep < 1 {
+		numToKeep = 1 // always keep the latest event: it is referenced by the rooms table
+	}
+	// newestNIDBefore returns the newest timeline event which isn't one of the most recent n, or 0
+	// if the room has no more than n timeline events.
+	newestNIDBefore := func(n int) (int64, error) {
+		var nid int64
+		err := s.DB.QueryRow(`SELECT event_nid FROM syncv3_events WHERE room_id = $1 AND is_state = FALSE
+			ORDER BY event_nid DESC OFFSET $2 LIMIT 1`, roomID, n).Scan(&nid)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return nid, err
+	}
+	// Only this event and older ones can be purged, so the most recent numToKeep are never purged.
+	newestNID, err := newestNIDBefore(numToKeep)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select newest purgeable event: %w", err)
+	}
+	if newestNID == 0 {
+		return 0, nil
+	}
+	// Of these, events are purged if they are beyond the cap, or older than the retention period.
+	var capNID int64 // events up to and including this one are beyond the cap, 0 means none are
+	if policy.MaxEvents > 0 {
+		if policy.MaxEvents <= numToKeep {
+			capNID = newestNID
+		} else if capNID, err = newestNIDBefore(policy.MaxEvents); err != nil {
+			return 0, fmt.Errorf("failed to select newest event beyond the cap: %w", err)
+		}
+	}
+	var olderThanTs int64 // origin_server_ts in msecs, 0 means no retention period
+	if policy.MaxAge > 0 {
+		olderThanTs = now.Add(-policy.MaxAge).UnixMilli()
+	}
+	if capNID == 0 && olderThanTs == 0 {
+		return 0, nil
+	}
+	var numPurged int64
+	for {
+		var purgedNIDs []int64
+		err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+			err := txn.Select(&purgedNIDs, `DELETE FROM syncv3_events WHERE event_nid IN (
+				SELECT event_nid FROM syncv3_events
+				WHERE room_id = $1 AND event_nid <= $2 AND is_state = FALSE AND has_state_key = FALSE
+				AND (event_nid <= $3 OR ($4::BIGINT > 0 AND COALESCE((convert_from(event, 'UTF8')::jsonb->>'origin_server_ts')::BIGINT, 0) < $4::BIGINT))
+				ORDER BY event_nid LIMIT $5
+			  ) RETURNING event_nid`, roomID, newestNID, capNID, olderThanTs, purgeTimelineEventsBatchSize)
+			if err != nil {
+				return fmt.Errorf("failed to delete timeline events: %w", err)
+			}
+			if len(purgedNIDs) == 0 {
+				return nil
+			}
+			var newestPurgedNID int64
+			for _, nid := range purgedNIDs {
+				if nid > newestPurgedNID {
+					newestPurgedNID = nid
+				}
+			}
+			if err = s.EventsTable.UpdateMissingPreviousAfter(txn, roomID, newestPurgedNID); err != nil {
+				return fmt.Errorf("failed to mark gap: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return numPurged, err
+		}
+		numPurged += int64(len(purgedNIDs))
+		if len(purgedNIDs) < purgeTimelineEventsBatchSize {
+			return numPurged, nil
+		}
+	}
+}
+
+// PurgeToDeviceMessages removes to-device messages older than ToDeviceRetention, and all but the
+// most recent MaxToDeviceMessages messages for each device. Returns the number of messages purged.
+func (s *Storage) PurgeToDeviceMessages(now time.Time) (int64, error) {
+	var olderThan time.Time
+	if s.ToDeviceRetention > 0 {
+		olderThan = now.Add(-s.ToDeviceRetention)
+	}
+	numPurged, err := s.ToDeviceTable.Purge(olderThan, s.MaxToDeviceMessages)
+	if err != nil {
+		return 0, fmt.Errorf("failed to PurgeToDeviceMessages: %s", err)
+	}
+	if numPurged > 0 {
+		logger.Info().Int64("rows_affected", numPurged).Msg("PurgeToDeviceMessages: deleted rows")
+	}
+	return numPurged, nil
+}
+
+// PurgeBackfill removes pages of history which were fetched longer than BackfillRetention ago.
+// Returns the number of pages purged.
+func (s *Storage) PurgeBackfill(now time.Time) (int64, error) {
+	if s.BackfillRetention <= 0 {
+		return 0, nil
+	}
+	numPurged, err := s.BackfillTable.Purge(now.Add(-s.BackfillRetention))
+	if err != nil {
+		return 0, fmt.Errorf("failed to PurgeBackfill: %s", err)
+	}
+	if numPurged > 0 {
+		logger.Info().Int64("rows_affected", numPurged).Msg("PurgeBackfill: deleted rows")
+	}
+	return numPurged, nil
+}
+
+func (s *Storage) GetClosestPrevBatch(ctx context.Context, roomID string, eventNID int64) (prevBatch string) {
 	var err error
-	sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+	sqlutil.WithTransactionContext(ctx, s.DB, func(txn *sqlx.Tx) error {
 		// discard the error, we don't care if we fail as it's best effort
-		prevBatch, err = s.EventsTable.SelectClosestPrevBatch(txn, roomID, eventNID)
+		prevBatch, err = s.EventsTable.SelectClosestPrevBatch(ctx, txn, roomID, eventNID)
 		return err
 	})
 	return
@@ -819,13 +1089,13 @@ func (s *Storage) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch
 // visibleEventNIDsBetweenForRooms determines which events a given user has permission to see.
 // It accepts a nid range [from, to]. For each given room, it calculates the NID range
 // [A1, B1] within [from, to] in which the user has permission to see events.
-func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []string, from, to int64) (map[string][2]int64, error) {
+func (s *Storage) visibleEventNIDsBetweenForRooms(ctx context.Context, userID string, roomIDs []string, from, to int64) (map[string][2]int64, error) {
 	// load *THESE* joined rooms for this user at from (inclusive)
 	var membershipEvents []Event
 	var err error
 	if from != 0 {
 		// if from==0 then this query will return nothing, so optimise it out
-		membershipEvents, err = s.Accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms(roomIDs, "m.room.member", userID, 0, from)
+		membershipEvents, err = s.Accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms(ctx, roomIDs, "m.room.member", userID, 0, from)
 		if err != nil {
 			return nil, fmt.Errorf("VisibleEventNIDsBetweenForRooms.SelectEventsWithTypeStateKeyInRooms: %s", err)
 		}
@@ -836,7 +1106,7 @@ func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []strin
 	}
 
 	// load membership deltas for *THESE* rooms for this user
-	membershipEvents, err = s.Accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms(roomIDs, "m.room.member", userID, from, to)
+	membershipEvents, err = s.Accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms(ctx, roomIDs, "m.room.member", userID, from, to)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load membership events: %s", err)
 	}
@@ -874,13 +1144,13 @@ func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []strin
 //	- For Room E: from=1, to=15 returns { RoomE: [ 13,15 ] } (tests invites)
 func (s *Storage) VisibleEventNIDsBetween(userID string, from, to int64) (map[string][2]int64, error) {
 	// load *ALL* joined rooms for this user at from (inclusive)
-	joinTimingsAtFromByRoomID, err := s.JoinedRoomsAfterPosition(userID, from)
+	joinTimingsAtFromByRoomID, err := s.JoinedRoomsAfterPosition(context.Background(), userID, from)
 	if err != nil {
 		return nil, fmt.Errorf("failed to work out joined rooms for %s at pos %d: %s", userID, from, err)
 	}
 
 	// load *ALL* membership deltas for all rooms for this user
-	membershipEvents, err := s.Accumulator.eventsTable.SelectEventsWithTypeStateKey("m.room.member", userID, from, to)
+	membershipEvents, err := s.Accumulator.eventsTable.SelectEventsWithTypeStateKey(context.Background(), "m.room.member", userID, from, to)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load membership events: %s", err)
 	}
@@ -1088,10 +1358,15 @@ Loop:
 				logger.Warn().Err(err).Msg("failed to clean txn ID table")
 				sentry.CaptureException(err)
 			}
-			// we also want to clean up stale state snapshots which are inaccessible, to
-			// keep the size of the syncv3_snapshots table low.
-			if err = s.RemoveInaccessibleStateSnapshots(); err != nil {
-				logger.Warn().Err(err).Msg("failed to remove inaccessible state snapshots")
+			// connections expire long before this, so their positions can't be resumed
+			if err = s.ConnPositionsTable.Clean(boundaryTime); err != nil {
+				logger.Warn().Err(err).Msg("failed to clean conn positions table")
+				sentry.CaptureException(err)
+			}
+			// we also want to clean up stale state snapshots which are inaccessible, and purge
+			// anything past its retention, to keep the size of the database down.
+			if err = s.Compact(now); err != nil {
+				logger.Warn().Err(err).Msg("failed to compact database")
 				sentry.CaptureException(err)
 			}
 		case <-s.shutdownCh:
@@ -1100,9 +1375,9 @@ Loop:
 	}
 }
 
-func (s *Storage) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
+func (s *Storage) LatestEventNIDInRooms(ctx context.Context, roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
 	roomToNID = make(map[string]int64)
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithTransactionContext(ctx, s.readDB(highestNID), func(txn *sqlx.Tx) error {
 		// Pull out the latest nids for all the rooms. If they are < highestNID then use them, else we need to query the
 		// events table (slow) for the latest nid in this room which is < highestNID.
 		fastRoomToLatestNIDs, err := s.Accumulator.roomsTable.LatestNIDs(txn, roomIDs)
@@ -1125,7 +1400,7 @@ func (s *Storage) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roo
 		}
 		logger.Warn().Int("slow_rooms", len(slowRooms)).Msg("LatestEventNIDInRooms: pos value provided is far behind the database copy, performance degraded")
 
-		slowRoomToLatestNIDs, err := s.EventsTable.LatestEventNIDInRooms(txn, slowRooms, highestNID)
+		slowRoomToLatestNIDs, err := s.EventsTable.LatestEventNIDInRooms(ctx, txn, slowRooms, highestNID)
 		if err != nil {
 			return err
 		}
@@ -1139,11 +1414,11 @@ func (s *Storage) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roo
 
 // Returns a map from joined room IDs to EventMetadata, which is nil iff a non-nil error
 // is returned.
-func (s *Storage) JoinedRoomsAfterPosition(userID string, pos int64) (
+func (s *Storage) JoinedRoomsAfterPosition(ctx context.Context, userID string, pos int64) (
 	joinTimingByRoomID map[string]internal.EventMetadata, err error,
 ) {
 	// fetch all the membership events up to and including pos
-	membershipEvents, err := s.Accumulator.eventsTable.SelectEventsWithTypeStateKey("m.room.member", userID, 0, pos)
+	membershipEvents, err := s.Accumulator.eventsTable.SelectEventsWithTypeStateKey(ctx, "m.room.member", userID, 0, pos)
 	if err != nil {
 		return nil, fmt.Errorf("JoinedRoomsAfterPosition.SelectEventsWithTypeStateKey: %s", err)
 	}
@@ -1193,11 +1468,19 @@ func (s *Storage) Teardown() {
 		s.shutdown = true
 		close(s.shutdownCh)
 	}
+	if s.metricsRegistered {
+		sqlutil.UnregisterMetrics()
+	}
 
 	err := s.Accumulator.db.Close()
 	if err != nil {
 		panic("Storage.Teardown: " + err.Error())
 	}
+	if s.replica != nil {
+		if err = s.replica.db.Close(); err != nil {
+			panic("Storage.Teardown: " + err.Error())
+		}
+	}
 }
 
 // circularSlice is a slice which can be appended to which will wraparound at `max`.
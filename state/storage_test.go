@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"reflect"
 	"sort"
 	"testing"
@@ -170,7 +173,7 @@ func TestStorageJoinedRoomsAfterPosition(t *testing.T) {
 		}
 		latestPos = accResult.TimelineNIDs[len(accResult.TimelineNIDs)-1]
 	}
-	aliceJoinTimingsByRoomID, err := store.JoinedRoomsAfterPosition(alice, latestPos)
+	aliceJoinTimingsByRoomID, err := store.JoinedRoomsAfterPosition(context.Background(), alice, latestPos)
 	if err != nil {
 		t.Fatalf("failed to JoinedRoomsAfterPosition: %s", err)
 	}
@@ -182,7 +185,7 @@ func TestStorageJoinedRoomsAfterPosition(t *testing.T) {
 			t.Fatalf("JoinedRoomsAfterPosition at %v for %s got %v want %v", latestPos, alice, gotRoomID, joinedRoomID)
 		}
 	}
-	bobJoinTimingsByRoomID, err := store.JoinedRoomsAfterPosition(bob, latestPos)
+	bobJoinTimingsByRoomID, err := store.JoinedRoomsAfterPosition(context.Background(), bob, latestPos)
 	if err != nil {
 		t.Fatalf("failed to JoinedRoomsAfterPosition: %s", err)
 	}
@@ -377,7 +380,7 @@ func TestVisibleEventNIDsBetween(t *testing.T) {
 	}
 
 	// check that we can query subsets too
-	roomIDToVisibleRangesSubset, err := store.visibleEventNIDsBetweenForRooms(alice, []string{roomA, roomB}, startPos, latestPos)
+	roomIDToVisibleRangesSubset, err := store.visibleEventNIDsBetweenForRooms(context.Background(), alice, []string{roomA, roomB}, startPos, latestPos)
 	if err != nil {
 		t.Fatalf("VisibleEventNIDsBetweenForRooms to %d: %s", latestPos, err)
 	}
@@ -567,7 +570,7 @@ func TestStorageLatestEventsInRoomsPrevBatch(t *testing.T) {
 		// closest batch to the last event in the chunk (latest nid) is always the next prev batch token
 		var pb string
 		_ = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) (err error) {
-			pb, err = store.EventsTable.SelectClosestPrevBatch(txn, roomID, eventNID)
+			pb, err = store.EventsTable.SelectClosestPrevBatch(context.Background(), txn, roomID, eventNID)
 			if err != nil {
 				t.Fatalf("failed to SelectClosestPrevBatch: %s", err)
 			}
@@ -580,6 +583,116 @@ func TestStorageLatestEventsInRoomsPrevBatch(t *testing.T) {
 	}
 }
 
+// Test that the prev_batch tokens returned for timelines can be used with the upstream homeserver's
+// /messages without skipping any events. The mock upstream hands out tokens which are positions in
+// the room's stream: paginating backwards from position N returns the events before N.
+func TestStoragePrevBatchWithUpstreamMessages(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStoragePrevBatchWithUpstreamMessages:localhost"
+	alice := "@alice_TestStoragePrevBatchWithUpstreamMessages:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	assertNoError(t, err)
+
+	// the upstream room stream
+	var upstream []json.RawMessage
+	for i := 0; i < 10; i++ {
+		upstream = append(upstream, testutils.NewMessageEvent(t, alice, fmt.Sprintf("%d", i)))
+	}
+	token := func(pos int) string {
+		return fmt.Sprintf("s%d", pos)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var pos int
+		if _, err := fmt.Sscanf(req.URL.Query().Get("from"), "s%d", &pos); err != nil || req.URL.Query().Get("dir") != "b" || pos > len(upstream) {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"errcode":"M_INVALID_PARAM"}`))
+			return
+		}
+		var chunk []json.RawMessage
+		for i := pos - 1; i >= 0; i-- {
+			chunk = append(chunk, upstream[i])
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"chunk": chunk,
+			"start": req.URL.Query().Get("from"),
+			"end":   token(0),
+		})
+	}))
+	defer srv.Close()
+	messages := func(from string) []string {
+		t.Helper()
+		res, err := http.Get(srv.URL + "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/messages?dir=b&from=" + url.QueryEscape(from))
+		assertNoError(t, err)
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("/messages from %q: got HTTP %d", from, res.StatusCode)
+		}
+		var body struct {
+			Chunk []json.RawMessage `json:"chunk"`
+		}
+		assertNoError(t, json.NewDecoder(res.Body).Decode(&body))
+		var eventIDs []string
+		for _, ev := range body.Chunk {
+			eventIDs = append(eventIDs, gjson.GetBytes(ev, "event_id").Str)
+		}
+		return eventIDs
+	}
+
+	// the pollers see the room in 3 syncs
+	for _, chunk := range [][2]int{{0, 4}, {4, 7}, {7, 10}} {
+		_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{
+			Events:    upstream[chunk[0]:chunk[1]],
+			PrevBatch: token(chunk[0]),
+			NextBatch: token(chunk[1]),
+		})
+		assertNoError(t, err)
+	}
+	eventIDs := make([]string, len(upstream))
+	for i, ev := range upstream {
+		eventIDs[i] = gjson.GetBytes(ev, "event_id").Str
+	}
+	var idsToNIDs map[string]int64
+	_ = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+		idsToNIDs, err = store.EventsTable.SelectNIDsByIDs(txn, eventIDs)
+		return err
+	})
+	assertNoError(t, err)
+
+	// whichever event the timeline starts at, paginating from prev_batch must return the event
+	// before it, possibly after events the client already has.
+	for i := range upstream {
+		prevBatch := store.GetClosestPrevBatch(context.Background(), roomID, idsToNIDs[eventIDs[i]])
+		if prevBatch == "" {
+			t.Fatalf("timeline starting at event %d: no prev_batch", i)
+		}
+		paginated := messages(prevBatch)
+		if i == 0 {
+			if len(paginated) != 0 {
+				t.Fatalf("timeline starting at the first event: got %v from /messages want nothing", paginated)
+			}
+			continue
+		}
+		// drop events the client has, then the next event must be the one before the timeline
+		for len(paginated) > 0 && paginated[0] != eventIDs[i-1] {
+			paginated = paginated[1:]
+		}
+		if len(paginated) == 0 {
+			t.Fatalf("timeline starting at event %d: /messages from %s skipped event %d", i, prevBatch, i-1)
+		}
+	}
+	// exact tokens are used when known
+	if got := store.GetClosestPrevBatch(context.Background(), roomID, idsToNIDs[eventIDs[4]]); got != token(4) {
+		t.Errorf("timeline starting at event 4: got prev_batch %s want %s", got, token(4))
+	}
+	if got := store.GetClosestPrevBatch(context.Background(), roomID, idsToNIDs[eventIDs[8]]); got != token(10) {
+		t.Errorf("timeline starting at event 8: got prev_batch %s want %s", got, token(10))
+	}
+}
+
 func TestGlobalSnapshot(t *testing.T) {
 	alice := "@TestGlobalSnapshot_alice:localhost"
 	bob := "@TestGlobalSnapshot_bob:localhost"
@@ -1066,6 +1179,212 @@ func TestRemoveInaccessibleStateSnapshots(t *testing.T) {
 	}))
 }
 
+func TestPurgeTimelineEvents(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	numEventsInRoom := func(roomID string) int {
+		t.Helper()
+		var val int
+		if err := store.DB.QueryRow(`SELECT count(*) FROM syncv3_events WHERE room_id=$1`, roomID).Scan(&val); err != nil {
+			t.Fatalf("failed to count events: %s", err)
+		}
+		return val
+	}
+	assertLatestEvents := func(roomID string, wantNumEvents int, wantPrevBatch string) {
+		t.Helper()
+		to, err := store.LatestEventNID()
+		mustNotError(t, err)
+		latest, err := store.LatestEventsInRooms(context.Background(), userID, []string{roomID}, to, 50)
+		mustNotError(t, err)
+		if got := len(latest[roomID].Timeline); got != wantNumEvents {
+			t.Errorf("LatestEventsInRooms: got %d events want %d", got, wantNumEvents)
+		}
+		if latest[roomID].PrevBatch != wantPrevBatch {
+			t.Errorf("LatestEventsInRooms: got prev_batch %q want %q", latest[roomID].PrevBatch, wantPrevBatch)
+		}
+	}
+	accumulate := func(roomID string, events []json.RawMessage, prevBatch string) {
+		t.Helper()
+		_, err := store.Accumulate(userID, roomID, sync2.TimelineResponse{Events: events, PrevBatch: prevBatch})
+		mustNotError(t, err)
+	}
+	messages := func(n int, ts time.Time) []json.RawMessage {
+		events := make([]json.RawMessage, n)
+		for i := range events {
+			events[i] = testutils.NewMessageEvent(t, userID, fmt.Sprintf("msg %d", i), testutils.WithTimestamp(ts))
+		}
+		return events
+	}
+
+	// a room with 4 initial state events, 10 messages, then 6 state events (one with an empty
+	// state_key) and 25 messages, then 15 messages.
+	roomCapped := "!TestPurgeTimelineEvents_capped:localhost"
+	mustPersistEvents(t, roomCapped, store, persistOpts{withInitialEvents: true, numTimelineEvents: 10})
+	var batchB []json.RawMessage
+	for i := 0; i < 5; i++ {
+		batchB = append(batchB, testutils.NewStateEvent(t, "some_kind_of_state", fmt.Sprintf("%d", i), userID, map[string]interface{}{}))
+	}
+	batchB = append(batchB, testutils.NewStateEvent(t, "m.room.topic", "", userID, map[string]interface{}{"topic": "purging"}))
+	accumulate(roomCapped, append(batchB, messages(25, time.Now())...), "batch B")
+	accumulate(roomCapped, messages(15, time.Now()), "batch C")
+	if got := numEventsInRoom(roomCapped); got != 60 {
+		t.Fatalf("got %d events want 60", got)
+	}
+
+	store.MaxTimelineLimit = 10
+	store.MaxEventsPerRoom = 20
+	_, err := store.PurgeTimelineEvents(time.Now())
+	mustNotError(t, err)
+	// the 20 most recent events are kept, along with all state events
+	if got := numEventsInRoom(roomCapped); got != 4+6+20 {
+		t.Fatalf("got %d events want %d", got, 4+6+20)
+	}
+	// timelines stop at the gap, and the prev_batch lets clients backfill from the homeserver
+	store.MaxTimelineLimit = 50
+	assertLatestEvents(roomCapped, 20, "batch C")
+	// state is unaffected
+	mustNotError(t, sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+		snapID, err := store.Accumulator.roomsTable.CurrentAfterSnapshotID(txn, roomCapped)
+		if err != nil {
+			return err
+		}
+		state, err := store.StateSnapshot(snapID)
+		if err != nil {
+			return err
+		}
+		if len(state) != 10 {
+			return fmt.Errorf("got %d state events want 10", len(state))
+		}
+		return nil
+	}))
+	// purging again does nothing
+	store.MaxTimelineLimit = 10
+	_, err = store.PurgeTimelineEvents(time.Now())
+	mustNotError(t, err)
+	if got := numEventsInRoom(roomCapped); got != 30 {
+		t.Fatalf("purging again removed events: got %d events want 30", got)
+	}
+	// new events are served as normal
+	accumulate(roomCapped, messages(1, time.Now()), "")
+	store.MaxTimelineLimit = 50
+	assertLatestEvents(roomCapped, 21, "batch C")
+
+	// a room with 10 messages from 2 days ago, then 5 new messages
+	roomRetention := "!TestPurgeTimelineEvents_retention:localhost"
+	mustPersistEvents(t, roomRetention, store, persistOpts{withInitialEvents: true})
+	accumulate(roomRetention, messages(10, time.Now().Add(-48*time.Hour)), "batch D")
+	accumulate(roomRetention, messages(5, time.Now()), "batch E")
+	store.MaxTimelineLimit = 3
+	store.MaxEventsPerRoom = 0
+	store.EventRetention = 24 * time.Hour
+	_, err = store.PurgeTimelineEvents(time.Now())
+	mustNotError(t, err)
+	if got := numEventsInRoom(roomRetention); got != 4+5 {
+		t.Fatalf("got %d events want %d", got, 4+5)
+	}
+	store.MaxTimelineLimit = 50
+	assertLatestEvents(roomRetention, 5, "batch E")
+	// the capped room only has recent events, so is untouched
+	if got := numEventsInRoom(roomCapped); got != 31 {
+		t.Fatalf("retention purged recent events: got %d events want 31", got)
+	}
+}
+
+// Test that rooms with their own retention policy are purged according to it, and not the default.
+func TestPurgeTimelineEventsRoomRetention(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	numEventsInRoom := func(roomID string) int {
+		t.Helper()
+		var val int
+		if err := store.DB.QueryRow(`SELECT count(*) FROM syncv3_events WHERE room_id=$1`, roomID).Scan(&val); err != nil {
+			t.Fatalf("failed to count events: %s", err)
+		}
+		return val
+	}
+	// each room has 4 initial state events and 20 messages
+	roomDefault := "!TestPurgeTimelineEventsRoomRetention_default:localhost"
+	roomCapped := "!TestPurgeTimelineEventsRoomRetention_capped:localhost"
+	roomForever := "!TestPurgeTimelineEventsRoomRetention_forever:localhost"
+	for _, roomID := range []string{roomDefault, roomCapped, roomForever} {
+		mustPersistEvents(t, roomID, store, persistOpts{withInitialEvents: true, numTimelineEvents: 20})
+	}
+
+	store.MaxTimelineLimit = 5
+	store.MaxEventsPerRoom = 10
+	store.RoomRetention = map[string]RetentionPolicy{
+		roomCapped:  {MaxEvents: 5},
+		roomForever: {},
+	}
+	_, err := store.PurgeTimelineEvents(time.Now())
+	mustNotError(t, err)
+	for roomID, want := range map[string]int{
+		roomDefault: 4 + 10,
+		roomCapped:  4 + 5,
+		roomForever: 4 + 20,
+	} {
+		if got := numEventsInRoom(roomID); got != want {
+			t.Errorf("%s: got %d events want %d", roomID, got, want)
+		}
+	}
+}
+
+// Test that rooms with both a max age and max events purge events which are beyond the cap or too
+// old, but never the most recent MaxTimelineLimit events.
+func TestPurgeTimelineEventsAgeAndCap(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	numEventsInRoom := func(roomID string) int {
+		t.Helper()
+		var val int
+		if err := store.DB.QueryRow(`SELECT count(*) FROM syncv3_events WHERE room_id=$1`, roomID).Scan(&val); err != nil {
+			t.Fatalf("failed to count events: %s", err)
+		}
+		return val
+	}
+	messages := func(n int, ts time.Time) []json.RawMessage {
+		events := make([]json.RawMessage, n)
+		for i := range events {
+			events[i] = testutils.NewMessageEvent(t, userID, fmt.Sprintf("msg %d", i), testutils.WithTimestamp(ts))
+		}
+		return events
+	}
+	accumulate := func(roomID string, events []json.RawMessage) {
+		t.Helper()
+		_, err := store.Accumulate(userID, roomID, sync2.TimelineResponse{Events: events, PrevBatch: "prev"})
+		mustNotError(t, err)
+	}
+	// each room has 4 initial state events
+	roomOld := "!TestPurgeTimelineEventsAgeAndCap_old:localhost"
+	roomNew := "!TestPurgeTimelineEventsAgeAndCap_new:localhost"
+	roomAllOld := "!TestPurgeTimelineEventsAgeAndCap_all_old:localhost"
+	for _, roomID := range []string{roomOld, roomNew, roomAllOld} {
+		mustPersistEvents(t, roomID, store, persistOpts{withInitialEvents: true})
+	}
+	// 10 old messages then 5 new ones: the old ones within the cap are purged as they are too old
+	accumulate(roomOld, messages(10, time.Now().Add(-48*time.Hour)))
+	accumulate(roomOld, messages(5, time.Now()))
+	// 20 new messages: the ones beyond the cap are purged even though they are new
+	accumulate(roomNew, messages(20, time.Now()))
+	// 20 old messages: the most recent MaxTimelineLimit are kept
+	accumulate(roomAllOld, messages(20, time.Now().Add(-48*time.Hour)))
+
+	store.MaxTimelineLimit = 3
+	store.EventRetention = 24 * time.Hour
+	store.MaxEventsPerRoom = 10
+	_, err := store.PurgeTimelineEvents(time.Now())
+	mustNotError(t, err)
+	for roomID, want := range map[string]int{
+		roomOld:    4 + 5,
+		roomNew:    4 + 10,
+		roomAllOld: 4 + 3,
+	} {
+		if got := numEventsInRoom(roomID); got != want {
+			t.Errorf("%s: got %d events want %d", roomID, got, want)
+		}
+	}
+}
+
 func createInitialEvents(t *testing.T, creator string) []json.RawMessage {
 	t.Helper()
 	baseTimestamp := time.Now()
@@ -1136,3 +1455,90 @@ func verifyRange(t *testing.T, result map[string][2]int64, roomID string, wantRa
 		t.Errorf("%s range got %v want %v", roomID, gotRange, wantRange)
 	}
 }
+
+func TestStorageThreadSummaries(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageThreadSummaries:localhost"
+	alice := "@TestStorageThreadSummaries_alice:localhost"
+	bob := "@TestStorageThreadSummaries_bob:localhost"
+	mustPersistEvents(t, roomID, store, persistOpts{withInitialEvents: true})
+	eventID := func(ev json.RawMessage) string {
+		return gjson.GetBytes(ev, "event_id").Str
+	}
+	reply := func(sender, threadID string) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.message", sender, map[string]interface{}{
+			"body": "reply",
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.thread",
+				"event_id": threadID,
+			},
+		})
+	}
+	root1 := testutils.NewMessageEvent(t, bob, "root 1")
+	root2 := testutils.NewMessageEvent(t, bob, "root 2")
+	thread1 := []json.RawMessage{reply(bob, eventID(root1)), reply(alice, eventID(root1)), reply(bob, eventID(root1))}
+	thread2 := []json.RawMessage{reply(bob, eventID(root2))}
+	mainMsg := testutils.NewMessageEvent(t, bob, "main")
+	_, err := store.Accumulate(userID, roomID, sync2.TimelineResponse{
+		Events: []json.RawMessage{root1, root2, thread1[0], thread2[0], thread1[1], thread1[2], mainMsg},
+	})
+	mustNotError(t, err)
+	sendReceipt := func(eventID, threadID string) {
+		t.Helper()
+		info := map[string]interface{}{"ts": 1}
+		if threadID != "" {
+			info["thread_id"] = threadID
+		}
+		_, err := store.ReceiptTable.Insert(roomID, testutils.NewEvent(t, "m.receipt", "", map[string]interface{}{
+			eventID: map[string]interface{}{
+				"m.read": map[string]interface{}{alice: info},
+			},
+		}))
+		mustNotError(t, err)
+	}
+	assertUnread := func(wantThread1, wantThread2 int) {
+		t.Helper()
+		summaries, err := store.ThreadSummaries([]string{roomID, "!no_threads:localhost"}, alice, 10)
+		mustNotError(t, err)
+		if len(summaries) != 1 {
+			t.Fatalf("got summaries for %d rooms want 1: %+v", len(summaries), summaries)
+		}
+		got := summaries[roomID]
+		// thread 1 has the latest reply
+		if len(got) != 2 || got[0].ThreadID != eventID(root1) || got[1].ThreadID != eventID(root2) {
+			t.Fatalf("got threads %+v want [%s %s]", got, eventID(root1), eventID(root2))
+		}
+		if got[0].NumReplies != 3 || got[0].LatestEventID != eventID(thread1[2]) || got[1].NumReplies != 1 || got[1].LatestEventID != eventID(thread2[0]) {
+			t.Errorf("got threads %+v", got)
+		}
+		if got[0].NumUnread != wantThread1 || got[1].NumUnread != wantThread2 {
+			t.Errorf("got unread counts %d, %d want %d, %d", got[0].NumUnread, got[1].NumUnread, wantThread1, wantThread2)
+		}
+	}
+	// alice's own reply is never unread
+	assertUnread(2, 1)
+	// a threaded receipt only clears its own thread
+	sendReceipt(eventID(thread1[1]), eventID(root1))
+	assertUnread(1, 1)
+	// a main timeline receipt doesn't affect threads
+	sendReceipt(eventID(mainMsg), ThreadMainTimeline)
+	assertUnread(1, 1)
+	// an unthreaded receipt clears every thread up to that point
+	sendReceipt(eventID(thread2[0]), "")
+	assertUnread(1, 0)
+	sendReceipt(eventID(mainMsg), "")
+	assertUnread(0, 0)
+	// new replies are unread
+	_, err = store.Accumulate(userID, roomID, sync2.TimelineResponse{
+		Events: []json.RawMessage{reply(bob, eventID(root2))},
+	})
+	mustNotError(t, err)
+	assertUnread(0, 1)
+	// the limit returns the most recently active threads
+	summaries, err := store.ThreadSummaries([]string{roomID}, alice, 1)
+	mustNotError(t, err)
+	if len(summaries[roomID]) != 1 || summaries[roomID][0].ThreadID != eventID(root2) {
+		t.Fatalf("got %+v want only thread %s", summaries[roomID], eventID(root2))
+	}
+}
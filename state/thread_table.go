@@ -0,0 +1,174 @@
+package state
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/tidwall/gjson"
+)
+
+// ThreadMainTimeline is the thread_id of receipts which only apply to the main timeline.
+const ThreadMainTimeline = "main"
+
+// ThreadReply is a timeline event with an m.thread relation.
+type ThreadReply struct {
+	NID      int64  `db:"event_nid"`
+	RoomID   string `db:"room_id"`
+	ThreadID string `db:"thread_id"`
+	EventID  string `db:"event_id"`
+	Sender   string `db:"sender"`
+}
+
+// NewThreadReplyFromEvent returns the thread reply for this event, or nil if it is not in a thread.
+func NewThreadReplyFromEvent(ev Event) *ThreadReply {
+	event := gjson.ParseBytes(ev.JSON)
+	if event.Get("state_key").Exists() {
+		return nil
+	}
+	relatesTo := event.Get(`content.m\.relates_to`)
+	threadID := relatesTo.Get("event_id").Str
+	if relatesTo.Get("rel_type").Str != "m.thread" || threadID == "" {
+		return nil
+	}
+	return &ThreadReply{
+		NID:      ev.NID,
+		RoomID:   ev.RoomID,
+		ThreadID: threadID,
+		EventID:  ev.ID,
+		Sender:   event.Get("sender").Str,
+	}
+}
+
+// ThreadSummary summarises a thread from the point of view of a single user.
+type ThreadSummary struct {
+	RoomID string `db:"room_id"`
+	// The event ID of the thread root.
+	ThreadID      string `db:"thread_id"`
+	LatestEventID string `db:"latest_event_id"`
+	LatestNID     int64  `db:"latest_nid"`
+	NumReplies    int    `db:"num_replies"`
+	// The number of replies after the user's read receipt which were not sent by the user.
+	NumUnread int `db:"num_unread"`
+}
+
+// ThreadTable stores the replies in each thread, so threads can be summarised without scanning
+// the events table.
+type ThreadTable struct {
+	db *sqlx.DB
+}
+
+func NewThreadTable(db *sqlx.DB) *ThreadTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_thread_replies (
+		event_nid BIGINT PRIMARY KEY NOT NULL,
+		room_id TEXT NOT NULL,
+		thread_id TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		sender TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_thread_replies_thread_idx ON syncv3_thread_replies(room_id, thread_id, event_nid);
+	`)
+	return &ThreadTable{db}
+}
+
+// Insert the thread replies in these events, which must have NIDs. Events which are not in a
+// thread are ignored.
+func (t *ThreadTable) Insert(txn *sqlx.Tx, events []Event) error {
+	var replies []ThreadReply
+	for _, ev := range events {
+		if reply := NewThreadReplyFromEvent(ev); reply != nil {
+			replies = append(replies, *reply)
+		}
+	}
+	if len(replies) == 0 {
+		return nil
+	}
+	chunks := sqlutil.Chunkify(5, MaxPostgresParameters, ThreadReplyChunker(replies))
+	for _, chunk := range chunks {
+		_, err := txn.NamedExec(`
+		INSERT INTO syncv3_thread_replies (event_nid, room_id, thread_id, event_id, sender)
+		VALUES (:event_nid, :room_id, :thread_id, :event_id, :sender) ON CONFLICT (event_nid) DO NOTHING`, chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SelectThreadSummaries returns summaries of the `limit` most recently active threads in the room,
+// most recent first. readNIDs maps thread IDs to the NID of the latest event userID has read in
+// that thread, and threads which are not in readNIDs use defaultReadNID. Replies after this which
+// were not sent by userID are unread.
+func (t *ThreadTable) SelectThreadSummaries(txn *sqlx.Tx, roomID, userID string, limit int, readNIDs map[string]int64, defaultReadNID int64) (summaries []ThreadSummary, err error) {
+	threadIDs := make([]string, 0, len(readNIDs))
+	nids := make([]int64, 0, len(readNIDs))
+	for threadID, nid := range readNIDs {
+		threadIDs = append(threadIDs, threadID)
+		nids = append(nids, nid)
+	}
+	err = txn.Select(&summaries, `
+	WITH threads AS (
+		SELECT thread_id, COUNT(*) AS num_replies, MAX(event_nid) AS latest_nid FROM syncv3_thread_replies
+		WHERE room_id = $1 GROUP BY thread_id ORDER BY latest_nid DESC LIMIT $2
+	), reads AS (
+		SELECT * FROM unnest($3::TEXT[], $4::BIGINT[]) AS r(thread_id, read_nid)
+	)
+	SELECT latest.room_id, threads.thread_id, latest.event_id AS latest_event_id, threads.latest_nid, threads.num_replies, (
+		SELECT COUNT(*) FROM syncv3_thread_replies unread
+		WHERE unread.room_id = $1 AND unread.thread_id = threads.thread_id
+		AND unread.event_nid > COALESCE(reads.read_nid, $5) AND unread.sender <> $6
+	) AS num_unread
+	FROM threads
+	JOIN syncv3_thread_replies latest ON latest.event_nid = threads.latest_nid
+	LEFT JOIN reads ON reads.thread_id = threads.thread_id
+	ORDER BY threads.latest_nid DESC`,
+		roomID, limit, pq.StringArray(threadIDs), pq.Int64Array(nids), defaultReadNID, userID)
+	return
+}
+
+// ThreadReadNIDs works out how far a user has read in each thread from their read receipts, which
+// must all be in the same room. eventNIDs maps the event IDs of the receipts to NIDs: receipts for
+// unknown events are ignored.
+//
+// A receipt with a thread_id only applies to that thread, and a receipt for the main timeline only
+// applies to events which are not in a thread. An unthreaded receipt applies to every event before
+// it, including thread replies, so readNIDs is never less than unthreadedNID.
+func ThreadReadNIDs(receipts []internal.Receipt, eventNIDs map[string]int64) (readNIDs map[string]int64, unthreadedNID int64) {
+	threaded := make(map[string]int64)
+	for _, r := range receipts {
+		nid, ok := eventNIDs[r.EventID]
+		if !ok {
+			continue
+		}
+		switch r.ThreadID {
+		case "":
+			if nid > unthreadedNID {
+				unthreadedNID = nid
+			}
+		case ThreadMainTimeline:
+			// does not affect threads
+		default:
+			if nid > threaded[r.ThreadID] {
+				threaded[r.ThreadID] = nid
+			}
+		}
+	}
+	readNIDs = make(map[string]int64, len(threaded))
+	for threadID, nid := range threaded {
+		if nid > unthreadedNID {
+			readNIDs[threadID] = nid
+		}
+	}
+	return readNIDs, unthreadedNID
+}
+
+type ThreadReplyChunker []ThreadReply
+
+func (c ThreadReplyChunker) Len() int {
+	return len(c)
+}
+func (c ThreadReplyChunker) Subslice(i, j int) sqlutil.Chunker {
+	return c[i:j]
+}
@@ -0,0 +1,109 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestNewThreadReplyFromEvent(t *testing.T) {
+	testCases := []struct {
+		name string
+		json string
+		want *ThreadReply
+	}{
+		{
+			name: "thread reply",
+			json: `{"type":"m.room.message","event_id":"$reply","sender":"@alice","content":{"body":"hi","m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}}`,
+			want: &ThreadReply{NID: 5, RoomID: "!room", ThreadID: "$root", EventID: "$reply", Sender: "@alice"},
+		},
+		{
+			name: "not a relation",
+			json: `{"type":"m.room.message","event_id":"$reply","sender":"@alice","content":{"body":"hi"}}`,
+		},
+		{
+			name: "other relation",
+			json: `{"type":"m.reaction","event_id":"$reply","sender":"@alice","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$root","key":"👍"}}}`,
+		},
+		{
+			name: "missing root",
+			json: `{"type":"m.room.message","event_id":"$reply","sender":"@alice","content":{"m.relates_to":{"rel_type":"m.thread"}}}`,
+		},
+		{
+			name: "state event",
+			json: `{"type":"m.room.topic","state_key":"","event_id":"$reply","sender":"@alice","content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}}`,
+		},
+	}
+	for _, tc := range testCases {
+		got := NewThreadReplyFromEvent(Event{NID: 5, RoomID: "!room", ID: "$reply", JSON: []byte(tc.json)})
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestThreadReadNIDs(t *testing.T) {
+	eventNIDs := map[string]int64{
+		"$1": 1, "$2": 2, "$3": 3, "$4": 4, "$5": 5,
+	}
+	testCases := []struct {
+		name              string
+		receipts          []internal.Receipt
+		wantReadNIDs      map[string]int64
+		wantUnthreadedNID int64
+	}{
+		{
+			name:              "no receipts",
+			wantReadNIDs:      map[string]int64{},
+			wantUnthreadedNID: 0,
+		},
+		{
+			name: "threaded receipts only apply to their thread",
+			receipts: []internal.Receipt{
+				{EventID: "$3", ThreadID: "$root1"},
+				{EventID: "$4", ThreadID: "$root2", IsPrivate: true},
+				{EventID: "$2", ThreadID: "$root2"},
+			},
+			wantReadNIDs:      map[string]int64{"$root1": 3, "$root2": 4},
+			wantUnthreadedNID: 0,
+		},
+		{
+			name: "main timeline receipts do not apply to threads",
+			receipts: []internal.Receipt{
+				{EventID: "$5", ThreadID: ThreadMainTimeline},
+				{EventID: "$1", ThreadID: "$root1"},
+			},
+			wantReadNIDs:      map[string]int64{"$root1": 1},
+			wantUnthreadedNID: 0,
+		},
+		{
+			name: "unthreaded receipts apply to all threads",
+			receipts: []internal.Receipt{
+				{EventID: "$3"},
+				{EventID: "$1", ThreadID: "$root1"},
+				{EventID: "$5", ThreadID: "$root2"},
+			},
+			wantReadNIDs:      map[string]int64{"$root2": 5},
+			wantUnthreadedNID: 3,
+		},
+		{
+			name: "receipts for unknown events are ignored",
+			receipts: []internal.Receipt{
+				{EventID: "$unknown"},
+				{EventID: "$unknown", ThreadID: "$root1"},
+			},
+			wantReadNIDs:      map[string]int64{},
+			wantUnthreadedNID: 0,
+		},
+	}
+	for _, tc := range testCases {
+		gotReadNIDs, gotUnthreadedNID := ThreadReadNIDs(tc.receipts, eventNIDs)
+		if !reflect.DeepEqual(gotReadNIDs, tc.wantReadNIDs) {
+			t.Errorf("%s: got read NIDs %v want %v", tc.name, gotReadNIDs, tc.wantReadNIDs)
+		}
+		if gotUnthreadedNID != tc.wantUnthreadedNID {
+			t.Errorf("%s: got unthreaded NID %v want %v", tc.name, gotUnthreadedNID, tc.wantUnthreadedNID)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -54,7 +55,8 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 		message TEXT NOT NULL,
 		-- nullable as these fields are not on all to-device events
 		unique_key TEXT,
-		action SMALLINT DEFAULT 0 -- 0 means unknown
+		action SMALLINT DEFAULT 0, -- 0 means unknown
+		inserted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
 	);
 	CREATE TABLE IF NOT EXISTS syncv3_to_device_ack_pos (
 		user_id TEXT NOT NULL,
@@ -90,11 +92,53 @@ func (t *ToDeviceTable) DeleteAllMessagesForDevice(userID, deviceID string) erro
 	return err
 }
 
+// CountMessages returns the number of to-device messages stored for this device.
+func (t *ToDeviceTable) CountMessages(userID, deviceID string) (count int64, err error) {
+	err = t.db.QueryRow(`SELECT COUNT(*) FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2`, userID, deviceID).Scan(&count)
+	return
+}
+
+// Purge deletes to-device messages which were stored before olderThan, and all but the most
+// recent maxPerDevice messages for each device, as devices which never sync again would otherwise
+// accumulate messages forever. A zero olderThan or maxPerDevice means no limit. Messages are
+// deleted whether or not they have been sent to the device. Returns the number of messages deleted.
+func (t *ToDeviceTable) Purge(olderThan time.Time, maxPerDevice int) (int64, error) {
+	if olderThan.IsZero() && maxPerDevice <= 0 {
+		return 0, nil
+	}
+	result, err := t.db.Exec(`WITH ranked_messages AS (
+		SELECT
+		  position,
+		  ROW_NUMBER() OVER (PARTITION BY user_id, device_id ORDER BY position DESC) AS row_num
+		FROM
+		  syncv3_to_device_messages
+	  )
+	  DELETE FROM syncv3_to_device_messages USING ranked_messages
+	  WHERE syncv3_to_device_messages.position = ranked_messages.position
+	  AND (
+		($1::BIGINT > 0 AND ranked_messages.row_num > $1) OR
+		($2::TIMESTAMPTZ IS NOT NULL AND syncv3_to_device_messages.inserted_at < $2)
+	  )`, maxPerDevice, sql.NullTime{Time: olderThan, Valid: !olderThan.IsZero()})
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 // Messages fetches up to `limit` to-device messages for this device, starting from and excluding `from`.
 // Returns the fetches messages ordered by ascending position, as well as the position of the last to-device message
 // fetched.
 func (t *ToDeviceTable) Messages(userID, deviceID string, from, limit int64) (msgs []json.RawMessage, upTo int64, err error) {
+	msgs, positions, err := t.MessagesWithPositions(userID, deviceID, from, limit)
 	upTo = from
+	if len(positions) > 0 {
+		upTo = positions[len(positions)-1]
+	}
+	return
+}
+
+// MessagesWithPositions is like Messages but returns the position of each message.
+func (t *ToDeviceTable) MessagesWithPositions(userID, deviceID string, from, limit int64) (msgs []json.RawMessage, positions []int64, err error) {
 	var rows []ToDeviceRow
 	err = t.db.Select(&rows,
 		`SELECT position, message FROM syncv3_to_device_messages WHERE user_id = $1 AND device_id = $2 AND position > $3 ORDER BY position ASC LIMIT $4`,
@@ -104,15 +148,16 @@ func (t *ToDeviceTable) Messages(userID, deviceID string, from, limit int64) (ms
 		return
 	}
 	msgs = make([]json.RawMessage, len(rows))
+	positions = make([]int64, len(rows))
 	for i := range rows {
 		msgs[i] = json.RawMessage(rows[i].Message)
+		positions[i] = rows[i].Position
 		m := gjson.ParseBytes(msgs[i])
 		msgId := m.Get(`content.org\.matrix\.msgid`).Str
 		if msgId != "" {
 			logger.Info().Str("msgid", msgId).Str("user", userID).Str("device", deviceID).Msg("ToDeviceTable.Messages")
 		}
 	}
-	upTo = rows[len(rows)-1].Position
 	return
 }
 
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
@@ -237,6 +238,47 @@ func TestToDeviceTableNoDeleteUnacks(t *testing.T) {
 	bytesEqual(t, gotMsgs[1], cancelEv)
 }
 
+func TestToDeviceTablePurge(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewToDeviceTable(db)
+	userID := "@TestToDeviceTablePurge:localhost"
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":1}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":2}}`),
+		json.RawMessage(`{"sender":"alice","type":"something","content":{"n":3}}`),
+	}
+	_, err := table.InsertMessages(userID, "CAPPED", msgs)
+	assertNoError(t, err)
+	_, err = table.InsertMessages(userID, "OLD", msgs[:1])
+	assertNoError(t, err)
+	_, err = db.Exec(`UPDATE syncv3_to_device_messages SET inserted_at = NOW() - INTERVAL '2 days' WHERE user_id = $1 AND device_id = 'OLD'`, userID)
+	assertNoError(t, err)
+
+	// nothing to do without limits
+	purged, err := table.Purge(time.Time{}, 0)
+	assertNoError(t, err)
+	if purged != 0 {
+		t.Fatalf("Purge with no limits: purged %d messages", purged)
+	}
+
+	// the oldest messages beyond the cap, and messages older than a day, are purged
+	_, err = table.Purge(time.Now().Add(-24*time.Hour), 2)
+	assertNoError(t, err)
+	got, _, err := table.Messages(userID, "CAPPED", 0, 10)
+	assertNoError(t, err)
+	if len(got) != 2 {
+		t.Fatalf("got %d messages, want 2: %v", len(got), jsonArrStr(got))
+	}
+	bytesEqual(t, got[0], msgs[1])
+	bytesEqual(t, got[1], msgs[2])
+	count, err := table.CountMessages(userID, "OLD")
+	assertNoError(t, err)
+	if count != 0 {
+		t.Fatalf("got %d old messages, want 0", count)
+	}
+}
+
 // Guard against possible message truncation?
 func TestToDeviceTableBytesInEqualBytesOut(t *testing.T) {
 	db, close := connectToDB(t)
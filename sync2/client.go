@@ -17,18 +17,43 @@ import (
 
 const AccountDataGlobalRoom = ""
 
+// DefaultTimelineLimit is the timeline limit used when polling with a since token.
+const DefaultTimelineLimit = 50
+
 var ProxyVersion = ""
 var HTTP401 error = fmt.Errorf("HTTP 401")
 
+// HTTP401SoftLogout is returned instead of HTTP401 when the homeserver says the access token has
+// expired with "soft_logout": true, meaning the device still exists and the client can refresh
+// the token or log in again to carry on with it.
+var HTTP401SoftLogout error = fmt.Errorf("HTTP 401 (soft logout)")
+
+// unauthorized returns HTTP401 or HTTP401SoftLogout for the body of a 401 response.
+func unauthorized(res *http.Response) error {
+	body, _ := io.ReadAll(res.Body)
+	if gjson.GetBytes(body, "soft_logout").Bool() {
+		return HTTP401SoftLogout
+	}
+	return HTTP401
+}
+
 type Client interface {
 	// Versions fetches and parses the list of Matrix versions that the homeserver
 	// advertises itself as supporting.
 	Versions(ctx context.Context) (version []string, err error)
 	// WhoAmI asks the homeserver to lookup the access token using the CSAPI /whoami
 	// endpoint. The response must contain a device ID (meaning that we assume the
-	// homeserver supports Matrix >= 1.1.)
-	WhoAmI(ctx context.Context, accessToken string) (userID, deviceID string, err error)
+	// homeserver supports Matrix >= 1.1.) isGuest is false if the homeserver does not say.
+	WhoAmI(ctx context.Context, accessToken string) (userID, deviceID string, isGuest bool, err error)
 	DoSyncV2(ctx context.Context, accessToken, since string, isFirst bool, toDeviceOnly bool) (*SyncResponse, int, error)
+	// DirectoryVisibility asks the homeserver whether the room is published in the room directory,
+	// returning "public" or "private". This endpoint does not need an access token.
+	DirectoryVisibility(ctx context.Context, roomID string) (visibility string, err error)
+	// Messages fetches up to `limit` timeline events before the `from` token using the CSAPI
+	// /messages endpoint, newest first.
+	Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error)
+	// RoomState fetches the current state of the room using the CSAPI /rooms/{roomId}/state endpoint.
+	RoomState(ctx context.Context, accessToken, roomID string) (state []json.RawMessage, err error)
 }
 
 // HTTPClient represents a Sync v2 Client.
@@ -37,6 +62,14 @@ type HTTPClient struct {
 	Client            *http.Client
 	LongTimeoutClient *http.Client
 	DestinationServer string
+	// The timeline limit to request when polling with a since token. 0 means DefaultTimelineLimit.
+	// Only the timeline is ever limited: state, account data, ephemeral events and to-device
+	// messages are always requested in full, as is membership (no lazy-loading), as the proxy
+	// needs all of these to serve clients.
+	TimelineLimit int
+	// Whether to ask the homeserver for presence. Presence is filtered out unless this is set, as
+	// every poller receives the presence of every user it shares a room with.
+	Presence bool
 }
 
 func NewHTTPClient(shortTimeout, longTimeout time.Duration, destHomeServer string) *HTTPClient {
@@ -86,35 +119,118 @@ func (v *HTTPClient) Versions(ctx context.Context) ([]string, error) {
 	return parsedRes.Result, nil
 }
 
-// Return sync2.HTTP401 if this request returns 401
-func (v *HTTPClient) WhoAmI(ctx context.Context, accessToken string) (string, string, error) {
+// Return sync2.HTTP401 or sync2.HTTP401SoftLogout if this request returns 401
+func (v *HTTPClient) WhoAmI(ctx context.Context, accessToken string) (string, string, bool, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", v.DestinationServer+"/_matrix/client/r0/account/whoami", nil)
 	if err != nil {
-		return "", "", err
+		return "", "", false, err
 	}
 	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 	res, err := v.Client.Do(req)
 	if err != nil {
-		return "", "", err
+		return "", "", false, err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != 200 {
 		if res.StatusCode == 401 {
-			return "", "", HTTP401
+			return "", "", false, unauthorized(res)
 		}
-		return "", "", fmt.Errorf("/whoami returned HTTP %d", res.StatusCode)
+		return "", "", false, fmt.Errorf("/whoami returned HTTP %d", res.StatusCode)
 	}
-	defer res.Body.Close()
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return "", "", err
+		return "", "", false, err
 	}
 	response := gjson.ParseBytes(body)
-	return response.Get("user_id").Str, response.Get("device_id").Str, nil
+	return response.Get("user_id").Str, response.Get("device_id").Str, response.Get("is_guest").Bool(), nil
+}
+
+func (v *HTTPClient) DirectoryVisibility(ctx context.Context, roomID string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.DestinationServer+"/_matrix/client/v3/directory/list/room/"+url.PathEscape(roomID), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("/directory/list/room returned HTTP %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	visibility := gjson.GetBytes(body, "visibility").Str
+	if visibility == "" {
+		return "", fmt.Errorf("/directory/list/room response missing visibility: %s", body)
+	}
+	return visibility, nil
+}
+
+// Return sync2.HTTP401 or sync2.HTTP401SoftLogout if this request returns 401
+func (v *HTTPClient) Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error) {
+	query := url.Values{}
+	query.Set("dir", "b")
+	query.Set("from", from)
+	query.Set("limit", fmt.Sprintf("%d", limit))
+	messagesURL := v.DestinationServer + "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/messages?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", messagesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		if res.StatusCode == 401 {
+			return nil, unauthorized(res)
+		}
+		return nil, fmt.Errorf("/messages returned HTTP %d", res.StatusCode)
+	}
+	var resp MessagesResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to decode /messages response: %w", err)
+	}
+	return &resp, nil
+}
+
+// Return sync2.HTTP401 or sync2.HTTP401SoftLogout if this request returns 401
+func (v *HTTPClient) RoomState(ctx context.Context, accessToken, roomID string) ([]json.RawMessage, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.DestinationServer+"/_matrix/client/v3/rooms/"+url.PathEscape(roomID)+"/state", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		if res.StatusCode == 401 {
+			return nil, unauthorized(res)
+		}
+		return nil, fmt.Errorf("/rooms/{roomId}/state returned HTTP %d", res.StatusCode)
+	}
+	var state []json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to decode /rooms/{roomId}/state response: %w", err)
+	}
+	return state, nil
 }
 
 // DoSyncV2 performs a sync v2 request. Returns the sync response and the response status code
 // or an error. Set isFirst=true on the first sync to force a timeout=0 sync to ensure snapiness.
+// The error is sync2.HTTP401 or sync2.HTTP401SoftLogout if the request returns 401.
 func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
 	syncURL := v.createSyncURL(since, isFirst, toDeviceOnly)
 	req, err := http.NewRequestWithContext(ctx, "GET", syncURL, nil)
@@ -132,6 +248,7 @@ func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, is
 	if err != nil {
 		return nil, 0, fmt.Errorf("DoSyncV2: request failed: %w", err)
 	}
+	defer res.Body.Close()
 	switch res.StatusCode {
 	case 200:
 		var svr SyncResponse
@@ -139,6 +256,8 @@ func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, is
 			return nil, 0, fmt.Errorf("DoSyncV2: response body decode JSON failed: %w", err)
 		}
 		return &svr, 200, nil
+	case 401:
+		return nil, 401, unauthorized(res)
 	default:
 		return nil, res.StatusCode, fmt.Errorf("DoSyncV2: response returned %s", res.Status)
 	}
@@ -163,7 +282,12 @@ func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) str
 	// https://github.com/matrix-org/synapse/blob/89a71e73905ffa1c97ae8be27d521cd2ef3f3a0c/synapse/handlers/sync.py#L576-L577
 	// NB: this is a stopgap to reduce the likelihood of hitting
 	// https://github.com/matrix-org/sliding-sync/issues/18
-	timelineLimit := 50
+	// Operators can lower this to reduce the amount of data ingested per poll, at the cost of
+	// more gappy timelines for busy rooms.
+	timelineLimit := DefaultTimelineLimit
+	if v.TimelineLimit > 0 {
+		timelineLimit = v.TimelineLimit
+	}
 	if since == "" {
 		// First time the poller has sync v2-ed for this user
 		timelineLimit = 1
@@ -177,8 +301,10 @@ func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) str
 	}
 	filter := map[string]interface{}{
 		"room": room,
-		// filter out all presence events (remove this once/if the proxy handles presence)
-		"presence": map[string]interface{}{"not_types": []string{"*"}},
+	}
+	if !v.Presence {
+		// filter out all presence events
+		filter["presence"] = map[string]interface{}{"not_types": []string{"*"}}
 	}
 	filterJSON, _ := json.Marshal(filter)
 	qps += "&filter=" + url.QueryEscape(string(filterJSON))
@@ -205,6 +331,7 @@ type SyncResponse struct {
 type SyncRoomsResponse struct {
 	Join   map[string]SyncV2JoinResponse   `json:"join"`
 	Invite map[string]SyncV2InviteResponse `json:"invite"`
+	Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 	Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 }
 
@@ -226,25 +353,36 @@ type TimelineResponse struct {
 	Events    []json.RawMessage `json:"events"`
 	Limited   bool              `json:"limited"`
 	PrevBatch string            `json:"prev_batch,omitempty"`
+	// NextBatch is the next_batch of the sync response containing this timeline. It is not part of
+	// the timeline JSON and is set by the poller.
+	NextBatch string `json:"-"`
 }
 
 type EventsResponse struct {
 	Events []json.RawMessage `json:"events"`
 }
 
+// MessagesResponse is a /messages response. End is empty if there are no more events.
+type MessagesResponse struct {
+	Chunk []json.RawMessage `json:"chunk"`
+	Start string            `json:"start"`
+	End   string            `json:"end,omitempty"`
+}
+
 // InviteResponse represents a /sync response for a room which is under the 'invite' key.
 type SyncV2InviteResponse struct {
 	InviteState EventsResponse `json:"invite_state"`
 }
 
+// KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type SyncV2KnockResponse struct {
+	KnockState EventsResponse `json:"knock_state"`
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type SyncV2LeaveResponse struct {
 	State struct {
 		Events []json.RawMessage `json:"events"`
 	} `json:"state"`
-	Timeline struct {
-		Events    []json.RawMessage `json:"events"`
-		Limited   bool              `json:"limited"`
-		PrevBatch string            `json:"prev_batch,omitempty"`
-	} `json:"timeline"`
+	Timeline TimelineResponse `json:"timeline"`
 }
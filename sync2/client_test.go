@@ -1,8 +1,12 @@
 package sync2
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestSyncURL(t *testing.T) {
@@ -72,4 +76,121 @@ func TestSyncURL(t *testing.T) {
 			t.Errorf("Case %d/%d: got %v want %v", i+1, len(testCases), gotURL, tc.wantURL)
 		}
 	}
+
+	// a configured timeline limit only applies once there is a since token
+	client.TimelineLimit = 10
+	gotURL := client.createSyncURL("112233", false, false)
+	wantURL := wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":10}}}`)
+	if gotURL != wantURL {
+		t.Errorf("custom timeline limit: got %v want %v", gotURL, wantURL)
+	}
+	gotURL = client.createSyncURL("", false, false)
+	wantURL = wantBaseURL + `?timeout=30000&set_presence=offline&filter=` + url.QueryEscape(`{"presence":{"not_types":["*"]},"room":{"timeline":{"limit":1}}}`)
+	if gotURL != wantURL {
+		t.Errorf("custom timeline limit without since: got %v want %v", gotURL, wantURL)
+	}
+
+	// presence is only filtered out when it is not wanted
+	client.Presence = true
+	gotURL = client.createSyncURL("112233", false, false)
+	wantURL = wantBaseURL + `?timeout=30000&since=112233&set_presence=offline&filter=` + url.QueryEscape(`{"room":{"timeline":{"limit":10}}}`)
+	if gotURL != wantURL {
+		t.Errorf("presence: got %v want %v", gotURL, wantURL)
+	}
+}
+
+func TestDirectoryVisibility(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("directory lookup sent an access token")
+		}
+		switch req.URL.EscapedPath() {
+		case "/_matrix/client/v3/directory/list/room/%21public:localhost":
+			w.Write([]byte(`{"visibility":"public"}`))
+		case "/_matrix/client/v3/directory/list/room/%21private:localhost":
+			w.Write([]byte(`{"visibility":"private"}`))
+		default:
+			w.WriteHeader(404)
+			w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+		}
+	}))
+	defer srv.Close()
+	client := NewHTTPClient(time.Second, time.Second, srv.URL)
+	testCases := []struct {
+		roomID         string
+		wantVisibility string
+		wantErr        bool
+	}{
+		{roomID: "!public:localhost", wantVisibility: "public"},
+		{roomID: "!private:localhost", wantVisibility: "private"},
+		{roomID: "!unknown:localhost", wantErr: true},
+	}
+	for _, tc := range testCases {
+		visibility, err := client.DirectoryVisibility(context.Background(), tc.roomID)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got err %v want err %v", tc.roomID, err, tc.wantErr)
+		}
+		if visibility != tc.wantVisibility {
+			t.Errorf("%s: got visibility %q want %q", tc.roomID, visibility, tc.wantVisibility)
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN"}`))
+			return
+		}
+		if req.URL.EscapedPath() != "/_matrix/client/v3/rooms/%21a:localhost/messages" {
+			t.Errorf("got path %s", req.URL.EscapedPath())
+		}
+		query := req.URL.Query()
+		if query.Get("dir") != "b" || query.Get("from") != "t1" || query.Get("limit") != "2" {
+			t.Errorf("got query %s", req.URL.RawQuery)
+		}
+		w.Write([]byte(`{"chunk":[{"event_id":"$b"},{"event_id":"$a"}],"start":"t1","end":"t2"}`))
+	}))
+	defer srv.Close()
+	client := NewHTTPClient(time.Second, time.Second, srv.URL)
+	res, err := client.Messages(context.Background(), "token", "!a:localhost", "t1", 2)
+	if err != nil {
+		t.Fatalf("Messages: %s", err)
+	}
+	if len(res.Chunk) != 2 || res.Start != "t1" || res.End != "t2" {
+		t.Errorf("got %+v", res)
+	}
+	if _, err = client.Messages(context.Background(), "wrong", "!a:localhost", "t1", 2); err != HTTP401 {
+		t.Errorf("got err %v want HTTP401", err)
+	}
+}
+
+func TestUnauthorizedSoftLogout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(401)
+		if req.Header.Get("Authorization") == "Bearer expired" {
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","soft_logout":true}`))
+			return
+		}
+		w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","soft_logout":false}`))
+	}))
+	defer srv.Close()
+	client := NewHTTPClient(time.Second, time.Second, srv.URL)
+	testCases := []struct {
+		accessToken string
+		wantErr     error
+	}{
+		{accessToken: "expired", wantErr: HTTP401SoftLogout},
+		{accessToken: "logged_out", wantErr: HTTP401},
+	}
+	for _, tc := range testCases {
+		if _, _, _, err := client.WhoAmI(context.Background(), tc.accessToken); err != tc.wantErr {
+			t.Errorf("WhoAmI(%s): got err %v want %v", tc.accessToken, err, tc.wantErr)
+		}
+		_, statusCode, err := client.DoSyncV2(context.Background(), tc.accessToken, "", false, false)
+		if statusCode != 401 || err != tc.wantErr {
+			t.Errorf("DoSyncV2(%s): got %d %v want 401 %v", tc.accessToken, statusCode, err, tc.wantErr)
+		}
+	}
 }
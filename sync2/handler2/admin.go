@@ -0,0 +1,107 @@
+package handler2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// AdminPollerPath is the path of the endpoint which returns the status of a poller, or with DELETE
+// evicts it.
+const AdminPollerPath = "/_syncv3/admin/poller"
+
+// AdminPollerResponse is the status of the poller for a device, so it can be compared with the
+// upstream homeserver when investigating missing data. The access token is never included.
+type AdminPollerResponse struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	// The since token the poller will use on its next request to the upstream homeserver.
+	Since string `json:"since"`
+	// When the poller last finished processing a sync response, in milliseconds since the
+	// epoch. Omitted if it never has.
+	LastSyncTimestamp int64 `json:"last_sync_ts,omitempty"`
+	Terminated        bool  `json:"terminated"`
+	// The number of sync v2 requests in a row which have failed. The poller backs off whilst
+	// this is above 0.
+	FailCount int `json:"fail_count"`
+}
+
+type adminHandler struct {
+	pMap       sync2.IPollerMap
+	adminToken string
+}
+
+// AdminHandler returns an admin handler for the pollers started by this handler.
+func (h *Handler) AdminHandler(adminToken string) http.Handler {
+	return NewAdminHandler(h.pMap, adminToken)
+}
+
+// NewAdminHandler returns a handler for AdminPollerPath, which requires `adminToken` as the access
+// token. Takes the query parameters `user_id` and `device_id`. DELETE terminates the poller as if
+// its access token had expired, closing the device's connections. If the device is still in use, a
+// new poller is started once the client's access token is checked again.
+func NewAdminHandler(pMap sync2.IPollerMap, adminToken string) http.Handler {
+	return &adminHandler{
+		pMap:       pMap,
+		adminToken: adminToken,
+	}
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "DELETE" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	res, herr := h.serve(req)
+	if herr != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *adminHandler) serve(req *http.Request) (*AdminPollerResponse, *internal.HandlerError) {
+	if herr := internal.CheckAdminToken(req, h.adminToken); herr != nil {
+		return nil, herr
+	}
+	pid := sync2.PollerID{
+		UserID:   req.URL.Query().Get("user_id"),
+		DeviceID: req.URL.Query().Get("device_id"),
+	}
+	if pid.UserID == "" || pid.DeviceID == "" {
+		return nil, &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("user_id and device_id are required"),
+			ErrCode:    "M_MISSING_PARAM",
+		}
+	}
+	status, ok := h.pMap.Status(pid)
+	if !ok {
+		return nil, &internal.HandlerError{
+			StatusCode: 404,
+			Err:        fmt.Errorf("no poller for this device"),
+			ErrCode:    "M_NOT_FOUND",
+		}
+	}
+	if req.Method == "DELETE" && !status.Terminated {
+		status.Terminated = h.pMap.ExpirePollers([]sync2.PollerID{pid}) > 0
+	}
+	res := &AdminPollerResponse{
+		UserID:     pid.UserID,
+		DeviceID:   pid.DeviceID,
+		Since:      status.Since,
+		Terminated: status.Terminated,
+		FailCount:  status.FailCount,
+	}
+	if !status.LastSync.IsZero() {
+		res.LastSyncTimestamp = status.LastSync.UnixMilli()
+	}
+	return res, nil
+}
@@ -0,0 +1,110 @@
+package handler2_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+)
+
+func doAdminRequest(t *testing.T, h http.Handler, method, accessToken, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, handler2.AdminPollerPath+"?"+query, nil)
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminHandlerPollerStatus(t *testing.T) {
+	pid := sync2.PollerID{UserID: "@alice:localhost", DeviceID: "ALICE"}
+	lastSync := time.UnixMilli(1632131678061)
+	pMap := &mockPollerMap{
+		statuses: map[sync2.PollerID]sync2.PollerStatus{
+			pid: {Since: "s123_456", LastSync: lastSync, FailCount: 2},
+		},
+	}
+	h := handler2.NewAdminHandler(pMap, "admin_secret")
+	query := "user_id=%40alice%3Alocalhost&device_id=ALICE"
+
+	testCases := []struct {
+		name        string
+		accessToken string
+		query       string
+		wantCode    int
+	}{
+		{name: "missing token", query: query, wantCode: http.StatusUnauthorized},
+		{name: "wrong token", accessToken: "alice_token", query: query, wantCode: http.StatusUnauthorized},
+		{name: "missing device", accessToken: "admin_secret", query: "user_id=%40alice%3Alocalhost", wantCode: http.StatusBadRequest},
+		{name: "unknown device", accessToken: "admin_secret", query: "user_id=%40alice%3Alocalhost&device_id=BOB", wantCode: http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		if w := doAdminRequest(t, h, "GET", tc.accessToken, tc.query); w.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d want %d: %s", tc.name, w.Code, tc.wantCode, w.Body.String())
+		}
+	}
+
+	w := doAdminRequest(t, h, "GET", "admin_secret", query)
+	if w.Code != 200 {
+		t.Fatalf("got HTTP %d want 200: %s", w.Code, w.Body.String())
+	}
+	var res handler2.AdminPollerResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	want := handler2.AdminPollerResponse{
+		UserID:            pid.UserID,
+		DeviceID:          pid.DeviceID,
+		Since:             "s123_456",
+		LastSyncTimestamp: lastSync.UnixMilli(),
+		FailCount:         2,
+	}
+	if res != want {
+		t.Fatalf("got %+v want %+v", res, want)
+	}
+	if len(pMap.expired) > 0 {
+		t.Fatalf("GET expired pollers: %v", pMap.expired)
+	}
+}
+
+func TestAdminHandlerEvictPoller(t *testing.T) {
+	pid := sync2.PollerID{UserID: "@alice:localhost", DeviceID: "ALICE"}
+	pMap := &mockPollerMap{
+		statuses: map[sync2.PollerID]sync2.PollerStatus{
+			pid: {Since: "s123_456"},
+		},
+	}
+	h := handler2.NewAdminHandler(pMap, "admin_secret")
+
+	if w := doAdminRequest(t, h, "DELETE", "alice_token", "user_id=%40alice%3Alocalhost&device_id=ALICE"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token: got HTTP %d want 401: %s", w.Code, w.Body.String())
+	}
+	if w := doAdminRequest(t, h, "DELETE", "admin_secret", "user_id=%40alice%3Alocalhost&device_id=BOB"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown device: got HTTP %d want 404: %s", w.Code, w.Body.String())
+	}
+	if len(pMap.expired) > 0 {
+		t.Fatalf("rejected requests expired pollers: %v", pMap.expired)
+	}
+
+	w := doAdminRequest(t, h, "DELETE", "admin_secret", "user_id=%40alice%3Alocalhost&device_id=ALICE")
+	if w.Code != 200 {
+		t.Fatalf("got HTTP %d want 200: %s", w.Code, w.Body.String())
+	}
+	var res handler2.AdminPollerResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	if !res.Terminated {
+		t.Errorf("response does not say the poller was terminated: %+v", res)
+	}
+	if !reflect.DeepEqual(pMap.expired, []sync2.PollerID{pid}) {
+		t.Errorf("expired pollers: got %v want %v", pMap.expired, []sync2.PollerID{pid})
+	}
+}
@@ -0,0 +1,190 @@
+package handler2
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/tidwall/gjson"
+)
+
+// AppserviceTransactionsPath is the path prefix of the endpoint which receives the transactions the
+// homeserver sends to an application service, see Handler.SetAppservice.
+const AppserviceTransactionsPath = "/_matrix/app/v1/transactions/"
+
+// Appservice is the registration of an application service, e.g a bridge, whose transactions are
+// sent to the proxy. Users in its user namespace are never polled: their rooms are kept up to date
+// with the events in its transactions instead, so bridges with thousands of puppet users don't
+// need a poller per puppet.
+type Appservice struct {
+	// HSToken is the token the homeserver sends with each transaction.
+	HSToken string
+	// Users matches the user IDs in the application service's user namespace.
+	Users *regexp.Regexp
+}
+
+// NewAppservice returns the registration for an application service with this hs_token, whose
+// user namespace is usersRegex. As in registration files, the regex must match the whole user ID.
+func NewAppservice(hsToken, usersRegex string) (*Appservice, error) {
+	if hsToken == "" {
+		return nil, fmt.Errorf("appservice hs_token is required")
+	}
+	users, err := regexp.Compile("^(?:" + usersRegex + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid appservice user namespace: %w", err)
+	}
+	return &Appservice{
+		HSToken: hsToken,
+		Users:   users,
+	}, nil
+}
+
+// IsInterestedInUser returns true if the user is in the application service's user namespace.
+// Always returns false for a nil Appservice.
+func (a *Appservice) IsInterestedInUser(userID string) bool {
+	return a != nil && a.Users.MatchString(userID)
+}
+
+// SetAppservice stops polling users in the application service's namespace, whose rooms are then
+// updated by the transactions served by AppserviceHandler. Must be called before StartV2Pollers.
+func (h *Handler) SetAppservice(as *Appservice) {
+	h.appservice = as
+}
+
+// AppserviceHandler returns a handler for AppserviceTransactionsPath, or nil if SetAppservice has
+// not been called.
+func (h *Handler) AppserviceHandler() http.Handler {
+	if h.appservice == nil {
+		return nil
+	}
+	return &appserviceHandler{h: h}
+}
+
+type appserviceHandler struct {
+	h *Handler
+}
+
+func (a *appserviceHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if herr := a.serve(req); herr != nil {
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+		return
+	}
+	w.WriteHeader(200)
+	w.Write([]byte("{}"))
+}
+
+func (a *appserviceHandler) serve(req *http.Request) *internal.HandlerError {
+	// homeservers which predate the Authorization header send the token as a query parameter
+	hsToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if hsToken == "" {
+		hsToken = req.URL.Query().Get("access_token")
+	}
+	if hsToken == "" {
+		return &internal.HandlerError{
+			StatusCode: 401,
+			ErrCode:    "M_UNAUTHORIZED",
+			Err:        fmt.Errorf("missing hs_token"),
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(hsToken), []byte(a.h.appservice.HSToken)) != 1 {
+		return &internal.HandlerError{
+			StatusCode: 403,
+			ErrCode:    "M_FORBIDDEN",
+			Err:        fmt.Errorf("invalid hs_token"),
+		}
+	}
+	txnID := strings.TrimPrefix(req.URL.Path, AppserviceTransactionsPath)
+	if txnID == "" || strings.Contains(txnID, "/") {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			ErrCode:    "M_INVALID_PARAM",
+			Err:        fmt.Errorf("invalid transaction ID"),
+		}
+	}
+	var txn struct {
+		Events []json.RawMessage `json:"events"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&txn); err != nil {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			ErrCode:    "M_NOT_JSON",
+			Err:        fmt.Errorf("failed to decode transaction: %w", err),
+		}
+	}
+	if err := a.h.OnAppserviceTransaction(req.Context(), txnID, txn.Events); err != nil {
+		// the homeserver retries the transaction until it succeeds
+		return &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	return nil
+}
+
+// OnAppserviceTransaction stores the events in an application service transaction, as if they had
+// been received by a poller. Invites and leaves of users in the namespace are handled as they would
+// be in those users' sync responses. Transactions are processed one at a time, in the order the
+// homeserver sends them, and a retry of the last transaction is ignored.
+//
+// As with pollers, timelines for rooms the proxy has no state for are only stored if they start
+// with the m.room.create event.
+func (h *Handler) OnAppserviceTransaction(ctx context.Context, txnID string, events []json.RawMessage) error {
+	h.appserviceMu.Lock()
+	defer h.appserviceMu.Unlock()
+	if txnID == h.lastAppserviceTxnID {
+		return nil
+	}
+	// group events by room, keeping the order they were sent in
+	var roomIDs []string
+	timelines := make(map[string][]json.RawMessage)
+	for _, ev := range events {
+		roomID := gjson.GetBytes(ev, "room_id").Str
+		if roomID == "" {
+			continue
+		}
+		if _, exists := timelines[roomID]; !exists {
+			roomIDs = append(roomIDs, roomID)
+		}
+		timelines[roomID] = append(timelines[roomID], ev)
+	}
+	for _, roomID := range roomIDs {
+		err := h.Accumulate(ctx, "", "", roomID, sync2.TimelineResponse{Events: timelines[roomID]})
+		if err != nil {
+			return fmt.Errorf("Accumulate[%s]: %w", roomID, err)
+		}
+		for _, ev := range timelines[roomID] {
+			parsed := gjson.ParseBytes(ev)
+			userID := parsed.Get("state_key").Str
+			if parsed.Get("type").Str != "m.room.member" || !h.appservice.IsInterestedInUser(userID) {
+				continue
+			}
+			switch parsed.Get("content.membership").Str {
+			case "invite":
+				inviteState := []json.RawMessage{}
+				for _, stripped := range parsed.Get("unsigned.invite_room_state").Array() {
+					inviteState = append(inviteState, json.RawMessage(stripped.Raw))
+				}
+				err = h.OnInvite(ctx, userID, roomID, append(inviteState, ev))
+			case "leave", "ban":
+				err = h.OnLeftRoom(ctx, userID, roomID, ev)
+			}
+			if err != nil {
+				return fmt.Errorf("membership[%s]: %w", roomID, err)
+			}
+		}
+	}
+	h.lastAppserviceTxnID = txnID
+	return nil
+}
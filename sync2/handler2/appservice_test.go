@@ -0,0 +1,175 @@
+package handler2_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestAppserviceIsInterestedInUser(t *testing.T) {
+	as, err := handler2.NewAppservice("hs_secret", "@bridge_.*:localhost")
+	assertNoError(t, err)
+	testCases := []struct {
+		userID string
+		want   bool
+	}{
+		{userID: "@bridge_alice:localhost", want: true},
+		{userID: "@bridge_:localhost", want: true},
+		{userID: "@alice:localhost", want: false},
+		// the regex must match the whole user ID
+		{userID: "@bridge_alice:localhost.evil", want: false},
+		{userID: "@evil@bridge_alice:localhost", want: false},
+	}
+	for _, tc := range testCases {
+		if got := as.IsInterestedInUser(tc.userID); got != tc.want {
+			t.Errorf("IsInterestedInUser(%s): got %v want %v", tc.userID, got, tc.want)
+		}
+	}
+	var noAppservice *handler2.Appservice
+	if noAppservice.IsInterestedInUser("@bridge_alice:localhost") {
+		t.Errorf("nil Appservice is interested in users")
+	}
+	if _, err = handler2.NewAppservice("", ".*"); err == nil {
+		t.Errorf("NewAppservice without an hs_token: got no error")
+	}
+	if _, err = handler2.NewAppservice("hs_secret", "@bridge_(.*"); err == nil {
+		t.Errorf("NewAppservice with an invalid regex: got no error")
+	}
+}
+
+func TestAppserviceHandlerRejectsBadRequests(t *testing.T) {
+	h, err := handler2.NewHandler(&mockPollerMap{}, nil, nil, newMockPub(), &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	if h.AppserviceHandler() != nil {
+		t.Fatalf("AppserviceHandler without an appservice: got a handler")
+	}
+	as, err := handler2.NewAppservice("hs_secret", "@bridge_.*:localhost")
+	assertNoError(t, err)
+	h.SetAppservice(as)
+
+	testCases := []struct {
+		name     string
+		method   string
+		target   string
+		hsToken  string
+		body     string
+		wantCode int
+	}{
+		{name: "wrong method", method: "POST", target: "txn1", hsToken: "hs_secret", body: `{"events":[]}`, wantCode: http.StatusMethodNotAllowed},
+		{name: "missing token", method: "PUT", target: "txn1", body: `{"events":[]}`, wantCode: http.StatusUnauthorized},
+		{name: "wrong token", method: "PUT", target: "txn1", hsToken: "wrong", body: `{"events":[]}`, wantCode: http.StatusForbidden},
+		{name: "wrong query token", method: "PUT", target: "txn1?access_token=wrong", body: `{"events":[]}`, wantCode: http.StatusForbidden},
+		{name: "missing txn ID", method: "PUT", target: "", hsToken: "hs_secret", body: `{"events":[]}`, wantCode: http.StatusBadRequest},
+		{name: "bad JSON", method: "PUT", target: "txn1", hsToken: "hs_secret", body: `{"events":`, wantCode: http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, handler2.AppserviceTransactionsPath+tc.target, strings.NewReader(tc.body))
+		if tc.hsToken != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.hsToken)
+		}
+		w := httptest.NewRecorder()
+		h.AppserviceHandler().ServeHTTP(w, req)
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d want %d: %s", tc.name, w.Code, tc.wantCode, w.Body.String())
+		}
+	}
+}
+
+// Test that appservice transactions are stored as if they were polled, that retried transactions
+// are ignored, and that appservice users are not polled.
+func TestAppserviceTransactions(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	pMap := &mockPollerMap{}
+	pub := newMockPub()
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, &mockSub{}, false, time.Minute)
+	assertNoError(t, err)
+	as, err := handler2.NewAppservice("hs_secret", "@bridge_.*:appservice")
+	assertNoError(t, err)
+	h.SetAppservice(as)
+
+	creator := "@creator:appservice"
+	puppet := "@bridge_alice:appservice"
+	roomID := "!appservice:appservice"
+	withRoomID := func(ev json.RawMessage) json.RawMessage {
+		var m map[string]interface{}
+		assertNoError(t, json.Unmarshal(ev, &m))
+		m["room_id"] = roomID
+		ev, err = json.Marshal(m)
+		assertNoError(t, err)
+		return ev
+	}
+	events := []json.RawMessage{
+		withRoomID(testutils.NewStateEvent(t, "m.room.create", "", creator, map[string]interface{}{"creator": creator})),
+		withRoomID(testutils.NewJoinEvent(t, creator)),
+		withRoomID(testutils.NewStateEvent(t, "m.room.member", puppet, creator, map[string]interface{}{"membership": "invite"})),
+		withRoomID(testutils.NewEvent(t, "m.room.message", creator, map[string]interface{}{"body": "hello"})),
+	}
+	doTxn := func(txnID string) {
+		t.Helper()
+		body, _ := json.Marshal(map[string]interface{}{"events": events})
+		req := httptest.NewRequest("PUT", handler2.AppserviceTransactionsPath+txnID+"?access_token=hs_secret", strings.NewReader(string(body)))
+		w := httptest.NewRecorder()
+		h.AppserviceHandler().ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("transaction %s: got HTTP %d want 200: %s", txnID, w.Code, w.Body.String())
+		}
+	}
+	doTxn("txn1")
+
+	var gotAccumulate, gotInvite int
+	for _, p := range pub.calls {
+		switch payload := p.(type) {
+		case *pubsub.V2Initialise, *pubsub.V2Accumulate:
+			gotAccumulate++
+		case *pubsub.V2InviteRoom:
+			if payload.UserID != puppet || payload.RoomID != roomID {
+				t.Errorf("got invite %+v want invite for %s to %s", payload, puppet, roomID)
+			}
+			gotInvite++
+		}
+	}
+	if gotAccumulate == 0 {
+		t.Errorf("transaction was not accumulated")
+	}
+	if gotInvite != 1 {
+		t.Errorf("got %d invites want 1", gotInvite)
+	}
+	// the homeserver retries transactions whose response it did not receive
+	numCalls := len(pub.calls)
+	doTxn("txn1")
+	if len(pub.calls) != numCalls {
+		t.Errorf("retried transaction published %d payloads", len(pub.calls)-numCalls)
+	}
+
+	// appservice users get their initial sync straight away, without a poller
+	var tok *sync2.Token
+	sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		err = v2Store.DevicesTable.InsertDevice(txn, puppet, "PUPPET")
+		assertNoError(t, err)
+		tok, err = v2Store.TokensTable.Insert(txn, "puppetToken", puppet, "PUPPET", time.Now())
+		assertNoError(t, err)
+		return nil
+	})
+	ch := pub.WaitForPayloadType((&pubsub.V2InitialSyncComplete{}).Type())
+	h.EnsurePolling(&pubsub.V3EnsurePolling{
+		UserID:          puppet,
+		DeviceID:        "PUPPET",
+		AccessTokenHash: tok.AccessTokenHash,
+	})
+	pub.DoWait(t, "didn't see V2InitialSyncComplete", ch, false)
+	if len(pMap.calls) > 0 {
+		t.Fatalf("appservice user was polled: %+v", pMap.calls)
+	}
+}
@@ -40,7 +40,9 @@ type Handler struct {
 	v3Sub   *pubsub.V3Sub
 	// user_id|room_id|event_type => fnv_hash(last_event_bytes)
 	accountDataMap *sync.Map
-	unreadMap      map[string]struct {
+	// user_id => fnv_hash(last presence state), see presenceHash
+	presenceMap *sync.Map
+	unreadMap   map[string]struct {
 		Highlight int
 		Notif     int
 	}
@@ -53,8 +55,15 @@ type Handler struct {
 	pollerExpiryTicker *time.Ticker
 	e2eeWorkerPool     *internal.WorkerPool
 
-	numPollers prometheus.Gauge
-	subSystem  string
+	// see SetAppservice. nil if there is no appservice.
+	appservice          *Appservice
+	appserviceMu        *sync.Mutex
+	lastAppserviceTxnID string
+
+	numPollers         prometheus.Gauge
+	numDuplicateEvents prometheus.Counter
+	toDeviceQueueDepth prometheus.Histogram
+	subSystem          string
 }
 
 func NewHandler(
@@ -71,11 +80,13 @@ func NewHandler(
 			Notif     int
 		}),
 		accountDataMap:   &sync.Map{},
+		presenceMap:      &sync.Map{},
 		typingMu:         &sync.Mutex{},
 		typingHandler:    make(map[string]sync2.PollerID),
 		PendingTxnIDs:    sync2.NewPendingTransactionIDs(pMap.DeviceIDs),
 		deviceDataTicker: sync2.NewDeviceDataTicker(deviceDataUpdateDuration),
 		e2eeWorkerPool:   internal.NewWorkerPool(500), // TODO: assign as fraction of db max conns, not hardcoded
+		appserviceMu:     &sync.Mutex{},
 	}
 
 	if enablePrometheus {
@@ -105,6 +116,11 @@ func (h *Handler) Listen() {
 	go h.deviceDataTicker.Run()
 }
 
+// Shutdown stops every poller once it has stored what it is processing. See sync2.PollerMap.Shutdown.
+func (h *Handler) Shutdown(ctx context.Context) error {
+	return h.pMap.Shutdown(ctx)
+}
+
 func (h *Handler) Teardown() {
 	// stop polling and tear down DB conns
 	h.v3Sub.Teardown()
@@ -119,6 +135,12 @@ func (h *Handler) Teardown() {
 	if h.numPollers != nil {
 		prometheus.Unregister(h.numPollers)
 	}
+	if h.numDuplicateEvents != nil {
+		prometheus.Unregister(h.numDuplicateEvents)
+	}
+	if h.toDeviceQueueDepth != nil {
+		prometheus.Unregister(h.toDeviceQueueDepth)
+	}
 }
 
 func (h *Handler) StartV2Pollers() {
@@ -133,6 +155,7 @@ func (h *Handler) StartV2Pollers() {
 	// Too low and this will take ages for the v2 pollers to startup.
 	numWorkers := 16
 	numFails := 0
+	numAppservice := 0
 	ch := make(chan sync2.TokenForPoller, len(tokens))
 	for _, t := range tokens {
 		// if we fail to decrypt the access token, skip it.
@@ -140,10 +163,15 @@ func (h *Handler) StartV2Pollers() {
 			numFails++
 			continue
 		}
+		// appservice users are updated by appservice transactions rather than polled
+		if h.appservice.IsInterestedInUser(t.UserID) {
+			numAppservice++
+			continue
+		}
 		ch <- t
 	}
 	close(ch)
-	logger.Info().Int("num_devices", len(tokens)).Int("num_fail_decrypt", numFails).Msg("StartV2Pollers")
+	logger.Info().Int("num_devices", len(tokens)).Int("num_fail_decrypt", numFails).Int("num_appservice", numAppservice).Msg("StartV2Pollers")
 	var wg sync.WaitGroup
 	wg.Add(numWorkers)
 	for i := 0; i < numWorkers; i++ {
@@ -195,16 +223,24 @@ func (h *Handler) OnTerminated(ctx context.Context, pollerID sync2.PollerID) {
 	h.updateMetrics()
 }
 
-func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
-	err := h.v2Store.TokensTable.Delete(accessTokenHash)
+func (h *Handler) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+	var err error
+	if softLogout {
+		// the device still exists, and may already have a refreshed token which we should keep
+		err = h.v2Store.TokensTable.Delete(accessTokenHash)
+	} else {
+		// the device was logged out, so none of its tokens work any more
+		_, err = h.v2Store.TokensTable.DeleteDevice(userID, deviceID)
+	}
 	if err != nil {
 		logger.Err(err).Str("user", userID).Str("device", deviceID).Str("access_token_hash", accessTokenHash).Msg("V2: failed to expire token")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 	}
 	// Notify v3 side so it can remove the connection from ConnMap
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2ExpiredToken{
-		UserID:   userID,
-		DeviceID: deviceID,
+		UserID:     userID,
+		DeviceID:   deviceID,
+		SoftLogout: softLogout,
 	})
 }
 
@@ -216,6 +252,21 @@ func (h *Handler) addPrometheusMetrics() {
 		Help:      "Number of active sync v2 pollers.",
 	})
 	prometheus.MustRegister(h.numPollers)
+	h.numDuplicateEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "num_duplicate_events",
+		Help:      "Number of duplicate timeline events dropped when accumulating sync v2 timelines.",
+	})
+	prometheus.MustRegister(h.numDuplicateEvents)
+	h.toDeviceQueueDepth = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sliding_sync",
+		Subsystem: h.subSystem,
+		Name:      "to_device_queue_depth",
+		Help:      "Number of to-device messages stored for a device after new messages are added.",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 6),
+	})
+	prometheus.MustRegister(h.toDeviceQueueDepth)
 }
 
 // Emits nothing as no downstream components need it.
@@ -306,6 +357,9 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return err
 	}
+	if accResult.NumDuplicates > 0 && h.numDuplicateEvents != nil {
+		h.numDuplicateEvents.Add(float64(accResult.NumDuplicates))
+	}
 
 	// Consumers should reload state content before processing new timeline events.
 	if accResult.IncludesStateRedaction {
@@ -317,9 +371,10 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID strin
 	// We've updated the database. Now tell any pubsub listeners what we learned.
 	if accResult.NumNew != 0 {
 		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Accumulate{
-			RoomID:    roomID,
-			PrevBatch: timeline.PrevBatch,
-			EventNIDs: accResult.TimelineNIDs,
+			RoomID:          roomID,
+			PrevBatch:       timeline.PrevBatch,
+			EventNIDs:       accResult.TimelineNIDs,
+			MissingPrevious: accResult.MissingPrevious,
 		})
 	}
 
@@ -422,6 +477,33 @@ func (h *Handler) SetTyping(ctx context.Context, pollerID sync2.PollerID, roomID
 	})
 }
 
+func (h *Handler) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	// Every poller sharing a room with a user sees their presence, so suppress duplicates by
+	// remembering the last presence state of each user.
+	dedupedEvents := make([]json.RawMessage, 0, len(events))
+	for _, ev := range events {
+		parsed := gjson.ParseBytes(ev)
+		sender := parsed.Get("sender").Str
+		if sender == "" || parsed.Get("type").Str != "m.presence" {
+			continue
+		}
+		thisHash := presenceHash(parsed.Get("content"))
+		last, _ := h.presenceMap.Load(sender)
+		if last != nil && last.(uint64) == thisHash {
+			continue
+		}
+		dedupedEvents = append(dedupedEvents, ev)
+		h.presenceMap.Store(sender, thisHash)
+	}
+	if len(dedupedEvents) == 0 {
+		return
+	}
+	// like typing notifs, presence is ephemeral so is not persisted.
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Presence{
+		Events: dedupedEvents,
+	})
+}
+
 func (h *Handler) OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage) {
 	// update our records - we make an artifically new RR event if there are genuine changes
 	// else it returns nil
@@ -447,6 +529,12 @@ func (h *Handler) AddToDeviceMessages(ctx context.Context, userID, deviceID stri
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return err
 	}
+	if h.toDeviceQueueDepth != nil {
+		// devices which don't sync build up a queue until the messages are purged
+		if depth, err := h.Store.ToDeviceTable.CountMessages(userID, deviceID); err == nil {
+			h.toDeviceQueueDepth.Observe(float64(depth))
+		}
+	}
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2DeviceMessages{
 		UserID:   userID,
 		DeviceID: deviceID,
@@ -587,13 +675,18 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 			UserID:   p.UserID,
 			DeviceID: p.DeviceID,
 		}
-		_, err = h.pMap.EnsurePolling(
-			pid, accessToken, since, false, log,
-		)
-		if err != nil {
-			log.Err(err).Msg("Failed to start poller")
+		if h.appservice.IsInterestedInUser(p.UserID) {
+			// the user's rooms are updated by appservice transactions, so there is nothing to poll
+			log.Info().Msg("EnsurePolling: appservice user, not polling")
+		} else {
+			_, err = h.pMap.EnsurePolling(
+				pid, accessToken, since, false, log,
+			)
+			if err != nil {
+				log.Err(err).Msg("Failed to start poller")
+			}
+			h.updateMetrics()
 		}
-		h.updateMetrics()
 		h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InitialSyncComplete{
 			UserID:   p.UserID,
 			DeviceID: p.DeviceID,
@@ -602,6 +695,24 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 	}()
 }
 
+// UpdateAccessToken switches the poller for the device to the new access token, so it keeps
+// polling when the client refreshes its token rather than dying when the old one expires.
+func (h *Handler) UpdateAccessToken(p *pubsub.V3UpdateAccessToken) {
+	log := logger.With().Str("user_id", p.UserID).Str("device_id", p.DeviceID).Logger()
+	accessToken, _, err := h.v2Store.TokensTable.GetTokenAndSince(p.UserID, p.DeviceID, p.AccessTokenHash)
+	if err != nil {
+		log.Err(err).Msg("V3Sub: UpdateAccessToken unknown device")
+		return
+	}
+	pid := sync2.PollerID{
+		UserID:   p.UserID,
+		DeviceID: p.DeviceID,
+	}
+	if h.pMap.UpdateAccessToken(pid, accessToken) {
+		log.Info().Msg("UpdateAccessToken: poller switched to new access token")
+	}
+}
+
 func (h *Handler) startPollerExpiryTicker() {
 	if h.pollerExpiryTicker != nil {
 		return
@@ -636,6 +747,12 @@ func (h *Handler) ExpireOldPollers() {
 	}
 }
 
+// presenceHash hashes the fields of presence content which clients show. last_active_ago is left
+// out as it is different in every poller's copy of the same presence.
+func presenceHash(content gjson.Result) uint64 {
+	return fnvHash(json.RawMessage(content.Get("presence").Str + "|" + content.Get("status_msg").Raw + "|" + content.Get("currently_active").Raw))
+}
+
 func fnvHash(event json.RawMessage) uint64 {
 	h := fnv.New64a()
 	h.Write(event)
@@ -36,20 +36,49 @@ type pollInfo struct {
 }
 
 type mockPollerMap struct {
-	calls []pollInfo
+	calls         []pollInfo
+	statuses      map[sync2.PollerID]sync2.PollerStatus
+	expired       []sync2.PollerID
+	updatedTokens map[sync2.PollerID]string
 }
 
 func (p *mockPollerMap) NumPollers() int {
 	return 0
 }
 func (p *mockPollerMap) Terminate() {}
+func (p *mockPollerMap) Shutdown(ctx context.Context) error {
+	return nil
+}
 
 func (p *mockPollerMap) DeviceIDs(userID string) []string {
 	return nil
 }
 
-func (p *mockPollerMap) ExpirePollers([]sync2.PollerID) int {
-	return 0
+func (p *mockPollerMap) ExpirePollers(pids []sync2.PollerID) int {
+	var numExpired int
+	for _, pid := range pids {
+		if _, ok := p.statuses[pid]; ok {
+			p.expired = append(p.expired, pid)
+			numExpired++
+		}
+	}
+	return numExpired
+}
+
+func (p *mockPollerMap) UpdateAccessToken(pid sync2.PollerID, accessToken string) bool {
+	if _, ok := p.statuses[pid]; !ok {
+		return false
+	}
+	if p.updatedTokens == nil {
+		p.updatedTokens = make(map[sync2.PollerID]string)
+	}
+	p.updatedTokens[pid] = accessToken
+	return true
+}
+
+func (p *mockPollerMap) Status(pid sync2.PollerID) (sync2.PollerStatus, bool) {
+	status, ok := p.statuses[pid]
+	return status, ok
 }
 
 func (p *mockPollerMap) EnsurePolling(pid sync2.PollerID, accessToken, v2since string, isStartup bool, logger zerolog.Logger) (bool, error) {
@@ -187,6 +216,54 @@ func TestHandlerFreshEnsurePolling(t *testing.T) {
 
 }
 
+// Test that a refreshed token is handed to the running poller, and that soft logouts only forget
+// the expired token whereas hard logouts forget every token for the device.
+func TestHandlerRefreshedAccessToken(t *testing.T) {
+	store := state.NewStorage(postgresURI)
+	v2Store := sync2.NewStore(postgresURI, "secret")
+	alice := "@alice:refresh"
+	deviceID := "ALICE"
+	pid := sync2.PollerID{UserID: alice, DeviceID: deviceID}
+	pMap := &mockPollerMap{statuses: map[sync2.PollerID]sync2.PollerStatus{pid: {}}}
+	pub := newMockPub()
+	sub := &mockSub{}
+	h, err := handler2.NewHandler(pMap, v2Store, store, pub, sub, false, time.Minute)
+	assertNoError(t, err)
+
+	var oldTok, newTok *sync2.Token
+	sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		err = v2Store.DevicesTable.InsertDevice(txn, alice, deviceID)
+		assertNoError(t, err)
+		oldTok, err = v2Store.TokensTable.Insert(txn, "oldToken", alice, deviceID, time.Now())
+		assertNoError(t, err)
+		newTok, err = v2Store.TokensTable.Insert(txn, "newToken", alice, deviceID, time.Now())
+		assertNoError(t, err)
+		return nil
+	})
+
+	h.UpdateAccessToken(&pubsub.V3UpdateAccessToken{
+		UserID:          alice,
+		DeviceID:        deviceID,
+		AccessTokenHash: newTok.AccessTokenHash,
+	})
+	if got := pMap.updatedTokens[pid]; got != "newToken" {
+		t.Fatalf("poller was not switched to the new token, got %q", got)
+	}
+
+	h.OnExpiredToken(context.Background(), oldTok.AccessTokenHash, alice, deviceID, true)
+	if _, err = v2Store.TokensTable.Token("oldToken"); err == nil {
+		t.Fatalf("soft logout did not forget the expired token")
+	}
+	if _, err = v2Store.TokensTable.Token("newToken"); err != nil {
+		t.Fatalf("soft logout forgot the refreshed token: %s", err)
+	}
+
+	h.OnExpiredToken(context.Background(), newTok.AccessTokenHash, alice, deviceID, false)
+	if _, err = v2Store.TokensTable.Token("newToken"); err == nil {
+		t.Fatalf("hard logout did not forget the device's tokens")
+	}
+}
+
 func TestSetTypingConcurrently(t *testing.T) {
 	store := state.NewStorage(postgresURI)
 	v2Store := sync2.NewStore(postgresURI, "secret")
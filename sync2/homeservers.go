@@ -0,0 +1,247 @@
+package sync2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+type ctxServerName struct{}
+
+// WithServerName returns a context for requests to the homeserver with this server name, for
+// Clients which serve more than one homeserver. See MultiHomeserverClient.
+func WithServerName(ctx context.Context, serverName string) context.Context {
+	return context.WithValue(ctx, ctxServerName{}, serverName)
+}
+
+// ServerNameFromContext returns the server name set by WithServerName, or "" if there is none.
+func ServerNameFromContext(ctx context.Context) string {
+	serverName, _ := ctx.Value(ctxServerName{}).(string)
+	return serverName
+}
+
+// ServerNameOf returns the server name of a user or room ID e.g "example.com" for
+// "@alice:example.com", or "" if the ID has no server name.
+func ServerNameOf(id string) string {
+	_, serverName, ok := strings.Cut(id, ":")
+	if !ok {
+		return ""
+	}
+	return serverName
+}
+
+// ParseHomeservers parses a comma separated list of server names, each optionally followed by
+// =base URL e.g "example.com=https://matrix.example.com,example.org". Server names without a base URL
+// map to "", meaning the base URL is looked up with .well-known.
+func ParseHomeservers(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	homeservers := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		serverName, baseURL, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if serverName == "" || strings.ContainsAny(serverName, "/ ") {
+			return nil, fmt.Errorf("invalid server name in %q", entry)
+		}
+		if _, exists := homeservers[serverName]; exists {
+			return nil, fmt.Errorf("server name %s is listed more than once", serverName)
+		}
+		homeservers[serverName] = baseURL
+	}
+	return homeservers, nil
+}
+
+// ErrUnknownServerName is returned by MultiHomeserverClient for requests to homeservers which the
+// proxy is not configured to serve.
+var ErrUnknownServerName = fmt.Errorf("proxy does not serve this homeserver")
+
+// MultiHomeserverClient is a Client for deployments which serve users of more than one homeserver.
+// Requests are sent to the homeserver of the server name in their context, see WithServerName.
+// Only the configured homeservers are served, so that users of other homeservers cannot use the
+// proxy. Pollers are keyed by user ID, which includes the server name, so each homeserver's
+// pollers and stored data are kept apart without any changes to storage.
+type MultiHomeserverClient struct {
+	newClient func(baseURL string) *HTTPClient
+	// used to look up base URLs with .well-known
+	wellKnownClient *http.Client
+
+	mu       *sync.Mutex
+	baseURLs map[string]string
+	clients  map[string]*HTTPClient
+}
+
+// NewMultiHomeserverClient serves the homeservers in `homeservers`, a map of server name to the
+// base URL of its client-server API. Base URLs which are empty are looked up with
+// /.well-known/matrix/client the first time they are needed. newClient makes the client for each
+// homeserver.
+func NewMultiHomeserverClient(homeservers map[string]string, timeout time.Duration, newClient func(baseURL string) *HTTPClient) *MultiHomeserverClient {
+	baseURLs := make(map[string]string, len(homeservers))
+	for serverName, baseURL := range homeservers {
+		baseURLs[serverName] = baseURL
+	}
+	return &MultiHomeserverClient{
+		newClient:       newClient,
+		wellKnownClient: &http.Client{Timeout: timeout},
+		mu:              &sync.Mutex{},
+		baseURLs:        baseURLs,
+		clients:         make(map[string]*HTTPClient),
+	}
+}
+
+// ServerNames returns the server names of the homeservers which are served, sorted.
+func (c *MultiHomeserverClient) ServerNames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	serverNames := make([]string, 0, len(c.baseURLs))
+	for serverName := range c.baseURLs {
+		serverNames = append(serverNames, serverName)
+	}
+	sort.Strings(serverNames)
+	return serverNames
+}
+
+// ServerNameForHost returns the server name of the homeserver whose clients connect to the proxy
+// at this host, i.e the longest served server name which is the host or a parent domain of it,
+// e.g "example.com" for "syncv3.example.com". Returns false if no homeserver matches.
+func (c *MultiHomeserverClient) ServerNameForHost(host string) (string, bool) {
+	host = strings.ToLower(host)
+	best := ""
+	for _, serverName := range c.ServerNames() {
+		name := strings.ToLower(serverName)
+		if host != name && !strings.HasSuffix(host, "."+name) {
+			continue
+		}
+		if len(serverName) > len(best) {
+			best = serverName
+		}
+	}
+	if best == "" {
+		// the client may have connected on a different port to the homeserver
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			return c.ServerNameForHost(hostname)
+		}
+		return "", false
+	}
+	return best, true
+}
+
+// client returns the client for the homeserver in the context.
+func (c *MultiHomeserverClient) client(ctx context.Context) (*HTTPClient, error) {
+	serverName := ServerNameFromContext(ctx)
+	if serverName == "" {
+		return nil, fmt.Errorf("no server name for request")
+	}
+	c.mu.Lock()
+	client, ok := c.clients[serverName]
+	baseURL, served := c.baseURLs[serverName]
+	c.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+	if !served {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownServerName, serverName)
+	}
+	if baseURL == "" {
+		var err error
+		if baseURL, err = c.lookupWellKnown(ctx, serverName); err != nil {
+			return nil, err
+		}
+		logger.Info().Str("server_name", serverName).Str("base_url", baseURL).Msg("found homeserver with .well-known")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client, ok = c.clients[serverName]; !ok {
+		client = c.newClient(baseURL)
+		c.clients[serverName] = client
+	}
+	return client, nil
+}
+
+// lookupWellKnown returns the base URL of the homeserver from its /.well-known/matrix/client.
+func (c *MultiHomeserverClient) lookupWellKnown(ctx context.Context, serverName string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+serverName+"/.well-known/matrix/client", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	res, err := c.wellKnownClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch .well-known for %s: %w", serverName, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf(".well-known for %s returned HTTP %d", serverName, res.StatusCode)
+	}
+	var wellKnown struct {
+		Homeserver struct {
+			BaseURL string `json:"base_url"`
+		} `json:"m.homeserver"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&wellKnown); err != nil {
+		return "", fmt.Errorf("failed to decode .well-known for %s: %w", serverName, err)
+	}
+	if wellKnown.Homeserver.BaseURL == "" {
+		return "", fmt.Errorf(".well-known for %s has no m.homeserver base_url", serverName)
+	}
+	return internal.GetBaseURL(wellKnown.Homeserver.BaseURL), nil
+}
+
+func (c *MultiHomeserverClient) Versions(ctx context.Context) ([]string, error) {
+	client, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.Versions(ctx)
+}
+
+func (c *MultiHomeserverClient) WhoAmI(ctx context.Context, accessToken string) (string, string, bool, error) {
+	client, err := c.client(ctx)
+	if err != nil {
+		return "", "", false, err
+	}
+	return client.WhoAmI(ctx, accessToken)
+}
+
+func (c *MultiHomeserverClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
+	client, err := c.client(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return client.DoSyncV2(ctx, accessToken, since, isFirst, toDeviceOnly)
+}
+
+// DirectoryVisibility asks the homeserver in the context, or else the homeserver of the room ID.
+func (c *MultiHomeserverClient) DirectoryVisibility(ctx context.Context, roomID string) (string, error) {
+	if ServerNameFromContext(ctx) == "" {
+		ctx = WithServerName(ctx, ServerNameOf(roomID))
+	}
+	client, err := c.client(ctx)
+	if err != nil {
+		return "", err
+	}
+	return client.DirectoryVisibility(ctx, roomID)
+}
+
+func (c *MultiHomeserverClient) Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error) {
+	client, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.Messages(ctx, accessToken, roomID, from, limit)
+}
+
+func (c *MultiHomeserverClient) RoomState(ctx context.Context, accessToken, roomID string) ([]json.RawMessage, error) {
+	client, err := c.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.RoomState(ctx, accessToken, roomID)
+}
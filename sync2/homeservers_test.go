@@ -0,0 +1,127 @@
+package sync2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHomeservers(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{input: "", want: nil},
+		{input: "example.com", want: map[string]string{"example.com": ""}},
+		{
+			input: "example.com=https://matrix.example.com, example.org",
+			want:  map[string]string{"example.com": "https://matrix.example.com", "example.org": ""},
+		},
+		{input: "example.com,,example.org", wantErr: true},
+		{input: "=https://matrix.example.com", wantErr: true},
+		{input: "https://example.com", wantErr: true},
+		{input: "example.com,example.com=https://matrix.example.com", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseHomeservers(tc.input)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseHomeservers(%q): got err %v want err %v", tc.input, err, tc.wantErr)
+		}
+		if !tc.wantErr && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseHomeservers(%q): got %v want %v", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestServerNameForHost(t *testing.T) {
+	client := NewMultiHomeserverClient(map[string]string{
+		"example.com":     "https://matrix.example.com",
+		"sub.example.com": "https://matrix.sub.example.com",
+		"localhost:8448":  "http://localhost:8008",
+	}, time.Second, nil)
+	testCases := []struct {
+		host   string
+		want   string
+		wantOK bool
+	}{
+		{host: "example.com", want: "example.com", wantOK: true},
+		{host: "syncv3.EXAMPLE.com", want: "example.com", wantOK: true},
+		{host: "syncv3.example.com:443", want: "example.com", wantOK: true},
+		{host: "syncv3.sub.example.com", want: "sub.example.com", wantOK: true},
+		{host: "localhost:8448", want: "localhost:8448", wantOK: true},
+		{host: "notexample.com"},
+		{host: "example.org"},
+		{host: "localhost:8009"},
+	}
+	for _, tc := range testCases {
+		got, ok := client.ServerNameForHost(tc.host)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("ServerNameForHost(%s): got %q %v want %q %v", tc.host, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+// Test that requests go to the homeserver of the server name in their context, looking up base
+// URLs with .well-known if they are not configured.
+func TestMultiHomeserverClient(t *testing.T) {
+	newHomeserver := func(userID string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(`{"user_id":"` + userID + `","device_id":"DEVICE"}`))
+		}))
+	}
+	hsA := newHomeserver("@alice:a.localhost")
+	defer hsA.Close()
+	hsB := newHomeserver("@bob:b.localhost")
+	defer hsB.Close()
+	wellKnownLookups := 0
+	wellKnown := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/.well-known/matrix/client" {
+			t.Errorf("got well-known request for %s", req.URL.Path)
+		}
+		wellKnownLookups++
+		w.Write([]byte(`{"m.homeserver":{"base_url":"` + hsB.URL + `/"}}`))
+	}))
+	defer wellKnown.Close()
+	wellKnownURL, _ := url.Parse(wellKnown.URL)
+	serverNameB := wellKnownURL.Host
+
+	client := NewMultiHomeserverClient(map[string]string{
+		"a.localhost": hsA.URL,
+		serverNameB:   "",
+	}, time.Second, func(baseURL string) *HTTPClient {
+		return NewHTTPClient(time.Second, time.Second, baseURL)
+	})
+	client.wellKnownClient = wellKnown.Client()
+
+	testCases := []struct {
+		serverName string
+		wantUserID string
+	}{
+		{serverName: "a.localhost", wantUserID: "@alice:a.localhost"},
+		{serverName: serverNameB, wantUserID: "@bob:b.localhost"},
+		{serverName: serverNameB, wantUserID: "@bob:b.localhost"},
+	}
+	for _, tc := range testCases {
+		userID, _, _, err := client.WhoAmI(WithServerName(context.Background(), tc.serverName), "token")
+		if err != nil || userID != tc.wantUserID {
+			t.Errorf("WhoAmI on %s: got %s %v want %s", tc.serverName, userID, err, tc.wantUserID)
+		}
+	}
+	if wellKnownLookups != 1 {
+		t.Errorf("got %d .well-known lookups, want 1", wellKnownLookups)
+	}
+
+	// homeservers which aren't configured, or requests without a server name, are refused
+	if _, _, _, err := client.WhoAmI(WithServerName(context.Background(), "c.localhost"), "token"); !errors.Is(err, ErrUnknownServerName) {
+		t.Errorf("WhoAmI on unknown server: got err %v want ErrUnknownServerName", err)
+	}
+	if _, _, _, err := client.WhoAmI(context.Background(), "token"); err == nil {
+		t.Errorf("WhoAmI without a server name: got no error")
+	}
+}
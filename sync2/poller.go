@@ -45,6 +45,8 @@ type V2DataReceiver interface {
 	Initialise(ctx context.Context, roomID string, state []json.RawMessage) error // snapshot ID?
 	// SetTyping indicates which users are typing.
 	SetTyping(ctx context.Context, pollerID PollerID, roomID string, ephEvent json.RawMessage)
+	// Sent when there are presence events, which are global rather than per-room.
+	OnPresence(ctx context.Context, userID string, events []json.RawMessage)
 	// Sent when there is a new receipt
 	OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
 	// AddToDeviceMessages adds this chunk of to_device messages. Preserve the ordering.
@@ -65,18 +67,41 @@ type V2DataReceiver interface {
 	OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
 	// Sent when the poll loop terminates
 	OnTerminated(ctx context.Context, pollerID PollerID)
-	// Sent when the token gets a 401 response
-	OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string)
+	// Sent when the token gets a 401 response. softLogout is false if the homeserver said the device
+	// was logged out, rather than just this access token having expired.
+	OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool)
 }
 
 type IPollerMap interface {
 	EnsurePolling(pid PollerID, accessToken, v2since string, isStartup bool, logger zerolog.Logger) (created bool, err error)
+	// UpdateAccessToken switches the poller for this device to a new access token, e.g because the
+	// client refreshed its token. Returns false if there is no running poller for the device.
+	UpdateAccessToken(pid PollerID, accessToken string) bool
 	NumPollers() int
 	Terminate()
 	DeviceIDs(userID string) []string
 	// ExpirePollers requests that the given pollers are terminated as if their access
 	// tokens had expired. Returns the number of pollers successfully terminated.
 	ExpirePollers(ids []PollerID) int
+	// Status returns the status of the poller for this device, or false if there is no poller.
+	Status(pid PollerID) (status PollerStatus, ok bool)
+	// Shutdown terminates every poller and waits for them to finish processing what they have
+	// received, or for ctx to be done.
+	Shutdown(ctx context.Context) error
+}
+
+// PollerStatus describes the state of a poller, for diagnostics.
+type PollerStatus struct {
+	// The since token the poller will use on its next request to the upstream homeserver. Empty
+	// if the poller has not completed an initial sync.
+	Since string
+	// When the poller last finished processing a sync response. Zero if it never has.
+	LastSync time.Time
+	// True if the poller has stopped e.g because its access token expired.
+	Terminated bool
+	// The number of sync v2 requests in a row which have failed. The poller waits before each
+	// retry whilst this is above 0, and gives up after 1000.
+	FailCount int
 }
 
 // PollerMap is a map of device ID to Poller
@@ -92,6 +117,8 @@ type PollerMap struct {
 	gappyStateSizeVec           *prometheus.HistogramVec
 	numOutstandingSyncReqsGauge prometheus.Gauge
 	totalNumPollsCounter        prometheus.Counter
+	pollLagGauge                prometheus.GaugeFunc
+	stateRefetcher              *stateRefetcher
 }
 
 // NewPollerMap makes a new PollerMap. Guarantees that the V2DataReceiver will be called on the same
@@ -124,6 +151,8 @@ func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 		pollerMu: &sync.Mutex{},
 		Pollers:  make(map[PollerID]*poller),
 		executor: make(chan func(), 0),
+		// shared by every poller, so each room is only re-fetched once
+		stateRefetcher: newStateRefetcher(enablePrometheus),
 	}
 	if enablePrometheus {
 		pm.processHistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -164,14 +193,60 @@ func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 			Help:      "Number of sync v2 requests that have yet to return a response.",
 		})
 		prometheus.MustRegister(pm.numOutstandingSyncReqsGauge)
+		pm.pollLagGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "max_poll_lag_secs",
+			Help:      "Seconds since the running poller which has gone the longest without a sync v2 response last got one. Pollers long-poll, so this should stay below the sync v2 timeout.",
+		}, pm.maxPollLag)
+		prometheus.MustRegister(pm.pollLagGauge)
 	}
 	return pm
 }
 
+// maxPollLag returns the longest time in seconds since a running poller processed a response,
+// ignoring pollers which have not processed one yet.
+func (h *PollerMap) maxPollLag() float64 {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	var lag time.Duration
+	for _, p := range h.Pollers {
+		status := p.Status()
+		if status.Terminated || status.LastSync.IsZero() {
+			continue
+		}
+		if since := timeSince(status.LastSync); since > lag {
+			lag = since
+		}
+	}
+	return lag.Seconds()
+}
+
 func (h *PollerMap) SetCallbacks(callbacks V2DataReceiver) {
 	h.callbacks = callbacks
 }
 
+// Shutdown terminates every poller, cancelling their requests to the homeserver, and waits for
+// their poll loops to finish, so responses being processed are stored along with the since token
+// to carry on from. Returns ctx.Err() if ctx is done first.
+func (h *PollerMap) Shutdown(ctx context.Context) error {
+	h.pollerMu.Lock()
+	pollers := make([]*poller, 0, len(h.Pollers))
+	for _, p := range h.Pollers {
+		p.Terminate()
+		pollers = append(pollers, p)
+	}
+	h.pollerMu.Unlock()
+	for _, p := range pollers {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
 // Terminate all pollers. Useful in tests.
 func (h *PollerMap) Terminate() {
 	h.pollerMu.Lock()
@@ -194,6 +269,10 @@ func (h *PollerMap) Terminate() {
 	if h.numOutstandingSyncReqsGauge != nil {
 		prometheus.Unregister(h.numOutstandingSyncReqsGauge)
 	}
+	if h.pollLagGauge != nil {
+		prometheus.Unregister(h.pollLagGauge)
+	}
+	h.stateRefetcher.Teardown()
 	close(h.executor)
 }
 
@@ -222,6 +301,27 @@ func (h *PollerMap) DeviceIDs(userID string) []string {
 	return devices
 }
 
+func (h *PollerMap) Status(pid PollerID) (status PollerStatus, ok bool) {
+	h.pollerMu.Lock()
+	p, ok := h.Pollers[pid]
+	h.pollerMu.Unlock()
+	if !ok {
+		return PollerStatus{}, false
+	}
+	return p.Status(), true
+}
+
+func (h *PollerMap) UpdateAccessToken(pid PollerID, accessToken string) bool {
+	h.pollerMu.Lock()
+	p, ok := h.Pollers[pid]
+	h.pollerMu.Unlock()
+	if !ok || p.terminated.Load() {
+		return false
+	}
+	p.setAccessToken(accessToken)
+	return true
+}
+
 func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 	h.pollerMu.Lock()
 	numTerminated := 0
@@ -239,7 +339,7 @@ func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 		p.Terminate()
 		// Ensure that we won't recreate this poller on startup. If it reappears later,
 		// we'll make another EnsurePolling call which will recreate the poller.
-		h.callbacks.OnExpiredToken(context.Background(), hashToken(p.accessToken), p.userID, p.deviceID)
+		h.callbacks.OnExpiredToken(context.Background(), hashToken(p.currentAccessToken()), p.userID, p.deviceID, true)
 		numTerminated++
 	}
 
@@ -262,7 +362,7 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 	poller, ok := h.Pollers[pid]
 	// a poller exists and hasn't been terminated so we don't need to do anything
 	if ok && !poller.terminated.Load() {
-		if poller.accessToken != accessToken {
+		if poller.currentAccessToken() != accessToken {
 			logger.Warn().Msg("PollerMap.EnsurePolling: poller already running with different access token")
 		}
 		h.pollerMu.Unlock()
@@ -294,6 +394,7 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 	poller.gappyStateSizeVec = h.gappyStateSizeVec
 	poller.numOutstandingSyncReqs = h.numOutstandingSyncReqsGauge
 	poller.totalNumPolls = h.totalNumPollsCounter
+	poller.stateRefetcher = h.stateRefetcher
 	go poller.Poll(v2since)
 	h.Pollers[pid] = poller
 
@@ -347,6 +448,15 @@ func (h *PollerMap) SetTyping(ctx context.Context, pollerID PollerID, roomID str
 	}
 	wg.Wait()
 }
+func (h *PollerMap) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		h.callbacks.OnPresence(ctx, userID, events)
+		wg.Done()
+	}
+	wg.Wait()
+}
 func (h *PollerMap) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) (err error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -379,8 +489,8 @@ func (h *PollerMap) OnTerminated(ctx context.Context, pollerID PollerID) {
 	h.callbacks.OnTerminated(ctx, pollerID)
 }
 
-func (h *PollerMap) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
-	h.callbacks.OnExpiredToken(ctx, accessTokenHash, userID, deviceID)
+func (h *PollerMap) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+	h.callbacks.OnExpiredToken(ctx, accessTokenHash, userID, deviceID, softLogout)
 }
 
 func (h *PollerMap) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
@@ -424,8 +534,9 @@ func (h *PollerMap) OnE2EEData(ctx context.Context, userID, deviceID string, otk
 
 // Poller can automatically poll the sync v2 endpoint and accumulate the responses in storage
 type poller struct {
-	userID      string
-	deviceID    string
+	userID   string
+	deviceID string
+	// guarded by statusMu, as the client can refresh it whilst the poller is running
 	accessToken string
 	client      Client
 	receiver    V2DataReceiver
@@ -440,6 +551,17 @@ type poller struct {
 	// flag set to true when poll() returns due to expired access tokens
 	terminated *atomic.Bool
 	wg         *sync.WaitGroup
+	// closed when Poll returns
+	done chan struct{}
+
+	// the since token and time of the last processed sync response, and the number of failed
+	// requests since, for diagnostics
+	statusMu  *sync.Mutex
+	since     string
+	lastSync  time.Time
+	failCount int
+	// cancels the request to the homeserver in flight, guarded by statusMu
+	cancelRequest context.CancelFunc
 
 	// stats about poll response data, for logging purposes
 	lastLogged              time.Time
@@ -450,6 +572,7 @@ type poller struct {
 	totalInvites            int
 	totalDeviceEvents       int
 	totalAccountData        int
+	totalPresence           int
 	totalChangedDeviceLists int
 	totalLeftDeviceLists    int
 
@@ -459,6 +582,10 @@ type poller struct {
 	gappyStateSizeVec      *prometheus.HistogramVec
 	numOutstandingSyncReqs prometheus.Gauge
 	totalNumPolls          prometheus.Counter
+
+	// re-fetches the state of rooms with gappy timelines when the poller falls behind. nil to
+	// never re-fetch state.
+	stateRefetcher *stateRefetcher
 }
 
 func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataReceiver, logger zerolog.Logger, initialToDeviceOnly bool) *poller {
@@ -471,8 +598,10 @@ func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataR
 		client:              client,
 		receiver:            receiver,
 		terminated:          &atomic.Bool{},
+		statusMu:            &sync.Mutex{},
 		logger:              logger,
 		wg:                  &wg,
+		done:                make(chan struct{}),
 		initialToDeviceOnly: initialToDeviceOnly,
 	}
 }
@@ -482,8 +611,62 @@ func (p *poller) WaitUntilInitialSync() {
 	p.wg.Wait()
 }
 
+// Terminate stops the poll loop, cancelling any request to the homeserver in flight. A response
+// which is being processed is processed in full.
 func (p *poller) Terminate() {
 	p.terminated.CompareAndSwap(false, true)
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	if p.cancelRequest != nil {
+		p.cancelRequest()
+	}
+}
+
+// setCancelRequest remembers how to cancel the request to the homeserver about to be made. Returns
+// false if the poller has been terminated, in which case the request must not be made.
+func (p *poller) setCancelRequest(cancel context.CancelFunc) bool {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	p.cancelRequest = cancel
+	// Terminate sets the flag before taking statusMu, so either it sees this cancel func or we see
+	// the flag
+	return !p.terminated.Load()
+}
+
+func (p *poller) Status() PollerStatus {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	return PollerStatus{
+		Since:      p.since,
+		LastSync:   p.lastSync,
+		Terminated: p.terminated.Load(),
+		FailCount:  p.failCount,
+	}
+}
+
+func (p *poller) currentAccessToken() string {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	return p.accessToken
+}
+
+func (p *poller) setAccessToken(accessToken string) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	p.accessToken = accessToken
+}
+
+func (p *poller) setFailCount(failCount int) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	p.failCount = failCount
+}
+
+func (p *poller) setStatus(since string, lastSync time.Time) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	p.since = since
+	p.lastSync = lastSync
 }
 
 type pollLoopState struct {
@@ -491,6 +674,8 @@ type pollLoopState struct {
 	failCount       int
 	since           string
 	lastStoredSince time.Time // The time we last stored the since token in the database
+	storedSince     string    // The since token we last stored in the database
+	lastResponse    time.Time // The time we last processed a sync response
 }
 
 // Poll will block forever, repeatedly calling v2 sync. Do this in a goroutine.
@@ -505,9 +690,12 @@ func (p *poller) Poll(since string) {
 	hub.ConfigureScope(func(scope *sentry.Scope) {
 		scope.SetUser(sentry.User{Username: p.userID, ID: p.deviceID})
 	})
-	ctx := sentry.SetHubOnContext(context.Background(), hub)
+	// requests go to this user's homeserver, if more than one is served
+	ctx := sentry.SetHubOnContext(WithServerName(context.Background(), ServerNameOf(p.userID)), hub)
 
 	p.logger.Info().Str("since", since).Msg("Poller: v2 poll loop started")
+	p.setStatus(since, time.Time{})
+	defer close(p.done)
 	defer func() {
 		panicErr := recover()
 		if panicErr != nil {
@@ -526,15 +714,22 @@ func (p *poller) Poll(since string) {
 		since:     since,
 		// Setting time.Time{} results in the first poll loop to immediately store the since token.
 		lastStoredSince: time.Time{},
+		storedSince:     since,
 	}
 	for !p.terminated.Load() {
 		ctx, task := internal.StartTask(ctx, "Poll")
 		err := p.poll(ctx, &state)
 		task.End()
+		p.setFailCount(state.failCount)
 		if err != nil {
 			break
 		}
 	}
+	// store the since token of the last response processed, else it is processed again when the
+	// device is next polled
+	if state.since != state.storedSince {
+		p.receiver.UpdateDeviceSince(ctx, p.userID, p.deviceID, state.since)
+	}
 	p.maybeLogStats(true)
 	// always unblock EnsurePolling else we can end up head-of-line blocking other pollers!
 	if state.firstTime {
@@ -555,7 +750,7 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 			// 3s * 1000 = 3000s = 50 minutes
 			errMsg := "poller: access token has failed >1000 times to /sync, terminating loop"
 			p.logger.Warn().Msg(errMsg)
-			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
+			p.receiver.OnExpiredToken(ctx, hashToken(p.currentAccessToken()), p.userID, p.deviceID, true)
 			p.Terminate()
 			return fmt.Errorf(errMsg)
 		}
@@ -574,7 +769,15 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Inc()
 	}
-	resp, statusCode, err := p.client.DoSyncV2(spanCtx, p.accessToken, s.since, s.firstTime, p.initialToDeviceOnly)
+	reqCtx, cancelRequest := context.WithCancel(spanCtx)
+	var resp *SyncResponse
+	var statusCode int
+	var err error
+	accessToken := p.currentAccessToken()
+	if p.setCancelRequest(cancelRequest) {
+		resp, statusCode, err = p.client.DoSyncV2(reqCtx, accessToken, s.since, s.firstTime, p.initialToDeviceOnly)
+	}
+	cancelRequest()
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Dec()
 	}
@@ -590,10 +793,14 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 			p.logger.Warn().Int("code", statusCode).Err(err).Msg("Poller: sync v2 poll returned temporary error")
 			s.failCount += 1
 			return nil
+		} else if p.currentAccessToken() != accessToken {
+			// the client refreshed its access token whilst this request was in flight
+			p.logger.Info().Int("code", statusCode).Msg("Poller: access token was replaced, retrying with the new token")
+			return nil
 		} else {
 			errMsg := "poller: access token has been invalidated, terminating loop"
-			p.logger.Warn().Msg(errMsg)
-			p.receiver.OnExpiredToken(ctx, hashToken(p.accessToken), p.userID, p.deviceID)
+			p.logger.Warn().Bool("soft_logout", err == HTTP401SoftLogout).Msg(errMsg)
+			p.receiver.OnExpiredToken(ctx, hashToken(accessToken), p.userID, p.deviceID, err == HTTP401SoftLogout)
 			p.Terminate()
 			return fmt.Errorf(errMsg)
 		}
@@ -619,7 +826,11 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 		s.failCount += 1
 		return nil
 	}
-	retryErr = p.parseRoomsResponse(ctx, resp)
+	p.parsePresence(ctx, resp)
+	// a poller which has gone a while without a response may have been sent gappy timelines for
+	// rooms whose state changed in ways the homeserver doesn't tell us about
+	behind := s.since != "" && timeSince(s.lastResponse) > StaleSyncThreshold
+	retryErr = p.parseRoomsResponse(ctx, resp, behind)
 	if shouldRetry(retryErr) {
 		p.logger.Err(retryErr).Msg("Poller: parseRoomsResponse returned an error")
 		s.failCount += 1
@@ -642,11 +853,14 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	wasFirst := s.firstTime
 
 	s.since = resp.NextBatch
+	s.lastResponse = time.Now()
+	p.setStatus(s.since, s.lastResponse)
 	// Persist the since token if it either was more than one minute ago since we
 	// last stored it OR the response contains to-device messages
 	if timeSince(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0 {
 		p.receiver.UpdateDeviceSince(ctx, p.userID, p.deviceID, s.since)
 		s.lastStoredSince = time.Now()
+		s.storedSince = s.since
 	}
 
 	if s.firstTime {
@@ -781,7 +995,17 @@ func (p *poller) parseGlobalAccountData(ctx context.Context, res *SyncResponse)
 	return p.receiver.OnAccountData(ctx, p.userID, AccountDataGlobalRoom, res.AccountData.Events)
 }
 
-func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) error {
+func (p *poller) parsePresence(ctx context.Context, res *SyncResponse) {
+	if len(res.Presence.Events) == 0 {
+		return
+	}
+	p.totalPresence += len(res.Presence.Events)
+	p.receiver.OnPresence(ctx, p.userID, res.Presence.Events)
+}
+
+// parseRoomsResponse processes the rooms in the response. If the poller has fallen behind, the
+// state of rooms with gappy timelines is re-fetched after their timelines are stored.
+func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse, behind bool) error {
 	ctx, task := internal.StartTask(ctx, "parseRoomsResponse")
 	defer task.End()
 	stateCalls := 0
@@ -872,11 +1096,15 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 			timelineCalls++
 			p.trackTimelineSize(len(roomData.Timeline.Events), roomData.Timeline.Limited)
 
+			roomData.Timeline.NextBatch = res.NextBatch
 			err := p.receiver.Accumulate(ctx, p.userID, p.deviceID, roomID, roomData.Timeline)
 			if err != nil {
 				lastErrs = append(lastErrs, fmt.Errorf("Accumulate[%s]: %w", roomID, err))
 				continue
 			}
+			if behind && roomData.Timeline.Limited {
+				p.refetchRoomState(ctx, roomID)
+			}
 		}
 
 		// process unread counts AFTER events so global caches have been updated by the time this metadata is added.
@@ -889,6 +1117,7 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 	for roomID, roomData := range res.Rooms.Leave {
 		if len(roomData.Timeline.Events) > 0 {
 			p.trackTimelineSize(len(roomData.Timeline.Events), roomData.Timeline.Limited)
+			roomData.Timeline.NextBatch = res.NextBatch
 			err := p.receiver.Accumulate(ctx, p.userID, p.deviceID, roomID, roomData.Timeline)
 			if err != nil {
 				lastErrs = append(lastErrs, fmt.Errorf("Accumulate_Leave[%s]: %w", roomID, err))
@@ -919,6 +1148,14 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 			lastErrs = append(lastErrs, fmt.Errorf("OnInvite[%s]: %w", roomID, err))
 		}
 	}
+	// knocks are stored like invites, as both are rooms we only know about from stripped state.
+	// They are told apart by the user's own membership event in the stripped state.
+	for roomID, roomData := range res.Rooms.Knock {
+		err := p.receiver.OnInvite(ctx, p.userID, roomID, roomData.KnockState.Events)
+		if err != nil {
+			lastErrs = append(lastErrs, fmt.Errorf("OnInvite[%s]: %w", roomID, err))
+		}
+	}
 
 	p.totalReceipts += receiptCalls
 	p.totalStateCalls += stateCalls
@@ -965,12 +1202,13 @@ func (p *poller) maybeLogStats(force bool) {
 			p.totalTimelineCalls, p.totalStateCalls, p.totalTyping, p.totalReceipts, p.totalInvites,
 		},
 	).Ints(
-		"device [events,changed,left,account]", []int{
-			p.totalDeviceEvents, p.totalChangedDeviceLists, p.totalLeftDeviceLists, p.totalAccountData,
+		"device [events,changed,left,account,presence]", []int{
+			p.totalDeviceEvents, p.totalChangedDeviceLists, p.totalLeftDeviceLists, p.totalAccountData, p.totalPresence,
 		},
 	).Msg("Poller: accumulated data")
 
 	p.totalAccountData = 0
+	p.totalPresence = 0
 	p.totalChangedDeviceLists = 0
 	p.totalDeviceEvents = 0
 	p.totalInvites = 0
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
 	"strconv"
 	"sync"
 	"testing"
@@ -66,6 +68,60 @@ func init() {
 	}
 }
 
+// Tests that Status reports the since token and last sync time of a running poller.
+func TestPollerMapStatus(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	syncRequests := make(chan string, 10)
+	syncResponses := make(chan *SyncResponse)
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		syncRequests <- since
+		if since == "" {
+			return &SyncResponse{NextBatch: "s1"}, 200, nil
+		}
+		return <-syncResponses, 200, nil
+	})
+	pm := NewPollerMap(client, false)
+	pm.SetCallbacks(accumulator)
+	defer func() {
+		pm.Terminate()
+		close(syncResponses)
+	}()
+
+	if _, ok := pm.Status(pid); ok {
+		t.Fatalf("Status returned a poller which does not exist")
+	}
+	before := time.Now()
+	if _, err := pm.EnsurePolling(pid, "access_token", "", false, zerolog.New(os.Stderr)); err != nil {
+		t.Fatalf("EnsurePolling: %s", err)
+	}
+	assertStatus := func(wantSince string) {
+		t.Helper()
+		status, ok := pm.Status(pid)
+		if !ok {
+			t.Fatalf("Status did not return the poller")
+		}
+		if status.Since != wantSince {
+			t.Fatalf("got since %q want %q", status.Since, wantSince)
+		}
+		if status.LastSync.Before(before) || status.Terminated {
+			t.Fatalf("got status %+v, want it to have synced after %v", status, before)
+		}
+	}
+	assertStatus("s1")
+
+	// the status changes once the next sync response is processed
+	<-syncRequests
+	if since := <-syncRequests; since != "s1" {
+		t.Fatalf("got since %q want s1", since)
+	}
+	before = time.Now()
+	syncResponses <- &SyncResponse{NextBatch: "s2"}
+	if since := <-syncRequests; since != "s2" {
+		t.Fatalf("got since %q want s2", since)
+	}
+	assertStatus("s2")
+}
+
 // Tests that EnsurePolling works in the happy case
 func TestPollerMapEnsurePolling(t *testing.T) {
 	nextSince := "next"
@@ -80,6 +136,7 @@ func TestPollerMapEnsurePolling(t *testing.T) {
 		Rooms: struct {
 			Join   map[string]SyncV2JoinResponse   `json:"join"`
 			Invite map[string]SyncV2InviteResponse `json:"invite"`
+			Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 		}{
 			Join: map[string]SyncV2JoinResponse{
@@ -163,6 +220,7 @@ func TestPollerMapEnsurePollingIdempotent(t *testing.T) {
 		Rooms: struct {
 			Join   map[string]SyncV2JoinResponse   `json:"join"`
 			Invite map[string]SyncV2InviteResponse `json:"invite"`
+			Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 		}{
 			Join: map[string]SyncV2JoinResponse{
@@ -358,6 +416,7 @@ func TestPollerPollFromNothing(t *testing.T) {
 				Rooms: struct {
 					Join   map[string]SyncV2JoinResponse   `json:"join"`
 					Invite map[string]SyncV2InviteResponse `json:"invite"`
+					Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 					Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 				}{
 					Join: map[string]SyncV2JoinResponse{
@@ -449,6 +508,7 @@ func TestPollerPollFromExisting(t *testing.T) {
 			Rooms: struct {
 				Join   map[string]SyncV2JoinResponse   `json:"join"`
 				Invite map[string]SyncV2InviteResponse `json:"invite"`
+				Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 			}{
 				Join: map[string]SyncV2JoinResponse{
@@ -740,6 +800,95 @@ func TestPollerUnblocksIfTerminatedInitially(t *testing.T) {
 	}
 }
 
+// Test that a poller keeps going when the client refreshes its access token whilst a request with
+// the old token is in flight, and that expired tokens are reported as soft or hard logouts.
+func TestPollerRefreshedAccessToken(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	var p *poller
+	var tokensUsed []string
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		tokensUsed = append(tokensUsed, authHeader)
+		switch {
+		case since == "":
+			return &SyncResponse{NextBatch: "1"}, 200, nil
+		case authHeader == "old_token":
+			// the client refreshes its token, and the old one expires before this request returns
+			p.setAccessToken("new_token")
+			return nil, 401, HTTP401SoftLogout
+		case authHeader == "new_token":
+			return nil, 401, HTTP401SoftLogout
+		}
+		return nil, 401, HTTP401
+	})
+	type expiry struct {
+		tokenHash  string
+		softLogout bool
+	}
+	var expired []expiry
+	accumulator.onExpiredToken = func(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
+		expired = append(expired, expiry{accessTokenHash, softLogout})
+	}
+	p = newPoller(pid, "old_token", client, accumulator, zerolog.New(os.Stderr), false)
+	p.Poll("")
+	wantTokens := []string{"old_token", "old_token", "new_token"}
+	if !reflect.DeepEqual(tokensUsed, wantTokens) {
+		t.Errorf("got tokens %v want %v", tokensUsed, wantTokens)
+	}
+	wantExpired := []expiry{{hashToken("new_token"), true}}
+	if !reflect.DeepEqual(expired, wantExpired) {
+		t.Errorf("got expired %+v want %+v", expired, wantExpired)
+	}
+
+	// logged out devices are not soft logouts
+	expired = nil
+	p = newPoller(pid, "logged_out_token", client, accumulator, zerolog.New(os.Stderr), false)
+	p.Poll("1")
+	wantExpired = []expiry{{hashToken("logged_out_token"), false}}
+	if !reflect.DeepEqual(expired, wantExpired) {
+		t.Errorf("got expired %+v want %+v", expired, wantExpired)
+	}
+}
+
+// Test that terminating a poller cancels its request to the homeserver, and stores the since token
+// of the last response it processed.
+func TestPollerTerminateStoresSince(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	accumulator, _ := newMocks(nil)
+	requestStarted := make(chan struct{})
+	client := &ctxClient{fn: func(ctx context.Context, since string) (*SyncResponse, int, error) {
+		switch since {
+		case "":
+			return &SyncResponse{NextBatch: "1"}, 200, nil
+		case "1":
+			// not stored straight away, as it was stored less than a minute ago
+			return &SyncResponse{NextBatch: "2"}, 200, nil
+		}
+		close(requestStarted)
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}}
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	go poller.Poll("")
+	select {
+	case <-requestStarted:
+	case <-time.After(time.Second):
+		t.Fatalf("poller did not make a third request")
+	}
+	accumulator.mu.Lock()
+	mustEqualSince(t, accumulator.pollerIDToSince[pid], "1")
+	accumulator.mu.Unlock()
+
+	poller.Terminate()
+	select {
+	case <-poller.done:
+	case <-time.After(time.Second):
+		t.Fatalf("Poll did not return after Terminate")
+	}
+	accumulator.mu.Lock()
+	defer accumulator.mu.Unlock()
+	mustEqualSince(t, accumulator.pollerIDToSince[pid], "2")
+}
+
 // Test that the poller sends the same sync v2 request, without incrementing the since token,
 // when an errorable callback returns an error.
 func TestPollerResendsOnCallbackError(t *testing.T) {
@@ -947,6 +1096,31 @@ func TestPollerResendsOnCallbackError(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "OnInvite for knocks",
+			// generate a response which will trigger the right callback
+			syncResponse: &SyncResponse{
+				Rooms: SyncRoomsResponse{
+					Knock: map[string]SyncV2KnockResponse{
+						"!foo:bar": {
+							KnockState: EventsResponse{
+								Events: []json.RawMessage{
+									[]byte(`{"type":"m.room.member","state_key":"` + pid.UserID + `","content":{"membership":"knock"}}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			// generate a receiver which errors for the right callback
+			generateReceiver: func() V2DataReceiver {
+				return &overrideDataReceiver{
+					onInvite: func(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error {
+						return fmt.Errorf("onInvite error")
+					},
+				}
+			},
+		},
 		{
 			name: "OnLeftRoom",
 			// generate a response which will trigger the right callback
@@ -1228,7 +1402,7 @@ func TestPollerResendsOnDataErrorWithOtherErrors(t *testing.T) {
 	}
 	// rather than set up the entire loop and machinery, just directly call parseRoomsResponse with various failure modes
 	for _, tc := range testCases {
-		err := poller.parseRoomsResponse(context.Background(), &tc.res)
+		err := poller.parseRoomsResponse(context.Background(), &tc.res, false)
 		if err == nil {
 			t.Errorf("%s: got no error", tc.name)
 			continue
@@ -1241,6 +1415,73 @@ func TestPollerResendsOnDataErrorWithOtherErrors(t *testing.T) {
 	}
 }
 
+// Test that the state of rooms with gappy timelines is re-fetched when the poller has fallen behind,
+// and only once between all pollers.
+func TestPollerRefetchesStateAfterGap(t *testing.T) {
+	ctx := context.Background()
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	roomID := "!gappy:localhost"
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		return &SyncResponse{
+			NextBatch: since + "1",
+			Rooms: SyncRoomsResponse{
+				Join: map[string]SyncV2JoinResponse{
+					roomID: {
+						Timeline: TimelineResponse{
+							Limited: true,
+							Events:  []json.RawMessage{testutils.NewMessageEvent(t, pid.UserID, "hello")},
+						},
+					},
+				},
+			},
+		}, 200, nil
+	})
+	currentState := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", pid.UserID, map[string]interface{}{"creator": pid.UserID}),
+		testutils.NewJoinEvent(t, pid.UserID),
+	}
+	refetches := 0
+	client.roomState = func(gotRoomID string) ([]json.RawMessage, error) {
+		if gotRoomID != roomID {
+			t.Errorf("re-fetched state of %s want %s", gotRoomID, roomID)
+		}
+		refetches++
+		return currentState, nil
+	}
+	refetcher := newStateRefetcher(false)
+	newTestPoller := func() *poller {
+		p := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+		p.stateRefetcher = refetcher
+		return p
+	}
+	poll := func(p *poller, s *pollLoopState, wantRefetches int) {
+		t.Helper()
+		if err := p.poll(ctx, s); err != nil {
+			t.Fatalf("poll: %s", err)
+		}
+		if refetches != wantRefetches {
+			t.Fatalf("got %d state re-fetches want %d", refetches, wantRefetches)
+		}
+	}
+
+	// a poller which starts from a stored since token has fallen behind
+	p := newTestPoller()
+	s := &pollLoopState{since: "0"}
+	poll(p, s, 1)
+	if len(accumulator.states[roomID]) != len(currentState) {
+		t.Errorf("room was not initialised with the re-fetched state: got %v", accumulator.states[roomID])
+	}
+	// but has caught up after its first response
+	poll(p, s, 1)
+	// another poller which falls behind doesn't re-fetch the state again
+	poll(newTestPoller(), &pollLoopState{since: "0"}, 1)
+	refetcher.release(roomID)
+	poll(newTestPoller(), &pollLoopState{since: "0"}, 2)
+	// initial syncs have not fallen behind
+	refetcher.release(roomID)
+	poll(newTestPoller(), &pollLoopState{}, 2)
+}
+
 func waitForInitialSync(t *testing.T, poller *poller) {
 	go func() {
 		poller.Poll(initialSinceToken)
@@ -1261,8 +1502,87 @@ func waitForInitialSync(t *testing.T, poller *poller) {
 	}
 }
 
+// Test that the poller only ingests as many timeline events as the configured filter asks for,
+// and that the filter never holds back state, account data or to-device messages.
+func TestPollerIngestsConfiguredTimelineLimit(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	roomID := "!foo:bar"
+	const numNewEvents = 100
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		since := req.URL.Query().Get("since")
+		if since == "2" {
+			w.WriteHeader(401)
+			w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN"}`))
+			return
+		}
+		var filter map[string]interface{}
+		if err := json.Unmarshal([]byte(req.URL.Query().Get("filter")), &filter); err != nil {
+			t.Errorf("failed to parse filter: %s", err)
+		}
+		// only the timeline is limited: nothing else may be filtered out
+		room, _ := filter["room"].(map[string]interface{})
+		timeline, _ := room["timeline"].(map[string]interface{})
+		if len(filter) != 2 || len(room) != 1 || len(timeline) != 1 {
+			t.Errorf("filter limits more than the timeline: %s", req.URL.Query().Get("filter"))
+		}
+		limit := int(timeline["limit"].(float64))
+		// the homeserver returns the most recent events up to the limit
+		var events []json.RawMessage
+		for i := numNewEvents - limit; i < numNewEvents; i++ {
+			events = append(events, json.RawMessage(fmt.Sprintf(`{"event_id":"$%s_%d","type":"m.room.message"}`, since, i)))
+		}
+		joinResp := SyncV2JoinResponse{
+			Timeline: TimelineResponse{Events: events, PrevBatch: "prev_" + since},
+		}
+		if since == "" {
+			joinResp.State.Events = []json.RawMessage{json.RawMessage(`{"event_id":"$create","type":"m.room.create","state_key":""}`)}
+		}
+		nextBatch := "1"
+		if since == "1" {
+			nextBatch = "2"
+		}
+		res := SyncResponse{
+			NextBatch:   nextBatch,
+			AccountData: EventsResponse{Events: []json.RawMessage{json.RawMessage(`{"type":"m.push_rules","content":{}}`)}},
+			ToDevice:    EventsResponse{Events: []json.RawMessage{json.RawMessage(`{"type":"m.room_key","content":{}}`)}},
+		}
+		res.Rooms.Join = map[string]SyncV2JoinResponse{roomID: joinResp}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer srv.Close()
+	client := NewHTTPClient(time.Second, time.Second, srv.URL)
+	client.TimelineLimit = 10
+
+	accumulator, _ := newMocks(nil)
+	var numAccountData, numToDevice int
+	accumulator.onAccountData = func(ctx context.Context, userID, roomID string, events []json.RawMessage) error {
+		numAccountData += len(events)
+		return nil
+	}
+	accumulator.addToDeviceMessages = func(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) error {
+		numToDevice += len(msgs)
+		return nil
+	}
+	poller := newPoller(pid, "token", client, accumulator, zerolog.New(os.Stderr), false)
+	poller.Poll("")
+
+	// the first poll only asks for the latest event, then the configured limit is used
+	if got, want := len(accumulator.timelines[roomID]), 1+10; got != want {
+		t.Errorf("ingested %d timeline events want %d", got, want)
+	}
+	if len(accumulator.states[roomID]) != 1 {
+		t.Errorf("got state %v want the create event", accumulator.states[roomID])
+	}
+	if numAccountData != 2 || numToDevice != 2 {
+		t.Errorf("got %d account data events and %d to-device messages, want 2 of each", numAccountData, numToDevice)
+	}
+}
+
 type mockClient struct {
-	fn func(authHeader, since string) (*SyncResponse, int, error)
+	fn        func(authHeader, since string) (*SyncResponse, int, error)
+	roomState func(roomID string) ([]json.RawMessage, error)
 }
 
 func (c *mockClient) Versions(ctx context.Context) ([]string, error) {
@@ -1271,8 +1591,30 @@ func (c *mockClient) Versions(ctx context.Context) ([]string, error) {
 func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
 	return c.fn(authHeader, since)
 }
-func (c *mockClient) WhoAmI(ctx context.Context, authHeader string) (string, string, error) {
-	return "@alice:localhost", "device_123", nil
+func (c *mockClient) WhoAmI(ctx context.Context, authHeader string) (string, string, bool, error) {
+	return "@alice:localhost", "device_123", false, nil
+}
+func (c *mockClient) DirectoryVisibility(ctx context.Context, roomID string) (string, error) {
+	return "private", nil
+}
+func (c *mockClient) Messages(ctx context.Context, accessToken, roomID, from string, limit int) (*MessagesResponse, error) {
+	return &MessagesResponse{Start: from}, nil
+}
+func (c *mockClient) RoomState(ctx context.Context, accessToken, roomID string) ([]json.RawMessage, error) {
+	if c.roomState == nil {
+		return nil, nil
+	}
+	return c.roomState(roomID)
+}
+
+// ctxClient is a mockClient whose requests can see their context.
+type ctxClient struct {
+	mockClient
+	fn func(ctx context.Context, since string) (*SyncResponse, int, error)
+}
+
+func (c *ctxClient) DoSyncV2(ctx context.Context, authHeader, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
+	return c.fn(ctx, since)
 }
 
 type mockDataReceiver struct {
@@ -1320,11 +1662,12 @@ type overrideDataReceiver struct {
 	updateUnreadCounts  func(ctx context.Context, roomID, userID string, highlightCount, notifCount *int)
 	onAccountData       func(ctx context.Context, userID, roomID string, events []json.RawMessage) error
 	onReceipt           func(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
+	onPresence          func(ctx context.Context, userID string, events []json.RawMessage)
 	onInvite            func(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error
 	onLeftRoom          func(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
 	onE2EEData          func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
 	onTerminated        func(ctx context.Context, pollerID PollerID)
-	onExpiredToken      func(ctx context.Context, accessTokenHash, userID, deviceID string)
+	onExpiredToken      func(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool)
 }
 
 func (s *overrideDataReceiver) Accumulate(ctx context.Context, userID, deviceID, roomID string, timeline TimelineResponse) error {
@@ -1375,6 +1718,12 @@ func (s *overrideDataReceiver) OnReceipt(ctx context.Context, userID, roomID, ep
 	}
 	s.onReceipt(ctx, userID, roomID, ephEventType, ephEvent)
 }
+func (s *overrideDataReceiver) OnPresence(ctx context.Context, userID string, events []json.RawMessage) {
+	if s.onPresence == nil {
+		return
+	}
+	s.onPresence(ctx, userID, events)
+}
 func (s *overrideDataReceiver) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error {
 	if s.onInvite == nil {
 		return nil
@@ -1399,11 +1748,11 @@ func (s *overrideDataReceiver) OnTerminated(ctx context.Context, pollerID Poller
 	}
 	s.onTerminated(ctx, pollerID)
 }
-func (s *overrideDataReceiver) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
+func (s *overrideDataReceiver) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string, softLogout bool) {
 	if s.onExpiredToken == nil {
 		return
 	}
-	s.onExpiredToken(ctx, accessTokenHash, userID, deviceID)
+	s.onExpiredToken(ctx, accessTokenHash, userID, deviceID, softLogout)
 }
 
 func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error)) (*mockDataReceiver, *mockClient) {
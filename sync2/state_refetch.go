@@ -0,0 +1,107 @@
+package sync2
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StaleSyncThreshold is how long a poller can go between sync v2 responses before it is considered
+// to have fallen behind. A poller which starts from a stored since token has always fallen behind.
+var StaleSyncThreshold = 5 * time.Minute
+
+// the time after re-fetching a room's state during which it is not re-fetched again, whichever
+// poller sees a gap in the room next.
+const stateRefetchInterval = 10 * time.Minute
+
+// stateRefetcher re-fetches the state of rooms with gappy timelines from pollers which fell behind.
+// The state block of a gappy sync v2 response only has the state which the homeserver thinks
+// changed during the gap, which can miss changes e.g after state resets, leaving the proxy with
+// stale state for the room. Re-fetching the room's current state in full and initialising the room
+// with it replaces the stale state, which invalidates the room: see V2InvalidateRoom.
+//
+// Room state is shared by every user in the room, so each room is re-fetched at most once every
+// stateRefetchInterval between all pollers, e.g when every poller starts from a stored since token
+// on startup.
+type stateRefetcher struct {
+	mu        *sync.Mutex
+	refetched map[string]time.Time // room ID -> when the state was last re-fetched
+	// nil if prometheus is disabled
+	refetches *prometheus.CounterVec
+}
+
+func newStateRefetcher(enablePrometheus bool) *stateRefetcher {
+	r := &stateRefetcher{
+		mu:        &sync.Mutex{},
+		refetched: make(map[string]time.Time),
+	}
+	if enablePrometheus {
+		r.refetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "poller",
+			Name:      "state_refetches",
+			Help:      "Number of rooms whose state was re-fetched after a gappy sync v2 timeline from a poller which fell behind, labelled by whether it was re-fetched.",
+		}, []string{"result"})
+		prometheus.MustRegister(r.refetches)
+	}
+	return r
+}
+
+// claim returns true if the room's state should be re-fetched now, in which case it won't be
+// again for stateRefetchInterval unless release is called.
+func (r *stateRefetcher) claim(roomID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for id, at := range r.refetched {
+		if now.Sub(at) >= stateRefetchInterval {
+			delete(r.refetched, id)
+		}
+	}
+	if _, exists := r.refetched[roomID]; exists {
+		return false
+	}
+	r.refetched[roomID] = now
+	return true
+}
+
+// release allows the room's state to be re-fetched again straight away, e.g after failing to.
+func (r *stateRefetcher) release(roomID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.refetched, roomID)
+}
+
+func (r *stateRefetcher) track(result string) {
+	if r.refetches != nil {
+		r.refetches.WithLabelValues(result).Inc()
+	}
+}
+
+func (r *stateRefetcher) Teardown() {
+	if r.refetches != nil {
+		prometheus.Unregister(r.refetches)
+	}
+}
+
+// refetchRoomState re-fetches the room's current state and initialises the room with it, unless
+// another poller has recently. Errors are logged rather than returned, as the timeline has already
+// been stored: the room is left with the state from the gappy sync.
+func (p *poller) refetchRoomState(ctx context.Context, roomID string) {
+	if p.stateRefetcher == nil || !p.stateRefetcher.claim(roomID) {
+		return
+	}
+	state, err := p.client.RoomState(ctx, p.currentAccessToken(), roomID)
+	if err == nil && len(state) > 0 {
+		err = p.receiver.Initialise(ctx, roomID, state)
+	}
+	if err != nil {
+		p.logger.Warn().Err(err).Str("room", roomID).Msg("Poller: failed to re-fetch state after gappy sync")
+		p.stateRefetcher.release(roomID)
+		p.stateRefetcher.track("failed")
+		return
+	}
+	p.stateRefetcher.track("refetched")
+}
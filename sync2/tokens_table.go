@@ -20,6 +20,9 @@ type Token struct {
 	UserID               string    `db:"user_id"`
 	DeviceID             string    `db:"device_id"`
 	LastSeen             time.Time `db:"last_seen"`
+	// True if the token is for a guest account, as reported by the homeserver's /whoami
+	// when the token was first seen.
+	IsGuest bool `db:"is_guest"`
 }
 
 // TokensTable remembers sync v2 tokens
@@ -42,7 +45,8 @@ func NewTokensTable(db *sqlx.DB, secret string) *TokensTable {
 		-- TODO: FK constraints to devices table?
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
-		last_seen TIMESTAMP WITH TIME ZONE NOT NULL
+		last_seen TIMESTAMP WITH TIME ZONE NOT NULL,
+		is_guest BOOLEAN NOT NULL DEFAULT FALSE
 	);`)
 
 	// derive the key from the secret
@@ -119,7 +123,7 @@ func (t *TokensTable) Token(plaintextToken string) (*Token, error) {
 	var token Token
 	err := t.db.Get(
 		&token,
-		`SELECT token_encrypted, user_id, device_id, last_seen FROM syncv3_sync2_tokens WHERE token_hash=$1`,
+		`SELECT token_encrypted, user_id, device_id, last_seen, is_guest FROM syncv3_sync2_tokens WHERE token_hash=$1`,
 		tokenHash,
 	)
 	if err != nil {
@@ -152,7 +156,7 @@ func (t *TokensTable) TokenForEachDevice(txn *sqlx.Tx) (tokens []TokenForPoller,
 	err = sqlx.Select(
 		db,
 		&tokens,
-		`SELECT DISTINCT ON (user_id, device_id) token_encrypted, user_id, device_id, last_seen, since
+		`SELECT DISTINCT ON (user_id, device_id) token_encrypted, user_id, device_id, last_seen, is_guest, since
 		FROM syncv3_sync2_tokens JOIN syncv3_sync2_devices USING (user_id, device_id)
 		ORDER BY user_id, device_id, last_seen DESC
 	`)
@@ -198,6 +202,16 @@ func (t *TokensTable) Insert(txn *sqlx.Tx, plaintextToken, userID, deviceID stri
 	}, nil
 }
 
+// SetIsGuest records whether the token is for a guest account.
+func (t *TokensTable) SetIsGuest(txn *sqlx.Tx, token *Token, isGuest bool) error {
+	_, err := txn.Exec(`UPDATE syncv3_sync2_tokens SET is_guest = $1 WHERE token_hash = $2`, isGuest, token.AccessTokenHash)
+	if err != nil {
+		return err
+	}
+	token.IsGuest = isGuest
+	return nil
+}
+
 // MaybeUpdateLastSeen actions a request to update a Token struct with its last_seen value
 // in the DB. To avoid spamming the DB with a write every time a sync3 request arrives,
 // we only update the last seen timestamp or the if it is at least 24 hours old.
@@ -258,3 +272,16 @@ func (t *TokensTable) Delete(accessTokenHash string) error {
 	}
 	return nil
 }
+
+// DeleteDevice deletes every token for this device, e.g because the device was logged out.
+// Returns the number of tokens deleted.
+func (t *TokensTable) DeleteDevice(userID, deviceID string) (int64, error) {
+	result, err := t.db.Exec(
+		`DELETE FROM syncv3_sync2_tokens WHERE user_id = $1 AND device_id = $2`,
+		userID, deviceID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -128,7 +128,91 @@ func TestDeletingTokens(t *testing.T) {
 	t.Log("We should no longer be able to fetch this token.")
 	token, err = tokens.Token(accessToken)
 	if token != nil || err == nil {
-		t.Fatalf("Fetching token after deletion did not fail: got %s, %s", token, err)
+		t.Fatalf("Fetching token after deletion did not fail: got %+v, %s", token, err)
+	}
+}
+
+func TestDeletingDeviceTokens(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	tokens := NewTokensTable(db, "my_secret")
+
+	t.Log("Insert two tokens for a device, e.g before and after a refresh, and one for another device.")
+	_ = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
+		for accessToken, deviceID := range map[string]string{
+			"old_token":   "refreshing_device",
+			"new_token":   "refreshing_device",
+			"other_token": "other_device",
+		} {
+			if _, err = tokens.Insert(txn, accessToken, "@carol:builders.com", deviceID, time.Now()); err != nil {
+				t.Fatalf("Failed to Insert token: %s", err)
+			}
+		}
+		return nil
+	})
+
+	t.Log("Deleting the device deletes both of its tokens.")
+	deleted, err := tokens.DeleteDevice("@carol:builders.com", "refreshing_device")
+	if err != nil {
+		t.Fatalf("Failed to delete device tokens: %s", err)
+	}
+	if deleted != 2 {
+		t.Fatalf("DeleteDevice: got %d deleted tokens, want 2", deleted)
+	}
+	for _, accessToken := range []string{"old_token", "new_token"} {
+		if token, err := tokens.Token(accessToken); token != nil || err == nil {
+			t.Fatalf("Fetching %s after deleting the device did not fail: got %+v, %s", accessToken, token, err)
+		}
+	}
+
+	t.Log("The other device's token is untouched.")
+	if _, err = tokens.Token("other_token"); err != nil {
+		t.Fatalf("Failed to fetch token for other device: %s", err)
+	}
+}
+
+func TestTokensTableIsGuest(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	tokens := NewTokensTable(db, "my_secret")
+
+	var guestToken *Token
+	_ = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
+		t.Log("Insert tokens for a guest and a regular user.")
+		guestToken, err = tokens.Insert(txn, "guest_secret", "@1234:localhost", "guest_device", time.Now())
+		if err != nil {
+			t.Fatalf("Failed to Insert token: %s", err)
+		}
+		if guestToken.IsGuest {
+			t.Fatalf("New token should not be a guest")
+		}
+		if err = tokens.SetIsGuest(txn, guestToken, true); err != nil {
+			t.Fatalf("Failed to set guest: %s", err)
+		}
+		if !guestToken.IsGuest {
+			t.Fatalf("SetIsGuest did not update the token")
+		}
+		_, err = tokens.Insert(txn, "alice_secret", "@alice:localhost", "alice_device", time.Now())
+		if err != nil {
+			t.Fatalf("Failed to Insert token: %s", err)
+		}
+		return nil
+	})
+
+	t.Log("Guest status should be loaded with the token.")
+	fetched, err := tokens.Token("guest_secret")
+	if err != nil {
+		t.Fatalf("Failed to fetch token: %s", err)
+	}
+	if !fetched.IsGuest {
+		t.Fatalf("Guest token was not loaded as a guest")
+	}
+	fetched, err = tokens.Token("alice_secret")
+	if err != nil {
+		t.Fatalf("Failed to fetch token: %s", err)
+	}
+	if fetched.IsGuest {
+		t.Fatalf("Regular token was loaded as a guest")
 	}
 }
 
@@ -0,0 +1,86 @@
+package sync3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+// bufferedResponse is a response buffered for the client in case it needs to be sent again.
+// At least one of res and compressed is set. Both are set once a response is compressed to save
+// it with the connection's position, so it is only compressed once.
+type bufferedResponse struct {
+	pos int64
+	res *Response
+	// the response as gzip-compressed JSON
+	compressed []byte
+	// the ApproxSize of res, or the length of compressed
+	size int
+	// when the response was buffered, for BufferLimits.MaxAge
+	bufferedAt time.Time
+}
+
+// response returns the buffered response, decompressing it if needed. The returned response must
+// not be modified as it may be the buffered response itself. Returns nil if b is nil.
+func (b *bufferedResponse) response() (*Response, *internal.HandlerError) {
+	if b == nil {
+		return nil, nil
+	}
+	if b.res != nil {
+		return b.res, nil
+	}
+	res, err := decompressResponse(b.compressed)
+	if err != nil {
+		// we compressed it ourselves, so this is a bug
+		err = fmt.Errorf("failed to decompress buffered response for pos %d: %w", b.pos, err)
+		logger.Err(err).Msg("cannot resend buffered response")
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	return res, nil
+}
+
+func compressResponse(res *Response) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressResponse(compressed []byte) (*Response, error) {
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var res Response
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -0,0 +1,138 @@
+package sync3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+)
+
+// newInitialSyncResponse returns a response which looks like an initial sync, freshly allocated so
+// responses buffered by different connections don't share memory.
+func newInitialSyncResponse(numRooms, numEvents int) *Response {
+	res := &Response{
+		Lists: map[string]ResponseList{
+			"all": {
+				Count: numRooms,
+				Ops:   []ResponseOp{&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, int64(numRooms - 1)}}},
+			},
+		},
+		Rooms: make(map[string]Room, numRooms),
+		Extensions: extensions.Response{
+			Typing: &extensions.TypingResponse{Rooms: map[string]json.RawMessage{
+				"!0:localhost": json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@alice:localhost"]}}`),
+			}},
+		},
+		TrimmedRooms: []string{"!trimmed:localhost"},
+	}
+	for i := 0; i < numRooms; i++ {
+		roomID := fmt.Sprintf("!%d:localhost", i)
+		res.Lists["all"].Ops[0].(*ResponseOpRange).RoomIDs = append(res.Lists["all"].Ops[0].(*ResponseOpRange).RoomIDs, roomID)
+		room := Room{
+			Name:              fmt.Sprintf("Room %d", i),
+			NotificationCount: int64(i),
+			Initial:           true,
+			RequiredState: []json.RawMessage{
+				json.RawMessage(fmt.Sprintf(`{"type":"m.room.create","state_key":"","event_id":"$create%d","content":{"creator":"@alice:localhost"}}`, i)),
+			},
+		}
+		for j := 0; j < numEvents; j++ {
+			room.Timeline = append(room.Timeline, json.RawMessage(fmt.Sprintf(
+				`{"type":"m.room.message","event_id":"$%d-%d","sender":"@alice:localhost","content":{"msgtype":"m.text","body":"%s"}}`,
+				i, j, strings.Repeat("hello world ", 5),
+			)))
+		}
+		res.Rooms[roomID] = room
+	}
+	return res
+}
+
+// Test that buffered responses behind the first are compressed, and are sent again unchanged.
+func TestConnCompressBufferedResponses(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	newConn := func(compress bool) *Conn {
+		return NewConnWithOptions(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+			return newInitialSyncResponse(5, 10), nil
+		}}, ConnOptions{CompressBufferedResponses: compress})
+	}
+	var bufferedBytes []int64
+	for _, compress := range []bool{false, true} {
+		c := newConn(compress)
+		_, err := c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+		assertNoError(t, err)
+		sent, err := c.OnIncomingRequest(ctx, &Request{pos: 1, TxnID: "a"}, time.Now())
+		assertNoError(t, err)
+		assertPos(t, sent.Pos, 2)
+		assertInt(t, c.BufferedResponses(), 2)
+		if c.serverResponses[0].res == nil {
+			t.Fatalf("compress=%v: the first buffered response was compressed", compress)
+		}
+		if compressed := c.serverResponses[1].res == nil; compressed != compress {
+			t.Fatalf("compress=%v: got second buffered response compressed=%v", compress, compressed)
+		}
+		bufferedBytes = append(bufferedBytes, c.BufferedBytes())
+
+		// the response was lost, so the client retransmits
+		resent, err := c.OnIncomingRequest(ctx, &Request{pos: 1, TxnID: "b"}, time.Now())
+		assertNoError(t, err)
+		if resent.TxnID != "b" {
+			t.Errorf("compress=%v: got txn_id %q want b", compress, resent.TxnID)
+		}
+		resent.TxnID = sent.TxnID
+		sentJSON, _ := json.Marshal(sent)
+		resentJSON, _ := json.Marshal(resent)
+		if string(sentJSON) != string(resentJSON) {
+			t.Errorf("compress=%v: resent response differs:\ngot  %s\nwant %s", compress, resentJSON, sentJSON)
+		}
+
+		// once the client ACKs pos 2 the compressed response is kept for retransmits, but not
+		// decompressed until it is needed
+		_, err = c.OnIncomingRequest(ctx, &Request{pos: 2}, time.Now())
+		assertNoError(t, err)
+		if compressed := c.serverResponses[0].res == nil; compressed != compress {
+			t.Fatalf("compress=%v: got ACKed response compressed=%v", compress, compressed)
+		}
+	}
+	if bufferedBytes[1] >= bufferedBytes[0] {
+		t.Errorf("compressing did not reduce buffered bytes: got %d, uncompressed %d", bufferedBytes[1], bufferedBytes[0])
+	}
+}
+
+// Compare the memory used by 10k idle connections which have each buffered the response to their
+// initial sync and the response after it.
+func BenchmarkConnBufferedResponses(b *testing.B) {
+	const numConns = 10000
+	for _, compress := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compress=%v", compress), func(b *testing.B) {
+			ctx := context.Background()
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				conns := make([]*Conn, numConns)
+				for j := range conns {
+					conns[j] = NewConnWithOptions(ConnID{DeviceID: fmt.Sprintf("d%d", j)}, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+						return newInitialSyncResponse(5, 5), nil
+					}}, ConnOptions{CompressBufferedResponses: compress})
+					for pos := int64(0); pos < 2; pos++ {
+						if _, err := conns[j].OnIncomingRequest(ctx, &Request{pos: pos}, time.Now()); err != nil {
+							b.Fatalf("OnIncomingRequest: %s", err)
+						}
+					}
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/numConns, "heap-bytes/conn")
+				runtime.KeepAlive(conns)
+			}
+		})
+	}
+}
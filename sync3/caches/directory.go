@@ -0,0 +1,123 @@
+package caches
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Directory visibilities returned to clients.
+const (
+	DirectoryVisibilityPublic  = "public"
+	DirectoryVisibilityPrivate = "private"
+	// The proxy could not find out whether the room is published, e.g the homeserver was
+	// unreachable. The lookup is retried after DirectoryVisibilityFailureTTL.
+	DirectoryVisibilityUnknown = "unknown"
+)
+
+const (
+	// DirectoryVisibilityTTL is how long a room's directory visibility is remembered for. Publishing
+	// a room is not visible to pollers, so this is the longest a client can see a stale value for.
+	DirectoryVisibilityTTL = 10 * time.Minute
+	// DirectoryVisibilityFailureTTL is how long to wait before retrying a failed lookup.
+	DirectoryVisibilityFailureTTL = 30 * time.Second
+	// the longest time a single lookup can take before the visibility is "unknown"
+	directoryLookupTimeout = 5 * time.Second
+	// the maximum number of concurrent lookups for a single call to Load
+	maxConcurrentDirectoryLookups = 8
+)
+
+// DirectoryLookupFunc asks the homeserver for the directory visibility of a room.
+type DirectoryLookupFunc func(ctx context.Context, roomID string) (visibility string, err error)
+
+type cachedVisibility struct {
+	visibility string
+	expiresAt  time.Time
+}
+
+// DirectoryVisibilityCache remembers whether rooms are published in the room directory. This is
+// not room state, so the proxy cannot see it when polling: instead the homeserver is asked when a
+// room is loaded, and the answer is cached for DirectoryVisibilityTTL.
+type DirectoryVisibilityCache struct {
+	lookup DirectoryLookupFunc
+	// customisable for testing
+	now func() time.Time
+
+	mu    *sync.Mutex
+	cache map[string]cachedVisibility
+}
+
+func NewDirectoryVisibilityCache(lookup DirectoryLookupFunc) *DirectoryVisibilityCache {
+	return &DirectoryVisibilityCache{
+		lookup: lookup,
+		now:    time.Now,
+		mu:     &sync.Mutex{},
+		cache:  make(map[string]cachedVisibility),
+	}
+}
+
+// Load returns the directory visibility of each room, looking up rooms which are not cached. Rooms
+// which could not be looked up are DirectoryVisibilityUnknown. Always returns an entry for every room.
+func (c *DirectoryVisibilityCache) Load(ctx context.Context, roomIDs []string) map[string]string {
+	result := make(map[string]string, len(roomIDs))
+	var toLookup []string
+	now := c.now()
+	c.mu.Lock()
+	// drop expired entries so the cache doesn't grow without bound
+	for k, v := range c.cache {
+		if !now.Before(v.expiresAt) {
+			delete(c.cache, k)
+		}
+	}
+	for _, roomID := range roomIDs {
+		cached, ok := c.cache[roomID]
+		if ok && now.Before(cached.expiresAt) {
+			result[roomID] = cached.visibility
+		} else {
+			toLookup = append(toLookup, roomID)
+		}
+	}
+	c.mu.Unlock()
+	if len(toLookup) == 0 {
+		return result
+	}
+
+	var wg sync.WaitGroup
+	var resultMu sync.Mutex
+	sem := make(chan struct{}, maxConcurrentDirectoryLookups)
+	for _, roomID := range toLookup {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(roomID string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			visibility := c.lookupRoom(ctx, roomID)
+			resultMu.Lock()
+			result[roomID] = visibility
+			resultMu.Unlock()
+		}(roomID)
+	}
+	wg.Wait()
+	return result
+}
+
+func (c *DirectoryVisibilityCache) lookupRoom(ctx context.Context, roomID string) string {
+	ctx, cancel := context.WithTimeout(ctx, directoryLookupTimeout)
+	defer cancel()
+	visibility, err := c.lookup(ctx, roomID)
+	ttl := DirectoryVisibilityTTL
+	if err != nil || (visibility != DirectoryVisibilityPublic && visibility != DirectoryVisibilityPrivate) {
+		logger.Warn().Err(err).Str("room", roomID).Str("visibility", visibility).Msg("failed to lookup directory visibility")
+		visibility = DirectoryVisibilityUnknown
+		ttl = DirectoryVisibilityFailureTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cache[roomID] = cachedVisibility{
+		visibility: visibility,
+		expiresAt:  c.now().Add(ttl),
+	}
+	return visibility
+}
@@ -0,0 +1,64 @@
+package caches
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDirectoryVisibilityCache(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	visibilities := map[string]string{
+		"!public:localhost":  DirectoryVisibilityPublic,
+		"!private:localhost": DirectoryVisibilityPrivate,
+		"!weird:localhost":   "secret",
+	}
+	cache := NewDirectoryVisibilityCache(func(ctx context.Context, roomID string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[roomID]++
+		visibility, ok := visibilities[roomID]
+		if !ok {
+			return "", fmt.Errorf("HTTP 404")
+		}
+		return visibility, nil
+	})
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	roomIDs := []string{"!public:localhost", "!private:localhost", "!weird:localhost", "!unknown:localhost"}
+	assertLoad := func(want map[string]string, wantCalls map[string]int) {
+		t.Helper()
+		got := cache.Load(context.Background(), roomIDs)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Load: got %v want %v", got, want)
+		}
+		if !reflect.DeepEqual(calls, wantCalls) {
+			t.Fatalf("Load: got calls %v want %v", calls, wantCalls)
+		}
+	}
+	want := map[string]string{
+		"!public:localhost":  DirectoryVisibilityPublic,
+		"!private:localhost": DirectoryVisibilityPrivate,
+		"!weird:localhost":   DirectoryVisibilityUnknown,
+		"!unknown:localhost": DirectoryVisibilityUnknown,
+	}
+	assertLoad(want, map[string]int{"!public:localhost": 1, "!private:localhost": 1, "!weird:localhost": 1, "!unknown:localhost": 1})
+	// everything is cached
+	assertLoad(want, map[string]int{"!public:localhost": 1, "!private:localhost": 1, "!weird:localhost": 1, "!unknown:localhost": 1})
+
+	// failures are retried sooner
+	visibilities["!unknown:localhost"] = DirectoryVisibilityPrivate
+	now = now.Add(DirectoryVisibilityFailureTTL)
+	want["!unknown:localhost"] = DirectoryVisibilityPrivate
+	assertLoad(want, map[string]int{"!public:localhost": 1, "!private:localhost": 1, "!weird:localhost": 2, "!unknown:localhost": 2})
+
+	// changes are seen when the TTL expires
+	visibilities["!private:localhost"] = DirectoryVisibilityPublic
+	now = now.Add(DirectoryVisibilityTTL)
+	want["!private:localhost"] = DirectoryVisibilityPublic
+	assertLoad(want, map[string]int{"!public:localhost": 2, "!private:localhost": 2, "!weird:localhost": 3, "!unknown:localhost": 3})
+}
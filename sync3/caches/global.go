@@ -53,6 +53,10 @@ type EventData struct {
 	// Flag set when this event should force the room contents to be resent e.g
 	// state res, initial join, etc
 	ForceInitial bool
+
+	// True if the events before this one in the timeline are not known, because the homeserver
+	// skipped them in a gappy sync v2 timeline.
+	MissingPrevious bool
 }
 
 var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
@@ -60,6 +64,16 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 	TimeFormat: "15:04:05",
 })
 
+// DefaultLargeRoomThreshold is the number of joined members at which rooms are considered large. To
+// avoid loading the membership of large rooms:
+//   - join counts are approximate, so that the count, and the calculated room name which depends
+//     on it, do not change with every join and leave.
+//   - required_state never includes every member: only the members which would be lazy loaded and
+//     members requested by user ID.
+//   - heroes are taken from the members the cache already knows about, and are not recalculated
+//     from the room's membership when the room is invalidated.
+const DefaultLargeRoomThreshold = 10000
+
 // The purpose of global cache is to store global-level information about all rooms the server is aware of.
 // Global-level information is represented as internal.RoomMetadata and includes things like Heroes, join/invite
 // counts, if the room is encrypted, etc. Basically anything that is the same for all users of the system. This
@@ -68,6 +82,20 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 type GlobalCache struct {
 	// LoadJoinedRoomsOverride allows tests to mock out the behaviour of LoadJoinedRooms.
 	LoadJoinedRoomsOverride func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, latestNIDs map[string]int64, err error)
+	// LoadStateEventOverride allows tests to mock out the behaviour of LoadStateEvent.
+	LoadStateEventOverride func(roomID string, loadPosition int64, evType, stateKey string) json.RawMessage
+	// LoadStateEventsOverride allows tests to mock out the behaviour of LoadStateEvents.
+	LoadStateEventsOverride func(roomIDs []string, loadPosition int64, evType, stateKey string) map[string]json.RawMessage
+	// LoadStateEventsOfTypesOverride allows tests to mock out the behaviour of LoadStateEventsOfTypes.
+	LoadStateEventsOfTypesOverride func(roomIDs []string, loadPosition int64, evTypes []string) map[string][]json.RawMessage
+	// LoadMembersOverride allows tests to mock out the behaviour of LoadMembers.
+	LoadMembersOverride func(roomIDs []string, loadPosition int64, userIDs []string) map[string][]json.RawMessage
+	// LoadDirectoryVisibilityOverride allows tests to mock out the behaviour of LoadDirectoryVisibility.
+	LoadDirectoryVisibilityOverride func(roomIDs []string) map[string]string
+	// LoadEventsOverride allows tests to mock out the behaviour of LoadEvents.
+	LoadEventsOverride func(roomID string, eventIDs []string) map[string]json.RawMessage
+	// LoadEventTypesOverride allows tests to mock out the behaviour of LoadEventTypes.
+	LoadEventTypesOverride func(roomID string, eventIDs []string) map[string]string
 
 	// inserts are done by v2 poll loops, selects are done by v3 request threads
 	// there are lots of overlapping keys as many users (threads) can be joined to the same room (key)
@@ -75,8 +103,16 @@ type GlobalCache struct {
 	roomIDToMetadata   map[string]*internal.RoomMetadata
 	roomIDToMetadataMu *sync.RWMutex
 
+	// the latest m.presence event for each user. Like typing notifs, this is only held in memory.
+	userIDToPresence   map[string]json.RawMessage
+	userIDToPresenceMu *sync.RWMutex
+
 	// for loading room state not held in-memory TODO: remove to another struct along with associated functions
 	store *state.Storage
+	// for loading whether rooms are published in the room directory. May be nil.
+	directoryVisibility *DirectoryVisibilityCache
+	// the number of joined members at which rooms are large, or 0 if rooms are never large.
+	largeRoomThreshold int
 }
 
 func NewGlobalCache(store *state.Storage) *GlobalCache {
@@ -84,7 +120,33 @@ func NewGlobalCache(store *state.Storage) *GlobalCache {
 		roomIDToMetadataMu: &sync.RWMutex{},
 		store:              store,
 		roomIDToMetadata:   make(map[string]*internal.RoomMetadata),
+		userIDToPresenceMu: &sync.RWMutex{},
+		userIDToPresence:   make(map[string]json.RawMessage),
+		largeRoomThreshold: DefaultLargeRoomThreshold,
+	}
+}
+
+// SetLargeRoomThreshold sets the number of joined members at which rooms are large. Rooms are
+// never large if the threshold is 0 or less. Must be called before Startup.
+func (c *GlobalCache) SetLargeRoomThreshold(threshold int) {
+	if threshold < 0 {
+		threshold = 0
+	}
+	c.largeRoomThreshold = threshold
+}
+
+// setJoinCount sets the join count of the room and whether it is large. Large rooms have their
+// join count rounded down to 2 significant figures e.g 123456 becomes 120000.
+func (c *GlobalCache) setJoinCount(metadata *internal.RoomMetadata, joinCount int) {
+	metadata.Large = c.largeRoomThreshold > 0 && joinCount >= c.largeRoomThreshold
+	if metadata.Large {
+		unit := 1
+		for joinCount/unit >= 100 {
+			unit *= 10
+		}
+		joinCount = (joinCount / unit) * unit
 	}
+	metadata.JoinCount = joinCount
 }
 
 func (c *GlobalCache) OnRegistered(_ context.Context) error {
@@ -150,7 +212,7 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (
 	if err != nil {
 		return 0, nil, nil, nil, err
 	}
-	joinTimingByRoomID, err = c.store.JoinedRoomsAfterPosition(userID, initialLoadPosition)
+	joinTimingByRoomID, err = c.store.JoinedRoomsAfterPosition(internal.LoadContext(ctx), userID, initialLoadPosition)
 	if err != nil {
 		return 0, nil, nil, nil, err
 	}
@@ -161,7 +223,7 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (
 		i++
 	}
 
-	latestNIDs, err = c.store.LatestEventNIDInRooms(roomIDs, initialLoadPosition)
+	latestNIDs, err = c.store.LatestEventNIDInRooms(internal.LoadContext(ctx), roomIDs, initialLoadPosition)
 	if err != nil {
 		return 0, nil, nil, nil, err
 	}
@@ -171,13 +233,25 @@ func (c *GlobalCache) LoadJoinedRooms(ctx context.Context, userID string) (
 	return initialLoadPosition, rooms, joinTimingByRoomID, latestNIDs, nil
 }
 
+// captureLoadError reports a failure to load from the database to sentry, unless the load failed
+// because the request it was for was cancelled. See internal.LoadContext.
+func captureLoadError(ctx context.Context, err error) {
+	if internal.LoadContext(ctx).Err() != nil {
+		return
+	}
+	internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+}
+
 func (c *GlobalCache) LoadStateEvent(ctx context.Context, roomID string, loadPosition int64, evType, stateKey string) json.RawMessage {
-	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, []string{roomID}, loadPosition, map[string][]string{
+	if c.LoadStateEventOverride != nil {
+		return c.LoadStateEventOverride(roomID, loadPosition, evType, stateKey)
+	}
+	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(internal.LoadContext(ctx), []string{roomID}, loadPosition, map[string][]string{
 		evType: {stateKey},
 	})
 	if err != nil {
 		logger.Err(err).Str("room", roomID).Int64("pos", loadPosition).Msg("failed to load room state")
-		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		captureLoadError(ctx, err)
 		return nil
 	}
 	events := roomIDToStateEvents[roomID]
@@ -187,6 +261,181 @@ func (c *GlobalCache) LoadStateEvent(ctx context.Context, roomID string, loadPos
 	return nil
 }
 
+// LoadStateEvents loads the state event with the given type and state key in each room at the given
+// load position. Rooms which do not have this state event are not included in the returned map.
+func (c *GlobalCache) LoadStateEvents(ctx context.Context, roomIDs []string, loadPosition int64, evType, stateKey string) map[string]json.RawMessage {
+	if c.LoadStateEventsOverride != nil {
+		return c.LoadStateEventsOverride(roomIDs, loadPosition, evType, stateKey)
+	}
+	if c.store == nil || len(roomIDs) == 0 {
+		return nil
+	}
+	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(internal.LoadContext(ctx), roomIDs, loadPosition, map[string][]string{
+		evType: {stateKey},
+	})
+	if err != nil {
+		logger.Err(err).Strs("rooms", roomIDs).Int64("pos", loadPosition).Str("type", evType).Msg("failed to load state events")
+		captureLoadError(ctx, err)
+		return nil
+	}
+	result := make(map[string]json.RawMessage, len(roomIDToStateEvents))
+	for roomID, events := range roomIDToStateEvents {
+		for _, ev := range events {
+			if ev.Type == evType && ev.StateKey == stateKey {
+				result[roomID] = ev.JSON
+				break
+			}
+		}
+	}
+	return result
+}
+
+// LoadStateEventsOfTypes loads all state events with the given types, regardless of state key, in
+// each room at the given load position. Rooms with none of these state events are not included in
+// the returned map.
+func (c *GlobalCache) LoadStateEventsOfTypes(ctx context.Context, roomIDs []string, loadPosition int64, evTypes ...string) map[string][]json.RawMessage {
+	if c.LoadStateEventsOfTypesOverride != nil {
+		return c.LoadStateEventsOfTypesOverride(roomIDs, loadPosition, evTypes)
+	}
+	if c.store == nil || len(roomIDs) == 0 || len(evTypes) == 0 {
+		return nil
+	}
+	// an empty list of state keys matches all state keys
+	eventTypesToStateKeys := make(map[string][]string, len(evTypes))
+	for _, evType := range evTypes {
+		eventTypesToStateKeys[evType] = []string{}
+	}
+	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(internal.LoadContext(ctx), roomIDs, loadPosition, eventTypesToStateKeys)
+	if err != nil {
+		logger.Err(err).Strs("rooms", roomIDs).Int64("pos", loadPosition).Strs("types", evTypes).Msg("failed to load state events")
+		captureLoadError(ctx, err)
+		return nil
+	}
+	result := make(map[string][]json.RawMessage, len(roomIDToStateEvents))
+	for roomID, events := range roomIDToStateEvents {
+		for _, ev := range events {
+			if _, ok := eventTypesToStateKeys[ev.Type]; ok {
+				result[roomID] = append(result[roomID], ev.JSON)
+			}
+		}
+	}
+	return result
+}
+
+// LoadMembers loads the m.room.member events for the given users in each room at the given load
+// position. Users with no membership event are not returned, and rooms with none of these users
+// are not included in the returned map.
+func (c *GlobalCache) LoadMembers(ctx context.Context, roomIDs []string, loadPosition int64, userIDs []string) map[string][]json.RawMessage {
+	if c.LoadMembersOverride != nil {
+		return c.LoadMembersOverride(roomIDs, loadPosition, userIDs)
+	}
+	if c.store == nil || len(roomIDs) == 0 || len(userIDs) == 0 {
+		return nil
+	}
+	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(internal.LoadContext(ctx), roomIDs, loadPosition, map[string][]string{
+		"m.room.member": userIDs,
+	})
+	if err != nil {
+		logger.Err(err).Strs("rooms", roomIDs).Int64("pos", loadPosition).Strs("users", userIDs).Msg("failed to load members")
+		captureLoadError(ctx, err)
+		return nil
+	}
+	result := make(map[string][]json.RawMessage, len(roomIDToStateEvents))
+	for roomID, events := range roomIDToStateEvents {
+		for _, ev := range events {
+			if ev.Type == "m.room.member" {
+				result[roomID] = append(result[roomID], ev.JSON)
+			}
+		}
+	}
+	return result
+}
+
+// SetDirectoryLookup sets how to find out whether rooms are published in the room directory.
+func (c *GlobalCache) SetDirectoryLookup(lookup DirectoryLookupFunc) {
+	c.directoryVisibility = NewDirectoryVisibilityCache(lookup)
+}
+
+// LoadDirectoryVisibility returns whether each room is published in the room directory. Every room
+// is in the returned map: rooms which could not be looked up are DirectoryVisibilityUnknown.
+func (c *GlobalCache) LoadDirectoryVisibility(ctx context.Context, roomIDs []string) map[string]string {
+	if c.LoadDirectoryVisibilityOverride != nil {
+		return c.LoadDirectoryVisibilityOverride(roomIDs)
+	}
+	if c.directoryVisibility == nil {
+		result := make(map[string]string, len(roomIDs))
+		for _, roomID := range roomIDs {
+			result[roomID] = DirectoryVisibilityUnknown
+		}
+		return result
+	}
+	return c.directoryVisibility.Load(ctx, roomIDs)
+}
+
+// LoadPresence returns the latest m.presence event of each of the given users. Users whose presence
+// has not been seen since startup are not returned.
+func (c *GlobalCache) LoadPresence(userIDs []string) map[string]json.RawMessage {
+	c.userIDToPresenceMu.RLock()
+	defer c.userIDToPresenceMu.RUnlock()
+	result := make(map[string]json.RawMessage)
+	for _, userID := range userIDs {
+		if presence, ok := c.userIDToPresence[userID]; ok {
+			result[userID] = presence
+		}
+	}
+	return result
+}
+
+// LoadEventTypes returns a map of event ID to event type for the given events. Events which are
+// unknown or are not in the given room are not returned.
+func (c *GlobalCache) LoadEventTypes(ctx context.Context, roomID string, eventIDs []string) map[string]string {
+	if c.LoadEventTypesOverride != nil {
+		return c.LoadEventTypesOverride(roomID, eventIDs)
+	}
+	if c.store == nil || len(eventIDs) == 0 {
+		return nil
+	}
+	events, err := c.store.EventsTable.SelectStrippedEventsByIDs(nil, false, eventIDs)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Strs("events", eventIDs).Msg("failed to load event types")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil
+	}
+	result := make(map[string]string, len(events))
+	for _, ev := range events {
+		// never reveal events in other rooms
+		if ev.RoomID == roomID {
+			result[ev.ID] = ev.Type
+		}
+	}
+	return result
+}
+
+// LoadEvents returns a map of event ID to the event JSON as currently stored, e.g redacted if it
+// has been redacted. Events which are unknown or are not in the given room are not returned.
+func (c *GlobalCache) LoadEvents(ctx context.Context, roomID string, eventIDs []string) map[string]json.RawMessage {
+	if c.LoadEventsOverride != nil {
+		return c.LoadEventsOverride(roomID, eventIDs)
+	}
+	if c.store == nil || len(eventIDs) == 0 {
+		return nil
+	}
+	events, err := c.store.EventsTable.SelectByIDs(nil, false, eventIDs)
+	if err != nil {
+		logger.Err(err).Str("room", roomID).Strs("events", eventIDs).Msg("failed to load events")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil
+	}
+	result := make(map[string]json.RawMessage, len(events))
+	for _, ev := range events {
+		// never reveal events in other rooms
+		if ev.RoomID == roomID {
+			result[ev.ID] = ev.JSON
+		}
+	}
+	return result
+}
+
 // TODO: remove? Doesn't touch global cache fields
 func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadPosition int64, requiredStateMap *internal.RequiredStateMap, roomToUsersInTimeline map[string][]string) map[string][]json.RawMessage {
 	if c.store == nil {
@@ -196,10 +445,10 @@ func (c *GlobalCache) LoadRoomState(ctx context.Context, roomIDs []string, loadP
 		return nil
 	}
 	resultMap := make(map[string][]json.RawMessage, len(roomIDs))
-	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(ctx, roomIDs, loadPosition, requiredStateMap.QueryStateMap())
+	roomIDToStateEvents, err := c.store.RoomStateAfterEventPosition(internal.LoadContext(ctx), roomIDs, loadPosition, requiredStateMap.QueryStateMap())
 	if err != nil {
 		logger.Err(err).Strs("rooms", roomIDs).Int64("pos", loadPosition).Msg("failed to load room state")
-		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		captureLoadError(ctx, err)
 		return nil
 	}
 	for roomID, stateEvents := range roomIDToStateEvents {
@@ -249,6 +498,7 @@ func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata)
 		}
 		internal.Assert("room ID is set", metadata.RoomID != "", debugContext)
 		internal.Assert("last message timestamp exists", metadata.LastMessageTimestamp > 1, debugContext)
+		c.setJoinCount(&metadata, metadata.JoinCount)
 		c.roomIDToMetadata[roomID] = &metadata
 	}
 	return nil
@@ -274,6 +524,12 @@ func (c *GlobalCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEv
 	c.roomIDToMetadata[roomID] = metadata
 }
 
+func (c *GlobalCache) OnPresence(ctx context.Context, userID string, presenceEvent json.RawMessage, roomIDs []string) {
+	c.userIDToPresenceMu.Lock()
+	defer c.userIDToPresenceMu.Unlock()
+	c.userIDToPresence[userID] = presenceEvent
+}
+
 func (c *GlobalCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	// nothing to do but we need it because the Dispatcher demands it.
 }
@@ -301,6 +557,10 @@ func (c *GlobalCache) OnNewEvent(
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			metadata.Encrypted = true
 		}
+	case "m.room.guest_access":
+		if ed.StateKey != nil && *ed.StateKey == "" {
+			metadata.GuestAccess = ed.Content.Get("guest_access").Str == "can_join"
+		}
 	case "m.room.tombstone":
 		if ed.StateKey != nil && *ed.StateKey == "" {
 			newRoomID := ed.Content.Get("replacement_room").Str
@@ -325,7 +585,7 @@ func (c *GlobalCache) OnNewEvent(
 				metadata.PredecessorRoomID = &predecessorRoomID
 			}
 		}
-	case "m.space.child": // only track space child changes for now, not parents
+	case "m.space.child":
 		if ed.StateKey != nil {
 			isDeleted := !ed.Content.Get("via").IsArray()
 			if isDeleted {
@@ -334,20 +594,33 @@ func (c *GlobalCache) OnNewEvent(
 				metadata.ChildSpaceRooms[*ed.StateKey] = struct{}{}
 			}
 		}
+	case "m.space.parent":
+		if ed.StateKey != nil {
+			isDeleted := !ed.Content.Get("via").IsArray()
+			if metadata.ParentSpaceRooms == nil {
+				metadata.ParentSpaceRooms = make(map[string]struct{})
+			}
+			if isDeleted {
+				delete(metadata.ParentSpaceRooms, *ed.StateKey)
+			} else {
+				metadata.ParentSpaceRooms[*ed.StateKey] = struct{}{}
+			}
+		}
 	case "m.room.member":
 		if ed.StateKey != nil {
 			membership := ed.Content.Get("membership").Str
 			eventJSON := gjson.ParseBytes(ed.Event)
 			if internal.IsMembershipChange(eventJSON) {
-				metadata.JoinCount = ed.JoinCount
+				c.setJoinCount(metadata, ed.JoinCount)
 				metadata.InviteCount = ed.InviteCount
 				if membership == "leave" || membership == "ban" {
 					// remove this user as a hero
 					metadata.RemoveHero(*ed.StateKey)
 				}
 			}
-			if len(metadata.Heroes) < 6 && (membership == "join" || membership == "invite") {
-				// try to find the existing hero e.g they changed their display name
+			if membership == "join" || membership == "invite" {
+				// try to find the existing hero e.g they changed their display name. This must be
+				// done even if we have all the heroes we need, else names and avatars go stale.
 				found := false
 				for i := range metadata.Heroes {
 					if metadata.Heroes[i].ID == *ed.StateKey {
@@ -357,7 +630,7 @@ func (c *GlobalCache) OnNewEvent(
 						break
 					}
 				}
-				if !found {
+				if !found && len(metadata.Heroes) < 6 {
 					metadata.Heroes = append(metadata.Heroes, internal.Hero{
 						ID:     *ed.StateKey,
 						Name:   ed.Content.Get("displayname").Str,
@@ -387,9 +660,15 @@ func (c *GlobalCache) OnInvalidateRoom(ctx context.Context, roomID string) {
 		return
 	}
 
-	err := c.store.ResetMetadataState(metadata)
+	// large rooms keep their heroes and counts rather than loading every member to recalculate them
+	isLarge := metadata.Large
+	err := c.store.ResetMetadataState(metadata, isLarge)
 	if err != nil {
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		logger.Warn().Err(err).Msg("OnInvalidateRoom: failed to reset metadata")
+		return
+	}
+	if !isLarge {
+		c.setJoinCount(metadata, metadata.JoinCount)
 	}
 }
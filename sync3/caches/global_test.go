@@ -4,13 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
 )
 
 func TestGlobalCacheLoadState(t *testing.T) {
@@ -234,3 +237,131 @@ func TestGlobalCacheLoadState(t *testing.T) {
 		})
 	}
 }
+
+func newJoinEventData(t testutils.TestBenchInterface, roomID, userID string, joinCount int) *caches.EventData {
+	ev := testutils.NewJoinEvent(t, userID)
+	return &caches.EventData{
+		Event:     ev,
+		RoomID:    roomID,
+		EventType: "m.room.member",
+		StateKey:  &userID,
+		Content:   gjson.GetBytes(ev, "content"),
+		Timestamp: gjson.GetBytes(ev, "origin_server_ts").Uint(),
+		JoinCount: joinCount,
+	}
+}
+
+func TestGlobalCacheLargeRoomCounts(t *testing.T) {
+	ctx := context.Background()
+	largeRoomID := "!large:localhost"
+	smallRoomID := "!small:localhost"
+	large := internal.NewRoomMetadata(largeRoomID)
+	large.JoinCount = 123456
+	large.LastMessageTimestamp = 100
+	small := internal.NewRoomMetadata(smallRoomID)
+	small.JoinCount = 999
+	small.LastMessageTimestamp = 100
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.SetLargeRoomThreshold(1000)
+	if err := globalCache.Startup(map[string]internal.RoomMetadata{
+		largeRoomID: *large,
+		smallRoomID: *small,
+	}); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	assertCount := func(roomID string, wantCount int, wantLarge bool) {
+		t.Helper()
+		metadata := globalCache.LoadRooms(ctx, roomID)[roomID]
+		if metadata.JoinCount != wantCount || metadata.Large != wantLarge {
+			t.Fatalf("%s: got join count %d large %v, want %d large %v", roomID, metadata.JoinCount, metadata.Large, wantCount, wantLarge)
+		}
+	}
+	assertCount(largeRoomID, 120000, true)
+	assertCount(smallRoomID, 999, false)
+
+	// joins to large rooms don't change the count until it passes the next 2 significant figures
+	globalCache.OnNewEvent(ctx, newJoinEventData(t, largeRoomID, "@alice:localhost", 123457))
+	assertCount(largeRoomID, 120000, true)
+	globalCache.OnNewEvent(ctx, newJoinEventData(t, largeRoomID, "@bob:localhost", 130001))
+	assertCount(largeRoomID, 130000, true)
+
+	// rooms become large when they reach the threshold
+	globalCache.OnNewEvent(ctx, newJoinEventData(t, smallRoomID, "@alice:localhost", 1000))
+	assertCount(smallRoomID, 1000, true)
+	globalCache.OnNewEvent(ctx, newJoinEventData(t, smallRoomID, "@bob:localhost", 1019))
+	assertCount(smallRoomID, 1000, true)
+
+	// rooms are never large when disabled
+	globalCache = caches.NewGlobalCache(nil)
+	globalCache.SetLargeRoomThreshold(0)
+	if err := globalCache.Startup(map[string]internal.RoomMetadata{largeRoomID: *large}); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	assertCount(largeRoomID, 123456, false)
+}
+
+// Test that heroes' profile changes are tracked, even once the room has all the heroes it needs.
+func TestGlobalCacheHeroProfileChanges(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!heroes:localhost"
+	metadata := internal.NewRoomMetadata(roomID)
+	metadata.JoinCount = 6
+	metadata.LastMessageTimestamp = 100
+	for i := 0; i < 6; i++ {
+		metadata.Heroes = append(metadata.Heroes, internal.Hero{ID: fmt.Sprintf("@%d:localhost", i)})
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	if err := globalCache.Startup(map[string]internal.RoomMetadata{roomID: *metadata}); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	userID := "@5:localhost"
+	ev := testutils.NewStateEvent(t, "m.room.member", userID, userID, map[string]interface{}{
+		"membership":  "join",
+		"displayname": "Five",
+		"avatar_url":  "mxc://localhost/five",
+	}, testutils.WithUnsigned(map[string]interface{}{
+		"prev_content": map[string]interface{}{"membership": "join"},
+	}))
+	globalCache.OnNewEvent(ctx, &caches.EventData{
+		Event:     ev,
+		RoomID:    roomID,
+		EventType: "m.room.member",
+		StateKey:  &userID,
+		Content:   gjson.GetBytes(ev, "content"),
+		Timestamp: 101,
+		JoinCount: 6,
+	})
+	// a 7th member does not become a hero
+	globalCache.OnNewEvent(ctx, newJoinEventData(t, roomID, "@6:localhost", 7))
+
+	heroes := globalCache.LoadRooms(ctx, roomID)[roomID].Heroes
+	if len(heroes) != 6 {
+		t.Fatalf("got %d heroes want 6: %+v", len(heroes), heroes)
+	}
+	want := internal.Hero{ID: userID, Name: "Five", Avatar: "mxc://localhost/five"}
+	if heroes[5] != want {
+		t.Fatalf("got hero %+v want %+v", heroes[5], want)
+	}
+}
+
+// Benchmark the cost of joins to a synthetic large room, which should not depend on the number of
+// members in the room.
+func BenchmarkGlobalCacheLargeRoomJoins(b *testing.B) {
+	ctx := context.Background()
+	roomID := "!large:localhost"
+	metadata := internal.NewRoomMetadata(roomID)
+	metadata.JoinCount = 500000
+	metadata.LastMessageTimestamp = 100
+	globalCache := caches.NewGlobalCache(nil)
+	if err := globalCache.Startup(map[string]internal.RoomMetadata{roomID: *metadata}); err != nil {
+		b.Fatalf("Startup: %s", err)
+	}
+	joins := make([]*caches.EventData, b.N)
+	for i := range joins {
+		joins[i] = newJoinEventData(b, roomID, fmt.Sprintf("@user%d:localhost", i), metadata.JoinCount+i)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		globalCache.OnNewEvent(ctx, joins[i])
+	}
+}
@@ -0,0 +1,122 @@
+package caches
+
+import (
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// joinedRoomsSnapshot is the user's joined rooms as returned by GlobalCache.LoadJoinedRooms, kept up
+// to date with the events the dispatcher sends to the user cache. It is loaded when the user cache
+// is registered with the dispatcher, so no events are missed between loading it and receiving
+// updates, and lets connections skip scanning the user's membership history in the database.
+type joinedRoomsSnapshot struct {
+	// the database position the snapshot was loaded at. Events at or before this position are
+	// already included in the snapshot.
+	loadPos int64
+	// the position of the latest event in the snapshot
+	pos         int64
+	joinTimings map[string]internal.EventMetadata
+	latestNIDs  map[string]int64
+}
+
+func newJoinedRoomsSnapshot(pos int64, joinTimings map[string]internal.EventMetadata, latestNIDs map[string]int64) *joinedRoomsSnapshot {
+	s := &joinedRoomsSnapshot{
+		loadPos:     pos,
+		pos:         pos,
+		joinTimings: make(map[string]internal.EventMetadata, len(joinTimings)),
+		latestNIDs:  make(map[string]int64, len(latestNIDs)),
+	}
+	for roomID, timing := range joinTimings {
+		s.joinTimings[roomID] = timing
+	}
+	for roomID, nid := range latestNIDs {
+		s.latestNIDs[roomID] = nid
+	}
+	return s
+}
+
+// apply updates the snapshot with an event sent to the user cache. Returns false if the snapshot
+// can no longer be kept up to date, in which case it must be discarded.
+func (s *joinedRoomsSnapshot) apply(userID string, ed *EventData) bool {
+	isOwnMembership := ed.EventType == "m.room.member" && ed.StateKey != nil && *ed.StateKey == userID
+	if ed.NID == 0 {
+		// events from a state block have no position, so we cannot tell when we joined
+		return !isOwnMembership
+	}
+	if ed.NID <= s.pos {
+		// the database is ahead of the dispatcher, so events up to the load position may arrive
+		// after the snapshot was loaded. Any other event out of order means we can't trust pos.
+		return ed.NID <= s.loadPos
+	}
+	s.pos = ed.NID
+	_, joined := s.joinTimings[ed.RoomID]
+	if isOwnMembership {
+		switch ed.Content.Get("membership").Str {
+		case "join":
+			// as with LoadJoinedRooms, profile changes do not change when we joined
+			if !joined {
+				s.joinTimings[ed.RoomID] = internal.EventMetadata{
+					NID:       ed.NID,
+					Timestamp: ed.Timestamp,
+				}
+				joined = true
+			}
+		case "leave", "ban":
+			delete(s.joinTimings, ed.RoomID)
+			delete(s.latestNIDs, ed.RoomID)
+			return true
+		}
+	}
+	if joined {
+		s.latestNIDs[ed.RoomID] = ed.NID
+	}
+	return true
+}
+
+// JoinedRooms returns the position, join timings and latest event NIDs which LoadJoinedRooms would
+// return for this user, without going to the database. Returns false if they are not known, in
+// which case they must be loaded with LoadJoinedRooms.
+func (c *UserCache) JoinedRooms() (pos int64, joinTimings map[string]internal.EventMetadata, latestNIDs map[string]int64, ok bool) {
+	c.joinedRoomsMu.Lock()
+	defer c.joinedRoomsMu.Unlock()
+	s := c.joinedRooms
+	if s == nil {
+		return 0, nil, nil, false
+	}
+	joinTimings = make(map[string]internal.EventMetadata, len(s.joinTimings))
+	for roomID, timing := range s.joinTimings {
+		joinTimings[roomID] = timing
+	}
+	latestNIDs = make(map[string]int64, len(s.latestNIDs))
+	for roomID, nid := range s.latestNIDs {
+		latestNIDs[roomID] = nid
+	}
+	return s.pos, joinTimings, latestNIDs, true
+}
+
+func (c *UserCache) setJoinedRooms(s *joinedRoomsSnapshot) {
+	c.joinedRoomsMu.Lock()
+	defer c.joinedRoomsMu.Unlock()
+	c.joinedRooms = s
+}
+
+// leaveJoinedRoom removes the room from the snapshot. Leaves from a sync v2 response's leave section
+// are not always in the timeline, so may never be sent to the user cache as events.
+func (c *UserCache) leaveJoinedRoom(roomID string) {
+	c.joinedRoomsMu.Lock()
+	defer c.joinedRoomsMu.Unlock()
+	if c.joinedRooms != nil {
+		delete(c.joinedRooms.joinTimings, roomID)
+		delete(c.joinedRooms.latestNIDs, roomID)
+	}
+}
+
+func (c *UserCache) applyToJoinedRooms(ed *EventData) {
+	c.joinedRoomsMu.Lock()
+	defer c.joinedRoomsMu.Unlock()
+	if c.joinedRooms != nil && !c.joinedRooms.apply(c.UserID, ed) {
+		logger.Warn().Str("user", c.UserID).Str("room", ed.RoomID).Int64("nid", ed.NID).Msg(
+			"cannot keep joined rooms up to date, connections will load them from the database",
+		)
+		c.joinedRooms = nil
+	}
+}
@@ -1,6 +1,7 @@
 package caches
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -38,6 +39,26 @@ func (u *InviteUpdate) Type() string {
 	return fmt.Sprintf("InviteUpdate[%s]", u.RoomID())
 }
 
+// SpaceHierarchyUpdate is sent when the spaces a room is in, directly or via sub-spaces, change
+// because of a change elsewhere in the space hierarchy.
+type SpaceHierarchyUpdate struct {
+	RoomUpdate
+}
+
+func (u *SpaceHierarchyUpdate) Type() string {
+	return fmt.Sprintf("SpaceHierarchyUpdate[%s]", u.RoomID())
+}
+
+// IgnoredDMUpdate is sent when a room becomes, or stops being, a DM with an ignored user because
+// m.direct or m.ignored_user_list changed.
+type IgnoredDMUpdate struct {
+	RoomUpdate
+}
+
+func (u *IgnoredDMUpdate) Type() string {
+	return fmt.Sprintf("IgnoredDMUpdate[%s]", u.RoomID())
+}
+
 // TypingEdu corresponds to a typing EDU in the `ephemeral` section of a joined room's v2 sync resposne.
 type TypingUpdate struct {
 	RoomUpdate
@@ -47,6 +68,18 @@ func (u *TypingUpdate) Type() string {
 	return fmt.Sprintf("TypingUpdate[%s]", u.RoomID())
 }
 
+// PresenceUpdate corresponds to an m.presence event in the `presence` section of a v2 sync response.
+type PresenceUpdate struct {
+	UserID        string
+	PresenceEvent json.RawMessage
+	// The joined rooms the user shares with the user being updated.
+	RoomIDs []string
+}
+
+func (u *PresenceUpdate) Type() string {
+	return fmt.Sprintf("PresenceUpdate[%s]", u.UserID)
+}
+
 // RecieptUpdate corresponds to a receipt EDU in the `ephemeral` section of a joined room's v2 sync resposne.
 type ReceiptUpdate struct {
 	RoomUpdate
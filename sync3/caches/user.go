@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"reflect"
 	"sync"
 
 	"github.com/getsentry/sentry-go"
@@ -18,6 +20,10 @@ const (
 	InvitesAreHighlightsValue = 1 // invite -> highlight count = 1
 )
 
+// TagOrderUnset is the order in UserRoomData.Tags of tags which have no order. Rooms whose tag has
+// no order sort after rooms whose tag has one.
+var TagOrderUnset = math.Inf(1)
+
 type CacheFinder interface {
 	CacheForUser(userID string) *UserCache
 }
@@ -40,6 +46,7 @@ type JoinChecker interface {
 // in the caches.UserCache.
 type UserRoomData struct {
 	IsDM              bool
+	IsIgnoredDM       bool // a DM with a user in m.ignored_user_list, according to m.direct
 	IsInvite          bool
 	HasLeft           bool
 	NotificationCount int
@@ -60,7 +67,13 @@ type UserRoomData struct {
 
 	// Spaces is the set of room IDs of spaces that this room is part of.
 	Spaces map[string]struct{}
-	// Map of tag to order float.
+	// ParentSpaces is the set of room IDs of spaces this room claims to be part of with
+	// m.space.parent events.
+	ParentSpaces map[string]struct{}
+	// AncestorSpaces is the set of room IDs of every space this room is in, directly or via
+	// sub-spaces: the rooms in Spaces and ParentSpaces, their parent spaces and so on.
+	AncestorSpaces map[string]struct{}
+	// Map of tag to order float, which is TagOrderUnset for tags without an order.
 	// See https://spec.matrix.org/latest/client-server-api/#room-tagging
 	Tags map[string]float64
 	// JoinTiming tracks our latest join to the room, excluding profile changes.
@@ -69,11 +82,19 @@ type UserRoomData struct {
 
 func NewUserRoomData() UserRoomData {
 	return UserRoomData{
-		Spaces: make(map[string]struct{}),
-		Tags:   make(map[string]float64),
+		Spaces:         make(map[string]struct{}),
+		ParentSpaces:   make(map[string]struct{}),
+		AncestorSpaces: make(map[string]struct{}),
+		Tags:           make(map[string]float64),
 	}
 }
 
+// IsKnock returns true if the user has knocked on the room and is waiting to be let in. Knocks are
+// treated like invites, so IsInvite is true as well.
+func (u *UserRoomData) IsKnock() bool {
+	return u.IsInvite && u.Invite != nil && u.Invite.IsKnock
+}
+
 // Subset of data from internal.RoomMetadata which we can glean from invite_state.
 // Processed in the same way as joined rooms!
 type InviteData struct {
@@ -88,6 +109,9 @@ type InviteData struct {
 	Encrypted            bool
 	IsDM                 bool
 	RoomType             string
+	// IsKnock is true if this is the stripped state of a room the user has knocked on, rather than
+	// been invited to.
+	IsKnock bool
 }
 
 func NewInviteData(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) *InviteData {
@@ -116,6 +140,7 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 					AlwaysProcess: true,
 				}
 				id.IsDM = j.Get("content.is_direct").Bool()
+				id.IsKnock = j.Get("content.membership").Str == "knock"
 			} else if target == j.Get("sender").Str {
 				id.Heroes = append(id.Heroes, internal.Hero{
 					ID:     target,
@@ -136,7 +161,7 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 		}
 	}
 	if id.InviteEvent == nil {
-		const errMsg = "cannot make invite, missing invite event for user"
+		const errMsg = "cannot make invite, missing invite or knock event for user"
 		logger.Error().Str("invitee", userID).Str("room", roomID).Int("num_invite_state", len(inviteState)).Msg(errMsg)
 		hub := internal.GetSentryHubFromContextOrDefault(ctx)
 		hub.WithScope(func(scope *sentry.Scope) {
@@ -149,6 +174,14 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 		})
 		return nil
 	}
+	if len(id.Heroes) == 0 {
+		// servers need not include the inviter's member event in the stripped state, but the
+		// inviter is the only other member we know of, so use them to name the room like sync v2
+		inviter := gjson.GetBytes(id.InviteEvent.Event, "sender").Str
+		if inviter != "" && inviter != userID {
+			id.Heroes = append(id.Heroes, internal.Hero{ID: inviter})
+		}
+	}
 	return &id
 }
 
@@ -163,6 +196,9 @@ func (i *InviteData) RoomMetadata() *internal.RoomMetadata {
 	metadata.AvatarEvent = i.AvatarEvent
 	metadata.CanonicalAlias = i.CanonicalAlias
 	metadata.InviteCount = 1
+	if i.IsKnock {
+		metadata.InviteCount = 0
+	}
 	metadata.JoinCount = 1
 	metadata.LastMessageTimestamp = i.LastMessageTimestamp
 	metadata.Encrypted = i.Encrypted
@@ -181,8 +217,8 @@ type UserCacheListener interface {
 
 // Subset of store functions used by the user cache
 type UserCacheStore interface {
-	LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error)
-	GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string)
+	LatestEventsInRooms(ctx context.Context, userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error)
+	GetClosestPrevBatch(ctx context.Context, roomID string, eventNID int64) (prevBatch string)
 }
 
 // Tracks data specific to a given user. Specifically, this is the map of room ID to UserRoomData.
@@ -201,6 +237,14 @@ type UserCache struct {
 	joinChecker               JoinChecker
 	ignoredUsers              map[string]struct{}
 	ignoredUsersMu            *sync.RWMutex
+	// room ID -> the users m.direct says the room is a DM with. Guarded by roomToDataMu.
+	directRoomUsers map[string][]string
+	// the content of the user's m.push_rules account data, or nil if it is not known
+	pushRules   json.RawMessage
+	pushRulesMu *sync.RWMutex
+	// the user's joined rooms, or nil if they are not known
+	joinedRooms   *joinedRoomsSnapshot
+	joinedRoomsMu *sync.Mutex
 }
 
 func NewUserCache(userID string, globalCache *GlobalCache, store UserCacheStore, txnIDs TransactionIDFetcher, joinChecker JoinChecker) *UserCache {
@@ -218,6 +262,8 @@ func NewUserCache(userID string, globalCache *GlobalCache, store UserCacheStore,
 		joinChecker:    joinChecker,
 		ignoredUsers:   make(map[string]struct{}),
 		ignoredUsersMu: &sync.RWMutex{},
+		pushRulesMu:    &sync.RWMutex{},
+		joinedRoomsMu:  &sync.Mutex{},
 	}
 	return uc
 }
@@ -246,7 +292,7 @@ func (c *UserCache) Unsubscribe(id int) {
 func (c *UserCache) OnRegistered(ctx context.Context) error {
 	// select all spaces the user is a part of to seed the cache correctly. This has to be done in
 	// the OnRegistered callback which has locking guarantees. This is why...
-	_, joinedRooms, joinTimings, _, err := c.globalCache.LoadJoinedRooms(ctx, c.UserID)
+	pos, joinedRooms, joinTimings, latestNIDs, err := c.globalCache.LoadJoinedRooms(ctx, c.UserID)
 	if err != nil {
 		return fmt.Errorf("failed to load joined rooms: %s", err)
 	}
@@ -289,18 +335,22 @@ func (c *UserCache) OnRegistered(ctx context.Context) error {
 	// that ConnState has which is why it has loadPositions. However, unlike ConnState, these dupe updates
 	// don't have any negative effect as we are just updating UserRoomData, not sending timeline events,
 	// so we consciously let this race happen.
+	//
+	// The joined rooms themselves are remembered for connections, which need the same data and would
+	// otherwise load it again. These do care about duplicates, which joinedRoomsSnapshot ignores.
+	c.setJoinedRooms(newJoinedRoomsSnapshot(pos, joinTimings, latestNIDs))
 	for _, room := range joinedRooms {
-		// inject space children events
+		// inject the space hierarchy. Connections load rooms after this, so don't notify them.
+		c.roomToDataMu.Lock()
 		if room.IsSpace() {
 			for childRoomID := range room.ChildSpaceRooms {
-				c.OnSpaceUpdate(ctx, room.RoomID, childRoomID, false, &EventData{
-					RoomID:    room.RoomID,
-					EventType: "m.space.child",
-					StateKey:  &childRoomID,
-					NID:       0,
-				})
+				c.setSpaceLink(room.RoomID, childRoomID, false, false)
 			}
 		}
+		for parentRoomID := range room.ParentSpaceRooms {
+			c.setSpaceLink(parentRoomID, room.RoomID, true, false)
+		}
+		c.roomToDataMu.Unlock()
 
 		// Record when we joined the room. We've just had to scan the history of our
 		// membership in this room to produce joinedRooms above, so we may as well
@@ -314,6 +364,11 @@ func (c *UserCache) OnRegistered(ctx context.Context) error {
 		c.roomToData[room.RoomID] = urd
 		c.roomToDataMu.Unlock()
 	}
+	c.roomToDataMu.Lock()
+	for roomID := range c.roomToData {
+		c.updateAncestorSpaces(roomID)
+	}
+	c.roomToDataMu.Unlock()
 	return nil
 }
 
@@ -329,10 +384,10 @@ func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomID
 		return c.LazyLoadTimelinesOverride(loadPos, roomIDs, maxTimelineEvents)
 	}
 	result := make(map[string]state.LatestEvents)
-	roomIDToLatestEvents, err := c.store.LatestEventsInRooms(c.UserID, roomIDs, loadPos, maxTimelineEvents)
+	roomIDToLatestEvents, err := c.store.LatestEventsInRooms(internal.LoadContext(ctx), c.UserID, roomIDs, loadPos, maxTimelineEvents)
 	if err != nil {
 		logger.Err(err).Strs("rooms", roomIDs).Msg("failed to get LatestEventsInRooms")
-		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		captureLoadError(ctx, err)
 		return nil
 	}
 	for _, requestedRoomID := range roomIDs {
@@ -431,7 +486,7 @@ func (c *UserCache) Invites() map[string]UserRoomData {
 func (c *UserCache) AttemptToFetchPrevBatch(ctx context.Context, roomID string, firstTimelineEvent *EventData) (prevBatch string) {
 	_, span := internal.StartSpan(ctx, "AttemptToFetchPrevBatch")
 	defer span.End()
-	return c.store.GetClosestPrevBatch(roomID, firstTimelineEvent.NID)
+	return c.store.GetClosestPrevBatch(internal.LoadContext(ctx), roomID, firstTimelineEvent.NID)
 }
 
 // AnnotateWithTransactionIDs should be called just prior to returning events to the client. This
@@ -512,6 +567,14 @@ func (c *UserCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEven
 	c.emitOnRoomUpdate(ctx, update)
 }
 
+func (c *UserCache) OnPresence(ctx context.Context, userID string, presenceEvent json.RawMessage, roomIDs []string) {
+	c.emitOnUpdate(ctx, &PresenceUpdate{
+		UserID:        userID,
+		PresenceEvent: presenceEvent,
+		RoomIDs:       roomIDs,
+	})
+}
+
 func (c *UserCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	c.emitOnRoomUpdate(ctx, &ReceiptUpdate{
 		RoomUpdate: c.newRoomUpdate(ctx, receipt.RoomID),
@@ -569,14 +632,9 @@ func (c *UserCache) OnUnreadCounts(ctx context.Context, roomID string, highlight
 }
 
 func (c *UserCache) OnSpaceUpdate(ctx context.Context, parentRoomID, childRoomID string, isDeleted bool, eventData *EventData) {
-	childURD := c.LoadRoomData(childRoomID)
-	if isDeleted {
-		delete(childURD.Spaces, parentRoomID)
-	} else {
-		childURD.Spaces[parentRoomID] = struct{}{}
-	}
 	c.roomToDataMu.Lock()
-	c.roomToData[childRoomID] = childURD
+	c.setSpaceLink(parentRoomID, childRoomID, false, isDeleted)
+	changed := c.updateSpaceHierarchy(childRoomID)
 	c.roomToDataMu.Unlock()
 
 	// now we need to notify connections for the _child_
@@ -588,27 +646,145 @@ func (c *UserCache) OnSpaceUpdate(ctx context.Context, parentRoomID, childRoomID
 		}
 		c.emitOnRoomUpdate(ctx, roomUpdate)
 	}
+	c.emitSpaceHierarchyUpdates(ctx, changed, childRoomID)
+}
+
+// onSpaceParentUpdate is called when the child room's m.space.parent event for the parent changes.
+// The child room itself is notified by the event.
+func (c *UserCache) onSpaceParentUpdate(ctx context.Context, parentRoomID, childRoomID string, isDeleted bool) {
+	c.roomToDataMu.Lock()
+	c.setSpaceLink(parentRoomID, childRoomID, true, isDeleted)
+	changed := c.updateSpaceHierarchy(childRoomID)
+	c.roomToDataMu.Unlock()
+	c.emitSpaceHierarchyUpdates(ctx, changed, childRoomID)
+}
+
+// emitSpaceHierarchyUpdates notifies connections of the joined rooms in the space hierarchy which
+// are now in different spaces, apart from the room which caused the change.
+func (c *UserCache) emitSpaceHierarchyUpdates(ctx context.Context, changedRoomIDs []string, exceptRoomID string) {
+	for _, roomID := range changedRoomIDs {
+		if roomID == exceptRoomID || !c.joinChecker.IsUserJoined(c.UserID, roomID) {
+			continue
+		}
+		c.emitOnRoomUpdate(ctx, &SpaceHierarchyUpdate{
+			RoomUpdate: c.newRoomUpdate(ctx, roomID),
+		})
+	}
+}
+
+// setSpaceLink records that the child room is in the parent space, according to either the
+// parent's m.space.child event or the child's m.space.parent event. Does not update AncestorSpaces.
+// Must hold roomToDataMu.
+func (c *UserCache) setSpaceLink(parentRoomID, childRoomID string, isParentEvent, isDeleted bool) {
+	childURD, ok := c.roomToData[childRoomID]
+	if !ok {
+		childURD = NewUserRoomData()
+	}
+	spaces := childURD.Spaces
+	if isParentEvent {
+		if childURD.ParentSpaces == nil {
+			childURD.ParentSpaces = make(map[string]struct{})
+		}
+		spaces = childURD.ParentSpaces
+	}
+	if isDeleted {
+		delete(spaces, parentRoomID)
+	} else {
+		spaces[parentRoomID] = struct{}{}
+	}
+	c.roomToData[childRoomID] = childURD
+}
+
+// updateSpaceHierarchy updates AncestorSpaces for the room and every room below it in the space
+// hierarchy, returning the rooms whose AncestorSpaces changed. Must hold roomToDataMu.
+func (c *UserCache) updateSpaceHierarchy(roomID string) (changed []string) {
+	// find the rooms below this one. Space changes are rare, so scan rather than keeping an index.
+	below := []string{roomID}
+	seen := map[string]bool{roomID: true}
+	for i := 0; i < len(below); i++ {
+		for childRoomID, urd := range c.roomToData {
+			if seen[childRoomID] {
+				continue
+			}
+			_, inSpace := urd.Spaces[below[i]]
+			_, claimsSpace := urd.ParentSpaces[below[i]]
+			if inSpace || claimsSpace {
+				seen[childRoomID] = true
+				below = append(below, childRoomID)
+			}
+		}
+	}
+	for _, r := range below {
+		if c.updateAncestorSpaces(r) {
+			changed = append(changed, r)
+		}
+	}
+	return changed
+}
+
+// updateAncestorSpaces recalculates AncestorSpaces for the room, returning true if it changed.
+// Must hold roomToDataMu.
+func (c *UserCache) updateAncestorSpaces(roomID string) bool {
+	urd, ok := c.roomToData[roomID]
+	if !ok {
+		return false
+	}
+	ancestors := make(map[string]struct{})
+	var toVisit []string
+	addParents := func(r UserRoomData) {
+		for spaceID := range r.Spaces {
+			toVisit = append(toVisit, spaceID)
+		}
+		for spaceID := range r.ParentSpaces {
+			toVisit = append(toVisit, spaceID)
+		}
+	}
+	addParents(urd)
+	for len(toVisit) > 0 {
+		spaceID := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+		if _, visited := ancestors[spaceID]; visited || spaceID == roomID {
+			continue // space hierarchies can have cycles
+		}
+		ancestors[spaceID] = struct{}{}
+		addParents(c.roomToData[spaceID])
+	}
+	if reflect.DeepEqual(ancestors, urd.AncestorSpaces) {
+		return false
+	}
+	// replace rather than modify the map, as copies of urd are held by connections
+	urd.AncestorSpaces = ancestors
+	c.roomToData[roomID] = urd
+	return true
 }
 
 func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
+	c.applyToJoinedRooms(eventData)
 	// add this to our tracked timelines if we have one
 	urd := c.LoadRoomData(eventData.RoomID)
 	// reset the IsInvite field when the user actually joins/rejects the invite
 	if urd.IsInvite && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
-		urd.IsInvite = eventData.Content.Get("membership").Str == "invite"
+		membership := eventData.Content.Get("membership").Str
+		urd.IsInvite = membership == "invite" || (membership == "knock" && urd.IsKnock())
 		if !urd.IsInvite {
 			urd.HighlightCount = 0
 		}
 	}
+	c.roomToDataMu.Lock()
+	c.roomToData[eventData.RoomID] = urd
+	c.roomToDataMu.Unlock()
+	// space updates are handled after storing urd, as they can change the space hierarchy of this room
 	if eventData.EventType == "m.space.child" && eventData.StateKey != nil {
 		// the children for a space we are a part of have changed. Find the room that was affected and update our cache value.
 		childRoomID := *eventData.StateKey
 		isDeleted := !eventData.Content.Get("via").IsArray()
 		c.OnSpaceUpdate(ctx, eventData.RoomID, childRoomID, isDeleted, eventData)
 	}
-	c.roomToDataMu.Lock()
-	c.roomToData[eventData.RoomID] = urd
-	c.roomToDataMu.Unlock()
+	if eventData.EventType == "m.space.parent" && eventData.StateKey != nil {
+		// this room has changed which spaces it claims to be in
+		isDeleted := !eventData.Content.Get("via").IsArray()
+		c.onSpaceParentUpdate(ctx, *eventData.StateKey, eventData.RoomID, isDeleted)
+	}
 
 	roomUpdate := &RoomEventUpdate{
 		RoomUpdate: c.newRoomUpdate(ctx, eventData.RoomID),
@@ -628,6 +804,10 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 	urd.IsInvite = true
 	urd.HasLeft = false
 	urd.HighlightCount = InvitesAreHighlightsValue
+	if inviteData.IsKnock {
+		// we are waiting on the room, so there is nothing for the user to act on
+		urd.HighlightCount = 0
+	}
 	urd.IsDM = inviteData.IsDM
 	urd.Invite = inviteData
 	c.roomToDataMu.Lock()
@@ -657,6 +837,7 @@ func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent js
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = urd
 	c.roomToDataMu.Unlock()
+	c.leaveJoinedRoom(roomID)
 
 	ev := gjson.ParseBytes(leaveEvent)
 	stateKey := ev.Get("state_key").Str
@@ -698,6 +879,8 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 	roomUpdates := make(map[string][]state.AccountData)
 	// room_id -> tag_id -> order
 	tagUpdates := make(map[string]map[string]float64)
+	// true if the DMs or the ignored users changed, so which rooms are DMs with ignored users may have
+	ignoredDMsChanged := false
 	for _, d := range datas {
 		up := roomUpdates[d.RoomID]
 		up = append(up, d)
@@ -705,16 +888,19 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 		switch d.Type {
 		case "m.direct":
 			dmRoomSet := make(map[string]struct{})
+			directRoomUsers := make(map[string][]string)
 			// pull out rooms and mark them as DMs
 			content := gjson.ParseBytes(d.Data).Get("content")
-			content.ForEach(func(_, v gjson.Result) bool {
+			content.ForEach(func(k, v gjson.Result) bool {
 				for _, roomIDResult := range v.Array() {
 					dmRoomSet[roomIDResult.Str] = struct{}{}
+					directRoomUsers[roomIDResult.Str] = append(directRoomUsers[roomIDResult.Str], k.Str)
 				}
 				return true
 			})
 			// this event REPLACES all DM rooms so reset the DM state on all rooms then update
 			c.roomToDataMu.Lock()
+			c.directRoomUsers = directRoomUsers
 			for roomID, urd := range c.roomToData {
 				_, exists := dmRoomSet[roomID]
 				urd.IsDM = exists
@@ -728,13 +914,19 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 				c.roomToData[dmRoomID] = u
 			}
 			c.roomToDataMu.Unlock()
+			ignoredDMsChanged = true
 		case "m.tag":
 			content := gjson.ParseBytes(d.Data).Get("content.tags")
 			if tagUpdates[d.RoomID] == nil {
 				tagUpdates[d.RoomID] = make(map[string]float64)
 			}
 			content.ForEach(func(k, v gjson.Result) bool {
-				tagUpdates[d.RoomID][k.Str] = v.Get("order").Float()
+				order := v.Get("order")
+				if order.Type == gjson.Number {
+					tagUpdates[d.RoomID][k.Str] = order.Num
+				} else {
+					tagUpdates[d.RoomID][k.Str] = TagOrderUnset
+				}
 				return true
 			})
 		case "m.ignored_user_list":
@@ -753,6 +945,18 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 			c.ignoredUsersMu.Lock()
 			c.ignoredUsers = ignoredUsers
 			c.ignoredUsersMu.Unlock()
+			ignoredDMsChanged = true
+		case "m.push_rules":
+			if d.RoomID != state.AccountDataGlobalRoom {
+				continue
+			}
+			content := gjson.GetBytes(d.Data, "content")
+			if !content.IsObject() {
+				continue
+			}
+			c.pushRulesMu.Lock()
+			c.pushRules = json.RawMessage(content.Raw)
+			c.pushRulesMu.Unlock()
 		}
 	}
 	if len(tagUpdates) > 0 {
@@ -768,6 +972,10 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 		}
 		c.roomToDataMu.Unlock()
 	}
+	var ignoredDMsChangedRoomIDs []string
+	if ignoredDMsChanged {
+		ignoredDMsChangedRoomIDs = c.updateIgnoredDMs()
+	}
 	// bucket account data updates per-room and globally then invoke listeners
 	for roomID, updates := range roomUpdates {
 		if roomID == state.AccountDataGlobalRoom {
@@ -783,7 +991,47 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 			c.emitOnRoomUpdate(ctx, roomUpdate)
 		}
 	}
+	// lists which exclude DMs with ignored users need to add or remove these rooms
+	for _, roomID := range ignoredDMsChangedRoomIDs {
+		if !c.joinChecker.IsUserJoined(c.UserID, roomID) {
+			continue
+		}
+		c.emitOnRoomUpdate(ctx, &IgnoredDMUpdate{
+			RoomUpdate: c.newRoomUpdate(ctx, roomID),
+		})
+	}
+}
+
+// updateIgnoredDMs recalculates IsIgnoredDM for every room from m.direct and the ignored users.
+// Returns the rooms whose IsIgnoredDM changed.
+func (c *UserCache) updateIgnoredDMs() (changedRoomIDs []string) {
+	c.ignoredUsersMu.RLock()
+	defer c.ignoredUsersMu.RUnlock()
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	for roomID, urd := range c.roomToData {
+		isIgnoredDM := false
+		for _, userID := range c.directRoomUsers[roomID] {
+			if _, ignored := c.ignoredUsers[userID]; ignored {
+				isIgnoredDM = true
+				break
+			}
+		}
+		if urd.IsIgnoredDM == isIgnoredDM {
+			continue
+		}
+		urd.IsIgnoredDM = isIgnoredDM
+		c.roomToData[roomID] = urd
+		changedRoomIDs = append(changedRoomIDs, roomID)
+	}
+	return changedRoomIDs
+}
 
+// PushRules returns the content of the user's m.push_rules account data, or nil if it is not known.
+func (u *UserCache) PushRules() json.RawMessage {
+	u.pushRulesMu.RLock()
+	defer u.pushRulesMu.RUnlock()
+	return u.pushRules
 }
 
 func (u *UserCache) ShouldIgnore(userID string) bool {
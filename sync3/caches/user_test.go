@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sort"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
 )
 
 type joinChecker struct{}
@@ -129,3 +133,258 @@ func convertIDTxnToEventStub(sender string, roomToEventIDs map[string][][2]strin
 	}
 	return result
 }
+
+type roomUpdateRecorder struct {
+	roomIDs []string
+}
+
+func (r *roomUpdateRecorder) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	r.roomIDs = append(r.roomIDs, up.RoomID())
+}
+
+func (r *roomUpdateRecorder) OnUpdate(ctx context.Context, up caches.Update) {}
+
+// Test that rooms are in the spaces above them in the space hierarchy, whether they are linked by
+// m.space.child or m.space.parent, and that rooms lower down are told when this changes.
+func TestUserCacheSpaceHierarchy(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	uc := caches.NewUserCache(userID, caches.NewGlobalCache(nil), nil, &txnIDFetcher{}, &joinChecker{})
+	recorder := &roomUpdateRecorder{}
+	uc.Subsribe(recorder)
+	spaceEvent := func(roomID, evType, stateKey string, deleted bool) {
+		content := `{"via":["localhost"]}`
+		if deleted {
+			content = `{}`
+		}
+		uc.OnNewEvent(ctx, &caches.EventData{
+			RoomID:    roomID,
+			EventType: evType,
+			StateKey:  &stateKey,
+			Content:   gjson.Parse(content),
+			NID:       1,
+		})
+	}
+	assertSpaces := func(roomID string, wantSpaces ...string) {
+		t.Helper()
+		got := uc.LoadRoomData(roomID).AncestorSpaces
+		want := make(map[string]struct{})
+		for _, s := range wantSpaces {
+			want[s] = struct{}{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("room %s: got spaces %v want %v", roomID, got, want)
+		}
+	}
+	// !top has child !sub, which has child !room
+	spaceEvent("!sub", "m.space.child", "!room", false)
+	spaceEvent("!top", "m.space.child", "!sub", false)
+	assertSpaces("!room", "!sub", "!top")
+	assertSpaces("!sub", "!top")
+	assertSpaces("!top")
+
+	// rooms below a space which moves are told about it
+	recorder.roomIDs = nil
+	spaceEvent("!other", "m.space.parent", "!top", false)
+	assertSpaces("!other", "!top")
+	spaceEvent("!top", "m.space.parent", "!root", false)
+	assertSpaces("!room", "!sub", "!top", "!root")
+	assertSpaces("!other", "!top", "!root")
+	sort.Strings(recorder.roomIDs)
+	if !reflect.DeepEqual(recorder.roomIDs, []string{"!other", "!other", "!room", "!sub", "!top"}) {
+		t.Errorf("unexpected room updates: %v", recorder.roomIDs)
+	}
+
+	// cycles don't put a room in its own space
+	spaceEvent("!room", "m.space.child", "!top", false)
+	assertSpaces("!top", "!root", "!room", "!sub")
+	assertSpaces("!room", "!sub", "!top", "!root")
+
+	// removing links removes the spaces further up as well
+	spaceEvent("!room", "m.space.child", "!top", true)
+	spaceEvent("!top", "m.space.child", "!sub", true)
+	assertSpaces("!room", "!sub")
+	assertSpaces("!sub")
+	spaceEvent("!top", "m.space.parent", "!root", true)
+	assertSpaces("!other", "!top")
+}
+
+// Test that the joined rooms loaded when the user cache is registered are kept up to date with the
+// events it is sent, ignoring events which were already loaded.
+func TestUserCacheJoinedRooms(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, latestNIDs map[string]int64, err error) {
+		return 10, map[string]*internal.RoomMetadata{
+			"!a": internal.NewRoomMetadata("!a"),
+			"!b": internal.NewRoomMetadata("!b"),
+		}, map[string]internal.EventMetadata{
+			"!a": {NID: 1, Timestamp: 100},
+			"!b": {NID: 2, Timestamp: 200},
+		}, map[string]int64{
+			"!a": 9,
+			"!b": 10,
+		}, nil
+	}
+	uc := caches.NewUserCache(userID, globalCache, nil, &txnIDFetcher{}, &joinChecker{})
+	if _, _, _, ok := uc.JoinedRooms(); ok {
+		t.Fatalf("JoinedRooms before OnRegistered: got ok")
+	}
+	if err := uc.OnRegistered(ctx); err != nil {
+		t.Fatalf("OnRegistered: %s", err)
+	}
+	newEvent := func(roomID string, nid int64, stateKey *string, membership string) {
+		evType := "m.room.message"
+		if stateKey != nil {
+			evType = "m.room.member"
+		}
+		uc.OnNewEvent(ctx, &caches.EventData{
+			RoomID:    roomID,
+			EventType: evType,
+			StateKey:  stateKey,
+			Content:   gjson.Parse(fmt.Sprintf(`{"membership":"%s"}`, membership)),
+			NID:       nid,
+			Timestamp: uint64(nid * 100),
+		})
+	}
+	assertJoinedRooms := func(wantPos int64, wantTimings map[string]internal.EventMetadata, wantLatestNIDs map[string]int64) {
+		t.Helper()
+		pos, timings, latestNIDs, ok := uc.JoinedRooms()
+		if !ok {
+			t.Fatalf("JoinedRooms: got !ok")
+		}
+		if pos != wantPos || !reflect.DeepEqual(timings, wantTimings) || !reflect.DeepEqual(latestNIDs, wantLatestNIDs) {
+			t.Errorf("JoinedRooms: got %d %v %v want %d %v %v", pos, timings, latestNIDs, wantPos, wantTimings, wantLatestNIDs)
+		}
+	}
+	// the database was ahead of the dispatcher: this was already loaded
+	newEvent("!a", 8, nil, "")
+	// alice's profile change doesn't change when she joined
+	newEvent("!b", 11, &userID, "join")
+	newEvent("!c", 12, &userID, "join")
+	newEvent("!a", 13, &userID, "leave")
+	newEvent("!c", 14, nil, "")
+	assertJoinedRooms(14, map[string]internal.EventMetadata{
+		"!b": {NID: 2, Timestamp: 200},
+		"!c": {NID: 12, Timestamp: 1200},
+	}, map[string]int64{
+		"!b": 11,
+		"!c": 14,
+	})
+	uc.OnLeftRoom(ctx, "!c", json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","sender":"@alice:localhost","content":{"membership":"leave"}}`))
+	assertJoinedRooms(14, map[string]internal.EventMetadata{
+		"!b": {NID: 2, Timestamp: 200},
+	}, map[string]int64{
+		"!b": 11,
+	})
+
+	// joining a room from a state block has no position, so the joined rooms are no longer known
+	newEvent("!d", 0, &userID, "join")
+	if _, _, _, ok := uc.JoinedRooms(); ok {
+		t.Fatalf("JoinedRooms after joining from a state block: got ok")
+	}
+}
+
+// Test that tags without an order are remembered as such, so they can sort after tags with one.
+func TestUserCacheTagOrders(t *testing.T) {
+	uc := caches.NewUserCache("@alice:localhost", caches.NewGlobalCache(nil), nil, &txnIDFetcher{}, &joinChecker{})
+	uc.OnAccountData(context.Background(), []state.AccountData{{
+		RoomID: "!a",
+		Type:   "m.tag",
+		Data:   []byte(`{"type":"m.tag","content":{"tags":{"m.favourite":{"order":0.25},"u.work":{},"u.bad":{"order":"1"}}}}`),
+	}})
+	want := map[string]float64{
+		"m.favourite": 0.25,
+		"u.work":      caches.TagOrderUnset,
+		"u.bad":       caches.TagOrderUnset,
+	}
+	if got := uc.LoadRoomData("!a").Tags; !reflect.DeepEqual(got, want) {
+		t.Errorf("got tags %v want %v", got, want)
+	}
+}
+
+// Test that rooms are DMs with ignored users whichever of m.direct and m.ignored_user_list changes,
+// and that their connections are told when this changes.
+func TestUserCacheIgnoredDMs(t *testing.T) {
+	ctx := context.Background()
+	uc := caches.NewUserCache("@alice:localhost", caches.NewGlobalCache(nil), nil, &txnIDFetcher{}, &joinChecker{})
+	recorder := &roomUpdateRecorder{}
+	uc.Subsribe(recorder)
+	globalAccountData := func(evType, content string) {
+		uc.OnAccountData(ctx, []state.AccountData{{
+			RoomID: state.AccountDataGlobalRoom,
+			Type:   evType,
+			Data:   []byte(fmt.Sprintf(`{"type":"%s","content":%s}`, evType, content)),
+		}})
+	}
+	assertIgnoredDMs := func(wantIgnoredDMs, wantUpdates []string) {
+		t.Helper()
+		for _, roomID := range []string{"!bob", "!charlie", "!group"} {
+			want := false
+			for _, r := range wantIgnoredDMs {
+				want = want || r == roomID
+			}
+			if got := uc.LoadRoomData(roomID).IsIgnoredDM; got != want {
+				t.Errorf("room %s: got IsIgnoredDM %v want %v", roomID, got, want)
+			}
+		}
+		sort.Strings(recorder.roomIDs)
+		if !reflect.DeepEqual(recorder.roomIDs, wantUpdates) {
+			t.Errorf("got room updates for %v want %v", recorder.roomIDs, wantUpdates)
+		}
+		recorder.roomIDs = nil
+	}
+	globalAccountData("m.direct", `{"@bob:localhost":["!bob","!group"],"@charlie:localhost":["!charlie","!group"]}`)
+	assertIgnoredDMs(nil, nil)
+
+	globalAccountData("m.ignored_user_list", `{"ignored_users":{"@bob:localhost":{}}}`)
+	assertIgnoredDMs([]string{"!bob", "!group"}, []string{"!bob", "!group"})
+
+	// !group is still a DM with bob
+	globalAccountData("m.direct", `{"@bob:localhost":["!group"],"@charlie:localhost":["!charlie"]}`)
+	assertIgnoredDMs([]string{"!group"}, []string{"!bob"})
+
+	globalAccountData("m.ignored_user_list", `{"ignored_users":{"@charlie:localhost":{}}}`)
+	assertIgnoredDMs([]string{"!charlie"}, []string{"!charlie", "!group"})
+}
+
+// Test that invites are named after the inviter, even if their member event isn't in the stripped state.
+func TestNewInviteDataHeroes(t *testing.T) {
+	userID := "@alice:localhost"
+	inviter := "@bob:localhost"
+	invite := json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","sender":"@bob:localhost","content":{"membership":"invite","is_direct":true},"origin_server_ts":100}`)
+	inviterMember := json.RawMessage(`{"type":"m.room.member","state_key":"@bob:localhost","sender":"@bob:localhost","content":{"membership":"join","displayname":"Bob","avatar_url":"mxc://localhost/bob"}}`)
+	testCases := []struct {
+		name        string
+		inviteState []json.RawMessage
+		wantHero    string
+		wantName    string
+		wantAvatar  string
+	}{
+		{
+			name:        "inviter member event",
+			inviteState: []json.RawMessage{invite, inviterMember},
+			wantHero:    inviter,
+			wantName:    "Bob",
+			wantAvatar:  "mxc://localhost/bob",
+		},
+		{
+			name:        "no inviter member event",
+			inviteState: []json.RawMessage{invite},
+			wantHero:    inviter,
+		},
+	}
+	for _, tc := range testCases {
+		id := caches.NewInviteData(context.Background(), userID, "!invite:localhost", tc.inviteState)
+		if id == nil {
+			t.Fatalf("%s: NewInviteData returned nil", tc.name)
+		}
+		if len(id.Heroes) != 1 || id.Heroes[0].ID != tc.wantHero || id.Heroes[0].Name != tc.wantName || id.Heroes[0].Avatar != tc.wantAvatar {
+			t.Errorf("%s: got heroes %+v want %s (%q, %q)", tc.name, id.Heroes, tc.wantHero, tc.wantName, tc.wantAvatar)
+		}
+		if !id.IsDM {
+			t.Errorf("%s: invite is not a DM", tc.name)
+		}
+	}
+}
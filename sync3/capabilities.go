@@ -0,0 +1,107 @@
+package sync3
+
+import (
+	"sort"
+
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+)
+
+const (
+	// CapabilitiesSchemaVersion is the version of the Capabilities JSON object. Fields and feature
+	// names are only ever added: if an existing field or feature changes meaning, this is bumped.
+	CapabilitiesSchemaVersion = 1
+	// SpecRevision identifies the sliding sync proposal which this proxy implements.
+	SpecRevision = "org.matrix.msc3575"
+)
+
+// Features which depend on how the proxy is configured.
+const (
+	FeatureSuggestedPollInterval = "suggested_poll_interval"
+	FeatureUntrackedRooms        = "untracked_rooms"
+	FeatureBackfill              = "backfill"
+)
+
+// Features which are always available in this build of the proxy, in addition to those in
+// SpecRevision. These are generally the names of optional request parameters.
+var Features = []string{
+	"account_data_types",
+	"active_since",
+	"annotate_mentions",
+	"changes_only",
+	"coalesce_ms",
+	"coalesce_sync_ops",
+	"count_delta",
+	"embed_sender_profile",
+	"focus_room",
+	"include_create",
+	"include_directory_visibility",
+	"include_encrypted_metadata",
+	"include_indexes",
+	"include_join_rules",
+	"include_name_content",
+	"include_notification_level",
+	"include_relation_targets",
+	"include_rooms_removed",
+	"include_server_acl",
+	"include_topic",
+	"include_widgets",
+	"is_ignored_dm",
+	"is_knock",
+	"list_debug",
+	"live_event_limit",
+	"max_response_bytes",
+	"member_query",
+	"membership_changes",
+	"nonce",
+	"ops_only",
+	"quiet",
+	"required_state_delta",
+	"timeline_senders",
+	"timeline_threads",
+	"to_device_deduplicate",
+}
+
+// Capabilities describes the proxy to clients so they can feature-detect. It is returned on the
+// first response of each connection.
+type Capabilities struct {
+	SchemaVersion int    `json:"schema_version"`
+	ProxyVersion  string `json:"proxy_version"`
+	Spec          string `json:"spec"`
+	// The names of supported extensions, as used in the `extensions` request object.
+	Extensions []string `json:"extensions"`
+	// Supported features beyond those in Spec, sorted.
+	Features []string `json:"features"`
+}
+
+// NewCapabilities returns the Capabilities of this build of the proxy. enabledFeatures are any
+// configuration dependent features which are enabled e.g FeatureUntrackedRooms.
+func NewCapabilities(proxyVersion string, enabledFeatures ...string) *Capabilities {
+	features := append(append([]string{}, Features...), enabledFeatures...)
+	sort.Strings(features)
+	return &Capabilities{
+		SchemaVersion: CapabilitiesSchemaVersion,
+		ProxyVersion:  proxyVersion,
+		Spec:          SpecRevision,
+		Extensions:    extensions.Names(),
+		Features:      features,
+	}
+}
+
+// WithoutFeatures returns a copy of these capabilities which does not list these features.
+func (c *Capabilities) WithoutFeatures(features []string) *Capabilities {
+	if len(features) == 0 {
+		return c
+	}
+	excluded := make(map[string]bool, len(features))
+	for _, feature := range features {
+		excluded[feature] = true
+	}
+	without := *c
+	without.Features = make([]string, 0, len(c.Features))
+	for _, feature := range c.Features {
+		if !excluded[feature] {
+			without.Features = append(without.Features, feature)
+		}
+	}
+	return &without
+}
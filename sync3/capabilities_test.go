@@ -0,0 +1,112 @@
+package sync3
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+)
+
+func TestCapabilities(t *testing.T) {
+	caps := NewCapabilities("v1.2.3", FeatureUntrackedRooms)
+	if caps.SchemaVersion != CapabilitiesSchemaVersion || caps.ProxyVersion != "v1.2.3" || caps.Spec != SpecRevision {
+		t.Fatalf("unexpected capabilities: %+v", caps)
+	}
+	if !sort.StringsAreSorted(caps.Features) {
+		t.Fatalf("features are not sorted: %v", caps.Features)
+	}
+	hasFeature := func(c *Capabilities, feature string) bool {
+		for _, f := range c.Features {
+			if f == feature {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasFeature(caps, FeatureUntrackedRooms) {
+		t.Errorf("enabled feature %s is not advertised", FeatureUntrackedRooms)
+	}
+	if hasFeature(caps, FeatureSuggestedPollInterval) {
+		t.Errorf("disabled feature %s is advertised", FeatureSuggestedPollInterval)
+	}
+	for _, f := range Features {
+		if !hasFeature(caps, f) {
+			t.Errorf("feature %s is not advertised", f)
+		}
+	}
+	// NewCapabilities must not modify the global list of features
+	if hasFeature(NewCapabilities(""), FeatureUntrackedRooms) {
+		t.Errorf("features leaked between calls to NewCapabilities")
+	}
+
+	// every extension which can be requested is advertised, and nothing else is
+	reqJSON, err := json.Marshal(extensions.Request{})
+	if err != nil {
+		t.Fatalf("failed to marshal extensions request: %s", err)
+	}
+	var reqKeys map[string]interface{}
+	if err := json.Unmarshal(reqJSON, &reqKeys); err != nil {
+		t.Fatalf("failed to unmarshal extensions request: %s", err)
+	}
+	wantExtensions := make([]string, 0, len(reqKeys))
+	for k := range reqKeys {
+		wantExtensions = append(wantExtensions, k)
+	}
+	gotExtensions := append([]string{}, caps.Extensions...)
+	sort.Strings(wantExtensions)
+	sort.Strings(gotExtensions)
+	if !reflect.DeepEqual(gotExtensions, wantExtensions) {
+		t.Errorf("extensions: got %v want %v", gotExtensions, wantExtensions)
+	}
+}
+
+// Test that every request parameter which isn't in the original sliding sync proposal is
+// advertised, so clients can tell whether the proxy will honour it.
+func TestCapabilitiesAdvertiseRequestParams(t *testing.T) {
+	inProposal := map[string]bool{
+		"bump_event_types": true, "conn_id": true, "deleted": true, "extensions": true, "filters": true,
+		"include_heroes": true, "include_old_rooms": true, "is_dm": true, "is_encrypted": true,
+		"is_invite": true, "is_tombstoned": true, "lists": true, "not_room_types": true, "not_tags": true,
+		"ranges": true, "required_state": true, "room_name_like": true, "room_subscriptions": true,
+		"room_types": true, "slow_get_all_rooms": true, "sort": true, "spaces": true, "tags": true,
+		"timeline_limit": true, "txn_id": true, "unsubscribe_rooms": true,
+	}
+	// params which are part of a feature with a different name
+	paramToFeature := map[string]string{
+		"debug":    "list_debug",
+		"priority": "max_response_bytes",
+	}
+	features := make(map[string]bool, len(Features))
+	for _, f := range Features {
+		features[f] = true
+	}
+	var checkParams func(typ reflect.Type)
+	checkParams = func(typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Anonymous {
+				checkParams(field.Type)
+				continue
+			}
+			param, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if param == "" || param == "-" || inProposal[param] {
+				continue
+			}
+			feature := param
+			if f, ok := paramToFeature[param]; ok {
+				feature = f
+			}
+			if !features[feature] {
+				t.Errorf("%s.%s: request param %s is not advertised as a feature", typ.Name(), field.Name, param)
+			}
+		}
+	}
+	for _, typ := range []reflect.Type{
+		reflect.TypeOf(Request{}), reflect.TypeOf(RequestList{}), reflect.TypeOf(RoomSubscription{}), reflect.TypeOf(RequestFilters{}),
+	} {
+		checkParams(typ)
+	}
+}
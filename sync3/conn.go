@@ -2,13 +2,19 @@ package sync3
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // The amount of time to artificially wait if the server detects spamming clients. This time will
@@ -16,6 +22,11 @@ import (
 // /sync?pos=5 then /sync?pos=5 over and over. Likewise /sync without a ?pos=.
 var SpamProtectionInterval = 10 * time.Millisecond
 
+// The minimum time a request waits for the request before it on the same connection to finish,
+// before the client is told to retry. Requests wait for up to their timeout if it is longer. The
+// request before is cancelled, so normally finishes well within this time.
+var MinConnLockWait = time.Second
+
 type ConnID struct {
 	UserID   string
 	DeviceID string
@@ -26,13 +37,166 @@ func (c *ConnID) String() string {
 	return fmt.Sprintf("%s|%s|%s", c.UserID, c.DeviceID, c.CID)
 }
 
+// BufferLimits caps the responses a connection buffers for the client, for clients which stop
+// acknowledging responses. 0 means no limit.
+type BufferLimits struct {
+	// The maximum number of unacknowledged responses.
+	MaxResponses int
+	// The maximum approximate size in bytes of unacknowledged responses: see Response.ApproxSize.
+	// Compressed responses count as their compressed size.
+	MaxBytes int
+	// The maximum time the oldest unacknowledged response can be buffered for.
+	MaxAge time.Duration
+}
+
+// exceeded returns which limit a buffer of this size and age exceeds: "responses", "bytes" or
+// "age". Returns "" if the buffer is within the limits.
+func (l BufferLimits) exceeded(numResponses int, numBytes int64, age time.Duration) string {
+	switch {
+	case l.MaxResponses > 0 && numResponses > l.MaxResponses:
+		return "responses"
+	case l.MaxBytes > 0 && numBytes > int64(l.MaxBytes):
+		return "bytes"
+	case l.MaxAge > 0 && age > l.MaxAge:
+		return "age"
+	}
+	return ""
+}
+
+// RateLimit limits how often a connection can make requests, for clients which make requests in a
+// tight loop. Requests over the limit are rejected with M_LIMIT_EXCEEDED.
+type RateLimit struct {
+	// The average number of requests per second. 0 means no limit.
+	Rate float64
+	// The number of requests which can be made at once before the rate applies.
+	Burst int
+	// If true, requests which are answered from the buffered responses without invoking the
+	// handler are not limited, as they are cheap.
+	ExemptBuffered bool
+}
+
+// TimeoutLimits bound the long-poll timeout clients ask for. 0 means no bound.
+type TimeoutLimits struct {
+	Min time.Duration
+	Max time.Duration
+	// The timeout used when the client asks for 0 or doesn't ask for one.
+	Default time.Duration
+}
+
+// apply returns timeoutMSecs within the limits.
+func (l TimeoutLimits) apply(timeoutMSecs int) int {
+	timeout := time.Duration(timeoutMSecs) * time.Millisecond
+	if timeout <= 0 && l.Default > 0 {
+		timeout = l.Default
+	}
+	if l.Min > 0 && timeout < l.Min {
+		timeout = l.Min
+	}
+	if l.Max > 0 && timeout > l.Max {
+		timeout = l.Max
+	}
+	return int(timeout.Milliseconds())
+}
+
+// DefaultMSecs returns the timeout in milliseconds for requests which don't ask for one.
+func (l TimeoutLimits) DefaultMSecs() int {
+	if l.Default > 0 {
+		return l.apply(0)
+	}
+	return l.apply(DefaultTimeoutMSecs)
+}
+
+// RequestBranch is how Conn.OnIncomingRequest handled a request, for metrics and tests.
+type RequestBranch string
+
+const (
+	// A request without a pos, which the handler calculated a response for.
+	RequestBranchInitial RequestBranch = "initial"
+	// A request which ACKed a response, which the handler calculated a response for. If
+	// responses are still buffered, the oldest is returned before the one the handler calculated.
+	RequestBranchLive RequestBranch = "live"
+	// A request at the same pos as the last request but with different parameters, which the
+	// handler processed. Any buffered response is returned before the one the handler calculated.
+	RequestBranchChanged RequestBranch = "changed"
+	// A request the same as the last request, which is sent the response it was sent before.
+	RequestBranchRetransmit RequestBranch = "retransmit"
+	// A request with the same parameters as the last request, which is sent the oldest buffered
+	// response the client hasn't received yet without invoking the handler.
+	RequestBranchBuffered RequestBranch = "buffered"
+	// A request whose pos is unknown, which was rejected with M_UNKNOWN_POS.
+	RequestBranchUnknownPos RequestBranch = "unknown_pos"
+	// A request which was rejected by the connection's rate limit.
+	RequestBranchRateLimited RequestBranch = "rate_limited"
+	// A request which ran out of time whilst being processed, which is sent an empty response.
+	RequestBranchTimeout RequestBranch = "timeout"
+	// A request on a connection which was resumed after a restart: see ConnStore.
+	RequestBranchResumed RequestBranch = "resumed"
+	// A request whilst shutting down: see Conn.Shutdown.
+	RequestBranchShutdown RequestBranch = "shutdown"
+	// A request on a connection which the handler tore down.
+	RequestBranchTornDown RequestBranch = "torn_down"
+)
+
+// connMetrics are the metrics shared by all connections in a ConnMap.
+type connMetrics struct {
+	// time taken by Conn.OnIncomingRequest, labelled by the RequestBranch as type
+	requestDuration *prometheus.HistogramVec
+	// requests rejected because their pos is unknown
+	unknownPos prometheus.Counter
+	// the timeout of each request after applying TimeoutLimits
+	requestTimeout prometheus.Histogram
+	// the number and size of unacknowledged responses each time a response is buffered
+	unACKedResponses prometheus.Histogram
+	unACKedBytes     prometheus.Histogram
+	// connections expired for exceeding BufferLimits, labelled by the limit exceeded
+	bufferExpired *prometheus.CounterVec
+}
+
+func (m *connMetrics) observeRequest(branch RequestBranch, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.requestDuration.WithLabelValues(string(branch)).Observe(time.Since(start).Seconds())
+}
+
+func (m *connMetrics) observeTimeout(timeoutMSecs int) {
+	if m == nil {
+		return
+	}
+	m.requestTimeout.Observe((time.Duration(timeoutMSecs) * time.Millisecond).Seconds())
+}
+
+func (m *connMetrics) countUnknownPos() {
+	if m == nil {
+		return
+	}
+	m.unknownPos.Inc()
+}
+
+func (m *connMetrics) observeUnACKed(numResponses int, numBytes int64) {
+	if m == nil {
+		return
+	}
+	m.unACKedResponses.Observe(float64(numResponses))
+	m.unACKedBytes.Observe(float64(numBytes))
+}
+
+func (m *connMetrics) countBufferExpired(limit string) {
+	if m == nil {
+		return
+	}
+	m.bufferExpired.WithLabelValues(limit).Inc()
+}
+
 type ConnHandler interface {
 	// Callback which is allowed to block as long as the context is active. Return the response
 	// to send back or an error. Errors of type *internal.HandlerError are inspected for the correct
-	// status code to send back.
+	// status code to send back, and whether to tear down the connection.
 	OnIncomingRequest(ctx context.Context, cid ConnID, req *Request, isInitial bool, start time.Time) (*Response, error)
 	OnUpdate(ctx context.Context, update caches.Update)
 	PublishEventsUpTo(roomID string, nid int64)
+	// Destroy may be called more than once e.g when the connection is torn down, then again when
+	// it is removed.
 	Destroy()
 	Alive() bool
 	SetCancelCallback(cancel context.CancelFunc)
@@ -56,26 +220,223 @@ type Conn struct {
 	// - The ACKing message is always the response with the same pos as req.pos
 	// - Everything before it is old and can be deleted
 	// - Everything after that is new and unseen, and the first element is the one we want to return.
-	serverResponses []Response
+	// Writes to serverResponses and lastPos must also hold stateMu: see Snapshot.
+	serverResponses []bufferedResponse
 	lastPos         int64
+	// The total size of serverResponses, and the number of responses. These are atomic so they can
+	// be read for metrics without waiting for the request being processed.
+	bufferedBytes     atomic.Int64
+	bufferedResponses atomic.Int64
+	bufferLimits      BufferLimits
+	// if true, responses buffered behind another response are compressed
+	compressBuffered bool
+	timeoutLimits    TimeoutLimits
+	// nil if there are no callbacks
+	onPanic   func(connID ConnID, req *Request, stack []byte)
+	onRequest func(connID ConnID, req *Request, branch RequestBranch)
+	// When the last request started or finished. Guarded by mu and stateMu.
+	lastSeen time.Time
+	// when the connection was created, for ExpiryPolicy.MaxLifetime
+	created time.Time
+	// held briefly when modifying serverResponses, lastPos and lastSeen, so they can be read
+	// without waiting for mu which is held whilst long-polling
+	stateMu sync.Mutex
+	// nil if requests are not rate limited
+	limiter        *internal.TokenBucket
+	exemptBuffered bool
+	// nil if metrics are disabled
+	metrics *connMetrics
+	// true once Shutdown has been called
+	shuttingDown atomic.Bool
+	// the error which tore down the connection, if any
+	tornDown atomic.Pointer[internal.HandlerError]
+	// nil if positions are not saved. storeChecked is true once the saved position has been
+	// looked for, and savedRequest is the saved request to restore sticky parameters from until
+	// a request on the resumed connection is processed. stickyRequest is the sticky parameters
+	// of the processed requests so far, which are saved along with the journal of txn_ids.
+	// lastSaved identifies the position saveStickyParams last saved, so it is only saved again
+	// when it changes.
+	store         ConnStore
+	storeChecked  bool
+	savedRequest  *Request
+	stickyRequest *Request
+	txnIDs        []JournalledTxnID
+	lastSaved     *savedPosition
+	// held whilst saving the position. destroyed is true once the connection has been closed, after
+	// which its position is never saved again, as a request in flight when it was closed would
+	// otherwise save the position the connection was closed at.
+	saveMu    sync.Mutex
+	destroyed bool
 
 	// ensure only 1 incoming request is handled per connection
-	mu                         *sync.Mutex
+	mu                         *internal.ContextMutex
 	cancelOutstandingRequest   func()
 	cancelOutstandingRequestMu *sync.Mutex
 }
 
+// ConnOptions configure a Conn. The zero value is a connection without rate limiting or compression.
+type ConnOptions struct {
+	RateLimit RateLimit
+	// The long-poll timeout of every request is clamped to these limits before it is used.
+	TimeoutLimits TimeoutLimits
+	// If true, buffered responses are held gzip-compressed apart from the first, and only
+	// decompressed if they need to be sent again. This trades CPU for memory on connections which
+	// have buffered large responses e.g after an initial sync. Responses which have just been
+	// calculated are always sent without compressing them first.
+	CompressBufferedResponses bool
+	// If set, called with how each request was handled once it has been. For tests and debugging.
+	OnRequest func(connID ConnID, req *Request, branch RequestBranch)
+	// If set, called when the handler panics whilst handling req, after the panic is logged and
+	// reported to Sentry. The client is sent a 500 and can carry on using the connection.
+	OnPanic func(connID ConnID, req *Request, stack []byte)
+	// If set, the connection's position and buffered responses are saved after every request which
+	// calculates a response, so the client can resume the connection from its pos after the proxy
+	// restarts. The saved position is loaded when the first request on the connection has a pos.
+	Store ConnStore
+}
+
 func NewConn(connID ConnID, h ConnHandler) *Conn {
-	return &Conn{
+	return NewConnWithOptions(connID, h, ConnOptions{})
+}
+
+// NewConnWithOptions returns a connection which can limit how often the client can make requests
+// and compress the responses it buffers.
+func NewConnWithOptions(connID ConnID, h ConnHandler, opts ConnOptions) *Conn {
+	c := &Conn{
 		ConnID:                     connID,
 		handler:                    h,
-		mu:                         &sync.Mutex{},
+		lastSeen:                   time.Now(),
+		created:                    time.Now(),
+		compressBuffered:           opts.CompressBufferedResponses,
+		timeoutLimits:              opts.TimeoutLimits,
+		onPanic:                    opts.OnPanic,
+		onRequest:                  opts.OnRequest,
+		store:                      opts.Store,
+		mu:                         internal.NewContextMutex(),
 		cancelOutstandingRequestMu: &sync.Mutex{},
 	}
+	if opts.RateLimit.Rate > 0 {
+		c.limiter = internal.NewTokenBucket(opts.RateLimit.Rate, opts.RateLimit.Burst)
+		c.exemptBuffered = opts.RateLimit.ExemptBuffered
+	}
+	return c
+}
+
+// rateLimited returns an error if the client has made too many requests.
+func (c *Conn) rateLimited() *internal.HandlerError {
+	if c.limiter == nil {
+		return nil
+	}
+	retryAfter, ok := c.limiter.Allow()
+	if ok {
+		return nil
+	}
+	logger.Warn().Str("conn", c.ConnID.String()).Dur("retry_after", retryAfter).Msg("rate limiting requests")
+	return &internal.HandlerError{
+		StatusCode: http.StatusTooManyRequests,
+		Err:        fmt.Errorf("too many requests, retry in %v", retryAfter),
+		ErrCode:    "M_LIMIT_EXCEEDED",
+		RetryAfter: retryAfter,
+	}
 }
 
+// BufferedBytes returns the approximate size of the responses buffered for the client.
+func (c *Conn) BufferedBytes() int64 {
+	return c.bufferedBytes.Load()
+}
+
+// Handler returns the handler of the requests on this connection.
+func (c *Conn) Handler() ConnHandler {
+	return c.handler
+}
+
+// BufferedResponses returns the number of responses buffered for the client, including the
+// response the client is currently acknowledging.
+func (c *Conn) BufferedResponses() int {
+	return int(c.bufferedResponses.Load())
+}
+
+// Alive returns false if the connection should be removed. Torn down connections are kept until
+// they expire so requests on them keep getting the error which tore them down.
 func (c *Conn) Alive() bool {
-	return c.handler.Alive()
+	return c.tornDown.Load() != nil || c.handler.Alive()
+}
+
+// ConnSnapshot is a copy of the state of a connection, for observability.
+type ConnSnapshot struct {
+	ConnID ConnID
+	// The pos of the last response calculated for the client.
+	LastPos int64
+	// The number of responses buffered for the client, and their approximate size.
+	BufferedResponses int
+	BufferedBytes     int64
+	// When the last request on the connection started or finished, and how long ago that was.
+	LastSeen time.Time
+	Idle     time.Duration
+}
+
+// Snapshot returns a copy of the state of the connection. It doesn't wait for requests in flight
+// to finish, but is consistent with the state between the steps of a request.
+func (c *Conn) Snapshot() ConnSnapshot {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return ConnSnapshot{
+		ConnID:            c.ConnID,
+		LastPos:           c.lastPos,
+		BufferedResponses: len(c.serverResponses),
+		BufferedBytes:     c.bufferedBytes.Load(),
+		LastSeen:          c.lastSeen,
+		Idle:              time.Since(c.lastSeen),
+	}
+}
+
+// seen records that a request started or finished. Must hold mu.
+func (c *Conn) seen() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.lastSeen = time.Now()
+}
+
+// appendResponse buffers a response which is now the latest. Must hold mu.
+func (c *Conn) appendResponse(buffered bufferedResponse) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.serverResponses = append(c.serverResponses, buffered)
+	c.bufferedBytes.Add(int64(buffered.size))
+	c.bufferedResponses.Store(int64(len(c.serverResponses)))
+	c.lastPos = buffered.pos
+}
+
+// dropResponses removes the oldest n buffered responses. Must hold mu.
+func (c *Conn) dropResponses(n int) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	for _, r := range c.serverResponses[:n] {
+		c.bufferedBytes.Add(-int64(r.size))
+	}
+	c.serverResponses = c.serverResponses[n:]
+	c.bufferedResponses.Store(int64(len(c.serverResponses)))
+}
+
+// clearResponses removes every buffered response. Must hold mu.
+func (c *Conn) clearResponses() {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	c.serverResponses = nil
+	c.bufferedBytes.Store(0)
+	c.bufferedResponses.Store(0)
+}
+
+// teardown flushes the connection and makes every later request get herr. Must hold mu.
+func (c *Conn) teardown(ctx context.Context, herr *internal.HandlerError) {
+	logger.Info().Str("conn", c.ConnID.String()).Err(herr).Msg("tearing down connection")
+	c.clearResponses()
+	c.lastClientRequest = Request{}
+	c.savedRequest = nil
+	c.stickyRequest = nil
+	c.save(ctx, ConnPosition{})
+	c.handler.Destroy()
+	c.tornDown.Store(herr)
 }
 
 func (c *Conn) OnUpdate(ctx context.Context, update caches.Update) {
@@ -85,19 +446,22 @@ func (c *Conn) OnUpdate(ctx context.Context, update caches.Update) {
 // tryRequest is a wrapper around ConnHandler.OnIncomingRequest which automatically
 // starts and closes a tracing task.
 //
-// If the wrapped call panics, it is recovered from, reported to Sentry, and an error
+// If the wrapped call panics, it is recovered from, logged and reported to Sentry with the
+// connection and a summary of the request, passed to the OnPanic callback, and an error
 // is passed to the caller. If the wrapped call returns an error, that error is passed
 // upwards but will NOT be logged to Sentry (neither here nor by the caller). Errors
 // should be reported to Sentry as close as possible to the point of creating the error,
 // to provide the best possible Sentry traceback.
 func (c *Conn) tryRequest(ctx context.Context, req *Request, start time.Time) (res *Response, err error) {
-	// TODO: include useful information from the request in the sentry hub/context
-	// Might be better done in the caller though?
 	defer func() {
 		panicErr := recover()
 		if panicErr != nil {
-			err = fmt.Errorf("panic: %s", panicErr)
-			logger.Error().Msg(string(debug.Stack()))
+			stack := debug.Stack()
+			summary := req.Summary()
+			err = fmt.Errorf("panic on conn %s at pos %d: %s", c.ConnID.String(), req.pos, panicErr)
+			logger.Error().Str("conn", c.ConnID.String()).Str("user", c.UserID).Int64("pos", req.pos).Str("request", summary).
+				Interface("panic", panicErr).Msg(string(stack))
+			hub := internal.GetSentryHubFromContextOrDefault(ctx)
 			// Note: as we've captured the panicErr ourselves, there isn't much
 			// difference between RecoverWithContext and CaptureException. But
 			// there /is/ a small difference:
@@ -108,7 +472,17 @@ func (c *Conn) tryRequest(ctx context.Context, req *Request, start time.Time) (r
 			//
 			// I'm guessing that Sentry will use the former to display panicErr as
 			// having come from a panic.
-			internal.GetSentryHubFromContextOrDefault(ctx).RecoverWithContext(ctx, panicErr)
+			hub.WithScope(func(scope *sentry.Scope) {
+				scope.SetContext(internal.SentryCtxKey, map[string]any{
+					"conn":    c.ConnID.String(),
+					"pos":     req.pos,
+					"request": summary,
+				})
+				hub.RecoverWithContext(ctx, panicErr)
+			})
+			if c.onPanic != nil {
+				c.onPanic(c.ConnID, req, stack)
+			}
 		}
 	}()
 	taskType := "OnIncomingRequest"
@@ -123,7 +497,7 @@ func (c *Conn) tryRequest(ctx context.Context, req *Request, start time.Time) (r
 
 func (c *Conn) isOutstanding(pos int64) bool {
 	for _, r := range c.serverResponses {
-		if r.PosInt() == pos {
+		if r.pos == pos {
 			return true
 		}
 	}
@@ -135,23 +509,122 @@ func (c *Conn) isOutstanding(pos int64) bool {
 // client. It will NOT be reported to Sentry---this should happen as close as possible
 // to the creation of the error (or else Sentry cannot provide a meaningful traceback.)
 func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.Time) (resp *Response, herr *internal.HandlerError) {
+	received := time.Now()
+	branch := RequestBranchLive
+	if req.pos == 0 {
+		branch = RequestBranchInitial
+	}
+	defer func() {
+		c.metrics.observeRequest(branch, received)
+		if c.onRequest != nil {
+			c.onRequest(c.ConnID, req, branch)
+		}
+	}()
+	// every response returned is a copy, so this doesn't modify buffered responses
+	source := ResponseSourceHandler
+	defer func() {
+		if resp != nil {
+			resp.ServedFrom = source
+		}
+	}()
+	// the handler and the lock wait use the timeout within the limits, not what the client asked for
+	req.SetTimeoutMSecs(c.timeoutLimits.apply(req.TimeoutMSecs()))
+	c.metrics.observeTimeout(req.TimeoutMSecs())
 	ctx, span := internal.StartSpan(ctx, "OnIncomingRequest.AcquireMutex")
+	// Cancel the previous request and register this one atomically, before waiting for mu. If this
+	// were only registered once mu is held, a request arriving meanwhile would cancel the previous
+	// request again rather than this one, leaving this request to long-poll whilst it waits.
+	ctx, cancel := context.WithCancel(ctx)
 	c.cancelOutstandingRequestMu.Lock()
 	if c.cancelOutstandingRequest != nil {
 		c.cancelOutstandingRequest()
 	}
-	c.cancelOutstandingRequestMu.Unlock()
-	c.mu.Lock()
-	ctx, cancel := context.WithCancel(ctx)
-
-	c.cancelOutstandingRequestMu.Lock()
 	c.cancelOutstandingRequest = cancel
 	c.cancelOutstandingRequestMu.Unlock()
+	// don't queue behind a request which is slow to finish e.g a large initial sync for longer
+	// than the client is prepared to wait
+	lockWait := time.Duration(req.TimeoutMSecs()) * time.Millisecond
+	if lockWait < MinConnLockWait {
+		lockWait = MinConnLockWait
+	}
+	lockCtx, cancelLockWait := context.WithTimeout(ctx, lockWait)
+	lockErr := c.mu.LockContext(lockCtx)
+	cancelLockWait()
+	if lockErr != nil {
+		span.End()
+		if ctx.Err() != nil {
+			// this request was cancelled by a newer request, or the client went away
+			return nil, internal.ClientCancelledError(ctx.Err())
+		}
+		logger.Warn().Str("conn", c.ConnID.String()).Dur("waited", lockWait).Msg("timed out waiting for the previous request on the connection")
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusConflict,
+			Err:        fmt.Errorf("timed out after %v waiting for the previous request on this connection to finish, retry", lockWait),
+			ErrCode:    "M_UNKNOWN",
+		}
+	}
 	// it's intentional for the lock to be held whilst inside HandleIncomingRequest
 	// as it guarantees linearisation of data within a single connection
 	defer c.mu.Unlock()
 	span.End()
+	c.seen()
+	// deferred after the unlock so it runs first, whilst the lock is held
+	defer c.seen()
+
+	if tornDown := c.tornDown.Load(); tornDown != nil {
+		branch = RequestBranchTornDown
+		herrCopy := *tornDown
+		return nil, &herrCopy
+	}
+
+	if c.shuttingDown.Load() && req.pos == 0 {
+		branch = RequestBranchShutdown
+		return nil, shuttingDownError()
+	}
+
+	// unless buffered responses are exempt, every request counts towards the rate limit
+	if !c.exemptBuffered {
+		if herr := c.rateLimited(); herr != nil {
+			branch = RequestBranchRateLimited
+			return nil, herr
+		}
+	}
 
+	// the connection may be one we had before restarting
+	if c.store != nil && !c.storeChecked {
+		c.storeChecked = true
+		if req.pos != 0 && len(c.serverResponses) == 0 {
+			if resp, resumedFrom := c.resume(ctx, req); resp != nil {
+				branch = RequestBranchResumed
+				source = resumedFrom
+				return resp, nil
+			}
+		}
+	}
+
+	// Which branch a request takes depends on its pos and whether its body is the Same as the last
+	// request processed. txn_id and nonce are not part of the body, so never change the branch:
+	//
+	//   pos                          | body      | result
+	//   -----------------------------+-----------+------------------------------------------------
+	//   0                            | any       | processed as a new connection
+	//   unknown                      | any       | M_UNKNOWN_POS
+	//   same as last request         | same      | the buffered response is returned again
+	//   same as last request         | different | processed, the oldest unACKed response returned
+	//   ACKs, unACKed are buffered   | same      | the oldest unACKed response is returned
+	//   ACKs, unACKed are buffered   | different | processed, the oldest unACKed response returned
+	//   ACKs, nothing else buffered  | any       | processed, the new response returned
+	//
+	// Responses the handler marks NoChange are not buffered and keep the client at its pos, so
+	// sending that pos again with the same body processes the request again.
+	//
+	// A pos is ACKed if it is any buffered response, not just the oldest, as ACKs may be lost.
+	// Buffered responses before it are purged, so later requests at their pos are unknown.
+	//
+	// When a buffered response is returned because the body is the same, it has the txn_id and nonce
+	// of this request, as it reflects this request's parameters. Otherwise the response has the
+	// txn_id of the request which made it, so clients can tell when their new parameters apply.
+	// Once the connection is shutting down, requests are never processed: see Shutdown.
 	isFirstRequest := req.pos == 0
 	isRetransmit := !isFirstRequest && c.lastClientRequest.pos == req.pos
 	isSameRequest := !isFirstRequest && c.lastClientRequest.Same(req)
@@ -161,48 +634,80 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	if !isFirstRequest && !isRetransmit && !c.isOutstanding(req.pos) {
 		// the client made up a position, reject them
 		logger.Trace().Int64("pos", req.pos).Msg("unknown pos")
+		branch = RequestBranchUnknownPos
+		c.metrics.countUnknownPos()
 		return nil, internal.ExpiredSessionError()
 	}
 
 	// purge the response buffer based on the client's new position. Higher pos values are later.
-	var nextUnACKedResponse *Response
+	var nextUnACKed *bufferedResponse
 	delIndex := -1
 	for i := range c.serverResponses { // sorted so low pos are first
-		if req.pos > c.serverResponses[i].PosInt() {
+		if req.pos > c.serverResponses[i].pos {
 			// the client has advanced _beyond_ this position so it is safe to delete it, we won't
 			// see it again as a retransmit
 			delIndex = i
-		} else if req.pos < c.serverResponses[i].PosInt() {
+		} else if req.pos < c.serverResponses[i].pos {
 			// the client has not seen this response before, so we'll send it to them next no matter what.
-			nextUnACKedResponse = &c.serverResponses[i]
+			nextUnACKed = &c.serverResponses[i]
 			break
 		}
 	}
-	c.serverResponses = c.serverResponses[delIndex+1:] // slice out the first delIndex+1 elements
+	c.dropResponses(delIndex + 1)
 
 	defer func() {
 		l := logger.Trace().Int("num_res_acks", delIndex+1).Bool("is_retransmit", isRetransmit).Bool("is_first", isFirstRequest).Bool("is_same", isSameRequest).Int64("pos", req.pos).Str("user", c.UserID)
-		if nextUnACKedResponse != nil {
-			l.Int64("new_pos", nextUnACKedResponse.PosInt())
+		if nextUnACKed != nil {
+			l.Int64("new_pos", nextUnACKed.pos)
 		}
 
 		l.Msg("OnIncomingRequest finished")
 	}()
 
+	if c.shuttingDown.Load() {
+		// don't start calculating a new response: return what is buffered, else an empty response
+		// at the client's current pos so it can carry on once we are back.
+		if nextUnACKed != nil {
+			branch = RequestBranchBuffered
+			source = ResponseSourceBuffered
+			nextUnACKedResponse, herr := nextUnACKed.response()
+			if herr != nil {
+				return nil, herr
+			}
+			return withNonce(nextUnACKedResponse, req.Nonce), nil
+		}
+		branch = RequestBranchShutdown
+		source = ResponseSourceEmpty
+		return &Response{
+			Lists: map[string]ResponseList{},
+			Rooms: map[string]Room{},
+			Pos:   strconv.FormatInt(req.pos, 10),
+			Nonce: req.Nonce,
+		}, nil
+	}
+
 	if !isFirstRequest {
 		if isRetransmit {
 			// if the request bodies match up then this is a retry, else it could be the client modifying
-			// their filter params, so fallthrough
-			if isSameRequest {
+			// their filter params, so fallthrough. If nothing was buffered for this pos, the response
+			// had no changes so it is just as correct to process the request again.
+			if isSameRequest && nextUnACKed != nil {
 				// this is the 2nd+ time we've seen this request, meaning the client likely retried this
 				// request. Send the response we sent before.
 				logger.Trace().Int64("pos", req.pos).Msg("returning cached response for pos, with delay")
 				// apply a small artificial wait to protect the proxy in case this is caused by a buggy
 				// client sending the same request over and over
 				time.Sleep(SpamProtectionInterval)
-				return nextUnACKedResponse, nil
+				branch = RequestBranchRetransmit
+				source = ResponseSourceRetransmit
+				nextUnACKedResponse, herr := nextUnACKed.response()
+				if herr != nil {
+					return nil, herr
+				}
+				return forSameRequest(nextUnACKedResponse, req), nil
 			} else {
 				logger.Info().Int64("pos", req.pos).Msg("client has resent this pos with different request data")
+				branch = RequestBranchChanged
 				// we need to fallthrough to process this request as the client will not resend this request data,
 			}
 		}
@@ -210,9 +715,15 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 
 	// if the client has no new data for us but we still have buffered responses, return that rather than
 	// invoking the handler.
-	if nextUnACKedResponse != nil {
+	if nextUnACKed != nil {
 		if isSameRequest {
-			return nextUnACKedResponse, nil
+			branch = RequestBranchBuffered
+			source = ResponseSourceBuffered
+			nextUnACKedResponse, herr := nextUnACKed.response()
+			if herr != nil {
+				return nil, herr
+			}
+			return forSameRequest(nextUnACKedResponse, req), nil
 		}
 		// we have buffered responses but we cannot return it else we'll ignore the data in this request,
 		// so we need to wait for this incoming request to be processed _before_ we can return the data.
@@ -221,7 +732,46 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 		req.SetTimeoutMSecs(1)
 	}
 
-	resp, err := c.tryRequest(ctx, req, start)
+	// only requests which invoke the handler count towards the rate limit
+	if c.exemptBuffered {
+		if herr := c.rateLimited(); herr != nil {
+			branch = RequestBranchRateLimited
+			return nil, herr
+		}
+	}
+
+	handlerReq := req
+	if c.savedRequest != nil && !isFirstRequest {
+		handlerReq = withStickyParams(c.savedRequest, req)
+	}
+	resp, err := c.tryRequest(ctx, handlerReq, start)
+	if err != nil && errors.Is(err, context.Canceled) {
+		// the client went away or made a newer request, so nobody will see a response. Nothing is
+		// buffered, so the client can retry at the same pos.
+		return nil, internal.ClientCancelledError(err)
+	}
+	if err != nil && errors.Is(err, context.DeadlineExceeded) && !isFirstRequest {
+		// the request ran out of time e.g long-polling for longer than the HTTP timeout, which is
+		// the same as the long poll ending without changes. Initial requests must make progress, so
+		// that is a failure.
+		branch = RequestBranchTimeout
+		if nextUnACKed != nil {
+			source = ResponseSourceBuffered
+			nextUnACKedResponse, herr := nextUnACKed.response()
+			if herr != nil {
+				return nil, herr
+			}
+			return withNonce(nextUnACKedResponse, req.Nonce), nil
+		}
+		source = ResponseSourceEmpty
+		return &Response{
+			Lists:    map[string]ResponseList{},
+			Rooms:    map[string]Room{},
+			Pos:      strconv.FormatInt(req.pos, 10),
+			Nonce:    req.Nonce,
+			NoChange: true,
+		}, nil
+	}
 	if err != nil {
 		herr, ok := err.(*internal.HandlerError)
 		if !ok {
@@ -230,23 +780,172 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 				Err:        err,
 			}
 		}
+		if herr.TeardownConn {
+			c.teardown(ctx, herr)
+		}
 		return nil, herr
 	}
 	// assign the last client request now _after_ we have processed the request so we don't incorrectly
 	// cache errors or panics and result in getting wedged or tightlooping.
 	c.lastClientRequest = *req
+	resp.TxnID = req.TxnID
+	if resp.NoChange && !isFirstRequest && nextUnACKed == nil {
+		// there is nothing the client could lose, so don't buffer it: the client carries on from
+		// the pos it is at, which is still buffered in case it retransmits the earlier request.
+		resp.Pos = strconv.FormatInt(req.pos, 10)
+		c.journalTxnID(req.TxnID, req.pos)
+		c.saveStickyParams(ctx, isFirstRequest, handlerReq)
+		return withNonce(resp, req.Nonce), nil
+	}
 	// this position is the highest stored pos +1
 	resp.Pos = fmt.Sprintf("%d", c.lastPos+1)
-	resp.TxnID = req.TxnID
+	c.journalTxnID(req.TxnID, c.lastPos+1)
 	// buffer it
-	c.serverResponses = append(c.serverResponses, *resp)
-	c.lastPos = resp.PosInt()
-	if nextUnACKedResponse == nil {
-		nextUnACKedResponse = resp
+	c.appendResponse(c.bufferResponse(ctx, resp))
+	// the client isn't acknowledging responses, so rather than buffering them until we run out of
+	// memory make them start again. A single response is never too big or too old, else the client
+	// could never make progress.
+	numUnACKed, unACKedBytes, unACKedAge := c.unACKed(req.pos)
+	c.metrics.observeUnACKed(numUnACKed, unACKedBytes)
+	if limit := c.bufferLimits.exceeded(numUnACKed, unACKedBytes, unACKedAge); numUnACKed > 1 && limit != "" {
+		logger.Warn().Str("conn", c.ConnID.String()).Str("limit", limit).Int("responses", numUnACKed).
+			Int64("bytes", unACKedBytes).Dur("age", unACKedAge).Msg("unacknowledged responses exceeded the buffer limits, expiring connection")
+		c.metrics.countBufferExpired(limit)
+		c.clearResponses()
+		// forget the last request too, so every pos is unknown from now on
+		c.lastClientRequest = Request{}
+		c.txnIDs = nil
+		c.save(ctx, ConnPosition{})
+		return nil, &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("unacknowledged responses exceeded the %s limit, the connection must be restarted", limit),
+			ErrCode:    "M_UNKNOWN_POS",
+		}
+	}
+	c.saveStickyParams(ctx, isFirstRequest, handlerReq)
+	if nextUnACKed == nil {
+		return withNonce(resp, req.Nonce), nil
 	}
 
 	// return the oldest value
-	return nextUnACKedResponse, nil
+	source = ResponseSourceBuffered
+	nextUnACKedResponse, herr := nextUnACKed.response()
+	if herr != nil {
+		return nil, herr
+	}
+	return withNonce(nextUnACKedResponse, req.Nonce), nil
+}
+
+// bufferResponse returns the response to append to serverResponses, compressing it if it is
+// buffered behind another response. The response is kept as-is if it cannot be compressed.
+func (c *Conn) bufferResponse(ctx context.Context, resp *Response) bufferedResponse {
+	buffered := bufferedResponse{
+		pos:        resp.PosInt(),
+		res:        resp,
+		size:       resp.ApproxSize(),
+		bufferedAt: time.Now(),
+	}
+	if !c.compressBuffered || len(c.serverResponses) == 0 {
+		return buffered
+	}
+	compressed, err := compressResponse(resp)
+	if err != nil {
+		logger.Err(err).Str("conn", c.ConnID.String()).Int64("pos", buffered.pos).Msg("failed to compress buffered response")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return buffered
+	}
+	buffered.res = nil
+	buffered.compressed = compressed
+	buffered.size = len(compressed)
+	return buffered
+}
+
+// Shutdown stops the connection from calculating new responses, as the server is shutting down.
+// A request which is long-polling is cut short and returns the response it has so far, and Shutdown
+// waits for it to finish or for ctx to be done.
+//
+// Requests made after Shutdown are answered without invoking the handler. Requests at a known pos
+// get the next buffered response if there is one, else an empty response at the same pos, so
+// the client's pos stays valid and it can continue from it. Requests without a pos are rejected
+// with a 503, telling the client to retry.
+func (c *Conn) Shutdown(ctx context.Context) error {
+	c.shuttingDown.Store(true)
+	c.cancelOutstandingRequestMu.Lock()
+	if c.cancelOutstandingRequest != nil {
+		c.cancelOutstandingRequest()
+	}
+	c.cancelOutstandingRequestMu.Unlock()
+
+	// wait for the outstanding request to finish
+	if err := c.mu.LockContext(ctx); err != nil {
+		return err
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// ShutdownConns calls Shutdown on every connection at once, returning once they have all finished
+// their outstanding requests or ctx is done.
+func ShutdownConns(ctx context.Context, conns []*Conn) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(conns))
+	wg.Add(len(conns))
+	for i := range conns {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = conns[i].Shutdown(ctx)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func shuttingDownError() *internal.HandlerError {
+	return &internal.HandlerError{
+		StatusCode: http.StatusServiceUnavailable,
+		Err:        fmt.Errorf("server is shutting down"),
+		ErrCode:    "M_UNKNOWN",
+		RetryAfter: time.Second,
+	}
+}
+
+// unACKed returns the number and approximate size of buffered responses the client has not seen,
+// given the position it sent, and how long the oldest has been buffered. The response it is
+// acknowledging is kept for retransmits, but is not counted.
+func (c *Conn) unACKed(pos int64) (int, int64, time.Duration) {
+	unACKed := c.serverResponses
+	size := c.bufferedBytes.Load()
+	if len(unACKed) > 0 && unACKed[0].pos == pos {
+		size -= int64(unACKed[0].size)
+		unACKed = unACKed[1:]
+	}
+	if len(unACKed) == 0 {
+		return 0, size, 0
+	}
+	return len(unACKed), size, time.Since(unACKed[0].bufferedAt)
+}
+
+// withNonce returns a copy of the response with the nonce of the request it is being sent for. The
+// nonce is not part of the buffered response, as a buffered response may be sent for a different
+// request than the one which made it e.g on retransmits.
+func withNonce(res *Response, nonce string) *Response {
+	resCopy := *res
+	resCopy.Nonce = nonce
+	return &resCopy
+}
+
+// forSameRequest returns a copy of the buffered response for a request which is the Same as the
+// one which made it, with the txn_id and nonce of the new request. Clients may regenerate the
+// txn_id when they retry, and the response reflects the parameters of that txn_id too.
+func forSameRequest(res *Response, req *Request) *Response {
+	resCopy := withNonce(res, req.Nonce)
+	resCopy.TxnID = req.TxnID
+	return resCopy
 }
 
 func (c *Conn) SetCancelCallback(cancel context.CancelFunc) {
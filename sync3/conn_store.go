@@ -0,0 +1,304 @@
+package sync3
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// ConnPosition is the part of a connection which is saved so clients can resume it from their pos
+// after the proxy restarts.
+type ConnPosition struct {
+	// The pos of the last response sent to the client. 0 means the connection cannot be resumed.
+	LastPos int64 `json:"last_pos"`
+	// The sticky parameters of the requests the client has made.
+	LastClientRequest Request `json:"last_client_request"`
+	// The responses buffered for the client, oldest first, so a client which had not received
+	// the latest responses can be sent them after a restart.
+	Responses []SavedResponse `json:"responses,omitempty"`
+	// The txn_ids of the latest requests, oldest first, so a client which retries a request after
+	// a restart is told whether it has already been applied.
+	TxnIDs []JournalledTxnID `json:"txn_ids,omitempty"`
+}
+
+// JournalledTxnID is a request's txn_id in a ConnPosition.
+type JournalledTxnID struct {
+	TxnID string `json:"txn_id"`
+	// the pos of the first response with the request's parameters applied
+	Pos int64 `json:"pos"`
+}
+
+// the number of txn_ids kept in a ConnPosition. Clients only retry their latest requests.
+const maxJournalledTxnIDs = 20
+
+// SavedResponse is a buffered response in a ConnPosition.
+type SavedResponse struct {
+	Pos int64 `json:"pos"`
+	// the response as gzip-compressed JSON
+	Response []byte `json:"response"`
+}
+
+// ConnStore saves connection positions, e.g in Redis or Postgres. It must be safe to call from
+// multiple goroutines.
+type ConnStore interface {
+	// Save replaces the saved position of the connection.
+	Save(connID ConnID, pos ConnPosition) error
+	// Load returns the saved position of the connection, or nil if there is none.
+	Load(connID ConnID) (*ConnPosition, error)
+}
+
+// resume loads the saved position of the connection, for a connection which has not sent any
+// responses yet. If the client is acknowledging a saved response which is not the latest, the
+// saved responses are buffered again and the one after req.pos is returned. If the client is
+// acknowledging the last pos we saved, returns an empty response at the next pos, as the handler
+// state the client had before we restarted has gone. Either way, the next request is processed
+// with the sticky parameters of the saved request. Returns nil if the connection cannot be resumed
+// from req.pos.
+func (c *Conn) resume(ctx context.Context, req *Request) (*Response, ResponseSource) {
+	saved, err := c.store.Load(c.ConnID)
+	if err != nil {
+		logger.Err(err).Str("conn", c.ConnID.String()).Msg("failed to load saved connection position")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil, ""
+	}
+	if saved == nil || saved.LastPos == 0 {
+		return nil, ""
+	}
+	if req.pos != saved.LastPos {
+		return c.resumeBuffered(req, saved), ResponseSourceBuffered
+	}
+	logger.Info().Str("conn", c.ConnID.String()).Int64("pos", req.pos).Msg("resuming saved connection")
+	resp := &Response{
+		Lists: map[string]ResponseList{},
+		Rooms: map[string]Room{},
+		Pos:   strconv.FormatInt(saved.LastPos+1, 10),
+	}
+	c.txnIDs = saved.TxnIDs
+	// a retried request which was applied before the restart is reflected in the sticky parameters,
+	// so this response is for its txn_id too
+	if c.isTxnIDApplied(req.TxnID, saved.LastPos) {
+		resp.TxnID = req.TxnID
+	}
+	c.appendResponse(c.bufferResponse(ctx, resp))
+	c.lastClientRequest = *req
+	c.savedRequest = &saved.LastClientRequest
+	c.save(ctx, ConnPosition{
+		LastPos:           c.lastPos,
+		LastClientRequest: saved.LastClientRequest,
+		Responses:         c.savedResponses(ctx),
+		TxnIDs:            c.txnIDs,
+	})
+	return withNonce(resp, req.Nonce), ResponseSourceEmpty
+}
+
+// resumeBuffered buffers the saved responses from req.pos onwards again and returns the one after
+// req.pos, as the client never received it. Returns nil if req.pos is not a saved response.
+func (c *Conn) resumeBuffered(req *Request, saved *ConnPosition) *Response {
+	from := -1
+	for i, r := range saved.Responses {
+		if r.Pos == req.pos {
+			from = i
+			break
+		}
+	}
+	if from == -1 || from == len(saved.Responses)-1 {
+		return nil
+	}
+	next, herr := (&bufferedResponse{
+		pos:        saved.Responses[from+1].Pos,
+		compressed: saved.Responses[from+1].Response,
+	}).response()
+	if herr != nil {
+		return nil
+	}
+	logger.Info().Str("conn", c.ConnID.String()).Int64("pos", req.pos).Int("responses", len(saved.Responses)-from).Msg(
+		"resuming saved connection with buffered responses",
+	)
+	for _, r := range saved.Responses[from:] {
+		c.appendResponse(bufferedResponse{
+			pos:        r.Pos,
+			compressed: r.Response,
+			size:       len(r.Response),
+			bufferedAt: time.Now(),
+		})
+	}
+	c.lastClientRequest = *req
+	c.savedRequest = &saved.LastClientRequest
+	c.txnIDs = saved.TxnIDs
+	if c.isTxnIDApplied(req.TxnID, next.PosInt()) {
+		next.TxnID = req.TxnID
+	}
+	return withNonce(next, req.Nonce)
+}
+
+// journalTxnID remembers that the parameters of the request with this txn_id apply from the
+// response at pos onwards. Must hold mu.
+func (c *Conn) journalTxnID(txnID string, pos int64) {
+	if txnID == "" || c.store == nil || c.isTxnIDApplied(txnID, pos) {
+		return
+	}
+	c.txnIDs = append(c.txnIDs, JournalledTxnID{TxnID: txnID, Pos: pos})
+	if len(c.txnIDs) > maxJournalledTxnIDs {
+		c.txnIDs = c.txnIDs[len(c.txnIDs)-maxJournalledTxnIDs:]
+	}
+}
+
+// isTxnIDApplied returns true if the request with this txn_id was applied in the response at pos or
+// an earlier one. Must hold mu.
+func (c *Conn) isTxnIDApplied(txnID string, pos int64) bool {
+	if txnID == "" {
+		return false
+	}
+	for _, journalled := range c.txnIDs {
+		if journalled.TxnID == txnID && journalled.Pos <= pos {
+			return true
+		}
+	}
+	return false
+}
+
+// save saves the position of the connection, if it has a store and has not been destroyed.
+func (c *Conn) save(ctx context.Context, pos ConnPosition) {
+	if c.store == nil {
+		return
+	}
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	if c.destroyed {
+		return
+	}
+	c.storePosition(ctx, pos)
+}
+
+// destroy stops the connection saving its position. It doesn't need mu, so the connection can be
+// destroyed whilst a request is in flight. If forget is true, the saved position is cleared so the
+// connection cannot be resumed.
+func (c *Conn) destroy(ctx context.Context, forget bool) {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	c.destroyed = true
+	if forget && c.store != nil {
+		c.storePosition(ctx, ConnPosition{})
+	}
+}
+
+// storePosition writes pos to the store. Must hold saveMu.
+func (c *Conn) storePosition(ctx context.Context, pos ConnPosition) {
+	if err := c.store.Save(c.ConnID, pos); err != nil {
+		logger.Err(err).Str("conn", c.ConnID.String()).Msg("failed to save connection position")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	}
+}
+
+// saveStickyParams saves the connection's position with the sticky parameters of handlerReq, the
+// request the handler has just processed. Must hold mu.
+func (c *Conn) saveStickyParams(ctx context.Context, isFirstRequest bool, handlerReq *Request) {
+	if c.store == nil {
+		return
+	}
+	base := c.stickyRequest
+	if isFirstRequest || c.savedRequest != nil {
+		// handlerReq already has all the sticky parameters
+		base = nil
+	}
+	c.savedRequest = nil
+	c.stickyRequest = mergeStickyParams(base, handlerReq)
+	pos := c.savedPosition()
+	if c.lastSaved != nil && *c.lastSaved == pos {
+		// most requests long-poll without changing anything, so don't write the same position again
+		return
+	}
+	c.lastSaved = &pos
+	c.save(ctx, ConnPosition{
+		LastPos:           c.lastPos,
+		LastClientRequest: *c.stickyRequest,
+		Responses:         c.savedResponses(ctx),
+		TxnIDs:            c.txnIDs,
+	})
+}
+
+// savedPosition identifies a saved ConnPosition without the responses themselves, which don't
+// change once they are buffered.
+type savedPosition struct {
+	lastPos int64
+	// the pos of the oldest buffered response, which changes as the client ACKs responses
+	firstPos int64
+	// the sticky parameters as JSON
+	stickyRequest string
+	numTxnIDs     int
+	lastTxnID     JournalledTxnID
+}
+
+// savedPosition returns what would be saved for the connection now. Must hold mu.
+func (c *Conn) savedPosition() savedPosition {
+	pos := savedPosition{
+		lastPos:   c.lastPos,
+		numTxnIDs: len(c.txnIDs),
+	}
+	if len(c.serverResponses) > 0 {
+		pos.firstPos = c.serverResponses[0].pos
+	}
+	if len(c.txnIDs) > 0 {
+		pos.lastTxnID = c.txnIDs[len(c.txnIDs)-1]
+	}
+	if data, err := json.Marshal(c.stickyRequest); err == nil {
+		pos.stickyRequest = string(data)
+	}
+	return pos
+}
+
+// savedResponses returns the buffered responses to save with the connection's position. Responses
+// are compressed the first time they are saved, and kept compressed alongside the response so
+// later saves use the same bytes. If a response cannot be compressed, it and the responses after it
+// are not saved, so a client which has not received them cannot resume after a restart. Must hold mu.
+func (c *Conn) savedResponses(ctx context.Context) []SavedResponse {
+	saved := make([]SavedResponse, 0, len(c.serverResponses))
+	for i := range c.serverResponses {
+		r := &c.serverResponses[i]
+		if r.compressed == nil {
+			compressed, err := compressResponse(r.res)
+			if err != nil {
+				logger.Err(err).Str("conn", c.ConnID.String()).Int64("pos", r.pos).Msg("failed to compress buffered response, not saving it")
+				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+				return saved
+			}
+			c.stateMu.Lock()
+			r.compressed = compressed
+			c.stateMu.Unlock()
+		}
+		saved = append(saved, SavedResponse{Pos: r.pos, Response: r.compressed})
+	}
+	return saved
+}
+
+// mergeStickyParams returns a copy of req applied on top of the sticky parameters in base, which
+// may be nil. req is copied as the handler keeps per-connection state in extension requests,
+// which must not be shared with the saved request.
+func mergeStickyParams(base *Request, req *Request) *Request {
+	data, err := json.Marshal(req)
+	if err != nil {
+		logger.Err(err).Msg("failed to copy request, not saving sticky parameters")
+		return base
+	}
+	var reqCopy Request
+	if err = json.Unmarshal(data, &reqCopy); err != nil {
+		logger.Err(err).Msg("failed to copy request, not saving sticky parameters")
+		return base
+	}
+	merged, _ := base.ApplyDelta(&reqCopy)
+	return merged
+}
+
+// withStickyParams returns req with the sticky parameters of saved applied underneath it, for the
+// first request processed on a resumed connection.
+func withStickyParams(saved *Request, req *Request) *Request {
+	merged, _ := saved.ApplyDelta(req)
+	merged.TxnID = req.TxnID
+	merged.Nonce = req.Nonce
+	merged.pos = req.pos
+	merged.timeoutMSecs = req.timeoutMSecs
+	return merged
+}
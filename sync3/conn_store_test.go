@@ -0,0 +1,312 @@
+package sync3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryConnStore is a ConnStore which JSON encodes positions like a real store would.
+type memoryConnStore struct {
+	mu        sync.Mutex
+	positions map[ConnID][]byte
+}
+
+func (s *memoryConnStore) Save(connID ConnID, pos ConnPosition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	if s.positions == nil {
+		s.positions = make(map[ConnID][]byte)
+	}
+	s.positions[connID] = data
+	return nil
+}
+
+func (s *memoryConnStore) Load(connID ConnID) (*ConnPosition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.positions[connID]
+	if !ok {
+		return nil, nil
+	}
+	var pos ConnPosition
+	if err := json.Unmarshal(data, &pos); err != nil {
+		return nil, err
+	}
+	return &pos, nil
+}
+
+func TestConnResumeAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{UserID: "@alice:localhost", DeviceID: "d", CID: "room-list"}
+	store := &memoryConnStore{}
+	var handled []*Request
+	newConn := func() *Conn {
+		handled = nil
+		return NewConnWithOptions(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+			handled = append(handled, req)
+			return &Response{Lists: map[string]ResponseList{"a": {Count: len(handled)}}}, nil
+		}}, ConnOptions{Store: store})
+	}
+	lists := map[string]RequestList{
+		"a": {Ranges: SliceRanges{{0, 10}}, Sort: []string{SortByName}},
+	}
+
+	c := newConn()
+	resp, herr := c.OnIncomingRequest(ctx, &Request{pos: 0, Lists: lists}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 1)
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 2)
+	saved, _ := store.Load(connID)
+	if saved == nil || saved.LastPos != 2 {
+		t.Fatalf("got saved position %+v, want last pos 2", saved)
+	}
+
+	// after a restart, the client can't resume from a response it was never sent
+	c = newConn()
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: 3}, time.Now())
+	if herr == nil || herr.ErrCode != "M_UNKNOWN_POS" {
+		t.Fatalf("got error %v, want M_UNKNOWN_POS", herr)
+	}
+
+	// but is sent the response it never received again
+	c = newConn()
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 2)
+	if resp.Lists["a"].Count != 2 {
+		t.Fatalf("got response %+v, want the saved response for pos 2", resp)
+	}
+
+	// but can resume from the last response it received
+	c = newConn()
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 2, Nonce: "n"}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 3)
+	if len(resp.Lists) != 0 || len(resp.Rooms) != 0 || resp.Nonce != "n" {
+		t.Fatalf("got response %+v, want an empty response", resp)
+	}
+	assertInt(t, len(handled), 0)
+	// retransmits get the same response
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 2, Nonce: "n"}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 3)
+	assertInt(t, len(handled), 0)
+	saved, _ = store.Load(connID)
+	if saved == nil || saved.LastPos != 3 {
+		t.Fatalf("got saved position %+v, want last pos 3", saved)
+	}
+
+	// the next request is processed with the sticky parameters from before the restart
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 3, TxnID: "txn"}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 4)
+	if resp.TxnID != "txn" {
+		t.Errorf("got txn_id %q want txn", resp.TxnID)
+	}
+	assertInt(t, len(handled), 1)
+	got := handled[0]
+	if !reflect.DeepEqual(got.Lists["a"].Ranges, lists["a"].Ranges) || !reflect.DeepEqual(got.Lists["a"].Sort, lists["a"].Sort) {
+		t.Errorf("sticky parameters were not restored: got lists %+v", got.Lists)
+	}
+	if got.TxnID != "txn" || got.pos != 3 {
+		t.Errorf("got txn_id %q pos %d, want txn 3", got.TxnID, got.pos)
+	}
+
+	// a new connection with the same ID discards the saved position
+	c = newConn()
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 1)
+	if got := handled[0]; got.Lists != nil {
+		t.Errorf("new connection was given the saved sticky parameters: %+v", got.Lists)
+	}
+}
+
+// Test that a client which had not received the latest responses is sent them after a restart.
+func TestConnResumeBufferedResponses(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{UserID: "@alice:localhost", DeviceID: "d"}
+	store := &memoryConnStore{}
+	calls := 0
+	newConn := func() *Conn {
+		return NewConnWithOptions(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+			calls++
+			return &Response{Lists: map[string]ResponseList{"a": {Count: calls}}}, nil
+		}}, ConnOptions{Store: store})
+	}
+	c := newConn()
+	_, herr := c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+	// changing the request without ACKing buffers pos 2 and 3 behind pos 1
+	for i, name := range []string{"a", "b"} {
+		_, herr = c.OnIncomingRequest(ctx, &Request{pos: 1, TxnID: name, UnsubscribeRooms: []string{name}}, time.Now())
+		assertNoError(t, herr)
+		assertInt(t, c.BufferedResponses(), i+2)
+	}
+	saved, _ := store.Load(connID)
+	if saved == nil || len(saved.Responses) != 3 {
+		t.Fatalf("got saved position %+v, want 3 saved responses", saved)
+	}
+
+	c = newConn()
+	calls = 10
+	resp, herr := c.OnIncomingRequest(ctx, &Request{pos: 1, Nonce: "n"}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 2)
+	if resp.Lists["a"].Count != 2 || resp.TxnID != "a" || resp.Nonce != "n" || resp.ServedFrom != ResponseSourceBuffered {
+		t.Errorf("got response %+v, want the saved response for pos 2", resp)
+	}
+	assertInt(t, c.BufferedResponses(), 3)
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 2}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 3)
+	if resp.Lists["a"].Count != 3 {
+		t.Errorf("got response %+v, want the saved response for pos 3", resp)
+	}
+	assertInt(t, calls, 10)
+	// ACKing the last saved response calculates a new one
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 3}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 4)
+	if resp.Lists["a"].Count != 11 {
+		t.Errorf("got response %+v, want a new response", resp)
+	}
+}
+
+type countingConnStore struct {
+	memoryConnStore
+	saves int
+}
+
+func (s *countingConnStore) Save(connID ConnID, pos ConnPosition) error {
+	s.saves++
+	return s.memoryConnStore.Save(connID, pos)
+}
+
+// Test that the position is only saved again when it changes, and that buffered responses are only
+// compressed once.
+func TestConnSavesChangedPositions(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{UserID: "@alice:localhost", DeviceID: "d"}
+	store := &countingConnStore{}
+	c := NewConnWithOptions(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		return &Response{NoChange: !isInitial}, nil
+	}}, ConnOptions{Store: store})
+	_, herr := c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+	assertInt(t, store.saves, 1)
+	saved, _ := store.Load(connID)
+	compressed := c.serverResponses[0].compressed
+	if compressed == nil || !reflect.DeepEqual(saved.Responses[0].Response, compressed) {
+		t.Fatalf("saved response was not kept compressed")
+	}
+
+	// long-polling without any changes doesn't save the same position again
+	for i := 0; i < 3; i++ {
+		_, herr = c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+		assertNoError(t, herr)
+	}
+	assertInt(t, store.saves, 1)
+
+	// changing the sticky parameters saves them, without compressing the response again
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: 1, Lists: map[string]RequestList{"a": {Ranges: SliceRanges{{0, 5}}}}}, time.Now())
+	assertNoError(t, herr)
+	assertInt(t, store.saves, 2)
+	saved, _ = store.Load(connID)
+	if saved == nil || saved.LastPos != 1 || saved.LastClientRequest.Lists["a"].Ranges == nil {
+		t.Fatalf("got saved position %+v, want pos 1 and the list", saved)
+	}
+	if &c.serverResponses[0].compressed[0] != &compressed[0] {
+		t.Fatalf("response was compressed again")
+	}
+}
+
+func TestConnResumeExpired(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{UserID: "@alice:localhost", DeviceID: "d"}
+	store := &memoryConnStore{}
+	c := NewConnWithOptions(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		return &Response{}, nil
+	}}, ConnOptions{Store: store})
+	c.bufferLimits = BufferLimits{MaxResponses: 1}
+	_, herr := c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+	// keep changing the request without acknowledging responses until the connection expires
+	for _, name := range []string{"a", "b"} {
+		_, herr = c.OnIncomingRequest(ctx, &Request{pos: 1, UnsubscribeRooms: []string{name}}, time.Now())
+	}
+	if herr == nil || herr.ErrCode != "M_UNKNOWN_POS" {
+		t.Fatalf("got error %v, want M_UNKNOWN_POS", herr)
+	}
+	// an expired connection cannot be resumed after a restart either
+	c = NewConnWithOptions(connID, c.handler, ConnOptions{Store: store})
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: 2}, time.Now())
+	if herr == nil || herr.ErrCode != "M_UNKNOWN_POS" {
+		t.Fatalf("got error %v, want M_UNKNOWN_POS", herr)
+	}
+}
+
+// Test that a client which retries a request after a restart is sent its txn_id if the request was
+// applied before the restart, and not if it wasn't.
+func TestConnResumeTxnIDs(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{UserID: "@alice:localhost", DeviceID: "d"}
+	store := &memoryConnStore{}
+	newConn := func() *Conn {
+		return NewConnWithOptions(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+			// changing the room subscriptions doesn't change the response
+			return &Response{NoChange: !isInitial}, nil
+		}}, ConnOptions{Store: store})
+	}
+	c := newConn()
+	_, herr := c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+	resp, herr := c.OnIncomingRequest(ctx, &Request{pos: 1, TxnID: "unsub", UnsubscribeRooms: []string{"!a"}}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 1)
+	if resp.TxnID != "unsub" {
+		t.Fatalf("got txn_id %q want unsub", resp.TxnID)
+	}
+
+	// the client never received the response, so retries the request after a restart
+	c = newConn()
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 1, TxnID: "unsub", UnsubscribeRooms: []string{"!a"}}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 2)
+	if resp.TxnID != "unsub" {
+		t.Fatalf("got txn_id %q want unsub", resp.TxnID)
+	}
+
+	// a request which was never applied doesn't get its txn_id
+	c = newConn()
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 2, TxnID: "sub", UnsubscribeRooms: []string{"!b"}}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 3)
+	if resp.TxnID != "" {
+		t.Fatalf("got txn_id %q want none", resp.TxnID)
+	}
+
+	// only the latest txn_ids are kept
+	for i := 0; i < maxJournalledTxnIDs+5; i++ {
+		_, herr = c.OnIncomingRequest(ctx, &Request{pos: 3, TxnID: fmt.Sprintf("txn%d", i), UnsubscribeRooms: []string{fmt.Sprintf("!%d", i)}}, time.Now())
+		assertNoError(t, herr)
+	}
+	saved, _ := store.Load(connID)
+	if saved == nil || len(saved.TxnIDs) != maxJournalledTxnIDs {
+		t.Fatalf("got saved position %+v, want %d txn_ids", saved, maxJournalledTxnIDs)
+	}
+	if got, want := saved.TxnIDs[len(saved.TxnIDs)-1].TxnID, fmt.Sprintf("txn%d", maxJournalledTxnIDs+4); got != want {
+		t.Fatalf("got latest txn_id %q want %q", got, want)
+	}
+}
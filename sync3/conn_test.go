@@ -2,8 +2,12 @@ package sync3
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -136,6 +140,91 @@ func TestConnBlocking(t *testing.T) {
 
 }
 
+// Test that a new request cancels the outstanding request, including when the outstanding request
+// is still waiting for the request before it to finish.
+func TestConnCancelsOutstandingRequest(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	cancelled := make(map[string]bool)
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
+		name := req.Lists["a"].Sort[0]
+		if name == "third" {
+			return &Response{}, nil
+		}
+		if name == "first" {
+			close(started)
+		}
+		// long-poll until cancelled
+		var wasCancelled bool
+		select {
+		case <-ctx.Done():
+			wasCancelled = true
+		case <-time.After(time.Second):
+		}
+		mu.Lock()
+		cancelled[name] = wasCancelled
+		mu.Unlock()
+		if name == "first" {
+			// keep the second request waiting for the lock
+			<-release
+		}
+		return &Response{}, nil
+	}})
+	request := func(name string) *Request {
+		return &Request{
+			Lists: map[string]RequestList{
+				"a": {
+					Sort: []string{name},
+				},
+			},
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		c.OnIncomingRequest(ctx, request("first"), time.Now())
+	}()
+	<-started
+	var secondErr *internal.HandlerError
+	go func() {
+		defer wg.Done()
+		_, secondErr = c.OnIncomingRequest(ctx, request("second"), time.Now())
+	}()
+	// wait for the second request to cancel the first
+	for {
+		mu.Lock()
+		_, done := cancelled["first"]
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the third request arrives whilst the second is waiting for the first to finish
+	go func() {
+		defer wg.Done()
+		c.OnIncomingRequest(ctx, request("third"), time.Now())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if !cancelled["first"] {
+		t.Errorf("first request was not cancelled")
+	}
+	// the second request was cancelled whilst waiting for the lock, so never reaches the handler
+	if _, invoked := cancelled["second"]; invoked || secondErr == nil {
+		t.Errorf("second request was not cancelled: invoked handler=%v err=%v", invoked, secondErr)
+	}
+}
+
 func TestConnRetries(t *testing.T) {
 	ctx := context.Background()
 	connID := ConnID{
@@ -179,6 +268,112 @@ func TestConnRetries(t *testing.T) {
 	assertNoError(t, err)
 }
 
+// Test that requests which only differ by txn_id are retransmits, and get the buffered response
+// with their own txn_id.
+func TestConnRetransmitWithNewTxnID(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	numCalls := 0
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		numCalls++
+		return &Response{
+			Lists: map[string]ResponseList{"a": {Count: numCalls}},
+		}, nil
+	}})
+	request := func(pos int64, txnID, sort string) *Request {
+		return &Request{
+			pos:   pos,
+			TxnID: txnID,
+			Lists: map[string]RequestList{
+				"a": {Sort: []string{sort}},
+			},
+		}
+	}
+	assertResponse := func(res *Response, herr *internal.HandlerError, pos int, txnID string, count int) {
+		t.Helper()
+		assertNoError(t, herr)
+		assertPos(t, res.Pos, pos)
+		if res.TxnID != txnID {
+			t.Errorf("got txn_id %q want %q", res.TxnID, txnID)
+		}
+		assertInt(t, res.Lists["a"].Count, count)
+	}
+	res, herr := c.OnIncomingRequest(ctx, request(0, "a", "by_name"), time.Now())
+	assertResponse(res, herr, 1, "a", 1)
+	res, herr = c.OnIncomingRequest(ctx, request(1, "b", "by_name"), time.Now())
+	assertResponse(res, herr, 2, "b", 2)
+
+	// retrying with the same body and a new txn_id returns the buffered response with the new txn_id
+	res, herr = c.OnIncomingRequest(ctx, request(1, "c", "by_name"), time.Now())
+	assertResponse(res, herr, 2, "c", 2)
+	assertInt(t, numCalls, 2)
+
+	// retrying with a different body processes the request, but returns the oldest response which
+	// was made for the earlier parameters, so it keeps its txn_id
+	res, herr = c.OnIncomingRequest(ctx, request(1, "d", "by_recency"), time.Now())
+	assertResponse(res, herr, 2, "b", 2)
+	assertInt(t, numCalls, 3)
+
+	// the response for the new parameters is sent next, and can be given a new txn_id as well
+	res, herr = c.OnIncomingRequest(ctx, request(2, "e", "by_recency"), time.Now())
+	assertResponse(res, herr, 3, "e", 3)
+	assertInt(t, numCalls, 3)
+}
+
+// Test that responses record how they were served, without sending it to clients.
+func TestConnServedFrom(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		return &Response{}, nil
+	}})
+	request := func(pos int64, sort string) *Request {
+		return &Request{
+			pos: pos,
+			Lists: map[string]RequestList{
+				"a": {Sort: []string{sort}},
+			},
+		}
+	}
+	testCases := []struct {
+		name string
+		req  *Request
+		want ResponseSource
+	}{
+		{name: "initial", req: request(0, "by_name"), want: ResponseSourceHandler},
+		{name: "live", req: request(1, "by_name"), want: ResponseSourceHandler},
+		{name: "retransmit", req: request(1, "by_name"), want: ResponseSourceRetransmit},
+		// the new parameters are processed, but the response for the old ones is sent first
+		{name: "changed params", req: request(1, "by_recency"), want: ResponseSourceBuffered},
+		{name: "buffered", req: request(2, "by_recency"), want: ResponseSourceBuffered},
+		{name: "acked", req: request(3, "by_recency"), want: ResponseSourceHandler},
+	}
+	for _, tc := range testCases {
+		res, herr := c.OnIncomingRequest(ctx, tc.req, time.Now())
+		assertNoError(t, herr)
+		if res.ServedFrom != tc.want {
+			t.Errorf("%s: got served from %q want %q", tc.name, res.ServedFrom, tc.want)
+		}
+	}
+	// buffered responses are not modified
+	for _, buffered := range c.serverResponses {
+		if buffered.res != nil && buffered.res.ServedFrom != "" {
+			t.Errorf("buffered response for pos %d was modified: served from %q", buffered.pos, buffered.res.ServedFrom)
+		}
+	}
+	data, err := json.Marshal(&Response{ServedFrom: ResponseSourceBuffered})
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if strings.Contains(string(data), string(ResponseSourceBuffered)) {
+		t.Errorf("served from was sent to the client: %s", data)
+	}
+}
+
 func TestConnBufferRes(t *testing.T) {
 	ctx := context.Background()
 	connID := ConnID{
@@ -218,6 +413,127 @@ func TestConnBufferRes(t *testing.T) {
 	assertInt(t, callCount, 3)
 }
 
+// Test that a panicking handler returns a 500 with the connection and request reported to the
+// panic callback, and the connection can still be used.
+func TestConnHandlerPanic(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		UserID:   "@alice:localhost",
+		DeviceID: "d",
+	}
+	shouldPanic := false
+	var panicConnID ConnID
+	var panicReq *Request
+	var panicStack []byte
+	c := NewConnWithOptions(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		if shouldPanic {
+			panic("oh no")
+		}
+		return &Response{}, nil
+	}}, ConnOptions{OnPanic: func(connID ConnID, req *Request, stack []byte) {
+		panicConnID = connID
+		panicReq = req
+		panicStack = stack
+	}})
+	_, herr := c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+
+	shouldPanic = true
+	request := &Request{pos: 1, RoomSubscriptions: map[string]RoomSubscription{"!secret:localhost": {TimelineLimit: 1}}}
+	_, herr = c.OnIncomingRequest(ctx, request, time.Now())
+	if herr == nil || herr.StatusCode != 500 {
+		t.Fatalf("got error %v, want a 500", herr)
+	}
+	if !strings.Contains(herr.Error(), connID.String()) || !strings.Contains(herr.Error(), "oh no") {
+		t.Errorf("error does not say which connection panicked: %s", herr)
+	}
+	if panicConnID != connID || panicReq != request || len(panicStack) == 0 {
+		t.Errorf("OnPanic got conn %v request %v and %d bytes of stack", panicConnID, panicReq, len(panicStack))
+	}
+	if summary := panicReq.Summary(); !strings.Contains(summary, "room_subscriptions=1") || strings.Contains(summary, "!secret") {
+		t.Errorf("request summary is not redacted: %s", summary)
+	}
+
+	// the connection isn't wedged
+	shouldPanic = false
+	resp, herr := c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 2)
+}
+
+// Test that requests the client cancels are not errors, and don't buffer a response.
+func TestConnClientCancelled(t *testing.T) {
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	callCount := 0
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		callCount++
+		if req.pos == 1 && callCount == 2 {
+			<-ctx.Done()
+			return nil, fmt.Errorf("long poll stopped: %w", ctx.Err())
+		}
+		return &Response{Lists: map[string]ResponseList{"a": {Count: callCount}}}, nil
+	}})
+	_, herr := c.OnIncomingRequest(context.Background(), &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	if herr == nil || herr.StatusCode != internal.StatusClientClosedRequest {
+		t.Fatalf("got error %v, want %d", herr, internal.StatusClientClosedRequest)
+	}
+	assertInt(t, c.BufferedResponses(), 1)
+
+	// the client can retry at the same pos
+	resp, herr := c.OnIncomingRequest(context.Background(), &Request{pos: 1}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 2)
+	assertInt(t, resp.Lists["a"].Count, 3)
+}
+
+// Test that requests which run out of time are answered like a long poll without changes.
+func TestConnDeadlineExceeded(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	callCount := 0
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		callCount++
+		if len(req.UnsubscribeRooms) > 0 {
+			return nil, fmt.Errorf("long poll stopped: %w", context.DeadlineExceeded)
+		}
+		return &Response{Lists: map[string]ResponseList{"a": {Count: callCount}}}, nil
+	}})
+	// a timed out initial request is a failure, as the client has no pos to carry on from
+	_, herr := c.OnIncomingRequest(ctx, &Request{pos: 0, UnsubscribeRooms: []string{"!a"}}, time.Now())
+	if herr == nil || herr.StatusCode != 500 {
+		t.Fatalf("got error %v for initial request, want a 500", herr)
+	}
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+
+	resp, herr := c.OnIncomingRequest(ctx, &Request{pos: 1, UnsubscribeRooms: []string{"!a"}, Nonce: "n"}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 1)
+	if len(resp.Lists) != 0 || resp.ServedFrom != ResponseSourceEmpty || resp.Nonce != "n" {
+		t.Errorf("got response %+v, want an empty response", resp)
+	}
+	assertInt(t, c.BufferedResponses(), 1)
+
+	// if a response is buffered, it is sent rather than an empty one
+	sent, herr := c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, sent.Pos, 2)
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 1, UnsubscribeRooms: []string{"!a"}}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 2)
+	assertInt(t, resp.Lists["a"].Count, sent.Lists["a"].Count)
+	assertInt(t, c.BufferedResponses(), 2)
+}
+
 func TestConnErrors(t *testing.T) {
 	ctx := context.Background()
 	connID := ConnID{
@@ -373,6 +689,278 @@ func TestConnBufferRememberInflight(t *testing.T) {
 	}
 }
 
+// Test that a client can ACK any buffered response, not just the oldest, e.g because it received a
+// later response but the ACK for the oldest was lost. Positions before the ACKed one are purged.
+func TestConnAckMiddleBufferedResponse(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	callCount := 0
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
+		callCount += 1
+		return &Response{Lists: map[string]ResponseList{
+			"a": {
+				Count: callCount,
+			},
+		}}, nil
+	}})
+	_, err := c.OnIncomingRequest(ctx, &Request{}, time.Now())
+	assertNoError(t, err)
+	// change params without ACKing to buffer responses for pos 2, 3 and 4
+	for _, roomID := range []string{"a", "b", "c"} {
+		resp, err := c.OnIncomingRequest(ctx, &Request{pos: 1, UnsubscribeRooms: []string{roomID}}, time.Now())
+		assertNoError(t, err)
+		assertPos(t, resp.Pos, 2)
+	}
+	assertInt(t, c.BufferedResponses(), 4)
+
+	steps := []struct {
+		name          string
+		pos           int64
+		wantErr       bool
+		wantResPos    int
+		wantCallCount int
+	}{
+		{name: "ACK middle buffered response", pos: 3, wantResPos: 4, wantCallCount: 4},
+		{name: "ACK purged response", pos: 2, wantErr: true, wantCallCount: 4},
+		{name: "ACK pos never sent", pos: 9, wantErr: true, wantCallCount: 4},
+		{name: "retransmit of middle ACK", pos: 3, wantResPos: 4, wantCallCount: 4},
+		{name: "ACK latest buffered response", pos: 4, wantResPos: 5, wantCallCount: 5},
+	}
+	for _, step := range steps {
+		resp, herr := c.OnIncomingRequest(ctx, &Request{pos: step.pos, UnsubscribeRooms: []string{"c"}}, time.Now())
+		if step.wantErr {
+			if herr == nil || herr.ErrCode != "M_UNKNOWN_POS" {
+				t.Fatalf("%s: got error %v, want M_UNKNOWN_POS", step.name, herr)
+			}
+		} else {
+			assertNoError(t, herr)
+			assertPos(t, resp.Pos, step.wantResPos)
+		}
+		assertInt(t, callCount, step.wantCallCount)
+	}
+}
+
+// Test that responses with no changes are not buffered and keep the client at its pos, so idle
+// connections don't fill their buffer.
+func TestConnNoChangeResponses(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	callCount := 0
+	hasData := false
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
+		callCount++
+		return &Response{
+			Lists:    map[string]ResponseList{"a": {Count: callCount}},
+			NoChange: !init && !hasData,
+		}, nil
+	}})
+	steps := []struct {
+		name          string
+		pos           int64
+		txnID         string
+		hasData       bool
+		wantResPos    int
+		wantCount     int
+		wantBuffered  int
+		wantCallCount int
+	}{
+		// the first response is always buffered, so the client has a pos
+		{name: "initial", pos: 0, wantResPos: 1, wantCount: 1, wantBuffered: 1, wantCallCount: 1},
+		{name: "no change", pos: 1, txnID: "a", wantResPos: 1, wantCount: 2, wantBuffered: 1, wantCallCount: 2},
+		{name: "no change again", pos: 1, wantResPos: 1, wantCount: 3, wantBuffered: 1, wantCallCount: 3},
+		{name: "changes", pos: 1, hasData: true, wantResPos: 2, wantCount: 4, wantBuffered: 2, wantCallCount: 4},
+		// a retransmit of a request which had changes still gets the buffered response
+		{name: "retransmit", pos: 1, wantResPos: 2, wantCount: 4, wantBuffered: 2, wantCallCount: 4},
+		{name: "ACK then no change", pos: 2, wantResPos: 2, wantCount: 5, wantBuffered: 1, wantCallCount: 5},
+	}
+	for _, step := range steps {
+		hasData = step.hasData
+		resp, herr := c.OnIncomingRequest(ctx, &Request{pos: step.pos, TxnID: step.txnID}, time.Now())
+		assertNoError(t, herr)
+		assertPos(t, resp.Pos, step.wantResPos)
+		assertInt(t, resp.Lists["a"].Count, step.wantCount)
+		if resp.TxnID != step.txnID {
+			t.Errorf("%s: got txn_id %q want %q", step.name, resp.TxnID, step.txnID)
+		}
+		assertInt(t, c.BufferedResponses(), step.wantBuffered)
+		assertInt(t, callCount, step.wantCallCount)
+	}
+}
+
+// Test which branch each request in a sequence takes, and the buffer afterwards. Add steps here
+// when changing how OnIncomingRequest handles positions.
+func TestConnStateMachine(t *testing.T) {
+	ctx := context.Background()
+	callCount := 0
+	var gotBranch RequestBranch
+	c := NewConnWithOptions(ConnID{DeviceID: "d"}, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		callCount++
+		return &Response{Lists: map[string]ResponseList{"a": {Count: callCount}}}, nil
+	}}, ConnOptions{OnRequest: func(connID ConnID, req *Request, branch RequestBranch) {
+		gotBranch = branch
+	}})
+	steps := []struct {
+		name  string
+		pos   int64
+		txnID string
+		// requests with a different sort have different parameters
+		sort       string
+		wantBranch RequestBranch
+		// if set, the request is rejected with this errcode
+		wantErrCode string
+		wantResPos  int
+		wantTxnID   string
+		// the number of the handler call which calculated the response
+		wantCount    int
+		wantBuffered []int64
+		wantLastPos  int64
+	}{
+		{
+			name: "initial", pos: 0, txnID: "t1", sort: SortByName, wantBranch: RequestBranchInitial,
+			wantResPos: 1, wantTxnID: "t1", wantCount: 1, wantBuffered: []int64{1}, wantLastPos: 1,
+		},
+		{
+			name: "ACK newest", pos: 1, txnID: "t2", sort: SortByName, wantBranch: RequestBranchLive,
+			wantResPos: 2, wantTxnID: "t2", wantCount: 2, wantBuffered: []int64{1, 2}, wantLastPos: 2,
+		},
+		{
+			name: "retransmit with a new txn_id", pos: 1, txnID: "t3", sort: SortByName, wantBranch: RequestBranchRetransmit,
+			wantResPos: 2, wantTxnID: "t3", wantCount: 2, wantBuffered: []int64{1, 2}, wantLastPos: 2,
+		},
+		{
+			// the response for the new filter is buffered behind the one the client hasn't received
+			name: "retransmit with a changed filter", pos: 1, txnID: "t4", sort: SortByRecency, wantBranch: RequestBranchChanged,
+			wantResPos: 2, wantTxnID: "t2", wantCount: 2, wantBuffered: []int64{1, 2, 3}, wantLastPos: 3,
+		},
+		{
+			name: "retransmit with another changed filter", pos: 1, txnID: "t5", sort: SortByHighlightCount, wantBranch: RequestBranchChanged,
+			wantResPos: 2, wantTxnID: "t2", wantCount: 2, wantBuffered: []int64{1, 2, 3, 4}, wantLastPos: 4,
+		},
+		{
+			name: "ACK oldest", pos: 2, txnID: "t6", sort: SortByHighlightCount, wantBranch: RequestBranchBuffered,
+			wantResPos: 3, wantTxnID: "t6", wantCount: 3, wantBuffered: []int64{2, 3, 4}, wantLastPos: 4,
+		},
+		{
+			name: "ACK made up pos", pos: 9, sort: SortByHighlightCount, wantBranch: RequestBranchUnknownPos,
+			wantErrCode: "M_UNKNOWN_POS", wantBuffered: []int64{2, 3, 4}, wantLastPos: 4,
+		},
+		{
+			// pos 1 was purged, but is the pos of the last request processed so is a retransmit
+			name: "reordered retransmit of a purged pos", pos: 1, txnID: "t5", sort: SortByHighlightCount, wantBranch: RequestBranchRetransmit,
+			wantResPos: 2, wantTxnID: "t5", wantCount: 2, wantBuffered: []int64{2, 3, 4}, wantLastPos: 4,
+		},
+		{
+			name: "ACK newest of several", pos: 4, txnID: "t7", sort: SortByHighlightCount, wantBranch: RequestBranchLive,
+			wantResPos: 5, wantTxnID: "t7", wantCount: 5, wantBuffered: []int64{4, 5}, wantLastPos: 5,
+		},
+		{
+			name: "ACK made up pos after purging", pos: 3, sort: SortByHighlightCount, wantBranch: RequestBranchUnknownPos,
+			wantErrCode: "M_UNKNOWN_POS", wantBuffered: []int64{4, 5}, wantLastPos: 5,
+		},
+		// interleaved txn_ids: each response keeps the txn_id of the request which made it, unless
+		// it is sent for a request with the same parameters
+		{
+			name: "interleaved txn_ids: live", pos: 5, txnID: "t8", sort: SortByHighlightCount, wantBranch: RequestBranchLive,
+			wantResPos: 6, wantTxnID: "t8", wantCount: 6, wantBuffered: []int64{5, 6}, wantLastPos: 6,
+		},
+		{
+			name: "interleaved txn_ids: changed", pos: 5, txnID: "t9", sort: SortByName, wantBranch: RequestBranchChanged,
+			wantResPos: 6, wantTxnID: "t8", wantCount: 6, wantBuffered: []int64{5, 6, 7}, wantLastPos: 7,
+		},
+		{
+			name: "interleaved txn_ids: buffered", pos: 6, txnID: "t10", sort: SortByName, wantBranch: RequestBranchBuffered,
+			wantResPos: 7, wantTxnID: "t10", wantCount: 7, wantBuffered: []int64{6, 7}, wantLastPos: 7,
+		},
+	}
+	for _, step := range steps {
+		gotBranch = ""
+		resp, herr := c.OnIncomingRequest(ctx, &Request{
+			pos:   step.pos,
+			TxnID: step.txnID,
+			Lists: map[string]RequestList{"a": {Sort: []string{step.sort}}},
+		}, time.Now())
+		if gotBranch != step.wantBranch {
+			t.Errorf("%s: got branch %q want %q", step.name, gotBranch, step.wantBranch)
+		}
+		if step.wantErrCode != "" {
+			if herr == nil || herr.ErrCode != step.wantErrCode {
+				t.Errorf("%s: got error %v want %s", step.name, herr, step.wantErrCode)
+			}
+		} else if herr != nil {
+			t.Errorf("%s: got error %s", step.name, herr)
+		} else {
+			if resp.Pos != strconv.Itoa(step.wantResPos) || resp.TxnID != step.wantTxnID || resp.Lists["a"].Count != step.wantCount {
+				t.Errorf("%s: got pos %s txn_id %q count %d, want pos %d txn_id %q count %d", step.name,
+					resp.Pos, resp.TxnID, resp.Lists["a"].Count, step.wantResPos, step.wantTxnID, step.wantCount)
+			}
+		}
+		var gotBuffered []int64
+		for _, buffered := range c.serverResponses {
+			gotBuffered = append(gotBuffered, buffered.pos)
+		}
+		if !reflect.DeepEqual(gotBuffered, step.wantBuffered) {
+			t.Errorf("%s: got buffered positions %v want %v", step.name, gotBuffered, step.wantBuffered)
+		}
+		if snapshot := c.Snapshot(); snapshot.LastPos != step.wantLastPos {
+			t.Errorf("%s: got last pos %d want %d", step.name, snapshot.LastPos, step.wantLastPos)
+		}
+	}
+}
+
+// Test that the nonce of each request is echoed in its response, including cached responses
+// sent again for a retransmit.
+func TestConnNonce(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	callCount := 0
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
+		callCount += 1
+		return &Response{Lists: map[string]ResponseList{
+			"a": {
+				Count: callCount,
+			},
+		}}, nil
+	}})
+	assertNonce := func(resp *Response, want string) {
+		t.Helper()
+		if resp.Nonce != want {
+			t.Fatalf("got nonce %q want %q", resp.Nonce, want)
+		}
+	}
+	resp, err := c.OnIncomingRequest(ctx, &Request{Nonce: "n1"}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 1)
+	assertNonce(resp, "n1")
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 2)
+	assertNonce(resp, "")
+	// retransmit with a new nonce: the cached response is returned with the new nonce
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1, Nonce: "n2"}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 2)
+	assertInt(t, callCount, 2)
+	assertNonce(resp, "n2")
+	// retransmit with modified request data: the buffered response is returned with this nonce
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 1, Nonce: "n3", UnsubscribeRooms: []string{"a"}}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 2)
+	assertInt(t, callCount, 3)
+	assertNonce(resp, "n3")
+	// the buffered response from the previous request is returned with this nonce
+	resp, err = c.OnIncomingRequest(ctx, &Request{pos: 2, Nonce: "n4", UnsubscribeRooms: []string{"a"}}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 3)
+	assertInt(t, callCount, 3)
+	assertNonce(resp, "n4")
+}
+
 func assertPos(t *testing.T, pos string, wantPos int) {
 	t.Helper()
 	gotPos, err := strconv.Atoi(pos)
@@ -396,3 +984,368 @@ func assertNoError(t *testing.T, err *internal.HandlerError) {
 		t.Fatalf("got error: %v", err)
 	}
 }
+
+// Test that connections which buffer too many unacknowledged responses are expired, and that
+// acknowledged responses do not count towards the limits.
+func TestConnBufferLimits(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	event := json.RawMessage(`{"type":"m.room.message","content":{"body":"` + strings.Repeat("a", 70) + `"}}`)
+	newConn := func(limits BufferLimits) *Conn {
+		c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
+			return &Response{Rooms: map[string]Room{
+				"!a:localhost": {Timeline: []json.RawMessage{event}},
+			}}, nil
+		}})
+		c.bufferLimits = limits
+		return c
+	}
+	assertExpired := func(err *internal.HandlerError) {
+		t.Helper()
+		if err == nil || err.StatusCode != 400 || err.ErrCode != "M_UNKNOWN_POS" {
+			t.Fatalf("got error %v, want 400 M_UNKNOWN_POS", err)
+		}
+	}
+
+	for _, limits := range []BufferLimits{{MaxResponses: 1}, {MaxBytes: len(event) + 1}} {
+		// a client which acknowledges every response is never expired
+		c := newConn(limits)
+		for pos := 0; pos < 5; pos++ {
+			resp, err := c.OnIncomingRequest(ctx, &Request{pos: int64(pos)}, time.Now())
+			assertNoError(t, err)
+			assertPos(t, resp.Pos, pos+1)
+		}
+		// the acknowledged response is kept for retransmits
+		if got := c.BufferedBytes(); got != int64(2*len(event)) {
+			t.Fatalf("%+v: got %d buffered bytes, want %d", limits, got, 2*len(event))
+		}
+
+		// a client which keeps changing the request at the same pos has unacknowledged responses
+		// buffered, and is expired once over the limit
+		resp, err := c.OnIncomingRequest(ctx, &Request{pos: 5, UnsubscribeRooms: []string{"a"}}, time.Now())
+		assertNoError(t, err)
+		assertPos(t, resp.Pos, 6)
+		_, err = c.OnIncomingRequest(ctx, &Request{pos: 5, UnsubscribeRooms: []string{"b"}}, time.Now())
+		assertExpired(err)
+		if got := c.BufferedBytes(); got != 0 {
+			t.Fatalf("%+v: got %d buffered bytes after expiry, want 0", limits, got)
+		}
+		// every position is now unknown, so the client must start again
+		_, err = c.OnIncomingRequest(ctx, &Request{pos: 5, UnsubscribeRooms: []string{"b"}}, time.Now())
+		assertExpired(err)
+		_, err = c.OnIncomingRequest(ctx, &Request{pos: 6}, time.Now())
+		assertExpired(err)
+	}
+
+	// a single response larger than the limit is still sent
+	c := newConn(BufferLimits{MaxBytes: 1})
+	resp, err := c.OnIncomingRequest(ctx, &Request{}, time.Now())
+	assertNoError(t, err)
+	assertPos(t, resp.Pos, 1)
+
+	// a client which stops acknowledging responses is expired once the oldest is too old
+	c = newConn(BufferLimits{MaxAge: time.Minute})
+	_, err = c.OnIncomingRequest(ctx, &Request{}, time.Now())
+	assertNoError(t, err)
+	_, err = c.OnIncomingRequest(ctx, &Request{pos: 1, UnsubscribeRooms: []string{"a"}}, time.Now())
+	assertNoError(t, err)
+	// the acknowledged response is not counted, however old it is
+	c.serverResponses[0].bufferedAt = time.Now().Add(-time.Hour)
+	_, err = c.OnIncomingRequest(ctx, &Request{pos: 1, UnsubscribeRooms: []string{"b"}}, time.Now())
+	assertNoError(t, err)
+	c.serverResponses[1].bufferedAt = time.Now().Add(-2 * time.Minute)
+	_, err = c.OnIncomingRequest(ctx, &Request{pos: 1, UnsubscribeRooms: []string{"c"}}, time.Now())
+	assertExpired(err)
+}
+
+// Test that a client requesting in a tight loop is rate limited, whilst a client requesting at a
+// normal cadence is not.
+func TestConnRateLimit(t *testing.T) {
+	ctx := context.Background()
+	newConn := func(limit RateLimit) *Conn {
+		return NewConnWithOptions(ConnID{DeviceID: "d"}, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+			return &Response{}, nil
+		}}, ConnOptions{RateLimit: limit})
+	}
+
+	// flood the connection: the burst is allowed, then it is throttled
+	c := newConn(RateLimit{Rate: 10, Burst: 2})
+	var limited *internal.HandlerError
+	pos := int64(0)
+	for i := 0; i < 10 && limited == nil; i++ {
+		resp, herr := c.OnIncomingRequest(ctx, &Request{pos: pos}, time.Now())
+		if herr != nil {
+			limited = herr
+			if i < 2 {
+				t.Fatalf("request %d within the burst was rejected: %s", i, herr)
+			}
+			break
+		}
+		pos = resp.PosInt()
+	}
+	if limited == nil {
+		t.Fatalf("flood of requests was not rate limited")
+	}
+	if limited.StatusCode != 429 || limited.ErrCode != "M_LIMIT_EXCEEDED" {
+		t.Fatalf("got error %+v want 429 M_LIMIT_EXCEEDED", limited)
+	}
+	if limited.RetryAfter <= 0 || limited.RetryAfter > 100*time.Millisecond {
+		t.Fatalf("got retry after %v", limited.RetryAfter)
+	}
+	// waiting as long as we are told lets the request through
+	time.Sleep(limited.RetryAfter)
+	_, herr := c.OnIncomingRequest(ctx, &Request{pos: pos}, time.Now())
+	assertNoError(t, herr)
+
+	// a well-behaved client is never limited
+	c = newConn(RateLimit{Rate: 100, Burst: 2})
+	pos = 0
+	for i := 0; i < 20; i++ {
+		resp, herr := c.OnIncomingRequest(ctx, &Request{pos: pos}, time.Now())
+		assertNoError(t, herr)
+		pos = resp.PosInt()
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Test that retransmits which are answered from the buffer are not rate limited when they are exempt.
+func TestConnRateLimitExemptBuffered(t *testing.T) {
+	ctx := context.Background()
+	for _, exempt := range []bool{true, false} {
+		c := NewConnWithOptions(ConnID{DeviceID: "d"}, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+			return &Response{}, nil
+		}}, ConnOptions{RateLimit: RateLimit{Rate: 1, Burst: 2, ExemptBuffered: exempt}})
+		_, herr := c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+		assertNoError(t, herr)
+		resp, herr := c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+		assertNoError(t, herr)
+		assertPos(t, resp.Pos, 2)
+		var limited bool
+		for i := 0; i < 5; i++ {
+			// retransmit pos 1: the client never saw the response
+			_, herr = c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+			if herr != nil {
+				limited = true
+			}
+		}
+		if limited == exempt {
+			t.Errorf("ExemptBuffered=%v: got rate limited %v", exempt, limited)
+		}
+	}
+}
+
+// Test that the handler is given the timeout within the limits, rather than what the client asked for.
+func TestConnTimeoutLimits(t *testing.T) {
+	ctx := context.Background()
+	limits := TimeoutLimits{Min: time.Second, Max: 55 * time.Second, Default: 30 * time.Second}
+	var gotTimeout int
+	c := NewConnWithOptions(ConnID{DeviceID: "d"}, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		gotTimeout = req.TimeoutMSecs()
+		return &Response{}, nil
+	}}, ConnOptions{TimeoutLimits: limits})
+	testCases := []struct {
+		name    string
+		timeout int
+		want    int
+	}{
+		{name: "within limits", timeout: 20000, want: 20000},
+		{name: "zero uses the default", timeout: 0, want: 30000},
+		{name: "below min", timeout: 10, want: 1000},
+		{name: "above max", timeout: 3600000, want: 55000},
+	}
+	for i, tc := range testCases {
+		req := &Request{pos: int64(i)}
+		req.SetTimeoutMSecs(tc.timeout)
+		_, herr := c.OnIncomingRequest(ctx, req, time.Now())
+		assertNoError(t, herr)
+		if gotTimeout != tc.want {
+			t.Errorf("%s: handler got timeout %d want %d", tc.name, gotTimeout, tc.want)
+		}
+	}
+
+	if got := limits.DefaultMSecs(); got != 30000 {
+		t.Errorf("got default timeout %d want 30000", got)
+	}
+	// without a configured default, requests without a timeout use DefaultTimeoutMSecs within the
+	// limits, and 0 means return immediately
+	limits = TimeoutLimits{Max: 5 * time.Second}
+	if got := limits.DefaultMSecs(); got != 5000 {
+		t.Errorf("got default timeout %d want the max 5000", got)
+	}
+	assertInt(t, TimeoutLimits{}.DefaultMSecs(), DefaultTimeoutMSecs)
+	assertInt(t, TimeoutLimits{}.apply(0), 0)
+}
+
+// Test that the handler can tear down the connection mid-request, after which every request on it
+// gets the same error.
+func TestConnTeardown(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	numCalls := 0
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		numCalls++
+		if req.pos == 2 {
+			return nil, internal.ConnTornDownError(errors.New("device logged out"))
+		}
+		return &Response{}, nil
+	}})
+	_, herr := c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	assertNoError(t, herr)
+	// the handler tears down the connection on the request at pos 2. Retrying it or ACKing any
+	// pos sent before then would normally be accepted.
+	for _, pos := range []int64{2, 1, 2, 3} {
+		_, herr = c.OnIncomingRequest(ctx, &Request{pos: pos}, time.Now())
+		if herr == nil || herr.StatusCode != 401 || herr.ErrCode != "M_UNKNOWN_TOKEN" {
+			t.Fatalf("pos %d: got error %v, want 401 M_UNKNOWN_TOKEN", pos, herr)
+		}
+	}
+	assertInt(t, numCalls, 3)
+	assertInt(t, c.BufferedResponses(), 0)
+	if !c.Alive() {
+		t.Errorf("torn down connection is not alive, so later requests would get M_UNKNOWN_POS")
+	}
+}
+
+// Test that shutting down a connection returns the outstanding long poll promptly, and later
+// requests are answered without invoking the handler at a pos the client can carry on from.
+func TestConnShutdown(t *testing.T) {
+	ctx := context.Background()
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	var numCalls int
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		numCalls++
+		if !isInitial {
+			<-ctx.Done() // long poll until cancelled
+		}
+		return &Response{Lists: map[string]ResponseList{"a": {Count: numCalls}}}, nil
+	}})
+	resp, herr := c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 1)
+
+	// a long poll is in flight when we shut down
+	type result struct {
+		resp *Response
+		herr *internal.HandlerError
+	}
+	longPoll := make(chan result, 1)
+	go func() {
+		resp, herr := c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+		longPoll <- result{resp, herr}
+	}()
+	time.Sleep(10 * time.Millisecond) // let the request start long polling
+	shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := c.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("Shutdown: %s", err)
+	}
+	select {
+	case res := <-longPoll:
+		assertNoError(t, res.herr)
+		assertPos(t, res.resp.Pos, 2)
+	default:
+		t.Fatalf("Shutdown returned before the long poll did")
+	}
+	assertInt(t, numCalls, 2)
+
+	// the client has not seen pos 2 yet, so it is returned again
+	resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 2)
+	// nothing is buffered for pos 2, so the response is empty and leaves the client at pos 2
+	for i := 0; i < 2; i++ {
+		resp, herr = c.OnIncomingRequest(ctx, &Request{pos: 2, TxnID: "txn", Nonce: "nonce"}, time.Now())
+		assertNoError(t, herr)
+		assertPos(t, resp.Pos, 2)
+		if len(resp.Lists) != 0 || len(resp.Rooms) != 0 || resp.Nonce != "nonce" || resp.TxnID != "" {
+			t.Fatalf("got response %+v, want empty response with the nonce", resp)
+		}
+	}
+	assertInt(t, numCalls, 2)
+
+	// unknown positions are still rejected
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: 31415}, time.Now())
+	if herr == nil || herr.ErrCode != "M_UNKNOWN_POS" {
+		t.Fatalf("got error %v, want M_UNKNOWN_POS", herr)
+	}
+	// new connections are told to retry
+	_, herr = c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	if herr == nil || herr.StatusCode != 503 || herr.RetryAfter <= 0 {
+		t.Fatalf("got error %v, want 503 with retry after", herr)
+	}
+	assertInt(t, numCalls, 2)
+}
+
+// Test that Shutdown gives up waiting for a request which does not return.
+func TestConnShutdownTimeout(t *testing.T) {
+	ctx := context.Background()
+	release := make(chan struct{})
+	defer close(release)
+	c := NewConn(ConnID{DeviceID: "d"}, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		<-release // ignores cancellation
+		return &Response{}, nil
+	}})
+	go c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	time.Sleep(10 * time.Millisecond)
+	shutdownCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	err := ShutdownConns(shutdownCtx, []*Conn{c, NewConn(ConnID{DeviceID: "e"}, &connHandlerMock{})})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// Test that a request does not wait forever for a slow request before it on the same connection.
+func TestConnLockWaitTimeout(t *testing.T) {
+	ctx := context.Background()
+	oldWait := MinConnLockWait
+	MinConnLockWait = 50 * time.Millisecond
+	defer func() {
+		MinConnLockWait = oldWait
+	}()
+	release := make(chan struct{})
+	c := NewConn(ConnID{DeviceID: "d"}, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+		if isInitial {
+			<-release // a slow initial sync which doesn't notice it was cancelled
+		}
+		return &Response{}, nil
+	}})
+	initial := make(chan *internal.HandlerError, 1)
+	go func() {
+		_, herr := c.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+		initial <- herr
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	for _, timeout := range []time.Duration{0, 100 * time.Millisecond} {
+		req := &Request{pos: 1}
+		req.SetTimeoutMSecs(int(timeout.Milliseconds()))
+		start := time.Now()
+		_, herr := c.OnIncomingRequest(ctx, req, time.Now())
+		waited := time.Since(start)
+		if herr == nil || herr.StatusCode != 409 {
+			t.Fatalf("timeout %v: got error %v want 409", timeout, herr)
+		}
+		wantWait := MinConnLockWait
+		if timeout > wantWait {
+			wantWait = timeout
+		}
+		if waited < wantWait || waited > wantWait+time.Second {
+			t.Errorf("timeout %v: waited %v for the lock, want %v", timeout, waited, wantWait)
+		}
+	}
+
+	close(release)
+	assertNoError(t, <-initial)
+	resp, herr := c.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, resp.Pos, 2)
+}
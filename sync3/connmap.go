@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,6 +13,19 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// ExpiryPolicy decides when connections are expired, to free the memory of connections which
+// clients have abandoned. Clients which make a request on an expired connection are sent
+// M_UNKNOWN_POS, so they know to start a new connection.
+type ExpiryPolicy struct {
+	// How long a connection can go without a request before it is expired. 0 keeps the TTL the
+	// ConnMap was created with.
+	IdleTimeout time.Duration
+	// How long after it was created a connection is expired, whether or not it is being used. This
+	// bounds how long state built up by a connection is kept, at the cost of clients resyncing.
+	// 0 means connections can be used forever.
+	MaxLifetime time.Duration
+}
+
 // ConnMap stores a collection of Conns.
 type ConnMap struct {
 	cache *ttlcache.Cache
@@ -21,9 +35,25 @@ type ConnMap struct {
 	connIDToConn map[string]*Conn
 
 	numConns prometheus.Gauge
+	// the number of users with connections, and the most connections any one user has
+	numUsers        prometheus.GaugeFunc
+	maxConnsPerUser prometheus.GaugeFunc
+	// the total size of responses buffered by all connections
+	bufferedBytes prometheus.GaugeFunc
+	// the total number of responses buffered by all connections
+	bufferedResponses prometheus.GaugeFunc
+	// metrics updated by each connection, nil if metrics are disabled
+	connMetrics *connMetrics
 	// counters for reasons why connections have expired
 	expiryTimedOutCounter   prometheus.Counter
 	expiryBufferFullCounter prometheus.Counter
+	expiryLifetimeCounter   prometheus.Counter
+
+	bufferLimits BufferLimits
+	connOpts     ConnOptions
+	maxLifetime  time.Duration
+	// true once Shutdown has been called
+	shuttingDown bool
 
 	mu *sync.Mutex
 }
@@ -53,6 +83,13 @@ func NewConnMap(enablePrometheus bool, ttl time.Duration) *ConnMap {
 			Help:      "Counter of expired API connections due to reaching buffer update limit",
 		})
 		prometheus.MustRegister(cm.expiryBufferFullCounter)
+		cm.expiryLifetimeCounter = prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "expiry_conn_max_lifetime",
+			Help:      "Counter of expired API connections due to reaching their maximum lifetime",
+		})
+		prometheus.MustRegister(cm.expiryLifetimeCounter)
 		cm.numConns = prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: "sliding_sync",
 			Subsystem: "api",
@@ -60,22 +97,240 @@ func NewConnMap(enablePrometheus bool, ttl time.Duration) *ConnMap {
 			Help:      "Number of active sliding sync connections.",
 		})
 		prometheus.MustRegister(cm.numConns)
+		cm.numUsers = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "num_active_users",
+			Help:      "Number of users with active sliding sync connections.",
+		}, cm.numUsersWithConns)
+		prometheus.MustRegister(cm.numUsers)
+		cm.maxConnsPerUser = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "max_conns_per_user",
+			Help:      "The most active sliding sync connections any one user has.",
+		}, cm.mostConnsForOneUser)
+		prometheus.MustRegister(cm.maxConnsPerUser)
+		cm.bufferedBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "buffered_response_bytes",
+			Help:      "Approximate size of responses buffered for clients which have not acknowledged them.",
+		}, cm.totalBufferedBytes)
+		prometheus.MustRegister(cm.bufferedBytes)
+		cm.bufferedResponses = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "buffered_responses",
+			Help:      "Number of responses buffered for clients, summed across all connections.",
+		}, cm.totalBufferedResponses)
+		prometheus.MustRegister(cm.bufferedResponses)
+		cm.connMetrics = &connMetrics{
+			requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Namespace: "sliding_sync",
+				Subsystem: "api",
+				Name:      "conn_request_duration_secs",
+				Help:      "Time taken in seconds to handle a request on a connection including long polling, labelled by how the request was handled e.g initial, live, retransmit or buffered.",
+				Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+			}, []string{"type"}),
+			unknownPos: prometheus.NewCounter(prometheus.CounterOpts{
+				Namespace: "sliding_sync",
+				Subsystem: "api",
+				Name:      "unknown_pos",
+				Help:      "Counter of requests rejected because the client sent an unknown pos.",
+			}),
+			requestTimeout: prometheus.NewHistogram(prometheus.HistogramOpts{
+				Namespace: "sliding_sync",
+				Subsystem: "api",
+				Name:      "conn_request_timeout_secs",
+				Help:      "The long-poll timeout in seconds of requests on connections, after clamping it to the configured limits.",
+				Buckets:   []float64{0, 0.1, 1, 5, 10, 20, 30, 60, 120},
+			}),
+			unACKedResponses: prometheus.NewHistogram(prometheus.HistogramOpts{
+				Namespace: "sliding_sync",
+				Subsystem: "api",
+				Name:      "conn_unacked_responses",
+				Help:      "The number of responses each connection has buffered which the client has not acknowledged, observed each time a response is buffered.",
+				Buckets:   []float64{0, 1, 2, 3, 5, 10, 20, 50, 100},
+			}),
+			unACKedBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+				Namespace: "sliding_sync",
+				Subsystem: "api",
+				Name:      "conn_unacked_response_bytes",
+				Help:      "The approximate size of responses each connection has buffered which the client has not acknowledged, observed each time a response is buffered.",
+				Buckets:   prometheus.ExponentialBuckets(1024, 4, 9),
+			}),
+			bufferExpired: prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace: "sliding_sync",
+				Subsystem: "api",
+				Name:      "conn_buffer_limit_expired",
+				Help:      "Counter of connections expired for buffering too many, too large or too old unacknowledged responses, labelled by the limit exceeded.",
+			}, []string{"limit"}),
+		}
+		prometheus.MustRegister(cm.connMetrics.requestDuration)
+		prometheus.MustRegister(cm.connMetrics.unknownPos)
+		prometheus.MustRegister(cm.connMetrics.requestTimeout)
+		prometheus.MustRegister(cm.connMetrics.unACKedResponses)
+		prometheus.MustRegister(cm.connMetrics.unACKedBytes)
+		prometheus.MustRegister(cm.connMetrics.bufferExpired)
 	}
 	return cm
 }
 
+// SetBufferLimits caps the responses each connection buffers for the client. Connections which
+// exceed the limits are expired. Only applies to connections created after this is called.
+func (m *ConnMap) SetBufferLimits(limits BufferLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bufferLimits = limits
+}
+
+// SetExpiryPolicy changes when connections are expired. Existing connections use the new idle
+// timeout from their next request.
+func (m *ConnMap) SetExpiryPolicy(policy ExpiryPolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if policy.IdleTimeout > 0 {
+		m.cache.SetTTL(policy.IdleTimeout)
+	}
+	m.maxLifetime = policy.MaxLifetime
+}
+
+// SetRateLimit limits how often each connection can make requests. Only applies to connections
+// created after this is called.
+func (m *ConnMap) SetRateLimit(limit RateLimit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connOpts.RateLimit = limit
+}
+
+// SetTimeoutLimits clamps the long-poll timeout of requests on each connection. Only applies to
+// connections created after this is called.
+func (m *ConnMap) SetTimeoutLimits(limits TimeoutLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connOpts.TimeoutLimits = limits
+}
+
+// DefaultTimeoutMSecs returns the long-poll timeout in milliseconds for requests which don't ask
+// for one.
+func (m *ConnMap) DefaultTimeoutMSecs() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.connOpts.TimeoutLimits.DefaultMSecs()
+}
+
+// SetOnPanic sets the callback for when a connection's handler panics: see ConnOptions.OnPanic.
+// Only applies to connections created after this is called.
+func (m *ConnMap) SetOnPanic(onPanic func(connID ConnID, req *Request, stack []byte)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connOpts.OnPanic = onPanic
+}
+
+// SetCompressBufferedResponses sets whether connections compress the responses they buffer. Only
+// applies to connections created after this is called.
+func (m *ConnMap) SetCompressBufferedResponses(compress bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connOpts.CompressBufferedResponses = compress
+}
+
+// SetConnStore saves the positions of connections in store, so clients can resume connections after
+// a restart. Only applies to connections created after this is called.
+func (m *ConnMap) SetConnStore(store ConnStore) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connOpts.Store = store
+}
+
+// CanResumeConns returns true if connections which are not in the map may be resumed from a saved
+// position.
+func (m *ConnMap) CanResumeConns() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.connOpts.Store != nil
+}
+
+func (m *ConnMap) numUsersWithConns() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int
+	for _, conns := range m.userIDToConn {
+		if len(conns) > 0 {
+			total++
+		}
+	}
+	return float64(total)
+}
+
+func (m *ConnMap) mostConnsForOneUser() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var most int
+	for _, conns := range m.userIDToConn {
+		if len(conns) > most {
+			most = len(conns)
+		}
+	}
+	return float64(most)
+}
+
+func (m *ConnMap) totalBufferedBytes() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	for _, conn := range m.connIDToConn {
+		total += conn.BufferedBytes()
+	}
+	return float64(total)
+}
+
+func (m *ConnMap) totalBufferedResponses() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int
+	for _, conn := range m.connIDToConn {
+		total += conn.BufferedResponses()
+	}
+	return float64(total)
+}
+
 func (m *ConnMap) Teardown() {
 	m.cache.Close()
 
 	if m.numConns != nil {
 		prometheus.Unregister(m.numConns)
 	}
+	if m.numUsers != nil {
+		prometheus.Unregister(m.numUsers)
+	}
+	if m.maxConnsPerUser != nil {
+		prometheus.Unregister(m.maxConnsPerUser)
+	}
+	if m.bufferedBytes != nil {
+		prometheus.Unregister(m.bufferedBytes)
+	}
+	if m.bufferedResponses != nil {
+		prometheus.Unregister(m.bufferedResponses)
+	}
+	if m.connMetrics != nil {
+		prometheus.Unregister(m.connMetrics.requestDuration)
+		prometheus.Unregister(m.connMetrics.unknownPos)
+		prometheus.Unregister(m.connMetrics.requestTimeout)
+		prometheus.Unregister(m.connMetrics.unACKedResponses)
+		prometheus.Unregister(m.connMetrics.unACKedBytes)
+		prometheus.Unregister(m.connMetrics.bufferExpired)
+	}
 	if m.expiryBufferFullCounter != nil {
 		prometheus.Unregister(m.expiryBufferFullCounter)
 	}
 	if m.expiryTimedOutCounter != nil {
 		prometheus.Unregister(m.expiryTimedOutCounter)
 	}
+	if m.expiryLifetimeCounter != nil {
+		prometheus.Unregister(m.expiryLifetimeCounter)
+	}
 }
 
 // UpdateMetrics recalculates the number of active connections. Do this when you think there is a change.
@@ -122,6 +377,14 @@ func (m *ConnMap) getConn(cid ConnID) *Conn {
 		return nil
 	}
 	conn := cint.(*Conn)
+	if m.maxLifetime > 0 && time.Since(conn.created) > m.maxLifetime {
+		logger.Info().Str("conn", cid.String()).Dur("age", time.Since(conn.created)).Msg("closing connection due to reaching max lifetime")
+		m.expireConn(conn)
+		if m.expiryLifetimeCounter != nil {
+			m.expiryLifetimeCounter.Inc()
+		}
+		return nil
+	}
 	if conn.Alive() {
 		return conn
 	}
@@ -134,6 +397,25 @@ func (m *ConnMap) getConn(cid ConnID) *Conn {
 	return nil
 }
 
+// Snapshot returns a copy of the state of every connection, sorted by connection ID. It doesn't
+// wait for requests in flight to finish: see Conn.Snapshot.
+func (m *ConnMap) Snapshot() []ConnSnapshot {
+	m.mu.Lock()
+	conns := make([]*Conn, 0, len(m.connIDToConn))
+	for _, conn := range m.connIDToConn {
+		conns = append(conns, conn)
+	}
+	m.mu.Unlock()
+	snapshots := make([]ConnSnapshot, len(conns))
+	for i, conn := range conns {
+		snapshots[i] = conn.Snapshot()
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ConnID.String() < snapshots[j].ConnID.String()
+	})
+	return snapshots
+}
+
 // Atomically gets or creates a connection with this connection ID. Calls newConn if a new connection is required.
 func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandler func() ConnHandler) *Conn {
 	// atomically check if a conn exists already and nuke it if it exists
@@ -142,7 +424,7 @@ func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandl
 	conn := m.getConn(cid)
 	if conn != nil {
 		// tear down this connection and fallthrough
-		isSpamming := conn.lastPos <= 1
+		isSpamming := conn.Snapshot().LastPos <= 1
 		if isSpamming {
 			// the existing connection has only just been used for one response, and now they are asking
 			// for a new connection. Apply an artificial delay here to stop buggy clients from spamming
@@ -154,7 +436,12 @@ func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandl
 	}
 	h := newConnHandler()
 	h.SetCancelCallback(cancel)
-	conn = NewConn(cid, h)
+	conn = NewConnWithOptions(cid, h, m.connOpts)
+	conn.bufferLimits = m.bufferLimits
+	conn.metrics = m.connMetrics
+	if m.shuttingDown {
+		conn.shuttingDown.Store(true)
+	}
 	m.cache.Set(cid.String(), conn)
 	m.connIDToConn[cid.String()] = conn
 	m.userIDToConn[cid.UserID] = append(m.userIDToConn[cid.UserID], conn)
@@ -162,6 +449,42 @@ func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandl
 	return conn
 }
 
+// Shutdown shuts down every connection, including connections created afterwards, so clients are
+// not left waiting when the server stops. See Conn.Shutdown. Returns once all outstanding requests
+// have finished, or ctx is done.
+func (m *ConnMap) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.shuttingDown = true
+	conns := make([]*Conn, 0, len(m.connIDToConn))
+	for _, conn := range m.connIDToConn {
+		conns = append(conns, conn)
+	}
+	m.mu.Unlock()
+	logger.Info().Int("conns", len(conns)).Msg("shutting down connections")
+	return ShutdownConns(ctx, conns)
+}
+
+// CloseConn closes the connection with this ID, even if a request is in flight, and forgets its
+// saved position so it cannot be resumed. Returns false if there is no such connection, in memory
+// or saved.
+func (m *ConnMap) CloseConn(cid ConnID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	connKey := cid.String()
+	conn := m.connIDToConn[connKey]
+	if conn == nil {
+		// the connection may only be saved e.g if the proxy restarted since it was last used
+		return m.forgetSavedConn(cid)
+	}
+	logger.Info().Str("conn", connKey).Msg("closing connection due to CloseConn()")
+	m.expireConn(conn)
+	// the expiry callback ignores connections which are already closed
+	if err := m.cache.Remove(connKey); err != nil {
+		logger.Warn().Err(err).Str("conn", connKey).Msg("CloseConn: conn did not exist in ttlcache")
+	}
+	return true
+}
+
 func (m *ConnMap) CloseConnsForDevice(userID, deviceID string) {
 	logger.Trace().Str("user", userID).Str("device", deviceID).Msg("closing connections due to CloseConn()")
 	// gather open connections for this user|device
@@ -209,15 +532,80 @@ func (m *ConnMap) CloseConnsForUsers(userIDs []string) (closed int) {
 	return closed
 }
 
+// ExpireOldConns closes connections which have not had a request for maxAge. Connections which
+// are processing a request are never closed. Returns the number of connections closed.
+func (m *ConnMap) ExpireOldConns(maxAge time.Duration) (expired int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for connKey, conn := range m.connIDToConn {
+		// if a request holds the lock the connection is in use, and we must not destroy its state
+		// from under it
+		if !conn.mu.TryLock() {
+			continue
+		}
+		if now.Sub(conn.lastSeen) < maxAge {
+			conn.mu.Unlock()
+			continue
+		}
+		logger.Info().Str("conn", connKey).Dur("idle", now.Sub(conn.lastSeen)).Msg("closing idle connection")
+		m.expireConn(conn)
+		conn.mu.Unlock()
+		if m.expiryTimedOutCounter != nil {
+			m.expiryTimedOutCounter.Inc()
+		}
+		// the expiry callback ignores connections which are already closed
+		if err := m.cache.Remove(connKey); err != nil {
+			logger.Warn().Err(err).Str("conn", connKey).Msg("ExpireOldConns: conn did not exist in ttlcache")
+		}
+		expired++
+	}
+	return expired
+}
+
 func (m *ConnMap) closeConnExpires(connID string, value interface{}) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	conn := value.(*Conn)
+	if m.connIDToConn[connID] != conn {
+		// already closed e.g by ExpireOldConns, or replaced by a new connection
+		return
+	}
 	logger.Info().Str("conn", connID).Msg("closing connection due to expired TTL in cache")
 	if m.expiryTimedOutCounter != nil {
 		m.expiryTimedOutCounter.Inc()
 	}
+	m.expireConn(conn)
+}
+
+// expireConn closes a connection and forgets its saved position, so the client is sent
+// M_UNKNOWN_POS rather than the connection being resumed. Must hold mu.
+func (m *ConnMap) expireConn(conn *Conn) {
 	m.closeConn(conn)
+	conn.destroy(context.Background(), true)
+}
+
+// forgetSavedConn clears the saved position of a connection which is not in memory. Returns false
+// if there is no saved position. Must hold mu.
+func (m *ConnMap) forgetSavedConn(cid ConnID) bool {
+	store := m.connOpts.Store
+	if store == nil {
+		return false
+	}
+	saved, err := store.Load(cid)
+	if err != nil {
+		logger.Err(err).Str("conn", cid.String()).Msg("CloseConn: failed to load saved connection position")
+		return false
+	}
+	if saved == nil || saved.LastPos == 0 {
+		return false
+	}
+	logger.Info().Str("conn", cid.String()).Msg("forgetting saved connection due to CloseConn()")
+	if err := store.Save(cid, ConnPosition{}); err != nil {
+		logger.Err(err).Str("conn", cid.String()).Msg("CloseConn: failed to clear saved connection position")
+		internal.GetSentryHubFromContextOrDefault(context.Background()).CaptureException(err)
+	}
+	return true
 }
 
 // must hold mu
@@ -241,6 +629,9 @@ func (m *ConnMap) closeConn(conn *Conn) {
 		}
 	}
 	m.userIDToConn[conn.UserID] = conns
+	// stop a request in flight saving the position once it finishes: the connection may be
+	// expired, or replaced by a new connection with the same ID
+	conn.destroy(context.Background(), false)
 	// remove user cache listeners etc
 	h.Destroy()
 	m.updateMetrics(len(m.connIDToConn))
@@ -10,6 +10,9 @@ import (
 	"time"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 )
 
 const (
@@ -228,3 +231,367 @@ func (c *mockConnHandler) Alive() bool {
 func (c *mockConnHandler) SetCancelCallback(cancel context.CancelFunc) {
 	c.cancel = cancel
 }
+
+// Test that connections for the same device with different conn_ids have independent positions,
+// and that a conn_id is not resurrected once its connection is closed.
+func TestConnMap_ConnIDsForSameDeviceAreIndependent(t *testing.T) {
+	ctx := context.Background()
+	cm := NewConnMap(false, time.Minute)
+	newConn := func(cid ConnID) *Conn {
+		count := 0
+		_, cancel := context.WithCancel(ctx)
+		return cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+				count++
+				return &Response{
+					Lists: map[string]ResponseList{"a": {Count: count}},
+				}, nil
+			}}
+		})
+	}
+	roomListCID := ConnID{UserID: alice, DeviceID: "A", CID: "room-list"}
+	encryptionCID := ConnID{UserID: alice, DeviceID: "A", CID: "encryption"}
+	roomList := newConn(roomListCID)
+	encryption := newConn(encryptionCID)
+	if roomList == encryption {
+		t.Fatalf("conn_ids for the same device share a connection")
+	}
+	mustEqual(t, len(cm.Conns(alice, "A")), 2, "Conns length mismatch")
+
+	for pos := 0; pos < 3; pos++ {
+		res, herr := roomList.OnIncomingRequest(ctx, &Request{pos: int64(pos)}, time.Now())
+		assertNoError(t, herr)
+		assertPos(t, res.Pos, pos+1)
+	}
+	res, herr := encryption.OnIncomingRequest(ctx, &Request{pos: 0}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, res.Pos, 1)
+	assertInt(t, res.Lists["a"].Count, 1)
+
+	// the positions of one connection are not valid on the other
+	_, herr = encryption.OnIncomingRequest(ctx, &Request{pos: 3}, time.Now())
+	if herr == nil || herr.StatusCode != 400 {
+		t.Fatalf("got %v for another connection's position, want a 400", herr)
+	}
+	// retrying on one connection is unaffected by the other
+	res, herr = roomList.OnIncomingRequest(ctx, &Request{pos: 2}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, res.Pos, 3)
+	assertInt(t, res.Lists["a"].Count, 3)
+
+	// once closed, the conn_id is unknown: the handler returns M_UNKNOWN_POS for requests with a
+	// pos rather than creating a new connection
+	if err := cm.cache.Remove(encryptionCID.String()); err != nil {
+		t.Fatalf("failed to close connection: %s", err)
+	}
+	if cm.Conn(encryptionCID) != nil {
+		t.Fatalf("closed connection is still returned")
+	}
+	mustEqual(t, cm.Conn(roomListCID), roomList, "other connection for the device was closed")
+}
+
+func TestConnMap_ExpireOldConns(t *testing.T) {
+	cm := NewConnMap(false, time.Hour)
+	idleCID := ConnID{UserID: alice, DeviceID: "A", CID: "idle"}
+	busyCID := ConnID{UserID: alice, DeviceID: "A", CID: "busy"}
+	recentCID := ConnID{UserID: bob, DeviceID: "B", CID: "recent"}
+	cidToConn := map[ConnID]*Conn{
+		idleCID:   nil,
+		busyCID:   nil,
+		recentCID: nil,
+	}
+	for cid := range cidToConn {
+		_, cancel := context.WithCancel(context.Background())
+		cidToConn[cid] = cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &mockConnHandler{}
+		})
+	}
+	cidToConn[idleCID].lastSeen = time.Now().Add(-time.Hour)
+	cidToConn[busyCID].lastSeen = time.Now().Add(-time.Hour)
+	// pretend a request is in flight on the busy connection
+	cidToConn[busyCID].mu.Lock()
+
+	mustEqual(t, cm.ExpireOldConns(10*time.Minute), 1, "ExpireOldConns evicted count mismatch")
+	time.Sleep(100 * time.Millisecond) // the ttlcache callback fires asyncly
+	assertDestroyedConns(t, cidToConn, func(cid ConnID) bool {
+		return cid == idleCID
+	})
+	if cm.Conn(idleCID) != nil {
+		t.Errorf("idle conn was not removed")
+	}
+	mustEqual(t, len(cm.Conns(alice, "A")), 1, "Conns length mismatch")
+	mustEqual(t, cm.cache.Count(), 2, "cache length mismatch")
+
+	// once the request finishes the busy connection can be expired
+	cidToConn[busyCID].mu.Unlock()
+	mustEqual(t, cm.ExpireOldConns(10*time.Minute), 1, "ExpireOldConns evicted count mismatch")
+	time.Sleep(100 * time.Millisecond)
+	assertDestroyedConns(t, cidToConn, func(cid ConnID) bool {
+		return cid != recentCID
+	})
+	mustEqual(t, cm.cache.Count(), 1, "cache length mismatch")
+	mustEqual(t, cm.ExpireOldConns(10*time.Minute), 0, "ExpireOldConns evicted count mismatch")
+}
+
+func TestConnMap_ExpiryPolicy(t *testing.T) {
+	cm := NewConnMap(false, time.Hour)
+	store := &memoryConnStore{}
+	cm.SetConnStore(store)
+	cm.SetExpiryPolicy(ExpiryPolicy{MaxLifetime: time.Hour})
+	oldCID := ConnID{UserID: alice, DeviceID: "A", CID: "old"}
+	newCID := ConnID{UserID: alice, DeviceID: "A", CID: "new"}
+	idleCID := ConnID{UserID: bob, DeviceID: "B", CID: "idle"}
+	cidToConn := map[ConnID]*Conn{
+		oldCID:  nil,
+		newCID:  nil,
+		idleCID: nil,
+	}
+	for cid := range cidToConn {
+		_, cancel := context.WithCancel(context.Background())
+		cidToConn[cid] = cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &mockConnHandler{}
+		})
+		store.Save(cid, ConnPosition{LastPos: 5})
+	}
+	cidToConn[oldCID].created = time.Now().Add(-2 * time.Hour)
+	cidToConn[idleCID].lastSeen = time.Now().Add(-2 * time.Hour)
+
+	// connections past their lifetime are expired on the next request, even though they are in use
+	if cm.Conn(oldCID) != nil {
+		t.Fatalf("conn past its max lifetime was returned")
+	}
+	if cm.Conn(newCID) == nil {
+		t.Fatalf("conn within its max lifetime was not returned")
+	}
+	mustEqual(t, cm.ExpireOldConns(time.Hour), 1, "ExpireOldConns evicted count mismatch")
+	assertDestroyedConns(t, cidToConn, func(cid ConnID) bool {
+		return cid != newCID
+	})
+	// expired connections cannot be resumed, so the client is told to start again
+	for cid := range cidToConn {
+		pos, err := store.Load(cid)
+		if err != nil {
+			t.Fatalf("Load: %s", err)
+		}
+		wantPos := int64(0)
+		if cid == newCID {
+			wantPos = 5
+		}
+		mustEqual(t, pos.LastPos, wantPos, fmt.Sprintf("saved pos of %v", cid))
+	}
+}
+
+func TestConnMap_CloseConnForgetsSavedPosition(t *testing.T) {
+	cm := NewConnMap(false, time.Hour)
+	store := &memoryConnStore{}
+	cm.SetConnStore(store)
+	liveCID := ConnID{UserID: alice, DeviceID: "A", CID: "live"}
+	savedCID := ConnID{UserID: alice, DeviceID: "A", CID: "saved"}
+	_, cancel := context.WithCancel(context.Background())
+	conn := cm.CreateConn(liveCID, cancel, func() ConnHandler {
+		return &mockConnHandler{}
+	})
+	store.Save(liveCID, ConnPosition{LastPos: 5})
+	// saved before a restart, so not in memory
+	store.Save(savedCID, ConnPosition{LastPos: 7})
+
+	mustEqual(t, cm.CloseConn(liveCID), true, "CloseConn of a live conn")
+	mustEqual(t, conn.handler.(*mockConnHandler).isDestroyed.Load(), true, "live conn was not destroyed")
+	mustEqual(t, cm.CloseConn(savedCID), true, "CloseConn of a saved conn")
+	for _, cid := range []ConnID{liveCID, savedCID} {
+		pos, err := store.Load(cid)
+		if err != nil {
+			t.Fatalf("Load: %s", err)
+		}
+		mustEqual(t, pos.LastPos, int64(0), fmt.Sprintf("saved pos of %v", cid))
+	}
+	// there is nothing left to close
+	mustEqual(t, cm.CloseConn(liveCID), false, "CloseConn of a closed conn")
+	mustEqual(t, cm.CloseConn(savedCID), false, "CloseConn of a forgotten conn")
+}
+
+// Test that a connection closed whilst a request is long-polling cannot be resumed once the
+// request finishes.
+func TestConnMap_CloseConnWhilstLongPolling(t *testing.T) {
+	ctx := context.Background()
+	cm := NewConnMap(false, time.Hour)
+	store := &memoryConnStore{}
+	cm.SetConnStore(store)
+	cid := ConnID{UserID: alice, DeviceID: "A", CID: "polling"}
+	polling := make(chan struct{})
+	release := make(chan struct{})
+	count := 0
+	_, cancel := context.WithCancel(ctx)
+	conn := cm.CreateConn(cid, cancel, func() ConnHandler {
+		return &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+			count++
+			if count > 1 {
+				close(polling)
+				<-release
+			}
+			return &Response{
+				Lists: map[string]ResponseList{"a": {Count: count}},
+			}, nil
+		}}
+	})
+	res, herr := conn.OnIncomingRequest(ctx, &Request{}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, res.Pos, 1)
+	saved, err := store.Load(cid)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	mustEqual(t, saved.LastPos, int64(1), "saved pos before closing")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.OnIncomingRequest(ctx, &Request{pos: 1}, time.Now())
+	}()
+	<-polling
+	mustEqual(t, cm.CloseConn(cid), true, "CloseConn of a long-polling conn")
+	close(release)
+	<-done
+
+	// the request finishing must not save the position the connection was closed at
+	saved, err = store.Load(cid)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	mustEqual(t, saved.LastPos, int64(0), "saved pos after the request finished")
+	if cm.Conn(cid) != nil {
+		t.Fatalf("closed connection is still returned")
+	}
+}
+
+func TestConnMap_Metrics(t *testing.T) {
+	cm := NewConnMap(true, time.Minute)
+	defer cm.Teardown()
+	ctx := context.Background()
+	newConn := func(cid ConnID) *Conn {
+		_, cancel := context.WithCancel(ctx)
+		return cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+				return &Response{}, nil
+			}}
+		})
+	}
+	connA := newConn(ConnID{UserID: alice, DeviceID: "A"})
+	connB := newConn(ConnID{UserID: bob, DeviceID: "B"})
+
+	mustRequest := func(conn *Conn, pos int64) {
+		t.Helper()
+		_, herr := conn.OnIncomingRequest(ctx, &Request{pos: pos}, time.Now())
+		assertNoError(t, herr)
+	}
+	mustRequest(connA, 0) // initial, buffers pos 1
+	mustRequest(connA, 1) // live, buffers pos 2
+	mustRequest(connA, 1) // retransmit of pos 1
+	mustRequest(connB, 0)
+	// connA has pos 1 and 2 buffered, connB has pos 1
+	mustEqual(t, testutil.ToFloat64(cm.bufferedResponses), 3, "buffered_responses mismatch")
+
+	if _, herr := connB.OnIncomingRequest(ctx, &Request{pos: 31415}, time.Now()); herr == nil {
+		t.Fatalf("unknown pos was accepted")
+	}
+	mustEqual(t, testutil.ToFloat64(cm.connMetrics.unknownPos), 1, "unknown_pos mismatch")
+
+	// new params for pos 1 are processed and buffer pos 3, then pos 3 is returned from the buffer
+	subs := map[string]RoomSubscription{"!foo:bar": {TimelineLimit: 1}}
+	_, herr := connA.OnIncomingRequest(ctx, &Request{pos: 1, RoomSubscriptions: subs}, time.Now())
+	assertNoError(t, herr)
+	res, herr := connA.OnIncomingRequest(ctx, &Request{pos: 2, RoomSubscriptions: subs}, time.Now())
+	assertNoError(t, herr)
+	assertPos(t, res.Pos, 3)
+
+	for requestType, want := range map[string]uint64{"initial": 2, "live": 1, "retransmit": 1, "changed": 1, "buffered": 1, "unknown_pos": 1} {
+		var m dto.Metric
+		if err := cm.connMetrics.requestDuration.WithLabelValues(requestType).(prometheus.Metric).Write(&m); err != nil {
+			t.Fatalf("failed to read %s request durations: %s", requestType, err)
+		}
+		mustEqual(t, m.GetHistogram().GetSampleCount(), want, requestType+" request count mismatch")
+	}
+	// observed for every buffered response
+	var m dto.Metric
+	if err := cm.connMetrics.unACKedResponses.Write(&m); err != nil {
+		t.Fatalf("failed to read unacked responses: %s", err)
+	}
+	mustEqual(t, m.GetHistogram().GetSampleCount(), uint64(4), "unacked responses count mismatch")
+}
+
+func TestConnMap_Shutdown(t *testing.T) {
+	cm := NewConnMap(false, time.Minute)
+	ctx := context.Background()
+	newConn := func(cid ConnID) *Conn {
+		_, cancel := context.WithCancel(ctx)
+		return cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+				return &Response{}, nil
+			}}
+		})
+	}
+	before := newConn(ConnID{UserID: alice, DeviceID: "A"})
+	if err := cm.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %s", err)
+	}
+	after := newConn(ConnID{UserID: bob, DeviceID: "B"})
+	for _, conn := range []*Conn{before, after} {
+		if !conn.shuttingDown.Load() {
+			t.Errorf("conn %s was not shut down", conn.ConnID.String())
+		}
+	}
+}
+
+// Test that connections can be snapshotted whilst a request is long-polling on them.
+func TestConnMap_Snapshot(t *testing.T) {
+	cm := NewConnMap(false, time.Minute)
+	ctx := context.Background()
+	longPolling := make(chan struct{})
+	finishLongPoll := make(chan struct{})
+	newConn := func(cid ConnID) *Conn {
+		_, cancel := context.WithCancel(ctx)
+		return cm.CreateConn(cid, cancel, func() ConnHandler {
+			return &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, isInitial bool) (*Response, error) {
+				if req.pos == 2 {
+					close(longPolling)
+					<-finishLongPoll
+				}
+				return &Response{}, nil
+			}}
+		})
+	}
+	aliceCID := ConnID{UserID: alice, DeviceID: "A"}
+	bobCID := ConnID{UserID: bob, DeviceID: "B"}
+	aliceConn := newConn(aliceCID)
+	newConn(bobCID)
+	for pos := int64(0); pos < 2; pos++ {
+		_, herr := aliceConn.OnIncomingRequest(ctx, &Request{pos: pos}, time.Now())
+		assertNoError(t, herr)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, herr := aliceConn.OnIncomingRequest(ctx, &Request{pos: 2}, time.Now())
+		assertNoError(t, herr)
+	}()
+	<-longPolling
+
+	snapshots := cm.Snapshot()
+	if len(snapshots) != 2 {
+		t.Fatalf("got %d snapshots, want 2", len(snapshots))
+	}
+	got := snapshots[0]
+	mustEqual(t, got.ConnID, aliceCID, "snapshots are not sorted")
+	mustEqual(t, got.LastPos, int64(2), "last pos")
+	// the response for pos 2 is kept in case the client retries
+	mustEqual(t, got.BufferedResponses, 1, "buffered responses")
+	if got.LastSeen.IsZero() || got.Idle < 0 {
+		t.Errorf("got last seen %v idle %v", got.LastSeen, got.Idle)
+	}
+	mustEqual(t, snapshots[1].ConnID, bobCID, "snapshots are not sorted")
+	mustEqual(t, snapshots[1].LastPos, int64(0), "last pos")
+
+	close(finishLongPoll)
+	<-done
+	mustEqual(t, aliceConn.Snapshot().LastPos, int64(3), "last pos after long poll")
+}
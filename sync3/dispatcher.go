@@ -24,6 +24,9 @@ type Receiver interface {
 	OnNewEvent(ctx context.Context, event *caches.EventData)
 	OnReceipt(ctx context.Context, receipt internal.Receipt)
 	OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage)
+	// OnPresence is called with the m.presence event of userID. roomIDs are the joined rooms the
+	// receiver's user shares with userID, or nil for global listeners.
+	OnPresence(ctx context.Context, userID string, presenceEvent json.RawMessage, roomIDs []string)
 	// OnRegistered is called after a successful call to Dispatcher.Register
 	OnRegistered(ctx context.Context) error
 }
@@ -169,9 +172,21 @@ func (d *Dispatcher) OnNewInitialRoomState(ctx context.Context, roomID string, s
 
 func (d *Dispatcher) OnNewEvent(
 	ctx context.Context, roomID string, event json.RawMessage, nid int64,
+) {
+	d.onNewEvent(ctx, d.newEventData(event, roomID, nid))
+}
+
+// OnNewEventAfterGap is OnNewEvent for an event whose previous timeline events are not known, as
+// the homeserver skipped them in a gappy sync v2 timeline.
+func (d *Dispatcher) OnNewEventAfterGap(
+	ctx context.Context, roomID string, event json.RawMessage, nid int64,
 ) {
 	ed := d.newEventData(event, roomID, nid)
+	ed.MissingPrevious = true
+	d.onNewEvent(ctx, ed)
+}
 
+func (d *Dispatcher) onNewEvent(ctx context.Context, ed *caches.EventData) {
 	// update the tracker
 	targetUser := ""
 	membership := ""
@@ -239,6 +254,50 @@ func (d *Dispatcher) OnEphemeralEvent(ctx context.Context, roomID string, ephEve
 	}
 }
 
+// OnPresence notifies users who share a joined room with userID, and userID themselves, of their
+// presence.
+func (d *Dispatcher) OnPresence(ctx context.Context, userID string, presenceEvent json.RawMessage) {
+	userToSharedRooms := make(map[string][]string)
+	for _, roomID := range d.jrt.JoinedRoomsForUser(userID) {
+		notifyUserIDs, _ := d.jrt.JoinedUsersForRoom(roomID, func(joinedUserID string) bool {
+			if joinedUserID == DispatcherAllUsers {
+				return false // safety guard to prevent dupe global callbacks
+			}
+			return d.ReceiverForUser(joinedUserID) != nil
+		})
+		for _, notifyUserID := range notifyUserIDs {
+			userToSharedRooms[notifyUserID] = append(userToSharedRooms[notifyUserID], roomID)
+		}
+	}
+	if _, exists := userToSharedRooms[userID]; !exists && d.ReceiverForUser(userID) != nil {
+		userToSharedRooms[userID] = []string{}
+	}
+
+	d.userToReceiverMu.RLock()
+	defer d.userToReceiverMu.RUnlock()
+
+	// global listeners (invoke before per-user listeners so caches can update)
+	listener := d.userToReceiver[DispatcherAllUsers]
+	if listener != nil {
+		listener.OnPresence(ctx, userID, presenceEvent, nil)
+	}
+
+	// poke user caches OnPresence which then pokes ConnState
+	for notifyUserID, roomIDs := range userToSharedRooms {
+		l := d.userToReceiver[notifyUserID]
+		if l == nil {
+			continue
+		}
+		l.OnPresence(ctx, userID, presenceEvent, roomIDs)
+	}
+}
+
+// JoinedUsersForRoom returns the users joined to the room, according to the dispatcher.
+func (d *Dispatcher) JoinedUsersForRoom(roomID string) []string {
+	userIDs, _ := d.jrt.JoinedUsersForRoom(roomID, nil)
+	return userIDs
+}
+
 func (d *Dispatcher) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	notifyUserIDs, _ := d.jrt.JoinedUsersForRoom(receipt.RoomID, func(userID string) bool {
 		if userID == DispatcherAllUsers {
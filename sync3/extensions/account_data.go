@@ -3,6 +3,7 @@ package extensions
 import (
 	"context"
 	"encoding/json"
+	"strconv"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
@@ -12,16 +13,34 @@ import (
 // Client created request params
 type AccountDataRequest struct {
 	Core
+	ChangesOnly
+	// If set, only account data of these event types is sent, for both global and room account
+	// data, e.g ["m.tag", "m.fully_read"]. Unset leaves it unchanged, [] sends every type.
+	Types []string `json:"types,omitempty"`
 }
 
 func (r *AccountDataRequest) Name() string {
 	return "AccountDataRequest"
 }
 
+func (r *AccountDataRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*AccountDataRequest)
+	r.ChangesOnly.applyDelta(&next.ChangesOnly)
+	if next.Types != nil {
+		r.Types = next.Types
+	}
+}
+
 // Server response
 type AccountDataResponse struct {
 	Global []json.RawMessage            `json:"global,omitempty"`
 	Rooms  map[string][]json.RawMessage `json:"rooms,omitempty"`
+	// The position to reconnect from with `initial: false`. Only set when the connection starts.
+	Pos string `json:"pos,omitempty"`
+	// True if the client asked for changes only but this is a full snapshot, because `since`
+	// could not be used.
+	Full bool `json:"full,omitempty"`
 	// which rooms have had account data loaded from the DB in this response
 	loadedRooms map[string]bool
 }
@@ -41,15 +60,48 @@ func accountEventsAsJSON(events []state.AccountData) []json.RawMessage {
 	return j
 }
 
+// changedAccountData removes account data the client already has when only sending changes.
+func (r *AccountDataRequest) changedAccountData(events []state.AccountData) []state.AccountData {
+	if r.changesSince == 0 {
+		return events
+	}
+	changed := make([]state.AccountData, 0, len(events))
+	for _, ev := range events {
+		if ev.ID > r.changesSince {
+			changed = append(changed, ev)
+		}
+	}
+	return changed
+}
+
+// wantedAccountData removes account data of types the client did not ask for.
+func (r *AccountDataRequest) wantedAccountData(events []state.AccountData) []state.AccountData {
+	if len(r.Types) == 0 {
+		return events
+	}
+	wanted := make([]state.AccountData, 0, len(events))
+	for _, ev := range events {
+		for _, evType := range r.Types {
+			if ev.Type == evType {
+				wanted = append(wanted, ev)
+				break
+			}
+		}
+	}
+	return wanted
+}
+
 func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
 	var globalMsgs []json.RawMessage
 	roomToMsgs := map[string][]json.RawMessage{}
 	switch update := up.(type) {
 	case *caches.AccountDataUpdate:
-		globalMsgs = accountEventsAsJSON(update.AccountData)
+		globalMsgs = accountEventsAsJSON(r.wantedAccountData(update.AccountData))
 	case *caches.RoomAccountDataUpdate:
 		if r.RoomInScope(update.RoomID(), extCtx) {
-			roomToMsgs[update.RoomID()] = accountEventsAsJSON(update.AccountData)
+			if wanted := r.wantedAccountData(update.AccountData); len(wanted) > 0 {
+				roomToMsgs[update.RoomID()] = accountEventsAsJSON(wanted)
+			}
 		}
 	case caches.RoomUpdate:
 		if !r.RoomInScope(update.RoomID(), extCtx) {
@@ -64,11 +116,12 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 				// for the same room, we could send dupe room account data if we didn't do this check.
 				return
 			}
-			roomAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, update.RoomID())
+			roomAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, r.Types, update.RoomID())
 			if err != nil {
 				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.RoomID()).Msg("failed to fetch room account data")
 				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 			} else {
+				roomAccountData = r.changedAccountData(roomAccountData)
 				if len(roomAccountData) > 0 { // else we can end up with `null` not `[]`
 					roomToMsgs[update.RoomID()] = accountEventsAsJSON(roomAccountData)
 				}
@@ -92,28 +145,37 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 }
 
 func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
-	roomIDs := make([]string, len(extCtx.RoomIDToTimeline))
-	i := 0
+	roomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
 	for roomID := range extCtx.RoomIDToTimeline {
 		if r.RoomInScope(roomID, extCtx) {
-			roomIDs[i] = roomID
-			i++
+			roomIDs = append(roomIDs, roomID)
 		}
 	}
 	extRes := &AccountDataResponse{
 		Rooms:       make(map[string][]json.RawMessage),
 		loadedRooms: make(map[string]bool),
 	}
+	if extCtx.IsInitial {
+		// take the position before loading anything so nothing can be missed on reconnect
+		latestID, err := extCtx.Store.LatestAccountDataID(extCtx.UserID)
+		if err != nil {
+			logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch latest account data position")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		} else {
+			extRes.Full = r.startConnection(latestID)
+			extRes.Pos = strconv.FormatInt(latestID, 10)
+		}
+	}
 	// room account data needs to be sent every time the user scrolls the list to get new room IDs
 	// TODO: remember which rooms the client has been told about
 	if len(roomIDs) > 0 {
-		roomsAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, roomIDs...)
+		roomsAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, r.Types, roomIDs...)
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Strs("rooms", roomIDs).Msg("failed to fetch room account data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		} else {
 			extRes.Rooms = make(map[string][]json.RawMessage)
-			for _, ad := range roomsAccountData {
+			for _, ad := range r.changedAccountData(roomsAccountData) {
 				extRes.Rooms[ad.RoomID] = append(extRes.Rooms[ad.RoomID], ad.Data)
 				extRes.loadedRooms[ad.RoomID] = true
 			}
@@ -121,15 +183,15 @@ func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response,
 	}
 	// global account data is only sent on the first connection, then we live stream
 	if extCtx.IsInitial {
-		globalAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID)
+		globalAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, r.Types)
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch global account data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		} else {
-			extRes.Global = accountEventsAsJSON(globalAccountData)
+			extRes.Global = accountEventsAsJSON(r.changedAccountData(globalAccountData))
 		}
 	}
-	if len(extRes.Rooms) > 0 || len(extRes.Global) > 0 {
+	if len(extRes.Rooms) > 0 || len(extRes.Global) > 0 || extRes.Pos != "" {
 		res.AccountData = extRes
 	}
 }
@@ -112,3 +112,59 @@ func TestLiveAccountDataAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.AccountData.Global, wantGlobalAccountData)
 	}
 }
+
+// Test that only account data of the requested types is sent, and that types are sticky.
+func TestLiveAccountDataTypes(t *testing.T) {
+	boolTrue := true
+	ext := &AccountDataRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+		Types: []string{"m.tag", "m.direct"},
+	}
+	ext.ApplyDelta(&AccountDataRequest{})
+	var res Response
+	extCtx := Context{
+		AllSubscribedRooms: []string{roomA},
+	}
+	tag := state.AccountData{Type: "m.tag", Data: []byte(`{"type":"m.tag"}`)}
+	fullyRead := state.AccountData{Type: "m.fully_read", Data: []byte(`{"type":"m.fully_read"}`)}
+	direct := state.AccountData{Type: "m.direct", Data: []byte(`{"type":"m.direct"}`)}
+	pushRules := state.AccountData{Type: "m.push_rules", Data: []byte(`{"type":"m.push_rules"}`)}
+	roomUpdate := func(roomID string, datas ...state.AccountData) *caches.RoomAccountDataUpdate {
+		return &caches.RoomAccountDataUpdate{
+			RoomUpdate: &dummyRoomUpdate{
+				roomID:         roomID,
+				globalMetadata: &internal.RoomMetadata{RoomID: roomID},
+			},
+			AccountData: datas,
+		}
+	}
+	ext.AppendLive(ctx, &res, extCtx, roomUpdate(roomA, tag, fullyRead))
+	ext.AppendLive(ctx, &res, extCtx, roomUpdate(roomA, fullyRead))
+	// out of scope rooms get nothing, even for wanted types
+	ext.AppendLive(ctx, &res, extCtx, roomUpdate(roomB, tag))
+	ext.AppendLive(ctx, &res, extCtx, &caches.AccountDataUpdate{AccountData: []state.AccountData{pushRules, direct}})
+	if res.AccountData == nil {
+		t.Fatalf("account_data response is empty")
+	}
+	wantRooms := map[string][]json.RawMessage{
+		roomA: {tag.Data},
+	}
+	if !reflect.DeepEqual(res.AccountData.Rooms, wantRooms) {
+		t.Fatalf("rooms: got %s want %s", res.AccountData.Rooms, wantRooms)
+	}
+	if want := []json.RawMessage{direct.Data}; !reflect.DeepEqual(res.AccountData.Global, want) {
+		t.Fatalf("global: got %s want %s", res.AccountData.Global, want)
+	}
+
+	// no types means every type
+	ext.ApplyDelta(&AccountDataRequest{Types: []string{}})
+	res = Response{}
+	ext.AppendLive(ctx, &res, extCtx, roomUpdate(roomA, fullyRead))
+	if res.AccountData == nil || len(res.AccountData.Rooms[roomA]) != 1 {
+		t.Fatalf("all types: got %+v", res.AccountData)
+	}
+}
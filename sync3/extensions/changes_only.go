@@ -0,0 +1,56 @@
+package extensions
+
+import (
+	"strconv"
+)
+
+// ChangesOnly is a mixin for extensions which can resume from a position stored by the client on
+// a previous connection, for clients which keep the extension's data locally and don't want the
+// full snapshot again when they reconnect.
+//
+// Every extension using this returns `pos` on the first response of a connection. A client which
+// reconnects with `initial: false` and that position as `since` is only sent data which changed
+// after it. The position is taken when the connection starts, so data changed during the
+// connection is sent again on reconnect: this is harmless as these extensions only send the latest
+// value of each item.
+//
+// If `since` cannot be used to compute the changes - it is missing, malformed, or newer than
+// anything the proxy has (e.g because the proxy's database was reset) - a full snapshot is sent as
+// if `initial` were true, with `full: true` so the client knows to replace its stored state rather
+// than merging into it.
+type ChangesOnly struct {
+	// If false, do not send a full snapshot when the connection starts, only changes after Since.
+	// Defaults to true.
+	Initial *bool `json:"initial,omitempty"`
+	// The `pos` from the first response of a previous connection.
+	Since string `json:"since,omitempty"`
+
+	// The position to send changes after for the lifetime of this connection, set when the
+	// connection starts. 0 means send everything.
+	changesSince int64
+}
+
+func (c *ChangesOnly) applyDelta(next *ChangesOnly) {
+	if next.Initial != nil {
+		c.Initial = next.Initial
+	}
+	if next.Since != "" {
+		c.Since = next.Since
+	}
+}
+
+// startConnection works out what to send on this connection, given the latest position of the
+// extension's data. Returns true if the client asked for changes only but must be sent a full
+// snapshot instead.
+func (c *ChangesOnly) startConnection(latest int64) (full bool) {
+	c.changesSince = 0
+	if c.Initial == nil || *c.Initial {
+		return false
+	}
+	since, err := strconv.ParseInt(c.Since, 10, 64)
+	if err != nil || since < 0 || since > latest {
+		return true
+	}
+	c.changesSince = since
+	return false
+}
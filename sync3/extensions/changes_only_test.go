@@ -0,0 +1,65 @@
+package extensions
+
+import (
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+func TestChangesOnlyStartConnection(t *testing.T) {
+	boolFalse := false
+	testCases := []struct {
+		name             string
+		req              ChangesOnly
+		latest           int64
+		wantFull         bool
+		wantChangesSince int64
+	}{
+		{name: "initial snapshot by default", req: ChangesOnly{Since: "5"}, latest: 10},
+		{name: "initial snapshot", req: ChangesOnly{Initial: &boolTrue, Since: "5"}, latest: 10},
+		{name: "changes only", req: ChangesOnly{Initial: &boolFalse, Since: "5"}, latest: 10, wantChangesSince: 5},
+		{name: "changes only, nothing changed", req: ChangesOnly{Initial: &boolFalse, Since: "10"}, latest: 10, wantChangesSince: 10},
+		{name: "changes only without since", req: ChangesOnly{Initial: &boolFalse}, latest: 10, wantFull: true},
+		{name: "changes only with malformed since", req: ChangesOnly{Initial: &boolFalse, Since: "abc"}, latest: 10, wantFull: true},
+		{name: "changes only with negative since", req: ChangesOnly{Initial: &boolFalse, Since: "-1"}, latest: 10, wantFull: true},
+		{name: "changes only with since from the future", req: ChangesOnly{Initial: &boolFalse, Since: "11"}, latest: 10, wantFull: true},
+	}
+	for _, tc := range testCases {
+		// the position from a previous connection must not leak into this one
+		tc.req.changesSince = 99
+		full := tc.req.startConnection(tc.latest)
+		if full != tc.wantFull {
+			t.Errorf("%s: got full=%v want %v", tc.name, full, tc.wantFull)
+		}
+		if tc.req.changesSince != tc.wantChangesSince {
+			t.Errorf("%s: got changesSince=%d want %d", tc.name, tc.req.changesSince, tc.wantChangesSince)
+		}
+	}
+}
+
+func TestChangesOnlyApplyDelta(t *testing.T) {
+	boolFalse := false
+	req := &AccountDataRequest{}
+	req.ApplyDelta(&AccountDataRequest{ChangesOnly: ChangesOnly{Initial: &boolFalse, Since: "5"}})
+	// sticky
+	req.ApplyDelta(&AccountDataRequest{Core: Core{Enabled: &boolTrue}})
+	if req.Initial == nil || *req.Initial || req.Since != "5" {
+		t.Fatalf("got initial=%v since=%q want false and 5", req.Initial, req.Since)
+	}
+	if !ExtensionEnabled(req) {
+		t.Fatalf("core fields were not applied")
+	}
+}
+
+func TestAccountDataChangesOnly(t *testing.T) {
+	events := []state.AccountData{{ID: 3, Type: "a"}, {ID: 7, Type: "b"}, {ID: 5, Type: "c"}}
+	req := &AccountDataRequest{}
+	if got := req.changedAccountData(events); len(got) != 3 {
+		t.Fatalf("full snapshot: got %d events want 3", len(got))
+	}
+	req.changesSince = 5
+	got := req.changedAccountData(events)
+	if len(got) != 1 || got[0].Type != "b" {
+		t.Fatalf("changes only: got %+v want only b", got)
+	}
+}
@@ -0,0 +1,86 @@
+package extensions
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Client created request params
+type CountChangesRequest struct {
+	Core
+	// set when this extension is first enabled on a connection, so we know to send a snapshot
+	// of all counts rather than just the changes.
+	sendSnapshot bool
+}
+
+func (r *CountChangesRequest) Name() string {
+	return "CountChangesRequest"
+}
+
+func (r *CountChangesRequest) InterpretAsInitial() {
+	r.Core.InterpretAsInitial()
+	r.sendSnapshot = true
+}
+
+type RoomCounts struct {
+	NotificationCount int `json:"notification_count"`
+	HighlightCount    int `json:"highlight_count"`
+}
+
+// Server response
+type CountChangesResponse struct {
+	// room_id -> counts. The first response after this extension is enabled contains every joined
+	// room with non-zero counts: rooms not in this map have no notifications. Subsequent responses
+	// only contain rooms whose counts have changed since the previous response. This is not scoped
+	// by lists or room subscriptions as it covers every room on the account.
+	Rooms map[string]RoomCounts `json:"rooms,omitempty"`
+}
+
+func (r *CountChangesResponse) HasData(isInitial bool) bool {
+	return len(r.Rooms) > 0
+}
+
+func (r *CountChangesRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.UnreadCountUpdate)
+	if !ok {
+		return
+	}
+	userRoomData := update.UserRoomMetadata()
+	if res.CountChanges == nil {
+		res.CountChanges = &CountChangesResponse{
+			Rooms: make(map[string]RoomCounts),
+		}
+	}
+	// aggregate: the latest counts for this room win
+	res.CountChanges.Rooms[update.RoomID()] = RoomCounts{
+		NotificationCount: userRoomData.NotificationCount,
+		HighlightCount:    userRoomData.HighlightCount,
+	}
+}
+
+func (r *CountChangesRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	if !r.sendSnapshot && !extCtx.IsInitial {
+		return
+	}
+	r.sendSnapshot = false
+	rooms := make(map[string]RoomCounts)
+	err := extCtx.Store.UnreadTable.SelectAllNonZeroCountsForUser(extCtx.UserID, func(roomID string, highlightCount, notificationCount int) {
+		rooms[roomID] = RoomCounts{
+			NotificationCount: notificationCount,
+			HighlightCount:    highlightCount,
+		}
+	})
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Msg("failed to load unread counts")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if len(rooms) == 0 {
+		return
+	}
+	res.CountChanges = &CountChangesResponse{
+		Rooms: rooms,
+	}
+}
@@ -0,0 +1,80 @@
+package extensions
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+func TestCountChangesLive(t *testing.T) {
+	boolTrue := true
+	ext := &CountChangesRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+	}
+	countUpdate := func(roomID string, notifs, highlights int) *caches.UnreadCountUpdate {
+		return &caches.UnreadCountUpdate{
+			RoomUpdate: &dummyRoomUpdate{
+				roomID: roomID,
+				userRoomData: &caches.UserRoomData{
+					NotificationCount: notifs,
+					HighlightCount:    highlights,
+				},
+			},
+		}
+	}
+	var res Response
+	extCtx := Context{}
+	ext.AppendLive(ctx, &res, extCtx, countUpdate(roomA, 1, 0))
+	ext.AppendLive(ctx, &res, extCtx, countUpdate(roomB, 3, 1))
+	ext.AppendLive(ctx, &res, extCtx, countUpdate(roomA, 2, 1)) // clobbers the first update
+	// other updates are ignored
+	ext.AppendLive(ctx, &res, extCtx, &caches.RoomEventUpdate{
+		RoomUpdate: &dummyRoomUpdate{roomID: roomC, userRoomData: &caches.UserRoomData{NotificationCount: 5}},
+	})
+	if res.CountChanges == nil || !res.CountChanges.HasData(false) {
+		t.Fatalf("count changes response is empty")
+	}
+	want := map[string]RoomCounts{
+		roomA: {NotificationCount: 2, HighlightCount: 1},
+		roomB: {NotificationCount: 3, HighlightCount: 1},
+	}
+	if !reflect.DeepEqual(res.CountChanges.Rooms, want) {
+		t.Fatalf("got %+v want %+v", res.CountChanges.Rooms, want)
+	}
+}
+
+// Test that a snapshot is only sent when the extension is first enabled
+func TestCountChangesSnapshot(t *testing.T) {
+	boolTrue := true
+	var curr Request
+	curr = curr.ApplyDelta(&Request{
+		CountChanges: &CountChangesRequest{
+			Core: Core{
+				Enabled: &boolTrue,
+			},
+		},
+	})
+	if !curr.CountChanges.sendSnapshot {
+		t.Fatalf("enabling the extension did not request a snapshot")
+	}
+	curr.CountChanges.sendSnapshot = false
+	curr = curr.ApplyDelta(&Request{
+		CountChanges: &CountChangesRequest{
+			Core: Core{
+				Enabled: &boolTrue,
+			},
+		},
+	})
+	if curr.CountChanges.sendSnapshot {
+		t.Fatalf("updating an enabled extension requested a snapshot")
+	}
+	// with no snapshot to send, ProcessInitial does not touch the database
+	var res Response
+	curr.CountChanges.ProcessInitial(ctx, &res, Context{IsInitial: false})
+	if res.CountChanges != nil {
+		t.Fatalf("unexpected count changes: %+v", res.CountChanges)
+	}
+}
@@ -70,7 +70,14 @@ func (r *E2EERequest) ProcessInitial(ctx context.Context, res *Response, extCtx
 		extRes.OTKCounts = dd.OTKCounts
 		hasUpdates = true
 	}
-	changed, left := internal.DeviceListChangesArrays(dd.DeviceLists.Sent)
+	// Non-initial requests swap New to Sent, returning the device data from before the swap, so
+	// New is what has changed since the last response. Nothing is swapped on initial requests:
+	// the client may have lost the last response as well as missed the changes since, so send both.
+	deviceLists := dd.DeviceLists.New
+	if extCtx.IsInitial {
+		deviceLists = dd.DeviceLists.SentAndNew()
+	}
+	changed, left := internal.DeviceListChangesArrays(deviceLists)
 	if len(changed) > 0 || len(left) > 0 {
 		extRes.DeviceLists = &E2EEDeviceList{
 			Changed: changed,
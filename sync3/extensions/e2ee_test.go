@@ -0,0 +1,76 @@
+package extensions
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+type mockE2EEFetcher struct {
+	dd *internal.DeviceData
+}
+
+func (f mockE2EEFetcher) DeviceData(ctx context.Context, userID, deviceID string, isInitial bool) *internal.DeviceData {
+	return f.dd
+}
+
+// Test that initial requests replay the device list changes which were last sent as well as those
+// since, and that other requests only send the changes since.
+func TestE2EEDeviceLists(t *testing.T) {
+	boolTrue := true
+	ext := &E2EERequest{
+		Core: Core{Enabled: &boolTrue},
+	}
+	dd := &internal.DeviceData{
+		OTKCounts:        map[string]int{"signed_curve25519": 10},
+		FallbackKeyTypes: []string{"signed_curve25519"},
+		DeviceLists: internal.DeviceLists{
+			Sent: internal.ToDeviceListChangesMap([]string{"@alice:localhost", "@bob:localhost"}, nil),
+			New:  internal.ToDeviceListChangesMap([]string{"@charlie:localhost"}, []string{"@bob:localhost"}),
+		},
+	}
+	extCtx := Context{
+		Handler:   &Handler{E2EEFetcher: mockE2EEFetcher{dd: dd}},
+		IsInitial: true,
+	}
+	var res Response
+	ext.ProcessInitial(ctx, &res, extCtx)
+	if res.E2EE == nil || res.E2EE.DeviceLists == nil {
+		t.Fatalf("initial: got no device lists: %+v", res.E2EE)
+	}
+	assertDeviceLists(t, "initial", res.E2EE.DeviceLists, []string{"@alice:localhost", "@charlie:localhost"}, []string{"@bob:localhost"})
+	if !reflect.DeepEqual(res.E2EE.OTKCounts, map[string]int(dd.OTKCounts)) || res.E2EE.FallbackKeyTypes == nil {
+		t.Fatalf("initial: got OTK counts %v fallback keys %v", res.E2EE.OTKCounts, res.E2EE.FallbackKeyTypes)
+	}
+
+	// unchanged OTK counts and fallback keys are not sent again
+	extCtx.IsInitial = false
+	res = Response{}
+	ext.ProcessInitial(ctx, &res, extCtx)
+	if res.E2EE == nil || res.E2EE.DeviceLists == nil {
+		t.Fatalf("incremental: got no device lists: %+v", res.E2EE)
+	}
+	assertDeviceLists(t, "incremental", res.E2EE.DeviceLists, []string{"@charlie:localhost"}, []string{"@bob:localhost"})
+	if res.E2EE.OTKCounts != nil || res.E2EE.FallbackKeyTypes != nil {
+		t.Fatalf("incremental: got OTK counts %v fallback keys %v", res.E2EE.OTKCounts, res.E2EE.FallbackKeyTypes)
+	}
+
+	dd.DeviceLists.New = nil
+	res = Response{}
+	ext.ProcessInitial(ctx, &res, extCtx)
+	if res.E2EE != nil {
+		t.Fatalf("no changes: got %+v", res.E2EE)
+	}
+}
+
+func assertDeviceLists(t *testing.T, msg string, got *E2EEDeviceList, wantChanged, wantLeft []string) {
+	t.Helper()
+	sort.Strings(got.Changed)
+	sort.Strings(got.Left)
+	if !reflect.DeepEqual(got.Changed, wantChanged) || !reflect.DeepEqual(got.Left, wantLeft) {
+		t.Fatalf("%s: got changed=%v left=%v want changed=%v left=%v", msg, got.Changed, got.Left, wantChanged, wantLeft)
+	}
+}
@@ -160,16 +160,21 @@ func ExtensionEnabled(r GenericRequest) bool {
 // To add new extensions, add a field here and return it in fields() whilst setting it correctly
 // in setFields().
 type Request struct {
-	ToDevice    *ToDeviceRequest    `json:"to_device"`
-	E2EE        *E2EERequest        `json:"e2ee"`
-	AccountData *AccountDataRequest `json:"account_data"`
-	Typing      *TypingRequest      `json:"typing"`
-	Receipts    *ReceiptsRequest    `json:"receipts"`
+	ToDevice     *ToDeviceRequest     `json:"to_device"`
+	E2EE         *E2EERequest         `json:"e2ee"`
+	AccountData  *AccountDataRequest  `json:"account_data"`
+	Typing       *TypingRequest       `json:"typing"`
+	Receipts     *ReceiptsRequest     `json:"receipts"`
+	CountChanges *CountChangesRequest `json:"count_changes"`
+	Threads      *ThreadsRequest      `json:"threads"`
+	MyReceipts   *MyReceiptsRequest   `json:"my_receipts"`
+	Presence     *PresenceRequest     `json:"presence"`
 }
 
 func (r *Request) fields() []GenericRequest {
 	return []GenericRequest{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.CountChanges, r.Threads, r.MyReceipts,
+		r.Presence,
 	}
 }
 
@@ -180,6 +185,20 @@ func (r *Request) setFields(fields []GenericRequest) {
 	r.AccountData = fields[2].(*AccountDataRequest)
 	r.Typing = fields[3].(*TypingRequest)
 	r.Receipts = fields[4].(*ReceiptsRequest)
+	r.CountChanges = fields[5].(*CountChangesRequest)
+	r.Threads = fields[6].(*ThreadsRequest)
+	r.MyReceipts = fields[7].(*MyReceiptsRequest)
+	r.Presence = fields[8].(*PresenceRequest)
+}
+
+// Names returns the JSON keys of all the extensions supported by this proxy.
+func Names() []string {
+	t := reflect.TypeOf(Request{})
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		names = append(names, t.Field(i).Tag.Get("json"))
+	}
+	return names
 }
 
 func (r Request) EnabledExtensions() (exts []GenericRequest) {
@@ -242,26 +261,48 @@ func (r *Request) InterpretAsInitial() {
 	if r.Receipts != nil {
 		r.Receipts.InterpretAsInitial()
 	}
+	if r.CountChanges != nil {
+		r.CountChanges.InterpretAsInitial()
+	}
+	if r.Threads != nil {
+		r.Threads.InterpretAsInitial()
+	}
+	if r.MyReceipts != nil {
+		r.MyReceipts.InterpretAsInitial()
+	}
+	if r.Presence != nil {
+		r.Presence.InterpretAsInitial()
+	}
 }
 
 // Response represents the top-level `extensions` key in the JSON response.
 //
 // To add a new extension, add a field here and in fields().
 type Response struct {
-	ToDevice    *ToDeviceResponse    `json:"to_device,omitempty"`
-	E2EE        *E2EEResponse        `json:"e2ee,omitempty"`
-	AccountData *AccountDataResponse `json:"account_data,omitempty"`
-	Typing      *TypingResponse      `json:"typing,omitempty"`
-	Receipts    *ReceiptsResponse    `json:"receipts,omitempty"`
+	ToDevice     *ToDeviceResponse     `json:"to_device,omitempty"`
+	E2EE         *E2EEResponse         `json:"e2ee,omitempty"`
+	AccountData  *AccountDataResponse  `json:"account_data,omitempty"`
+	Typing       *TypingResponse       `json:"typing,omitempty"`
+	Receipts     *ReceiptsResponse     `json:"receipts,omitempty"`
+	CountChanges *CountChangesResponse `json:"count_changes,omitempty"`
+	Threads      *ThreadsResponse      `json:"threads,omitempty"`
+	MyReceipts   *MyReceiptsResponse   `json:"my_receipts,omitempty"`
+	Presence     *PresenceResponse     `json:"presence,omitempty"`
+	// The extensions which were left out of this response because they exceeded the size limits.
+	Truncated []string `json:"truncated,omitempty"`
 }
 
 func (r Response) fields() []GenericResponse {
 	return []GenericResponse{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.CountChanges, r.Threads, r.MyReceipts,
+		r.Presence,
 	}
 }
 
 func (r Response) HasData(isInitial bool) bool {
+	if len(r.Truncated) > 0 {
+		return true
+	}
 	fields := r.fields()
 	for _, f := range fields {
 		if isNil(f) {
@@ -306,12 +347,15 @@ type Context struct {
 type HandlerInterface interface {
 	Handle(ctx context.Context, req Request, extCtx Context) (res Response)
 	HandleLiveUpdate(ctx context.Context, update caches.Update, req Request, res *Response, extCtx Context)
+	EnforceSizeLimits(ctx context.Context, res *Response)
 }
 
 type Handler struct {
-	Store       *state.Storage
-	E2EEFetcher E2EEFetcher
-	GlobalCache *caches.GlobalCache
+	Store           *state.Storage
+	E2EEFetcher     E2EEFetcher
+	PresenceFetcher PresenceFetcher
+	GlobalCache     *caches.GlobalCache
+	SizeLimits      SizeLimits
 }
 
 func (h *Handler) HandleLiveUpdate(ctx context.Context, update caches.Update, req Request, res *Response, extCtx Context) {
@@ -149,6 +149,11 @@ func TestExtension_ApplyDelta(t *testing.T) {
 					},
 					Limit: 42,
 				},
+				CountChanges: &CountChangesRequest{
+					Core: Core{
+						Enabled: &boolFalse,
+					},
+				},
 			},
 			next: &Request{
 				AccountData: &AccountDataRequest{
@@ -177,6 +182,11 @@ func TestExtension_ApplyDelta(t *testing.T) {
 					},
 					Since: "A",
 				},
+				CountChanges: &CountChangesRequest{
+					Core: Core{
+						Enabled: &boolTrue,
+					},
+				},
 			},
 			want: &Request{
 				AccountData: &AccountDataRequest{
@@ -206,6 +216,11 @@ func TestExtension_ApplyDelta(t *testing.T) {
 					Since: "A",
 					Limit: 42,
 				},
+				CountChanges: &CountChangesRequest{
+					Core: Core{
+						Enabled: &boolTrue,
+					},
+				},
 			},
 		},
 	}
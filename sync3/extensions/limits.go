@@ -0,0 +1,147 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// SizeLimitTotal is the key in SYNCV3_MAX_EXTENSION_BYTES for the limit on all extensions combined.
+const SizeLimitTotal = "total"
+
+// SizeLimitPriority is the order in which extensions are given space in a response. When the total
+// limit is tight, earlier extensions are kept before later ones are considered. Extensions needed
+// to decrypt messages come first, then persistent data, then ephemeral data which is superseded by
+// the next update anyway.
+var SizeLimitPriority = []string{
+	"e2ee", "to_device", "account_data", "my_receipts", "count_changes", "threads", "receipts", "typing", "presence",
+}
+
+// SizeLimits caps the number of bytes of JSON extensions can add to a response. 0 means no limit.
+//
+// The to-device extension is truncated to fit, and the rest of the messages are sent in later
+// responses. Other extensions which do not fit are left out of the response and listed in
+// `truncated`, so clients know that their view of that extension's data is incomplete.
+type SizeLimits struct {
+	// The maximum size of all extensions in a response combined.
+	Total int
+	// The maximum size of each extension, keyed by its JSON key e.g "to_device". Extensions not
+	// in this map are only limited by Total.
+	PerExtension map[string]int
+}
+
+// ParseSizeLimits parses a comma separated list of extension=bytes pairs e.g
+// "total=1048576,to_device=524288". The special extension SizeLimitTotal sets the total limit.
+func ParseSizeLimits(s string) (limits SizeLimits, err error) {
+	if s == "" {
+		return
+	}
+	known := make(map[string]bool)
+	for _, name := range Names() {
+		known[name] = true
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return SizeLimits{}, fmt.Errorf("%q is not of the form extension=bytes", pair)
+		}
+		bytes, err := strconv.Atoi(val)
+		if err != nil || bytes < 0 {
+			return SizeLimits{}, fmt.Errorf("invalid number of bytes for %s: %q", name, val)
+		}
+		if name == SizeLimitTotal {
+			limits.Total = bytes
+			continue
+		}
+		if !known[name] {
+			return SizeLimits{}, fmt.Errorf("unknown extension %q", name)
+		}
+		if limits.PerExtension == nil {
+			limits.PerExtension = make(map[string]int)
+		}
+		limits.PerExtension[name] = bytes
+	}
+	return limits, nil
+}
+
+// limitFor returns the most bytes this extension can use if it is the only extension in the
+// response, or math.MaxInt if there is no limit.
+func (l SizeLimits) limitFor(name string) int {
+	limit := math.MaxInt
+	if l.Total > 0 {
+		limit = l.Total
+	}
+	if perExtension := l.PerExtension[name]; perExtension > 0 && perExtension < limit {
+		limit = perExtension
+	}
+	return limit
+}
+
+// EnforceSizeLimits removes data from extensions in the response until they fit within the size
+// limits, giving space to extensions in SizeLimitPriority order. Must be called once the response
+// is complete, as live updates are aggregated into the response.
+func (h *Handler) EnforceSizeLimits(ctx context.Context, res *Response) {
+	if h.SizeLimits.Total == 0 && len(h.SizeLimits.PerExtension) == 0 {
+		return
+	}
+	remaining := math.MaxInt
+	if h.SizeLimits.Total > 0 {
+		remaining = h.SizeLimits.Total
+	}
+	fields := res.fieldsByName()
+	for _, name := range SizeLimitPriority {
+		field := fields[name]
+		if !field.IsValid() || field.IsNil() {
+			continue
+		}
+		limit := h.SizeLimits.limitFor(name)
+		if remaining < limit {
+			limit = remaining
+		}
+		size := jsonSize(field.Interface())
+		if size > limit {
+			if toDevice, ok := field.Interface().(*ToDeviceResponse); ok {
+				toDevice.truncate(limit)
+				size = jsonSize(toDevice)
+			} else {
+				internal.Logf(ctx, "extensions", "dropped %s: %d bytes exceeds limit of %d", name, size, limit)
+				field.Set(reflect.Zero(field.Type()))
+				res.Truncated = append(res.Truncated, name)
+				continue
+			}
+		}
+		remaining -= size
+		if remaining < 0 {
+			remaining = 0
+		}
+	}
+}
+
+// fieldsByName returns the extension fields in this response keyed by their JSON key.
+func (r *Response) fieldsByName() map[string]reflect.Value {
+	v := reflect.ValueOf(r).Elem()
+	t := v.Type()
+	fields := make(map[string]reflect.Value, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Type.Kind() != reflect.Ptr {
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[name] = v.Field(i)
+	}
+	return fields
+}
+
+func jsonSize(val interface{}) int {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
@@ -0,0 +1,140 @@
+package extensions
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseSizeLimits(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    SizeLimits
+		wantErr bool
+	}{
+		{input: "", want: SizeLimits{}},
+		{input: "total=1000", want: SizeLimits{Total: 1000}},
+		{input: "total=1000, to_device=500,typing=10", want: SizeLimits{
+			Total:        1000,
+			PerExtension: map[string]int{"to_device": 500, "typing": 10},
+		}},
+		{input: "to_device", wantErr: true},
+		{input: "to_device=-1", wantErr: true},
+		{input: "to_device=lots", wantErr: true},
+		{input: "unknown=100", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := ParseSizeLimits(tc.input)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("ParseSizeLimits(%q): want error, got %+v", tc.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSizeLimits(%q): %s", tc.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseSizeLimits(%q): got %+v want %+v", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestSizeLimitPriorityHasEveryExtension(t *testing.T) {
+	got := append([]string{}, SizeLimitPriority...)
+	want := Names()
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("SizeLimitPriority has %v, want %v", got, want)
+	}
+	fields := (&Response{}).fieldsByName()
+	for _, name := range want {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("Response has no field for extension %s", name)
+		}
+	}
+}
+
+func toDeviceMessages(n int) ([]json.RawMessage, []int64) {
+	msgs := make([]json.RawMessage, n)
+	positions := make([]int64, n)
+	for i := range msgs {
+		msgs[i] = json.RawMessage(`{"type":"m.room_key","content":{"key":"` + strings.Repeat("k", 80) + `"}}`)
+		positions[i] = int64(10 + i)
+	}
+	return msgs, positions
+}
+
+func TestEnforceSizeLimits(t *testing.T) {
+	newResponse := func() *Response {
+		msgs, positions := toDeviceMessages(5)
+		return &Response{
+			ToDevice: &ToDeviceResponse{
+				NextBatch: "14",
+				Events:    msgs,
+				deviceID:  "DEVICE",
+				positions: positions,
+			},
+			Typing: &TypingResponse{
+				Rooms: map[string]json.RawMessage{
+					roomA: json.RawMessage(`{"user_ids":["@alice:localhost"]}`),
+				},
+			},
+		}
+	}
+
+	// no limits: nothing changes
+	h := &Handler{}
+	res := newResponse()
+	h.EnforceSizeLimits(ctx, res)
+	if len(res.ToDevice.Events) != 5 || res.Typing == nil || res.Truncated != nil {
+		t.Fatalf("response changed without limits: %+v", res)
+	}
+
+	// the total limit fits 2 to-device messages, so typing is dropped
+	msgSize := len(res.ToDevice.Events[0])
+	h.SizeLimits = SizeLimits{Total: 2*msgSize + 50}
+	res = newResponse()
+	h.EnforceSizeLimits(ctx, res)
+	if len(res.ToDevice.Events) != 2 {
+		t.Fatalf("got %d to-device messages, want 2", len(res.ToDevice.Events))
+	}
+	if res.ToDevice.NextBatch != "11" {
+		t.Fatalf("got next_batch %s want 11", res.ToDevice.NextBatch)
+	}
+	if res.Typing != nil {
+		t.Fatalf("typing was not dropped: %+v", res.Typing)
+	}
+	if !reflect.DeepEqual(res.Truncated, []string{"typing"}) {
+		t.Fatalf("got truncated %v want [typing]", res.Truncated)
+	}
+	if !res.HasData(false) {
+		t.Fatalf("truncated response has no data")
+	}
+
+	// per-extension limits apply even when the total has room
+	h.SizeLimits = SizeLimits{Total: 10000, PerExtension: map[string]int{"to_device": msgSize + 50}}
+	res = newResponse()
+	h.EnforceSizeLimits(ctx, res)
+	if len(res.ToDevice.Events) != 1 || res.ToDevice.NextBatch != "10" {
+		t.Fatalf("got %d to-device messages up to %s, want 1 up to 10", len(res.ToDevice.Events), res.ToDevice.NextBatch)
+	}
+	if res.Typing == nil || res.Truncated != nil {
+		t.Fatalf("typing was dropped: truncated=%v", res.Truncated)
+	}
+
+	// at least one to-device message is always sent so the client makes progress
+	h.SizeLimits = SizeLimits{Total: 1}
+	res = newResponse()
+	h.EnforceSizeLimits(ctx, res)
+	if len(res.ToDevice.Events) != 1 || res.ToDevice.NextBatch != "10" {
+		t.Fatalf("got %d to-device messages up to %s, want 1 up to 10", len(res.ToDevice.Events), res.ToDevice.NextBatch)
+	}
+	if !reflect.DeepEqual(res.Truncated, []string{"typing"}) {
+		t.Fatalf("got truncated %v want [typing]", res.Truncated)
+	}
+}
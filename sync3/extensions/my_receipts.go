@@ -0,0 +1,126 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Client created request params. Unlike the receipts extension, this returns the user's own
+// receipts in every room they have sent a receipt in, so `lists` and `rooms` are ignored.
+type MyReceiptsRequest struct {
+	Core
+	ChangesOnly
+
+	// true once the user's receipts have been sent on this connection
+	sentInitial bool
+}
+
+func (r *MyReceiptsRequest) Name() string {
+	return "MyReceiptsRequest"
+}
+
+func (r *MyReceiptsRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	r.ChangesOnly.applyDelta(&gnext.(*MyReceiptsRequest).ChangesOnly)
+}
+
+// Server response
+type MyReceiptsResponse struct {
+	// room_id -> m.receipt ephemeral event containing only the user's own receipts, including
+	// their m.read.private receipts. The first response has every room the user has a receipt in,
+	// later responses have the rooms where the user's receipts changed. A receipt replaces the
+	// user's previous receipt of the same type and thread.
+	Rooms map[string]json.RawMessage `json:"rooms,omitempty"`
+	// The position to reconnect from with `initial: false`. Only set when the connection starts.
+	Pos string `json:"pos,omitempty"`
+	// True if the client asked for changes only but this is a full snapshot, because `since`
+	// could not be used.
+	Full bool `json:"full,omitempty"`
+}
+
+func (r *MyReceiptsResponse) HasData(isInitial bool) bool {
+	if isInitial {
+		return true
+	}
+	return len(r.Rooms) > 0
+}
+
+func (r *MyReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.ReceiptUpdate)
+	if !ok || update.Receipt.UserID != extCtx.UserID {
+		return
+	}
+	roomID := update.RoomID()
+	receipts := []internal.Receipt{update.Receipt}
+	if res.MyReceipts != nil && res.MyReceipts.Rooms[roomID] != nil {
+		pub, priv, err := state.UnpackReceiptsFromEDU(roomID, res.MyReceipts.Rooms[roomID])
+		if err != nil {
+			logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to unpack own receipts from edu")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
+		}
+		for _, existing := range append(pub, priv...) {
+			if existing.ThreadID == update.Receipt.ThreadID && existing.IsPrivate == update.Receipt.IsPrivate {
+				continue // superseded by the live receipt
+			}
+			receipts = append(receipts, existing)
+		}
+	}
+	edu, err := state.PackReceiptsIntoEDU(receipts)
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to pack own receipts into edu")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if res.MyReceipts == nil {
+		res.MyReceipts = &MyReceiptsResponse{}
+	}
+	if res.MyReceipts.Rooms == nil {
+		res.MyReceipts.Rooms = make(map[string]json.RawMessage)
+	}
+	res.MyReceipts.Rooms[roomID] = edu
+}
+
+func (r *MyReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// the user's receipts don't depend on which rooms are in the response, so only send them
+	// once: afterwards they are kept up to date by live updates.
+	if !extCtx.IsInitial && r.sentInitial {
+		return
+	}
+	r.sentInitial = true
+	var pos string
+	var full bool
+	if extCtx.IsInitial {
+		// take the position before loading anything so nothing can be missed on reconnect
+		latestPos, err := extCtx.Store.ReceiptTable.LatestPos()
+		if err != nil {
+			logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch latest receipt position")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		} else {
+			full = r.startConnection(latestPos)
+			pos = strconv.FormatInt(latestPos, 10)
+		}
+	}
+	receiptsByRoom, err := extCtx.Store.ReceiptTable.SelectReceiptsForUserInAllRoomsSince(extCtx.UserID, r.changesSince)
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Msg("failed to SelectReceiptsForUserInAllRooms")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	rooms := make(map[string]json.RawMessage, len(receiptsByRoom))
+	for roomID, receipts := range receiptsByRoom {
+		rooms[roomID], _ = state.PackReceiptsIntoEDU(receipts)
+	}
+	if len(rooms) > 0 || pos != "" {
+		res.MyReceipts = &MyReceiptsResponse{
+			Rooms: rooms,
+			Pos:   pos,
+			Full:  full,
+		}
+	}
+}
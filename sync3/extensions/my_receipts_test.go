@@ -0,0 +1,84 @@
+package extensions
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+func TestLiveMyReceipts(t *testing.T) {
+	boolTrue := true
+	ext := &MyReceiptsRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			// the user's receipts are returned regardless of the rooms in scope
+			Lists: []string{},
+			Rooms: []string{},
+		},
+	}
+	var res Response
+	alice := "@alice:localhost"
+	extCtx := Context{
+		UserID: alice,
+	}
+	receiptUpdate := func(receipt internal.Receipt) *caches.ReceiptUpdate {
+		return &caches.ReceiptUpdate{
+			Receipt: receipt,
+			RoomUpdate: &dummyRoomUpdate{
+				roomID: receipt.RoomID,
+			},
+		}
+	}
+	// someone else's receipts are not returned
+	ext.AppendLive(ctx, &res, extCtx, receiptUpdate(internal.Receipt{
+		RoomID: roomA, EventID: "$other", UserID: "@someone:here", TS: 1,
+	}))
+	if res.MyReceipts != nil {
+		t.Fatalf("got response for another user's receipt: %+v", res.MyReceipts)
+	}
+
+	readA1 := internal.Receipt{RoomID: roomA, EventID: "$a1", UserID: alice, TS: 1}
+	privateA1 := internal.Receipt{RoomID: roomA, EventID: "$a1", UserID: alice, TS: 2, IsPrivate: true}
+	threadA1 := internal.Receipt{RoomID: roomA, EventID: "$t1", UserID: alice, TS: 3, ThreadID: "$thread"}
+	readB1 := internal.Receipt{RoomID: roomB, EventID: "$b1", UserID: alice, TS: 4}
+	readA2 := internal.Receipt{RoomID: roomA, EventID: "$a2", UserID: alice, TS: 5}
+	for _, receipt := range []internal.Receipt{readA1, privateA1, threadA1, readB1, readA2} {
+		ext.AppendLive(ctx, &res, extCtx, receiptUpdate(receipt))
+	}
+	if res.MyReceipts == nil {
+		t.Fatalf("my_receipts response is empty")
+	}
+	// readA2 replaces readA1, but the private and threaded receipts are kept
+	wantA, err := state.PackReceiptsIntoEDU([]internal.Receipt{readA2, privateA1, threadA1})
+	assertNoError(t, err)
+	wantB, err := state.PackReceiptsIntoEDU([]internal.Receipt{readB1})
+	assertNoError(t, err)
+	got := make(map[string][]internal.Receipt)
+	want := make(map[string][]internal.Receipt)
+	for roomID, edu := range map[string]json.RawMessage{roomA: wantA, roomB: wantB} {
+		want[roomID] = unpackReceipts(t, roomID, edu)
+	}
+	for roomID, edu := range res.MyReceipts.Rooms {
+		got[roomID] = unpackReceipts(t, roomID, edu)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+// unpackReceipts returns the receipts in the EDU in a stable order.
+func unpackReceipts(t *testing.T, roomID string, edu json.RawMessage) []internal.Receipt {
+	t.Helper()
+	pub, priv, err := state.UnpackReceiptsFromEDU(roomID, edu)
+	assertNoError(t, err)
+	receipts := append(pub, priv...)
+	sort.Slice(receipts, func(i, j int) bool {
+		return receipts[i].TS < receipts[j].TS
+	})
+	return receipts
+}
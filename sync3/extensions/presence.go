@@ -0,0 +1,106 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+// Fetcher used by the presence extension
+type PresenceFetcher interface {
+	// Presence returns the latest m.presence events of the users joined to any of the given rooms.
+	Presence(ctx context.Context, roomIDs []string) []json.RawMessage
+}
+
+// Client created request params
+type PresenceRequest struct {
+	Core
+}
+
+func (r *PresenceRequest) Name() string {
+	return "PresenceRequest"
+}
+
+func (r *PresenceRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+}
+
+// Server response
+type PresenceResponse struct {
+	// m.presence events, at most one per user, in the same format as the sync v2 `presence` section.
+	Events []json.RawMessage `json:"events,omitempty"`
+}
+
+func (r *PresenceResponse) HasData(isInitial bool) bool {
+	return len(r.Events) > 0
+}
+
+// add replaces any presence event for the same user, as only the latest one matters.
+func (r *PresenceResponse) add(presenceEvent json.RawMessage) {
+	sender := gjson.GetBytes(presenceEvent, "sender").Str
+	for i, ev := range r.Events {
+		if gjson.GetBytes(ev, "sender").Str == sender {
+			r.Events[i] = presenceEvent
+			return
+		}
+	}
+	r.Events = append(r.Events, presenceEvent)
+}
+
+func (r *PresenceRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.PresenceUpdate)
+	if !ok {
+		return
+	}
+	// Only send the presence of users in rooms the client can see, and the user's own presence.
+	inScope := update.UserID == extCtx.UserID
+	for _, roomID := range update.RoomIDs {
+		if inScope {
+			break
+		}
+		inScope = r.RoomInScope(roomID, extCtx)
+	}
+	if !inScope {
+		return
+	}
+	if res.Presence == nil {
+		res.Presence = &PresenceResponse{}
+	}
+	res.Presence.add(update.PresenceEvent)
+}
+
+func (r *PresenceRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// Live updates keep the client up to date, so only send the presence of users in rooms which
+	// are new to the client: all of them on an initial sync, else the rooms in this response.
+	var roomIDs []string
+	if extCtx.IsInitial {
+		for _, roomID := range extCtx.AllSubscribedRooms {
+			roomIDs = append(roomIDs, roomID)
+		}
+		for roomID := range extCtx.RoomIDsToLists {
+			roomIDs = append(roomIDs, roomID)
+		}
+	} else {
+		for roomID := range extCtx.RoomIDToTimeline {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	inScope := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if r.RoomInScope(roomID, extCtx) {
+			inScope = append(inScope, roomID)
+		}
+	}
+	if len(inScope) == 0 || extCtx.PresenceFetcher == nil {
+		return
+	}
+	events := extCtx.PresenceFetcher.Presence(ctx, inScope)
+	if len(events) == 0 {
+		return // don't add a presence extension, no data!
+	}
+	res.Presence = &PresenceResponse{
+		Events: events,
+	}
+}
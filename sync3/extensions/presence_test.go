@@ -0,0 +1,118 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+type mockPresenceFetcher map[string][]json.RawMessage
+
+func (f mockPresenceFetcher) Presence(ctx context.Context, roomIDs []string) []json.RawMessage {
+	sort.Strings(roomIDs)
+	var events []json.RawMessage
+	for _, roomID := range roomIDs {
+		events = append(events, f[roomID]...)
+	}
+	return events
+}
+
+// Test that presence is aggregated per user, and only sent for users in rooms the client can see.
+func TestLivePresence(t *testing.T) {
+	boolTrue := true
+	ext := &PresenceRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{roomA},
+		},
+	}
+	var res Response
+	extCtx := Context{
+		UserID:             "@me:localhost",
+		AllSubscribedRooms: []string{roomA, roomB},
+		AllLists:           []string{"a"},
+		RoomIDsToLists: map[string][]string{
+			roomC: {"a"},
+		},
+	}
+	aliceOnline := json.RawMessage(`{"type":"m.presence","sender":"@alice:localhost","content":{"presence":"online"}}`)
+	aliceOffline := json.RawMessage(`{"type":"m.presence","sender":"@alice:localhost","content":{"presence":"offline"}}`)
+	bobOnline := json.RawMessage(`{"type":"m.presence","sender":"@bob:localhost","content":{"presence":"online"}}`)
+	charlieOnline := json.RawMessage(`{"type":"m.presence","sender":"@charlie:localhost","content":{"presence":"online"}}`)
+	meOnline := json.RawMessage(`{"type":"m.presence","sender":"@me:localhost","content":{"presence":"online"}}`)
+	updates := []*caches.PresenceUpdate{
+		{UserID: "@alice:localhost", PresenceEvent: aliceOnline, RoomIDs: []string{roomA}},
+		// roomB is subscribed to, but not in the extension's rooms
+		{UserID: "@bob:localhost", PresenceEvent: bobOnline, RoomIDs: []string{roomB}},
+		// roomC is visible in a list
+		{UserID: "@charlie:localhost", PresenceEvent: charlieOnline, RoomIDs: []string{roomB, roomC}},
+		// own presence is always sent
+		{UserID: "@me:localhost", PresenceEvent: meOnline, RoomIDs: []string{}},
+		// replaces the earlier presence for alice
+		{UserID: "@alice:localhost", PresenceEvent: aliceOffline, RoomIDs: []string{roomA}},
+	}
+	for _, up := range updates {
+		ext.AppendLive(ctx, &res, extCtx, up)
+	}
+	if res.Presence == nil {
+		t.Fatalf("presence response is empty")
+	}
+	want := []json.RawMessage{aliceOffline, charlieOnline, meOnline}
+	if !reflect.DeepEqual(res.Presence.Events, want) {
+		t.Fatalf("got  %s\nwant %s", res.Presence.Events, want)
+	}
+}
+
+func TestProcessInitialPresence(t *testing.T) {
+	boolTrue := true
+	ext := &PresenceRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+	}
+	alice := json.RawMessage(`{"type":"m.presence","sender":"@alice:localhost","content":{"presence":"online"}}`)
+	bob := json.RawMessage(`{"type":"m.presence","sender":"@bob:localhost","content":{"presence":"online"}}`)
+	charlie := json.RawMessage(`{"type":"m.presence","sender":"@charlie:localhost","content":{"presence":"online"}}`)
+	fetcher := mockPresenceFetcher{
+		roomA: {alice},
+		roomB: {bob},
+		roomC: {charlie},
+	}
+	extCtx := Context{
+		Handler:            &Handler{PresenceFetcher: fetcher},
+		IsInitial:          true,
+		AllSubscribedRooms: []string{roomA},
+		AllLists:           []string{"a"},
+		RoomIDsToLists: map[string][]string{
+			roomB: {"a"},
+		},
+		RoomIDToTimeline: map[string][]string{
+			roomC: {"$event"},
+		},
+	}
+
+	// initial syncs get the presence for every room in scope
+	var res Response
+	ext.ProcessInitial(ctx, &res, extCtx)
+	want := []json.RawMessage{alice, bob}
+	if res.Presence == nil || !reflect.DeepEqual(res.Presence.Events, want) {
+		t.Fatalf("initial: got %+v want %s", res.Presence, want)
+	}
+
+	// other requests only get presence for the rooms in the response
+	extCtx.IsInitial = false
+	extCtx.RoomIDsToLists[roomC] = []string{"a"}
+	res = Response{}
+	ext.ProcessInitial(ctx, &res, extCtx)
+	want = []json.RawMessage{charlie}
+	if res.Presence == nil || !reflect.DeepEqual(res.Presence.Events, want) {
+		t.Fatalf("incremental: got %+v want %s", res.Presence, want)
+	}
+}
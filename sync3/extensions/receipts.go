@@ -3,6 +3,7 @@ package extensions
 import (
 	"context"
 	"encoding/json"
+	"strconv"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
@@ -12,16 +13,27 @@ import (
 // Client created request params
 type ReceiptsRequest struct {
 	Core
+	ChangesOnly
 }
 
 func (r *ReceiptsRequest) Name() string {
 	return "ReceiptsRequest"
 }
 
+func (r *ReceiptsRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	r.ChangesOnly.applyDelta(&gnext.(*ReceiptsRequest).ChangesOnly)
+}
+
 // Server response
 type ReceiptsResponse struct {
 	// room_id -> m.receipt ephemeral event
 	Rooms map[string]json.RawMessage `json:"rooms,omitempty"`
+	// The position to reconnect from with `initial: false`. Only set when the connection starts.
+	Pos string `json:"pos,omitempty"`
+	// True if the client asked for changes only but this is a full snapshot, because `since`
+	// could not be used.
+	Full bool `json:"full,omitempty"`
 }
 
 func (r *ReceiptsResponse) HasData(isInitial bool) bool {
@@ -84,6 +96,19 @@ func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx
 }
 
 func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	var pos string
+	var full bool
+	if extCtx.IsInitial {
+		// take the position before loading anything so nothing can be missed on reconnect
+		latestPos, err := extCtx.Store.ReceiptTable.LatestPos()
+		if err != nil {
+			logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch latest receipt position")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		} else {
+			full = r.startConnection(latestPos)
+			pos = strconv.FormatInt(latestPos, 10)
+		}
+	}
 	// grab receipts for all timelines for all the rooms we're going to return
 	rooms := make(map[string]json.RawMessage)
 	interestedRoomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
@@ -92,7 +117,7 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		if !r.RoomInScope(roomID, extCtx) {
 			continue
 		}
-		receipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForEvents(roomID, timeline)
+		receipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForEventsSince(roomID, timeline, r.changesSince)
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to SelectReceiptsForEvents")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -102,7 +127,7 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		interestedRoomIDs = append(interestedRoomIDs, roomID)
 	}
 	// single shot query to pull out our own receipts for these rooms to always include our own receipts
-	ownReceipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForUser(interestedRoomIDs, extCtx.UserID)
+	ownReceipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForUserSince(interestedRoomIDs, extCtx.UserID, r.changesSince)
 	if err != nil {
 		logger.Err(err).Str("user", extCtx.UserID).Strs("rooms", interestedRoomIDs).Msg("failed to SelectReceiptsForUser")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -121,9 +146,11 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		rooms[roomID], _ = state.PackReceiptsIntoEDU(receipts)
 	}
 
-	if len(rooms) > 0 {
+	if len(rooms) > 0 || pos != "" {
 		res.Receipts = &ReceiptsResponse{
 			Rooms: rooms,
+			Pos:   pos,
+			Full:  full,
 		}
 	}
 }
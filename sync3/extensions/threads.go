@@ -0,0 +1,150 @@
+package extensions
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// DefaultThreadSummaryLimit is the number of threads summarised per room if the client does not
+// specify a limit.
+const DefaultThreadSummaryLimit = 10
+
+// maxThreadSummaryLimit is the most threads which will be summarised per room.
+const maxThreadSummaryLimit = 100
+
+// Client created request params
+type ThreadsRequest struct {
+	Core
+	// The number of threads to summarise per room, most recently active first.
+	Limit int `json:"limit"`
+}
+
+func (r *ThreadsRequest) Name() string {
+	return "ThreadsRequest"
+}
+
+func (r *ThreadsRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*ThreadsRequest)
+	if next.Limit != 0 {
+		r.Limit = next.Limit
+	}
+}
+
+func (r *ThreadsRequest) limit() int {
+	if r.Limit <= 0 {
+		return DefaultThreadSummaryLimit
+	}
+	if r.Limit > maxThreadSummaryLimit {
+		return maxThreadSummaryLimit
+	}
+	return r.Limit
+}
+
+// ThreadSummary summarises a thread for the syncing user.
+type ThreadSummary struct {
+	// The event ID of the thread root.
+	ThreadID      string `json:"thread_id"`
+	LatestEventID string `json:"latest_event_id"`
+	NumReplies    int    `json:"num_replies"`
+	// The number of replies from other users after the user's read receipt for this thread, or
+	// their latest unthreaded receipt if that is later. Receipts for the main timeline do not
+	// affect threads.
+	NumUnread int  `json:"num_unread"`
+	Unread    bool `json:"unread"`
+}
+
+// Server response
+type ThreadsResponse struct {
+	// room_id -> the most recently active threads in the room. These replace any summaries
+	// previously sent for the room. Rooms are included when they are sent in the response, when
+	// a thread receives a reply, and when the user sends a read receipt in the room.
+	Rooms map[string][]ThreadSummary `json:"rooms,omitempty"`
+}
+
+func (r *ThreadsResponse) HasData(isInitial bool) bool {
+	return len(r.Rooms) > 0
+}
+
+func (r *ThreadsRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	var roomID string
+	switch update := up.(type) {
+	case *caches.RoomEventUpdate:
+		if update.EventData.StateKey != nil || update.EventData.Content.Get(`m\.relates_to.rel_type`).Str != "m.thread" {
+			return
+		}
+		roomID = update.RoomID()
+	case *caches.ReceiptUpdate:
+		// only our own receipts change what is unread
+		if update.Receipt.UserID != extCtx.UserID {
+			return
+		}
+		roomID = update.RoomID()
+	default:
+		return
+	}
+	if !r.RoomInScope(roomID, extCtx) {
+		return
+	}
+	rooms := r.loadSummaries(ctx, extCtx, []string{roomID})
+	if len(rooms) == 0 {
+		return
+	}
+	if res.Threads == nil {
+		res.Threads = &ThreadsResponse{
+			Rooms: make(map[string][]ThreadSummary),
+		}
+	}
+	for roomID, summaries := range rooms {
+		res.Threads.Rooms[roomID] = summaries
+	}
+}
+
+func (r *ThreadsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	roomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
+	for roomID := range extCtx.RoomIDToTimeline {
+		if r.RoomInScope(roomID, extCtx) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	if len(roomIDs) == 0 {
+		return
+	}
+	rooms := r.loadSummaries(ctx, extCtx, roomIDs)
+	if len(rooms) > 0 {
+		res.Threads = &ThreadsResponse{
+			Rooms: rooms,
+		}
+	}
+}
+
+func (r *ThreadsRequest) loadSummaries(ctx context.Context, extCtx Context, roomIDs []string) map[string][]ThreadSummary {
+	summariesByRoom, err := extCtx.Store.ThreadSummaries(roomIDs, extCtx.UserID, r.limit())
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Strs("rooms", roomIDs).Msg("failed to load thread summaries")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil
+	}
+	rooms := make(map[string][]ThreadSummary, len(summariesByRoom))
+	for roomID, summaries := range summariesByRoom {
+		rooms[roomID] = newThreadSummaries(summaries)
+	}
+	return rooms
+}
+
+func newThreadSummaries(summaries []state.ThreadSummary) []ThreadSummary {
+	result := make([]ThreadSummary, len(summaries))
+	for i, s := range summaries {
+		result[i] = ThreadSummary{
+			ThreadID:      s.ThreadID,
+			LatestEventID: s.LatestEventID,
+			NumReplies:    s.NumReplies,
+			NumUnread:     s.NumUnread,
+			Unread:        s.NumUnread > 0,
+		}
+	}
+	return result
+}
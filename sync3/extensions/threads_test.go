@@ -0,0 +1,101 @@
+package extensions
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+func TestThreadsLimit(t *testing.T) {
+	var curr Request
+	curr = curr.ApplyDelta(&Request{
+		Threads: &ThreadsRequest{Core: Core{Enabled: &boolTrue}},
+	})
+	if got := curr.Threads.limit(); got != DefaultThreadSummaryLimit {
+		t.Fatalf("got limit %d want default %d", got, DefaultThreadSummaryLimit)
+	}
+	curr = curr.ApplyDelta(&Request{
+		Threads: &ThreadsRequest{Limit: 3},
+	})
+	curr = curr.ApplyDelta(&Request{
+		Threads: &ThreadsRequest{},
+	})
+	if got := curr.Threads.limit(); got != 3 {
+		t.Fatalf("limit was not sticky: got %d want 3", got)
+	}
+	curr = curr.ApplyDelta(&Request{
+		Threads: &ThreadsRequest{Limit: 999999},
+	})
+	if got := curr.Threads.limit(); got != maxThreadSummaryLimit {
+		t.Fatalf("got limit %d want %d", got, maxThreadSummaryLimit)
+	}
+}
+
+// Test that only thread replies and the user's own receipts cause thread summaries to be reloaded.
+// The extension has no store, so loading summaries would panic.
+func TestThreadsLiveIgnoresUnrelatedUpdates(t *testing.T) {
+	ext := &ThreadsRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+	}
+	extCtx := Context{
+		UserID:             "@me:localhost",
+		AllSubscribedRooms: []string{roomA},
+	}
+	stateKey := ""
+	updates := []caches.Update{
+		// not in a thread
+		&caches.RoomEventUpdate{
+			RoomUpdate: &dummyRoomUpdate{roomID: roomA},
+			EventData:  &caches.EventData{Content: gjson.Parse(`{"body":"hi"}`)},
+		},
+		// another relation
+		&caches.RoomEventUpdate{
+			RoomUpdate: &dummyRoomUpdate{roomID: roomA},
+			EventData:  &caches.EventData{Content: gjson.Parse(`{"m.relates_to":{"rel_type":"m.annotation","event_id":"$root"}}`)},
+		},
+		// state events are never thread replies
+		&caches.RoomEventUpdate{
+			RoomUpdate: &dummyRoomUpdate{roomID: roomA},
+			EventData:  &caches.EventData{StateKey: &stateKey, Content: gjson.Parse(`{"m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}`)},
+		},
+		// a thread reply in a room which isn't in scope
+		&caches.RoomEventUpdate{
+			RoomUpdate: &dummyRoomUpdate{roomID: roomB},
+			EventData:  &caches.EventData{Content: gjson.Parse(`{"m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}`)},
+		},
+		// someone else's receipt
+		&caches.ReceiptUpdate{
+			RoomUpdate: &dummyRoomUpdate{roomID: roomA},
+			Receipt:    internal.Receipt{RoomID: roomA, UserID: "@other:localhost", EventID: "$event"},
+		},
+	}
+	var res Response
+	for _, up := range updates {
+		ext.AppendLive(ctx, &res, extCtx, up)
+	}
+	if res.Threads != nil {
+		t.Fatalf("got threads response %+v want none", res.Threads)
+	}
+}
+
+func TestNewThreadSummaries(t *testing.T) {
+	got := newThreadSummaries([]state.ThreadSummary{
+		{RoomID: roomA, ThreadID: "$root1", LatestEventID: "$reply2", LatestNID: 20, NumReplies: 2, NumUnread: 1},
+		{RoomID: roomA, ThreadID: "$root2", LatestEventID: "$reply3", LatestNID: 10, NumReplies: 5},
+	})
+	want := []ThreadSummary{
+		{ThreadID: "$root1", LatestEventID: "$reply2", NumReplies: 2, NumUnread: 1, Unread: true},
+		{ThreadID: "$root2", LatestEventID: "$reply3", NumReplies: 5, NumUnread: 0, Unread: false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+}
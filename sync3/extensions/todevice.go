@@ -2,16 +2,26 @@ package extensions
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
+// toDeviceMessageIDKey is the key in the content of to-device messages which homeservers use to
+// identify each message. It differs between otherwise identical messages, so is ignored when
+// deduplicating.
+const toDeviceMessageIDKey = "org.matrix.msgid"
+
 // used to remember since positions to warn when they are not incremented. This can happen
 // when the response is genuinely lost, but then we would expect the Conn cache to pick it up based
 // on resending the `?pos=`, so it could mean they really aren't incrementing it and it's a client bug,
@@ -24,6 +34,10 @@ type ToDeviceRequest struct {
 	Core
 	Limit int    `json:"limit"` // max number of to-device messages per response
 	Since string `json:"since"` // since token
+	// If true, messages in a response which are identical to an earlier message in the same response
+	// are dropped: see dedupeToDeviceMessages. Off by default, as some protocols rely on seeing
+	// every message.
+	Deduplicate *bool `json:"deduplicate,omitempty"`
 }
 
 func (r *ToDeviceRequest) Name() string {
@@ -39,12 +53,102 @@ func (r *ToDeviceRequest) ApplyDelta(gnext GenericRequest) {
 	if next.Since != "" {
 		r.Since = next.Since
 	}
+	if next.Deduplicate != nil {
+		r.Deduplicate = next.Deduplicate
+	}
 }
 
 // Server response
 type ToDeviceResponse struct {
 	NextBatch string            `json:"next_batch"`
 	Events    []json.RawMessage `json:"events,omitempty"`
+	// True if there are more messages after NextBatch, because of the limit or the size limits.
+	// Clients with a backlog get them page by page, by sending NextBatch as the since token.
+	Limited bool `json:"limited,omitempty"`
+
+	// the device these messages are for and the position of each message, so the response can be truncated
+	deviceID  string
+	positions []int64
+}
+
+// truncate drops messages from the end of the response until it is at most maxBytes of JSON, and
+// rewinds NextBatch so the dropped messages are sent in the next response. At least one message is
+// always kept, even if it alone exceeds maxBytes, else the client would never make progress.
+// Returns the position of the last message kept.
+func (r *ToDeviceResponse) truncate(maxBytes int) int64 {
+	if len(r.positions) != len(r.Events) || len(r.Events) == 0 {
+		upTo, _ := strconv.ParseInt(r.NextBatch, 10, 64)
+		return upTo
+	}
+	// {"next_batch":"","events":[]} plus the position, then each message and its comma
+	size := len(`{"next_batch":"","events":[]}`) + len(r.NextBatch)
+	keep := 0
+	for keep < len(r.Events) {
+		next := size + len(r.Events[keep])
+		if keep > 0 {
+			next++
+		}
+		if keep > 0 && next > maxBytes {
+			break
+		}
+		size = next
+		keep++
+	}
+	if keep == len(r.Events) {
+		// nothing to drop. NextBatch may be after the last message if duplicates were dropped.
+		upTo, _ := strconv.ParseInt(r.NextBatch, 10, 64)
+		return upTo
+	}
+	upTo := r.positions[keep-1]
+	r.Events = r.Events[:keep]
+	r.positions = r.positions[:keep]
+	r.NextBatch = fmt.Sprintf("%d", upTo)
+	r.Limited = true
+	mapMu.Lock()
+	deviceIDToSinceDebugOnly[r.deviceID] = upTo
+	mapMu.Unlock()
+	return upTo
+}
+
+// dedupeToDeviceMessages drops messages which are identical to an earlier message, along with their
+// positions. Messages are identical if they have the same type, sender and content, ignoring the
+// message ID in toDeviceMessageIDKey. Content is compared byte for byte, so the same content with
+// keys in a different order is not a duplicate.
+func dedupeToDeviceMessages(msgs []json.RawMessage, positions []int64) ([]json.RawMessage, []int64) {
+	if len(msgs) != len(positions) {
+		return msgs, positions
+	}
+	seen := make(map[[sha256.Size]byte]struct{}, len(msgs))
+	dedupedMsgs := make([]json.RawMessage, 0, len(msgs))
+	dedupedPositions := make([]int64, 0, len(positions))
+	for i, msg := range msgs {
+		key := toDeviceDedupeKey(msg)
+		if _, exists := seen[key]; exists {
+			continue
+		}
+		seen[key] = struct{}{}
+		dedupedMsgs = append(dedupedMsgs, msg)
+		dedupedPositions = append(dedupedPositions, positions[i])
+	}
+	return dedupedMsgs, dedupedPositions
+}
+
+func toDeviceDedupeKey(msg json.RawMessage) [sha256.Size]byte {
+	parsed := gjson.ParseBytes(msg)
+	content := []byte(parsed.Get("content").Raw)
+	if withoutID, err := sjson.DeleteBytes(content, strings.ReplaceAll(toDeviceMessageIDKey, ".", `\.`)); err == nil {
+		content = withoutID
+	}
+	h := sha256.New()
+	// the type and sender cannot contain NUL, so they can't run into each other
+	h.Write([]byte(parsed.Get("type").Str))
+	h.Write([]byte{0})
+	h.Write([]byte(parsed.Get("sender").Str))
+	h.Write([]byte{0})
+	h.Write(content)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
 }
 
 func (r *ToDeviceResponse) HasData(isInitial bool) bool {
@@ -93,13 +197,40 @@ func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		)
 	}
 
-	msgs, upTo, err := extCtx.Store.ToDeviceTable.Messages(extCtx.UserID, extCtx.DeviceID, from, int64(r.Limit))
+	// fetch one more than the limit to find out if there is another page
+	msgs, positions, err := extCtx.Store.ToDeviceTable.MessagesWithPositions(extCtx.UserID, extCtx.DeviceID, from, int64(r.Limit)+1)
 	if err != nil {
 		l.Err(err).Int64("from", from).Msg("cannot query to-device messages")
 		// TODO add context to sentry
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return
 	}
+	limited := len(msgs) > r.Limit
+	if limited {
+		msgs = msgs[:r.Limit]
+		positions = positions[:r.Limit]
+	}
+	upTo := from
+	if len(positions) > 0 {
+		upTo = positions[len(positions)-1]
+	}
+	if r.Deduplicate != nil && *r.Deduplicate {
+		// duplicates are still acknowledged by NextBatch, as they were delivered in this batch
+		msgs, positions = dedupeToDeviceMessages(msgs, positions)
+	}
+	toDevice := &ToDeviceResponse{
+		NextBatch: fmt.Sprintf("%d", upTo),
+		Events:    msgs,
+		Limited:   limited,
+		deviceID:  extCtx.DeviceID,
+		positions: positions,
+	}
+	if extCtx.Handler != nil {
+		// apply the per-extension limit now so we don't mark messages we won't send as unacked
+		if limit := extCtx.Handler.SizeLimits.limitFor("to_device"); limit < math.MaxInt {
+			upTo = toDevice.truncate(limit)
+		}
+	}
 	err = extCtx.Store.ToDeviceTable.SetUnackedPosition(extCtx.UserID, extCtx.DeviceID, upTo)
 	if err != nil {
 		l.Err(err).Msg("cannot set unacked position")
@@ -111,8 +242,5 @@ func (r *ToDeviceRequest) ProcessInitial(ctx context.Context, res *Response, ext
 	deviceIDToSinceDebugOnly[extCtx.DeviceID] = upTo
 	mapMu.Unlock()
 	// we don't need to aggregate here as we're pulling from the DB and not relying on in-memory structs
-	res.ToDevice = &ToDeviceResponse{
-		NextBatch: fmt.Sprintf("%d", upTo),
-		Events:    msgs,
-	}
+	res.ToDevice = toDevice
 }
@@ -0,0 +1,84 @@
+package extensions
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDedupeToDeviceMessages(t *testing.T) {
+	msgs := []json.RawMessage{
+		json.RawMessage(`{"sender":"@alice:localhost","type":"m.room_key_request","content":{"action":"request","org.matrix.msgid":"1"}}`),
+		// duplicate with a different message ID
+		json.RawMessage(`{"sender":"@alice:localhost","type":"m.room_key_request","content":{"action":"request","org.matrix.msgid":"2"}}`),
+		// duplicate without a message ID
+		json.RawMessage(`{"sender":"@alice:localhost","type":"m.room_key_request","content":{"action":"request"}}`),
+		// different sender
+		json.RawMessage(`{"sender":"@bob:localhost","type":"m.room_key_request","content":{"action":"request","org.matrix.msgid":"3"}}`),
+		// different type
+		json.RawMessage(`{"sender":"@alice:localhost","type":"m.room_key_request.v2","content":{"action":"request","org.matrix.msgid":"4"}}`),
+		// different content
+		json.RawMessage(`{"sender":"@alice:localhost","type":"m.room_key_request","content":{"action":"request_cancellation","org.matrix.msgid":"5"}}`),
+		// exact duplicate of the first message
+		json.RawMessage(`{"sender":"@alice:localhost","type":"m.room_key_request","content":{"action":"request","org.matrix.msgid":"1"}}`),
+		// the same content with keys in a different order is not byte identical, so is kept
+		json.RawMessage(`{"sender":"@alice:localhost","type":"m.dummy","content":{"a":1,"b":2}}`),
+		json.RawMessage(`{"sender":"@alice:localhost","type":"m.dummy","content":{"b":2,"a":1}}`),
+	}
+	positions := []int64{10, 11, 12, 13, 14, 15, 16, 17, 18}
+	gotMsgs, gotPositions := dedupeToDeviceMessages(msgs, positions)
+	wantPositions := []int64{10, 13, 14, 15, 17, 18}
+	if !reflect.DeepEqual(gotPositions, wantPositions) {
+		t.Fatalf("got positions %v want %v", gotPositions, wantPositions)
+	}
+	for i, pos := range wantPositions {
+		if want := msgs[pos-10]; string(gotMsgs[i]) != string(want) {
+			t.Errorf("message %d: got %s want %s", i, gotMsgs[i], want)
+		}
+	}
+
+	// distinct messages are all kept
+	distinct := []json.RawMessage{msgs[0], msgs[3], msgs[4]}
+	gotMsgs, gotPositions = dedupeToDeviceMessages(distinct, []int64{1, 2, 3})
+	if !reflect.DeepEqual(gotMsgs, distinct) || !reflect.DeepEqual(gotPositions, []int64{1, 2, 3}) {
+		t.Fatalf("distinct messages were changed: got %v at %v", gotMsgs, gotPositions)
+	}
+}
+
+func TestToDeviceTruncateAfterDedupe(t *testing.T) {
+	msgs, positions := dedupeToDeviceMessages([]json.RawMessage{
+		json.RawMessage(`{"sender":"@alice:localhost","type":"m.dummy","content":{}}`),
+		json.RawMessage(`{"sender":"@alice:localhost","type":"m.dummy","content":{}}`),
+	}, []int64{10, 11})
+	res := &ToDeviceResponse{NextBatch: "11", Events: msgs, positions: positions}
+	// the dropped duplicate is acknowledged along with the message it duplicated
+	if upTo := res.truncate(10000); upTo != 11 || res.NextBatch != "11" || len(res.Events) != 1 {
+		t.Fatalf("got upTo=%d next_batch=%s with %d messages, want 11, 11 and 1", upTo, res.NextBatch, len(res.Events))
+	}
+}
+
+func TestToDeviceTruncateSetsLimited(t *testing.T) {
+	msg := json.RawMessage(`{"sender":"@alice:localhost","type":"m.dummy","content":{}}`)
+	res := &ToDeviceResponse{NextBatch: "12", Events: []json.RawMessage{msg, msg, msg}, positions: []int64{10, 11, 12}}
+	if res.truncate(10000); res.Limited {
+		t.Fatalf("limited set when nothing was truncated")
+	}
+	// room for the first message only
+	if upTo := res.truncate(len(`{"next_batch":"","events":[]}`) + 2 + len(msg)); upTo != 10 || !res.Limited || res.NextBatch != "10" {
+		t.Fatalf("got upTo=%d next_batch=%s limited=%v, want 10, 10 and true", upTo, res.NextBatch, res.Limited)
+	}
+}
+
+func TestToDeviceRequestDeduplicateIsSticky(t *testing.T) {
+	boolTrue := true
+	boolFalse := false
+	r := &ToDeviceRequest{Deduplicate: &boolTrue}
+	r.ApplyDelta(&ToDeviceRequest{Since: "5"})
+	if r.Deduplicate == nil || !*r.Deduplicate {
+		t.Fatalf("deduplicate was not sticky")
+	}
+	r.ApplyDelta(&ToDeviceRequest{Deduplicate: &boolFalse})
+	if *r.Deduplicate {
+		t.Fatalf("deduplicate was not turned off")
+	}
+}
@@ -5,17 +5,52 @@ import (
 	"encoding/json"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 // Client created request params
 type TypingRequest struct {
 	Core
+	// If true, the requesting user is removed from the typing users we return. Defaults to false.
+	ExcludeSelf *bool `json:"exclude_self,omitempty"`
 }
 
 func (r *TypingRequest) Name() string {
 	return "TypingRequest"
 }
 
+func (r *TypingRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*TypingRequest)
+	if next.ExcludeSelf != nil {
+		r.ExcludeSelf = next.ExcludeSelf
+	}
+}
+
+// filter returns the typing event to send to the client, removing the requesting user if asked to.
+func (r *TypingRequest) filter(typingEvent json.RawMessage, userID string) json.RawMessage {
+	if r.ExcludeSelf == nil || !*r.ExcludeSelf {
+		return typingEvent
+	}
+	userIDs := gjson.GetBytes(typingEvent, "content.user_ids").Array()
+	filtered := make([]string, 0, len(userIDs))
+	for _, u := range userIDs {
+		if u.Str != userID {
+			filtered = append(filtered, u.Str)
+		}
+	}
+	if len(filtered) == len(userIDs) {
+		return typingEvent
+	}
+	ev, err := sjson.SetBytes(typingEvent, "content.user_ids", filtered)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Msg("failed to remove self from typing event")
+		return typingEvent
+	}
+	return ev
+}
+
 // Server response
 type TypingResponse struct {
 	Rooms map[string]json.RawMessage `json:"rooms,omitempty"`
@@ -62,7 +97,7 @@ func (r *TypingRequest) AppendLive(ctx context.Context, res *Response, extCtx Co
 			Rooms: make(map[string]json.RawMessage),
 		}
 	}
-	res.Typing.Rooms[roomID] = typingEvent
+	res.Typing.Rooms[roomID] = r.filter(typingEvent, extCtx.UserID)
 }
 
 func (r *TypingRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
@@ -83,7 +118,7 @@ func (r *TypingRequest) ProcessInitial(ctx context.Context, res *Response, extCt
 			continue
 		}
 
-		rooms[roomID] = meta.TypingEvent
+		rooms[roomID] = r.filter(meta.TypingEvent, extCtx.UserID)
 	}
 	if len(rooms) == 0 {
 		return // don't add a typing extension, no data!
@@ -90,3 +90,64 @@ func TestLiveTypingAggregation(t *testing.T) {
 		t.Fatalf("got  %s\nwant %s", res.Typing.Rooms, want)
 	}
 }
+
+// Test that the requesting user can be excluded from typing notifications
+func TestTypingExcludeSelf(t *testing.T) {
+	boolTrue := true
+	alice := "@alice:localhost"
+	typingEvent := json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@alice:localhost","@bob:localhost"]}}`)
+	typingA := &caches.TypingUpdate{
+		RoomUpdate: &dummyRoomUpdate{
+			roomID: roomA,
+			globalMetadata: &internal.RoomMetadata{
+				RoomID:      roomA,
+				TypingEvent: typingEvent,
+			},
+		},
+	}
+	extCtx := Context{
+		UserID:             alice,
+		AllSubscribedRooms: []string{roomA},
+	}
+	testCases := []struct {
+		name        string
+		excludeSelf *bool
+		wantUserIDs []string
+	}{
+		{name: "default includes self", wantUserIDs: []string{alice, "@bob:localhost"}},
+		{name: "exclude_self", excludeSelf: &boolTrue, wantUserIDs: []string{"@bob:localhost"}},
+	}
+	for _, tc := range testCases {
+		ext := &TypingRequest{
+			Core: Core{
+				Enabled: &boolTrue,
+				Lists:   []string{"*"},
+				Rooms:   []string{"*"},
+			},
+			ExcludeSelf: tc.excludeSelf,
+		}
+		var res Response
+		ext.AppendLive(ctx, &res, extCtx, typingA)
+		if res.Typing == nil {
+			t.Fatalf("%s: typing response is empty", tc.name)
+		}
+		var gotUserIDs []string
+		for _, u := range gjson.GetBytes(res.Typing.Rooms[roomA], "content.user_ids").Array() {
+			gotUserIDs = append(gotUserIDs, u.Str)
+		}
+		if !reflect.DeepEqual(gotUserIDs, tc.wantUserIDs) {
+			t.Errorf("%s: got user_ids %v want %v", tc.name, gotUserIDs, tc.wantUserIDs)
+		}
+	}
+	// the source event must not be modified
+	if !reflect.DeepEqual(typingA.GlobalRoomMetadata().TypingEvent, typingEvent) {
+		t.Fatalf("typing event in the global metadata was modified")
+	}
+
+	// exclude_self is sticky
+	ext := &TypingRequest{ExcludeSelf: &boolTrue}
+	ext.ApplyDelta(&TypingRequest{})
+	if ext.ExcludeSelf == nil || !*ext.ExcludeSelf {
+		t.Fatalf("exclude_self was not sticky")
+	}
+}
@@ -0,0 +1,156 @@
+package sync3
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// gatedFeatures are the features which operators can gate with FeatureGates, along with how to
+// remove the feature from a request so that devices it is not enabled for cannot use it.
+var gatedFeatures = map[string]func(r *Request){
+	"count_delta": func(r *Request) {
+		r.eachList(func(rl *RequestList) { rl.CountDelta = nil })
+	},
+	"include_encrypted_metadata": func(r *Request) {
+		r.eachRoomSubscription(func(rs *RoomSubscription) { rs.EncryptedMetadata = nil })
+	},
+	"include_indexes": func(r *Request) {
+		r.eachList(func(rl *RequestList) { rl.Indexes = nil })
+	},
+	"include_name_content": func(r *Request) {
+		r.eachRoomSubscription(func(rs *RoomSubscription) { rs.NameContent = nil })
+	},
+	"include_notification_level": func(r *Request) {
+		r.eachRoomSubscription(func(rs *RoomSubscription) { rs.NotificationLevel = nil })
+	},
+	"required_state_delta": func(r *Request) {
+		r.eachRoomSubscription(func(rs *RoomSubscription) { rs.RequiredStateDelta = nil })
+	},
+	"to_device_deduplicate": func(r *Request) {
+		if r.Extensions.ToDevice != nil {
+			r.Extensions.ToDevice.Deduplicate = nil
+		}
+	},
+}
+
+// FeatureGates restricts features to some devices, so operators can roll out features gradually.
+// Features which are not gated are enabled for every device.
+//
+// A feature is enabled for a device if its device ID is listed for the feature, or if the device
+// falls within the percentage of devices the feature is rolled out to. Devices are assigned to a
+// percentile by hashing the feature name and device ID, so the same devices get a feature on every
+// proxy instance and across restarts, and raising the percentage only adds devices.
+type FeatureGates struct {
+	gates map[string]*featureGate
+}
+
+type featureGate struct {
+	percent   int
+	deviceIDs map[string]bool
+}
+
+// ParseFeatureGates parses a comma separated list of feature=rule pairs, where a rule is either a
+// percentage of devices e.g "25%" or a | separated list of device IDs e.g "DEVICEA|DEVICEB".
+// A feature may be listed more than once, in which case it is enabled for a device if any of its
+// rules match e.g "include_indexes=10%,include_indexes=DEVICEA".
+func ParseFeatureGates(s string) (gates FeatureGates, err error) {
+	if s == "" {
+		return
+	}
+	gates.gates = make(map[string]*featureGate)
+	for _, pair := range strings.Split(s, ",") {
+		name, rule, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || rule == "" {
+			return FeatureGates{}, fmt.Errorf("%q is not of the form feature=rule", pair)
+		}
+		if _, ok := gatedFeatures[name]; !ok {
+			return FeatureGates{}, fmt.Errorf("feature %q cannot be gated", name)
+		}
+		gate := gates.gates[name]
+		if gate == nil {
+			gate = &featureGate{deviceIDs: make(map[string]bool)}
+			gates.gates[name] = gate
+		}
+		if val, isPercent := strings.CutSuffix(rule, "%"); isPercent {
+			percent, err := strconv.Atoi(val)
+			if err != nil || percent < 0 || percent > 100 {
+				return FeatureGates{}, fmt.Errorf("invalid percentage for %s: %q", name, rule)
+			}
+			if percent > gate.percent {
+				gate.percent = percent
+			}
+			continue
+		}
+		for _, deviceID := range strings.Split(rule, "|") {
+			gate.deviceIDs[deviceID] = true
+		}
+	}
+	return gates, nil
+}
+
+// Enabled returns true if the feature is enabled for this device.
+func (g FeatureGates) Enabled(feature, deviceID string) bool {
+	gate, ok := g.gates[feature]
+	if !ok {
+		return true
+	}
+	return gate.deviceIDs[deviceID] || rolloutPercentile(feature, deviceID) < gate.percent
+}
+
+// Disabled returns the sorted names of the features which are not enabled for this device.
+func (g FeatureGates) Disabled(deviceID string) (features []string) {
+	for feature := range g.gates {
+		if !g.Enabled(feature, deviceID) {
+			features = append(features, feature)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// rolloutPercentile deterministically assigns a device to a percentile in the range [0,100) for a
+// feature. The feature name is included so that each feature is rolled out to different devices
+// first.
+func rolloutPercentile(feature, deviceID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(feature))
+	h.Write([]byte{0})
+	h.Write([]byte(deviceID))
+	return int(h.Sum32() % 100)
+}
+
+// RemoveFeatures removes the request parameters for these gated features, so they have no effect.
+func (r *Request) RemoveFeatures(features []string) {
+	for _, feature := range features {
+		if remove := gatedFeatures[feature]; remove != nil {
+			remove(r)
+		}
+	}
+}
+
+func (r *Request) eachList(fn func(rl *RequestList)) {
+	for key, rl := range r.Lists {
+		fn(&rl)
+		r.Lists[key] = rl
+	}
+}
+
+// eachRoomSubscription calls fn for every room subscription in the request, including those of
+// lists and those for old rooms.
+func (r *Request) eachRoomSubscription(fn func(rs *RoomSubscription)) {
+	var each func(rs *RoomSubscription)
+	each = func(rs *RoomSubscription) {
+		fn(rs)
+		if rs.IncludeOldRooms != nil {
+			each(rs.IncludeOldRooms)
+		}
+	}
+	r.eachList(func(rl *RequestList) { each(&rl.RoomSubscription) })
+	for roomID, rs := range r.RoomSubscriptions {
+		each(&rs)
+		r.RoomSubscriptions[roomID] = rs
+	}
+}
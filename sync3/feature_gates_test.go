@@ -0,0 +1,167 @@
+package sync3
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
+)
+
+func TestParseFeatureGates(t *testing.T) {
+	testCases := []struct {
+		input   string
+		wantErr bool
+	}{
+		{input: ""},
+		{input: "include_indexes=10%"},
+		{input: "include_indexes=DEVICEA|DEVICEB, count_delta=0%,include_indexes=100%"},
+		{input: "include_indexes", wantErr: true},
+		{input: "include_indexes=", wantErr: true},
+		{input: "include_indexes=101%", wantErr: true},
+		{input: "include_indexes=-1%", wantErr: true},
+		{input: "include_indexes=lots%", wantErr: true},
+		{input: "unknown=10%", wantErr: true},
+	}
+	for _, tc := range testCases {
+		_, err := ParseFeatureGates(tc.input)
+		if tc.wantErr && err == nil {
+			t.Errorf("ParseFeatureGates(%q): want error", tc.input)
+		}
+		if !tc.wantErr && err != nil {
+			t.Errorf("ParseFeatureGates(%q): %s", tc.input, err)
+		}
+	}
+	for feature := range gatedFeatures {
+		if !hasString(Features, feature) {
+			t.Errorf("gated feature %s is not in Features", feature)
+		}
+	}
+}
+
+func TestFeatureGatesByDeviceID(t *testing.T) {
+	gates, err := ParseFeatureGates("include_indexes=DEVICEA|DEVICEB,count_delta=0%,include_name_content=100%")
+	if err != nil {
+		t.Fatalf("ParseFeatureGates: %s", err)
+	}
+	testCases := []struct {
+		feature  string
+		deviceID string
+		want     bool
+	}{
+		{feature: "include_indexes", deviceID: "DEVICEA", want: true},
+		{feature: "include_indexes", deviceID: "DEVICEB", want: true},
+		{feature: "include_indexes", deviceID: "DEVICEC", want: false},
+		{feature: "count_delta", deviceID: "DEVICEA", want: false},
+		{feature: "include_name_content", deviceID: "DEVICEC", want: true},
+		// features without gates are enabled for everyone
+		{feature: "include_encrypted_metadata", deviceID: "DEVICEC", want: true},
+	}
+	for _, tc := range testCases {
+		if got := gates.Enabled(tc.feature, tc.deviceID); got != tc.want {
+			t.Errorf("Enabled(%s, %s): got %v want %v", tc.feature, tc.deviceID, got, tc.want)
+		}
+	}
+	if got, want := gates.Disabled("DEVICEC"), []string{"count_delta", "include_indexes"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Disabled(DEVICEC): got %v want %v", got, want)
+	}
+	if got := (FeatureGates{}).Disabled("DEVICEC"); len(got) != 0 {
+		t.Errorf("no gates: got disabled features %v", got)
+	}
+}
+
+func TestFeatureGatesPercentage(t *testing.T) {
+	gates10, _ := ParseFeatureGates("include_indexes=10%")
+	gates50, _ := ParseFeatureGates("include_indexes=50%")
+	var enabled10, enabled50 int
+	for i := 0; i < 1000; i++ {
+		deviceID := fmt.Sprintf("DEVICE%d", i)
+		in10 := gates10.Enabled("include_indexes", deviceID)
+		in50 := gates50.Enabled("include_indexes", deviceID)
+		if in10 != gates10.Enabled("include_indexes", deviceID) {
+			t.Fatalf("gating %s is not deterministic", deviceID)
+		}
+		// raising the percentage only adds devices
+		if in10 && !in50 {
+			t.Errorf("%s is enabled at 10%% but not 50%%", deviceID)
+		}
+		if in10 {
+			enabled10++
+		}
+		if in50 {
+			enabled50++
+		}
+	}
+	if enabled10 < 50 || enabled10 > 150 {
+		t.Errorf("10%% rollout enabled %d/1000 devices", enabled10)
+	}
+	if enabled50 < 400 || enabled50 > 600 {
+		t.Errorf("50%% rollout enabled %d/1000 devices", enabled50)
+	}
+	// the same device falls in a different percentile for different features
+	var differs bool
+	for i := 0; i < 100 && !differs; i++ {
+		deviceID := fmt.Sprintf("DEVICE%d", i)
+		differs = rolloutPercentile("include_indexes", deviceID) != rolloutPercentile("count_delta", deviceID)
+	}
+	if !differs {
+		t.Errorf("features are rolled out to the same devices")
+	}
+}
+
+func TestRequestRemoveFeatures(t *testing.T) {
+	boolTrue := true
+	sub := RoomSubscription{
+		NameContent:       &boolTrue,
+		EncryptedMetadata: &boolTrue,
+		IncludeOldRooms:   &RoomSubscription{NameContent: &boolTrue},
+	}
+	req := Request{
+		Lists: map[string]RequestList{
+			"a": {RoomSubscription: sub, Indexes: &boolTrue, CountDelta: &boolTrue},
+		},
+		RoomSubscriptions: map[string]RoomSubscription{
+			"!foo:bar": {NameContent: &boolTrue},
+		},
+		Extensions: extensions.Request{
+			ToDevice: &extensions.ToDeviceRequest{Deduplicate: &boolTrue},
+		},
+	}
+	req.RemoveFeatures([]string{"include_indexes", "include_name_content", "to_device_deduplicate"})
+	list := req.Lists["a"]
+	if list.Indexes != nil || list.NameContent != nil || list.IncludeOldRooms.NameContent != nil {
+		t.Errorf("list features were not removed: %+v", list)
+	}
+	if list.CountDelta == nil || list.EncryptedMetadata == nil {
+		t.Errorf("features which are not disabled were removed: %+v", list)
+	}
+	if req.RoomSubscriptions["!foo:bar"].NameContent != nil {
+		t.Errorf("room subscription feature was not removed")
+	}
+	if req.Extensions.ToDevice.Deduplicate != nil {
+		t.Errorf("to-device feature was not removed")
+	}
+}
+
+func TestCapabilitiesWithoutFeatures(t *testing.T) {
+	caps := NewCapabilities("v1.2.3")
+	without := caps.WithoutFeatures([]string{"include_indexes"})
+	if hasString(without.Features, "include_indexes") {
+		t.Errorf("removed feature is still advertised")
+	}
+	if len(without.Features) != len(caps.Features)-1 || without.ProxyVersion != caps.ProxyVersion {
+		t.Errorf("unexpected capabilities: %+v", without)
+	}
+	if !hasString(caps.Features, "include_indexes") {
+		t.Errorf("WithoutFeatures modified the original capabilities")
+	}
+}
+
+func hasString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
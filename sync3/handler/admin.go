@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// AdminConnsPath is the path of the endpoint which lists the active connections, or with DELETE
+// destroys one.
+const AdminConnsPath = "/_syncv3/admin/conns"
+
+// AdminConnsResponse lists the active connections, sorted by connection ID.
+type AdminConnsResponse struct {
+	Conns []AdminConn `json:"conns"`
+}
+
+// AdminConn is the state of a connection, for operating the proxy.
+type AdminConn struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+	// The conn_id the client gave, which is empty if it didn't give one.
+	ConnID string `json:"conn_id"`
+	// The pos of the last response calculated for the client.
+	LastPos int64 `json:"last_pos"`
+	// The number of responses buffered for the client, and their approximate size in bytes.
+	BufferedResponses int   `json:"buffered_responses"`
+	BufferedBytes     int64 `json:"buffered_bytes"`
+	// When the last request on the connection started or finished, in milliseconds since the epoch.
+	LastSeenTimestamp int64 `json:"last_seen_ts"`
+}
+
+type adminConnsHandler struct {
+	connMap    *sync3.ConnMap
+	adminToken string
+}
+
+// AdminHandler returns an admin handler for the connections of this handler.
+func (h *SyncLiveHandler) AdminHandler(adminToken string) http.Handler {
+	return NewAdminConnsHandler(h.ConnMap, adminToken)
+}
+
+// NewAdminConnsHandler returns a handler for AdminConnsPath, which requires `adminToken` as the
+// access token. GET lists the connections, filtered to one user by the optional `user_id` query
+// param. DELETE destroys the connection given by the `user_id`, `device_id` and `conn_id` query
+// params, so the client's next request on it is rejected with M_UNKNOWN_POS. If connection positions
+// are persisted, the saved position is cleared so the connection cannot be resumed.
+func NewAdminConnsHandler(connMap *sync3.ConnMap, adminToken string) http.Handler {
+	return &adminConnsHandler{
+		connMap:    connMap,
+		adminToken: adminToken,
+	}
+}
+
+func (h *adminConnsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var res any
+	var herr *internal.HandlerError
+	switch req.Method {
+	case "GET":
+		res, herr = h.list(req)
+	case "DELETE":
+		res, herr = h.destroy(req)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if herr != nil {
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+		return
+	}
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(res)
+}
+
+func (h *adminConnsHandler) list(req *http.Request) (*AdminConnsResponse, *internal.HandlerError) {
+	if herr := internal.CheckAdminToken(req, h.adminToken); herr != nil {
+		return nil, herr
+	}
+	userID := req.URL.Query().Get("user_id")
+	res := &AdminConnsResponse{
+		Conns: []AdminConn{},
+	}
+	for _, snapshot := range h.connMap.Snapshot() {
+		if userID != "" && snapshot.ConnID.UserID != userID {
+			continue
+		}
+		res.Conns = append(res.Conns, AdminConn{
+			UserID:            snapshot.ConnID.UserID,
+			DeviceID:          snapshot.ConnID.DeviceID,
+			ConnID:            snapshot.ConnID.CID,
+			LastPos:           snapshot.LastPos,
+			BufferedResponses: snapshot.BufferedResponses,
+			BufferedBytes:     snapshot.BufferedBytes,
+			LastSeenTimestamp: snapshot.LastSeen.UnixMilli(),
+		})
+	}
+	return res, nil
+}
+
+func (h *adminConnsHandler) destroy(req *http.Request) (struct{}, *internal.HandlerError) {
+	if herr := internal.CheckAdminToken(req, h.adminToken); herr != nil {
+		return struct{}{}, herr
+	}
+	query := req.URL.Query()
+	cid := sync3.ConnID{
+		UserID:   query.Get("user_id"),
+		DeviceID: query.Get("device_id"),
+		CID:      query.Get("conn_id"),
+	}
+	if cid.UserID == "" || cid.DeviceID == "" {
+		return struct{}{}, &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("user_id and device_id are required"),
+			ErrCode:    "M_MISSING_PARAM",
+		}
+	}
+	if !h.connMap.CloseConn(cid) {
+		return struct{}{}, &internal.HandlerError{
+			StatusCode: 404,
+			Err:        fmt.Errorf("no such connection"),
+			ErrCode:    "M_NOT_FOUND",
+		}
+	}
+	return struct{}{}, nil
+}
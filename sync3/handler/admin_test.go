@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestAdminConnsHandler(t *testing.T) {
+	connMap := sync3.NewConnMap(false, time.Minute)
+	defer connMap.Teardown()
+	aliceConn := sync3.ConnID{UserID: "@alice:localhost", DeviceID: "ALICE", CID: "room-list"}
+	bobConn := sync3.ConnID{UserID: "@bob:localhost", DeviceID: "BOB"}
+	for _, cid := range []sync3.ConnID{aliceConn, bobConn} {
+		conn := connMap.CreateConn(cid, func() {}, func() sync3.ConnHandler {
+			return &updatesConnHandler{updates: make(chan int)}
+		})
+		if _, herr := conn.OnIncomingRequest(context.Background(), &sync3.Request{}, time.Now()); herr != nil {
+			t.Fatalf("OnIncomingRequest: %s", herr)
+		}
+	}
+	h := NewAdminConnsHandler(connMap, "admin_secret")
+	doRequest := func(method, accessToken, query string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, AdminConnsPath+"?"+query, nil)
+		if accessToken != "" {
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	listConns := func(query string) []AdminConn {
+		t.Helper()
+		w := doRequest("GET", "admin_secret", query)
+		if w.Code != 200 {
+			t.Fatalf("GET %s: got HTTP %d want 200: %s", query, w.Code, w.Body.String())
+		}
+		var res AdminConnsResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("failed to unmarshal response: %s", err)
+		}
+		return res.Conns
+	}
+
+	testCases := []struct {
+		name        string
+		method      string
+		accessToken string
+		query       string
+		wantCode    int
+	}{
+		{name: "list without token", method: "GET", wantCode: http.StatusUnauthorized},
+		{name: "list with wrong token", method: "GET", accessToken: "alice_token", wantCode: http.StatusUnauthorized},
+		{name: "destroy with wrong token", method: "DELETE", accessToken: "alice_token", query: "user_id=%40bob%3Alocalhost&device_id=BOB", wantCode: http.StatusUnauthorized},
+		{name: "destroy without device", method: "DELETE", accessToken: "admin_secret", query: "user_id=%40bob%3Alocalhost", wantCode: http.StatusBadRequest},
+		{name: "destroy unknown conn", method: "DELETE", accessToken: "admin_secret", query: "user_id=%40bob%3Alocalhost&device_id=BOB&conn_id=other", wantCode: http.StatusNotFound},
+		{name: "wrong method", method: "POST", accessToken: "admin_secret", wantCode: http.StatusMethodNotAllowed},
+	}
+	for _, tc := range testCases {
+		if w := doRequest(tc.method, tc.accessToken, tc.query); w.Code != tc.wantCode {
+			t.Errorf("%s: got HTTP %d want %d: %s", tc.name, w.Code, tc.wantCode, w.Body.String())
+		}
+	}
+
+	conns := listConns("")
+	if len(conns) != 2 {
+		t.Fatalf("got %d conns want 2: %+v", len(conns), conns)
+	}
+	got := conns[0]
+	if got.UserID != aliceConn.UserID || got.DeviceID != aliceConn.DeviceID || got.ConnID != aliceConn.CID {
+		t.Errorf("got conn %+v want %+v", got, aliceConn)
+	}
+	if got.LastPos != 1 || got.BufferedResponses != 1 {
+		t.Errorf("got pos %d with %d responses buffered, want pos 1 with 1 response buffered", got.LastPos, got.BufferedResponses)
+	}
+	if since := time.Since(time.UnixMilli(got.LastSeenTimestamp)); since < 0 || since > time.Minute {
+		t.Errorf("got last seen %v ago", since)
+	}
+	if conns = listConns("user_id=%40bob%3Alocalhost"); len(conns) != 1 || conns[0].UserID != bobConn.UserID {
+		t.Errorf("filtering by user: got %+v want bob's conn", conns)
+	}
+
+	if w := doRequest("DELETE", "admin_secret", "user_id=%40bob%3Alocalhost&device_id=BOB"); w.Code != 200 {
+		t.Fatalf("destroy: got HTTP %d want 200: %s", w.Code, w.Body.String())
+	}
+	if connMap.Conn(bobConn) != nil {
+		t.Errorf("bob's conn still exists")
+	}
+	if conns = listConns(""); len(conns) != 1 || conns[0].UserID != aliceConn.UserID {
+		t.Errorf("after destroying bob's conn: got %+v want alice's conn", conns)
+	}
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// admissionController limits the rate at which new connections are set up, to smooth out reconnect
+// storms e.g when every client reconnects after the homeserver restarts. Connection setup is
+// expensive as it may authenticate the access token with the homeserver and start a poller.
+//
+// Setups are admitted at `rate` per second, with bursts of up to one second's worth. Setups over
+// the rate wait for their turn, up to maxWait, after which they are rejected with a 429 telling the
+// client when to retry. Requests on existing connections are never limited.
+type admissionController struct {
+	rate    float64
+	bucket  *internal.TokenBucket
+	maxWait time.Duration
+	// counts setups labelled by result=admitted|queued|rejected. May be nil.
+	setups *prometheus.CounterVec
+}
+
+func newAdmissionController(rate float64, maxWait time.Duration, setups *prometheus.CounterVec) *admissionController {
+	return &admissionController{
+		rate:    rate,
+		bucket:  internal.NewTokenBucket(rate, int(math.Ceil(rate))),
+		maxWait: maxWait,
+		setups:  setups,
+	}
+}
+
+// Admit blocks until a new connection can be set up. Returns an error if the setup would need to
+// wait longer than maxWait, or the request is cancelled whilst waiting.
+func (a *admissionController) Admit(ctx context.Context) *internal.HandlerError {
+	if a == nil || a.rate <= 0 {
+		return nil
+	}
+	wait := a.bucket.Reserve()
+	if wait > a.maxWait {
+		a.bucket.Release()
+		a.count("rejected")
+		return &internal.HandlerError{
+			StatusCode: http.StatusTooManyRequests,
+			Err:        fmt.Errorf("too many new connections, retry in %v", wait),
+			ErrCode:    "M_LIMIT_EXCEEDED",
+			RetryAfter: wait,
+		}
+	}
+	if wait <= 0 {
+		a.count("admitted")
+		return nil
+	}
+	a.count("queued")
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// let someone else have our turn
+		a.bucket.Release()
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        ctx.Err(),
+		}
+	}
+}
+
+func (a *admissionController) count(result string) {
+	if a.setups != nil {
+		a.setups.WithLabelValues(result).Inc()
+	}
+}
+
+// setupRateLimiter limits how often each user and each device can set up new connections, so a
+// misbehaving client which keeps starting again cannot crowd out everyone else's setups. Setups over
+// the limit are rejected with a 429 telling the client when to retry.
+type setupRateLimiter struct {
+	// may be nil, for no limit
+	perUser   *internal.TokenBuckets
+	perDevice *internal.TokenBuckets
+}
+
+func newSetupRateLimiter(perUser, perDevice sync3.RateLimit) *setupRateLimiter {
+	var l setupRateLimiter
+	if perUser.Rate > 0 {
+		l.perUser = internal.NewTokenBuckets(perUser.Rate, perUser.Burst)
+	}
+	if perDevice.Rate > 0 {
+		l.perDevice = internal.NewTokenBuckets(perDevice.Rate, perDevice.Burst)
+	}
+	return &l
+}
+
+// Allow returns an error if the device or the user has set up too many connections recently.
+func (l *setupRateLimiter) Allow(userID, deviceID string) *internal.HandlerError {
+	if l == nil {
+		return nil
+	}
+	if l.perDevice != nil {
+		if retryAfter, ok := l.perDevice.Allow(userID + "|" + deviceID); !ok {
+			return setupRateLimitedError("device", retryAfter)
+		}
+	}
+	if l.perUser != nil {
+		if retryAfter, ok := l.perUser.Allow(userID); !ok {
+			return setupRateLimitedError("user", retryAfter)
+		}
+	}
+	return nil
+}
+
+func setupRateLimitedError(who string, retryAfter time.Duration) *internal.HandlerError {
+	return &internal.HandlerError{
+		StatusCode: http.StatusTooManyRequests,
+		Err:        fmt.Errorf("%s is setting up too many new connections, retry in %v", who, retryAfter),
+		ErrCode:    "M_LIMIT_EXCEEDED",
+		RetryAfter: retryAfter,
+	}
+}
+
+// initialSyncLimiter caps the number of initial syncs being calculated at once. Initial syncs load
+// and sort every room the user is in, so many at once can use all the CPU and database connections,
+// slowing down every other request. Initial syncs over the cap wait for a turn, up to maxWait, after
+// which they are rejected with a 429 telling the client when to retry.
+type initialSyncLimiter struct {
+	slots   chan struct{}
+	maxWait time.Duration
+}
+
+func newInitialSyncLimiter(max int, maxWait time.Duration) *initialSyncLimiter {
+	return &initialSyncLimiter{
+		slots:   make(chan struct{}, max),
+		maxWait: maxWait,
+	}
+}
+
+// Acquire blocks until the initial sync can be calculated. The caller must call release once it has
+// been. Returns an error if there is no turn within maxWait, or the request is cancelled whilst waiting.
+func (l *initialSyncLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release = func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		retryAfter := l.maxWait
+		if retryAfter < time.Second {
+			retryAfter = time.Second
+		}
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusTooManyRequests,
+			Err:        fmt.Errorf("too many initial syncs in progress, retry in %v", retryAfter),
+			ErrCode:    "M_LIMIT_EXCEEDED",
+			RetryAfter: retryAfter,
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestAdmissionControllerUnlimited(t *testing.T) {
+	var a *admissionController
+	if herr := a.Admit(context.Background()); herr != nil {
+		t.Fatalf("nil admission controller rejected setup: %s", herr)
+	}
+	a = newAdmissionController(0, 0, nil)
+	for i := 0; i < 100; i++ {
+		if herr := a.Admit(context.Background()); herr != nil {
+			t.Fatalf("admission controller without a rate rejected setup: %s", herr)
+		}
+	}
+}
+
+func TestAdmissionControllerCancelled(t *testing.T) {
+	a := newAdmissionController(1, time.Minute, nil)
+	if herr := a.Admit(context.Background()); herr != nil {
+		t.Fatalf("first setup was rejected: %s", herr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if herr := a.Admit(ctx); herr == nil {
+		t.Fatalf("cancelled setup was admitted")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("cancelled setup waited for its turn")
+	}
+}
+
+// Simulate a reconnect storm: many clients try to set up connections at once. Only the burst and
+// the setups which can start within maxWait are admitted, and everything else is told to retry.
+func TestAdmissionControllerStorm(t *testing.T) {
+	const (
+		rate       = 100
+		maxWait    = 200 * time.Millisecond
+		numClients = 500
+	)
+	a := newAdmissionController(rate, maxWait, nil)
+	var admitted, rejected atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(numClients)
+	start := time.Now()
+	for i := 0; i < numClients; i++ {
+		go func() {
+			defer wg.Done()
+			herr := a.Admit(context.Background())
+			if herr == nil {
+				admitted.Add(1)
+				return
+			}
+			if herr.StatusCode != http.StatusTooManyRequests || herr.ErrCode != "M_LIMIT_EXCEEDED" {
+				t.Errorf("got error %+v want 429 M_LIMIT_EXCEEDED", herr)
+			}
+			if herr.RetryAfter <= maxWait || herr.RetryAfter > numClients*time.Second/rate {
+				t.Errorf("got retry after %v", herr.RetryAfter)
+			}
+			rejected.Add(1)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// the burst plus the setups which fit into maxWait, allowing for the time taken to start
+	// all the goroutines
+	maxAdmitted := int64(rate + rate*elapsed.Seconds() + 1)
+	if admitted.Load() < rate || admitted.Load() > maxAdmitted {
+		t.Errorf("admitted %d setups in %v, want between %d and %d", admitted.Load(), elapsed, rate, maxAdmitted)
+	}
+	if admitted.Load()+rejected.Load() != numClients {
+		t.Errorf("admitted %d and rejected %d, want %d total", admitted.Load(), rejected.Load(), numClients)
+	}
+	// excess clients are rejected straight away rather than waiting
+	if elapsed > 2*maxWait+time.Second {
+		t.Errorf("storm took %v to handle", elapsed)
+	}
+}
+
+func TestSetupRateLimiter(t *testing.T) {
+	var l *setupRateLimiter
+	if herr := l.Allow("@alice:localhost", "A"); herr != nil {
+		t.Fatalf("nil limiter rejected setup: %s", herr)
+	}
+	l = newSetupRateLimiter(sync3.RateLimit{Rate: 0.001, Burst: 3}, sync3.RateLimit{Rate: 0.001, Burst: 2})
+	assertAllowed := func(userID, deviceID string, wantReject string) {
+		t.Helper()
+		herr := l.Allow(userID, deviceID)
+		if wantReject == "" {
+			if herr != nil {
+				t.Fatalf("%s %s: setup was rejected: %s", userID, deviceID, herr)
+			}
+			return
+		}
+		if herr == nil {
+			t.Fatalf("%s %s: setup was allowed, want rejected for the %s", userID, deviceID, wantReject)
+		}
+		if herr.StatusCode != http.StatusTooManyRequests || herr.ErrCode != "M_LIMIT_EXCEEDED" || herr.RetryAfter <= 0 {
+			t.Fatalf("%s %s: got error %+v want 429 M_LIMIT_EXCEEDED with a retry after", userID, deviceID, herr)
+		}
+		if !strings.HasPrefix(herr.Err.Error(), wantReject) {
+			t.Fatalf("%s %s: got error %s want it to be for the %s", userID, deviceID, herr, wantReject)
+		}
+	}
+	// each device has its own burst
+	assertAllowed("@alice:localhost", "A", "")
+	assertAllowed("@alice:localhost", "A", "")
+	assertAllowed("@alice:localhost", "A", "device")
+	// the user has a burst across all their devices
+	assertAllowed("@alice:localhost", "B", "")
+	assertAllowed("@alice:localhost", "B", "user")
+	// other users are unaffected, even with the same device ID
+	assertAllowed("@bob:localhost", "A", "")
+}
+
+func TestInitialSyncLimiter(t *testing.T) {
+	var l *initialSyncLimiter
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("nil limiter rejected initial sync: %s", err)
+	}
+	release()
+
+	l = newInitialSyncLimiter(2, 50*time.Millisecond)
+	release1, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("first initial sync was rejected: %s", err)
+	}
+	release2, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("second initial sync was rejected: %s", err)
+	}
+	// over the cap, initial syncs wait for up to maxWait before being told to retry
+	start := time.Now()
+	_, err = l.Acquire(context.Background())
+	herr, ok := err.(*internal.HandlerError)
+	if !ok || herr.StatusCode != http.StatusTooManyRequests || herr.RetryAfter != time.Second {
+		t.Fatalf("got error %+v want 429 with retry after 1s", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("rejected after %v, want after maxWait", waited)
+	}
+	// cancelled requests stop waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = l.Acquire(ctx); err != context.Canceled {
+		t.Fatalf("got error %v want context.Canceled", err)
+	}
+	// a waiting initial sync gets the turn of one which finishes
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release1()
+	}()
+	release3, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("waiting initial sync was rejected: %s", err)
+	}
+	release2()
+	release3()
+}
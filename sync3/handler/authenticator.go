@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Authenticator identifies the owner of an access token which the proxy has not seen before.
+// Implementations should return sync2.HTTP401 if the access token is invalid, which is returned
+// to the client as M_UNKNOWN_TOKEN. Any other error is treated as a temporary failure.
+type Authenticator interface {
+	Authenticate(ctx context.Context, accessToken string) (userID, deviceID string, isGuest bool, err error)
+}
+
+// UpstreamAuthenticator is the default Authenticator, which asks the upstream homeserver who owns
+// the access token via /account/whoami.
+type UpstreamAuthenticator struct {
+	Client sync2.Client
+}
+
+func (a *UpstreamAuthenticator) Authenticate(ctx context.Context, accessToken string) (string, string, bool, error) {
+	return a.Client.WhoAmI(ctx, accessToken)
+}
+
+const (
+	// MSC2967 scopes saying which device an OIDC access token is for, and that it is for a guest
+	scopeDevicePrefix = "urn:matrix:org.matrix.msc2967.client:device:"
+	scopeGuest        = "urn:matrix:org.matrix.msc2967.client:api:guest"
+)
+
+// IntrospectionAuthenticator identifies access tokens issued by an OpenID Connect provider, for
+// homeservers which delegate authentication to one (MSC3861). Tokens are looked up with the
+// provider's OAuth 2.0 token introspection endpoint (RFC 7662), as a confidential client.
+type IntrospectionAuthenticator struct {
+	Client *http.Client
+	// The provider's introspection endpoint.
+	URL          string
+	ClientID     string
+	ClientSecret string
+	// The homeserver's server name, which user IDs are made from along with the token's username.
+	ServerName string
+}
+
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	Username string `json:"username"`
+}
+
+func (a *IntrospectionAuthenticator) Authenticate(ctx context.Context, accessToken string) (string, string, bool, error) {
+	form := url.Values{}
+	form.Set("token", accessToken)
+	form.Set("token_type_hint", "access_token")
+	req, err := http.NewRequestWithContext(ctx, "POST", a.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client credentials are form encoded before being used for basic auth, see RFC 6749 2.3.1
+	req.SetBasicAuth(url.QueryEscape(a.ClientID), url.QueryEscape(a.ClientSecret))
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return "", "", false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", "", false, fmt.Errorf("token introspection returned HTTP %d", res.StatusCode)
+	}
+	var introspection introspectionResponse
+	if err = json.NewDecoder(res.Body).Decode(&introspection); err != nil {
+		return "", "", false, fmt.Errorf("failed to decode token introspection response: %w", err)
+	}
+	if !introspection.Active {
+		return "", "", false, sync2.HTTP401
+	}
+	var deviceID string
+	isGuest := false
+	for _, scope := range strings.Fields(introspection.Scope) {
+		if strings.HasPrefix(scope, scopeDevicePrefix) {
+			deviceID = strings.TrimPrefix(scope, scopeDevicePrefix)
+		} else if scope == scopeGuest {
+			isGuest = true
+		}
+	}
+	if deviceID == "" || introspection.Username == "" {
+		// tokens which aren't for a Matrix device can't be used to sync
+		return "", "", false, sync2.HTTP401
+	}
+	return "@" + introspection.Username + ":" + a.ServerName, deviceID, isGuest, nil
+}
+
+// authCacheMaxEntries bounds the number of access tokens a CachingAuthenticator remembers.
+const authCacheMaxEntries = 100000
+
+type cachedIdentity struct {
+	userID    string
+	deviceID  string
+	isGuest   bool
+	expiresAt time.Time
+}
+
+// CachingAuthenticator wraps an Authenticator and remembers successfully validated access tokens
+// for a fixed TTL. Failures are never cached, so an invalid token is re-checked every time.
+// Tokens are keyed by their hash so plaintext tokens are not held in memory, along with the server
+// name of the request when the proxy serves more than one homeserver, as a token is only valid on
+// the homeserver which issued it.
+//
+// Tokens which are revoked upstream are accepted until the TTL expires, or until the pollers
+// notice the token has expired and call InvalidateDevice, whichever is sooner.
+type CachingAuthenticator struct {
+	next Authenticator
+	ttl  time.Duration
+	// customisable for testing
+	now        func() time.Time
+	maxEntries int
+	// counts cache lookups labelled by result=hit|miss. May be nil.
+	lookups *prometheus.CounterVec
+
+	mu    *sync.Mutex
+	cache map[string]cachedIdentity
+	// when expired entries are next dropped
+	nextSweep time.Time
+}
+
+// NewCachingAuthenticator caches the results of next for ttl. If ttl is 0 or less, returns next.
+// If lookups is non-nil, cache hits and misses are counted with a "result" label.
+func NewCachingAuthenticator(next Authenticator, ttl time.Duration, lookups *prometheus.CounterVec) Authenticator {
+	if ttl <= 0 {
+		return next
+	}
+	return &CachingAuthenticator{
+		next:       next,
+		ttl:        ttl,
+		now:        time.Now,
+		maxEntries: authCacheMaxEntries,
+		lookups:    lookups,
+		mu:         &sync.Mutex{},
+		cache:      make(map[string]cachedIdentity),
+	}
+}
+
+// cacheKey returns the key of the access token for the homeserver in ctx.
+func cacheKey(ctx context.Context, accessToken string) string {
+	return sync2.ServerNameFromContext(ctx) + "|" + hashAccessToken(accessToken)
+}
+
+func (a *CachingAuthenticator) Authenticate(ctx context.Context, accessToken string) (string, string, bool, error) {
+	key := cacheKey(ctx, accessToken)
+	now := a.now()
+	a.mu.Lock()
+	identity, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && now.Before(identity.expiresAt) {
+		a.countLookup("hit")
+		return identity.userID, identity.deviceID, identity.isGuest, nil
+	}
+	a.countLookup("miss")
+	userID, deviceID, isGuest, err := a.next.Authenticate(ctx, accessToken)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err != nil {
+		delete(a.cache, key)
+		return "", "", false, err
+	}
+	// drop expired entries at most once per TTL, so the cache doesn't grow without bound
+	if !now.Before(a.nextSweep) {
+		for k, v := range a.cache {
+			if !now.Before(v.expiresAt) {
+				delete(a.cache, k)
+			}
+		}
+		a.nextSweep = now.Add(a.ttl)
+	}
+	if _, exists := a.cache[key]; !exists && len(a.cache) >= a.maxEntries {
+		// make room by forgetting an arbitrary token, which will be checked again when next used
+		for k := range a.cache {
+			delete(a.cache, k)
+			break
+		}
+	}
+	a.cache[key] = cachedIdentity{
+		userID:    userID,
+		deviceID:  deviceID,
+		isGuest:   isGuest,
+		expiresAt: now.Add(a.ttl),
+	}
+	return userID, deviceID, isGuest, nil
+}
+
+// InvalidateDevice forgets all cached access tokens for this device. Called when an access token
+// for this device is found to be invalid, so revoked tokens are rejected promptly.
+func (a *CachingAuthenticator) InvalidateDevice(userID, deviceID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, v := range a.cache {
+		if v.userID == userID && v.deviceID == deviceID {
+			delete(a.cache, k)
+		}
+	}
+}
+
+func (a *CachingAuthenticator) countLookup(result string) {
+	if a.lookups != nil {
+		a.lookups.WithLabelValues(result).Inc()
+	}
+}
+
+func hashAccessToken(accessToken string) string {
+	hash := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(hash[:])
+}
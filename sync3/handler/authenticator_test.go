@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+)
+
+type mockAuthenticator struct {
+	calls  int
+	tokens map[string][2]string
+	// tokens for guest accounts
+	guests map[string]bool
+}
+
+func (a *mockAuthenticator) Authenticate(ctx context.Context, accessToken string) (string, string, bool, error) {
+	a.calls++
+	identity, ok := a.tokens[accessToken]
+	if !ok {
+		return "", "", false, sync2.HTTP401
+	}
+	return identity[0], identity[1], a.guests[accessToken], nil
+}
+
+func TestCachingAuthenticator(t *testing.T) {
+	mock := &mockAuthenticator{
+		tokens: map[string][2]string{
+			"good":  {"@alice:localhost", "DEVICE"},
+			"guest": {"@1234:localhost", "DEVICE"},
+		},
+		guests: map[string]bool{
+			"guest": true,
+		},
+	}
+	if NewCachingAuthenticator(mock, 0, nil) != mock {
+		t.Fatalf("NewCachingAuthenticator with no TTL should not cache")
+	}
+	auth := NewCachingAuthenticator(mock, time.Minute, nil).(*CachingAuthenticator)
+	now := time.Now()
+	auth.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	assertAuth := func(token, wantUserID string, wantErr error, wantCalls int) {
+		t.Helper()
+		userID, deviceID, isGuest, err := auth.Authenticate(ctx, token)
+		if err != wantErr {
+			t.Fatalf("Authenticate(%s): got err %v want %v", token, err, wantErr)
+		}
+		if userID != wantUserID {
+			t.Fatalf("Authenticate(%s): got user %s want %s", token, userID, wantUserID)
+		}
+		if err == nil && deviceID != "DEVICE" {
+			t.Fatalf("Authenticate(%s): got device %s", token, deviceID)
+		}
+		if err == nil && isGuest != mock.guests[token] {
+			t.Fatalf("Authenticate(%s): got guest %v want %v", token, isGuest, mock.guests[token])
+		}
+		if mock.calls != wantCalls {
+			t.Fatalf("Authenticate(%s): got %d calls to the underlying authenticator, want %d", token, mock.calls, wantCalls)
+		}
+	}
+
+	assertAuth("good", "@alice:localhost", nil, 1)
+	// cached
+	assertAuth("good", "@alice:localhost", nil, 1)
+	// failures are not cached
+	assertAuth("bad", "", sync2.HTTP401, 2)
+	assertAuth("bad", "", sync2.HTTP401, 3)
+	// the cache expires
+	now = now.Add(time.Minute)
+	assertAuth("good", "@alice:localhost", nil, 4)
+	assertAuth("good", "@alice:localhost", nil, 4)
+	// revoked tokens are forgotten when they are next checked
+	delete(mock.tokens, "good")
+	now = now.Add(2 * time.Minute)
+	assertAuth("good", "", sync2.HTTP401, 5)
+	// guest status is cached along with the user
+	assertAuth("guest", "@1234:localhost", nil, 6)
+	assertAuth("guest", "@1234:localhost", nil, 6)
+	delete(mock.tokens, "guest")
+	now = now.Add(2 * time.Minute)
+	assertAuth("guest", "", sync2.HTTP401, 7)
+	if len(auth.cache) != 0 {
+		t.Fatalf("cache should be empty, got %d entries", len(auth.cache))
+	}
+}
+
+// Test that cached tokens are only valid for the homeserver they were validated by, and that the
+// cache is bounded.
+func TestCachingAuthenticatorKeys(t *testing.T) {
+	mock := &mockAuthenticator{
+		tokens: map[string][2]string{
+			"alice": {"@alice:a.localhost", "DEVICE"},
+			"bob":   {"@bob:a.localhost", "DEVICE"},
+		},
+	}
+	auth := NewCachingAuthenticator(mock, time.Hour, nil).(*CachingAuthenticator)
+	auth.maxEntries = 2
+	ctxA := sync2.WithServerName(context.Background(), "a.localhost")
+	ctxB := sync2.WithServerName(context.Background(), "b.localhost")
+	assertCalls := func(ctx context.Context, token string, wantCalls int) {
+		t.Helper()
+		if _, _, _, err := auth.Authenticate(ctx, token); err != nil {
+			t.Fatalf("Authenticate(%s): %s", token, err)
+		}
+		if mock.calls != wantCalls {
+			t.Fatalf("Authenticate(%s): got %d calls to the underlying authenticator, want %d", token, mock.calls, wantCalls)
+		}
+	}
+	assertCalls(ctxA, "alice", 1)
+	assertCalls(ctxA, "alice", 1)
+	// the same token is checked again for another homeserver
+	assertCalls(ctxB, "alice", 2)
+	assertCalls(ctxB, "alice", 2)
+	// the cache is full, so caching another token forgets one of the others
+	assertCalls(ctxA, "bob", 3)
+	if len(auth.cache) != 2 {
+		t.Fatalf("got %d cache entries want 2", len(auth.cache))
+	}
+	assertCalls(ctxA, "bob", 3)
+}
+
+func TestCachingAuthenticatorInvalidateDevice(t *testing.T) {
+	mock := &mockAuthenticator{
+		tokens: map[string][2]string{
+			"alice1": {"@alice:localhost", "DEVICE"},
+			"alice2": {"@alice:localhost", "DEVICE"},
+			"bob":    {"@bob:localhost", "DEVICE"},
+		},
+	}
+	lookups := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "lookups"}, []string{"result"})
+	auth := NewCachingAuthenticator(mock, time.Hour, lookups).(*CachingAuthenticator)
+	ctx := context.Background()
+	for _, token := range []string{"alice1", "alice2", "bob", "alice1", "bob"} {
+		if _, _, _, err := auth.Authenticate(ctx, token); err != nil {
+			t.Fatalf("Authenticate(%s): %s", token, err)
+		}
+	}
+	count := func(result string) float64 {
+		var m dto.Metric
+		if err := lookups.WithLabelValues(result).Write(&m); err != nil {
+			t.Fatalf("failed to read metric: %s", err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	if hits := count("hit"); hits != 2 {
+		t.Fatalf("got %v hits, want 2", hits)
+	}
+	if misses := count("miss"); misses != 3 {
+		t.Fatalf("got %v misses, want 3", misses)
+	}
+
+	// the poller finds that alice's token has expired: all of alice's tokens are forgotten
+	// straight away rather than when the TTL expires.
+	delete(mock.tokens, "alice1")
+	auth.InvalidateDevice("@alice:localhost", "DEVICE")
+	if _, _, _, err := auth.Authenticate(ctx, "alice1"); err != sync2.HTTP401 {
+		t.Fatalf("revoked token was not rejected: %v", err)
+	}
+	calls := mock.calls
+	if _, _, _, err := auth.Authenticate(ctx, "bob"); err != nil {
+		t.Fatalf("Authenticate(bob): %s", err)
+	}
+	if mock.calls != calls {
+		t.Fatalf("bob's token should still be cached")
+	}
+}
+
+func TestIntrospectionAuthenticator(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, _ := req.BasicAuth(); user != "sliding-sync" || pass != "s3cr%3Dt" {
+			t.Errorf("got client credentials %s %s", user, pass)
+		}
+		if err := req.ParseForm(); err != nil {
+			t.Fatalf("ParseForm: %s", err)
+		}
+		switch req.PostForm.Get("token") {
+		case "alice":
+			w.Write([]byte(`{"active":true,"username":"alice","scope":"openid urn:matrix:org.matrix.msc2967.client:api:* urn:matrix:org.matrix.msc2967.client:device:ALICEDEVICE"}`))
+		case "guest":
+			w.Write([]byte(`{"active":true,"username":"1234","scope":"urn:matrix:org.matrix.msc2967.client:api:guest urn:matrix:org.matrix.msc2967.client:device:GUEST"}`))
+		case "no_device":
+			w.Write([]byte(`{"active":true,"username":"alice","scope":"openid"}`))
+		case "broken":
+			w.WriteHeader(500)
+		default:
+			w.Write([]byte(`{"active":false}`))
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	auth := &IntrospectionAuthenticator{
+		Client:       srv.Client(),
+		URL:          srv.URL,
+		ClientID:     "sliding-sync",
+		ClientSecret: "s3cr=t",
+		ServerName:   "localhost",
+	}
+	testCases := []struct {
+		token        string
+		wantUserID   string
+		wantDeviceID string
+		wantGuest    bool
+		wantErr      error
+	}{
+		{token: "alice", wantUserID: "@alice:localhost", wantDeviceID: "ALICEDEVICE"},
+		{token: "guest", wantUserID: "@1234:localhost", wantDeviceID: "GUEST", wantGuest: true},
+		{token: "no_device", wantErr: sync2.HTTP401},
+		{token: "revoked", wantErr: sync2.HTTP401},
+	}
+	for _, tc := range testCases {
+		userID, deviceID, isGuest, err := auth.Authenticate(ctx, tc.token)
+		if err != tc.wantErr || userID != tc.wantUserID || deviceID != tc.wantDeviceID || isGuest != tc.wantGuest {
+			t.Errorf("%s: got %s %s %v %v want %s %s %v %v", tc.token, userID, deviceID, isGuest, err, tc.wantUserID, tc.wantDeviceID, tc.wantGuest, tc.wantErr)
+		}
+	}
+	// failures of the provider are temporary, not invalid tokens
+	if _, _, _, err := auth.Authenticate(ctx, "broken"); err == nil || err == sync2.HTTP401 {
+		t.Errorf("broken: got err %v want a temporary error", err)
+	}
+}
+
+// Test that a homeserver can't vouch for access tokens of users of another homeserver, when the
+// proxy serves more than one.
+func TestIdentifyUnknownAccessTokenServerName(t *testing.T) {
+	h := &SyncLiveHandler{
+		Authenticator: &mockAuthenticator{
+			tokens: map[string][2]string{
+				"mallory": {"@alice:a.localhost", "DEVICE"},
+			},
+		},
+	}
+	logger := zerolog.Nop()
+	ctx := sync2.WithServerName(context.Background(), "b.localhost")
+	_, herr := h.identifyUnknownAccessToken(ctx, "mallory", &logger)
+	if herr == nil || herr.StatusCode != 401 || herr.ErrCode != "M_UNKNOWN_TOKEN" {
+		t.Fatalf("got %v want 401 M_UNKNOWN_TOKEN", herr)
+	}
+}
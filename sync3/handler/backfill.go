@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/rs/zerolog/hlog"
+)
+
+// MessagesPath is the path of the endpoint which serves timeline history older than the proxy has
+// stored. See SetBackfill.
+const MessagesPath = "/_matrix/client/unstable/org.matrix.msc3575/sync/messages"
+
+const (
+	defaultBackfillLimit = 20
+	maxBackfillLimit     = 100
+	// backfill tokens are prefixed so they can't be confused with upstream tokens
+	backfillTokenPrefix = "ssb_"
+)
+
+// MessagesResponse is a page of timeline history, newest first. End is the token for the page
+// before this one, and is empty when there is no more history.
+type MessagesResponse struct {
+	Chunk []json.RawMessage `json:"chunk"`
+	End   string            `json:"end,omitempty"`
+}
+
+func backfillToken(pageID int64) string {
+	return backfillTokenPrefix + strconv.FormatInt(pageID, 10)
+}
+
+// parseBackfillToken returns the page ID in a token made by backfillToken, or false if this is
+// some other token e.g an upstream prev_batch.
+func parseBackfillToken(token string) (pageID int64, ok bool) {
+	if !strings.HasPrefix(token, backfillTokenPrefix) {
+		return 0, false
+	}
+	pageID, err := strconv.ParseInt(strings.TrimPrefix(token, backfillTokenPrefix), 10, 64)
+	return pageID, err == nil
+}
+
+// serveMessages returns the page of history before the `from` token in the room. `from` is either a
+// prev_batch from a sync response, or the `end` of a previous page. Pages are fetched from the
+// homeserver's /messages the first time they are requested, then served from the database, so a
+// page always has the events it had when it was first fetched, whatever the limit.
+func (h *SyncLiveHandler) serveMessages(w http.ResponseWriter, req *http.Request) error {
+	if !h.backfill || req.Method != "GET" {
+		return &internal.HandlerError{
+			StatusCode: 404,
+			ErrCode:    "M_UNRECOGNIZED",
+			Err:        fmt.Errorf("backfilling history is not enabled"),
+		}
+	}
+	query := req.URL.Query()
+	roomID := query.Get("room_id")
+	from := query.Get("from")
+	if roomID == "" || from == "" {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			ErrCode:    "M_MISSING_PARAM",
+			Err:        fmt.Errorf("room_id and from are required"),
+		}
+	}
+	limit := int64(defaultBackfillLimit)
+	if query.Get("limit") != "" {
+		var herr *internal.HandlerError
+		if limit, herr = parseIntFromQuery(req.URL, "limit"); herr != nil {
+			return herr
+		}
+		if limit <= 0 {
+			limit = defaultBackfillLimit
+		} else if limit > maxBackfillLimit {
+			limit = maxBackfillLimit
+		}
+	}
+	accessToken, err := internal.ExtractAccessToken(req)
+	if err != nil || accessToken == "" {
+		return &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        err,
+		}
+	}
+	token, herr := h.lookupToken(req, accessToken)
+	if herr != nil {
+		return herr
+	}
+
+	upstreamFrom := from
+	if pageID, ok := parseBackfillToken(from); ok {
+		prev, err := h.Storage.BackfillTable.SelectByID(pageID)
+		if err != nil {
+			return err
+		}
+		// pages belong to the user who fetched them, as they only contain history that user can see
+		if prev == nil || prev.UserID != token.UserID || prev.RoomID != roomID {
+			return &internal.HandlerError{
+				StatusCode: 400,
+				ErrCode:    "M_INVALID_PARAM",
+				Err:        fmt.Errorf("unknown from token %s", from),
+			}
+		}
+		if prev.End == "" {
+			// there is no more history
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			return json.NewEncoder(w).Encode(MessagesResponse{Chunk: []json.RawMessage{}})
+		}
+		upstreamFrom = prev.End
+	}
+	page, err := h.Storage.BackfillTable.SelectByFrom(token.UserID, roomID, upstreamFrom)
+	if err != nil {
+		return err
+	}
+	if page == nil {
+		page, herr = h.fetchBackfillPage(req, accessToken, token.UserID, roomID, upstreamFrom, int(limit))
+		if herr != nil {
+			return herr
+		}
+	}
+	var res MessagesResponse
+	if err = json.Unmarshal(page.Events, &res.Chunk); err != nil {
+		return err
+	}
+	if page.End != "" {
+		res.End = backfillToken(page.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(res)
+}
+
+// fetchBackfillPage fetches the page before `from` from the homeserver as the user, and stores it.
+func (h *SyncLiveHandler) fetchBackfillPage(req *http.Request, accessToken, userID, roomID, from string, limit int) (*state.BackfillPage, *internal.HandlerError) {
+	ctx := sync2.WithServerName(req.Context(), sync2.ServerNameOf(userID))
+	messages, err := h.V2.Messages(ctx, accessToken, roomID, from, limit)
+	if err != nil {
+		if herr := unknownTokenError(err); herr != nil {
+			return nil, herr
+		}
+		hlog.FromRequest(req).Warn().Err(err).Str("room", roomID).Msg("failed to backfill from /messages")
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusBadGateway,
+			Err:        err,
+		}
+	}
+	// the homeserver sends back the from token when there is no more history
+	end := messages.End
+	if end == from {
+		end = ""
+	}
+	pageID, err := h.Storage.BackfillTable.Insert(userID, roomID, from, end, messages.Chunk)
+	if err != nil {
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	eventsJSON, _ := json.Marshal(messages.Chunk)
+	if messages.Chunk == nil {
+		eventsJSON = []byte("[]")
+	}
+	return &state.BackfillPage{
+		ID:     pageID,
+		UserID: userID,
+		RoomID: roomID,
+		From:   from,
+		End:    end,
+		Events: eventsJSON,
+	}, nil
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestBackfillToken(t *testing.T) {
+	pageID, ok := parseBackfillToken(backfillToken(42))
+	if !ok || pageID != 42 {
+		t.Fatalf("round trip: got %d %v want 42 true", pageID, ok)
+	}
+	// upstream tokens are passed through to the homeserver
+	for _, token := range []string{"t47-1234_5_6", "ssb_", "ssb_abc", ""} {
+		if _, ok := parseBackfillToken(token); ok {
+			t.Errorf("parseBackfillToken(%q) returned ok", token)
+		}
+	}
+}
+
+func TestServeMessagesDisabled(t *testing.T) {
+	h := &SyncLiveHandler{}
+	req := httptest.NewRequest("GET", MessagesPath+"?room_id=!a:localhost&from=t1", nil)
+	err := h.serveMessages(httptest.NewRecorder(), req)
+	herr, ok := err.(*internal.HandlerError)
+	if !ok || herr.StatusCode != 404 || herr.ErrCode != "M_UNRECOGNIZED" {
+		t.Fatalf("got %v want 404 M_UNRECOGNIZED", err)
+	}
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		// responses are compressed whilst the client waits, so favour speed over size
+		w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return w
+	},
+}
+
+// acceptsEncoding returns true if the Accept-Encoding header allows the content coding, i.e it is
+// listed, or * is, without q=0.
+func acceptsEncoding(header http.Header, coding string) bool {
+	accepted := false
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.TrimSpace(name)
+			if !strings.EqualFold(name, coding) && name != "*" {
+				continue
+			}
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if ok && strings.EqualFold(strings.TrimSpace(key), "q") {
+					if parsed, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err == nil {
+						q = parsed
+					}
+				}
+			}
+			if strings.EqualFold(name, coding) {
+				// an explicit entry for the coding overrides *
+				return q > 0
+			}
+			accepted = q > 0
+		}
+	}
+	return accepted
+}
+
+// gzipResponseWriter gzips the body written to the underlying ResponseWriter. Flush flushes the
+// gzip stream as well, so streamed rooms reach the client as they are written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+// newGzipResponseWriter sets the headers for a gzipped body and returns a writer for it. Call Close
+// once the body is written.
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Length")
+	gz := gzipWriters.Get().(*gzip.Writer)
+	gz.Reset(w)
+	return &gzipResponseWriter{ResponseWriter: w, gz: gz}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	return w.gz.Write(p)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	w.gz.Flush()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes the end of the gzip stream.
+func (w *gzipResponseWriter) Close() error {
+	err := w.gz.Close()
+	gzipWriters.Put(w.gz)
+	return err
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	testCases := []struct {
+		headers []string
+		want    bool
+	}{
+		{headers: nil, want: false},
+		{headers: []string{"gzip"}, want: true},
+		{headers: []string{"deflate, GZIP"}, want: true},
+		{headers: []string{"br", "gzip;q=0.5"}, want: true},
+		{headers: []string{"gzip;q=0"}, want: false},
+		{headers: []string{"gzip; q=0.0, deflate"}, want: false},
+		{headers: []string{"*"}, want: true},
+		{headers: []string{"*;q=0"}, want: false},
+		{headers: []string{"gzip;q=0, *"}, want: false},
+		{headers: []string{"*;q=0, gzip"}, want: true},
+		{headers: []string{"identity"}, want: false},
+		{headers: []string{"x-gzip"}, want: false},
+	}
+	for _, tc := range testCases {
+		header := http.Header{}
+		for _, h := range tc.headers {
+			header.Add("Accept-Encoding", h)
+		}
+		if got := acceptsEncoding(header, "gzip"); got != tc.want {
+			t.Errorf("acceptsEncoding(%v): got %v want %v", tc.headers, got, tc.want)
+		}
+	}
+}
+
+func TestGzipResponseWriter(t *testing.T) {
+	h := &SyncLiveHandler{}
+	resp := &sync3.Response{
+		Pos: "5",
+		Rooms: map[string]sync3.Room{
+			"!a:localhost": {Name: "A"},
+			"!b:localhost": {Name: "B"},
+		},
+	}
+	req := httptest.NewRequest("POST", "/sync", nil)
+	rec := httptest.NewRecorder()
+	gw := newGzipResponseWriter(rec)
+	if err := h.writeResponse(gw, req, resp); err != nil {
+		t.Fatalf("writeResponse: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q want gzip", got)
+	}
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %s", err)
+	}
+	var got sync3.Response
+	if err := json.NewDecoder(r).Decode(&got); err != nil {
+		t.Fatalf("failed to decode gzipped response: %s", err)
+	}
+	if got.Pos != resp.Pos || len(got.Rooms) != 2 || got.Rooms["!b:localhost"].Name != "B" {
+		t.Fatalf("got %+v want %+v", got, resp)
+	}
+}
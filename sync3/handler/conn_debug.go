@@ -0,0 +1,267 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// ConnDebugPath is the path prefix of the endpoint which describes the connections on one of the
+// user's devices, followed by the device ID. See SetConnDebug.
+const ConnDebugPath = "/_debug/connections/"
+
+// ConnDebugResponse describes the connections on a device, sorted by conn_id.
+type ConnDebugResponse struct {
+	Connections []ConnDebug `json:"connections"`
+}
+
+// ConnDebug is the state of a connection as of the last response calculated on it, for client
+// developers working out why the connection returned what it did.
+type ConnDebug struct {
+	// The conn_id the client gave, which is empty if it didn't give one.
+	ConnID string `json:"conn_id"`
+	// The pos of the last response calculated for the client.
+	LastPos           int64                             `json:"last_pos"`
+	Lists             map[string]ConnDebugList          `json:"lists"`
+	RoomSubscriptions map[string]sync3.RoomSubscription `json:"room_subscriptions"`
+	// The last responses calculated on the connection, oldest first.
+	Responses []ConnDebugResponseSummary `json:"responses"`
+}
+
+// ConnDebugList is a list as the connection has it, after combining the sticky parameters of
+// every request.
+type ConnDebugList struct {
+	Ranges  sync3.SliceRanges     `json:"ranges"`
+	Sort    []string              `json:"sort"`
+	Filters *sync3.RequestFilters `json:"filters,omitempty"`
+	Count   int                   `json:"count"`
+}
+
+// ConnDebugResponseSummary summarises a response, with the order of each list's rooms when it was
+// calculated.
+type ConnDebugResponseSummary struct {
+	// The pos of the request the response was calculated for, which is 0 for the first request.
+	Since int64 `json:"since"`
+	// When the response was calculated, in milliseconds since the epoch.
+	Timestamp int64 `json:"ts"`
+	Initial   bool  `json:"initial"`
+	// The rooms in the response, sorted by room ID.
+	Rooms []string                        `json:"rooms"`
+	Lists map[string]ConnDebugListSummary `json:"lists"`
+}
+
+// ConnDebugListSummary is what a response said about a list. Rooms are the rooms in the list's
+// ranges after the response, in list order, with the values they were sorted by.
+type ConnDebugListSummary struct {
+	Count int                   `json:"count"`
+	Ops   []sync3.ResponseOp    `json:"ops,omitempty"`
+	Rooms []ConnDebugSortedRoom `json:"rooms"`
+}
+
+// ConnDebugSortedRoom is a room in a list, with the values which list sort orders compare.
+type ConnDebugSortedRoom struct {
+	RoomID string `json:"room_id"`
+	Index  int    `json:"index"`
+	Name   string `json:"name"`
+	// The timestamp the room is sorted by for by_recency, which depends on the list's bump_event_types.
+	Recency           uint64             `json:"recency_ts"`
+	NotificationCount int                `json:"notification_count"`
+	HighlightCount    int                `json:"highlight_count"`
+	Encrypted         bool               `json:"encrypted"`
+	Tags              map[string]float64 `json:"tags,omitempty"`
+}
+
+// connDebugger keeps the state of a connection after each response, so it can be read without
+// waiting for the request being processed.
+type connDebugger struct {
+	mu           *sync.Mutex
+	maxResponses int
+	// the state as of the last response
+	lists             map[string]ConnDebugList
+	roomSubscriptions map[string]sync3.RoomSubscription
+	responses         []ConnDebugResponseSummary
+}
+
+func newConnDebugger(maxResponses int) *connDebugger {
+	return &connDebugger{
+		mu:                &sync.Mutex{},
+		maxResponses:      maxResponses,
+		lists:             map[string]ConnDebugList{},
+		roomSubscriptions: map[string]sync3.RoomSubscription{},
+	}
+}
+
+// record the state of the connection after calculating this response to the request. Must be
+// called by the conn goroutine, as it reads the connection's lists.
+func (d *connDebugger) record(s *ConnState, req *sync3.Request, isInitial bool, response *sync3.Response) {
+	lists := make(map[string]ConnDebugList, len(s.muxedReq.Lists))
+	for listKey, reqList := range s.muxedReq.Lists {
+		list := ConnDebugList{
+			Ranges:  reqList.Ranges,
+			Sort:    reqList.Sort,
+			Filters: reqList.Filters,
+		}
+		if sortedRooms := s.lists.Get(listKey); sortedRooms != nil {
+			list.Sort = sortedRooms.SortBy()
+			list.Count = int(sortedRooms.Len())
+		}
+		lists[listKey] = list
+	}
+	roomSubscriptions := make(map[string]sync3.RoomSubscription, len(s.roomSubscriptions))
+	for roomID, sub := range s.roomSubscriptions {
+		roomSubscriptions[roomID] = sub
+	}
+	summary := ConnDebugResponseSummary{
+		Since:     req.Pos(),
+		Timestamp: time.Now().UnixMilli(),
+		Initial:   isInitial,
+		Rooms:     make([]string, 0, len(response.Rooms)),
+		Lists:     make(map[string]ConnDebugListSummary, len(response.Lists)),
+	}
+	for roomID := range response.Rooms {
+		summary.Rooms = append(summary.Rooms, roomID)
+	}
+	sort.Strings(summary.Rooms)
+	for listKey, l := range response.Lists {
+		summary.Lists[listKey] = ConnDebugListSummary{
+			Count: l.Count,
+			Ops:   l.Ops,
+			Rooms: sortedRoomsInRanges(s.lists, listKey, s.muxedReq.Lists[listKey]),
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lists = lists
+	d.roomSubscriptions = roomSubscriptions
+	d.responses = append(d.responses, summary)
+	if len(d.responses) > d.maxResponses {
+		d.responses = d.responses[len(d.responses)-d.maxResponses:]
+	}
+}
+
+// sortedRoomsInRanges returns the rooms in the list's ranges in list order, with their sort values.
+func sortedRoomsInRanges(lists *sync3.InternalRequestLists, listKey string, reqList sync3.RequestList) []ConnDebugSortedRoom {
+	sortedRooms := lists.Get(listKey)
+	if sortedRooms == nil {
+		return nil
+	}
+	var roomIDs []string
+	if reqList.SlowGetAllRooms != nil && *reqList.SlowGetAllRooms {
+		roomIDs = sortedRooms.RoomIDs()
+	} else {
+		for _, subslice := range reqList.Ranges.SliceInto(sortedRooms) {
+			roomIDs = append(roomIDs, subslice.(sync3.SortableRoomsSubslice).RoomIDs()...)
+		}
+	}
+	rooms := make([]ConnDebugSortedRoom, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		r := lists.ReadOnlyRoom(roomID)
+		if r == nil {
+			continue
+		}
+		index, _ := sortedRooms.IndexOf(roomID)
+		var tags map[string]float64
+		if len(r.Tags) > 0 {
+			// copied, as the room's tags are replaced whilst the conn goroutine runs
+			tags = make(map[string]float64, len(r.Tags))
+			for tag, order := range r.Tags {
+				tags[tag] = order
+			}
+		}
+		rooms = append(rooms, ConnDebugSortedRoom{
+			RoomID:            roomID,
+			Index:             index,
+			Name:              r.CanonicalisedName,
+			Recency:           r.GetLastInterestedEventTimestamp(listKey),
+			NotificationCount: r.NotificationCount,
+			HighlightCount:    r.HighlightCount,
+			Encrypted:         r.Encrypted,
+			Tags:              tags,
+		})
+	}
+	return rooms
+}
+
+// snapshot returns a copy of the state of the connection as of the last response.
+func (d *connDebugger) snapshot(cid sync3.ConnID, lastPos int64) ConnDebug {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	responses := make([]ConnDebugResponseSummary, len(d.responses))
+	copy(responses, d.responses)
+	return ConnDebug{
+		ConnID:            cid.CID,
+		LastPos:           lastPos,
+		Lists:             d.lists,
+		RoomSubscriptions: d.roomSubscriptions,
+		Responses:         responses,
+	}
+}
+
+// SetConnDebug serves ConnDebugPath, which lets users see the lists, room subscriptions and recent
+// responses of the connections on their devices. The last numResponses responses of each
+// connection are summarised. 0 disables the endpoint.
+func (h *SyncLiveHandler) SetConnDebug(numResponses int) {
+	h.connDebugResponses = numResponses
+}
+
+// serveConnDebug describes the connections on one of the user's devices.
+func (h *SyncLiveHandler) serveConnDebug(w http.ResponseWriter, req *http.Request) error {
+	if h.connDebugResponses <= 0 || req.Method != "GET" {
+		return &internal.HandlerError{
+			StatusCode: 404,
+			ErrCode:    "M_UNRECOGNIZED",
+			Err:        fmt.Errorf("connection debugging is not enabled"),
+		}
+	}
+	deviceID := strings.TrimPrefix(req.URL.Path, ConnDebugPath)
+	if deviceID == "" {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			ErrCode:    "M_MISSING_PARAM",
+			Err:        fmt.Errorf("a device ID is required"),
+		}
+	}
+	accessToken, err := internal.ExtractAccessToken(req)
+	if err != nil || accessToken == "" {
+		return &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        err,
+		}
+	}
+	token, herr := h.lookupToken(req, accessToken)
+	if herr != nil {
+		return herr
+	}
+	res := ConnDebugResponse{
+		Connections: []ConnDebug{},
+	}
+	// users can only see the connections of their own devices
+	for _, conn := range h.ConnMap.Conns(token.UserID, deviceID) {
+		cs, ok := conn.Handler().(*ConnState)
+		if !ok || cs.debug == nil {
+			continue
+		}
+		res.Connections = append(res.Connections, cs.debug.snapshot(conn.ConnID, conn.Snapshot().LastPos))
+	}
+	if len(res.Connections) == 0 {
+		return &internal.HandlerError{
+			StatusCode: 404,
+			ErrCode:    "M_NOT_FOUND",
+			Err:        fmt.Errorf("no connections for device %s", deviceID),
+		}
+	}
+	sort.Slice(res.Connections, func(i, j int) bool {
+		return res.Connections[i].ConnID < res.Connections[j].ConnID
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	return json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestConnDebugRecordsResponses(t *testing.T) {
+	cid := sync3.ConnID{
+		DeviceID: "d",
+		CID:      "room-list",
+	}
+	userID := "@TestConnDebugRecordsResponses_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1000))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(3000))
+	roomC := newRoomMetadata("!c:localhost", spec.Timestamp(2000))
+	cs, _, _ := newTestConnState(t, userID, "d", roomA, roomB, roomC)
+	cs.debug = newConnDebugger(1)
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges{{0, 1}},
+		}},
+	}
+	if _, err := cs.OnIncomingRequest(context.Background(), cid, req, true, time.Now()); err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	req = &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{{1, 2}},
+		}},
+	}
+	req.SetPos(1)
+	if _, err := cs.OnIncomingRequest(context.Background(), cid, req, false, time.Now()); err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	got := cs.debug.snapshot(cid, 2)
+	if got.ConnID != "room-list" || got.LastPos != 2 {
+		t.Errorf("got conn_id %q last_pos %d want room-list 2", got.ConnID, got.LastPos)
+	}
+	wantList := ConnDebugList{
+		Ranges: sync3.SliceRanges{{1, 2}},
+		Sort:   []string{sync3.SortByRecency},
+		Count:  3,
+	}
+	if !reflect.DeepEqual(got.Lists["a"], wantList) {
+		t.Errorf("got list %+v want %+v", got.Lists["a"], wantList)
+	}
+	// only the last response is kept
+	if len(got.Responses) != 1 {
+		t.Fatalf("got %d responses want 1", len(got.Responses))
+	}
+	res := got.Responses[0]
+	if res.Since != 1 || res.Initial {
+		t.Errorf("got since %d initial %v want 1 false", res.Since, res.Initial)
+	}
+	var gotRooms []string
+	var gotIndexes []int
+	for _, r := range res.Lists["a"].Rooms {
+		gotRooms = append(gotRooms, r.RoomID)
+		gotIndexes = append(gotIndexes, r.Index)
+	}
+	if want := []string{roomC.RoomID, roomA.RoomID}; !reflect.DeepEqual(gotRooms, want) {
+		t.Errorf("got sorted rooms %v want %v", gotRooms, want)
+	}
+	if want := []int{1, 2}; !reflect.DeepEqual(gotIndexes, want) {
+		t.Errorf("got indexes %v want %v", gotIndexes, want)
+	}
+	if got := res.Lists["a"].Rooms[0].Recency; got != 2000 {
+		t.Errorf("got recency %d want 2000", got)
+	}
+}
+
+func TestServeConnDebugDisabled(t *testing.T) {
+	h := &SyncLiveHandler{}
+	req := httptest.NewRequest("GET", ConnDebugPath+"DEVICE", nil)
+	err := h.serveConnDebug(httptest.NewRecorder(), req)
+	herr, ok := err.(*internal.HandlerError)
+	if !ok || herr.StatusCode != 404 || herr.ErrCode != "M_UNRECOGNIZED" {
+		t.Fatalf("got %v want 404 M_UNRECOGNIZED", err)
+	}
+}
@@ -0,0 +1,37 @@
+package handler
+
+import (
+	"encoding/json"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// PostgresConnStore is a sync3.ConnStore which saves connection positions as JSON in Postgres.
+type PostgresConnStore struct {
+	table *state.ConnPositionsTable
+}
+
+func NewPostgresConnStore(table *state.ConnPositionsTable) *PostgresConnStore {
+	return &PostgresConnStore{table: table}
+}
+
+func (s *PostgresConnStore) Save(connID sync3.ConnID, pos sync3.ConnPosition) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	return s.table.Upsert(connID.UserID, connID.DeviceID, connID.CID, data)
+}
+
+func (s *PostgresConnStore) Load(connID sync3.ConnID) (*sync3.ConnPosition, error) {
+	data, err := s.table.Select(connID.UserID, connID.DeviceID, connID.CID)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var pos sync3.ConnPosition
+	if err = json.Unmarshal(data, &pos); err != nil {
+		return nil, err
+	}
+	return &pos, nil
+}
@@ -3,6 +3,8 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"hash/fnv"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -22,6 +24,8 @@ type JoinChecker interface {
 type ConnState struct {
 	userID   string
 	deviceID string
+	// True if the user is a guest, in which case only rooms which allow guest access are visible.
+	isGuest bool
 	// the only thing that can touch these data structures is the conn goroutine
 	muxedReq        *sync3.Request
 	cancelLatestReq context.CancelFunc
@@ -42,16 +46,41 @@ type ConnState struct {
 	anchorLoadPosition int64
 	// roomID -> latest load pos
 	loadPositions map[string]int64
-
-	txnIDWaiter *TxnIDWaiter
-	live        *connStateLive
+	// The maximum number of joined rooms to track when the connection is loaded, or 0 for no limit.
+	// Untracked rooms are not put in lists or loaded for this connection, but the user cache and
+	// the poller still have them, so this only bounds the memory used by each connection.
+	maxTrackedRooms int
+	// The number of rooms the user was joined to when the connection was loaded.
+	numJoinedRooms int
+	// Joined rooms which were not tracked because of maxTrackedRooms. Rooms are removed from this
+	// set when they get activity, at which point they are tracked like any other room.
+	untrackedRooms map[string]struct{}
+	// list key -> the count sent in the previous response, used to calculate count deltas
+	listCounts map[string]int
+	// Rooms which were left out of the previous response because of max_response_bytes, which
+	// are sent in full on the next request.
+	trimmedRooms map[string]struct{}
+	// room ID -> the notification level last sent for the room, so that it is sent again when the
+	// user's push rules change it.
+	notificationLevels map[string]string
+	// room ID -> event type and state key -> hash of the state event last sent in required_state,
+	// for rooms which want required_state_delta. Starts empty for every new connection, so the
+	// first time a room is sent on a connection it has its full state.
+	sentState map[string]map[string]uint64
+
+	live *connStateLive
 
 	globalCache *caches.GlobalCache
 	userCache   *caches.UserCache
-	userCacheID int
 	lazyCache   *LazyCache
 
 	joinChecker JoinChecker
+	// records the connection's state after each response for ConnDebugPath. nil if disabled.
+	debug *connDebugger
+	// redacts, drops or annotates events and rooms before they are sent. nil if not filtering.
+	responseFilter ResponseFilter
+	// caps the initial syncs calculated at once across every connection. nil means no limit.
+	initialSyncs *initialSyncLimiter
 
 	extensionsHandler   extensions.HandlerInterface
 	setupHistogramVec   *prometheus.HistogramVec
@@ -61,7 +90,8 @@ type ConnState struct {
 func NewConnState(
 	userID, deviceID string, userCache *caches.UserCache, globalCache *caches.GlobalCache,
 	ex extensions.HandlerInterface, joinChecker JoinChecker, setupHistVec *prometheus.HistogramVec, histVec *prometheus.HistogramVec,
-	maxPendingEventUpdates int, maxTransactionIDDelay time.Duration,
+	devices *deviceUpdatesMap, maxCoalesceWindow time.Duration,
+	maxTrackedRooms int,
 ) *ConnState {
 	cs := &ConnState{
 		globalCache:         globalCache,
@@ -70,6 +100,9 @@ func NewConnState(
 		deviceID:            deviceID,
 		anchorLoadPosition:  -1,
 		loadPositions:       make(map[string]int64),
+		maxTrackedRooms:     maxTrackedRooms,
+		listCounts:          make(map[string]int),
+		notificationLevels:  make(map[string]string),
 		roomSubscriptions:   make(map[string]sync3.RoomSubscription),
 		lists:               sync3.NewInternalRequestLists(),
 		extensionsHandler:   ex,
@@ -79,19 +112,12 @@ func NewConnState(
 		processHistogramVec: histVec,
 	}
 	cs.live = &connStateLive{
-		ConnState: cs,
-		updates:   make(chan caches.Update, maxPendingEventUpdates),
-	}
-	cs.txnIDWaiter = NewTxnIDWaiter(
-		userID,
-		maxTransactionIDDelay,
-		func(delayed bool, update caches.Update) {
-			cs.live.onUpdate(update)
-		},
-	)
+		ConnState:         cs,
+		maxCoalesceWindow: maxCoalesceWindow,
+	}
 	// subscribe for updates before loading. We risk seeing dupes but that's fine as load positions
 	// will stop us double-processing.
-	cs.userCacheID = cs.userCache.Subsribe(cs)
+	cs.live.updates = devices.Subscribe(userCache, deviceID, cs.Destroy)
 	return cs
 }
 
@@ -106,17 +132,31 @@ func NewConnState(
 //     N events arrive and get buffered.
 //   - load() bases its current state based on the latest position, which includes processing of these N events.
 //   - post load() we read N events, processing them a 2nd time.
+//
+// If the user cache already knows the joined rooms (e.g it was warmed up) they are used instead of
+// loading them from the database. They are positioned at the latest event the user cache has seen,
+// so the same guard applies.
 func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
-	initialLoadPosition, joinedRooms, joinTimings, loadPositions, err := s.globalCache.LoadJoinedRooms(ctx, s.userID)
-	if err != nil {
-		return err
+	initialLoadPosition, joinTimings, loadPositions, ok := s.userCache.JoinedRooms()
+	var joinedRooms map[string]*internal.RoomMetadata
+	if ok {
+		joinedRooms = s.globalCache.LoadRoomsFromMap(ctx, joinTimings)
+	} else {
+		var err error
+		initialLoadPosition, joinedRooms, joinTimings, loadPositions, err = s.globalCache.LoadJoinedRooms(ctx, s.userID)
+		if err != nil {
+			return err
+		}
 	}
 	for roomID, pos := range loadPositions {
 		s.loadPositions[roomID] = pos
 	}
-	rooms := make([]sync3.RoomConnMetadata, len(joinedRooms))
-	i := 0
+	s.numJoinedRooms = len(joinedRooms)
+	rooms := make([]sync3.RoomConnMetadata, 0, len(joinedRooms))
 	for _, metadata := range joinedRooms {
+		if s.hiddenFromGuest(metadata) {
+			continue
+		}
 		metadata.RemoveHero(s.userID)
 		urd := s.userCache.LoadRoomData(metadata.RoomID)
 		timing, ok := joinTimings[metadata.RoomID]
@@ -142,16 +182,19 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 			}
 			interestedEventTimestampsByList[listKey] = interestingActivityTs
 		}
-		rooms[i] = sync3.RoomConnMetadata{
+		rooms = append(rooms, sync3.RoomConnMetadata{
 			RoomMetadata:                  *metadata,
 			UserRoomData:                  urd,
 			LastInterestedEventTimestamps: interestedEventTimestampsByList,
-		}
-		i++
+		})
 	}
+	rooms = s.trackMostRecentRooms(rooms)
 	invites := s.userCache.Invites()
 	for _, urd := range invites {
 		metadata := urd.Invite.RoomMetadata()
+		if s.hiddenFromGuest(metadata) {
+			continue
+		}
 		inviteTimestampsByList := make(map[string]uint64, len(req.Lists))
 		for listKey, _ := range req.Lists {
 			inviteTimestampsByList[listKey] = metadata.LastMessageTimestamp
@@ -170,22 +213,61 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 	return nil
 }
 
+// trackMostRecentRooms returns the maxTrackedRooms most recently active rooms, remembering the
+// rest as untracked. Returns all the rooms if there is no limit or the limit is not reached.
+// Untracked rooms are still in the user cache, see maxTrackedRooms.
+func (s *ConnState) trackMostRecentRooms(rooms []sync3.RoomConnMetadata) []sync3.RoomConnMetadata {
+	if s.maxTrackedRooms <= 0 || len(rooms) <= s.maxTrackedRooms {
+		return rooms
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].LastMessageTimestamp > rooms[j].LastMessageTimestamp
+	})
+	s.untrackedRooms = make(map[string]struct{}, len(rooms)-s.maxTrackedRooms)
+	for _, r := range rooms[s.maxTrackedRooms:] {
+		s.untrackedRooms[r.RoomID] = struct{}{}
+	}
+	logger.Info().Str("user", s.userID).Str("device", s.deviceID).Int("tracked", s.maxTrackedRooms).Int(
+		"untracked", len(s.untrackedRooms),
+	).Msg("too many rooms, not tracking the least recently active rooms")
+	return rooms[:s.maxTrackedRooms]
+}
+
 // OnIncomingRequest is guaranteed to be called sequentially (it's protected by a mutex in conn.go)
 func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req *sync3.Request, isInitial bool, start time.Time) (*sync3.Response, error) {
+	if isInitial {
+		release, err := s.initialSyncs.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		// nothing is kept from an initial request which is cancelled, as the client retries it on a
+		// new connection, so stop loading its data from the database as soon as it is superseded.
+		// Later requests keep loading, as their responses are buffered for the client to retry.
+		ctx = internal.WithCancellableLoads(ctx)
+	}
 	if s.anchorLoadPosition <= 0 {
 		// load() needs no ctx so drop it
 		_, region := internal.StartSpan(ctx, "load")
 		err := s.load(ctx, req)
+		region.End()
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
 			// in practice this means DB hit failures. If we try again later maybe it'll work, and we will because
 			// anchorLoadPosition is unset.
 			logger.Err(err).Str("conn", cid.String()).Msg("failed to load initial data")
 		}
-		region.End()
 	}
 	setupTime := time.Since(start)
 	s.trackSetupDuration(ctx, setupTime, isInitial)
-	return s.onIncomingRequest(ctx, req, isInitial)
+	resp, err := s.onIncomingRequest(ctx, req, isInitial)
+	if err == nil && isInitial && ctx.Err() != nil {
+		// loads were cancelled part way through, so the response may be missing data
+		return nil, ctx.Err()
+	}
+	return resp, err
 }
 
 // onIncomingRequest is a callback which fires when the client makes a request to the server. Whilst each request may
@@ -216,6 +298,8 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	s.buildRoomSubscriptions(reqCtx, builder, delta.Subs, delta.Unsubs)
 	// works out how rooms get moved about but doesn't pull room data
 	respLists := s.buildListSubscriptions(reqCtx, builder, delta.Lists)
+	// resends rooms which did not fit in the previous response
+	s.buildTrimmedRooms(reqCtx, builder)
 
 	// pull room data and set changes on the response
 	response := &sync3.Response{
@@ -251,32 +335,255 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	s.live.liveUpdate(updateCtx, req, s.muxedReq.Extensions, isInitial, response)
 	region.End()
 
+	// extensions aggregate live updates, so only enforce size limits once the response is complete
+	s.extensionsHandler.EnforceSizeLimits(reqCtx, &response.Extensions)
+
 	// counts are AFTER events are applied, hence after liveUpdate
+	countsChanged := false
 	for listKey := range response.Lists {
 		l := response.Lists[listKey]
 		l.Count = s.lists.Count(listKey)
+		reqList := s.muxedReq.Lists[listKey]
+		prevCount, ok := s.listCounts[listKey]
+		if !ok || prevCount != l.Count {
+			countsChanged = true
+		}
+		if ok && reqList.WantsCountDelta() {
+			countDelta := l.Count - prevCount
+			l.CountDelta = &countDelta
+		}
+		s.listCounts[listKey] = l.Count
+		if reqList.WantsIndexes() {
+			l.Indexes = listIndexes(s.lists.Get(listKey), l.Ops)
+		}
+		if reqList.IsDebug() {
+			l.Applied = &sync3.AppliedList{
+				Sort:    s.lists.Get(listKey).SortBy(),
+				Filters: reqList.Filters,
+			}
+		}
 		response.Lists[listKey] = l
 	}
 
+	response.UntrackedRooms = len(s.untrackedRooms)
+
+	// summarise membership changes AFTER live update so we include events from both initial
+	// room loading and live updates. Filter first, so nothing is summarised from dropped events.
+	for roomID, room := range response.Rooms {
+		if s.responseFilter != nil {
+			room = filterRoom(reqCtx, s.responseFilter, s.userID, roomID, room)
+		}
+		room.MembershipChanges = sync3.MembershipChangesFromTimeline(room.Timeline)
+		if s.live.shouldInclude(roomID, sync3.RoomSubscription.IncludeRelationTargets) {
+			room.RelationTargets = s.loadRelationTargets(reqCtx, roomID, room.Timeline)
+		}
+		response.Rooms[roomID] = room
+	}
+
 	// Add membership events for users sending typing notifications. We do this after live update
 	// and initial room loading code so we LL room members in all cases.
 	if response.Extensions.Typing != nil && response.Extensions.Typing.HasData(isInitial) {
 		s.lazyLoadTypingMembers(reqCtx, response)
 	}
+
+	// trim last so the size of everything else in the response is known
+	s.trimRoomsToFit(reqCtx, response)
+	// after trimming, so only the state of rooms which are actually sent is remembered
+	s.deltaRequiredState(response)
+	response.NoChange = !isInitial && !countsChanged && !responseHasData(response, isInitial) && len(response.TrimmedRooms) == 0
+	if s.debug != nil && !response.NoChange {
+		s.debug.record(s, req, isInitial, response)
+	}
 	return response, nil
 }
 
+// deltaRequiredState removes the required_state events which the connection has already sent
+// unchanged, for rooms which want required_state_delta, and remembers the state which is sent.
+func (s *ConnState) deltaRequiredState(response *sync3.Response) {
+	for roomID, room := range response.Rooms {
+		if !s.live.shouldInclude(roomID, sync3.RoomSubscription.WantsRequiredStateDelta) {
+			delete(s.sentState, roomID)
+			continue
+		}
+		if len(room.RequiredState) == 0 {
+			continue
+		}
+		if s.sentState == nil {
+			s.sentState = make(map[string]map[string]uint64)
+		}
+		sent, isDelta := s.sentState[roomID]
+		if !isDelta {
+			sent = make(map[string]uint64, len(room.RequiredState))
+			s.sentState[roomID] = sent
+		}
+		var changed []json.RawMessage
+		for _, ev := range room.RequiredState {
+			parsed := gjson.GetManyBytes(ev, "type", "state_key")
+			key := parsed[0].Str + "\x00" + parsed[1].Str
+			h := fnv.New64a()
+			h.Write(ev)
+			hash := h.Sum64()
+			if prevHash, ok := sent[key]; ok && prevHash == hash {
+				continue
+			}
+			sent[key] = hash
+			changed = append(changed, ev)
+		}
+		room.RequiredState = changed
+		room.RequiredStateDelta = isDelta
+		response.Rooms[roomID] = room
+	}
+}
+
+// listIndexes returns the current index of every room referenced in the ops which is still in the list.
+func listIndexes(list *sync3.FilteredSortableRooms, ops []sync3.ResponseOp) map[string]int {
+	indexes := make(map[string]int)
+	if list == nil {
+		return indexes
+	}
+	for _, op := range ops {
+		for _, roomID := range op.IncludedRoomIDs() {
+			if i, ok := list.IndexOf(roomID); ok {
+				indexes[roomID] = i
+			}
+		}
+	}
+	return indexes
+}
+
+// trimRoomsToFit removes room data from the response until it fits within max_response_bytes.
+// Rooms are given space in this order:
+//   - rooms with a room subscription, which are never trimmed
+//   - rooms in lists, by the highest priority list they are visible in, then by list key. Within a
+//     list, rooms are ordered by their position in the list.
+//
+// Rooms are trimmed from the end of this order. The first room is always kept so the client makes
+// progress, and list counts and operations are never trimmed. Trimmed rooms are sent in full on the
+// next request.
+func (s *ConnState) trimRoomsToFit(ctx context.Context, response *sync3.Response) {
+	limit := s.muxedReq.ResponseByteLimit()
+	if limit == 0 || len(response.Rooms) <= 1 {
+		return
+	}
+	size := jsonSize(response.Rooms)
+	if size <= limit {
+		return
+	}
+
+	// sort the lists by the order they are given space in
+	listKeys := s.muxedReq.ListKeys()
+	sort.Slice(listKeys, func(i, j int) bool {
+		li, lj := s.muxedReq.Lists[listKeys[i]], s.muxedReq.Lists[listKeys[j]]
+		pi, pj := li.ResponsePriority(), lj.ResponsePriority()
+		if pi != pj {
+			return pi > pj
+		}
+		return listKeys[i] < listKeys[j]
+	})
+	listOrder := make(map[string]int, len(listKeys))
+	for i, listKey := range listKeys {
+		listOrder[listKey] = i
+	}
+
+	// work out where each room goes in the order
+	type roomOrder struct {
+		roomID string
+		list   int // -1 for room subscriptions
+		index  int
+	}
+	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	rooms := make([]roomOrder, 0, len(response.Rooms))
+	for roomID := range response.Rooms {
+		ro := roomOrder{roomID: roomID, list: -1}
+		if _, subscribed := s.roomSubscriptions[roomID]; !subscribed {
+			for _, listKey := range roomIDsToLists[roomID] {
+				if ro.list == -1 || listOrder[listKey] < ro.list {
+					ro.list = listOrder[listKey]
+				}
+			}
+			if ro.list != -1 {
+				ro.index, _ = s.lists.Get(listKeys[ro.list]).IndexOf(roomID)
+			}
+		}
+		rooms = append(rooms, ro)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].list != rooms[j].list {
+			return rooms[i].list < rooms[j].list
+		}
+		if rooms[i].index != rooms[j].index {
+			return rooms[i].index < rooms[j].index
+		}
+		return rooms[i].roomID < rooms[j].roomID
+	})
+
+	for i := len(rooms) - 1; i > 0 && size > limit; i-- {
+		if rooms[i].list == -1 {
+			// everything before this is a room subscription too
+			break
+		}
+		roomID := rooms[i].roomID
+		// the room ID key, its quotes, colon and comma
+		size -= jsonSize(response.Rooms[roomID]) + len(roomID) + 4
+		delete(response.Rooms, roomID)
+		if s.trimmedRooms == nil {
+			s.trimmedRooms = make(map[string]struct{})
+		}
+		s.trimmedRooms[roomID] = struct{}{}
+		response.TrimmedRooms = append(response.TrimmedRooms, roomID)
+	}
+	sort.Strings(response.TrimmedRooms)
+	internal.Logf(ctx, "connstate", "trimmed %d rooms to fit response into %d bytes", len(response.TrimmedRooms), limit)
+}
+
+// buildTrimmedRooms adds the rooms which were trimmed from the previous response to the builder,
+// with the subscriptions of every list they are visible in. Rooms which are no longer visible are
+// forgotten, as the client will be sent them in full if they become visible again.
+func (s *ConnState) buildTrimmedRooms(ctx context.Context, builder *RoomsBuilder) {
+	if len(s.trimmedRooms) == 0 {
+		return
+	}
+	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	for roomID := range s.trimmedRooms {
+		for _, listKey := range roomIDsToLists[roomID] {
+			reqList := s.muxedReq.Lists[listKey]
+			if reqList.IsOpsOnly() {
+				continue
+			}
+			subID := builder.AddSubscription(reqList.RoomSubscription)
+			builder.AddRoomsToSubscription(ctx, subID, []string{roomID})
+		}
+	}
+	s.trimmedRooms = nil
+}
+
+func jsonSize(val interface{}) int {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
 func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBuilder, listKey string, prevReqList, nextReqList *sync3.RequestList) sync3.ResponseList {
 	ctx, span := internal.StartSpan(ctx, "onIncomingListRequest")
 	defer span.End()
 	roomList, overwritten := s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.DoNotOverwrite)
+	// ops_only lists only send operations, so their rooms are never added to the builder
+	sendRooms := !nextReqList.IsOpsOnly()
 
 	if nextReqList.ShouldGetAllRooms() {
 		if overwritten || prevReqList.FiltersChanged(nextReqList) {
 			// this is either a new list or the filters changed, so we need to splat all the rooms to the client.
-			subID := builder.AddSubscription(nextReqList.RoomSubscription)
 			allRoomIDs := roomList.RoomIDs()
-			builder.AddRoomsToSubscription(ctx, subID, allRoomIDs)
+			if len(allRoomIDs) == 0 {
+				// there is nothing to sync, and [0,-1] is not a valid range
+				return sync3.ResponseList{}
+			}
+			if sendRooms {
+				subID := builder.AddSubscription(nextReqList.RoomSubscription)
+				builder.AddRoomsToSubscription(ctx, subID, allRoomIDs)
+			}
 			return sync3.ResponseList{
 				// send all the room IDs initially so the user knows which rooms in the top-level rooms map
 				// correspond to this list.
@@ -309,7 +616,9 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 
 	sortChanged := prevReqList.SortOrderChanged(nextReqList)
 	filtersChanged := prevReqList.FiltersChanged(nextReqList)
-	if sortChanged || filtersChanged {
+	// slow_get_all_rooms lists are not kept sorted, so sort the list if the client switched to ranges
+	unsorted := !nextReqList.ShouldGetAllRooms() && roomList.IsUnsorted()
+	if sortChanged || filtersChanged || unsorted {
 		// the sort/filter operations have changed, invalidate everything (if there were previous syncs), re-sort and re-SYNC
 		if prevReqList != nil {
 			// there were previous syncs for this list, INVALIDATE the lot
@@ -332,10 +641,12 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 			roomList, _ = s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.Overwrite)
 		}
 		// resort as either we changed the sort order or we added/removed a bunch of rooms
+		_, sortSpan := internal.StartSpan(ctx, "sortList")
 		if err := roomList.Sort(nextReqList.Sort); err != nil {
 			logger.Err(err).Str("key", listKey).Msg("cannot sort list")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
+		sortSpan.End()
 		addedRanges = nextReqList.Ranges
 		removedRanges = nil
 	}
@@ -366,10 +677,11 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		if len(subslice) == 0 {
 			continue
 		}
-		sortableRooms := subslice[0].(*sync3.SortableRooms)
-		roomIDs := sortableRooms.RoomIDs()
-		// the builder will populate this with the right room data
-		builder.AddRoomsToSubscription(ctx, subID, roomIDs)
+		roomIDs := subslice[0].(sync3.SortableRoomsSubslice).RoomIDs()
+		if sendRooms {
+			// the builder will populate this with the right room data
+			builder.AddRoomsToSubscription(ctx, subID, roomIDs)
+		}
 
 		responseOperations = append(responseOperations, &sync3.ResponseOpRange{
 			Operation: sync3.OpSync,
@@ -383,7 +695,7 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		// we need to make a new subscription registering this change to include the new data.
 		timelineChanged := prevReqList.TimelineLimitChanged(nextReqList)
 		reqStateChanged := prevReqList.RoomSubscription.RequiredStateChanged(nextReqList.RoomSubscription)
-		if !sortChanged && !filtersChanged && (timelineChanged || reqStateChanged) {
+		if sendRooms && !sortChanged && !filtersChanged && (timelineChanged || reqStateChanged) {
 			var newRS sync3.RoomSubscription
 			if timelineChanged {
 				newRS.TimelineLimit = nextReqList.TimelineLimit
@@ -395,8 +707,7 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 			// all the current rooms need to be added to this subscription
 			subslice := nextReqList.Ranges.SliceInto(roomList)
 			for _, ss := range subslice {
-				sortableRooms := ss.(*sync3.SortableRooms)
-				roomIDs := sortableRooms.RoomIDs()
+				roomIDs := ss.(sync3.SortableRoomsSubslice).RoomIDs()
 				// it's important that we filter out rooms the user is no longer joined to. Specifically,
 				// there is a race condition exercised in the security test TestSecurityLiveStreamEventLeftLeak
 				// whereby Eve syncs whilst still joined to the room, then she gets kicked, then syncs again
@@ -417,6 +728,10 @@ func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBui
 		}
 	}
 
+	if nextReqList.WantsCoalescedSyncOps() {
+		responseOperations = sync3.CoalesceSyncOps(responseOperations)
+	}
+
 	return sync3.ResponseList{
 		Ops: responseOperations,
 		// count will be filled in later
@@ -433,6 +748,7 @@ func (s *ConnState) buildListSubscriptions(ctx context.Context, builder *RoomsBu
 			// they deleted this list
 			logger.Debug().Str("key", listKey).Msg("list deleted")
 			s.lists.DeleteList(listKey)
+			delete(s.listCounts, listKey)
 			continue
 		}
 		result[listKey] = s.onIncomingListRequest(ctx, builder, listKey, list.Prev, list.Curr)
@@ -448,6 +764,9 @@ func (s *ConnState) buildRoomSubscriptions(ctx context.Context, builder *RoomsBu
 		if !s.joinChecker.IsUserJoined(s.userID, roomID) {
 			continue
 		}
+		if s.isGuest && s.hiddenFromGuest(s.globalCache.LoadRooms(ctx, roomID)[roomID]) {
+			continue
+		}
 
 		sub, ok := s.muxedReq.RoomSubscriptions[roomID]
 		if !ok {
@@ -523,6 +842,28 @@ func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscriptio
 	return result
 }
 
+// loadRelationTargets returns the targets of relations in this timeline which are not in the
+// timeline. Targets which the proxy does not know about are not returned.
+func (s *ConnState) loadRelationTargets(ctx context.Context, roomID string, timeline []json.RawMessage) []sync3.RelationTarget {
+	targetIDs := sync3.MissingRelationTargets(timeline)
+	if len(targetIDs) == 0 {
+		return nil
+	}
+	eventTypes := s.globalCache.LoadEventTypes(ctx, roomID, targetIDs)
+	var targets []sync3.RelationTarget
+	for _, eventID := range targetIDs {
+		evType, ok := eventTypes[eventID]
+		if !ok {
+			continue
+		}
+		targets = append(targets, sync3.RelationTarget{
+			EventID: eventID,
+			Type:    evType,
+		})
+	}
+	return targets
+}
+
 func (s *ConnState) lazyLoadTypingMembers(ctx context.Context, response *sync3.Response) {
 	for roomID, typingEvent := range response.Extensions.Typing.Rooms {
 		if !s.lazyCache.IsLazyLoading(roomID) {
@@ -552,6 +893,49 @@ func (s *ConnState) lazyLoadTypingMembers(ctx context.Context, response *sync3.R
 	}
 }
 
+// loadLargeRoomState loads the required state for rooms with too many members to load all of them.
+// Only the members which would be lazy loaded and the members asked for by state key are loaded:
+// asking for every member lazy loads members instead.
+func (s *ConnState) loadLargeRoomState(ctx context.Context, roomIDs []string, rsm *internal.RequiredStateMap, roomToUsersInTimeline map[string][]string) map[string][]json.RawMessage {
+	withoutMembers, memberStateKeys, lazyLoadMembers := rsm.WithoutMembers()
+	result := s.globalCache.LoadRoomState(ctx, roomIDs, s.anchorLoadPosition, withoutMembers, nil)
+	if result == nil {
+		result = make(map[string][]json.RawMessage, len(roomIDs))
+	}
+	// the members to load for each room
+	roomToUserIDs := make(map[string]map[string]struct{}, len(roomIDs))
+	allUserIDs := make(map[string]struct{})
+	for _, roomID := range roomIDs {
+		userIDs := make(map[string]struct{})
+		for _, userID := range memberStateKeys {
+			userIDs[userID] = struct{}{}
+		}
+		if lazyLoadMembers {
+			s.lazyCache.Add(roomID, roomToUsersInTimeline[roomID]...)
+			for _, userID := range roomToUsersInTimeline[roomID] {
+				userIDs[userID] = struct{}{}
+			}
+		}
+		for userID := range userIDs {
+			allUserIDs[userID] = struct{}{}
+		}
+		roomToUserIDs[roomID] = userIDs
+	}
+	if len(allUserIDs) == 0 {
+		return result
+	}
+	// members are loaded for all rooms at once, so only keep the members wanted in each room
+	roomIDToMembers := s.globalCache.LoadMembers(ctx, roomIDs, s.anchorLoadPosition, internal.Keys(allUserIDs))
+	for roomID, members := range roomIDToMembers {
+		for _, member := range members {
+			if _, ok := roomToUserIDs[roomID][gjson.GetBytes(member, "state_key").Str]; ok {
+				result[roomID] = append(result[roomID], member)
+			}
+		}
+	}
+	return result
+}
+
 func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSubscription, bumpEventTypes []string, roomIDs ...string) map[string]sync3.Room {
 	ctx, span := internal.StartSpan(ctx, "getInitialRoomData")
 	defer span.End()
@@ -571,6 +955,7 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	roomToUsersInTimeline := make(map[string][]string, len(timelines))
 	roomToTimeline := make(map[string][]json.RawMessage)
 	for roomID, latestEvents := range timelines {
+		latestEvents.Timeline = roomSub.FilterTimeline(latestEvents.Timeline)
 		senders := make(map[string]struct{})
 		for _, ev := range latestEvents.Timeline {
 			senders[gjson.GetBytes(ev, "sender").Str] = struct{}{}
@@ -590,9 +975,13 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 
 	// 2. Load required state events.
 	rsm := roomSub.RequiredStateMap(s.userID)
+	// the rooms are sent with their state in full, so the members sent before no longer count
+	for _, roomID := range roomIDs {
+		s.lazyCache.Forget(roomID)
+	}
 	if rsm.IsLazyLoading() {
-		for roomID, userIDs := range roomToUsersInTimeline {
-			s.lazyCache.Add(roomID, userIDs...)
+		for _, roomID := range roomIDs {
+			s.lazyCache.Add(roomID, roomToUsersInTimeline[roomID]...)
 		}
 	}
 
@@ -601,20 +990,82 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	// Filter out rooms we are only invited to, as we don't need to fetch the state
 	// since we'll be using the invite_state only.
 	loadRoomIDs := make([]string, 0, len(roomIDs))
+	// Large rooms have too many members to load all of them, so their members are loaded separately.
+	var smallRoomIDs, largeRoomIDs []string
 	for _, roomID := range roomIDs {
 		userRoomData, ok := userRoomDatas[roomID]
 		if !ok || !userRoomData.IsInvite {
 			loadRoomIDs = append(loadRoomIDs, roomID)
+			if metadata := roomMetadatas[roomID]; metadata != nil && metadata.Large {
+				largeRoomIDs = append(largeRoomIDs, roomID)
+			} else {
+				smallRoomIDs = append(smallRoomIDs, roomID)
+			}
 		}
 	}
 
 	// by reusing the same global load position anchor here, we can be sure that the state returned here
 	// matches the timeline we loaded earlier - the race conditions happen around pubsub updates and not
 	// the events table itself, so whatever position is picked based on this anchor is immutable.
-	roomIDToState := s.globalCache.LoadRoomState(ctx, loadRoomIDs, s.anchorLoadPosition, rsm, roomToUsersInTimeline)
+	roomIDToState := s.globalCache.LoadRoomState(ctx, smallRoomIDs, s.anchorLoadPosition, rsm, roomToUsersInTimeline)
 	if roomIDToState == nil { // e.g no required_state
 		roomIDToState = make(map[string][]json.RawMessage)
 	}
+	if len(largeRoomIDs) > 0 {
+		for roomID, state := range s.loadLargeRoomState(ctx, largeRoomIDs, rsm, roomToUsersInTimeline) {
+			roomIDToState[roomID] = state
+		}
+	}
+	var roomIDToJoinRules map[string]json.RawMessage
+	if roomSub.IncludeJoinRules() {
+		roomIDToJoinRules = s.globalCache.LoadStateEvents(ctx, loadRoomIDs, s.anchorLoadPosition, "m.room.join_rules", "")
+	}
+	var roomIDToCreate map[string]json.RawMessage
+	if roomSub.IncludeCreate() {
+		roomIDToCreate = s.globalCache.LoadStateEvents(ctx, loadRoomIDs, s.anchorLoadPosition, "m.room.create", "")
+	}
+	var roomIDToServerACL map[string]json.RawMessage
+	if roomSub.IncludeServerACL() {
+		roomIDToServerACL = s.globalCache.LoadStateEvents(ctx, loadRoomIDs, s.anchorLoadPosition, "m.room.server_acl", "")
+	}
+	var roomIDToName map[string]json.RawMessage
+	if roomSub.IncludeNameContent() {
+		roomIDToName = s.globalCache.LoadStateEvents(ctx, loadRoomIDs, s.anchorLoadPosition, "m.room.name", "")
+	}
+	var roomIDToTopic map[string]json.RawMessage
+	if roomSub.IncludeTopic() {
+		roomIDToTopic = s.globalCache.LoadStateEvents(ctx, loadRoomIDs, s.anchorLoadPosition, "m.room.topic", "")
+	}
+	var roomIDToWidgets map[string][]json.RawMessage
+	if roomSub.IncludeWidgets() {
+		roomIDToWidgets = s.globalCache.LoadStateEventsOfTypes(ctx, loadRoomIDs, s.anchorLoadPosition, sync3.WidgetEventTypes...)
+	}
+	var roomIDToDirectoryVisibility map[string]string
+	if roomSub.IncludeDirectoryVisibility() {
+		roomIDToDirectoryVisibility = s.globalCache.LoadDirectoryVisibility(ctx, loadRoomIDs)
+	}
+	var roomIDToMembers map[string][]json.RawMessage
+	var roomIDToPowerLevels map[string]json.RawMessage
+	queriedMembers := roomSub.QueriedMembers()
+	if len(queriedMembers) > 0 {
+		roomIDToMembers = s.globalCache.LoadMembers(ctx, loadRoomIDs, s.anchorLoadPosition, queriedMembers)
+		roomIDToPowerLevels = s.globalCache.LoadStateEvents(ctx, loadRoomIDs, s.anchorLoadPosition, "m.room.power_levels", "")
+	}
+	var roomIDToSenders map[string][]json.RawMessage
+	if roomSub.EmbedSenderProfile() {
+		senders := make(map[string]struct{})
+		for _, roomID := range loadRoomIDs {
+			for _, sender := range roomToUsersInTimeline[roomID] {
+				senders[sender] = struct{}{}
+			}
+		}
+		roomIDToSenders = s.globalCache.LoadMembers(ctx, loadRoomIDs, s.anchorLoadPosition, internal.Keys(senders))
+	}
+
+	var pushRules json.RawMessage
+	if roomSub.IncludeNotificationLevel() {
+		pushRules = s.userCache.PushRules()
+	}
 
 	// 3. Build sync3.Room structs to return to clients.
 	rooms := make(map[string]sync3.Room, len(roomIDs))
@@ -624,7 +1075,7 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			userRoomData = caches.NewUserRoomData()
 		}
 		metadata := roomMetadatas[roomID]
-		var inviteState []json.RawMessage
+		var inviteState, knockState []json.RawMessage
 		// handle invites specially as we do not want to leak additional data beyond the invite_state and if
 		// we happen to have this room in the global cache we will do.
 		// Furthermore, rooms the proxy have been invited to for the first time ever will not be in the global cache yet,
@@ -632,6 +1083,9 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		if userRoomData.IsInvite {
 			metadata = userRoomData.Invite.RoomMetadata()
 			inviteState = userRoomData.Invite.InviteState
+			if userRoomData.IsKnock() {
+				inviteState, knockState = nil, inviteState
+			}
 		}
 		metadata.RemoveHero(s.userID)
 		var requiredState []json.RawMessage
@@ -681,16 +1135,59 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			Timeline:          roomToTimeline[roomID],
 			RequiredState:     requiredState,
 			InviteState:       inviteState,
+			KnockState:        knockState,
 			Initial:           true,
 			IsDM:              userRoomData.IsDM,
 			JoinedCount:       metadata.JoinCount,
 			InvitedCount:      &metadata.InviteCount,
 			PrevBatch:         timelines[roomID].PrevBatch,
 			Timestamp:         maxTs,
+			LargeRoom:         metadata.Large,
 		}
 		if roomSub.IncludeHeroes() && calculated {
 			room.Heroes = metadata.Heroes
 		}
+		if roomSub.IncludeJoinRules() {
+			room.JoinRules = sync3.NewJoinRules(roomIDToJoinRules[roomID])
+		}
+		if roomSub.IncludeCreate() {
+			room.Create = sync3.NewRoomCreate(roomIDToCreate[roomID])
+		}
+		if roomSub.IncludeNameContent() {
+			room.NameContent = sync3.NewNameContent(roomIDToName[roomID])
+		}
+		if roomSub.IncludeTopic() {
+			room.Topic = sync3.NewRoomTopic(roomIDToTopic[roomID])
+		}
+		if roomSub.IncludeServerACL() {
+			room.ServerACL = sync3.NewServerACL(roomIDToServerACL[roomID])
+		}
+		if roomSub.IncludeWidgets() {
+			widgets := sync3.NewWidgets(roomIDToWidgets[roomID])
+			room.Widgets = &widgets
+		}
+		if roomSub.IncludeDirectoryVisibility() {
+			room.DirectoryVisibility = roomIDToDirectoryVisibility[roomID]
+			if room.DirectoryVisibility == "" {
+				room.DirectoryVisibility = caches.DirectoryVisibilityUnknown
+			}
+		}
+		if len(queriedMembers) > 0 {
+			room.Members = sync3.NewMembers(roomIDToMembers[roomID], roomIDToPowerLevels[roomID])
+		}
+		if roomSub.EmbedSenderProfile() && !userRoomData.IsInvite {
+			room.Timeline = sync3.EmbedSenderProfiles(room.Timeline, roomIDToSenders[roomID])
+		}
+		if roomSub.AnnotateMentions() {
+			room.Timeline = sync3.AnnotateMentions(room.Timeline, s.userID)
+		}
+		if roomSub.IncludeEncryptedMetadata() {
+			room.Timeline = sync3.EmbedEncryptedMetadata(room.Timeline)
+		}
+		if roomSub.IncludeNotificationLevel() {
+			room.NotificationLevel = notificationLevel(pushRules, s.userID, roomID, metadata.Encrypted, metadata.JoinCount)
+			s.notificationLevels[roomID] = room.NotificationLevel
+		}
 		rooms[roomID] = room
 	}
 
@@ -723,7 +1220,7 @@ func (s *ConnState) trackProcessDuration(ctx context.Context, dur time.Duration,
 
 // Called when the connection is torn down
 func (s *ConnState) Destroy() {
-	s.userCache.Unsubscribe(s.userCacheID)
+	s.live.updates.Close()
 	logger.Debug().Str("user_id", s.userID).Str("device_id", s.deviceID).Msg("cancelling any in-flight requests")
 	if s.cancelLatestReq != nil {
 		s.cancelLatestReq()
@@ -731,42 +1228,27 @@ func (s *ConnState) Destroy() {
 }
 
 func (s *ConnState) Alive() bool {
-	return !s.live.bufferFull
+	return !s.live.updates.Lost()
 }
 
 func (s *ConnState) UserID() string {
 	return s.userID
 }
 
-func (s *ConnState) OnUpdate(ctx context.Context, up caches.Update) {
-	// will eventually call s.live.onUpdate
-	s.txnIDWaiter.Ingest(up)
+// hiddenFromGuest returns true if the user is a guest and the room does not allow guest access.
+// Rooms without metadata are hidden, as it's not known whether guests can see them.
+func (s *ConnState) hiddenFromGuest(metadata *internal.RoomMetadata) bool {
+	return s.isGuest && (metadata == nil || !metadata.GuestAccess)
 }
 
-// Called by the user cache when updates arrive
-func (s *ConnState) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
-	switch update := up.(type) {
-	case *caches.RoomEventUpdate:
-		if !update.EventData.AlwaysProcess && update.EventData.NID == 0 {
-			// 0 -> this event was from a 'state' block, do not poke active connections.
-			// This is not the same as checking if we have already processed this event: NID=0 means
-			// it's part of initial room state. If we sent these events, we'd send them to clients in
-			// the timeline section which is wrong.
-			return
-		}
-		internal.AssertWithContext(ctx, "missing global room metadata", update.GlobalRoomMetadata() != nil)
-		internal.Logf(ctx, "connstate", "queued update %d", update.EventData.NID)
-		s.OnUpdate(ctx, update)
-	case caches.RoomUpdate:
-		internal.AssertWithContext(ctx, "missing global room metadata", update.GlobalRoomMetadata() != nil)
-		s.OnUpdate(ctx, update)
-	default:
-		logger.Warn().Str("room_id", up.RoomID()).Msg("OnRoomUpdate unknown update type")
-	}
+// OnUpdate queues the update for every connection on this device, as they share one buffer of
+// live updates.
+func (s *ConnState) OnUpdate(ctx context.Context, up caches.Update) {
+	s.live.updates.OnUpdate(ctx, up)
 }
 
 func (s *ConnState) PublishEventsUpTo(roomID string, nid int64) {
-	s.txnIDWaiter.PublishUpToNID(roomID, nid)
+	s.live.updates.PublishEventsUpTo(roomID, nid)
 }
 
 func (s *ConnState) SetCancelCallback(cancel context.CancelFunc) {
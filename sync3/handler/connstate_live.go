@@ -3,46 +3,54 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/tidwall/gjson"
 )
 
-// the amount of time to try to insert into a full buffer before giving up.
+// the amount of time a connection can have a full buffer for before it is destroyed.
 // Customisable for testing
 var BufferWaitTime = time.Second * 5
 
+// the number of responses worth of live events to defer per room when a room exceeds its live
+// event limit. Older deferred events are dropped beyond this.
+const maxDeferredResponses = 4
+
+// deferredRoomUpdates are the room event updates for a room which exceeded its live event limit.
+type deferredRoomUpdates struct {
+	// the updates in the order they were received
+	updates []*caches.RoomEventUpdate
+	// the room's live event limit when the first update was deferred
+	limit int64
+}
+
 // Contains code for processing live updates. Split out from connstate because they concern different
 // code paths. Relies on ConnState for various list/sort/subscription operations.
 type connStateLive struct {
 	*ConnState
 
-	// A channel which the dispatcher uses to send updates to the conn goroutine
-	// Consumed when the conn is read. There is a limit to how many updates we will store before
-	// saying the client is dead and clean up the conn.
-	updates    chan caches.Update
-	bufferFull bool
-}
-
-// Called when there is an update from the user cache. This callback fires when the server gets a new event and determines this connection MAY be
-// interested in it (e.g the client is joined to the room or it's an invite, etc).
-// We need to move this data onto a channel for onIncomingRequest to consume later.
-func (s *connStateLive) onUpdate(up caches.Update) {
-	if s.bufferFull {
-		return
-	}
-	select {
-	case s.updates <- up:
-	case <-time.After(BufferWaitTime):
-		logger.Warn().Interface("update", up).Str("user", s.userID).Str("device", s.deviceID).Msg(
-			"cannot send update to connection, buffer exceeded. Destroying connection.",
-		)
-		s.bufferFull = true
-		s.Destroy()
-	}
+	// The connection's cursor over the live updates for its device, which are shared by all of the
+	// device's connections. Consumed when the conn is read. There is a limit to how many updates
+	// we will store before saying the client is dead and clean up the conn.
+	updates *updateCursor
+	// the upper bound on the coalescing window a client can request via coalesce_ms
+	maxCoalesceWindow time.Duration
+	// room ID -> room event updates which exceeded the live event limit for the room. Processed at
+	// the start of the next response.
+	deferredUpdates map[string]*deferredRoomUpdates
+	// the rooms in deferredUpdates, in the order their first update was deferred
+	deferredRoomIDs []string
+	// rooms which had deferred updates dropped, so the next response for them has a gap.
+	limitedRooms map[string]bool
+	// How long to hold count-only updates for before returning them, for users joined to at least
+	// countUpdateThrottleMinRooms rooms. 0 disables throttling.
+	countUpdateThrottle         time.Duration
+	countUpdateThrottleMinRooms int
 }
 
 // live update waits for new data and populates the response given when new data arrives.
@@ -57,12 +65,40 @@ func (s *connStateLive) liveUpdate(
 	if req.TimeoutMSecs() < 100 {
 		req.SetTimeoutMSecs(100)
 	}
-	startBufferSize := len(s.updates)
+	startBufferSize := s.updates.Len()
+	// deliver any live events which didn't fit in the previous response first, so events are
+	// returned in order.
+	s.processDeferredUpdates(ctx, response, ex)
 	// block until we get a new event, with appropriate timeout
 	startTime := time.Now()
 	hasLiveStreamed := false
 	numProcessedUpdates := 0
-	for response.ListOps() == 0 && len(response.Rooms) == 0 && !response.Extensions.HasData(isInitial) {
+	// Initial responses with lists are always returned immediately, even if they have no rooms, as the
+	// list counts are authoritative: a brand new account with 0 rooms shouldn't have to wait for a timeout
+	// to find that out.
+	returnImmediately := isInitial && len(response.Lists) > 0
+	// In quiet mode, keep waiting until an urgent update arrives. Data which is already in the
+	// response (e.g from changing the request) counts as urgent, as the client asked for it.
+	seenUrgent := !s.muxedReq.IsQuiet() || responseHasData(response, isInitial)
+	// Live events in the focus room are returned without coalescing.
+	seenFocus := false
+	// When the response only has throttled count updates, it is held until this time so that
+	// other count changes are batched into it. Zero if the response is not being held.
+	var countsHeldUntil time.Time
+	process := func(update caches.Update) {
+		hadData := responseHasData(response, isInitial)
+		s.processUpdate(ctx, update, response, ex)
+		seenUrgent = seenUrgent || s.isUrgent(update)
+		seenFocus = seenFocus || s.isFocusUpdate(update)
+		numProcessedUpdates++
+		if !s.isThrottledCountUpdate(update) {
+			// anything else is returned as normal, along with any held counts
+			countsHeldUntil = time.Time{}
+		} else if !hadData && countsHeldUntil.IsZero() {
+			countsHeldUntil = time.Now().Add(s.countUpdateThrottle)
+		}
+	}
+	for !returnImmediately && !(seenUrgent && responseHasData(response, isInitial) && countsHeldUntil.IsZero()) {
 		hasLiveStreamed = true
 		timeToWait := time.Duration(req.TimeoutMSecs()) * time.Millisecond
 		timeWaited := time.Since(startTime)
@@ -71,24 +107,34 @@ func (s *connStateLive) liveUpdate(
 			log.Trace().Str("time_waited", timeWaited.String()).Msg("liveUpdate: timed out")
 			return
 		}
-		log.Trace().Str("dur", timeLeftToWait.String()).Msg("liveUpdate: no response data yet; blocking")
+		wait := timeLeftToWait
+		if !countsHeldUntil.IsZero() && time.Until(countsHeldUntil) < wait {
+			wait = time.Until(countsHeldUntil)
+		}
+		log.Trace().Str("dur", wait.String()).Msg("liveUpdate: no response data yet; blocking")
 		select {
 		case <-ctx.Done(): // client has given up
 			log.Trace().Msg("liveUpdate: client gave up, or we killed the connection")
 			internal.Logf(ctx, "liveUpdate", "context cancelled")
 			return
-		case <-time.After(timeLeftToWait): // we've timed out
+		case <-time.After(wait):
+			if wait < timeLeftToWait {
+				// we've held the counts for long enough, return them
+				internal.Logf(ctx, "liveUpdate", "held count updates for %v", s.countUpdateThrottle)
+				countsHeldUntil = time.Time{}
+				continue
+			}
+			// we've timed out
 			log.Trace().Msg("liveUpdate: timed out")
 			internal.Logf(ctx, "liveUpdate", "timed out after %v", timeLeftToWait)
 			return
-		case update := <-s.updates:
-			s.processUpdate(ctx, update, response, ex)
-			numProcessedUpdates++
+		case <-s.updates.Wait():
 			// if there's more updates and we don't have lots stacked up already, go ahead and process another
-			for len(s.updates) > 0 && numProcessedUpdates < 100 {
-				update = <-s.updates
-				s.processUpdate(ctx, update, response, ex)
-				numProcessedUpdates++
+			for update, ok := s.updates.Next(); ok; update, ok = s.updates.Next() {
+				process(update)
+				if numProcessedUpdates >= 100 {
+					break
+				}
 			}
 		}
 	}
@@ -97,10 +143,17 @@ func (s *connStateLive) liveUpdate(
 	// the update channel as the response will always have data already. In an effort to prevent starvation of new
 	// data, we will process some updates even though we have data already, but only if A) we didn't live stream
 	// due to natural circumstances, B) it isn't an initial request and C) there is in fact some data there.
-	numQueuedUpdates := len(s.updates)
+	if hasLiveStreamed && !seenFocus {
+		s.coalesce(ctx, req, ex, response, startTime)
+	}
+
+	numQueuedUpdates := s.updates.Len()
 	if !hasLiveStreamed && !isInitial && numQueuedUpdates > 0 {
 		for i := 0; i < numQueuedUpdates; i++ {
-			update := <-s.updates
+			update, ok := s.updates.Next()
+			if !ok {
+				break
+			}
 			s.processUpdate(ctx, update, response, ex)
 		}
 		log.Debug().Int("num_queued", numQueuedUpdates).Msg("liveUpdate: caught up")
@@ -109,14 +162,187 @@ func (s *connStateLive) liveUpdate(
 
 	log.Trace().Bool("live_streamed", hasLiveStreamed).Msg("liveUpdate: returning")
 
-	internal.SetConnBufferInfo(ctx, startBufferSize, len(s.updates), cap(s.updates))
+	internal.SetConnBufferInfo(ctx, startBufferSize, s.updates.Len(), s.updates.Cap())
 
 	// TODO: op consolidation
 }
 
+func responseHasData(response *sync3.Response, isInitial bool) bool {
+	return response.ListOps() > 0 || len(response.Rooms) > 0 || len(response.RoomsRemoved) > 0 || response.Extensions.HasData(isInitial)
+}
+
+// isUrgent returns true if this update should wake up a client in quiet mode. Urgent updates are:
+//   - unread count changes which leave the room with highlights i.e mentions.
+//   - events from other users in DMs.
+//   - invites, and leaves which must be processed e.g kicks.
+//   - to-device messages, as these may be needed to decrypt urgent events.
+//   - events in the focus room.
+//
+// Anything else, e.g messages in group rooms or receipts, is not urgent.
+func (s *connStateLive) isUrgent(update caches.Update) bool {
+	switch up := update.(type) {
+	case *caches.UnreadCountUpdate:
+		return !up.HasCountDecreased && up.UserRoomMetadata().HighlightCount > 0
+	case *caches.RoomEventUpdate:
+		if up.EventData.AlwaysProcess || s.isFocusUpdate(up) {
+			return true
+		}
+		return up.UserRoomMetadata().IsDM && up.EventData.Sender != s.userID
+	case *caches.InviteUpdate:
+		// knocks wait on the room, so the user has nothing to act on
+		return !up.InviteData.IsKnock
+	case caches.DeviceEventsUpdate:
+		return true
+	}
+	return false
+}
+
+// isThrottledCountUpdate returns true if this update only changes unread counts and should be held
+// for countUpdateThrottle, so that accounts in many rooms aren't woken for every count change.
+// Count changes which are urgent e.g mentions are never throttled.
+func (s *connStateLive) isThrottledCountUpdate(update caches.Update) bool {
+	if s.countUpdateThrottle <= 0 || s.numJoinedRooms < s.countUpdateThrottleMinRooms {
+		return false
+	}
+	_, ok := update.(*caches.UnreadCountUpdate)
+	return ok && !s.isUrgent(update)
+}
+
+// isFocusUpdate returns true if this update is a live event in the client's focus room. The focus
+// room is read from the current request, so when the client changes focus the previous focus room
+// is immediately treated like any other room.
+func (s *connStateLive) isFocusUpdate(update caches.Update) bool {
+	up, ok := update.(*caches.RoomEventUpdate)
+	if !ok {
+		return false
+	}
+	focusRoomID := s.muxedReq.FocusRoomID()
+	return focusRoomID != "" && up.RoomID() == focusRoomID
+}
+
+// coalesce keeps processing live updates into the response until the client's coalescing window
+// expires, or a live event arrives in the focus room. The window starts when the response first
+// gained data, and never extends past the request timeout: the timeout always wins. This means
+// clients which set timeout=0 (which we treat as 100ms) will coalesce for at most 100ms. Only called if we blocked waiting for live
+// data, so responses which already have data (e.g from a change in request params) are not delayed.
+func (s *connStateLive) coalesce(ctx context.Context, req *sync3.Request, ex extensions.Request, response *sync3.Response, startTime time.Time) {
+	window := s.muxedReq.CoalesceWindow(s.maxCoalesceWindow)
+	if window == 0 {
+		return
+	}
+	deadline := time.Now().Add(window)
+	if timeoutAt := startTime.Add(time.Duration(req.TimeoutMSecs()) * time.Millisecond); timeoutAt.Before(deadline) {
+		deadline = timeoutAt
+	}
+	numCoalesced := 0
+	for {
+		timeLeftToWait := time.Until(deadline)
+		if timeLeftToWait <= 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(timeLeftToWait):
+		case <-s.updates.Wait():
+			update, ok := s.updates.Next()
+			if !ok {
+				continue
+			}
+			s.processUpdate(ctx, update, response, ex)
+			numCoalesced++
+			if s.isFocusUpdate(update) {
+				internal.Logf(ctx, "liveUpdate", "coalesced %d updates, stopped early for focus room", numCoalesced)
+				return
+			}
+			continue
+		}
+		break
+	}
+	internal.Logf(ctx, "liveUpdate", "coalesced %d updates over %v", numCoalesced, window)
+}
+
+// processDeferredUpdates processes the room event updates which exceeded the live event limit in
+// a previous response. Updates which exceed the limit again are deferred again.
+func (s *connStateLive) processDeferredUpdates(ctx context.Context, response *sync3.Response, ex extensions.Request) {
+	if len(s.deferredRoomIDs) == 0 {
+		return
+	}
+	deferred := s.deferredUpdates
+	deferredRoomIDs := s.deferredRoomIDs
+	s.deferredUpdates = nil
+	s.deferredRoomIDs = nil
+	numDeferred := 0
+	for _, roomID := range deferredRoomIDs {
+		for _, update := range deferred[roomID].updates {
+			s.processUpdate(ctx, update, response, ex)
+		}
+		numDeferred += len(deferred[roomID].updates)
+	}
+	for roomID := range s.limitedRooms {
+		r, exists := response.Rooms[roomID]
+		if !exists || r.NumLive == 0 {
+			continue
+		}
+		// some events were dropped before the ones in this timeline, so tell the client to
+		// backfill from prev_batch.
+		r.Limited = true
+		response.Rooms[roomID] = r
+		delete(s.limitedRooms, roomID)
+	}
+	internal.Logf(ctx, "liveUpdate", "processed %d deferred updates, %d rooms still deferred", numDeferred, len(s.deferredRoomIDs))
+}
+
+// deferIfOverLimit returns true if this update has been deferred to a subsequent response because
+// the room already has the maximum number of live events in this response. Each room keeps at most
+// maxDeferredResponses worth of deferred events: any older ones are dropped and the room is marked
+// as limited so the client can backfill them.
+func (s *connStateLive) deferIfOverLimit(update caches.Update, response *sync3.Response) bool {
+	roomEventUpdate, ok := update.(*caches.RoomEventUpdate)
+	if !ok || roomEventUpdate.EventData.Event == nil || roomEventUpdate.EventData.AlwaysProcess {
+		return false
+	}
+	roomID := roomEventUpdate.RoomID()
+	// always defer if there are older deferred events for this room, to keep events in order
+	deferred := s.deferredUpdates[roomID]
+	if deferred == nil {
+		if !s.hasLiveEventLimit() {
+			return false
+		}
+		limit := s.combinedSubscription(roomID).MaxLiveEvents()
+		if limit == 0 || int64(response.Rooms[roomID].NumLive) < limit {
+			return false
+		}
+		deferred = &deferredRoomUpdates{limit: limit}
+		if s.deferredUpdates == nil {
+			s.deferredUpdates = make(map[string]*deferredRoomUpdates)
+		}
+		s.deferredUpdates[roomID] = deferred
+		s.deferredRoomIDs = append(s.deferredRoomIDs, roomID)
+	} else if int64(len(deferred.updates)) >= deferred.limit*maxDeferredResponses {
+		deferred.updates = deferred.updates[1:]
+		if s.limitedRooms == nil {
+			s.limitedRooms = make(map[string]bool)
+		}
+		s.limitedRooms[roomID] = true
+	}
+	deferred.updates = append(deferred.updates, roomEventUpdate)
+	return true
+}
+
 func (s *connStateLive) processUpdate(ctx context.Context, update caches.Update, response *sync3.Response, ex extensions.Request) {
+	if s.deferIfOverLimit(update, response) {
+		internal.Logf(ctx, "liveUpdate", "deferred live update %s", update.Type())
+		return
+	}
 	internal.Logf(ctx, "liveUpdate", "process live update %s", update.Type())
 	s.processLiveUpdate(ctx, update, response)
+	if s.muxedReq.IncludeRoomsRemoved() {
+		s.trackRemovedRoom(update, response)
+	}
+	if up, ok := update.(*caches.AccountDataUpdate); ok {
+		s.updateNotificationLevels(ctx, up, response)
+	}
 	// pass event to extensions AFTER processing
 	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
 	s.extensionsHandler.HandleLiveUpdate(ctx, update, ex, &response.Extensions, extensions.Context{
@@ -130,6 +356,73 @@ func (s *connStateLive) processUpdate(ctx context.Context, update caches.Update,
 	})
 }
 
+// updateNotificationLevels adds the notification levels which changed because the user's push
+// rules changed to the response. Only rooms which have been sent a notification level are checked:
+// other rooms are sent their level when they are next sent in full.
+func (s *connStateLive) updateNotificationLevels(ctx context.Context, up *caches.AccountDataUpdate, response *sync3.Response) {
+	changed := false
+	for _, d := range up.AccountData {
+		if d.Type == "m.push_rules" {
+			changed = true
+		}
+	}
+	if !changed || len(s.notificationLevels) == 0 {
+		return
+	}
+	pushRules := s.userCache.PushRules()
+	metadatas := s.globalCache.LoadRooms(ctx, internal.Keys(s.notificationLevels)...)
+	for roomID, prevLevel := range s.notificationLevels {
+		if !s.shouldInclude(roomID, sync3.RoomSubscription.IncludeNotificationLevel) || s.isOpsOnlyRoom(roomID) {
+			continue
+		}
+		metadata := metadatas[roomID]
+		if metadata == nil {
+			metadata = internal.NewRoomMetadata(roomID)
+		}
+		level := notificationLevel(pushRules, s.userID, roomID, metadata.Encrypted, metadata.JoinCount)
+		if level == prevLevel {
+			continue
+		}
+		s.notificationLevels[roomID] = level
+		r, exists := response.Rooms[roomID]
+		if !exists {
+			// the counts are always sent, so make sure they are correct
+			userRoomData := s.userCache.LoadRoomData(roomID)
+			r.NotificationCount = int64(userRoomData.NotificationCount)
+			r.HighlightCount = int64(userRoomData.HighlightCount)
+		}
+		r.NotificationLevel = level
+		response.Rooms[roomID] = r
+	}
+}
+
+// trackRemovedRoom updates response.RoomsRemoved if this update changes the user's own membership.
+// Leaving, kicks, bans and invite rejections remove the room from the account. The same leave can
+// be seen twice, via the room timeline and via the leave section of the v2 response, so removals
+// are deduplicated. Rejoining or being reinvited before the response is sent cancels the removal.
+func (s *connStateLive) trackRemovedRoom(update caches.Update, response *sync3.Response) {
+	up, ok := update.(*caches.RoomEventUpdate)
+	if !ok || up.EventData.EventType != "m.room.member" || up.EventData.StateKey == nil || *up.EventData.StateKey != s.userID {
+		return
+	}
+	roomID := up.RoomID()
+	i := sort.SearchStrings(response.RoomsRemoved, roomID)
+	alreadyRemoved := i < len(response.RoomsRemoved) && response.RoomsRemoved[i] == roomID
+	switch up.EventData.Content.Get("membership").Str {
+	case "leave", "ban":
+		if alreadyRemoved {
+			return
+		}
+		response.RoomsRemoved = append(response.RoomsRemoved, "")
+		copy(response.RoomsRemoved[i+1:], response.RoomsRemoved[i:])
+		response.RoomsRemoved[i] = roomID
+	case "join", "invite":
+		if alreadyRemoved {
+			response.RoomsRemoved = append(response.RoomsRemoved[:i], response.RoomsRemoved[i+1:]...)
+		}
+	}
+}
+
 func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update, response *sync3.Response) bool {
 	_, span := internal.StartSpan(ctx, "processLiveUpdate")
 	defer span.End()
@@ -165,8 +458,16 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 	// do global connection updates (e.g adding/removing rooms from allRooms)
 	delta := s.processGlobalUpdates(ctx, builder, up)
 
+	// guests cannot see rooms which don't allow guest access, even if they are joined, so remove the
+	// room from the lists and subscriptions and send nothing else about it. This handles the room's
+	// guest access being revoked whilst connected.
+	hidden := roomUpdate != nil && s.hiddenFromGuest(roomUpdate.GlobalRoomMetadata())
+	if hidden {
+		delete(s.roomSubscriptions, roomUpdate.RoomID())
+	}
+
 	// process room subscriptions
-	hasUpdates := s.processUpdatesForSubscriptions(ctx, builder, up)
+	hasUpdates := !hidden && s.processUpdatesForSubscriptions(ctx, builder, up)
 
 	// do per-list updates (e.g resorting, adding/removing rooms which no longer match filter)
 	for _, listDelta := range delta.Lists {
@@ -188,6 +489,25 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 	for roomID, room := range rooms {
 		response.Rooms[roomID] = room
 	}
+	if hidden {
+		delete(response.Rooms, roomUpdate.RoomID())
+		return hasUpdates
+	}
+	// rooms which are only visible in ops_only lists move in those lists, but get no room data
+	if roomUpdate != nil && s.isOpsOnlyRoom(roomUpdate.RoomID()) {
+		return hasUpdates
+	}
+
+	// the subscription of the updated room combined with the lists it is in. Only calculated once,
+	// and only if needed, as finding the lists the room is visible in looks at every list.
+	var combinedSubscription *sync3.RoomSubscription
+	roomSubscription := func() sync3.RoomSubscription {
+		if combinedSubscription == nil {
+			rs := s.combinedSubscription(roomUpdate.RoomID())
+			combinedSubscription = &rs
+		}
+		return *combinedSubscription
+	}
 
 	// TODO: find a better way to determine if the triggering event should be included e.g ask the lists?
 	if hasUpdates && roomEventUpdate != nil {
@@ -221,7 +541,8 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 		r.HighlightCount = int64(userRoomData.HighlightCount)
 		r.NotificationCount = int64(userRoomData.NotificationCount)
 		if roomEventUpdate != nil && roomEventUpdate.EventData.Event != nil {
-			r.NumLive++
+			// events filtered out of the timeline are not live events as far as the client is concerned
+			includeInTimeline := roomSubscription().IncludeTimelineEvent(roomEventUpdate.EventData.Event)
 			advancedPastEvent := false
 			if !roomEventUpdate.EventData.AlwaysProcess {
 				if roomEventUpdate.EventData.NID <= s.loadPositions[roomEventUpdate.RoomID()] {
@@ -235,10 +556,20 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			// - next request bumps a room from outside to inside the window
 			// - the initial:true room from BuildSubscriptions contains the latest live events in the timeline as it's pulled from the DB
 			// - we then process the live events in turn which adds them again.
-			if !advancedPastEvent {
-				roomIDtoTimeline := s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, map[string][]json.RawMessage{
-					roomEventUpdate.RoomID(): {roomEventUpdate.EventData.Event},
-				})
+			if !advancedPastEvent && includeInTimeline {
+				if roomEventUpdate.EventData.MissingPrevious {
+					// the homeserver skipped the events before this one, so the timeline starts again
+					// here. Paginating back from this event's prev_batch returns the skipped events
+					// and then the events dropped from this timeline.
+					r.Timeline = nil
+					r.NumLive = 0
+					r.PrevBatch = ""
+					r.Limited = true
+					r.GappyTimeline = true
+				}
+				// only count events which are appended: events already in an initial:true timeline
+				// are part of the historical snapshot, not live.
+				r.NumLive++
 				if len(r.Timeline) == 0 && r.PrevBatch == "" {
 					// attempt to fill in the prev_batch value for this room
 					prevBatch := s.userCache.AttemptToFetchPrevBatch(ctx, roomEventUpdate.RoomID(), roomEventUpdate.EventData)
@@ -246,9 +577,16 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 						r.PrevBatch = prevBatch
 					}
 				}
-				r.Timeline = append(r.Timeline, roomIDtoTimeline[roomEventUpdate.RoomID()]...)
 				roomID := roomEventUpdate.RoomID()
+				r.Timeline = append(r.Timeline, s.annotateLiveEvent(ctx, roomID, roomSubscription(), roomEventUpdate.EventData.Event))
+				if roomEventUpdate.EventData.EventType == "m.room.redaction" {
+					s.redactUndeliveredEvent(ctx, roomID, roomSubscription(), &r, roomEventUpdate.EventData)
+				}
 				sender := roomEventUpdate.EventData.Sender
+				if stateKey := roomEventUpdate.EventData.StateKey; stateKey != nil && roomEventUpdate.EventData.EventType == "m.room.member" && s.lazyCache.IsLazyLoading(roomID) {
+					// the client has this member event from the timeline, so doesn't need it again
+					s.lazyCache.AddUser(roomID, *stateKey)
+				}
 				if s.lazyCache.IsLazyLoading(roomID) && !s.lazyCache.IsSet(roomID, sender) {
 					// load the state event
 					_, span := internal.StartSpan(ctx, "LazyLoadingMemberEvent")
@@ -277,7 +615,7 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 
 				thisRoom.Name = roomName
 
-				if calculated && s.shouldIncludeHeroes(roomUpdate.RoomID()) {
+				if calculated && roomSubscription().IncludeHeroes() {
 					thisRoom.Heroes = metadata.Heroes
 				}
 			}
@@ -285,6 +623,10 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 				metadata := roomUpdate.GlobalRoomMetadata()
 				metadata.RemoveHero(s.userID)
 				thisRoom.AvatarChange = sync3.NewAvatarChange(internal.CalculateAvatar(metadata, roomUpdate.UserRoomMetadata().IsDM))
+				// the heroes carry avatars too, so keep them in sync with the avatar
+				if _, calculated := internal.CalculateRoomName(metadata, 5); calculated && roomSubscription().IncludeHeroes() {
+					thisRoom.Heroes = metadata.Heroes
+				}
 			}
 			if delta.InviteCountChanged {
 				thisRoom.InvitedCount = &roomUpdate.GlobalRoomMetadata().InviteCount
@@ -292,6 +634,34 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			if delta.JoinCountChanged {
 				thisRoom.JoinedCount = roomUpdate.GlobalRoomMetadata().JoinCount
 			}
+			if isStateEvent(roomEventUpdate, "m.room.join_rules", "") && roomSubscription().IncludeJoinRules() {
+				thisRoom.JoinRules = sync3.NewJoinRules(roomEventUpdate.EventData.Event)
+			}
+			if isStateEvent(roomEventUpdate, "m.room.name", "") && roomSubscription().IncludeNameContent() {
+				thisRoom.NameContent = sync3.NewNameContent(roomEventUpdate.EventData.Event)
+			}
+			if isStateEvent(roomEventUpdate, "m.room.topic", "") && roomSubscription().IncludeTopic() {
+				thisRoom.Topic = sync3.NewRoomTopic(roomEventUpdate.EventData.Event)
+			}
+			if isStateEvent(roomEventUpdate, "m.room.server_acl", "") && roomSubscription().IncludeServerACL() {
+				thisRoom.ServerACL = sync3.NewServerACL(roomEventUpdate.EventData.Event)
+			}
+			if isWidgetEvent(roomEventUpdate) && roomSubscription().IncludeWidgets() {
+				// widgets are returned in full, so reload them all as of this event
+				roomID := roomUpdate.RoomID()
+				roomIDToWidgets := s.globalCache.LoadStateEventsOfTypes(ctx, []string{roomID}, s.loadPositions[roomID], sync3.WidgetEventTypes...)
+				widgets := sync3.NewWidgets(roomIDToWidgets[roomID])
+				thisRoom.Widgets = &widgets
+			}
+			if isStateEvent(roomEventUpdate, "m.room.power_levels", "") || isStateEventOfType(roomEventUpdate, "m.room.member") {
+				roomID := roomUpdate.RoomID()
+				if queriedMembers := roomSubscription().QueriedMembers(); isQueriedMemberEvent(roomEventUpdate, queriedMembers) {
+					// members are returned in full, so reload them all as of this event
+					roomIDToMembers := s.globalCache.LoadMembers(ctx, []string{roomID}, s.loadPositions[roomID], queriedMembers)
+					powerLevels := s.globalCache.LoadStateEvents(ctx, []string{roomID}, s.loadPositions[roomID], "m.room.power_levels", "")
+					thisRoom.Members = sync3.NewMembers(roomIDToMembers[roomID], powerLevels[roomID])
+				}
+			}
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
 		if delta.HighlightCountChanged || delta.NotificationCountChanged {
@@ -339,9 +709,17 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 	rup, isRoomUpdate := up.(caches.RoomUpdate)
 	if isRoomUpdate {
 		updateTimestamp := rup.GlobalRoomMetadata().LastMessageTimestamp
+		existing := s.lists.ReadOnlyRoom(rup.RoomID())
 		for listKey, list := range s.muxedReq.Lists {
 			if len(list.BumpEventTypes) == 0 {
 				// If this list hasn't provided BumpEventTypes, bump the room list for all room updates.
+				// Updates which are not events carry a snapshot of the room from when they were made,
+				// which is older than what we loaded if the update was buffered before load(). Never
+				// move rooms backwards for these, else the room moves down and back up again in
+				// consecutive responses when the next event in the room is processed.
+				if !isRoomEventUpdate && existing != nil && updateTimestamp < existing.GetLastInterestedEventTimestamp(listKey) {
+					continue
+				}
 				bumpTimestampInList[listKey] = updateTimestamp
 			} else if isRoomEventUpdate {
 				// If BumpEventTypes are provided, only bump the room if we see an event
@@ -357,6 +735,8 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 			}
 		}
 
+		// activity in an untracked room means it should now be tracked
+		delete(s.untrackedRooms, rup.RoomID())
 		metadata := rup.GlobalRoomMetadata().DeepCopy()
 		metadata.RemoveHero(s.userID)
 		// TODO: if we change a room from being a DM to not being a DM, we should call
@@ -366,9 +746,14 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 		//   - call SetRooms for each room in the difference.
 		// I'm assuming this happens so rarely that we can ignore this for now. PRs
 		// welcome if you a strong opinion to the contrary.
+		userRoomData := *rup.UserRoomMetadata()
+		if s.hiddenFromGuest(metadata) {
+			// treat the room as left so it is removed from every list
+			userRoomData.HasLeft = true
+		}
 		delta = s.lists.SetRoom(sync3.RoomConnMetadata{
 			RoomMetadata:                  *metadata,
-			UserRoomData:                  *rup.UserRoomMetadata(),
+			UserRoomData:                  userRoomData,
 			LastInterestedEventTimestamps: bumpTimestampInList,
 		})
 	}
@@ -387,7 +772,7 @@ func (s *connStateLive) processLiveUpdateForList(
 	switch update := up.(type) {
 	case *caches.RoomEventUpdate:
 		logger.Trace().Str("user", s.userID).Str("type", update.EventData.EventType).Msg("received event update")
-		if update.EventData.ForceInitial {
+		if update.EventData.ForceInitial && !reqList.IsOpsOnly() {
 			// add room to sub: this applies for when we track all rooms too as we want joins/etc to come through with initial data
 			subID := builder.AddSubscription(reqList.RoomSubscription)
 			builder.AddRoomsToSubscription(ctx, subID, []string{update.RoomID()})
@@ -412,6 +797,13 @@ func (s *connStateLive) processLiveUpdateForList(
 	)
 	resList.Ops = append(resList.Ops, ops...)
 
+	// the stripped state of a visible room has been replaced e.g a knock was accepted with an
+	// invite, so send the room again. Rooms which came into view are already sent by resort.
+	if _, isInvite := up.(*caches.InviteUpdate); isInvite && listOp == sync3.ListOpChange && hasUpdates && !reqList.IsOpsOnly() {
+		subID := builder.AddSubscription(reqList.RoomSubscription)
+		builder.AddRoomsToSubscription(ctx, subID, []string{rup.RoomID()})
+	}
+
 	if !hasUpdates {
 		hasUpdates = len(resList.Ops) > 0
 	}
@@ -425,15 +817,23 @@ func (s *connStateLive) resort(
 	reqList *sync3.RequestList, intList *sync3.FilteredSortableRooms, roomID string,
 	listOp sync3.ListOp,
 ) (ops []sync3.ResponseOp, didUpdate bool) {
+	ctx, span := internal.StartSpan(ctx, "resort")
+	defer span.End()
 	if reqList.ShouldGetAllRooms() {
-		// no need to sort this list as we get all rooms
+		// no need to sort this list as we get all rooms, but it is sorted again if the client
+		// switches to ranges
 		// no need to calculate ops as we get all rooms
 		// no need to send initial state for some rooms as we already sent initial state for all rooms
+		if listOp != sync3.ListOpDel {
+			intList.MarkUnsorted()
+		}
 		if listOp == sync3.ListOpAdd {
 			intList.Add(roomID)
 			// ensure we send data when the user joins a new room
-			subID := builder.AddSubscription(reqList.RoomSubscription)
-			builder.AddRoomsToSubscription(ctx, subID, []string{roomID})
+			if !reqList.IsOpsOnly() {
+				subID := builder.AddSubscription(reqList.RoomSubscription)
+				builder.AddRoomsToSubscription(ctx, subID, []string{roomID})
+			}
 		} else if listOp == sync3.ListOpDel {
 			intList.Remove(roomID)
 		}
@@ -441,7 +841,7 @@ func (s *connStateLive) resort(
 	}
 
 	ops, subs := sync3.CalculateListOps(ctx, reqList, intList, roomID, listOp)
-	if len(subs) > 0 { // handle rooms which have just come into the window
+	if len(subs) > 0 && !reqList.IsOpsOnly() { // handle rooms which have just come into the window
 		subID := builder.AddSubscription(reqList.RoomSubscription)
 		builder.AddRoomsToSubscription(ctx, subID, subs)
 	}
@@ -458,19 +858,185 @@ func (s *connStateLive) resort(
 	return ops, hasUpdates
 }
 
+// hasLiveEventLimit returns true if the room subscriptions or any list limit the number of live
+// events per room. Most connections don't, so this avoids working out the limit for every event.
+func (s *connStateLive) hasLiveEventLimit() bool {
+	for _, rs := range s.roomSubscriptions {
+		if rs.MaxLiveEvents() > 0 {
+			return true
+		}
+	}
+	for _, list := range s.muxedReq.Lists {
+		if list.MaxLiveEvents() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // shouldIncludeHeroes returns whether the given roomID is in a list or direct
 // subscription which should return heroes.
 func (s *connStateLive) shouldIncludeHeroes(roomID string) bool {
-	if s.roomSubscriptions[roomID].IncludeHeroes() {
+	return s.shouldInclude(roomID, sync3.RoomSubscription.IncludeHeroes)
+}
+
+// shouldInclude returns true if the room subscription for this room, or any list this room is
+// visible in, wants the optional field checked by `wants`.
+func (s *connStateLive) shouldInclude(roomID string, wants func(sync3.RoomSubscription) bool) bool {
+	if wants(s.roomSubscriptions[roomID]) {
 		return true
 	}
 	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
 	for _, listKey := range roomIDsToLists[roomID] {
-		// check if this list should include heroes
-		if !s.muxedReq.Lists[listKey].IncludeHeroes() {
+		if wants(s.muxedReq.Lists[listKey].RoomSubscription) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOpsOnlyRoom returns true if the room has no room subscription and is only visible in ops_only
+// lists, so no room data is sent for it.
+func (s *connStateLive) isOpsOnlyRoom(roomID string) bool {
+	hasOpsOnlyList := false
+	for _, list := range s.muxedReq.Lists {
+		if list.IsOpsOnly() {
+			hasOpsOnlyList = true
+			break
+		}
+	}
+	if !hasOpsOnlyList {
+		return false
+	}
+	if _, subscribed := s.roomSubscriptions[roomID]; subscribed {
+		return false
+	}
+	listKeys := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)[roomID]
+	for _, listKey := range listKeys {
+		if list := s.muxedReq.Lists[listKey]; !list.IsOpsOnly() {
+			return false
+		}
+	}
+	return len(listKeys) > 0
+}
+
+// combinedSubscription returns the union of the room subscription for this room and the
+// subscriptions of all lists this room is visible in.
+func (s *connStateLive) combinedSubscription(roomID string) sync3.RoomSubscription {
+	var combined *sync3.RoomSubscription
+	if rs, ok := s.roomSubscriptions[roomID]; ok {
+		combined = &rs
+	}
+	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	for _, listKey := range roomIDsToLists[roomID] {
+		rs := s.muxedReq.Lists[listKey].RoomSubscription
+		if combined != nil {
+			rs = combined.Combine(rs)
+		}
+		combined = &rs
+	}
+	if combined == nil {
+		return sync3.RoomSubscription{}
+	}
+	return *combined
+}
+
+// annotateLiveEvent returns the live event with its transaction ID, if it was sent by this device,
+// and the annotations which the room's subscription asks for.
+func (s *connStateLive) annotateLiveEvent(ctx context.Context, roomID string, rs sync3.RoomSubscription, event json.RawMessage) json.RawMessage {
+	events := s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, map[string][]json.RawMessage{
+		roomID: {event},
+	})[roomID]
+	if rs.EmbedSenderProfile() {
+		sender := gjson.GetBytes(event, "sender").Str
+		senderMembership := s.globalCache.LoadMembers(ctx, []string{roomID}, s.loadPositions[roomID], []string{sender})
+		events = sync3.EmbedSenderProfiles(events, senderMembership[roomID])
+	}
+	if rs.AnnotateMentions() {
+		events = sync3.AnnotateMentions(events, s.userID)
+	}
+	if rs.IncludeEncryptedMetadata() {
+		events = sync3.EmbedEncryptedMetadata(events)
+	}
+	return events[0]
+}
+
+// redactUndeliveredEvent replaces the event redacted by `redaction` with its redacted form, if the
+// event is in the timeline of this response and so has not been sent to the client yet. This stops
+// clients briefly showing events which are redacted soon after they are sent. The window for
+// this is the lifetime of the response: the updates which are processed together, plus any
+// coalescing window the client asked for. Events which have already been sent are left for the
+// client to redact when it sees the redaction event, which is always sent. The redacted form is
+// annotated again, as it is loaded from the database without the live event's annotations.
+func (s *connStateLive) redactUndeliveredEvent(ctx context.Context, roomID string, rs sync3.RoomSubscription, r *sync3.Room, redaction *caches.EventData) {
+	// the redacted event ID moved into the content in room v11
+	redacts := gjson.GetBytes(redaction.Event, "redacts").Str
+	if redacts == "" {
+		redacts = redaction.Content.Get("redacts").Str
+	}
+	if redacts == "" {
+		return
+	}
+	for i, ev := range r.Timeline {
+		if gjson.GetBytes(ev, "event_id").Str != redacts {
 			continue
 		}
+		// the event is redacted in the database before the redaction is sent to connections
+		redacted := s.globalCache.LoadEvents(ctx, roomID, []string{redacts})[redacts]
+		if redacted == nil || !gjson.GetBytes(redacted, "unsigned.redacted_because").Exists() {
+			return
+		}
+		internal.Logf(ctx, "liveUpdate", "redacted undelivered event %s in %s", redacts, roomID)
+		r.Timeline[i] = s.annotateLiveEvent(ctx, roomID, rs, redacted)
+		return
+	}
+}
+
+// isWidgetEvent returns true if this update is for a widget state event.
+func isWidgetEvent(up *caches.RoomEventUpdate) bool {
+	if up == nil || up.EventData.Event == nil || up.EventData.StateKey == nil {
+		return false
+	}
+	for _, evType := range sync3.WidgetEventTypes {
+		if up.EventData.EventType == evType {
+			return true
+		}
+	}
+	return false
+}
+
+// isQueriedMemberEvent returns true if this update changes the membership or power level of any of
+// the queried users.
+func isQueriedMemberEvent(up *caches.RoomEventUpdate, queriedMembers []string) bool {
+	if len(queriedMembers) == 0 {
+		return false
+	}
+	if isStateEvent(up, "m.room.power_levels", "") {
 		return true
 	}
+	if !isStateEventOfType(up, "m.room.member") {
+		return false
+	}
+	for _, userID := range queriedMembers {
+		if *up.EventData.StateKey == userID {
+			return true
+		}
+	}
 	return false
 }
+
+// isStateEventOfType returns true if this update is for a state event with the given type.
+func isStateEventOfType(up *caches.RoomEventUpdate, evType string) bool {
+	if up == nil || up.EventData.Event == nil || up.EventData.StateKey == nil {
+		return false
+	}
+	return up.EventData.EventType == evType
+}
+
+// isStateEvent returns true if this update is for a state event with the given type and state key.
+func isStateEvent(up *caches.RoomEventUpdate, evType, stateKey string) bool {
+	if up == nil || up.EventData.Event == nil || up.EventData.StateKey == nil {
+		return false
+	}
+	return up.EventData.EventType == evType && *up.EventData.StateKey == stateKey
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -16,6 +17,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
 )
 
 type joinChecker struct{}
@@ -33,12 +35,15 @@ func (h *NopExtensionHandler) Handle(ctx context.Context, req extensions.Request
 func (h *NopExtensionHandler) HandleLiveUpdate(ctx context.Context, update caches.Update, req extensions.Request, res *extensions.Response, extCtx extensions.Context) {
 }
 
+func (h *NopExtensionHandler) EnforceSizeLimits(ctx context.Context, res *extensions.Response) {
+}
+
 type NopUserCacheStore struct{}
 
-func (s *NopUserCacheStore) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string) {
+func (s *NopUserCacheStore) GetClosestPrevBatch(ctx context.Context, roomID string, eventNID int64) (prevBatch string) {
 	return
 }
-func (s *NopUserCacheStore) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error) {
+func (s *NopUserCacheStore) LatestEventsInRooms(ctx context.Context, userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error) {
 	return nil, nil
 }
 
@@ -124,7 +129,7 @@ func TestConnStateInitial(t *testing.T) {
 		}
 		return result
 	}
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, newDeviceUpdatesMap(1000, 0, false), 0, 0)
 	if userID != cs.UserID() {
 		t.Fatalf("UserID returned wrong value, got %v want %v", cs.UserID(), userID)
 	}
@@ -289,7 +294,7 @@ func TestConnStateMultipleRanges(t *testing.T) {
 	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
 	dispatcher.Register(context.Background(), userCache.UserID, userCache)
 	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, newDeviceUpdatesMap(1000, 0, false), 0, 0)
 
 	// request first page
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
@@ -468,7 +473,7 @@ func TestBumpToOutsideRange(t *testing.T) {
 	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
 	dispatcher.Register(context.Background(), userCache.UserID, userCache)
 	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, newDeviceUpdatesMap(1000, 0, false), 0, 0)
 	// Ask for A,B
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
 		Lists: map[string]sync3.RequestList{"a": {
@@ -579,7 +584,7 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 	}
 	dispatcher.Register(context.Background(), userCache.UserID, userCache)
 	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
-	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, newDeviceUpdatesMap(1000, 0, false), 0, 0)
 	// subscribe to room D
 	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
 		RoomSubscriptions: map[string]sync3.RoomSubscription{
@@ -703,6 +708,244 @@ func TestConnStateRoomSubscriptions(t *testing.T) {
 	})
 }
 
+// Test that setting coalesce_ms batches live updates together, reducing the number of responses.
+func TestConnStateCoalesce(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateCoalesce_alice:localhost"
+	deviceID := "yep"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	numEvents := 5
+	numResponses := func(coalesceMSecs int64) int {
+		cs, dispatcher, _ := newTestConnState(t, userID, deviceID, roomA)
+		cs.live.maxCoalesceWindow = time.Second
+		_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			RoomSubscriptions: map[string]sync3.RoomSubscription{
+				roomA.RoomID: {
+					TimelineLimit: 20,
+				},
+			},
+			CoalesceMSecs: &coalesceMSecs,
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+
+		events := make([]json.RawMessage, numEvents)
+		for i := range events {
+			events[i] = testutils.NewEvent(t, "unimportant", "me", struct{}{})
+		}
+		go func() {
+			for i, ev := range events {
+				time.Sleep(20 * time.Millisecond)
+				dispatcher.OnNewEvent(context.Background(), roomA.RoomID, ev, int64(i+2))
+			}
+		}()
+		gotEvents := 0
+		responses := 0
+		for gotEvents < numEvents {
+			req := &sync3.Request{}
+			req.SetTimeoutMSecs(2000)
+			res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+			if err != nil {
+				t.Fatalf("OnIncomingRequest returned error : %s", err)
+			}
+			if len(res.Rooms) == 0 {
+				t.Fatalf("timed out waiting for events, got %d/%d", gotEvents, numEvents)
+			}
+			gotEvents += len(res.Rooms[roomA.RoomID].Timeline)
+			responses++
+		}
+		return responses
+	}
+	immediate := numResponses(0)
+	coalesced := numResponses(500)
+	if coalesced != 1 {
+		t.Errorf("coalesce_ms: got %d responses, want 1", coalesced)
+	}
+	if immediate <= coalesced {
+		t.Errorf("coalesce_ms did not reduce the number of responses: got %d without, %d with", immediate, coalesced)
+	}
+}
+
+// Test that live events in the focus room are returned without waiting for the coalescing window,
+// and that the previous focus room is coalesced as normal when the focus changes.
+func TestConnStateFocusRoom(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateFocusRoom_alice:localhost"
+	deviceID := "yep"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, _ := newTestConnState(t, userID, deviceID, roomA, roomB)
+	cs.live.maxCoalesceWindow = time.Second
+	coalesceMSecs := int64(500)
+	focusRoom := roomA.RoomID
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {TimelineLimit: 20},
+			roomB.RoomID: {TimelineLimit: 20},
+		},
+		CoalesceMSecs: &coalesceMSecs,
+		FocusRoom:     &focusRoom,
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	nid := int64(1)
+	sendEvents := func(roomIDs ...string) {
+		for _, roomID := range roomIDs {
+			time.Sleep(50 * time.Millisecond)
+			nid++
+			dispatcher.OnNewEvent(context.Background(), roomID, testutils.NewEvent(t, "unimportant", "me", struct{}{}), nid)
+		}
+	}
+	sync := func(req *sync3.Request) (*sync3.Response, time.Duration) {
+		t.Helper()
+		req.SetTimeoutMSecs(2000)
+		start := time.Now()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res, time.Since(start)
+	}
+
+	// an event in another room starts coalescing, but an event in the focus room ends it early
+	go sendEvents(roomB.RoomID, roomA.RoomID)
+	res, took := sync(&sync3.Request{})
+	if len(res.Rooms[roomA.RoomID].Timeline) != 1 || len(res.Rooms[roomB.RoomID].Timeline) != 1 {
+		t.Fatalf("expected 1 event in each room, got %+v", res.Rooms)
+	}
+	if took >= time.Duration(coalesceMSecs)*time.Millisecond {
+		t.Fatalf("focus room event was coalesced: response took %v", took)
+	}
+
+	// change focus: room A is now coalesced as normal
+	focusRoom = roomB.RoomID
+	go sendEvents(roomA.RoomID)
+	res, took = sync(&sync3.Request{FocusRoom: &focusRoom})
+	if len(res.Rooms[roomA.RoomID].Timeline) != 1 {
+		t.Fatalf("expected 1 event in room A, got %+v", res.Rooms)
+	}
+	if took < time.Duration(coalesceMSecs)*time.Millisecond {
+		t.Fatalf("previous focus room was not coalesced: response took %v", took)
+	}
+}
+
+// Test that leaving, being kicked from or being banned from a room lists it in rooms_removed, but
+// only if the client asked for it.
+func TestConnStateRoomsRemoved(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateRoomsRemoved_alice:localhost"
+	deviceID := "yep"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678062))
+	roomC := newRoomMetadata("!c:localhost", spec.Timestamp(1632131678063))
+	cs, dispatcher, _ := newTestConnState(t, userID, deviceID, roomA, roomB, roomC)
+	includeRoomsRemoved := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{
+				[2]int64{0, 10},
+			},
+		}},
+		RoomsRemoved: &includeRoomsRemoved,
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if len(res.RoomsRemoved) != 0 {
+		t.Fatalf("initial response has rooms_removed: %v", res.RoomsRemoved)
+	}
+	sync := func(req *sync3.Request) *sync3.Response {
+		t.Helper()
+		req.SetTimeoutMSecs(100)
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+	leave := func(sender, membership string) json.RawMessage {
+		return testutils.NewStateEvent(t, "m.room.member", userID, sender, map[string]interface{}{"membership": membership})
+	}
+
+	// leave room A: the leave is seen in the timeline and via the leave section, but is only removed once
+	leaveA := leave(userID, "leave")
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, leaveA, 2)
+	cs.userCache.OnLeftRoom(context.Background(), roomA.RoomID, leaveA)
+	res = sync(&sync3.Request{})
+	if !reflect.DeepEqual(res.RoomsRemoved, []string{roomA.RoomID}) {
+		t.Fatalf("rooms_removed: got %v want %v", res.RoomsRemoved, []string{roomA.RoomID})
+	}
+
+	// kicks and bans are removals, and removals are not repeated in later responses
+	dispatcher.OnNewEvent(context.Background(), roomC.RoomID, leave("@bob:localhost", "ban"), 3)
+	cs.userCache.OnLeftRoom(context.Background(), roomB.RoomID, leave("@bob:localhost", "leave"))
+	res = sync(&sync3.Request{})
+	if !reflect.DeepEqual(res.RoomsRemoved, []string{roomB.RoomID, roomC.RoomID}) {
+		t.Fatalf("rooms_removed: got %v want %v", res.RoomsRemoved, []string{roomB.RoomID, roomC.RoomID})
+	}
+
+	// rejoining before the response is sent cancels the removal
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewJoinEvent(t, userID), 4)
+	res = sync(&sync3.Request{})
+	if len(res.RoomsRemoved) != 0 {
+		t.Fatalf("rooms_removed after rejoining: got %v", res.RoomsRemoved)
+	}
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, leave(userID, "leave"), 5)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewJoinEvent(t, userID), 6)
+	res = sync(&sync3.Request{})
+	if len(res.RoomsRemoved) != 0 {
+		t.Fatalf("rooms_removed after leaving and rejoining: got %v", res.RoomsRemoved)
+	}
+
+	// not included if the client doesn't ask for it
+	includeRoomsRemoved = false
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, leave(userID, "leave"), 7)
+	res = sync(&sync3.Request{RoomsRemoved: &includeRoomsRemoved})
+	if len(res.RoomsRemoved) != 0 {
+		t.Fatalf("rooms_removed without include_rooms_removed: got %v", res.RoomsRemoved)
+	}
+}
+
+// newTestConnState makes a ConnState for a user joined to the given rooms, along with the dispatcher
+// and global cache backing it so tests can inject live events and mock out state loading.
+func newTestConnState(t *testing.T, userID, deviceID string, rooms ...internal.RoomMetadata) (*ConnState, *sync3.Dispatcher, *caches.GlobalCache) {
+	t.Helper()
+	roomIDToMetadata := make(map[string]internal.RoomMetadata, len(rooms))
+	roomIDToUsers := make(map[string][]string, len(rooms))
+	for _, r := range rooms {
+		roomIDToMetadata[r.RoomID] = r
+		roomIDToUsers[r.RoomID] = []string{userID}
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(roomIDToMetadata)
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(roomIDToUsers)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		joinedRooms = make(map[string]*internal.RoomMetadata, len(rooms))
+		joinTimings = make(map[string]internal.EventMetadata, len(rooms))
+		for i := range rooms {
+			joinedRooms[rooms[i].RoomID] = &rooms[i]
+			joinTimings[rooms[i].RoomID] = internal.EventMetadata{NID: 1, Timestamp: 1}
+		}
+		return 1, joinedRooms, joinTimings, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, newDeviceUpdatesMap(1000, 0, false), 0, 0)
+	return cs, dispatcher, globalCache
+}
+
 func checkResponse(t *testing.T, checkRoomIDsOnly bool, got, want *sync3.Response) {
 	t.Helper()
 	if len(got.Lists) != len(want.Lists) {
@@ -806,3 +1049,2541 @@ func serialise(t *testing.T, thing interface{}) string {
 func intPtr(val int) *int {
 	return &val
 }
+
+// Test that the join rules allow conditions of restricted rooms are returned when asked for,
+// and are updated live.
+func TestConnStateJoinRules(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateJoinRules_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	spaceRoomID := "!space:localhost"
+	cs, dispatcher, globalCache := newTestConnState(t, userID, "yep", roomA)
+	globalCache.LoadStateEventsOverride = func(roomIDs []string, loadPosition int64, evType, stateKey string) map[string]json.RawMessage {
+		if evType != "m.room.join_rules" || stateKey != "" {
+			t.Errorf("LoadStateEvents called with unexpected type/state key: %s %s", evType, stateKey)
+		}
+		return map[string]json.RawMessage{
+			roomA.RoomID: testutils.NewStateEvent(t, "m.room.join_rules", "", userID, map[string]interface{}{
+				"join_rule": "restricted",
+				"allow": []interface{}{
+					map[string]interface{}{"type": "m.room_membership", "room_id": spaceRoomID},
+					"not an object",
+				},
+			}),
+		}
+	}
+	boolTrue := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 1,
+				JoinRules:     &boolTrue,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	want := &sync3.JoinRules{
+		JoinRule: "restricted",
+		Allow: []sync3.JoinRuleAllow{
+			{Type: "m.room_membership", RoomID: spaceRoomID},
+		},
+	}
+	if got := res.Rooms[roomA.RoomID].JoinRules; !reflect.DeepEqual(got, want) {
+		t.Fatalf("initial join rules: got %+v want %+v", got, want)
+	}
+
+	// the room becomes public: this should be sent live
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewStateEvent(t, "m.room.join_rules", "", userID, map[string]interface{}{
+		"join_rule": "public",
+	}), 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	want = &sync3.JoinRules{JoinRule: "public"}
+	if got := res.Rooms[roomA.RoomID].JoinRules; !reflect.DeepEqual(got, want) {
+		t.Fatalf("live join rules: got %+v want %+v", got, want)
+	}
+}
+
+// Test that the create event summary is returned when asked for.
+func TestConnStateCreate(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateCreate_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678060))
+	cs, _, globalCache := newTestConnState(t, userID, "yep", roomA, roomB)
+	globalCache.LoadStateEventsOverride = func(roomIDs []string, loadPosition int64, evType, stateKey string) map[string]json.RawMessage {
+		if evType != "m.room.create" || stateKey != "" {
+			t.Errorf("LoadStateEvents called with unexpected type/state key: %s %s", evType, stateKey)
+		}
+		return map[string]json.RawMessage{
+			roomA.RoomID: testutils.NewStateEvent(t, "m.room.create", "", userID, map[string]interface{}{
+				"room_version": "11",
+				"type":         "m.space",
+			}),
+		}
+	}
+	boolTrue := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges: sync3.SliceRanges{{0, 1}},
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 1,
+				Create:        &boolTrue,
+			},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	want := &sync3.RoomCreate{RoomVersion: "11", Creator: userID, Type: "m.space", Federated: true}
+	if got := res.Rooms[roomA.RoomID].Create; !reflect.DeepEqual(got, want) {
+		t.Fatalf("create: got %+v want %+v", got, want)
+	}
+	// no create event was found for room B, so there is nothing to return.
+	if got := res.Rooms[roomB.RoomID].Create; got != nil {
+		t.Fatalf("create: got %+v want nil", got)
+	}
+}
+
+// Test that timeline_senders filters both the initial and live timeline.
+func TestConnStateTimelineSenders(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateTimelineSenders_alice:localhost"
+	bob := "@TestConnStateTimelineSenders_bob:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA)
+	aliceMsg := testutils.NewMessageEvent(t, userID, "from alice")
+	bobMsg := testutils.NewMessageEvent(t, bob, "from bob")
+	cs.userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		return map[string]state.LatestEvents{
+			roomA.RoomID: {
+				Timeline:  []json.RawMessage{aliceMsg, bobMsg},
+				PrevBatch: "prev",
+				LatestNID: 1,
+			},
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit:   10,
+				TimelineSenders: []string{bob},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	room := res.Rooms[roomA.RoomID]
+	if !reflect.DeepEqual(room.Timeline, []json.RawMessage{bobMsg}) {
+		t.Fatalf("initial timeline: got %s want only bob's message", room.Timeline)
+	}
+	if room.PrevBatch != "prev" {
+		t.Fatalf("prev_batch should refer to the unfiltered timeline: got %v", room.PrevBatch)
+	}
+
+	// a live event from alice is filtered out, but one from bob is not
+	aliceLive := testutils.NewMessageEvent(t, userID, "alice live")
+	bobLive := testutils.NewMessageEvent(t, bob, "bob live")
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, aliceLive, 2)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, bobLive, 3)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	room = res.Rooms[roomA.RoomID]
+	if !reflect.DeepEqual(room.Timeline, []json.RawMessage{bobLive}) {
+		t.Fatalf("live timeline: got %s want only bob's message", room.Timeline)
+	}
+	if room.NumLive != 1 {
+		t.Fatalf("num_live: got %d want 1", room.NumLive)
+	}
+}
+
+// Test that a burst of live events in a room is spread over multiple responses when it exceeds
+// the live event limit, and that the room is marked as limited if deferred events are dropped.
+func TestConnStateLiveEventLimit(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateLiveEventLimit_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA)
+	liveEventLimit := int64(2)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit:  10,
+				LiveEventLimit: &liveEventLimit,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	var burst []json.RawMessage
+	nid := int64(2)
+	sendBurst := func(n int) []json.RawMessage {
+		var events []json.RawMessage
+		for i := 0; i < n; i++ {
+			ev := testutils.NewMessageEvent(t, userID, fmt.Sprintf("burst %d", nid))
+			dispatcher.OnNewEvent(context.Background(), roomA.RoomID, ev, nid)
+			nid++
+			events = append(events, ev)
+		}
+		return events
+	}
+	assertTimeline := func(want []json.RawMessage, wantLimited bool) {
+		t.Helper()
+		res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		room := res.Rooms[roomA.RoomID]
+		if !reflect.DeepEqual(room.Timeline, want) {
+			t.Fatalf("timeline: got %s want %s", room.Timeline, want)
+		}
+		if room.NumLive != len(want) {
+			t.Fatalf("num_live: got %d want %d", room.NumLive, len(want))
+		}
+		if room.Limited != wantLimited {
+			t.Fatalf("limited: got %v want %v", room.Limited, wantLimited)
+		}
+	}
+
+	// 5 events are returned over 3 responses, in order
+	burst = sendBurst(5)
+	assertTimeline(burst[0:2], false)
+	assertTimeline(burst[2:4], false)
+	assertTimeline(burst[4:5], false)
+
+	// at most maxDeferredResponses worth of events are deferred, so the oldest deferred events of
+	// this burst are dropped
+	burst = sendBurst(2 + 2*maxDeferredResponses + 2)
+	assertTimeline(burst[0:2], false)
+	assertTimeline(burst[4:6], true)
+	assertTimeline(burst[6:8], false)
+}
+
+// Test that live events are limited to DefaultLiveEventLimit unless the client sets a live event
+// limit, and not limited at all if it sets a limit of 0.
+func TestConnStateDefaultLiveEventLimit(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateDefaultLiveEventLimit_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	noLimit := int64(0)
+	testCases := []struct {
+		name           string
+		liveEventLimit *int64
+		wantNumLive    []int
+	}{
+		{name: "unset", wantNumLive: []int{int(sync3.DefaultLiveEventLimit), 10}},
+		{name: "no limit", liveEventLimit: &noLimit, wantNumLive: []int{int(sync3.DefaultLiveEventLimit) + 10}},
+	}
+	for _, tc := range testCases {
+		cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA)
+		_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			RoomSubscriptions: map[string]sync3.RoomSubscription{
+				roomA.RoomID: {
+					TimelineLimit:  10,
+					LiveEventLimit: tc.liveEventLimit,
+				},
+			},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("%s: OnIncomingRequest returned error : %s", tc.name, err)
+		}
+		var burst []json.RawMessage
+		for nid := int64(2); nid < 2+sync3.DefaultLiveEventLimit+10; nid++ {
+			ev := testutils.NewMessageEvent(t, userID, fmt.Sprintf("burst %d", nid))
+			dispatcher.OnNewEvent(context.Background(), roomA.RoomID, ev, nid)
+			burst = append(burst, ev)
+		}
+		for _, numLive := range tc.wantNumLive {
+			res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+			if err != nil {
+				t.Fatalf("%s: OnIncomingRequest returned error : %s", tc.name, err)
+			}
+			room := res.Rooms[roomA.RoomID]
+			if !reflect.DeepEqual(room.Timeline, burst[:numLive]) || room.NumLive != numLive {
+				t.Fatalf("%s: got %d live events, want %d", tc.name, room.NumLive, numLive)
+			}
+			burst = burst[numLive:]
+		}
+	}
+}
+
+// Test that an edit which arrives for an event outside the timeline includes the edited event.
+func TestConnStateRelationTargets(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateRelationTargets_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, globalCache := newTestConnState(t, userID, "yep", roomA)
+	original := testutils.NewMessageEvent(t, userID, "original")
+	originalID := gjson.GetBytes(original, "event_id").Str
+	globalCache.LoadEventTypesOverride = func(roomID string, eventIDs []string) map[string]string {
+		if roomID != roomA.RoomID {
+			t.Errorf("LoadEventTypes called for unexpected room %s", roomID)
+		}
+		result := make(map[string]string)
+		for _, eventID := range eventIDs {
+			if eventID == originalID {
+				result[eventID] = "m.room.message"
+			}
+		}
+		return result
+	}
+	boolTrue := true
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit:   1,
+				RelationTargets: &boolTrue,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	edit := testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{
+		"body": "* edited",
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.replace",
+			"event_id": originalID,
+		},
+	})
+	// the target of this reaction is unknown, so it isn't returned
+	reaction := testutils.NewEvent(t, "m.reaction", userID, map[string]interface{}{
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.annotation",
+			"event_id": "$unknown",
+			"key":      "👍",
+		},
+	})
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, edit, 2)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, reaction, 3)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	want := []sync3.RelationTarget{{EventID: originalID, Type: "m.room.message"}}
+	if got := res.Rooms[roomA.RoomID].RelationTargets; !reflect.DeepEqual(got, want) {
+		t.Fatalf("relation targets: got %+v want %+v", got, want)
+	}
+}
+
+// Test that only the most recently active rooms are tracked when there are too many rooms, and
+// that untracked rooms become tracked when they get activity.
+func TestConnStateMaxTrackedRooms(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMaxTrackedRooms_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678062))
+	roomC := newRoomMetadata("!c:localhost", spec.Timestamp(1632131678060))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA, roomB, roomC)
+	cs.maxTrackedRooms = 2
+	loadedRoomIDs := make(map[string]bool)
+	cs.userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		for _, roomID := range roomIDs {
+			loadedRoomIDs[roomID] = true
+		}
+		return mockLazyRoomOverride(loadPos, roomIDs, maxTimelineEvents)
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges{{0, 9}},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 2,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 1},
+						RoomIDs:   []string{roomB.RoomID, roomA.RoomID},
+					},
+				},
+			},
+		},
+	})
+	if res.UntrackedRooms != 1 {
+		t.Fatalf("untracked_rooms: got %d want 1", res.UntrackedRooms)
+	}
+	if _, ok := res.Rooms[roomC.RoomID]; ok || loadedRoomIDs[roomC.RoomID] {
+		t.Fatalf("untracked room C was loaded: returned=%v loaded=%v", ok, loadedRoomIDs[roomC.RoomID])
+	}
+
+	// activity in a tracked room does not send or load room C
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, userID, "hello"), 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if _, ok := res.Rooms[roomA.RoomID]; !ok {
+		t.Fatalf("room A was not returned after activity")
+	}
+	if _, ok := res.Rooms[roomC.RoomID]; ok || loadedRoomIDs[roomC.RoomID] {
+		t.Fatalf("untracked room C was dispatched: returned=%v loaded=%v", ok, loadedRoomIDs[roomC.RoomID])
+	}
+	if count := res.Lists["a"].Count; count != 2 || res.UntrackedRooms != 1 {
+		t.Fatalf("list count: got %d want 2, untracked_rooms: got %d want 1", count, res.UntrackedRooms)
+	}
+
+	// activity in room C means it is now tracked
+	dispatcher.OnNewEvent(context.Background(), roomC.RoomID, testutils.NewMessageEvent(t, userID, "hello"), 3)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if count := res.Lists["a"].Count; count != 3 {
+		t.Fatalf("list count: got %d want 3", count)
+	}
+	if _, ok := res.Rooms[roomC.RoomID]; !ok {
+		t.Fatalf("room C was not returned after it became tracked")
+	}
+	if res.UntrackedRooms != 0 {
+		t.Fatalf("untracked_rooms: got %d want 0", res.UntrackedRooms)
+	}
+}
+
+// Test that the topic is returned when required_state asks for it, and is updated live.
+func TestConnStateTopic(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateTopic_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, globalCache := newTestConnState(t, userID, "yep", roomA)
+	globalCache.LoadStateEventsOverride = func(roomIDs []string, loadPosition int64, evType, stateKey string) map[string]json.RawMessage {
+		if evType != "m.room.topic" || stateKey != "" {
+			t.Errorf("LoadStateEvents called with unexpected type/state key: %s %s", evType, stateKey)
+		}
+		return map[string]json.RawMessage{
+			roomA.RoomID: testutils.NewStateEvent(t, "m.room.topic", "", userID, map[string]interface{}{
+				"topic": "plain",
+			}),
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.topic", ""}},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got, want := res.Rooms[roomA.RoomID].Topic, (&sync3.RoomTopic{Topic: "plain"}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("initial topic: got %+v want %+v", got, want)
+	}
+
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewStateEvent(t, "m.room.topic", "", userID, map[string]interface{}{
+		"m.topic": map[string]interface{}{
+			"m.text": []map[string]interface{}{
+				{"mimetype": "text/html", "body": "<i>rich</i>"},
+				{"body": "rich"},
+			},
+		},
+	}), 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	want := &sync3.RoomTopic{Topic: "rich", Representations: []sync3.TopicRepresentation{
+		{MimeType: "text/html", Body: "<i>rich</i>"},
+		{Body: "rich"},
+	}}
+	if got := res.Rooms[roomA.RoomID].Topic; !reflect.DeepEqual(got, want) {
+		t.Fatalf("live topic: got %+v want %+v", got, want)
+	}
+}
+
+// Test that ops_only lists return list operations without room data, unless the room is
+// explicitly subscribed to. The rooms are not loaded at all.
+func TestConnStateOpsOnlyList(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateOpsOnlyList_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678062))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA, roomB)
+	loadedRoomIDs := make(map[string]bool)
+	cs.userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		for _, roomID := range roomIDs {
+			loadedRoomIDs[roomID] = true
+		}
+		return mockLazyRoomOverride(loadPos, roomIDs, maxTimelineEvents)
+	}
+	boolTrue := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:    []string{sync3.SortByRecency},
+			Ranges:  sync3.SliceRanges{{0, 9}},
+			OpsOnly: &boolTrue,
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 1,
+			},
+		}},
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {TimelineLimit: 1},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 2,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 1},
+						RoomIDs:   []string{roomB.RoomID, roomA.RoomID},
+					},
+				},
+			},
+		},
+	})
+	if _, ok := res.Rooms[roomB.RoomID]; ok || loadedRoomIDs[roomB.RoomID] {
+		t.Fatalf("room B was returned or loaded despite only being in an ops_only list: returned=%v loaded=%v", ok, loadedRoomIDs[roomB.RoomID])
+	}
+	if _, ok := res.Rooms[roomA.RoomID]; !ok {
+		t.Fatalf("room A was not returned despite being subscribed to")
+	}
+
+	// room A jumps to the top of the list, which should be returned as ops without room data,
+	// apart from the subscribed room.
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, userID, "hello"), 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		UnsubscribeRooms: []string{roomA.RoomID},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 2,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpSingle{
+						Operation: "DELETE",
+						Index:     intPtr(1),
+					},
+					&sync3.ResponseOpSingle{
+						Operation: "INSERT",
+						Index:     intPtr(0),
+						RoomID:    roomA.RoomID,
+					},
+				},
+			},
+		},
+	})
+	if len(res.Rooms) != 0 {
+		t.Fatalf("got room data for an ops_only list: %v", res.Rooms)
+	}
+}
+
+// Test that a slow_get_all_rooms list, which is not kept sorted, is sorted again when the client
+// switches to ranges without changing the sort order.
+func TestConnStateGetAllRoomsToRanges(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateGetAllRoomsToRanges_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678062))
+	roomC := newRoomMetadata("!c:localhost", spec.Timestamp(1632131678063))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA, roomB, roomC)
+	boolTrue := true
+	boolFalse := false
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:            []string{sync3.SortByRecency},
+			SlowGetAllRooms: &boolTrue,
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 2},
+						RoomIDs:   []string{roomC.RoomID, roomB.RoomID, roomA.RoomID},
+					},
+				},
+			},
+		},
+	})
+
+	// room A becomes the most recent room, but the list isn't sorted as it has every room
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, userID, "hello", testutils.WithTimestamp(time.UnixMilli(1632131679000))), 2)
+	_, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	// switching to ranges returns the rooms in order
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:            []string{sync3.SortByRecency},
+			Ranges:          sync3.SliceRanges{{0, 9}},
+			SlowGetAllRooms: &boolFalse,
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 2},
+						RoomIDs:   []string{roomA.RoomID, roomC.RoomID, roomB.RoomID},
+					},
+				},
+			},
+		},
+	})
+
+	// and later updates move rooms relative to the sorted list
+	dispatcher.OnNewEvent(context.Background(), roomB.RoomID, testutils.NewMessageEvent(t, userID, "hello", testutils.WithTimestamp(time.UnixMilli(1632131680000))), 3)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpSingle{
+						Operation: "DELETE",
+						Index:     intPtr(2),
+					},
+					&sync3.ResponseOpSingle{
+						Operation: "INSERT",
+						Index:     intPtr(0),
+						RoomID:    roomB.RoomID,
+					},
+				},
+			},
+		},
+	})
+}
+
+// Test that the server ACL is absent for rooms without one, and that ACL changes are surfaced.
+func TestConnStateServerACL(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateServerACL_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, globalCache := newTestConnState(t, userID, "yep", roomA)
+	globalCache.LoadStateEventsOverride = func(roomIDs []string, loadPosition int64, evType, stateKey string) map[string]json.RawMessage {
+		if evType != "m.room.server_acl" || stateKey != "" {
+			t.Errorf("LoadStateEvents called with unexpected type/state key: %s %s", evType, stateKey)
+		}
+		return nil
+	}
+	boolTrue := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 1,
+				ServerACL:     &boolTrue,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got := res.Rooms[roomA.RoomID].ServerACL; got != nil {
+		t.Fatalf("initial server ACL: got %+v want nil", got)
+	}
+
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewStateEvent(t, "m.room.server_acl", "", userID, map[string]interface{}{
+		"allow":             []string{"*"},
+		"deny":              []string{"evil.example.com"},
+		"allow_ip_literals": false,
+	}), 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	want := &sync3.ServerACL{Allow: []string{"*"}, Deny: []string{"evil.example.com"}, AllowIPLiterals: false}
+	if got := res.Rooms[roomA.RoomID].ServerACL; !reflect.DeepEqual(got, want) {
+		t.Fatalf("live server ACL: got %+v want %+v", got, want)
+	}
+}
+
+// Test that active_since excludes rooms without recent activity, and that they are inserted into
+// the list when they become active.
+func TestConnStateActiveSince(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateActiveSince_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678062))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA, roomB)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges{{0, 9}},
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 1,
+			},
+			Filters: &sync3.RequestFilters{
+				ActiveSince: 1632131678062,
+			},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 1,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 0},
+						RoomIDs:   []string{roomB.RoomID},
+					},
+				},
+			},
+		},
+	})
+
+	// activity in room A means it is now included
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, userID, "hello"), 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 2,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpSingle{
+						Operation: "DELETE",
+						Index:     intPtr(1),
+					},
+					&sync3.ResponseOpSingle{
+						Operation: "INSERT",
+						Index:     intPtr(0),
+						RoomID:    roomA.RoomID,
+					},
+				},
+			},
+		},
+	})
+}
+
+// Test that the initial response for an account with no rooms returns immediately with all lists
+// present and counts of 0, rather than waiting for the timeout.
+func TestConnStateInitialNoRooms(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateInitialNoRooms_alice:localhost"
+	cs, _, _ := newTestConnState(t, userID, "yep")
+	boolTrue := true
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"ranged": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges{{0, 9}},
+			},
+			"all": {
+				Sort:            []string{sync3.SortByRecency},
+				SlowGetAllRooms: &boolTrue,
+			},
+		},
+	}
+	req.SetTimeoutMSecs(5000)
+	start := time.Now()
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, true, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("initial request took %v, it should return immediately", took)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"ranged": {Count: 0},
+			"all":    {Count: 0},
+		},
+	})
+}
+
+// Test that lists with debug: true echo the sort and filters which were applied.
+func TestConnStateListDebug(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateListDebug_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, _, _ := newTestConnState(t, userID, "yep", roomA)
+	boolTrue := true
+	isDM := false
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"defaulted": {
+				Ranges: sync3.SliceRanges{{0, 9}},
+				Filters: &sync3.RequestFilters{
+					IsDM: &isDM,
+				},
+				Debug: &boolTrue,
+			},
+			"invalid": {
+				Ranges: sync3.SliceRanges{{0, 9}},
+				Sort:   []string{sync3.SortByName, "by_unknown"},
+				Debug:  &boolTrue,
+			},
+			"no_debug": {
+				Ranges: sync3.SliceRanges{{0, 9}},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	// a missing sort defaults to recency
+	assertApplied(t, res.Lists["defaulted"].Applied, &sync3.AppliedList{
+		Sort:    []string{sync3.SortByRecency},
+		Filters: &sync3.RequestFilters{IsDM: &isDM},
+	})
+	// an invalid sort is not applied at all
+	assertApplied(t, res.Lists["invalid"].Applied, &sync3.AppliedList{})
+	assertApplied(t, res.Lists["no_debug"].Applied, nil)
+
+	// debug is sticky, and changing the sort is reflected
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"invalid": {
+				Ranges: sync3.SliceRanges{{0, 9}},
+				Sort:   []string{sync3.SortByName},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertApplied(t, res.Lists["invalid"].Applied, &sync3.AppliedList{
+		Sort: []string{sync3.SortByName},
+	})
+}
+
+func assertApplied(t *testing.T, got, want *sync3.AppliedList) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		t.Fatalf("applied: got %s want %s", gotJSON, wantJSON)
+	}
+}
+
+// Test that lists with count_delta: true include the change in count since the previous response.
+func TestConnStateCountDelta(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateCountDelta_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678062))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA, roomB)
+	boolTrue := true
+	assertCount := func(res *sync3.Response, wantCount int, wantDelta *int) {
+		t.Helper()
+		list := res.Lists["a"]
+		if list.Count != wantCount {
+			t.Fatalf("count: got %d want %d", list.Count, wantCount)
+		}
+		if !reflect.DeepEqual(list.CountDelta, wantDelta) {
+			t.Fatalf("count_delta: got %v want %v", list.CountDelta, wantDelta)
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:       []string{sync3.SortByRecency},
+			Ranges:     sync3.SliceRanges{{0, 9}},
+			CountDelta: &boolTrue,
+			Filters: &sync3.RequestFilters{
+				ActiveSince: 1632131678062,
+			},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	// there is nothing to compare against in the first response
+	assertCount(res, 1, nil)
+
+	// room A becomes active so is added to the list
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, userID, "hello"), 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertCount(res, 2, intPtr(1))
+
+	// being kicked from both rooms removes them from the list
+	for _, roomID := range []string{roomA.RoomID, roomB.RoomID} {
+		cs.userCache.OnLeftRoom(context.Background(), roomID, testutils.NewStateEvent(t, "m.room.member", userID, "@mod:localhost", map[string]interface{}{
+			"membership": "leave",
+		}))
+	}
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertCount(res, 0, intPtr(-2))
+}
+
+// Test that num_live only counts live events appended to an initial timeline, and not live events
+// which were already included in the initial snapshot.
+func TestConnStateNumLiveInitialAndLive(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateNumLiveInitialAndLive_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA)
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	var events []json.RawMessage
+	for nid := int64(2); nid <= 4; nid++ {
+		ev := testutils.NewMessageEvent(t, userID, fmt.Sprintf("msg %d", nid))
+		dispatcher.OnNewEvent(context.Background(), roomA.RoomID, ev, nid)
+		events = append(events, ev)
+	}
+	// the initial snapshot includes the first two events, the third is live
+	cs.userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		return map[string]state.LatestEvents{
+			roomA.RoomID: {
+				Timeline:  events[:2],
+				LatestNID: 3,
+			},
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 10,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	room := res.Rooms[roomA.RoomID]
+	if !room.Initial {
+		t.Fatalf("room should be initial")
+	}
+	if !reflect.DeepEqual(room.Timeline, events) {
+		t.Fatalf("timeline: got %s want %s", room.Timeline, events)
+	}
+	if room.NumLive != 1 {
+		t.Fatalf("num_live: got %d want 1", room.NumLive)
+	}
+}
+
+// Test that in quiet mode, messages in group rooms do not wake up the client but mentions do.
+func TestConnStateQuiet(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateQuiet_alice:localhost"
+	bob := "@TestConnStateQuiet_bob:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA)
+	quiet := true
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 10,
+			},
+		},
+		Quiet: &quiet,
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	doRequest := func(timeout time.Duration) (*sync3.Response, time.Duration) {
+		t.Helper()
+		req := &sync3.Request{}
+		req.SetTimeoutMSecs(int(timeout.Milliseconds()))
+		start := time.Now()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res, time.Since(start)
+	}
+
+	// a message which doesn't mention us is not urgent, so we wait for the timeout but still
+	// return it.
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, bob, "hi all"), 2)
+	res, took := doRequest(200 * time.Millisecond)
+	if took < 200*time.Millisecond {
+		t.Fatalf("non-urgent message woke the client after %v", took)
+	}
+	if len(res.Rooms[roomA.RoomID].Timeline) != 1 {
+		t.Fatalf("non-urgent message was not returned on timeout: %+v", res.Rooms)
+	}
+
+	// a mention is urgent
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, bob, "hi alice"), 3)
+	highlightCount := 1
+	cs.userCache.OnUnreadCounts(context.Background(), roomA.RoomID, &highlightCount, &highlightCount)
+	res, took = doRequest(5 * time.Second)
+	if took > time.Second {
+		t.Fatalf("mention did not wake the client, took %v", took)
+	}
+	if res.Rooms[roomA.RoomID].HighlightCount != 1 {
+		t.Fatalf("highlight_count: got %d want 1", res.Rooms[roomA.RoomID].HighlightCount)
+	}
+}
+
+// Test that widgets are returned initially, and that adding and removing widgets returns the
+// updated list.
+func TestConnStateWidgets(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateWidgets_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, globalCache := newTestConnState(t, userID, "yep", roomA)
+	newWidget := func(evType, id, url string) json.RawMessage {
+		content := map[string]interface{}{}
+		if url != "" {
+			content = map[string]interface{}{"type": "custom", "url": url}
+		}
+		return testutils.NewStateEvent(t, evType, id, userID, content)
+	}
+	legacy := newWidget("im.vector.modular.widgets", "legacy", "https://legacy.example.com")
+	added := newWidget("m.widget", "added", "https://added.example.com")
+	removed := newWidget("im.vector.modular.widgets", "legacy", "")
+	// load position -> widget state
+	stateAtPos := map[int64][]json.RawMessage{
+		1: {legacy},
+		2: {legacy, added},
+		3: {removed, added},
+	}
+	globalCache.LoadStateEventsOfTypesOverride = func(roomIDs []string, loadPosition int64, evTypes []string) map[string][]json.RawMessage {
+		if !reflect.DeepEqual(evTypes, sync3.WidgetEventTypes) {
+			t.Errorf("LoadStateEventsOfTypes called with unexpected types: %v", evTypes)
+		}
+		return map[string][]json.RawMessage{
+			roomA.RoomID: stateAtPos[loadPosition],
+		}
+	}
+	assertWidgets := func(res *sync3.Response, wantURLs ...string) {
+		t.Helper()
+		widgets := res.Rooms[roomA.RoomID].Widgets
+		if widgets == nil {
+			t.Fatalf("widgets were not returned")
+		}
+		gotURLs := []string{}
+		for _, w := range *widgets {
+			gotURLs = append(gotURLs, w.URL)
+		}
+		if !reflect.DeepEqual(gotURLs, append([]string{}, wantURLs...)) {
+			t.Fatalf("widgets: got %v want %v", gotURLs, wantURLs)
+		}
+	}
+	boolTrue := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 1,
+				Widgets:       &boolTrue,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertWidgets(res, "https://legacy.example.com")
+
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, added, 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertWidgets(res, "https://added.example.com", "https://legacy.example.com")
+
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, removed, 3)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertWidgets(res, "https://added.example.com")
+
+	// other state events do not return widgets
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{
+		"name": "renamed",
+	}), 4)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if widgets := res.Rooms[roomA.RoomID].Widgets; widgets != nil {
+		t.Fatalf("widgets returned for a non-widget event: %+v", *widgets)
+	}
+}
+
+func TestConnStateMemberQuery(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMemberQuery_alice:localhost"
+	bob := "@TestConnStateMemberQuery_bob:localhost"
+	charlie := "@TestConnStateMemberQuery_charlie:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, globalCache := newTestConnState(t, userID, "yep", roomA)
+	aliceJoin := testutils.NewJoinEvent(t, userID)
+	bobJoin := testutils.NewJoinEvent(t, bob)
+	charlieJoin := testutils.NewJoinEvent(t, charlie)
+	powerLevels := testutils.NewStateEvent(t, "m.room.power_levels", "", userID, map[string]interface{}{
+		"users": map[string]interface{}{bob: 50},
+	})
+	// load position -> member state
+	stateAtPos := map[int64][]json.RawMessage{
+		1: {aliceJoin},
+		2: {aliceJoin, bobJoin},
+		3: {aliceJoin, bobJoin, charlieJoin},
+		4: {aliceJoin, bobJoin, charlieJoin},
+	}
+	globalCache.LoadMembersOverride = func(roomIDs []string, loadPosition int64, userIDs []string) map[string][]json.RawMessage {
+		var members []json.RawMessage
+		for _, ev := range stateAtPos[loadPosition] {
+			for _, u := range userIDs {
+				if gjson.GetBytes(ev, "state_key").Str == u {
+					members = append(members, ev)
+				}
+			}
+		}
+		return map[string][]json.RawMessage{
+			roomA.RoomID: members,
+		}
+	}
+	globalCache.LoadStateEventsOverride = func(roomIDs []string, loadPosition int64, evType, stateKey string) map[string]json.RawMessage {
+		if evType != "m.room.power_levels" || loadPosition < 4 {
+			return nil
+		}
+		return map[string]json.RawMessage{
+			roomA.RoomID: powerLevels,
+		}
+	}
+	assertMembers := func(res *sync3.Response, want []sync3.Member) {
+		t.Helper()
+		got := res.Rooms[roomA.RoomID].Members
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("members: got %+v want %+v", got, want)
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 1,
+				MemberQuery:   []string{userID, bob},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	// bob has no membership event, so is not returned
+	assertMembers(res, []sync3.Member{
+		{UserID: userID, Membership: "join"},
+	})
+
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, bobJoin, 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertMembers(res, []sync3.Member{
+		{UserID: userID, Membership: "join"},
+		{UserID: bob, Membership: "join"},
+	})
+
+	// members which were not queried do not return members
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, charlieJoin, 3)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertMembers(res, nil)
+
+	// power level changes return members
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, powerLevels, 4)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertMembers(res, []sync3.Member{
+		{UserID: userID, Membership: "join"},
+		{UserID: bob, Membership: "join", PowerLevel: 50},
+	})
+}
+
+func TestConnStateEmbedSenderProfile(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateEmbedSenderProfile_alice:localhost"
+	bob := "@TestConnStateEmbedSenderProfile_bob:localhost"
+	charlie := "@TestConnStateEmbedSenderProfile_charlie:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, globalCache := newTestConnState(t, userID, "yep", roomA)
+	bobJoin := testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{
+		"membership":  "join",
+		"displayname": "Bob",
+	})
+	globalCache.LoadMembersOverride = func(roomIDs []string, loadPosition int64, userIDs []string) map[string][]json.RawMessage {
+		// charlie has no membership
+		if len(userIDs) != 1 || userIDs[0] != bob {
+			return nil
+		}
+		return map[string][]json.RawMessage{
+			roomA.RoomID: {bobJoin},
+		}
+	}
+	boolTrue := true
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 1,
+				SenderProfile: &boolTrue,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, bob, "hello"), 2)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, charlie, "hi"), 3)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	timeline := res.Rooms[roomA.RoomID].Timeline
+	if len(timeline) != 2 {
+		t.Fatalf("got %d timeline events, want 2", len(timeline))
+	}
+	profilePath := `unsigned.org\.matrix\.sliding_sync\.sender_profile`
+	if got := gjson.GetBytes(timeline[0], profilePath+".displayname").Str; got != "Bob" {
+		t.Errorf("got bob's displayname %q want Bob", got)
+	}
+	if profile := gjson.GetBytes(timeline[1], profilePath); profile.Exists() {
+		t.Errorf("got profile %s for charlie who has no membership", profile.Raw)
+	}
+}
+
+func TestConnStateDirectoryVisibility(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateDirectoryVisibility_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678062))
+	roomC := newRoomMetadata("!c:localhost", spec.Timestamp(1632131678063))
+	cs, _, globalCache := newTestConnState(t, userID, "yep", roomA, roomB, roomC)
+	globalCache.LoadDirectoryVisibilityOverride = func(roomIDs []string) map[string]string {
+		// the lookup for room B failed
+		return map[string]string{
+			roomA.RoomID: caches.DirectoryVisibilityPublic,
+			roomB.RoomID: caches.DirectoryVisibilityUnknown,
+		}
+	}
+	boolTrue := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit:       1,
+				DirectoryVisibility: &boolTrue,
+			},
+			roomB.RoomID: {
+				TimelineLimit:       1,
+				DirectoryVisibility: &boolTrue,
+			},
+			roomC.RoomID: {
+				TimelineLimit: 1,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	for roomID, want := range map[string]string{
+		roomA.RoomID: caches.DirectoryVisibilityPublic,
+		roomB.RoomID: caches.DirectoryVisibilityUnknown,
+		roomC.RoomID: "", // not asked for
+	} {
+		if got := res.Rooms[roomID].DirectoryVisibility; got != want {
+			t.Errorf("room %s: got directory visibility %q want %q", roomID, got, want)
+		}
+	}
+}
+
+func TestConnStateRedactUndeliveredEvents(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateRedactUndeliveredEvents_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, globalCache := newTestConnState(t, userID, "yep", roomA)
+	msg := testutils.NewMessageEvent(t, userID, "oops")
+	msgID := gjson.GetBytes(msg, "event_id").Str
+	redactedMsg := json.RawMessage(fmt.Sprintf(
+		`{"type":"m.room.message","event_id":"%s","sender":"%s","room_id":"%s","content":{},"unsigned":{"redacted_because":{}}}`,
+		msgID, userID, roomA.RoomID,
+	))
+	var loadedEventIDs []string
+	globalCache.LoadEventsOverride = func(roomID string, eventIDs []string) map[string]json.RawMessage {
+		loadedEventIDs = append(loadedEventIDs, eventIDs...)
+		return map[string]json.RawMessage{
+			msgID: redactedMsg,
+		}
+	}
+	// the redacted event is annotated like any other live event
+	member := testutils.NewStateEvent(t, "m.room.member", userID, userID, map[string]interface{}{"membership": "join", "displayname": "Alice"})
+	globalCache.LoadMembersOverride = func(roomIDs []string, loadPosition int64, userIDs []string) map[string][]json.RawMessage {
+		return map[string][]json.RawMessage{roomA.RoomID: {member}}
+	}
+	withProfile := func(ev json.RawMessage) json.RawMessage {
+		return sync3.EmbedSenderProfiles([]json.RawMessage{ev}, []json.RawMessage{member})[0]
+	}
+	newRedaction := func(redacts string) json.RawMessage {
+		return testutils.NewEvent(t, "m.room.redaction", userID, map[string]interface{}{"redacts": redacts})
+	}
+	boolTrue := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 10,
+				SenderProfile: &boolTrue,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	// the event and its redaction arrive before the next response: the redacted form is sent
+	redaction := newRedaction(msgID)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, msg, 2)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, redaction, 3)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, false, res, &sync3.Response{
+		Rooms: map[string]sync3.Room{
+			roomA.RoomID: {
+				Timeline: []json.RawMessage{withProfile(redactedMsg), withProfile(redaction)},
+				NumLive:  2,
+			},
+		},
+	})
+
+	// the event was sent in a previous response: the client is just sent the redaction
+	msg2 := testutils.NewMessageEvent(t, userID, "oops again")
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, msg2, 4)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	redaction2 := newRedaction(gjson.GetBytes(msg2, "event_id").Str)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, redaction2, 5)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, false, res, &sync3.Response{
+		Rooms: map[string]sync3.Room{
+			roomA.RoomID: {
+				Timeline: []json.RawMessage{withProfile(redaction2)},
+				NumLive:  1,
+			},
+		},
+	})
+	if len(loadedEventIDs) != 1 {
+		t.Fatalf("loaded events %v, want only the undelivered event %s", loadedEventIDs, msgID)
+	}
+}
+
+// Test that when the response exceeds max_response_bytes, rooms in lower priority lists are
+// trimmed first and sent on later requests, while list counts are always sent.
+func TestConnStateMaxResponseBytes(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMaxResponseBytes_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678064))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678063))
+	roomC := newRoomMetadata("!c:localhost", spec.Timestamp(1632131678062))
+	roomD := newRoomMetadata("!d:localhost", spec.Timestamp(1632131678061))
+	cs, _, _ := newTestConnState(t, userID, "yep", roomA, roomB, roomC, roomD)
+	oneByte := 1
+	noLimit := 0
+	highPriority := 1
+	assertResponse := func(res *sync3.Response, wantRooms, wantTrimmed []string) {
+		t.Helper()
+		for _, listKey := range []string{"a", "b"} {
+			if res.Lists[listKey].Count != 4 {
+				t.Fatalf("list %s: got count %d want 4", listKey, res.Lists[listKey].Count)
+			}
+		}
+		if len(res.Rooms) != len(wantRooms) {
+			t.Fatalf("got rooms %v want %v", internal.Keys(res.Rooms), wantRooms)
+		}
+		for _, roomID := range wantRooms {
+			if _, ok := res.Rooms[roomID]; !ok {
+				t.Fatalf("got rooms %v want %v", internal.Keys(res.Rooms), wantRooms)
+			}
+		}
+		if !reflect.DeepEqual(res.TrimmedRooms, wantTrimmed) {
+			t.Fatalf("got trimmed rooms %v want %v", res.TrimmedRooms, wantTrimmed)
+		}
+		for roomID, room := range res.Rooms {
+			if !room.Initial {
+				t.Fatalf("room %s was not sent in full", roomID)
+			}
+		}
+	}
+
+	// list b has the higher priority despite sorting after list a, so its room C is kept and the
+	// rest are trimmed from the end of list a.
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		MaxResponseBytes: &oneByte,
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges{{0, 1}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			},
+			"b": {
+				Sort:     []string{sync3.SortByRecency},
+				Ranges:   sync3.SliceRanges{{2, 3}},
+				Priority: &highPriority,
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertResponse(res, []string{roomC.RoomID}, []string{roomA.RoomID, roomB.RoomID, roomD.RoomID})
+
+	// trimmed rooms are resent one at a time while the limit applies
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertResponse(res, []string{roomD.RoomID}, []string{roomA.RoomID, roomB.RoomID})
+
+	// room subscriptions are never trimmed
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomB.RoomID: {TimelineLimit: 1},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertResponse(res, []string{roomB.RoomID}, []string{roomA.RoomID})
+
+	// removing the limit sends the rest
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		MaxResponseBytes: &noLimit,
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertResponse(res, []string{roomA.RoomID}, nil)
+}
+
+// staleRoomUpdate is a room update carrying an old snapshot of the room, as happens when updates are
+// buffered before the connection loads.
+type staleRoomUpdate struct {
+	metadata internal.RoomMetadata
+}
+
+func (u *staleRoomUpdate) Type() string {
+	return "staleRoomUpdate"
+}
+func (u *staleRoomUpdate) RoomID() string {
+	return u.metadata.RoomID
+}
+func (u *staleRoomUpdate) GlobalRoomMetadata() *internal.RoomMetadata {
+	return &u.metadata
+}
+func (u *staleRoomUpdate) UserRoomMetadata() *caches.UserRoomData {
+	return &caches.UserRoomData{}
+}
+
+// Test that back-to-back responses for a list whose order has not changed contain no ops, even
+// when updates carry an older snapshot of the room than the connection has seen.
+func TestConnStateNoSpuriousReorderOps(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateNoSpuriousReorderOps_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678063))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678062))
+	roomC := newRoomMetadata("!c:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA, roomB, roomC)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges{{0, 9}},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 2},
+						RoomIDs:   []string{roomA.RoomID, roomB.RoomID, roomC.RoomID},
+					},
+				},
+			},
+		},
+	})
+	sync := func() *sync3.Response {
+		t.Helper()
+		req := &sync3.Request{}
+		req.SetTimeoutMSecs(100)
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+	assertNoOps := func(res *sync3.Response) {
+		t.Helper()
+		if ops := res.Lists["a"].Ops; len(ops) != 0 {
+			t.Fatalf("got ops %v want none", ops)
+		}
+		if count := res.Lists["a"].Count; count != 3 {
+			t.Fatalf("got count %d want 3", count)
+		}
+	}
+
+	// an unread count update for room A with a snapshot from before room A's latest event
+	staleA := roomA
+	staleA.LastMessageTimestamp = roomC.LastMessageTimestamp - 1
+	cs.OnUpdate(context.Background(), &caches.UnreadCountUpdate{
+		RoomUpdate: &staleRoomUpdate{metadata: staleA},
+	})
+	assertNoOps(sync())
+
+	// a new event in the room at the top of the list does not reorder it either
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, userID, "hello"), 2)
+	assertNoOps(sync())
+}
+
+// Test that large rooms only return lazy loaded members when all members are requested.
+func TestConnStateLargeRoomMembers(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateLargeRoomMembers_alice:localhost"
+	bob := "@TestConnStateLargeRoomMembers_bob:localhost"
+	charlie := "@TestConnStateLargeRoomMembers_charlie:localhost"
+	largeRoom := newRoomMetadata("!large:localhost", spec.Timestamp(1632131678061))
+	largeRoom.JoinCount = caches.DefaultLargeRoomThreshold + 1
+	smallRoom := newRoomMetadata("!small:localhost", spec.Timestamp(1632131678062))
+	cs, _, globalCache := newTestConnState(t, userID, "yep", largeRoom, smallRoom)
+	bobMessage := testutils.NewMessageEvent(t, bob, "hello")
+	cs.userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		result := make(map[string]state.LatestEvents)
+		for _, roomID := range roomIDs {
+			result[roomID] = state.LatestEvents{
+				Timeline: []json.RawMessage{bobMessage},
+			}
+		}
+		return result
+	}
+	bobJoin := testutils.NewJoinEvent(t, bob)
+	charlieJoin := testutils.NewJoinEvent(t, charlie)
+	var loadedRooms, loadedUsers []string
+	globalCache.LoadMembersOverride = func(roomIDs []string, loadPosition int64, userIDs []string) map[string][]json.RawMessage {
+		loadedRooms = append(loadedRooms, roomIDs...)
+		loadedUsers = append(loadedUsers, userIDs...)
+		// charlie was not asked for so should not be returned
+		return map[string][]json.RawMessage{
+			largeRoom.RoomID: {bobJoin, charlieJoin},
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			largeRoom.RoomID: {
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.member", "*"}},
+			},
+			smallRoom.RoomID: {
+				TimelineLimit: 1,
+				RequiredState: [][2]string{{"m.room.member", "*"}},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if len(loadedRooms) != 1 || loadedRooms[0] != largeRoom.RoomID {
+		t.Errorf("loaded members for rooms %v, want only %s", loadedRooms, largeRoom.RoomID)
+	}
+	if len(loadedUsers) != 1 || loadedUsers[0] != bob {
+		t.Errorf("loaded members %v, want only %s", loadedUsers, bob)
+	}
+	room := res.Rooms[largeRoom.RoomID]
+	if !room.LargeRoom {
+		t.Errorf("large room does not have large_room set")
+	}
+	if room.JoinedCount != caches.DefaultLargeRoomThreshold {
+		t.Errorf("got joined count %d want %d", room.JoinedCount, caches.DefaultLargeRoomThreshold)
+	}
+	if len(room.RequiredState) != 1 || string(room.RequiredState[0]) != string(bobJoin) {
+		t.Errorf("got required_state %v want only bob's join", room.RequiredState)
+	}
+	if res.Rooms[smallRoom.RoomID].LargeRoom {
+		t.Errorf("small room has large_room set")
+	}
+}
+
+func TestConnStateNotificationLevel(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := pushRulesUserID
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678062))
+	cs, _, _ := newTestConnState(t, userID, "yep", roomA, roomB)
+	setPushRules := func(content json.RawMessage) {
+		cs.userCache.OnAccountData(context.Background(), []state.AccountData{{
+			UserID: userID,
+			RoomID: state.AccountDataGlobalRoom,
+			Type:   "m.push_rules",
+			Data:   json.RawMessage(`{"type":"m.push_rules","content":` + string(content) + `}`),
+		}})
+	}
+	setPushRules(defaultPushRules("", roomRule(roomB.RoomID, `["dont_notify"]`)))
+	boolTrue := true
+	req := &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit:     1,
+				NotificationLevel: &boolTrue,
+			},
+			roomB.RoomID: {
+				TimelineLimit:     1,
+				NotificationLevel: &boolTrue,
+			},
+		},
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got := res.Rooms[roomA.RoomID].NotificationLevel; got != sync3.NotificationLevelAll {
+		t.Errorf("room A: got notification level %q want %q", got, sync3.NotificationLevelAll)
+	}
+	if got := res.Rooms[roomB.RoomID].NotificationLevel; got != sync3.NotificationLevelMentionsOnly {
+		t.Errorf("room B: got notification level %q want %q", got, sync3.NotificationLevelMentionsOnly)
+	}
+
+	// muting room A sends the new level for only that room
+	setPushRules(defaultPushRules(muteRule(roomA.RoomID), roomRule(roomB.RoomID, `["dont_notify"]`)))
+	req = &sync3.Request{}
+	req.SetTimeoutMSecs(100)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if got := res.Rooms[roomA.RoomID].NotificationLevel; got != sync3.NotificationLevelMute {
+		t.Errorf("room A: got notification level %q want %q", got, sync3.NotificationLevelMute)
+	}
+	if _, ok := res.Rooms[roomB.RoomID]; ok {
+		t.Errorf("room B was sent but its notification level did not change: %+v", res.Rooms[roomB.RoomID])
+	}
+}
+
+func TestConnStateCoalesceSyncOps(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateCoalesceSyncOps_alice:localhost"
+	var rooms []internal.RoomMetadata
+	var roomIDs []string
+	for i := 0; i < 6; i++ {
+		room := newRoomMetadata(fmt.Sprintf("!%d:localhost", i), spec.Timestamp(1632131678061-i*1000))
+		rooms = append(rooms, room)
+		roomIDs = append(roomIDs, room.RoomID)
+	}
+	cs, _, _ := newTestConnState(t, userID, "yep", rooms...)
+	boolTrue := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"coalesced": {
+				Sort:            []string{sync3.SortByRecency},
+				Ranges:          sync3.SliceRanges{{0, 1}, {2, 3}, {5, 5}},
+				CoalesceSyncOps: &boolTrue,
+			},
+			"granular": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges{{0, 1}, {2, 3}, {5, 5}},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"coalesced": {
+				Count: len(rooms),
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: sync3.OpSync,
+						Range:     [2]int64{0, 3},
+						RoomIDs:   roomIDs[:4],
+					},
+					&sync3.ResponseOpRange{
+						Operation: sync3.OpSync,
+						Range:     [2]int64{5, 5},
+						RoomIDs:   roomIDs[5:],
+					},
+				},
+			},
+			"granular": {
+				Count: len(rooms),
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: sync3.OpSync,
+						Range:     [2]int64{0, 1},
+						RoomIDs:   roomIDs[:2],
+					},
+					&sync3.ResponseOpRange{
+						Operation: sync3.OpSync,
+						Range:     [2]int64{2, 3},
+						RoomIDs:   roomIDs[2:4],
+					},
+					&sync3.ResponseOpRange{
+						Operation: sync3.OpSync,
+						Range:     [2]int64{5, 5},
+						RoomIDs:   roomIDs[5:],
+					},
+				},
+			},
+		},
+	})
+}
+
+func TestConnStateAnnotateMentions(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateAnnotateMentions_alice:localhost"
+	bob := "@TestConnStateAnnotateMentions_bob:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA)
+	boolTrue := true
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 1,
+				Mentions:      &boolTrue,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{
+		"msgtype":    "m.text",
+		"body":       "hi alice",
+		"m.mentions": map[string]interface{}{"user_ids": []string{userID}},
+	}), 2)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{
+		"msgtype":    "m.text",
+		"body":       "hi everyone",
+		"m.mentions": map[string]interface{}{"room": true},
+	}), 3)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, bob, "hi"), 4)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	timeline := res.Rooms[roomA.RoomID].Timeline
+	if len(timeline) != 3 {
+		t.Fatalf("got %d timeline events, want 3", len(timeline))
+	}
+	mentionsPath := `unsigned.org\.matrix\.sliding_sync\.mentions`
+	want := []string{`{"user":true}`, `{"room":true}`, ``}
+	for i := range want {
+		if got := gjson.GetBytes(timeline[i], mentionsPath).Raw; got != want[i] {
+			t.Errorf("event %d: got mentions %s want %s", i, got, want[i])
+		}
+	}
+}
+
+// Test that count-only updates for accounts in many rooms are batched into one response, but that
+// count changes which add highlights are returned immediately.
+func TestConnStateCountUpdateThrottle(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateCountUpdateThrottle_alice:localhost"
+	var rooms []internal.RoomMetadata
+	for i := 0; i < 10; i++ {
+		rooms = append(rooms, newRoomMetadata(fmt.Sprintf("!%d:localhost", i), spec.Timestamp(1632131678061-i*1000)))
+	}
+	newConn := func(minRooms int) *ConnState {
+		cs, _, _ := newTestConnState(t, userID, "yep", rooms...)
+		cs.live.countUpdateThrottle = 500 * time.Millisecond
+		cs.live.countUpdateThrottleMinRooms = minRooms
+		_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges{{0, int64(len(rooms) - 1)}},
+			}},
+		}, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return cs
+	}
+	sync := func(cs *ConnState) (*sync3.Response, time.Duration) {
+		t.Helper()
+		req := &sync3.Request{}
+		req.SetTimeoutMSecs(2000)
+		start := time.Now()
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res, time.Since(start)
+	}
+	intPtr := func(i int) *int {
+		return &i
+	}
+
+	// count changes across many rooms are batched into a single response
+	cs := newConn(len(rooms))
+	numUpdates := 6
+	go func() {
+		for i := 0; i < numUpdates; i++ {
+			time.Sleep(20 * time.Millisecond)
+			cs.userCache.OnUnreadCounts(context.Background(), rooms[i].RoomID, intPtr(0), intPtr(i+1))
+		}
+	}()
+	res, took := sync(cs)
+	if len(res.Rooms) != numUpdates {
+		t.Errorf("got %d rooms in the response, want all %d count changes batched", len(res.Rooms), numUpdates)
+	}
+	if took < cs.live.countUpdateThrottle {
+		t.Errorf("count updates were returned after %v, before the throttle window", took)
+	}
+	for i := 0; i < numUpdates; i++ {
+		if got := res.Rooms[rooms[i].RoomID].NotificationCount; got != int64(i+1) {
+			t.Errorf("room %d: got notification count %d want %d", i, got, i+1)
+		}
+	}
+
+	// a mention is returned immediately, along with any held counts
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cs.userCache.OnUnreadCounts(context.Background(), rooms[7].RoomID, intPtr(0), intPtr(1))
+		time.Sleep(20 * time.Millisecond)
+		cs.userCache.OnUnreadCounts(context.Background(), rooms[8].RoomID, intPtr(1), intPtr(1))
+	}()
+	res, took = sync(cs)
+	if took >= cs.live.countUpdateThrottle {
+		t.Errorf("mention was returned after %v, want it returned immediately", took)
+	}
+	if got := res.Rooms[rooms[8].RoomID].HighlightCount; got != 1 {
+		t.Errorf("got highlight count %d want 1", got)
+	}
+	if got := res.Rooms[rooms[7].RoomID].NotificationCount; got != 1 {
+		t.Errorf("held count was not returned with the mention: got notification count %d want 1", got)
+	}
+
+	// accounts in fewer rooms are not throttled
+	cs = newConn(len(rooms) + 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cs.userCache.OnUnreadCounts(context.Background(), rooms[0].RoomID, intPtr(0), intPtr(1))
+	}()
+	res, took = sync(cs)
+	if took >= cs.live.countUpdateThrottle {
+		t.Errorf("count update was returned after %v, want it returned immediately", took)
+	}
+	if got := res.Rooms[rooms[0].RoomID].NotificationCount; got != 1 {
+		t.Errorf("got notification count %d want 1", got)
+	}
+}
+
+// Test that guests are only sent rooms which allow guest access, and that rooms are removed when
+// their guest access is revoked.
+func TestConnStateGuestAccess(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateGuestAccess_alice:localhost"
+	bob := "@TestConnStateGuestAccess_bob:localhost"
+	guestRoom := newRoomMetadata("!guest:localhost", spec.Timestamp(1632131678061))
+	guestRoom.GuestAccess = true
+	privateRoom := newRoomMetadata("!private:localhost", spec.Timestamp(1632131678062))
+	newRequest := func() *sync3.Request {
+		return &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges{{0, 9}},
+				RoomSubscription: sync3.RoomSubscription{
+					TimelineLimit: 1,
+				},
+			}},
+			RoomSubscriptions: map[string]sync3.RoomSubscription{
+				privateRoom.RoomID: {TimelineLimit: 1},
+			},
+		}
+	}
+
+	// non-guests see every room
+	cs, _, _ := newTestConnState(t, userID, "yep", guestRoom, privateRoom)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, newRequest(), false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.Lists["a"].Count != 2 || len(res.Rooms) != 2 {
+		t.Fatalf("non-guest got count %d and %d rooms, want 2 and 2", res.Lists["a"].Count, len(res.Rooms))
+	}
+
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", guestRoom, privateRoom)
+	cs.isGuest = true
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, newRequest(), false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.Lists["a"].Count != 1 {
+		t.Fatalf("guest got count %d want 1", res.Lists["a"].Count)
+	}
+	if _, exists := res.Rooms[guestRoom.RoomID]; !exists || len(res.Rooms) != 1 {
+		t.Fatalf("guest got rooms %v, want only %s", internal.Keys(res.Rooms), guestRoom.RoomID)
+	}
+
+	// live events in the private room are not sent
+	dispatcher.OnNewEvent(context.Background(), privateRoom.RoomID, testutils.NewMessageEvent(t, bob, "secret"), 2)
+	req := newRequest()
+	req.SetTimeoutMSecs(100)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if _, exists := res.Rooms[privateRoom.RoomID]; exists {
+		t.Fatalf("guest was sent live event in room without guest access: %+v", res.Rooms[privateRoom.RoomID])
+	}
+
+	// revoking guest access removes the room
+	dispatcher.OnNewEvent(context.Background(), guestRoom.RoomID, testutils.NewStateEvent(t, "m.room.guest_access", "", bob, map[string]interface{}{
+		"guest_access": "forbidden",
+	}), 3)
+	req = newRequest()
+	req.SetTimeoutMSecs(100)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.Lists["a"].Count != 0 {
+		t.Fatalf("guest got count %d after guest access was revoked, want 0", res.Lists["a"].Count)
+	}
+	if len(res.Lists["a"].Ops) != 1 || res.Lists["a"].Ops[0].Op() != sync3.OpDelete {
+		t.Fatalf("guest got ops %s after guest access was revoked, want a DELETE", serialise(t, res.Lists["a"]))
+	}
+	if _, exists := res.Rooms[guestRoom.RoomID]; exists {
+		t.Fatalf("guest was sent room after guest access was revoked: %+v", res.Rooms[guestRoom.RoomID])
+	}
+}
+
+// Test that include_indexes returns the index in the full sorted list of every room in the ops,
+// including after live updates move rooms around outside of the window.
+func TestConnStateIncludeIndexes(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateIncludeIndexes_alice:localhost"
+	timestampNow := spec.Timestamp(1632131678061)
+	var rooms []internal.RoomMetadata
+	for i := 0; i < 10; i++ {
+		// room 0 is the most recent
+		rooms = append(rooms, newRoomMetadata(fmt.Sprintf("!%d:localhost", i), timestampNow-spec.Timestamp(i*1000)))
+	}
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", rooms...)
+	boolTrue := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:    []string{sync3.SortByRecency},
+			Ranges:  sync3.SliceRanges{{0, 2}, {5, 6}},
+			Indexes: &boolTrue,
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	// the indexes agree with the positions in the SYNC ops
+	list := res.Lists["a"]
+	want := map[string]int{}
+	for _, op := range list.Ops {
+		rangeOp := op.(*sync3.ResponseOpRange)
+		for i, roomID := range rangeOp.RoomIDs {
+			want[roomID] = int(rangeOp.Range[0]) + i
+		}
+	}
+	if len(want) != 5 || !reflect.DeepEqual(list.Indexes, want) {
+		t.Fatalf("got indexes %v want %v", list.Indexes, want)
+	}
+
+	// bump room 8 to the top: it is inserted at 0, and the indexes are within the full list
+	dispatcher.OnNewEvent(context.Background(), rooms[8].RoomID, testutils.NewEvent(
+		t, "unimportant", "me", struct{}{}, testutils.WithTimestamp(timestampNow.Time().Add(time.Second)),
+	), 2)
+	req := &sync3.Request{}
+	req.SetTimeoutMSecs(100)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	list = res.Lists["a"]
+	for roomID, i := range list.Indexes {
+		if i < 0 || i >= list.Count {
+			t.Errorf("room %s has index %d outside the list of %d rooms", roomID, i, list.Count)
+		}
+	}
+	var insertedIndex *int
+	for _, op := range list.Ops {
+		if single, ok := op.(*sync3.ResponseOpSingle); ok && single.Operation == sync3.OpInsert && single.RoomID == rooms[8].RoomID {
+			insertedIndex = single.Index
+		}
+	}
+	if insertedIndex == nil {
+		t.Fatalf("no INSERT for %s in ops %s", rooms[8].RoomID, serialise(t, list))
+	}
+	if got, ok := list.Indexes[rooms[8].RoomID]; !ok || got != *insertedIndex || got != 0 {
+		t.Fatalf("got index %d (exists=%v) for %s, want %d", got, ok, rooms[8].RoomID, *insertedIndex)
+	}
+	// rooms which only shifted are not in the ops so have no index
+	if len(list.Indexes) != len(opRoomIDs(list.Ops)) {
+		t.Fatalf("got indexes %v for ops %s", list.Indexes, serialise(t, list))
+	}
+
+	// indexes are not sent when they are not requested
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Ranges:  sync3.SliceRanges{{0, 3}},
+			Indexes: new(bool),
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.Lists["a"].Indexes != nil {
+		t.Fatalf("got indexes %v when they were not requested", res.Lists["a"].Indexes)
+	}
+}
+
+func opRoomIDs(ops []sync3.ResponseOp) map[string]struct{} {
+	roomIDs := make(map[string]struct{})
+	for _, op := range ops {
+		for _, roomID := range op.IncludedRoomIDs() {
+			roomIDs[roomID] = struct{}{}
+		}
+	}
+	return roomIDs
+}
+
+// Test that encrypted timeline events have their cleartext metadata embedded when requested.
+func TestConnStateEncryptedMetadata(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateEncryptedMetadata_alice:localhost"
+	bob := "@TestConnStateEncryptedMetadata_bob:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, _ := newTestConnState(t, userID, "yep", roomA)
+	boolTrue := true
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit:     1,
+				EncryptedMetadata: &boolTrue,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewEvent(t, "m.room.encrypted", bob, map[string]interface{}{
+		"algorithm":  "m.megolm.v1.aes-sha2",
+		"ciphertext": "AwgAEnAC",
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.thread",
+			"event_id": "$root",
+		},
+	}), 2)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewMessageEvent(t, bob, "hi"), 3)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	timeline := res.Rooms[roomA.RoomID].Timeline
+	if len(timeline) != 2 {
+		t.Fatalf("got %d timeline events, want 2", len(timeline))
+	}
+	metadataPath := `unsigned.org\.matrix\.sliding_sync\.encrypted_metadata`
+	metadata := gjson.GetBytes(timeline[0], metadataPath)
+	if metadata.Get("sender").Str != bob || metadata.Get("rel_type").Str != "m.thread" || metadata.Get("relates_to").Str != "$root" {
+		t.Errorf("got encrypted metadata %s", metadata.Raw)
+	}
+	if gjson.GetBytes(timeline[1], metadataPath).Exists() {
+		t.Errorf("unencrypted event has encrypted metadata: %s", string(timeline[1]))
+	}
+}
+
+// Test that include_name_content returns the content of the name event with custom fields, both
+// initially and when the name changes.
+func TestConnStateNameContent(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateNameContent_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, globalCache := newTestConnState(t, userID, "yep", roomA)
+	globalCache.LoadStateEventsOverride = func(roomIDs []string, loadPosition int64, evType, stateKey string) map[string]json.RawMessage {
+		if evType != "m.room.name" || stateKey != "" {
+			t.Errorf("LoadStateEvents called with unexpected type/state key: %s %s", evType, stateKey)
+		}
+		return map[string]json.RawMessage{
+			roomA.RoomID: testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{
+				"name":                  "Room",
+				"org.example.localised": map[string]string{"de": "Raum"},
+			}),
+		}
+	}
+	boolTrue := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 1,
+				NameContent:   &boolTrue,
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	nameContent := gjson.ParseBytes(res.Rooms[roomA.RoomID].NameContent)
+	if nameContent.Get("name").Str != "Room" || nameContent.Get(`org\.example\.localised.de`).Str != "Raum" {
+		t.Fatalf("initial name content: got %s", nameContent.Raw)
+	}
+
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewStateEvent(t, "m.room.name", "", userID, map[string]interface{}{
+		"name":                  "New Room",
+		"org.example.localised": map[string]string{"de": "Neuer Raum"},
+	}), 2)
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	nameContent = gjson.ParseBytes(res.Rooms[roomA.RoomID].NameContent)
+	if nameContent.Get("name").Str != "New Room" || nameContent.Get(`org\.example\.localised.de`).Str != "Neuer Raum" {
+		t.Fatalf("live name content: got %s", nameContent.Raw)
+	}
+}
+
+// Test that rooms which want required_state_delta are only sent the state events which changed
+// since the room was last sent on the connection.
+func TestConnStateRequiredStateDelta(t *testing.T) {
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	boolTrue := true
+	cs := &ConnState{
+		muxedReq: &sync3.Request{},
+		lists:    sync3.NewInternalRequestLists(),
+		roomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA: {RequiredStateDelta: &boolTrue},
+			roomB: {},
+		},
+	}
+	cs.live = &connStateLive{ConnState: cs}
+	name := testutils.NewStateEvent(t, "m.room.name", "", "@alice:localhost", map[string]interface{}{"name": "A"})
+	topic := testutils.NewStateEvent(t, "m.room.topic", "", "@alice:localhost", map[string]interface{}{"topic": "A"})
+	newTopic := testutils.NewStateEvent(t, "m.room.topic", "", "@alice:localhost", map[string]interface{}{"topic": "B"})
+	newResponse := func(state ...json.RawMessage) *sync3.Response {
+		return &sync3.Response{Rooms: map[string]sync3.Room{
+			roomA: {RequiredState: state, Initial: true},
+			roomB: {RequiredState: state, Initial: true},
+		}}
+	}
+
+	// the first time a room is sent it gets its full state
+	res := newResponse(name, topic)
+	cs.deltaRequiredState(res)
+	if got := res.Rooms[roomA]; got.RequiredStateDelta || !reflect.DeepEqual(got.RequiredState, []json.RawMessage{name, topic}) {
+		t.Fatalf("first response: got delta=%v state=%s", got.RequiredStateDelta, got.RequiredState)
+	}
+
+	// after that only changed state is sent, unless the room does not want deltas
+	res = newResponse(name, newTopic)
+	cs.deltaRequiredState(res)
+	if got := res.Rooms[roomA]; !got.RequiredStateDelta || !reflect.DeepEqual(got.RequiredState, []json.RawMessage{newTopic}) {
+		t.Fatalf("second response: got delta=%v state=%s", got.RequiredStateDelta, got.RequiredState)
+	}
+	if got := res.Rooms[roomB]; got.RequiredStateDelta || len(got.RequiredState) != 2 {
+		t.Fatalf("room without deltas: got delta=%v state=%s", got.RequiredStateDelta, got.RequiredState)
+	}
+
+	// nothing changed, so no state is sent
+	res = newResponse(name, newTopic)
+	cs.deltaRequiredState(res)
+	if got := res.Rooms[roomA]; !got.RequiredStateDelta || len(got.RequiredState) != 0 {
+		t.Fatalf("unchanged response: got delta=%v state=%s", got.RequiredStateDelta, got.RequiredState)
+	}
+
+	// rooms which stop wanting deltas are forgotten, so get their full state if they want them again
+	cs.roomSubscriptions[roomA] = sync3.RoomSubscription{}
+	cs.deltaRequiredState(newResponse(name, newTopic))
+	cs.roomSubscriptions[roomA] = sync3.RoomSubscription{RequiredStateDelta: &boolTrue}
+	res = newResponse(name, newTopic)
+	cs.deltaRequiredState(res)
+	if got := res.Rooms[roomA]; got.RequiredStateDelta || len(got.RequiredState) != 2 {
+		t.Fatalf("resubscribed response: got delta=%v state=%s", got.RequiredStateDelta, got.RequiredState)
+	}
+}
+
+// Test that lists sorted by notification count are resorted as counts change, and that count
+// changes are sent for rooms outside the list ranges.
+func TestConnStateSortByNotificationCount(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateSortByNotificationCount_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678063))
+	roomB := newRoomMetadata("!b:localhost", spec.Timestamp(1632131678062))
+	roomC := newRoomMetadata("!c:localhost", spec.Timestamp(1632131678061))
+	cs, _, _ := newTestConnState(t, userID, "yep", roomA, roomB, roomC)
+	intPtr := func(i int) *int {
+		return &i
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByNotificationCount, sync3.SortByRecency},
+			Ranges: sync3.SliceRanges{{0, 0}},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 0},
+						RoomIDs:   []string{roomA.RoomID},
+					},
+				},
+			},
+		},
+	})
+	sync := func() *sync3.Response {
+		t.Helper()
+		req := &sync3.Request{}
+		req.SetTimeoutMSecs(100)
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+
+	// room C gains notifications so moves to the top of the list
+	cs.userCache.OnUnreadCounts(context.Background(), roomC.RoomID, intPtr(0), intPtr(2))
+	res = sync()
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpSingle{Operation: "DELETE", Index: intPtr(0)},
+					&sync3.ResponseOpSingle{Operation: "INSERT", Index: intPtr(0), RoomID: roomC.RoomID},
+				},
+			},
+		},
+	})
+	if got := res.Rooms[roomC.RoomID].NotificationCount; got != 2 {
+		t.Fatalf("room C: got notification count %d want 2", got)
+	}
+
+	// room B gains fewer notifications, so stays outside the range, but its count is still sent
+	cs.userCache.OnUnreadCounts(context.Background(), roomB.RoomID, intPtr(0), intPtr(1))
+	res = sync()
+	if ops := res.Lists["a"].Ops; len(ops) != 0 {
+		t.Fatalf("got ops %v want none", ops)
+	}
+	if got := res.Rooms[roomB.RoomID].NotificationCount; got != 1 {
+		t.Fatalf("room B: got notification count %d want 1", got)
+	}
+
+	// reading room C drops it back below room B
+	cs.userCache.OnUnreadCounts(context.Background(), roomC.RoomID, intPtr(0), intPtr(0))
+	res = sync()
+	checkResponse(t, true, res, &sync3.Response{
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpSingle{Operation: "DELETE", Index: intPtr(0)},
+					&sync3.ResponseOpSingle{Operation: "INSERT", Index: intPtr(0), RoomID: roomB.RoomID},
+				},
+			},
+		},
+	})
+	if got := res.Rooms[roomC.RoomID].NotificationCount; got != 0 {
+		t.Fatalf("room C: got notification count %d want 0", got)
+	}
+}
+
+// Test that knocks are sent with their knock_state, and move from knock to invite lists in the same
+// response when the knock is accepted.
+func TestConnStateKnocks(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateKnocks_alice:localhost"
+	bob := "@TestConnStateKnocks_bob:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, _, _ := newTestConnState(t, userID, "yep", roomA)
+	boolTrue := true
+	boolFalse := false
+	assertCounts := func(res *sync3.Response, wantInvites, wantKnocks int) {
+		t.Helper()
+		if res.Lists["joined"].Count != 1 || res.Lists["invites"].Count != wantInvites || res.Lists["knocks"].Count != wantKnocks {
+			t.Fatalf("got lists %+v want %d invites and %d knocks", res.Lists, wantInvites, wantKnocks)
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"joined": {
+				Ranges:  sync3.SliceRanges{{0, 9}},
+				Filters: &sync3.RequestFilters{IsInvite: &boolFalse, IsKnock: &boolFalse},
+			},
+			"invites": {
+				Ranges:  sync3.SliceRanges{{0, 9}},
+				Filters: &sync3.RequestFilters{IsInvite: &boolTrue},
+			},
+			"knocks": {
+				Ranges:  sync3.SliceRanges{{0, 9}},
+				Filters: &sync3.RequestFilters{IsKnock: &boolTrue},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	assertCounts(res, 0, 0)
+	sync := func() *sync3.Response {
+		t.Helper()
+		req := &sync3.Request{}
+		req.SetTimeoutMSecs(100)
+		res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		return res
+	}
+	roomID := "!knock:localhost"
+	joinRules := testutils.NewStateEvent(t, "m.room.join_rules", "", bob, map[string]interface{}{"join_rule": "knock"})
+
+	// knocking adds the room to the knock list
+	knock := testutils.NewStateEvent(t, "m.room.member", userID, userID, map[string]interface{}{"membership": "knock"})
+	cs.userCache.OnInvite(context.Background(), roomID, []json.RawMessage{joinRules, knock})
+	res = sync()
+	assertCounts(res, 0, 1)
+	room := res.Rooms[roomID]
+	if len(room.KnockState) != 2 || len(room.InviteState) != 0 {
+		t.Fatalf("got knock_state %s invite_state %s, want the knock_state", room.KnockState, room.InviteState)
+	}
+	if room.HighlightCount != 0 {
+		t.Fatalf("got highlight count %d want 0 for a knock", room.HighlightCount)
+	}
+
+	// being invited moves the room to the invite list
+	invite := testutils.NewStateEvent(t, "m.room.member", userID, bob, map[string]interface{}{"membership": "invite"})
+	cs.userCache.OnInvite(context.Background(), roomID, []json.RawMessage{joinRules, invite})
+	res = sync()
+	assertCounts(res, 1, 0)
+	room = res.Rooms[roomID]
+	if len(room.InviteState) != 2 || len(room.KnockState) != 0 {
+		t.Fatalf("got invite_state %s knock_state %s, want the invite_state", room.InviteState, room.KnockState)
+	}
+
+	// new invite state for a room already in the list is sent again
+	name := testutils.NewStateEvent(t, "m.room.name", "", bob, map[string]interface{}{"name": "Knock knock"})
+	cs.userCache.OnInvite(context.Background(), roomID, []json.RawMessage{joinRules, name, invite})
+	res = sync()
+	assertCounts(res, 1, 0)
+	room = res.Rooms[roomID]
+	if len(room.InviteState) != 3 || room.Name != "Knock knock" {
+		t.Fatalf("got name %q invite_state %s, want the new invite_state", room.Name, room.InviteState)
+	}
+}
+
+// Test that the senders of live events are lazy loaded in rooms whose initial timeline is empty, and
+// that member events in the live timeline are not sent again in required_state.
+func TestConnStateLazyLoadLiveMembers(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateLazyLoadLiveMembers_alice:localhost"
+	bob := "@bob:localhost"
+	charlie := "@charlie:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	cs, dispatcher, globalCache := newTestConnState(t, userID, "yep", roomA)
+	cs.userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		return map[string]state.LatestEvents{}
+	}
+	globalCache.LoadStateEventOverride = func(roomID string, loadPosition int64, evType, stateKey string) json.RawMessage {
+		if evType != "m.room.member" {
+			t.Errorf("LoadStateEvent called with unexpected type: %s", evType)
+		}
+		return testutils.NewStateEvent(t, "m.room.member", stateKey, stateKey, map[string]interface{}{
+			"membership": "join",
+		})
+	}
+	_, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {
+				TimelineLimit: 10,
+				RequiredState: [][2]string{{"m.room.member", sync3.StateKeyLazy}},
+			},
+		},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewStateEvent(t, "m.room.member", bob, bob, map[string]interface{}{
+		"membership": "join",
+	}), 2)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{
+		"body": "hello",
+	}), 3)
+	dispatcher.OnNewEvent(context.Background(), roomA.RoomID, testutils.NewEvent(t, "m.room.message", charlie, map[string]interface{}{
+		"body": "hi",
+	}), 4)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	var members []string
+	for _, ev := range res.Rooms[roomA.RoomID].RequiredState {
+		members = append(members, gjson.GetBytes(ev, "state_key").Str)
+	}
+	if want := []string{charlie}; !reflect.DeepEqual(members, want) {
+		t.Fatalf("lazy loaded members: got %v want %v", members, want)
+	}
+}
+
+// Test that an initial request which is cancelled while loading its rooms returns an error rather
+// than a response missing the rooms' data, and that later requests still return a response.
+func TestConnStateCancelledLoads(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateCancelledLoads_alice:localhost"
+	roomA := newRoomMetadata("!a:localhost", spec.Timestamp(1632131678061))
+	req := &sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomA.RoomID: {TimelineLimit: 10},
+		},
+	}
+	for _, isInitial := range []bool{true, false} {
+		cs, _, _ := newTestConnState(t, userID, "yep", roomA)
+		ctx, cancel := context.WithCancel(context.Background())
+		cs.userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+			// a newer request supersedes this one part way through loading
+			cancel()
+			return map[string]state.LatestEvents{}
+		}
+		res, err := cs.OnIncomingRequest(ctx, ConnID, req, isInitial, time.Now())
+		if isInitial {
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("initial request: got err %v want context.Canceled", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("OnIncomingRequest returned error : %s", err)
+		}
+		if _, ok := res.Rooms[roomA.RoomID]; !ok {
+			t.Fatalf("response is missing room %s", roomA.RoomID)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceUpdatesMap holds the live updates for each device which has connections. A device has one
+// buffer of updates which all of its connections (e.g one per browser tab) read through with their
+// own cursor, in the same way that a device has one poller however many connections it has. This
+// means updates are processed and queued once per device rather than once per connection, and a
+// connection which stops reading never holds up updates for the others.
+type deviceUpdatesMap struct {
+	// the number of unread updates a connection can have before it is destroyed
+	maxPendingEventUpdates int
+	maxTransactionIDDelay  time.Duration
+
+	mu      *sync.Mutex
+	devices map[sync2.PollerID]*deviceUpdates
+
+	numDevices prometheus.Gauge
+	fanOut     prometheus.Histogram
+}
+
+func newDeviceUpdatesMap(maxPendingEventUpdates int, maxTransactionIDDelay time.Duration, enablePrometheus bool) *deviceUpdatesMap {
+	if maxPendingEventUpdates < 1 {
+		maxPendingEventUpdates = 1
+	}
+	m := &deviceUpdatesMap{
+		maxPendingEventUpdates: maxPendingEventUpdates,
+		maxTransactionIDDelay:  maxTransactionIDDelay,
+		mu:                     &sync.Mutex{},
+		devices:                make(map[sync2.PollerID]*deviceUpdates),
+	}
+	if enablePrometheus {
+		m.numDevices = prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "num_devices_with_conns",
+			Help:      "Number of devices with connections, each of which has one buffer of live updates.",
+		})
+		prometheus.MustRegister(m.numDevices)
+		m.fanOut = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "update_fan_out",
+			Help:      "Number of connections each live update for a device is delivered to.",
+			Buckets:   []float64{0, 1, 2, 3, 5, 10, 20},
+		})
+		prometheus.MustRegister(m.fanOut)
+	}
+	return m
+}
+
+// Subscribe returns a cursor over the live updates for the user's device, starting with the next
+// update. onLost is called if the cursor falls too far behind, after which it returns no updates.
+// The cursor must be closed when the connection is destroyed.
+func (m *deviceUpdatesMap) Subscribe(userCache *caches.UserCache, deviceID string, onLost func()) *updateCursor {
+	pid := sync2.PollerID{UserID: userCache.UserID, DeviceID: deviceID}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, exists := m.devices[pid]
+	if !exists {
+		d = &deviceUpdates{
+			m:         m,
+			pid:       pid,
+			userCache: userCache,
+			mu:        &sync.Mutex{},
+			cursors:   make(map[*updateCursor]struct{}),
+			notify:    make(chan struct{}),
+		}
+		d.txnIDWaiter = NewTxnIDWaiter(pid.UserID, m.maxTransactionIDDelay, func(delayed bool, update caches.Update) {
+			d.append(update)
+		})
+		d.userCacheID = userCache.Subsribe(d)
+		m.devices[pid] = d
+		m.updateMetrics()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := &updateCursor{
+		d:      d,
+		pos:    d.start + int64(len(d.buf)),
+		onLost: onLost,
+	}
+	d.cursors[c] = struct{}{}
+	return c
+}
+
+// OnUpdate queues the update for every connection on the device, if it has any.
+func (m *deviceUpdatesMap) OnUpdate(ctx context.Context, userID, deviceID string, update caches.Update) {
+	m.mu.Lock()
+	d := m.devices[sync2.PollerID{UserID: userID, DeviceID: deviceID}]
+	m.mu.Unlock()
+	if d != nil {
+		d.OnUpdate(ctx, update)
+	}
+}
+
+// release forgets the device once its last cursor is closed.
+func (m *deviceUpdatesMap) release(d *deviceUpdates) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d.mu.Lock()
+	numCursors := len(d.cursors)
+	d.mu.Unlock()
+	if numCursors > 0 || m.devices[d.pid] != d {
+		return
+	}
+	d.userCache.Unsubscribe(d.userCacheID)
+	delete(m.devices, d.pid)
+	m.updateMetrics()
+}
+
+// must hold mu
+func (m *deviceUpdatesMap) updateMetrics() {
+	if m.numDevices == nil {
+		return
+	}
+	m.numDevices.Set(float64(len(m.devices)))
+}
+
+func (m *deviceUpdatesMap) Teardown() {
+	if m.numDevices != nil {
+		prometheus.Unregister(m.numDevices)
+	}
+	if m.fanOut != nil {
+		prometheus.Unregister(m.fanOut)
+	}
+}
+
+// deviceUpdates is the buffer of live updates for one device. It listens to the user cache on
+// behalf of all of the device's connections, and holds each update until every cursor has read it.
+type deviceUpdates struct {
+	m           *deviceUpdatesMap
+	pid         sync2.PollerID
+	userCache   *caches.UserCache
+	userCacheID int
+	// holds back events the user sent until their transaction IDs for this device are known
+	txnIDWaiter *TxnIDWaiter
+
+	mu *sync.Mutex
+	// the updates which some cursor has not read. start is the position of buf[0].
+	buf     []caches.Update
+	start   int64
+	cursors map[*updateCursor]struct{}
+	// closed and replaced whenever an update is appended
+	notify chan struct{}
+}
+
+// Called by the user cache when updates arrive
+func (d *deviceUpdates) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	switch update := up.(type) {
+	case *caches.RoomEventUpdate:
+		if !update.EventData.AlwaysProcess && update.EventData.NID == 0 {
+			// 0 -> this event was from a 'state' block, do not poke active connections.
+			// This is not the same as checking if we have already processed this event: NID=0 means
+			// it's part of initial room state. If we sent these events, we'd send them to clients in
+			// the timeline section which is wrong.
+			return
+		}
+		internal.AssertWithContext(ctx, "missing global room metadata", update.GlobalRoomMetadata() != nil)
+		internal.Logf(ctx, "connstate", "queued update %d", update.EventData.NID)
+		d.OnUpdate(ctx, update)
+	case caches.RoomUpdate:
+		internal.AssertWithContext(ctx, "missing global room metadata", update.GlobalRoomMetadata() != nil)
+		d.OnUpdate(ctx, update)
+	default:
+		logger.Warn().Str("room_id", up.RoomID()).Msg("OnRoomUpdate unknown update type")
+	}
+}
+
+func (d *deviceUpdates) OnUpdate(ctx context.Context, up caches.Update) {
+	// will eventually call d.append
+	d.txnIDWaiter.Ingest(up)
+}
+
+func (d *deviceUpdates) append(up caches.Update) {
+	d.mu.Lock()
+	d.buf = append(d.buf, up)
+	end := d.start + int64(len(d.buf))
+	var lost []*updateCursor
+	for c := range d.cursors {
+		if end-c.pos <= int64(d.m.maxPendingEventUpdates) {
+			continue
+		}
+		// the connection isn't keeping up. Give it BufferWaitTime to catch up before giving up on it,
+		// so a burst of updates doesn't destroy connections which are still reading.
+		if c.behindSince.IsZero() {
+			c.behindSince = time.Now()
+			time.AfterFunc(BufferWaitTime, d.expireLaggingCursors)
+		} else if time.Since(c.behindSince) >= BufferWaitTime {
+			lost = append(lost, c)
+		}
+	}
+	for _, c := range lost {
+		c.lost = true
+		delete(d.cursors, c)
+	}
+	d.trim()
+	close(d.notify)
+	d.notify = make(chan struct{})
+	fanOut := len(d.cursors)
+	d.mu.Unlock()
+
+	if d.m.fanOut != nil {
+		d.m.fanOut.Observe(float64(fanOut))
+	}
+	d.onLost(lost)
+}
+
+// expireLaggingCursors gives up on cursors which have been too far behind for BufferWaitTime.
+func (d *deviceUpdates) expireLaggingCursors() {
+	d.mu.Lock()
+	end := d.start + int64(len(d.buf))
+	var lost []*updateCursor
+	for c := range d.cursors {
+		if !c.behindSince.IsZero() && end-c.pos > int64(d.m.maxPendingEventUpdates) && time.Since(c.behindSince) >= BufferWaitTime {
+			c.lost = true
+			delete(d.cursors, c)
+			lost = append(lost, c)
+		}
+	}
+	d.trim()
+	d.mu.Unlock()
+	d.onLost(lost)
+}
+
+func (d *deviceUpdates) onLost(lost []*updateCursor) {
+	for _, c := range lost {
+		logger.Warn().Str("user", d.pid.UserID).Str("device", d.pid.DeviceID).Msg(
+			"cannot send update to connection, buffer exceeded. Destroying connection.",
+		)
+		c.onLost()
+	}
+}
+
+// trim drops the updates which every cursor has read. Must hold mu.
+func (d *deviceUpdates) trim() {
+	minPos := d.start + int64(len(d.buf))
+	for c := range d.cursors {
+		if c.pos < minPos {
+			minPos = c.pos
+		}
+	}
+	n := int(minPos - d.start)
+	if n == 0 {
+		return
+	}
+	for i := 0; i < n; i++ {
+		d.buf[i] = nil // allow GC
+	}
+	d.buf = d.buf[n:]
+	d.start = minPos
+}
+
+// updateCursor is a connection's position in the live updates for its device.
+type updateCursor struct {
+	d      *deviceUpdates
+	onLost func()
+	// guarded by d.mu
+	pos         int64 // the position of the next update to read
+	lost        bool
+	closed      bool
+	behindSince time.Time // when the cursor fell more than maxPendingEventUpdates behind
+}
+
+// Next returns the next update, or false if there are no more updates yet.
+func (c *updateCursor) Next() (caches.Update, bool) {
+	d := c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c.lost || c.closed || c.pos >= d.start+int64(len(d.buf)) {
+		return nil, false
+	}
+	up := d.buf[c.pos-d.start]
+	c.pos++
+	if d.start+int64(len(d.buf))-c.pos <= int64(d.m.maxPendingEventUpdates) {
+		c.behindSince = time.Time{}
+	}
+	d.trim()
+	return up, true
+}
+
+// Wait returns a channel which is closed when there is an update to read. The channel of a lost
+// cursor is never closed.
+func (c *updateCursor) Wait() <-chan struct{} {
+	d := c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c.lost || c.closed {
+		return nil
+	}
+	if c.pos < d.start+int64(len(d.buf)) {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	return d.notify
+}
+
+// Len returns the number of updates the cursor has not read.
+func (c *updateCursor) Len() int {
+	d := c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c.lost || c.closed {
+		return 0
+	}
+	return int(d.start + int64(len(d.buf)) - c.pos)
+}
+
+// Cap returns the number of unread updates the cursor can have before it is lost.
+func (c *updateCursor) Cap() int {
+	return c.d.m.maxPendingEventUpdates
+}
+
+// Lost returns true if the cursor fell too far behind.
+func (c *updateCursor) Lost() bool {
+	c.d.mu.Lock()
+	defer c.d.mu.Unlock()
+	return c.lost
+}
+
+// PublishEventsUpTo releases the events held back for transaction IDs in the room, see TxnIDWaiter.
+func (c *updateCursor) PublishEventsUpTo(roomID string, nid int64) {
+	c.d.txnIDWaiter.PublishUpToNID(roomID, nid)
+}
+
+// OnUpdate queues an update for every connection on the device.
+func (c *updateCursor) OnUpdate(ctx context.Context, up caches.Update) {
+	c.d.OnUpdate(ctx, up)
+}
+
+// Close stops the cursor. Safe to call more than once.
+func (c *updateCursor) Close() {
+	d := c.d
+	d.mu.Lock()
+	if c.closed {
+		d.mu.Unlock()
+		return
+	}
+	c.closed = true
+	delete(d.cursors, c)
+	d.trim()
+	d.mu.Unlock()
+	d.m.release(d)
+}
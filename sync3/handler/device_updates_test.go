@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Test that connections on the same device share one buffer, each reading every update once with
+// their own cursor, and that connections on other devices don't see them.
+func TestDeviceUpdatesSharedByConns(t *testing.T) {
+	userCache := caches.NewUserCache("@alice:localhost", nil, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	m := newDeviceUpdatesMap(10, 0, false)
+	tab1 := m.Subscribe(userCache, "DEVICE", func() {})
+	tab2 := m.Subscribe(userCache, "DEVICE", func() {})
+	other := m.Subscribe(userCache, "OTHER", func() {})
+	if len(m.devices) != 2 {
+		t.Fatalf("got %d device buffers want 2", len(m.devices))
+	}
+
+	m.OnUpdate(context.Background(), "@alice:localhost", "DEVICE", caches.DeviceEventsUpdate{})
+	m.OnUpdate(context.Background(), "@alice:localhost", "DEVICE", caches.DeviceDataUpdate{})
+	for name, cursor := range map[string]*updateCursor{"tab1": tab1, "tab2": tab2} {
+		select {
+		case <-cursor.Wait():
+		default:
+			t.Fatalf("%s: Wait did not return a closed channel", name)
+		}
+		if cursor.Len() != 2 {
+			t.Fatalf("%s: got %d pending updates want 2", name, cursor.Len())
+		}
+		if up, _ := cursor.Next(); up != (caches.DeviceEventsUpdate{}) {
+			t.Fatalf("%s: got first update %T want DeviceEventsUpdate", name, up)
+		}
+		if up, _ := cursor.Next(); up != (caches.DeviceDataUpdate{}) {
+			t.Fatalf("%s: got second update %T want DeviceDataUpdate", name, up)
+		}
+		if _, ok := cursor.Next(); ok {
+			t.Fatalf("%s: got a third update", name)
+		}
+	}
+	if other.Len() != 0 {
+		t.Fatalf("other device got %d updates want 0", other.Len())
+	}
+	// every cursor has read the updates, so they are no longer held
+	if d := m.devices[tab1.d.pid]; len(d.buf) != 0 {
+		t.Fatalf("buffer still holds %d updates", len(d.buf))
+	}
+
+	// closing the last connection on a device forgets its buffer
+	tab1.Close()
+	tab1.Close()
+	if len(m.devices) != 2 {
+		t.Fatalf("closing one of two connections forgot the device buffer")
+	}
+	tab2.Close()
+	if len(m.devices) != 1 {
+		t.Fatalf("got %d device buffers want 1", len(m.devices))
+	}
+}
+
+// Test that a connection which stops reading is lost once it has been too far behind for
+// BufferWaitTime, without affecting the other connections on the device.
+func TestDeviceUpdatesLaggingConn(t *testing.T) {
+	oldWaitTime := BufferWaitTime
+	BufferWaitTime = 10 * time.Millisecond
+	defer func() {
+		BufferWaitTime = oldWaitTime
+	}()
+	userCache := caches.NewUserCache("@alice:localhost", nil, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	m := newDeviceUpdatesMap(2, 0, false)
+	lostCh := make(chan struct{})
+	slow := m.Subscribe(userCache, "DEVICE", func() { close(lostCh) })
+	fast := m.Subscribe(userCache, "DEVICE", func() { t.Errorf("fast connection was lost") })
+
+	for i := 0; i < 3; i++ {
+		m.OnUpdate(context.Background(), "@alice:localhost", "DEVICE", caches.DeviceEventsUpdate{})
+		if _, ok := fast.Next(); !ok {
+			t.Fatalf("fast connection did not get update %d", i)
+		}
+	}
+	// the slow connection is over the limit, but has BufferWaitTime to catch up
+	if slow.Lost() {
+		t.Fatalf("slow connection was lost straight away")
+	}
+	select {
+	case <-lostCh:
+	case <-time.After(time.Second):
+		t.Fatalf("slow connection was not lost")
+	}
+	if !slow.Lost() || slow.Len() != 0 {
+		t.Fatalf("lost connection: got lost=%v len=%d", slow.Lost(), slow.Len())
+	}
+	if slow.Wait() != nil {
+		t.Fatalf("lost connection's Wait channel is not nil")
+	}
+	// the slow connection's updates are no longer held
+	if d := m.devices[fast.d.pid]; len(d.buf) != 0 {
+		t.Fatalf("buffer still holds %d updates", len(d.buf))
+	}
+	m.OnUpdate(context.Background(), "@alice:localhost", "DEVICE", caches.DeviceEventsUpdate{})
+	if _, ok := fast.Next(); !ok {
+		t.Fatalf("fast connection stopped getting updates")
+	}
+}
@@ -183,6 +183,23 @@ func (p *EnsurePoller) OnExpiredToken(payload *pubsub.V2ExpiredToken) {
 	// by signalling via the expired flag.
 }
 
+// UpdateAccessToken asks the pollers to switch to this access token if the device is being polled,
+// e.g because the client refreshed its token.
+func (p *EnsurePoller) UpdateAccessToken(pid sync2.PollerID, tokenHash string) {
+	p.mu.Lock()
+	pending, exists := p.pendingPolls[pid]
+	p.mu.Unlock()
+	if !exists || !pending.done || pending.expired {
+		// there is no running poller; EnsurePolling will start one with this token
+		return
+	}
+	p.notifier.Notify(p.chanName, &pubsub.V3UpdateAccessToken{
+		UserID:          pid.UserID,
+		DeviceID:        pid.DeviceID,
+		AccessTokenHash: tokenHash,
+	})
+}
+
 func (p *EnsurePoller) Teardown() {
 	p.notifier.Close()
 	if p.numPendingEnsurePolling != nil {
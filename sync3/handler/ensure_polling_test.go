@@ -200,3 +200,26 @@ func assertVal(t *testing.T, got, want interface{}) {
 		t.Fatalf("assertVal: got %v want %v", got, want)
 	}
 }
+
+// check that refreshed tokens are only sent to the pollers when the device is being polled
+func TestEnsurePollerUpdateAccessToken(t *testing.T) {
+	n := &mockNotifier{ch: make(chan pubsub.Payload, 100)}
+	pid := sync2.PollerID{UserID: "@alice:localhost", DeviceID: "DEVICE"}
+	ep := NewEnsurePoller(n, false)
+
+	// not polled yet: EnsurePolling will use the new token
+	ep.UpdateAccessToken(pid, "refreshedHash")
+	n.MustHaveNoSentPayloads(t)
+
+	ep.OnInitialSyncComplete(&pubsub.V2InitialSyncComplete{UserID: pid.UserID, DeviceID: pid.DeviceID, Success: true})
+	ep.UpdateAccessToken(pid, "refreshedHash")
+	want := &pubsub.V3UpdateAccessToken{UserID: pid.UserID, DeviceID: pid.DeviceID, AccessTokenHash: "refreshedHash"}
+	if got := n.WaitForNextPayload(t, time.Second); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+
+	// the poller has stopped, so the next request will start a new one
+	ep.OnExpiredToken(&pubsub.V2ExpiredToken{UserID: pid.UserID, DeviceID: pid.DeviceID, SoftLogout: true})
+	ep.UpdateAccessToken(pid, "refreshedAgainHash")
+	n.MustHaveNoSentPayloads(t)
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/rs/zerolog/hlog"
+)
+
+// sendEvents returns a pushSession send function which writes messages to w as Server-Sent Events.
+// Responses are sent with their pos as the event ID, so clients which reconnect send it back as
+// Last-Event-ID. Errors are sent as "error" events.
+func sendEvents(w http.ResponseWriter, flusher http.Flusher) func(v any) error {
+	return func(v any) error {
+		var err error
+		switch msg := v.(type) {
+		case *internal.HandlerError:
+			_, err = fmt.Fprintf(w, "event: error\ndata: %s\n\n", msg.JSON())
+		case *sync3.Response:
+			var data []byte
+			if data, err = json.Marshal(msg); err == nil {
+				_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", msg.Pos, data)
+			}
+		default:
+			err = fmt.Errorf("cannot send %T as an event", v)
+		}
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+}
+
+// serveEvents streams responses for an existing connection as Server-Sent Events, for clients which
+// cannot use WebSockets. The stream starts from the Last-Event-ID header, or the pos query param.
+// The request is changed by POSTing a pushRequest to the endpoint with ?events=true, as clients
+// cannot send messages on the stream: see pushEvents.
+func (h *SyncLiveHandler) serveEvents(w http.ResponseWriter, req *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return &internal.HandlerError{
+			StatusCode: 500,
+			Err:        fmt.Errorf("streaming events is not supported"),
+		}
+	}
+	query := req.URL.Query()
+	posStr := req.Header.Get("Last-Event-ID")
+	if posStr == "" {
+		posStr = query.Get("pos")
+	}
+	pos, err := strconv.ParseInt(posStr, 10, 64)
+	if err != nil || pos <= 0 {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("streaming events needs the pos of an existing connection, got %q", posStr),
+		}
+	}
+	first := &pushRequest{
+		Pos:     posStr,
+		Request: sync3.Request{ConnID: query.Get("conn_id")},
+	}
+	if herr := validateRequest(&first.Request); herr != nil {
+		return herr
+	}
+	if query.Get("timeout") != "" {
+		timeout, herr := parseIntFromQuery(req.URL, "timeout")
+		if herr != nil {
+			return herr
+		}
+		timeoutMSecs := int(timeout)
+		first.Timeout = &timeoutMSecs
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req, conn, herr := h.setupConnection(req.WithContext(ctx), cancel, &first.Request, true)
+	if herr != nil {
+		return herr
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// stop reverse proxies like nginx buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	session := h.newPushSession(conn, sendEvents(w, flusher))
+	key := conn.ConnID.String()
+	h.eventStreams.Store(key, session)
+	defer h.eventStreams.CompareAndDelete(key, session)
+	err = session.run(req.Context(), first, pos)
+	hlog.FromRequest(req).Debug().Err(err).Str("conn", key).Msg("event stream closed")
+	return nil
+}
+
+// pushEvents changes the request of the connection's event stream to the pushRequest in the body.
+// Responds with 202 once the stream has the message, as the response is sent on the stream.
+func (h *SyncLiveHandler) pushEvents(w http.ResponseWriter, req *http.Request) error {
+	var msg pushRequest
+	defer req.Body.Close()
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        err,
+		}
+	}
+	if herr := validateRequest(&msg.Request); herr != nil {
+		return herr
+	}
+	accessToken, err := internal.ExtractAccessToken(req)
+	if err != nil || accessToken == "" {
+		return &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        err,
+		}
+	}
+	token, herr := h.lookupToken(req, accessToken)
+	if herr != nil {
+		return herr
+	}
+	connID := sync3.ConnID{
+		UserID:   token.UserID,
+		DeviceID: token.DeviceID,
+		CID:      msg.Request.ConnID,
+	}
+	session, ok := h.eventStreams.Load(connID.String())
+	if !ok {
+		return &internal.HandlerError{
+			StatusCode: 404,
+			ErrCode:    "M_NOT_FOUND",
+			Err:        fmt.Errorf("connection has no event stream"),
+		}
+	}
+	session.(*pushSession).push(&msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("{}"))
+	return nil
+}
@@ -6,11 +6,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -30,6 +32,8 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/websocket"
 )
 
 const DefaultSessionID = "default"
@@ -49,6 +53,9 @@ type SyncLiveHandler struct {
 	EnsurePoller *EnsurePoller
 	ConnMap      *sync3.ConnMap
 	Extensions   *extensions.Handler
+	// Authenticator identifies access tokens which are not in the database. Defaults to asking
+	// the upstream homeserver. Use SetAuthenticator to enable caching.
+	Authenticator Authenticator
 
 	// inserts are done by v2 poll loops, selects are done by v3 request threads
 	// but the v3 requests touch non-overlapping keys, which is a good use case for sync.Map
@@ -56,13 +63,49 @@ type SyncLiveHandler struct {
 	userCaches *sync.Map // map[user_id]*UserCache
 	Dispatcher *sync3.Dispatcher
 
-	GlobalCache            *caches.GlobalCache
-	maxPendingEventUpdates int
-	maxTransactionIDDelay  time.Duration
+	GlobalCache *caches.GlobalCache
+	// the live updates for each device with connections, shared by the device's connections
+	deviceUpdates     *deviceUpdatesMap
+	maxCoalesceWindow time.Duration
+	maxTrackedRooms   int
+	pollInterval      *pollIntervalAdvisor
+	capabilities      *sync3.Capabilities
+	featureGates      sync3.FeatureGates
+	// see SetCountUpdateThrottle
+	countUpdateThrottle         time.Duration
+	countUpdateThrottleMinRooms int
 
 	setupHistVec *prometheus.HistogramVec
 	histVec      *prometheus.HistogramVec
 	slowReqs     prometheus.Counter
+	// authCacheLookups counts access token cache lookups, labelled by result=hit|miss.
+	authCacheLookups *prometheus.CounterVec
+	// connSetups counts new connection setups, labelled by result=admitted|queued|rejected.
+	connSetups *prometheus.CounterVec
+	// warmUpDurations tracks the time taken to warm up each user, see SetWarmUp.
+	warmUpDurations prometheus.Histogram
+	// see SetConnSetupRate. nil means no limit.
+	admission *admissionController
+	// see SetConnSetupRateLimits. nil means no limit.
+	setupLimiter *setupRateLimiter
+	// see SetMaxConcurrentInitialSyncs. nil means no limit.
+	initialSyncs *initialSyncLimiter
+	// see SetCompressResponses
+	compressResponses bool
+	// see SetBackfill
+	backfill bool
+	// see SetConnDebug. 0 means the endpoint is disabled.
+	connDebugResponses int
+	// see SetResponseFilter. nil means responses are not filtered.
+	responseFilter ResponseFilter
+	// see SetWarmUp. nil means users are not warmed up.
+	warmUps *warmUpQueue
+	// see SetServerNameForHost. nil if the proxy serves one homeserver.
+	serverNameForHost func(host string) (serverName string, ok bool)
+	// configuration dependent features, which are listed in capabilities
+	enabledFeatures []string
+	// the sessions streaming Server-Sent Events, so requests on the side-channel can find them
+	eventStreams sync.Map // map[ConnID.String()]*pushSession
 	// destroyedConns is the number of connections that have been destoryed after
 	// a room invalidation payload.
 	// TODO: could make this a CounterVec labelled by reason, to track expiry due
@@ -73,24 +116,39 @@ type SyncLiveHandler struct {
 func NewSync3Handler(
 	store *state.Storage, storev2 *sync2.Storage, v2Client sync2.Client, secret string,
 	pub pubsub.Notifier, sub pubsub.Listener, enablePrometheus bool, maxPendingEventUpdates int,
-	maxTransactionIDDelay time.Duration,
+	maxTransactionIDDelay time.Duration, maxCoalesceWindow time.Duration,
+	minPollInterval time.Duration, pollLoadThreshold int, maxTrackedRooms int,
 ) (*SyncLiveHandler, error) {
 	logger.Info().Msg("creating handler")
 	sh := &SyncLiveHandler{
-		V2:                     v2Client,
-		Storage:                store,
-		V2Store:                storev2,
-		ConnMap:                sync3.NewConnMap(enablePrometheus, 30*time.Minute),
-		userCaches:             &sync.Map{},
-		Dispatcher:             sync3.NewDispatcher(),
-		GlobalCache:            caches.NewGlobalCache(store),
-		maxPendingEventUpdates: maxPendingEventUpdates,
-		maxTransactionIDDelay:  maxTransactionIDDelay,
-	}
+		V2:                v2Client,
+		Authenticator:     &UpstreamAuthenticator{Client: v2Client},
+		Storage:           store,
+		V2Store:           storev2,
+		ConnMap:           sync3.NewConnMap(enablePrometheus, 30*time.Minute),
+		userCaches:        &sync.Map{},
+		Dispatcher:        sync3.NewDispatcher(),
+		GlobalCache:       caches.NewGlobalCache(store),
+		deviceUpdates:     newDeviceUpdatesMap(maxPendingEventUpdates, maxTransactionIDDelay, enablePrometheus),
+		maxCoalesceWindow: maxCoalesceWindow,
+		maxTrackedRooms:   maxTrackedRooms,
+		pollInterval:      newPollIntervalAdvisor(minPollInterval, pollLoadThreshold),
+	}
+	if v2Client != nil {
+		sh.GlobalCache.SetDirectoryLookup(v2Client.DirectoryVisibility)
+	}
+	if minPollInterval > 0 {
+		sh.enabledFeatures = append(sh.enabledFeatures, sync3.FeatureSuggestedPollInterval)
+	}
+	if maxTrackedRooms > 0 {
+		sh.enabledFeatures = append(sh.enabledFeatures, sync3.FeatureUntrackedRooms)
+	}
+	sh.capabilities = sync3.NewCapabilities(sync2.ProxyVersion, sh.enabledFeatures...)
 	sh.Extensions = &extensions.Handler{
-		Store:       store,
-		E2EEFetcher: sh,
-		GlobalCache: sh.GlobalCache,
+		Store:           store,
+		E2EEFetcher:     sh,
+		PresenceFetcher: sh,
+		GlobalCache:     sh.GlobalCache,
 	}
 
 	if enablePrometheus {
@@ -128,6 +186,12 @@ func (h *SyncLiveHandler) Listen() {
 	}()
 }
 
+// Shutdown answers outstanding and future requests without calculating new responses, so clients
+// keep their positions whilst the server stops. See sync3.ConnMap.Shutdown.
+func (h *SyncLiveHandler) Shutdown(ctx context.Context) error {
+	return h.ConnMap.Shutdown(ctx)
+}
+
 // used in tests to close postgres connections
 func (h *SyncLiveHandler) Teardown() {
 	// tear down DB conns
@@ -135,6 +199,10 @@ func (h *SyncLiveHandler) Teardown() {
 	h.V2Sub.Teardown()
 	h.EnsurePoller.Teardown()
 	h.ConnMap.Teardown()
+	h.deviceUpdates.Teardown()
+	if h.warmUps != nil {
+		h.warmUps.Close()
+	}
 	if h.setupHistVec != nil {
 		prometheus.Unregister(h.setupHistVec)
 	}
@@ -147,6 +215,127 @@ func (h *SyncLiveHandler) Teardown() {
 	if h.destroyedConns != nil {
 		prometheus.Unregister(h.destroyedConns)
 	}
+	if h.authCacheLookups != nil {
+		prometheus.Unregister(h.authCacheLookups)
+	}
+	if h.connSetups != nil {
+		prometheus.Unregister(h.connSetups)
+	}
+	if h.warmUpDurations != nil {
+		prometheus.Unregister(h.warmUpDurations)
+	}
+}
+
+// SetAuthenticator sets the Authenticator used for unknown access tokens. Validated tokens are
+// cached for cacheTTL, or not at all if cacheTTL is 0.
+func (h *SyncLiveHandler) SetAuthenticator(auth Authenticator, cacheTTL time.Duration) {
+	h.Authenticator = NewCachingAuthenticator(auth, cacheTTL, h.authCacheLookups)
+}
+
+// SetCountUpdateThrottle holds live updates which only change unread counts for up to `window`
+// before returning them, for users joined to at least minRooms rooms. This batches the frequent
+// count changes of huge accounts into fewer responses. Count changes which add highlights are
+// never held. Only applies to connections created after this is called. A window of 0 disables
+// throttling.
+func (h *SyncLiveHandler) SetCountUpdateThrottle(window time.Duration, minRooms int) {
+	h.countUpdateThrottle = window
+	h.countUpdateThrottleMinRooms = minRooms
+}
+
+// SetFeatureGates restricts the gated features to the devices the gates enable them for. Other
+// devices do not have the features listed in their capabilities, and their requests for them are
+// ignored.
+func (h *SyncLiveHandler) SetFeatureGates(gates sync3.FeatureGates) {
+	h.featureGates = gates
+}
+
+// SetConnSetupRate limits the number of new connections set up per second, to protect the
+// homeserver and database from reconnect storms. Setups over the limit wait for up to maxWait
+// before being rejected with M_LIMIT_EXCEEDED. A rate of 0 means no limit.
+func (h *SyncLiveHandler) SetConnSetupRate(rate float64, maxWait time.Duration) {
+	if rate <= 0 {
+		h.admission = nil
+		return
+	}
+	h.admission = newAdmissionController(rate, maxWait, h.connSetups)
+}
+
+// SetCompressResponses gzips responses for clients which send Accept-Encoding: gzip. Errors,
+// WebSockets and Server-Sent Events are never compressed.
+func (h *SyncLiveHandler) SetCompressResponses(compress bool) {
+	h.compressResponses = compress
+}
+
+// SetBackfill serves timeline history older than the proxy has stored on MessagesPath, by fetching
+// it from the homeserver's /messages on demand. Fetched history is kept for
+// Storage.BackfillRetention.
+func (h *SyncLiveHandler) SetBackfill(enabled bool) {
+	if enabled && !h.backfill {
+		h.enabledFeatures = append(h.enabledFeatures, sync3.FeatureBackfill)
+		h.capabilities = sync3.NewCapabilities(sync2.ProxyVersion, h.enabledFeatures...)
+	}
+	h.backfill = enabled
+}
+
+// SetServerNameForHost is used when the proxy serves users of more than one homeserver. Access
+// tokens which the proxy has not seen before are identified by the homeserver with the server name
+// that serverNameForHost returns for the Host the client connected to, and are rejected if that
+// homeserver says the token is for a user of another homeserver. Requests to hosts which no served
+// homeserver matches are rejected.
+func (h *SyncLiveHandler) SetServerNameForHost(serverNameForHost func(host string) (serverName string, ok bool)) {
+	h.serverNameForHost = serverNameForHost
+}
+
+// SetConnSetupRateLimits limits how often each user and each device can set up new connections, on
+// top of the overall rate set by SetConnSetupRate. Setups over the limit are rejected straight away
+// with M_LIMIT_EXCEEDED. ExemptBuffered is ignored. A rate of 0 means no limit.
+func (h *SyncLiveHandler) SetConnSetupRateLimits(perUser, perDevice sync3.RateLimit) {
+	if perUser.Rate <= 0 && perDevice.Rate <= 0 {
+		h.setupLimiter = nil
+		return
+	}
+	h.setupLimiter = newSetupRateLimiter(perUser, perDevice)
+}
+
+// SetMaxConcurrentInitialSyncs caps the number of initial syncs calculated at once. Initial syncs
+// over the cap wait for up to maxWait before being rejected with M_LIMIT_EXCEEDED. Only applies to
+// connections created after this is called. A max of 0 means no limit.
+func (h *SyncLiveHandler) SetMaxConcurrentInitialSyncs(max int, maxWait time.Duration) {
+	if max <= 0 {
+		h.initialSyncs = nil
+		return
+	}
+	h.initialSyncs = newInitialSyncLimiter(max, maxWait)
+}
+
+// SetWarmUp loads each user's caches in the background once their first sync v2 response has been
+// stored, up to `workers` users at a time, so their first request does not have to. Warmed up users
+// keep their caches in memory, as users with connections do. 0 workers disables warming up.
+func (h *SyncLiveHandler) SetWarmUp(workers int) {
+	if h.warmUps != nil {
+		h.warmUps.Close()
+		h.warmUps = nil
+	}
+	if workers > 0 {
+		h.warmUps = newWarmUpQueue(workers, h.warmUpDurations, h.warmUp)
+	}
+}
+
+// warmUp loads the user cache, which loads the user's joined rooms when it registers with the
+// dispatcher.
+func (h *SyncLiveHandler) warmUp(userID string) error {
+	if _, exists := h.userCaches.Load(userID); exists {
+		return nil
+	}
+	_, err := h.userCache(userID)
+	return err
+}
+
+// invalidateAuthCache forgets any cached access tokens for this device.
+func (h *SyncLiveHandler) invalidateAuthCache(userID, deviceID string) {
+	if c, ok := h.Authenticator.(*CachingAuthenticator); ok {
+		c.InvalidateDevice(userID, deviceID)
+	}
 }
 
 func (h *SyncLiveHandler) addPrometheusMetrics() {
@@ -176,19 +365,57 @@ func (h *SyncLiveHandler) addPrometheusMetrics() {
 		Name:      "destroyed_conns",
 		Help:      "Counter of conns that were destroyed.",
 	})
+	h.authCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "auth_cache_lookups",
+		Help:      "Counter of access token cache lookups, labelled by whether it was a hit or a miss.",
+	}, []string{"result"})
+	h.connSetups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "conn_setups",
+		Help:      "Counter of new connection setups, labelled by whether they were admitted immediately, queued, rejected or rate limited for the user or device.",
+	}, []string{"result"})
+	h.warmUpDurations = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "warm_up_duration_secs",
+		Help:      "Time taken in seconds to load a user's caches in the background after their first poll.",
+		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+	})
 
 	prometheus.MustRegister(h.setupHistVec)
 	prometheus.MustRegister(h.histVec)
 	prometheus.MustRegister(h.slowReqs)
 	prometheus.MustRegister(h.destroyedConns)
+	prometheus.MustRegister(h.warmUpDurations)
+	prometheus.MustRegister(h.authCacheLookups)
+	prometheus.MustRegister(h.connSetups)
 }
 
 func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if req.Method != "POST" {
+	if req.Method == "GET" && strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		// the Origin is not checked, as CORS allows any origin to sync
+		websocket.Server{Handler: h.serveWebSocket}.ServeHTTP(w, req)
+		return
+	}
+	var err error
+	switch {
+	case req.URL.Path == MessagesPath:
+		err = h.serveMessages(w, req)
+	case strings.HasPrefix(req.URL.Path, ConnDebugPath):
+		err = h.serveConnDebug(w, req)
+	case req.Method == "GET" && strings.Contains(req.Header.Get("Accept"), "text/event-stream"):
+		err = h.serveEvents(w, req)
+	case req.Method == "POST" && req.URL.Query().Get("events") == "true":
+		err = h.pushEvents(w, req)
+	case req.Method == "POST":
+		err = h.serve(w, req)
+	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	err := h.serve(w, req)
 	if err != nil {
 		herr, ok := err.(*internal.HandlerError)
 		if !ok {
@@ -197,13 +424,24 @@ func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				Err:        err,
 			}
 		}
-		if herr.ErrCode != "M_UNKNOWN_POS" {
+		if herr.StatusCode == internal.StatusClientClosedRequest {
+			// the client has gone, so don't make it wait. The status is still written in case the
+			// client is listening after all e.g it cancelled the request by making a newer one.
+			w.WriteHeader(herr.StatusCode)
+			return
+		}
+		if herr.ErrCode != "M_UNKNOWN_POS" && herr.RetryAfter == 0 {
 			// artificially wait a bit before sending back the error
 			// this guards against tightlooping when the client hammers the server with invalid requests,
 			// but not for M_UNKNOWN_POS which we expect to send back after expiring a client's connection.
-			// We want to recover rapidly in that scenario, hence not sleeping.
+			// We want to recover rapidly in that scenario, hence not sleeping. Clients are told how
+			// long to wait when they are rate limited, so don't hold onto those requests either.
 			time.Sleep(time.Second)
 		}
+		if herr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(herr.RetryAfter.Seconds()))))
+		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(herr.StatusCode)
 		w.Write(herr.JSON())
 	}
@@ -212,6 +450,7 @@ func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 // Entry point for sync v3
 func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error {
 	start := time.Now()
+	h.pollInterval.OnRequest()
 	defer func() {
 		dur := time.Since(start)
 		if dur > 50*time.Second {
@@ -231,12 +470,9 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 				Err:        err,
 			}
 		}
-		if err := requestBody.Validate(); err != nil {
-			return &internal.HandlerError{
-				StatusCode: 400,
-				Err:        err,
-			}
-		}
+	}
+	if herr := validateRequest(&requestBody); herr != nil {
+		return herr
 	}
 	if requestBody.ConnID != "" {
 		req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagConnID, requestBody.ConnID))
@@ -248,17 +484,11 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		c.Str("txn_id", requestBody.TxnID)
 		return c
 	})
-	for listKey, l := range requestBody.Lists {
-		if l.Ranges != nil && !l.Ranges.Valid() {
-			return &internal.HandlerError{
-				StatusCode: 400,
-				Err:        fmt.Errorf("list[%v] invalid ranges %v", listKey, l.Ranges),
-			}
-		}
-	}
-
 	logErrorOrWarning := func(msg string, herr *internal.HandlerError) {
-		if herr.StatusCode >= 500 {
+		if herr.StatusCode == internal.StatusClientClosedRequest {
+			// clients cancelling requests is normal
+			hlog.FromRequest(req).Trace().Err(herr).Msg(msg)
+		} else if herr.StatusCode >= 500 {
 			hlog.FromRequest(req).Err(herr).Msg(msg)
 		} else {
 			hlog.FromRequest(req).Warn().Err(herr).Msg(msg)
@@ -282,7 +512,7 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 
 	var timeout int
 	if req.URL.Query().Get("timeout") == "" {
-		timeout = sync3.DefaultTimeoutMSecs
+		timeout = h.ConnMap.DefaultTimeoutMSecs()
 	} else {
 		timeout64, herr := parseIntFromQuery(req.URL, "timeout")
 		if herr != nil {
@@ -294,6 +524,8 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 	requestBody.SetTimeoutMSecs(timeout)
 	log.Trace().Int("timeout", timeout).Msg("recv")
 
+	disabledFeatures := h.featureGates.Disabled(conn.DeviceID)
+	requestBody.RemoveFeatures(disabledFeatures)
 	resp, herr := conn.OnIncomingRequest(req.Context(), &requestBody, start)
 	if herr != nil {
 		logErrorOrWarning("failed to OnIncomingRequest", herr)
@@ -317,22 +549,37 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		req.Context(), cpos, resp.PosInt(), len(resp.Rooms), requestBody.TxnID, numToDeviceEvents, numGlobalAccountData,
 		numChangedDevices, numLeftDevices, requestBody.ConnID, len(requestBody.Lists), len(requestBody.RoomSubscriptions), len(requestBody.UnsubscribeRooms),
 	)
+	internal.SetRequestContextServedFrom(req.Context(), string(resp.ServedFrom))
+
+	resp.SuggestedPollIntervalMSecs = h.pollInterval.Suggested().Milliseconds()
+	if cpos == 0 {
+		// tell clients what we support on the first response for this connection
+		resp.Capabilities = h.capabilities.WithoutFeatures(disabledFeatures)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
+	var gw *gzipResponseWriter
+	if h.compressResponses && acceptsEncoding(req.Header, "gzip") {
+		gw = newGzipResponseWriter(w)
+	}
 	w.WriteHeader(200)
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	var err error
+	if gw != nil {
+		err = h.writeResponse(gw, req, resp)
+		if closeErr := gw.Close(); err == nil {
+			err = closeErr
+		}
+	} else {
+		err = h.writeResponse(w, req, resp)
+	}
+	if err != nil {
 		herr = &internal.HandlerError{
 			StatusCode: 500,
 			Err:        err,
 		}
 		if errors.Is(err, syscall.EPIPE) {
-			// Client closed the connection. Use a 499 status code internally so that
-			// we consider this a warning rather than an error. 499 is nonstandard,
-			// but a) the client has already gone, so this status code will only show
-			// up in our logs; and b) nginx uses 499 to mean "Client Closed Request",
-			// see e.g.
-			// https://www.nginx.com/resources/wiki/extending/api/http/#http-return-codes
-			herr.StatusCode = 499
+			// Client closed the connection, which is normal rather than an error.
+			herr.StatusCode = internal.StatusClientClosedRequest
 		}
 
 		logErrorOrWarning("failed to JSON-encode result", herr)
@@ -341,6 +588,34 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 	return nil
 }
 
+// validateRequest checks the request body is valid.
+func validateRequest(requestBody *sync3.Request) *internal.HandlerError {
+	if err := requestBody.Validate(); err != nil {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        err,
+		}
+	}
+	for listKey, l := range requestBody.Lists {
+		if l.Ranges != nil && !l.Ranges.Valid() {
+			return &internal.HandlerError{
+				StatusCode: 400,
+				Err:        fmt.Errorf("list[%v] invalid ranges %v", listKey, l.Ranges),
+			}
+		}
+	}
+	return nil
+}
+
+// writeResponse JSON-encodes the response.
+func (h *SyncLiveHandler) writeResponse(w http.ResponseWriter, req *http.Request, resp *sync3.Response) error {
+	if numReplaced := resp.ReplaceMalformedEvents(); numReplaced > 0 {
+		logger.Warn().Int("num_replaced", numReplaced).Msg("replaced malformed events with placeholders")
+		internal.Logf(req.Context(), "connstate", "replaced %d malformed events", numReplaced)
+	}
+	return json.NewEncoder(w).Encode(resp)
+}
+
 // setupConnection associates this request with an existing connection or makes a new connection.
 // It also sets a v2 sync poll loop going if one didn't exist already for this user.
 // When this function returns, the connection is alive and active.
@@ -359,25 +634,18 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 		}
 	}
 
-	// Try to lookup a record of this token
-	var token *sync2.Token
-	token, err = h.V2Store.TokensTable.Token(accessToken)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			hlog.FromRequest(req).Info().Msg("Received connection from unknown access token, querying with homeserver")
-			newToken, herr := h.identifyUnknownAccessToken(req.Context(), accessToken, hlog.FromRequest(req))
-			if herr != nil {
-				return req, nil, herr
-			}
-			token = newToken
-		} else {
-			hlog.FromRequest(req).Err(err).Msg("Failed to lookup access token")
-			return req, nil, &internal.HandlerError{
-				StatusCode: http.StatusInternalServerError,
-				Err:        err,
-			}
+	if !containsPos {
+		// new connections are expensive to set up, so smooth out reconnect storms
+		if herr := h.admission.Admit(req.Context()); herr != nil {
+			hlog.FromRequest(req).Warn().Err(herr).Msg("not setting up connection")
+			return req, nil, herr
 		}
 	}
+
+	token, herr := h.lookupToken(req, accessToken)
+	if herr != nil {
+		return req, nil, herr
+	}
 	req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagUserID, token.UserID))
 	req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagDeviceID, token.DeviceID))
 	log := hlog.FromRequest(req).With().
@@ -386,8 +654,20 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 		Str("conn", syncReq.ConnID).
 		Logger()
 	req = req.WithContext(internal.AssociateUserIDWithRequest(req.Context(), token.UserID, token.DeviceID))
+	// requests to the homeserver on behalf of this user go to their homeserver
+	req = req.WithContext(sync2.WithServerName(req.Context(), sync2.ServerNameOf(token.UserID)))
 	internal.Logf(req.Context(), "setupConnection", "identified access token as user=%s device=%s", token.UserID, token.DeviceID)
 
+	if !containsPos {
+		if herr := h.setupLimiter.Allow(token.UserID, token.DeviceID); herr != nil {
+			log.Warn().Err(herr).Msg("not setting up connection")
+			if h.connSetups != nil {
+				h.connSetups.WithLabelValues("rate_limited").Inc()
+			}
+			return req, nil, herr
+		}
+	}
+
 	// Record the fact that we've recieved a request from this token
 	err = h.V2Store.TokensTable.MaybeUpdateLastSeen(token, time.Now())
 	if err != nil {
@@ -409,8 +689,16 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 			log.Trace().Str("conn", conn.ConnID.String()).Msg("reusing conn")
 			return req, conn, nil
 		}
-		// conn doesn't exist, we probably nuked it.
-		return req, nil, internal.ExpiredSessionError()
+		// conn doesn't exist, we probably nuked it, or restarted since the client last saw it. In
+		// the latter case the connection may be resumed, which is as expensive as a new connection.
+		if !h.ConnMap.CanResumeConns() {
+			return req, nil, internal.ExpiredSessionError()
+		}
+		if herr := h.admission.Admit(req.Context()); herr != nil {
+			log.Warn().Err(herr).Msg("not resuming connection")
+			return req, nil, herr
+		}
+		log.Trace().Msg("no conn for pos, trying to resume it")
 	}
 
 	pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
@@ -418,6 +706,7 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	expiredToken := h.EnsurePoller.EnsurePolling(req.Context(), pid, token.AccessTokenHash)
 	if expiredToken {
 		log.Error().Msg("EnsurePolling failed, returning 401")
+		h.invalidateAuthCache(token.UserID, token.DeviceID)
 		// Assumption: the only way that EnsurePolling fails is if the access token is invalid.
 		return req, nil, &internal.HandlerError{
 			StatusCode: http.StatusUnauthorized,
@@ -454,22 +743,57 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	// to check for an existing connection though, as it's possible for the client to call /sync
 	// twice for a new connection.
 	conn = h.ConnMap.CreateConn(connID, cancel, func() sync3.ConnHandler {
-		return NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		cs := NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.deviceUpdates, h.maxCoalesceWindow, h.maxTrackedRooms)
+		cs.isGuest = token.IsGuest
+		cs.live.countUpdateThrottle = h.countUpdateThrottle
+		cs.live.countUpdateThrottleMinRooms = h.countUpdateThrottleMinRooms
+		cs.initialSyncs = h.initialSyncs
+		if h.connDebugResponses > 0 {
+			cs.debug = newConnDebugger(h.connDebugResponses)
+		}
+		cs.responseFilter = h.responseFilter
+		return cs
 	})
 	log.Info().Msg("created new connection")
 	return req, conn, nil
 }
 
-func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, accessToken string, logger *zerolog.Logger) (*sync2.Token, *internal.HandlerError) {
-	// We don't recognise the given accessToken. Ask the homeserver who owns it.
-	userID, deviceID, err := h.V2.WhoAmI(ctx, accessToken)
+// lookupToken returns the record of the access token, asking the homeserver about tokens we have
+// not seen before.
+func (h *SyncLiveHandler) lookupToken(req *http.Request, accessToken string) (*sync2.Token, *internal.HandlerError) {
+	token, err := h.V2Store.TokensTable.Token(accessToken)
 	if err != nil {
-		if err == sync2.HTTP401 {
-			return nil, &internal.HandlerError{
-				StatusCode: 401,
-				Err:        fmt.Errorf("/whoami returned HTTP 401"),
-				ErrCode:    "M_UNKNOWN_TOKEN",
+		if err == sql.ErrNoRows {
+			hlog.FromRequest(req).Info().Msg("Received connection from unknown access token, querying with homeserver")
+			ctx := req.Context()
+			if h.serverNameForHost != nil {
+				serverName, ok := h.serverNameForHost(req.Host)
+				if !ok {
+					return nil, &internal.HandlerError{
+						StatusCode: http.StatusNotFound,
+						ErrCode:    "M_UNRECOGNIZED",
+						Err:        fmt.Errorf("no homeserver is served at %s", req.Host),
+					}
+				}
+				ctx = sync2.WithServerName(ctx, serverName)
 			}
+			return h.identifyUnknownAccessToken(ctx, accessToken, hlog.FromRequest(req))
+		}
+		hlog.FromRequest(req).Err(err).Msg("Failed to lookup access token")
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	return token, nil
+}
+
+func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, accessToken string, logger *zerolog.Logger) (*sync2.Token, *internal.HandlerError) {
+	// We don't recognise the given accessToken. Ask the authenticator (usually the homeserver) who owns it.
+	userID, deviceID, isGuest, err := h.Authenticator.Authenticate(ctx, accessToken)
+	if err != nil {
+		if herr := unknownTokenError(err); herr != nil {
+			return nil, herr
 		}
 		log.Warn().Err(err).Msg("failed to get user ID from device ID")
 		return nil, &internal.HandlerError{
@@ -477,6 +801,15 @@ func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, access
 			Err:        err,
 		}
 	}
+	if serverName := sync2.ServerNameFromContext(ctx); serverName != "" && sync2.ServerNameOf(userID) != serverName {
+		// don't let one homeserver vouch for the users of another
+		logger.Warn().Str("user", userID).Str("server_name", serverName).Msg("access token is for a user of another homeserver")
+		return nil, &internal.HandlerError{
+			StatusCode: 401,
+			Err:        fmt.Errorf("access token is not for a user of %s", serverName),
+			ErrCode:    "M_UNKNOWN_TOKEN",
+		}
+	}
 
 	var token *sync2.Token
 	err = sqlutil.WithTransaction(h.V2Store.DB, func(txn *sqlx.Tx) error {
@@ -486,6 +819,12 @@ func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, access
 			logger.Warn().Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to insert v2 token")
 			return err
 		}
+		if isGuest {
+			if err = h.V2Store.TokensTable.SetIsGuest(txn, token, true); err != nil {
+				logger.Warn().Err(err).Str("user", userID).Str("device", deviceID).Msg("failed to mark v2 token as a guest")
+				return err
+			}
+		}
 
 		// Ensure we have a device row for this token.
 		err = h.V2Store.DevicesTable.InsertDevice(txn, userID, deviceID)
@@ -499,10 +838,27 @@ func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, access
 	if err != nil {
 		return nil, &internal.HandlerError{StatusCode: 500, Err: err}
 	}
+	// if this device is already being polled, this is probably a refreshed token, so make sure the
+	// poller uses it before the old one expires
+	h.EnsurePoller.UpdateAccessToken(sync2.PollerID{UserID: userID, DeviceID: deviceID}, token.AccessTokenHash)
 
 	return token, nil
 }
 
+// unknownTokenError returns the M_UNKNOWN_TOKEN error for the client if err is sync2.HTTP401 or
+// sync2.HTTP401SoftLogout, else nil.
+func unknownTokenError(err error) *internal.HandlerError {
+	if err != sync2.HTTP401 && err != sync2.HTTP401SoftLogout {
+		return nil
+	}
+	return &internal.HandlerError{
+		StatusCode: 401,
+		Err:        err,
+		ErrCode:    "M_UNKNOWN_TOKEN",
+		SoftLogout: err == sync2.HTTP401SoftLogout,
+	}
+}
+
 func (h *SyncLiveHandler) CacheForUser(userID string) *caches.UserCache {
 	c, ok := h.userCaches.Load(userID)
 	if ok {
@@ -554,6 +910,15 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnAccountData(context.Background(), []state.AccountData{ignoreEvent[0]})
 	}
 
+	// select the push rules, to work out notification levels
+	pushRulesEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.push_rules"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load push rules for user %s: %w", userID, err)
+	}
+	if len(pushRulesEvent) == 1 {
+		uc.OnAccountData(context.Background(), []state.AccountData{pushRulesEvent[0]})
+	}
+
 	// select all room tag account data and set it
 	tagEvents, err := h.Storage.RoomAccountDatasWithType(userID, "m.tag")
 	if err != nil {
@@ -613,7 +978,8 @@ func (h *SyncLiveHandler) DeviceData(ctx context.Context, userID, deviceID strin
 	// - The response is received and the client sends the next request -> do not send deltas.
 
 	// To handle the case where responses are lost, we just need to see if this is an initial request
-	// and if so, return a "Read-Only" snapshot of the last sent device list changes. This means we may send
+	// and if so, return a "Read-Only" snapshot of the last sent device list changes, which the E2EE extension
+	// sends along with any changes since (New) as the client had no connection to get them. This means we may send
 	// duplicate device list changes if the response did in fact get to the client and the next request hit a
 	// new proxy, but that's better than losing updates. In this scenario, we do not delete any data.
 	// To ensure we delete device list updates over time, we now want to swap what was New to Sent and then
@@ -644,6 +1010,9 @@ func (h *SyncLiveHandler) TransactionIDForEvents(userID string, deviceID string,
 
 func (h *SyncLiveHandler) OnInitialSyncComplete(p *pubsub.V2InitialSyncComplete) {
 	h.EnsurePoller.OnInitialSyncComplete(p)
+	if p.Success && h.warmUps != nil {
+		h.warmUps.Enqueue(p.UserID)
+	}
 }
 
 // Called from the v2 poller, implements V2DataReceiver
@@ -663,6 +1032,10 @@ func (h *SyncLiveHandler) Accumulate(p *pubsub.V2Accumulate) {
 	internal.Logf(ctx, "room", fmt.Sprintf("%s: %d events", p.RoomID, len(events)))
 	// we have new events, notify active connections
 	for i := range events {
+		if i == 0 && p.MissingPrevious {
+			h.Dispatcher.OnNewEventAfterGap(ctx, p.RoomID, events[i], p.EventNIDs[i])
+			continue
+		}
 		h.Dispatcher.OnNewEvent(ctx, p.RoomID, events[i], p.EventNIDs[i])
 	}
 }
@@ -709,10 +1082,7 @@ func (h *SyncLiveHandler) OnDeviceData(p *pubsub.V2DeviceData) {
 	internal.Logf(ctx, "device_data", fmt.Sprintf("%v users to notify", len(p.UserIDToDeviceIDs)))
 	for userID, deviceIDs := range p.UserIDToDeviceIDs {
 		for _, deviceID := range deviceIDs {
-			conns := h.ConnMap.Conns(userID, deviceID)
-			for _, conn := range conns {
-				conn.OnUpdate(ctx, caches.DeviceDataUpdate{})
-			}
+			h.deviceUpdates.OnUpdate(ctx, userID, deviceID, caches.DeviceDataUpdate{})
 		}
 	}
 }
@@ -720,11 +1090,7 @@ func (h *SyncLiveHandler) OnDeviceData(p *pubsub.V2DeviceData) {
 func (h *SyncLiveHandler) OnDeviceMessages(p *pubsub.V2DeviceMessages) {
 	ctx, task := internal.StartTask(context.Background(), "OnDeviceMessages")
 	defer task.End()
-	conns := h.ConnMap.Conns(p.UserID, p.DeviceID)
-	for _, conn := range conns {
-		conn.OnUpdate(ctx, caches.DeviceEventsUpdate{})
-	}
-
+	h.deviceUpdates.OnUpdate(ctx, p.UserID, p.DeviceID, caches.DeviceEventsUpdate{})
 }
 
 func (h *SyncLiveHandler) OnInvite(p *pubsub.V2InviteRoom) {
@@ -797,6 +1163,36 @@ func (h *SyncLiveHandler) OnTyping(p *pubsub.V2Typing) {
 	h.Dispatcher.OnEphemeralEvent(ctx, p.RoomID, p.EphemeralEvent)
 }
 
+func (h *SyncLiveHandler) OnPresence(p *pubsub.V2Presence) {
+	ctx, task := internal.StartTask(context.Background(), "OnPresence")
+	defer task.End()
+	for _, ev := range p.Events {
+		h.Dispatcher.OnPresence(ctx, gjson.GetBytes(ev, "sender").Str, ev)
+	}
+}
+
+// Presence returns the latest m.presence events of the users joined to any of the rooms.
+func (h *SyncLiveHandler) Presence(ctx context.Context, roomIDs []string) []json.RawMessage {
+	seen := make(map[string]bool)
+	var userIDs []string
+	for _, roomID := range roomIDs {
+		for _, userID := range h.Dispatcher.JoinedUsersForRoom(roomID) {
+			if !seen[userID] {
+				seen[userID] = true
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+	userToPresence := h.GlobalCache.LoadPresence(userIDs)
+	events := make([]json.RawMessage, 0, len(userToPresence))
+	for _, userID := range userIDs {
+		if ev, ok := userToPresence[userID]; ok {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
 func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
 	ctx, task := internal.StartTask(context.Background(), "OnAccountData")
 	defer task.End()
@@ -814,6 +1210,7 @@ func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
 }
 
 func (h *SyncLiveHandler) OnExpiredToken(p *pubsub.V2ExpiredToken) {
+	h.invalidateAuthCache(p.UserID, p.DeviceID)
 	h.EnsurePoller.OnExpiredToken(p)
 	h.ConnMap.CloseConnsForDevice(p.UserID, p.DeviceID)
 }
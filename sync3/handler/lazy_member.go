@@ -1,20 +1,20 @@
 package handler
 
+// LazyCache remembers which member events a connection has sent for the rooms whose members are
+// lazy loaded, so each member is only sent once to the client, which keeps the members it has.
 type LazyCache struct {
-	cache map[string]struct{}
-	rooms map[string]struct{}
+	// room ID -> user IDs whose member events have been sent
+	rooms map[string]map[string]struct{}
 }
 
 func NewLazyCache() *LazyCache {
 	return &LazyCache{
-		cache: make(map[string]struct{}),
-		rooms: make(map[string]struct{}),
+		rooms: make(map[string]map[string]struct{}),
 	}
 }
 
 func (lc *LazyCache) IsSet(roomID, userID string) bool {
-	key := roomID + " | " + userID
-	_, exists := lc.cache[key]
+	_, exists := lc.rooms[roomID][userID]
 	return exists
 }
 
@@ -24,7 +24,11 @@ func (lc *LazyCache) IsLazyLoading(roomID string) bool {
 	return exists
 }
 
+// Add marks the room as being lazy loaded, with these users' member events sent. The room is lazy
+// loaded even if no users are given e.g because its timeline is empty, so the senders of later
+// events are lazy loaded.
 func (lc *LazyCache) Add(roomID string, userIDs ...string) {
+	lc.users(roomID)
 	for _, u := range userIDs {
 		lc.AddUser(roomID, u)
 	}
@@ -33,12 +37,26 @@ func (lc *LazyCache) Add(roomID string, userIDs ...string) {
 // AddUser to this room. Returns true if this is the first time this user has done so, and
 // hence you should include the member event for this user.
 func (lc *LazyCache) AddUser(roomID, userID string) bool {
-	lc.rooms[roomID] = struct{}{}
-	key := roomID + " | " + userID
-	_, exists := lc.cache[key]
+	users := lc.users(roomID)
+	_, exists := users[userID]
 	if exists {
 		return false
 	}
-	lc.cache[key] = struct{}{}
+	users[userID] = struct{}{}
 	return true
 }
+
+// Forget stops lazy loading the room and forgets which members were sent. Call this when the room is
+// sent in full again, as the client replaces the members it has with the ones sent then.
+func (lc *LazyCache) Forget(roomID string) {
+	delete(lc.rooms, roomID)
+}
+
+func (lc *LazyCache) users(roomID string) map[string]struct{} {
+	users, exists := lc.rooms[roomID]
+	if !exists {
+		users = make(map[string]struct{})
+		lc.rooms[roomID] = users
+	}
+	return users
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// the most we will scale up the minimum poll interval when under load.
+const maxPollIntervalScale = 10
+
+// pollIntervalAdvisor calculates the suggested_poll_interval_ms to return to clients. The
+// suggestion is advisory: it does not affect how long we will hold a long-poll request open.
+//
+// The load signal is the number of requests received in the previous second. When this is at or
+// below loadThreshold, the suggestion is the configured minimum. Above it, the minimum is scaled by
+// how far over the threshold we are, up to maxPollIntervalScale times the minimum.
+type pollIntervalAdvisor struct {
+	min           time.Duration
+	loadThreshold int
+
+	mu          sync.Mutex
+	windowStart time.Time
+	numInWindow int
+	numPrevious int
+	now         func() time.Time
+}
+
+func newPollIntervalAdvisor(min time.Duration, loadThreshold int) *pollIntervalAdvisor {
+	return &pollIntervalAdvisor{
+		min:           min,
+		loadThreshold: loadThreshold,
+		now:           time.Now,
+	}
+}
+
+// OnRequest should be called for every incoming request.
+func (a *pollIntervalAdvisor) OnRequest() {
+	if a.min == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.roll()
+	a.numInWindow++
+}
+
+// Suggested returns the current suggested poll interval, or 0 if there is no suggestion.
+func (a *pollIntervalAdvisor) Suggested() time.Duration {
+	if a.min == 0 {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.roll()
+	if a.loadThreshold <= 0 || a.numPrevious <= a.loadThreshold {
+		return a.min
+	}
+	scaled := a.min * time.Duration(a.numPrevious) / time.Duration(a.loadThreshold)
+	if scaled > a.min*maxPollIntervalScale {
+		return a.min * maxPollIntervalScale
+	}
+	return scaled
+}
+
+// roll moves to a new 1s window if the current one has elapsed. Must hold mu.
+func (a *pollIntervalAdvisor) roll() {
+	now := a.now()
+	elapsed := now.Sub(a.windowStart)
+	if elapsed < time.Second {
+		return
+	}
+	if elapsed < 2*time.Second {
+		a.numPrevious = a.numInWindow
+	} else {
+		// no requests at all in the last full window
+		a.numPrevious = 0
+	}
+	a.numInWindow = 0
+	a.windowStart = now
+}
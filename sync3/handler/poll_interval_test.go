@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollIntervalAdvisor(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+
+	// disabled: never suggests anything
+	disabled := newPollIntervalAdvisor(0, 10)
+	disabled.now = clock
+	disabled.OnRequest()
+	if got := disabled.Suggested(); got != 0 {
+		t.Fatalf("disabled advisor suggested %v", got)
+	}
+
+	a := newPollIntervalAdvisor(100*time.Millisecond, 10)
+	a.now = clock
+	if got := a.Suggested(); got != 100*time.Millisecond {
+		t.Fatalf("idle: got %v want 100ms", got)
+	}
+	// 10 req/s is at the threshold, so no scaling.
+	now = now.Add(2 * time.Second)
+	for i := 0; i < 10; i++ {
+		a.OnRequest()
+	}
+	now = now.Add(time.Second)
+	if got := a.Suggested(); got != 100*time.Millisecond {
+		t.Fatalf("at threshold: got %v want 100ms", got)
+	}
+	// 30 req/s is 3x the threshold
+	for i := 0; i < 30; i++ {
+		a.OnRequest()
+	}
+	now = now.Add(time.Second)
+	if got := a.Suggested(); got != 300*time.Millisecond {
+		t.Fatalf("3x threshold: got %v want 300ms", got)
+	}
+	// scaling is capped
+	for i := 0; i < 1000; i++ {
+		a.OnRequest()
+	}
+	now = now.Add(time.Second)
+	if got := a.Suggested(); got != maxPollIntervalScale*100*time.Millisecond {
+		t.Fatalf("capped: got %v want %v", got, maxPollIntervalScale*100*time.Millisecond)
+	}
+	// load drops off after a quiet period
+	now = now.Add(5 * time.Second)
+	if got := a.Suggested(); got != 100*time.Millisecond {
+		t.Fatalf("after load: got %v want 100ms", got)
+	}
+
+	// no threshold means the minimum is always used
+	fixed := newPollIntervalAdvisor(250*time.Millisecond, 0)
+	fixed.now = clock
+	for i := 0; i < 1000; i++ {
+		fixed.OnRequest()
+	}
+	now = now.Add(time.Second)
+	if got := fixed.Suggested(); got != 250*time.Millisecond {
+		t.Fatalf("fixed: got %v want 250ms", got)
+	}
+}
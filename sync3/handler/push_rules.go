@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/tidwall/gjson"
+)
+
+// pushRuleKinds are the kinds of push rules in the order they are evaluated.
+var pushRuleKinds = []string{"override", "content", "room", "sender", "underride"}
+
+// pushRuleEvent is a hypothetical event in a room which push rules are evaluated against, to work
+// out how the user is notified about messages in the room without needing a real event.
+type pushRuleEvent struct {
+	userID      string
+	roomID      string
+	eventType   string
+	memberCount int
+	// true if the event mentions the user
+	mentioned bool
+}
+
+// notificationLevel returns the user's effective notification level for the room, given the content
+// of their m.push_rules account data. This evaluates the push rules against an ordinary message
+// from another user and a message from another user which mentions them. Returns the empty string
+// if the push rules are not known.
+func notificationLevel(pushRules json.RawMessage, userID, roomID string, encrypted bool, memberCount int) string {
+	if len(pushRules) == 0 {
+		return ""
+	}
+	rules := gjson.GetBytes(pushRules, "global")
+	ev := pushRuleEvent{
+		userID:      userID,
+		roomID:      roomID,
+		eventType:   "m.room.message",
+		memberCount: memberCount,
+	}
+	if encrypted {
+		ev.eventType = "m.room.encrypted"
+	}
+	if pushRulesNotify(rules, ev) {
+		return sync3.NotificationLevelAll
+	}
+	ev.mentioned = true
+	if pushRulesNotify(rules, ev) {
+		return sync3.NotificationLevelMentionsOnly
+	}
+	return sync3.NotificationLevelMute
+}
+
+// pushRulesNotify returns true if the first enabled push rule which matches the event notifies.
+// Events which match no rules do not notify.
+func pushRulesNotify(rules gjson.Result, ev pushRuleEvent) bool {
+	for _, kind := range pushRuleKinds {
+		for _, rule := range rules.Get(kind).Array() {
+			if !rule.Get("enabled").Bool() || !pushRuleMatches(kind, rule, ev) {
+				continue
+			}
+			for _, action := range rule.Get("actions").Array() {
+				if action.Str == "notify" {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return false
+}
+
+func pushRuleMatches(kind string, rule gjson.Result, ev pushRuleEvent) bool {
+	switch kind {
+	case "override", "underride":
+		for _, cond := range rule.Get("conditions").Array() {
+			if !pushConditionMatches(cond, ev) {
+				return false
+			}
+		}
+		return true
+	case "room":
+		return rule.Get("rule_id").Str == ev.roomID
+	default:
+		// content rules match the body and sender rules match the sender, neither of which the
+		// hypothetical event has.
+		return false
+	}
+}
+
+func pushConditionMatches(cond gjson.Result, ev pushRuleEvent) bool {
+	switch cond.Get("kind").Str {
+	case "event_match":
+		var value string
+		switch cond.Get("key").Str {
+		case "room_id":
+			value = ev.roomID
+		case "type":
+			value = ev.eventType
+		case "content.msgtype":
+			value = "m.text"
+		default:
+			return false
+		}
+		return globMatch(cond.Get("pattern").Str, value)
+	case "event_property_contains":
+		return ev.mentioned && cond.Get("key").Str == `content.m\.mentions.user_ids` && cond.Get("value").Str == ev.userID
+	case "contains_display_name":
+		return ev.mentioned
+	case "room_member_count":
+		return memberCountMatches(cond.Get("is").Str, ev.memberCount)
+	default:
+		// e.g @room mentions and sender_notification_permission
+		return false
+	}
+}
+
+// memberCountMatches returns true if the count matches a room_member_count condition e.g ">=2".
+func memberCountMatches(is string, count int) bool {
+	op := strings.TrimRight(is, "0123456789")
+	want, err := strconv.Atoi(is[len(op):])
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "", "==":
+		return count == want
+	case "<":
+		return count < want
+	case ">":
+		return count > want
+	case "<=":
+		return count <= want
+	case ">=":
+		return count >= want
+	}
+	return false
+}
+
+// globMatch matches the whole value against a case-insensitive glob pattern, where * matches any
+// number of characters and ? matches exactly one.
+func globMatch(pattern, value string) bool {
+	p := []rune(strings.ToLower(pattern))
+	v := []rune(strings.ToLower(value))
+	// the positions to backtrack to when the last * needs to match more characters
+	starP, starV := -1, 0
+	i, j := 0, 0
+	for j < len(v) {
+		switch {
+		case i < len(p) && (p[i] == '?' || p[i] == v[j]):
+			i++
+			j++
+		case i < len(p) && p[i] == '*':
+			starP, starV = i, j
+			i++
+		case starP >= 0:
+			starV++
+			i, j = starP+1, starV
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+const pushRulesUserID = "@alice:localhost"
+
+// defaultPushRules returns m.push_rules content with the server default rules, after the given
+// user defined override and room rules.
+func defaultPushRules(overrides, rooms string) json.RawMessage {
+	return json.RawMessage(fmt.Sprintf(`{"global":{
+		"override":[%s
+			{"rule_id":".m.rule.master","default":true,"enabled":false,"conditions":[],"actions":[]},
+			{"rule_id":".m.rule.suppress_notices","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"content.msgtype","pattern":"m.notice"}],"actions":[]},
+			{"rule_id":".m.rule.member_event","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.room.member"}],"actions":[]},
+			{"rule_id":".m.rule.is_user_mention","default":true,"enabled":true,"conditions":[{"kind":"event_property_contains","key":"content.m\\.mentions.user_ids","value":"%s"}],"actions":["notify",{"set_tweak":"highlight"}]},
+			{"rule_id":".m.rule.contains_display_name","default":true,"enabled":true,"conditions":[{"kind":"contains_display_name"}],"actions":["notify",{"set_tweak":"highlight"}]},
+			{"rule_id":".m.rule.is_room_mention","default":true,"enabled":true,"conditions":[{"kind":"event_property_is","key":"content.m\\.mentions.room","value":true},{"kind":"sender_notification_permission","key":"room"}],"actions":["notify"]}
+		],
+		"content":[
+			{"rule_id":".m.rule.contains_user_name","default":true,"enabled":true,"pattern":"alice","actions":["notify"]}
+		],
+		"room":[%s],
+		"sender":[],
+		"underride":[
+			{"rule_id":".m.rule.call","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.call.invite"}],"actions":["notify"]},
+			{"rule_id":".m.rule.room_one_to_one","default":true,"enabled":true,"conditions":[{"kind":"room_member_count","is":"2"},{"kind":"event_match","key":"type","pattern":"m.room.message"}],"actions":["notify"]},
+			{"rule_id":".m.rule.encrypted_room_one_to_one","default":true,"enabled":true,"conditions":[{"kind":"room_member_count","is":"2"},{"kind":"event_match","key":"type","pattern":"m.room.encrypted"}],"actions":["notify"]},
+			{"rule_id":".m.rule.message","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.room.message"}],"actions":["notify"]},
+			{"rule_id":".m.rule.encrypted","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.room.encrypted"}],"actions":["notify"]}
+		]
+	}}`, overrides, pushRulesUserID, rooms))
+}
+
+// muteRule is the override rule clients add to mute a room.
+func muteRule(roomID string) string {
+	return fmt.Sprintf(`{"rule_id":"%s","enabled":true,"conditions":[{"kind":"event_match","key":"room_id","pattern":"%s"}],"actions":[]},`, roomID, roomID)
+}
+
+// roomRule is the room rule clients add to change the notifications for a room.
+func roomRule(roomID string, actions string) string {
+	return fmt.Sprintf(`{"rule_id":"%s","enabled":true,"actions":%s}`, roomID, actions)
+}
+
+func TestNotificationLevel(t *testing.T) {
+	roomID := "!room:localhost"
+	otherRoomID := "!other:localhost"
+	testCases := []struct {
+		name        string
+		pushRules   json.RawMessage
+		encrypted   bool
+		memberCount int
+		want        string
+	}{
+		{
+			name: "no push rules",
+			want: "",
+		},
+		{
+			name:        "default rules",
+			pushRules:   defaultPushRules("", ""),
+			memberCount: 5,
+			want:        sync3.NotificationLevelAll,
+		},
+		{
+			name:        "default rules, encrypted DM",
+			pushRules:   defaultPushRules("", ""),
+			encrypted:   true,
+			memberCount: 2,
+			want:        sync3.NotificationLevelAll,
+		},
+		{
+			name:        "muted",
+			pushRules:   defaultPushRules(muteRule(roomID), ""),
+			memberCount: 5,
+			want:        sync3.NotificationLevelMute,
+		},
+		{
+			name:        "another room is muted",
+			pushRules:   defaultPushRules(muteRule(otherRoomID), ""),
+			memberCount: 5,
+			want:        sync3.NotificationLevelAll,
+		},
+		{
+			name:        "muted with a disabled rule",
+			pushRules:   defaultPushRules(`{"rule_id":"x","enabled":false,"conditions":[{"kind":"event_match","key":"room_id","pattern":"!room:*"}],"actions":[]},`, ""),
+			memberCount: 5,
+			want:        sync3.NotificationLevelAll,
+		},
+		{
+			name:        "muted with a glob",
+			pushRules:   defaultPushRules(`{"rule_id":"x","enabled":true,"conditions":[{"kind":"event_match","key":"room_id","pattern":"!ROOM:*"}],"actions":["dont_notify"]},`, ""),
+			memberCount: 5,
+			want:        sync3.NotificationLevelMute,
+		},
+		{
+			name:        "mentions only",
+			pushRules:   defaultPushRules("", roomRule(roomID, `["dont_notify"]`)),
+			memberCount: 5,
+			want:        sync3.NotificationLevelMentionsOnly,
+		},
+		{
+			name:        "mentions only, encrypted",
+			pushRules:   defaultPushRules("", roomRule(roomID, `[]`)),
+			encrypted:   true,
+			memberCount: 5,
+			want:        sync3.NotificationLevelMentionsOnly,
+		},
+		{
+			name:        "all messages loud",
+			pushRules:   defaultPushRules("", roomRule(roomID, `["notify",{"set_tweak":"sound","value":"default"}]`)),
+			memberCount: 5,
+			want:        sync3.NotificationLevelAll,
+		},
+		{
+			name:        "master rule",
+			pushRules:   defaultPushRules(`{"rule_id":".m.rule.master","default":true,"enabled":true,"conditions":[],"actions":[]},`, ""),
+			memberCount: 5,
+			want:        sync3.NotificationLevelMute,
+		},
+		{
+			name: "messages disabled by default",
+			pushRules: json.RawMessage(`{"global":{"underride":[
+				{"rule_id":".m.rule.message","default":true,"enabled":false,"conditions":[{"kind":"event_match","key":"type","pattern":"m.room.message"}],"actions":["notify"]}
+			]}}`),
+			memberCount: 5,
+			want:        sync3.NotificationLevelMute,
+		},
+		{
+			name: "group messages off by default, DM",
+			pushRules: json.RawMessage(`{"global":{"underride":[
+				{"rule_id":".m.rule.room_one_to_one","default":true,"enabled":true,"conditions":[{"kind":"room_member_count","is":"2"},{"kind":"event_match","key":"type","pattern":"m.room.message"}],"actions":["notify"]},
+				{"rule_id":".m.rule.message","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.room.message"}],"actions":[]}
+			]}}`),
+			memberCount: 2,
+			want:        sync3.NotificationLevelAll,
+		},
+	}
+	for _, tc := range testCases {
+		got := notificationLevel(tc.pushRules, pushRulesUserID, roomID, tc.encrypted, tc.memberCount)
+		if got != tc.want {
+			t.Errorf("%s: got %q want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{pattern: "m.room.message", value: "m.room.message", want: true},
+		{pattern: "m.room.message", value: "m.room.message.extra", want: false},
+		{pattern: "m.room.*", value: "m.room.message", want: true},
+		{pattern: "*", value: "", want: true},
+		{pattern: "!room:?ocalhost", value: "!room:localhost", want: true},
+		{pattern: "!room:?", value: "!room:", want: false},
+		{pattern: "*a*b", value: "xaxxab", want: true},
+		{pattern: "*a*b", value: "xaxxabc", want: false},
+		{pattern: "!ROOM:localhost", value: "!room:LOCALHOST", want: true},
+	}
+	for _, tc := range testCases {
+		if got := globMatch(tc.pattern, tc.value); got != tc.want {
+			t.Errorf("globMatch(%q, %q): got %v want %v", tc.pattern, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestMemberCountMatches(t *testing.T) {
+	testCases := []struct {
+		is    string
+		count int
+		want  bool
+	}{
+		{is: "2", count: 2, want: true},
+		{is: "==2", count: 3, want: false},
+		{is: "<2", count: 1, want: true},
+		{is: ">2", count: 2, want: false},
+		{is: "<=2", count: 2, want: true},
+		{is: ">=10", count: 10, want: true},
+		{is: "!2", count: 3, want: false},
+		{is: "", count: 0, want: false},
+	}
+	for _, tc := range testCases {
+		if got := memberCountMatches(tc.is, tc.count); got != tc.want {
+			t.Errorf("memberCountMatches(%q, %d): got %v want %v", tc.is, tc.count, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// pushRequest is a message from the client to a pushSession. The first message starts the session
+// from Pos. Later messages change the request: they are applied at the pos of the last response
+// sent, and cut short the request waiting for updates.
+type pushRequest struct {
+	// The pos to start from. Only read from the first message. Empty for a new connection.
+	Pos string `json:"pos,omitempty"`
+	// The long-poll timeout in milliseconds to use from now on. Unset means the server default.
+	Timeout *int          `json:"timeout,omitempty"`
+	Request sync3.Request `json:"request"`
+}
+
+// pushSession sends responses for a connection to the client as soon as they are calculated, for
+// transports which can push to the client such as WebSockets. It requests responses on behalf of
+// the client in a loop, each at the pos of the last response sent, so the client does not have to
+// make requests to receive updates. As responses are delivered in order, a client which reconnects
+// should ask for the last pos it received, which is still buffered along with the response after it.
+type pushSession struct {
+	conn *sync3.Conn
+	// sends a response or a *internal.HandlerError to the client
+	send func(v any) error
+	// the timeout for requests until the client sets one
+	timeoutMSecs int
+	// called on each request before it is handled, and on each response before it is sent
+	onRequest  func(req *sync3.Request)
+	onResponse func(pos int64, resp *sync3.Response)
+
+	mu sync.Mutex
+	// messages received from the client which have not been handled yet
+	pending []*pushRequest
+	// cancels the request being handled, so pending messages are handled
+	cancelRequest context.CancelFunc
+}
+
+// run handles first, then requests responses until ctx is done or the connection returns an error.
+// Errors are sent to the client before returning them.
+func (s *pushSession) run(ctx context.Context, first *pushRequest, pos int64) error {
+	s.mu.Lock()
+	s.pending = append([]*pushRequest{first}, s.pending...)
+	s.mu.Unlock()
+	for {
+		s.mu.Lock()
+		var msg *pushRequest
+		if len(s.pending) > 0 {
+			msg = s.pending[0]
+			s.pending = s.pending[1:]
+		}
+		morePending := len(s.pending) > 0
+		reqCtx, cancelRequest := context.WithCancel(ctx)
+		s.cancelRequest = cancelRequest
+		s.mu.Unlock()
+
+		req := &sync3.Request{ConnID: first.Request.ConnID}
+		if msg != nil {
+			req = &msg.Request
+			if msg.Timeout != nil {
+				s.timeoutMSecs = *msg.Timeout
+			}
+		}
+		req.SetPos(pos)
+		req.SetTimeoutMSecs(s.timeoutMSecs)
+		if morePending {
+			// don't wait for updates when the client has already changed the request again
+			req.SetTimeoutMSecs(0)
+		}
+		if s.onRequest != nil {
+			s.onRequest(req)
+		}
+		resp, herr := s.conn.OnIncomingRequest(reqCtx, req, time.Now())
+		cancelRequest()
+		if herr != nil && herr.StatusCode == internal.StatusClientClosedRequest {
+			s.mu.Lock()
+			changed := len(s.pending) > 0
+			s.mu.Unlock()
+			if ctx.Err() != nil {
+				return herr
+			}
+			if changed {
+				continue
+			}
+			// a request on the connection over HTTP replaced this one
+			herr = &internal.HandlerError{
+				StatusCode: 409,
+				Err:        fmt.Errorf("connection was continued by another request"),
+			}
+		}
+		if herr != nil {
+			s.send(herr)
+			return herr
+		}
+		if resp.NoChange {
+			// the client already has everything: keep waiting at the same pos
+			continue
+		}
+		if s.onResponse != nil {
+			s.onResponse(pos, resp)
+		}
+		if err := s.send(resp); err != nil {
+			return err
+		}
+		pos = resp.PosInt()
+	}
+}
+
+// push queues a message from the client, cutting short the request being handled.
+func (s *pushSession) push(msg *pushRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, msg)
+	if s.cancelRequest != nil {
+		s.cancelRequest()
+	}
+}
+
+// newPushSession returns a session which sends the responses for conn with send.
+func (h *SyncLiveHandler) newPushSession(conn *sync3.Conn, send func(v any) error) *pushSession {
+	disabledFeatures := h.featureGates.Disabled(conn.DeviceID)
+	return &pushSession{
+		conn:         conn,
+		send:         send,
+		timeoutMSecs: h.ConnMap.DefaultTimeoutMSecs(),
+		onRequest: func(syncReq *sync3.Request) {
+			h.pollInterval.OnRequest()
+			syncReq.RemoveFeatures(disabledFeatures)
+		},
+		onResponse: func(pos int64, resp *sync3.Response) {
+			if numReplaced := resp.ReplaceMalformedEvents(); numReplaced > 0 {
+				logger.Warn().Int("num_replaced", numReplaced).Msg("replaced malformed events with placeholders")
+			}
+			if pos == 0 {
+				resp.Capabilities = h.capabilities.WithoutFeatures(disabledFeatures)
+			}
+		},
+	}
+}
@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"golang.org/x/net/websocket"
+)
+
+// updatesConnHandler returns an initial response, then waits for updates before returning each
+// response, unless the request has a txn_id.
+type updatesConnHandler struct {
+	updates chan int
+	count   int
+}
+
+func (h *updatesConnHandler) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req *sync3.Request, isInitial bool, start time.Time) (*sync3.Response, error) {
+	if !isInitial && req.TxnID == "" {
+		select {
+		case count := <-h.updates:
+			h.count = count
+		case <-time.After(time.Duration(req.TimeoutMSecs()) * time.Millisecond):
+			return &sync3.Response{NoChange: true}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &sync3.Response{Lists: map[string]sync3.ResponseList{"a": {Count: h.count}}}, nil
+}
+func (h *updatesConnHandler) OnUpdate(ctx context.Context, update caches.Update) {}
+func (h *updatesConnHandler) PublishEventsUpTo(roomID string, nid int64)         {}
+func (h *updatesConnHandler) Destroy()                                           {}
+func (h *updatesConnHandler) Alive() bool                                        { return true }
+func (h *updatesConnHandler) SetCancelCallback(cancel context.CancelFunc)        {}
+
+func TestPushSessionWebSocket(t *testing.T) {
+	connHandler := &updatesConnHandler{updates: make(chan int)}
+	conn := sync3.NewConn(sync3.ConnID{DeviceID: "d"}, connHandler)
+	done := make(chan error, 1)
+	srv := httptest.NewServer(websocket.Server{Handler: func(ws *websocket.Conn) {
+		var first pushRequest
+		if err := websocket.JSON.Receive(ws, &first); err != nil {
+			done <- err
+			return
+		}
+		pos, _ := strconv.ParseInt(first.Pos, 10, 64)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		session := &pushSession{conn: conn, send: sendWebSocket(ws), timeoutMSecs: 50}
+		go receiveWebSocket(ctx, ws, session, cancel)
+		done <- session.run(ctx, &first, pos)
+	}})
+	defer srv.Close()
+	dial := func() *websocket.Conn {
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), "", "http://localhost")
+		if err != nil {
+			t.Fatalf("failed to dial: %s", err)
+		}
+		return ws
+	}
+	mustReceive := func(ws *websocket.Conn) (resp sync3.Response, errcode string) {
+		t.Helper()
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg json.RawMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatalf("failed to receive: %s", err)
+		}
+		var herr struct {
+			ErrCode string `json:"errcode"`
+		}
+		json.Unmarshal(msg, &herr)
+		json.Unmarshal(msg, &resp)
+		return resp, herr.ErrCode
+	}
+	assertResponse := func(resp sync3.Response, wantPos string, wantCount int, wantTxnID string) {
+		t.Helper()
+		if resp.Pos != wantPos || resp.Lists["a"].Count != wantCount || resp.TxnID != wantTxnID {
+			t.Errorf("got pos %s count %d txn_id %q, want pos %s count %d txn_id %q",
+				resp.Pos, resp.Lists["a"].Count, resp.TxnID, wantPos, wantCount, wantTxnID)
+		}
+	}
+
+	ws := dial()
+	websocket.JSON.Send(ws, pushRequest{})
+	resp, _ := mustReceive(ws)
+	assertResponse(resp, "1", 0, "")
+	// updates are pushed without the client asking, once the timeouts with no changes are skipped
+	time.Sleep(120 * time.Millisecond)
+	connHandler.updates <- 1
+	resp, _ = mustReceive(ws)
+	assertResponse(resp, "2", 1, "")
+	connHandler.updates <- 2
+	resp, _ = mustReceive(ws)
+	assertResponse(resp, "3", 2, "")
+
+	// changing the request cuts short the request waiting for updates
+	timeout := 10000
+	websocket.JSON.Send(ws, pushRequest{Timeout: &timeout, Request: sync3.Request{TxnID: "txn"}})
+	resp, _ = mustReceive(ws)
+	assertResponse(resp, "4", 2, "txn")
+
+	ws.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session did not stop when the WebSocket closed")
+	}
+
+	// starting from a pos the connection doesn't know is an error
+	ws = dial()
+	defer ws.Close()
+	websocket.JSON.Send(ws, pushRequest{Pos: "5"})
+	_, errcode := mustReceive(ws)
+	if errcode != "M_UNKNOWN_POS" {
+		t.Errorf("got errcode %q want M_UNKNOWN_POS", errcode)
+	}
+	if err := <-done; err == nil {
+		t.Errorf("session did not return an error")
+	}
+}
+
+func TestPushSessionEvents(t *testing.T) {
+	connHandler := &updatesConnHandler{updates: make(chan int)}
+	conn := sync3.NewConn(sync3.ConnID{DeviceID: "d"}, connHandler)
+	sessions := make(chan *pushSession, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		pos, _ := strconv.ParseInt(req.URL.Query().Get("pos"), 10, 64)
+		w.WriteHeader(200)
+		session := &pushSession{conn: conn, send: sendEvents(w, w.(http.Flusher)), timeoutMSecs: 50}
+		sessions <- session
+		session.run(req.Context(), &pushRequest{}, pos)
+	}))
+	defer srv.Close()
+	open := func(pos string) (*bufio.Reader, func()) {
+		res, err := http.Get(srv.URL + "?pos=" + pos)
+		if err != nil {
+			t.Fatalf("failed to open stream: %s", err)
+		}
+		return bufio.NewReader(res.Body), func() { res.Body.Close() }
+	}
+	// reads an event, returning its fields
+	mustReceive := func(r *bufio.Reader) map[string]string {
+		t.Helper()
+		fields := map[string]string{}
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("failed to read event: %s", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				return fields
+			}
+			name, value, _ := strings.Cut(line, ": ")
+			fields[name] = value
+		}
+	}
+	assertEvent := func(event map[string]string, wantPos string, wantCount int, wantTxnID string) {
+		t.Helper()
+		var resp sync3.Response
+		if err := json.Unmarshal([]byte(event["data"]), &resp); err != nil {
+			t.Fatalf("failed to decode event %v: %s", event, err)
+		}
+		if event["id"] != wantPos || resp.Pos != wantPos || resp.Lists["a"].Count != wantCount || resp.TxnID != wantTxnID {
+			t.Errorf("got event %v, want pos %s count %d txn_id %q", event, wantPos, wantCount, wantTxnID)
+		}
+	}
+
+	r, closeStream := open("")
+	assertEvent(mustReceive(r), "1", 0, "")
+	session := <-sessions
+	connHandler.updates <- 1
+	assertEvent(mustReceive(r), "2", 1, "")
+	// messages on the side-channel change the request
+	session.push(&pushRequest{Request: sync3.Request{TxnID: "txn"}})
+	assertEvent(mustReceive(r), "3", 1, "txn")
+	closeStream()
+
+	// reconnecting at an unknown pos is an error
+	r, closeStream = open("9")
+	defer closeStream()
+	event := mustReceive(r)
+	if event["event"] != "error" || !strings.Contains(event["data"], "M_UNKNOWN_POS") {
+		t.Errorf("got event %v, want an M_UNKNOWN_POS error", event)
+	}
+}
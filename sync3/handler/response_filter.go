@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// ResponseFilter lets deployments which embed the proxy redact, drop or annotate the events and
+// rooms sent to clients, e.g for compliance. It is called on the connection's goroutine for every
+// room in a response before the response is sent, so it must not block for long.
+type ResponseFilter interface {
+	// FilterEvent returns the event to send in place of this timeline, required state, invite state
+	// or knock state event, or nil to drop it. The event is shared with other connections so must not
+	// be modified: return a modified copy instead.
+	FilterEvent(ctx context.Context, userID, roomID string, event json.RawMessage) json.RawMessage
+	// FilterRoom can change the room before it is sent e.g to rename it. Its events have already
+	// been filtered with FilterEvent.
+	FilterRoom(ctx context.Context, userID, roomID string, room *sync3.Room)
+}
+
+// SetResponseFilter filters the rooms of every response with f. Only applies to connections created
+// after this is called. nil stops filtering.
+func (h *SyncLiveHandler) SetResponseFilter(f ResponseFilter) {
+	h.responseFilter = f
+}
+
+// filterRoom returns the room after passing its events and then the room itself through f.
+func filterRoom(ctx context.Context, f ResponseFilter, userID, roomID string, room sync3.Room) sync3.Room {
+	filterEvents := func(events []json.RawMessage) []json.RawMessage {
+		if len(events) == 0 {
+			return events
+		}
+		filtered := make([]json.RawMessage, 0, len(events))
+		for _, ev := range events {
+			if ev = f.FilterEvent(ctx, userID, roomID, ev); ev != nil {
+				filtered = append(filtered, ev)
+			}
+		}
+		return filtered
+	}
+	// the live events are the last NumLive in the timeline, so count how many of them are kept
+	firstLive := len(room.Timeline) - room.NumLive
+	var timeline []json.RawMessage
+	if len(room.Timeline) > 0 {
+		timeline = make([]json.RawMessage, 0, len(room.Timeline))
+		room.NumLive = 0
+	}
+	for i, ev := range room.Timeline {
+		if ev = f.FilterEvent(ctx, userID, roomID, ev); ev == nil {
+			continue
+		}
+		timeline = append(timeline, ev)
+		if i >= firstLive {
+			room.NumLive++
+		}
+	}
+	room.Timeline = timeline
+	room.RequiredState = filterEvents(room.RequiredState)
+	room.InviteState = filterEvents(room.InviteState)
+	room.KnockState = filterEvents(room.KnockState)
+	f.FilterRoom(ctx, userID, roomID, &room)
+	return room
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/tidwall/gjson"
+)
+
+// drops events from @eve and renames rooms
+type testResponseFilter struct{}
+
+func (f *testResponseFilter) FilterEvent(ctx context.Context, userID, roomID string, event json.RawMessage) json.RawMessage {
+	if gjson.GetBytes(event, "sender").Str == "@eve:localhost" {
+		return nil
+	}
+	return event
+}
+
+func (f *testResponseFilter) FilterRoom(ctx context.Context, userID, roomID string, room *sync3.Room) {
+	room.Name = userID + " in " + roomID
+}
+
+func TestFilterRoom(t *testing.T) {
+	event := func(sender string) json.RawMessage {
+		return json.RawMessage(`{"type":"m.room.message","sender":"` + sender + `"}`)
+	}
+	room := sync3.Room{
+		Name:          "Room",
+		Timeline:      []json.RawMessage{event("@eve:localhost"), event("@bob:localhost"), event("@eve:localhost"), event("@bob:localhost")},
+		NumLive:       2,
+		RequiredState: []json.RawMessage{event("@eve:localhost"), event("@bob:localhost")},
+	}
+	got := filterRoom(context.Background(), &testResponseFilter{}, "@alice:localhost", "!a:localhost", room)
+	want := sync3.Room{
+		Name:          "@alice:localhost in !a:localhost",
+		Timeline:      []json.RawMessage{event("@bob:localhost"), event("@bob:localhost")},
+		NumLive:       1,
+		RequiredState: []json.RawMessage{event("@bob:localhost")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+	// the original room is not modified
+	if len(room.Timeline) != 4 || room.NumLive != 2 || room.Name != "Room" {
+		t.Errorf("room was modified: %+v", room)
+	}
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the number of users which can wait to be warmed up. Users queued after this are not warmed up,
+// and load their caches on their first request as usual.
+const warmUpQueueSize = 1024
+
+// warmUpQueue warms up users in the background, a few at a time, once their first v2 sync has been
+// stored. Warming up a user loads the user cache, including the joined rooms connections would
+// otherwise load on the first request, which for accounts in thousands of rooms can take seconds.
+// See SetWarmUp.
+type warmUpQueue struct {
+	warm    func(userID string) error
+	queue   chan string
+	done    chan struct{}
+	mu      *sync.Mutex
+	pending map[string]struct{}
+	// nil if prometheus is disabled
+	durations prometheus.Histogram
+}
+
+func newWarmUpQueue(workers int, durations prometheus.Histogram, warm func(userID string) error) *warmUpQueue {
+	q := &warmUpQueue{
+		warm:      warm,
+		queue:     make(chan string, warmUpQueueSize),
+		done:      make(chan struct{}),
+		mu:        &sync.Mutex{},
+		pending:   make(map[string]struct{}),
+		durations: durations,
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue queues the user to be warmed up, unless they are already queued. Never blocks.
+func (q *warmUpQueue) Enqueue(userID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, exists := q.pending[userID]; exists {
+		return
+	}
+	select {
+	case q.queue <- userID:
+		q.pending[userID] = struct{}{}
+	default:
+		logger.Warn().Str("user", userID).Msg("warm up queue is full, not warming up user")
+	}
+}
+
+func (q *warmUpQueue) work() {
+	for {
+		select {
+		case <-q.done:
+			return
+		case userID := <-q.queue:
+			start := time.Now()
+			if err := q.warm(userID); err != nil {
+				logger.Err(err).Str("user", userID).Msg("failed to warm up user")
+			} else if q.durations != nil {
+				q.durations.Observe(time.Since(start).Seconds())
+			}
+			q.mu.Lock()
+			delete(q.pending, userID)
+			q.mu.Unlock()
+		}
+	}
+}
+
+// Close stops warming up users. Users still queued are not warmed up.
+func (q *warmUpQueue) Close() {
+	close(q.done)
+}
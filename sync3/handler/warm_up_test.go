@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that users are warmed up in the background, and that a user who is already queued is not
+// queued again.
+func TestWarmUpQueue(t *testing.T) {
+	block := make(chan struct{})
+	warmed := make(chan string, 10)
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	q := newWarmUpQueue(1, nil, func(userID string) error {
+		<-block
+		mu.Lock()
+		calls[userID]++
+		mu.Unlock()
+		warmed <- userID
+		return nil
+	})
+	defer q.Close()
+
+	// the worker blocks on alice, so bob is queued twice whilst alice is being warmed up
+	q.Enqueue("@alice:localhost")
+	q.Enqueue("@bob:localhost")
+	q.Enqueue("@bob:localhost")
+	close(block)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-warmed:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for users to be warmed up")
+		}
+	}
+	select {
+	case userID := <-warmed:
+		t.Fatalf("%s was warmed up twice", userID)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// once warmed up, users can be queued again e.g after their caches were invalidated
+	q.Enqueue("@bob:localhost")
+	select {
+	case <-warmed:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for bob to be warmed up again")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["@alice:localhost"] != 1 || calls["@bob:localhost"] != 2 {
+		t.Errorf("got warm up calls %v", calls)
+	}
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/rs/zerolog/hlog"
+	"golang.org/x/net/websocket"
+)
+
+// webSocketWriteTimeout is how long to wait for a response to be written to a WebSocket before
+// giving up on the client.
+const webSocketWriteTimeout = 30 * time.Second
+
+// sendWebSocket returns a pushSession send function which JSON-encodes messages to ws.
+func sendWebSocket(ws *websocket.Conn) func(v any) error {
+	return func(v any) error {
+		if err := ws.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout)); err != nil {
+			return err
+		}
+		if herr, ok := v.(*internal.HandlerError); ok {
+			return websocket.Message.Send(ws, string(herr.JSON()))
+		}
+		return websocket.JSON.Send(ws, v)
+	}
+}
+
+// receiveWebSocket pushes messages from ws to the session until the WebSocket closes, then calls
+// done.
+func receiveWebSocket(ctx context.Context, ws *websocket.Conn, session *pushSession, done context.CancelFunc) {
+	defer done()
+	for ctx.Err() == nil {
+		var msg pushRequest
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+		if herr := validateRequest(&msg.Request); herr != nil {
+			session.send(herr)
+			return
+		}
+		session.push(&msg)
+	}
+}
+
+// serveWebSocket is the entry point for sync v3 over a WebSocket. Each message is a pushRequest,
+// and responses are sent as they are calculated: see pushSession.
+func (h *SyncLiveHandler) serveWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	req := ws.Request()
+	log := hlog.FromRequest(req)
+	var first pushRequest
+	if err := websocket.JSON.Receive(ws, &first); err != nil {
+		log.Warn().Err(err).Msg("failed to read/decode first WebSocket message")
+		return
+	}
+	sendError := func(herr *internal.HandlerError) {
+		log.Warn().Err(herr).Msg("closing WebSocket")
+		sendWebSocket(ws)(herr)
+	}
+	if herr := validateRequest(&first.Request); herr != nil {
+		sendError(herr)
+		return
+	}
+	var pos int64
+	if first.Pos != "" {
+		var err error
+		if pos, err = strconv.ParseInt(first.Pos, 10, 64); err != nil {
+			sendError(&internal.HandlerError{
+				StatusCode: 400,
+				Err:        fmt.Errorf("invalid pos: %s", first.Pos),
+			})
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	req, conn, herr := h.setupConnection(req.WithContext(ctx), cancel, &first.Request, first.Pos != "")
+	if herr != nil {
+		sendError(herr)
+		return
+	}
+	session := h.newPushSession(conn, sendWebSocket(ws))
+	go receiveWebSocket(req.Context(), ws, session, cancel)
+	err := session.run(req.Context(), &first, pos)
+	log.Debug().Err(err).Str("conn", conn.ConnID.String()).Msg("WebSocket closed")
+}
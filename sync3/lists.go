@@ -118,12 +118,12 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 		// We'll automatically use the LastInterestedEventTimestamps provided by the
 		// caller, so that recency sorts work.
 	}
-	// filter.Include may call on this room ID in the RoomFinder, so make sure it finds it.
+	// list.Include may call on this room ID in the RoomFinder, so make sure it finds it.
 	s.allRooms[r.RoomID] = &r
 
 	for listKey, list := range s.lists {
-		_, alreadyExists := list.roomIDToIndex[r.RoomID]
-		shouldExist := list.filter.Include(&r, s)
+		_, alreadyExists := list.IndexOf(r.RoomID)
+		shouldExist := list.Include(&r)
 		if shouldExist && r.HasLeft {
 			shouldExist = false
 		}
@@ -214,8 +214,7 @@ func (s *InternalRequestLists) ListsByVisibleRoomIDs(muxedReqLists map[string]Re
 		} else {
 			subslices := reqList.Ranges.SliceInto(sortedRooms)
 			for _, subslice := range subslices {
-				sortedRooms = subslice.(*SortableRooms)
-				for _, roomID := range sortedRooms.RoomIDs() {
+				for _, roomID := range subslice.(SortableRoomsSubslice) {
 					listsByRoomIDs[roomID] = append(listsByRoomIDs[roomID], listKey)
 				}
 			}
@@ -233,6 +232,8 @@ func (s *InternalRequestLists) AssignList(ctx context.Context, listKey string, f
 			return s.lists[listKey], false
 		}
 	}
+	ctx, span := internal.StartSpan(ctx, "AssignList")
+	defer span.End()
 	roomIDs := make([]string, len(s.allRooms))
 	i := 0
 	for roomID := range s.allRooms {
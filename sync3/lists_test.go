@@ -49,3 +49,30 @@ func addRooms(list *sync3.InternalRequestLists, n int) {
 		})
 	}
 }
+
+// Benchmark moving rooms in a huge account's list, as happens on every live update.
+func BenchmarkCalculateListOpsLargeAccount(b *testing.B) {
+	const numRooms = 10000
+	const listKey = "benchmark"
+	list := sync3.NewInternalRequestLists()
+	addRooms(list, numRooms)
+	sortedRooms, _ := list.AssignList(context.Background(), listKey, &sync3.RequestFilters{}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	reqList := &sync3.RequestList{
+		Sort:   []string{sync3.SortByRecency},
+		Ranges: sync3.SliceRanges{{0, 20}},
+	}
+	allRoomIDs := sortedRooms.RoomIDs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// bump a room from further down the list to the top
+		roomID := allRoomIDs[(i*7919)%numRooms]
+		r := *list.ReadOnlyRoom(roomID)
+		ts := uint64(timestamp.Add(time.Duration(numRooms+i) * time.Minute).UnixMilli())
+		r.LastMessageTimestamp = ts
+		r.LastInterestedEventTimestamps = map[string]uint64{listKey: ts}
+		delta := list.SetRoom(r)
+		for _, listDelta := range delta.Lists {
+			sync3.CalculateListOps(context.Background(), reqList, sortedRooms, roomID, listDelta.Op)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package sync3
 
 import (
 	"context"
+	"sort"
+
 	"github.com/matrix-org/sliding-sync/internal"
 )
 
@@ -9,6 +11,7 @@ type List interface {
 	IndexOf(roomID string) (int, bool)
 	Len() int64
 	Sort(sortBy []string) error
+	SortRoom(roomID string, sortBy []string) error
 	Add(roomID string) bool
 	Remove(roomID string) int
 	Get(index int) string
@@ -48,7 +51,7 @@ func CalculateListOps(ctx context.Context, reqList *RequestList, list List, room
 		wasInsideRange = false // can't be inside the range if this is a new room
 		list.Add(roomID)
 		// this should only move exactly 1 room at most as this is called for every single update
-		if err := list.Sort(reqList.Sort); err != nil {
+		if err := list.SortRoom(roomID, reqList.Sort); err != nil {
 			logger.Err(err).Msg("cannot sort list")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
@@ -66,7 +69,7 @@ func CalculateListOps(ctx context.Context, reqList *RequestList, list List, room
 		}
 	case ListOpChange:
 		// this should only move exactly 1 room at most as this is called for every single update
-		if err := list.Sort(reqList.Sort); err != nil {
+		if err := list.SortRoom(roomID, reqList.Sort); err != nil {
 			logger.Err(err).Msg("cannot sort list")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
@@ -140,3 +143,53 @@ func CalculateListOps(ctx context.Context, reqList *RequestList, list List, room
 	}
 	return
 }
+
+// CoalesceSyncOps merges SYNC operations over contiguous ranges into a single SYNC covering the
+// whole range, e.g SYNC [0,9] and SYNC [10,19] become SYNC [0,19] with the room IDs of both.
+//
+// This is only done for runs of consecutive SYNC operations: any other operation between two SYNCs
+// applies to the list as it was after the first SYNC, so merging across it would change the result.
+// SYNCs within a run never overlap, as request ranges cannot overlap, so they can be applied in any
+// order and are sorted by range before merging. Other operations are returned in their original
+// order.
+func CoalesceSyncOps(ops []ResponseOp) []ResponseOp {
+	result := make([]ResponseOp, 0, len(ops))
+	var run []*ResponseOpRange
+	flush := func() {
+		sort.SliceStable(run, func(i, j int) bool {
+			return run[i].Range[0] < run[j].Range[0]
+		})
+		var prev *ResponseOpRange
+		for _, op := range run {
+			if prev != nil && prev.Range[1]+1 == op.Range[0] && isCompleteSync(prev) && isCompleteSync(op) {
+				prev.Range[1] = op.Range[1]
+				prev.RoomIDs = append(prev.RoomIDs, op.RoomIDs...)
+				continue
+			}
+			// copy so we don't modify the caller's operations when merging into this one
+			prev = &ResponseOpRange{
+				Operation: op.Operation,
+				Range:     op.Range,
+				RoomIDs:   append([]string{}, op.RoomIDs...),
+			}
+			result = append(result, prev)
+		}
+		run = nil
+	}
+	for _, op := range ops {
+		if rangeOp, ok := op.(*ResponseOpRange); ok && rangeOp.Operation == OpSync {
+			run = append(run, rangeOp)
+			continue
+		}
+		flush()
+		result = append(result, op)
+	}
+	flush()
+	return result
+}
+
+// isCompleteSync returns true if the SYNC has a room ID for every index in its range, which is
+// required to merge it without shifting the room IDs of the other SYNC.
+func isCompleteSync(op *ResponseOpRange) bool {
+	return int64(len(op.RoomIDs)) == op.Range[1]-op.Range[0]+1
+}
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/testutils"
 )
 
@@ -763,6 +767,60 @@ func assertSingleOp(t *testing.T, op ResponseOp, opName string, index int, optRo
 	}
 }
 
+// Test that back-to-back responses for rooms whose order has not changed emit no ops, whichever
+// room the update was for and wherever it is relative to the windows. This includes rooms which
+// tie with their neighbours, as these must not swap places.
+func TestCalculateListOps_NoOpsWithoutReorder(t *testing.T) {
+	const listKey = "a"
+	var rooms []*RoomConnMetadata
+	for i := 0; i < 10; i++ {
+		rooms = append(rooms, &RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: fmt.Sprintf("!%d:localhost", i),
+			},
+			UserRoomData: caches.UserRoomData{
+				CanonicalisedName: "room",
+			},
+			// pairs of rooms have the same timestamp
+			LastInterestedEventTimestamps: map[string]uint64{listKey: uint64(1000 - (i / 2))},
+		})
+	}
+	f := newFinder(rooms)
+	testCases := []struct {
+		name   string
+		sortBy []string
+		ranges SliceRanges
+	}{
+		{name: "everything in the window", sortBy: []string{SortByRecency}, ranges: SliceRanges{{0, 20}}},
+		{name: "part of the list in the window", sortBy: []string{SortByRecency}, ranges: SliceRanges{{0, 2}}},
+		{name: "many windows", sortBy: []string{SortByRecency}, ranges: SliceRanges{{1, 3}, {6, 8}}},
+		{name: "every room ties", sortBy: []string{SortByName}, ranges: SliceRanges{{2, 5}}},
+		{name: "many sort orders", sortBy: []string{SortByNotificationLevel, SortByRecency, SortByName}, ranges: SliceRanges{{0, 4}, {5, 9}}},
+	}
+	for _, tc := range testCases {
+		list := NewSortableRooms(f, listKey, f.roomIDs)
+		if err := list.Sort(tc.sortBy); err != nil {
+			t.Fatalf("%s: Sort: %s", tc.name, err)
+		}
+		wantRoomIDs := list.RoomIDs()
+		reqList := &RequestList{
+			Ranges: tc.ranges,
+			Sort:   tc.sortBy,
+		}
+		// every room is updated twice, as if by two updates which race
+		for i := 0; i < 2; i++ {
+			for _, roomID := range f.roomIDs {
+				gotOps, gotSubs := CalculateListOps(context.Background(), reqList, list, roomID, ListOpChange)
+				assertEqualOps(t, tc.name+" "+roomID, gotOps, nil)
+				assertEqualSlices(t, tc.name+" "+roomID, gotSubs, nil)
+			}
+		}
+		if got := list.RoomIDs(); !reflect.DeepEqual(got, wantRoomIDs) {
+			t.Errorf("%s: list was reordered: got %v want %v", tc.name, got, wantRoomIDs)
+		}
+	}
+}
+
 func assertEqualOps(t *testing.T, name string, gotOps, wantOps []ResponseOp) {
 	t.Helper()
 	got, err := json.Marshal(gotOps)
@@ -808,6 +866,9 @@ func (s *stringList) Sort(sortBy []string) error {
 	}
 	return nil
 }
+func (s *stringList) SortRoom(roomID string, sortBy []string) error {
+	return s.Sort(sortBy)
+}
 func (s *stringList) Add(roomID string) bool {
 	_, ok := s.roomIDToIndex[roomID]
 	if ok {
@@ -838,3 +899,146 @@ func (s *stringList) Remove(roomID string) int {
 func (s *stringList) Get(index int) string {
 	return s.roomIDs[index]
 }
+
+// applyOps applies the operations to a client's view of a list, as index -> room ID.
+func applyOps(t *testing.T, list map[int64]string, ops []ResponseOp) map[int64]string {
+	t.Helper()
+	result := make(map[int64]string, len(list))
+	for k, v := range list {
+		result[k] = v
+	}
+	for _, op := range ops {
+		switch o := op.(type) {
+		case *ResponseOpRange:
+			for i := o.Range[0]; i <= o.Range[1]; i++ {
+				if o.Operation == OpInvalidate {
+					delete(result, i)
+				} else {
+					result[i] = o.RoomIDs[i-o.Range[0]]
+				}
+			}
+		case *ResponseOpSingle:
+			// written to their index without shifting: enough to compare op lists which only
+			// differ in their SYNCs.
+			result[int64(*o.Index)] = o.RoomID
+		default:
+			t.Fatalf("unknown op %+v", op)
+		}
+	}
+	return result
+}
+
+func TestCoalesceSyncOps(t *testing.T) {
+	testCases := []struct {
+		name string
+		ops  []ResponseOp
+		want []ResponseOp
+	}{
+		{
+			name: "no ops",
+			ops:  []ResponseOp{},
+			want: []ResponseOp{},
+		},
+		{
+			name: "single SYNC",
+			ops: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"a", "b"}},
+			},
+			want: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"a", "b"}},
+			},
+		},
+		{
+			name: "contiguous SYNCs",
+			ops: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"a", "b"}},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{2, 2}, RoomIDs: []string{"c"}},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{3, 4}, RoomIDs: []string{"d", "e"}},
+			},
+			want: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 4}, RoomIDs: []string{"a", "b", "c", "d", "e"}},
+			},
+		},
+		{
+			name: "contiguous SYNCs out of order",
+			ops: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{2, 3}, RoomIDs: []string{"c", "d"}},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"a", "b"}},
+			},
+			want: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 3}, RoomIDs: []string{"a", "b", "c", "d"}},
+			},
+		},
+		{
+			name: "gap between SYNCs",
+			ops: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"a", "b"}},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{3, 4}, RoomIDs: []string{"d", "e"}},
+			},
+			want: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"a", "b"}},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{3, 4}, RoomIDs: []string{"d", "e"}},
+			},
+		},
+		{
+			name: "INVALIDATE before SYNCs",
+			ops: []ResponseOp{
+				&ResponseOpRange{Operation: OpInvalidate, Range: [2]int64{10, 19}},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"a", "b"}},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{2, 3}, RoomIDs: []string{"c", "d"}},
+			},
+			want: []ResponseOp{
+				&ResponseOpRange{Operation: OpInvalidate, Range: [2]int64{10, 19}},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 3}, RoomIDs: []string{"a", "b", "c", "d"}},
+			},
+		},
+		{
+			name: "DELETE/INSERT between SYNCs",
+			ops: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"a", "b"}},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(1)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "b"},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{2, 3}, RoomIDs: []string{"c", "d"}},
+			},
+			want: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 1}, RoomIDs: []string{"a", "b"}},
+				&ResponseOpSingle{Operation: OpDelete, Index: ptr(1)},
+				&ResponseOpSingle{Operation: OpInsert, Index: ptr(0), RoomID: "b"},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{2, 3}, RoomIDs: []string{"c", "d"}},
+			},
+		},
+		{
+			name: "SYNC with missing rooms",
+			ops: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 2}, RoomIDs: []string{"a", "b"}},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{3, 4}, RoomIDs: []string{"d", "e"}},
+			},
+			want: []ResponseOp{
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{0, 2}, RoomIDs: []string{"a", "b"}},
+				&ResponseOpRange{Operation: OpSync, Range: [2]int64{3, 4}, RoomIDs: []string{"d", "e"}},
+			},
+		},
+	}
+	initial := map[int64]string{0: "z", 1: "y", 10: "x", 11: "w"}
+	for _, tc := range testCases {
+		original, err := json.Marshal(tc.ops)
+		if err != nil {
+			t.Fatalf("%s: failed to marshal ops: %s", tc.name, err)
+		}
+		got := CoalesceSyncOps(tc.ops)
+		assertEqualOps(t, tc.name, got, tc.want)
+		// the caller's ops must not be modified
+		after, _ := json.Marshal(tc.ops)
+		if !bytes.Equal(original, after) {
+			t.Errorf("%s: ops were modified:\n%s\n%s", tc.name, string(original), string(after))
+		}
+		if tc.name == "SYNC with missing rooms" {
+			continue // applyOps cannot apply incomplete SYNCs
+		}
+		gotList := applyOps(t, initial, got)
+		wantList := applyOps(t, initial, tc.ops)
+		if !reflect.DeepEqual(gotList, wantList) {
+			t.Errorf("%s: coalesced ops are not equivalent: got %v want %v", tc.name, gotList, wantList)
+		}
+	}
+}
@@ -4,35 +4,67 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/tidwall/gjson"
+	"golang.org/x/exp/slices"
 )
 
 var (
 	SortByName              = "by_name"
 	SortByRecency           = "by_recency"
 	SortByNotificationLevel = "by_notification_level"
-	SortByNotificationCount = "by_notification_count" // deprecated
-	SortByHighlightCount    = "by_highlight_count"    // deprecated
-	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByNotificationLevel}
+	SortByNotificationCount = "by_notification_count"
+	SortByHighlightCount    = "by_highlight_count"
+	SortByTag               = "by_tag"
+	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByNotificationLevel, SortByTag}
 
 	Wildcard     = "*"
 	StateKeyLazy = "$LAZY"
 	StateKeyMe   = "$ME"
+	// The thread ID in timeline_threads for events which are not in a thread, as in MSC3771.
+	ThreadIDMain = "main"
 
 	DefaultTimelineLimit = int64(20)
-	DefaultTimeoutMSecs  = 10 * 1000 // 10s
+	// The default maximum number of live events returned per room in a single response
+	DefaultLiveEventLimit = int64(50)
+	DefaultTimeoutMSecs   = 10 * 1000 // 10s
 )
 
 type Request struct {
-	TxnID             string                      `json:"txn_id"`
+	TxnID string `json:"txn_id"`
+	// An opaque value echoed in the response to this request, so clients which pipeline requests
+	// can correlate responses with requests. Unlike txn_id it has no other effect, and it is
+	// echoed on every response including retransmits of a buffered response. Not sticky.
+	Nonce             string                      `json:"nonce,omitempty"`
 	ConnID            string                      `json:"conn_id"`
 	Lists             map[string]RequestList      `json:"lists"`
 	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
 	UnsubscribeRooms  []string                    `json:"unsubscribe_rooms"`
 	Extensions        extensions.Request          `json:"extensions"`
+	// The number of milliseconds to keep collecting live updates for after the first live update
+	// arrives, before returning a response. Sticky. Bounded by the server. Unset or 0 means
+	// return immediately.
+	CoalesceMSecs *int64 `json:"coalesce_ms,omitempty"`
+	// If true, long polls only return early for urgent updates: see connStateLive.isUrgent. Other
+	// updates are still included when the response is next returned, e.g on timeout. Sticky.
+	Quiet *bool `json:"quiet,omitempty"`
+	// The room the client has open in the foreground. Live events in this room are returned
+	// as soon as possible, ignoring coalesce_ms and waking clients in quiet mode. Sticky. Set to
+	// the empty string to clear.
+	FocusRoom *string `json:"focus_room,omitempty"`
+	// If true, responses include `rooms_removed`: the rooms which the user left, was kicked or
+	// banned from, or rejected an invite for, since the previous response. Sticky.
+	RoomsRemoved *bool `json:"include_rooms_removed,omitempty"`
+	// The approximate maximum number of bytes of room data in a response. When the rooms in a
+	// response do not fit, rooms from lower priority lists are left out and sent in a later
+	// response: see RequestList.Priority. List counts and operations are always sent. Sticky.
+	// Unset or 0 means no limit.
+	MaxResponseBytes *int `json:"max_response_bytes,omitempty"`
 
 	// set via query params or inferred
 	pos          int64
@@ -46,6 +78,9 @@ func (r *Request) Validate() error {
 	if len(r.TxnID) > 64 {
 		return fmt.Errorf("txn_id is too long: %d > 64", len(r.TxnID))
 	}
+	if len(r.Nonce) > 64 {
+		return fmt.Errorf("nonce is too long: %d > 64", len(r.Nonce))
+	}
 	return nil
 }
 
@@ -57,12 +92,55 @@ type RequestList struct {
 	SlowGetAllRooms *bool           `json:"slow_get_all_rooms,omitempty"`
 	Deleted         bool            `json:"deleted,omitempty"`
 	BumpEventTypes  []string        `json:"bump_event_types"`
+	// If true, only return list operations for this list and no room data. Clients obtain room
+	// data for these rooms via room_subscriptions, or another list which includes them.
+	OpsOnly *bool `json:"ops_only,omitempty"`
+	// If true, echo the sort and filters which were applied to this list in the response.
+	Debug *bool `json:"debug,omitempty"`
+	// If true, include the change in count since the previous response as `count_delta`.
+	CountDelta *bool `json:"count_delta,omitempty"`
+	// When the response exceeds `max_response_bytes`, rooms in lists with a higher priority are
+	// sent before rooms in lists with a lower priority. Defaults to 0, and may be negative.
+	Priority *int `json:"priority,omitempty"`
+	// If true, SYNC operations over contiguous ranges are merged into a single SYNC covering the
+	// whole range. See CoalesceSyncOps.
+	CoalesceSyncOps *bool `json:"coalesce_sync_ops,omitempty"`
+	// If true, include the index of each room in the ops in the full sorted list as `indexes`.
+	Indexes *bool `json:"include_indexes,omitempty"`
+}
+
+// ResponsePriority returns the priority of this list when trimming responses.
+func (rl *RequestList) ResponsePriority() int {
+	if rl.Priority == nil {
+		return 0
+	}
+	return *rl.Priority
+}
+
+func (rl *RequestList) IsDebug() bool {
+	return rl.Debug != nil && *rl.Debug
+}
+
+func (rl *RequestList) WantsCountDelta() bool {
+	return rl.CountDelta != nil && *rl.CountDelta
+}
+
+func (rl *RequestList) WantsCoalescedSyncOps() bool {
+	return rl.CoalesceSyncOps != nil && *rl.CoalesceSyncOps
+}
+
+func (rl *RequestList) WantsIndexes() bool {
+	return rl.Indexes != nil && *rl.Indexes
 }
 
 func (rl *RequestList) ShouldGetAllRooms() bool {
 	return rl.SlowGetAllRooms != nil && *rl.SlowGetAllRooms
 }
 
+func (rl *RequestList) IsOpsOnly() bool {
+	return rl.OpsOnly != nil && *rl.OpsOnly
+}
+
 func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
 	prevLen := 0
 	if rl != nil {
@@ -263,6 +341,11 @@ func (rl *RequestList) WriteSwapOp(
 func (r *Request) SetPos(pos int64) {
 	r.pos = pos
 }
+
+// Pos returns the pos the request was made at, which is 0 for the first request on a connection.
+func (r *Request) Pos() int64 {
+	return r.pos
+}
 func (r *Request) TimeoutMSecs() int {
 	return r.timeoutMSecs
 }
@@ -270,15 +353,74 @@ func (r *Request) SetTimeoutMSecs(timeout int) {
 	r.timeoutMSecs = timeout
 }
 
+// CoalesceWindow returns the coalescing window requested by the client, clamped to [0, max].
+func (r *Request) CoalesceWindow(max time.Duration) time.Duration {
+	if r.CoalesceMSecs == nil || *r.CoalesceMSecs <= 0 {
+		return 0
+	}
+	if *r.CoalesceMSecs > max.Milliseconds() {
+		return max
+	}
+	return time.Duration(*r.CoalesceMSecs) * time.Millisecond
+}
+
+func (r *Request) IsQuiet() bool {
+	return r.Quiet != nil && *r.Quiet
+}
+
+func (r *Request) IncludeRoomsRemoved() bool {
+	return r.RoomsRemoved != nil && *r.RoomsRemoved
+}
+
+// ResponseByteLimit returns the maximum number of bytes of room data in a response, or 0 if there
+// is no limit.
+func (r *Request) ResponseByteLimit() int {
+	if r.MaxResponseBytes == nil || *r.MaxResponseBytes < 0 {
+		return 0
+	}
+	return *r.MaxResponseBytes
+}
+
+// FocusRoomID returns the room ID of the focus room, or the empty string if there is no focus room.
+func (r *Request) FocusRoomID() string {
+	if r.FocusRoom == nil {
+		return ""
+	}
+	return *r.FocusRoom
+}
+
 // Same determines if the given request would produce the same output as the other
 // if given the same input data.
+// Summary describes the shape of the request for logs and error reports, without room IDs or
+// filter values which may be private.
+func (r *Request) Summary() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "pos=%d timeout=%d", r.pos, r.timeoutMSecs)
+	listKeys := r.ListKeys()
+	sort.Strings(listKeys)
+	for _, listKey := range listKeys {
+		list := r.Lists[listKey]
+		fmt.Fprintf(&sb, " list[%q]={ranges=%v sort=%v filters=%v timeline_limit=%d}",
+			listKey, list.Ranges, list.Sort, list.Filters != nil, list.TimelineLimit)
+	}
+	fmt.Fprintf(&sb, " room_subscriptions=%d unsubscribe_rooms=%d", len(r.RoomSubscriptions), len(r.UnsubscribeRooms))
+	var extNames []string
+	for _, ext := range r.Extensions.EnabledExtensions() {
+		extNames = append(extNames, ext.Name())
+	}
+	fmt.Fprintf(&sb, " extensions=%v", extNames)
+	return sb.String()
+}
+
 func (r *Request) Same(other *Request) bool {
-	// If a client changes nothing but the txn_id field, we need to consider the
-	// requests the same. Therefore we blank out the txn_id before marshaling.
+	// If a client changes nothing but the txn_id or nonce fields, we need to consider the
+	// requests the same. Therefore we blank them out before marshaling.
 	rCopy := *r
 	otherCopy := *other
 	rCopy.TxnID = ""
 	otherCopy.TxnID = ""
+	rCopy.Nonce = ""
+	otherCopy.Nonce = ""
 	serialised, err := json.Marshal(rCopy)
 	if err != nil {
 		return false
@@ -328,6 +470,26 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 	// conn ID isn't sticky, always use the nextReq value. This is only useful for logging,
 	// as the conn ID is used primarily in conn_map.go
 	result.ConnID = nextReq.ConnID
+	result.CoalesceMSecs = nextReq.CoalesceMSecs
+	if result.CoalesceMSecs == nil {
+		result.CoalesceMSecs = r.CoalesceMSecs
+	}
+	result.Quiet = nextReq.Quiet
+	if result.Quiet == nil {
+		result.Quiet = r.Quiet
+	}
+	result.FocusRoom = nextReq.FocusRoom
+	if result.FocusRoom == nil {
+		result.FocusRoom = r.FocusRoom
+	}
+	result.RoomsRemoved = nextReq.RoomsRemoved
+	if result.RoomsRemoved == nil {
+		result.RoomsRemoved = r.RoomsRemoved
+	}
+	result.MaxResponseBytes = nextReq.MaxResponseBytes
+	if result.MaxResponseBytes == nil {
+		result.MaxResponseBytes = r.MaxResponseBytes
+	}
 
 	listKeys := make(set)
 	for k := range nextReq.Lists {
@@ -378,6 +540,30 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if slowGetAllRooms == nil {
 			slowGetAllRooms = existingList.SlowGetAllRooms
 		}
+		opsOnly := nextList.OpsOnly
+		if opsOnly == nil {
+			opsOnly = existingList.OpsOnly
+		}
+		debug := nextList.Debug
+		if debug == nil {
+			debug = existingList.Debug
+		}
+		countDelta := nextList.CountDelta
+		if countDelta == nil {
+			countDelta = existingList.CountDelta
+		}
+		priority := nextList.Priority
+		if priority == nil {
+			priority = existingList.Priority
+		}
+		coalesceSyncOps := nextList.CoalesceSyncOps
+		if coalesceSyncOps == nil {
+			coalesceSyncOps = existingList.CoalesceSyncOps
+		}
+		indexes := nextList.Indexes
+		if indexes == nil {
+			indexes = existingList.Indexes
+		}
 		includeOldRooms := nextList.IncludeOldRooms
 		if includeOldRooms == nil {
 			includeOldRooms = existingList.IncludeOldRooms
@@ -398,19 +584,110 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		if heroes == nil {
 			heroes = existingList.Heroes
 		}
+		joinRules := nextList.JoinRules
+		if joinRules == nil {
+			joinRules = existingList.JoinRules
+		}
+		create := nextList.Create
+		if create == nil {
+			create = existingList.Create
+		}
+		timelineSenders := nextList.TimelineSenders
+		if timelineSenders == nil {
+			timelineSenders = existingList.TimelineSenders
+		}
+		timelineThreads := nextList.TimelineThreads
+		if timelineThreads == nil {
+			timelineThreads = existingList.TimelineThreads
+		}
+		serverACL := nextList.ServerACL
+		if serverACL == nil {
+			serverACL = existingList.ServerACL
+		}
+		widgets := nextList.Widgets
+		if widgets == nil {
+			widgets = existingList.Widgets
+		}
+		directoryVisibility := nextList.DirectoryVisibility
+		if directoryVisibility == nil {
+			directoryVisibility = existingList.DirectoryVisibility
+		}
+		memberQuery := nextList.MemberQuery
+		if memberQuery == nil {
+			memberQuery = existingList.MemberQuery
+		}
+		topic := nextList.Topic
+		if topic == nil {
+			topic = existingList.Topic
+		}
+		relationTargets := nextList.RelationTargets
+		if relationTargets == nil {
+			relationTargets = existingList.RelationTargets
+		}
+		liveEventLimit := nextList.LiveEventLimit
+		if liveEventLimit == nil {
+			liveEventLimit = existingList.LiveEventLimit
+		}
+		senderProfile := nextList.SenderProfile
+		if senderProfile == nil {
+			senderProfile = existingList.SenderProfile
+		}
+		notificationLevel := nextList.NotificationLevel
+		if notificationLevel == nil {
+			notificationLevel = existingList.NotificationLevel
+		}
+		mentions := nextList.Mentions
+		if mentions == nil {
+			mentions = existingList.Mentions
+		}
+		encryptedMetadata := nextList.EncryptedMetadata
+		if encryptedMetadata == nil {
+			encryptedMetadata = existingList.EncryptedMetadata
+		}
+		nameContent := nextList.NameContent
+		if nameContent == nil {
+			nameContent = existingList.NameContent
+		}
+		requiredStateDelta := nextList.RequiredStateDelta
+		if requiredStateDelta == nil {
+			requiredStateDelta = existingList.RequiredStateDelta
+		}
 
 		calculatedLists[listKey] = RequestList{
 			RoomSubscription: RoomSubscription{
-				RequiredState:   reqState,
-				TimelineLimit:   timelineLimit,
-				IncludeOldRooms: includeOldRooms,
-				Heroes:          heroes,
+				RequiredState:       reqState,
+				TimelineLimit:       timelineLimit,
+				IncludeOldRooms:     includeOldRooms,
+				Heroes:              heroes,
+				JoinRules:           joinRules,
+				Create:              create,
+				TimelineSenders:     timelineSenders,
+				TimelineThreads:     timelineThreads,
+				LiveEventLimit:      liveEventLimit,
+				RelationTargets:     relationTargets,
+				Topic:               topic,
+				ServerACL:           serverACL,
+				Widgets:             widgets,
+				MemberQuery:         memberQuery,
+				DirectoryVisibility: directoryVisibility,
+				SenderProfile:       senderProfile,
+				NotificationLevel:   notificationLevel,
+				Mentions:            mentions,
+				EncryptedMetadata:   encryptedMetadata,
+				NameContent:         nameContent,
+				RequiredStateDelta:  requiredStateDelta,
 			},
 			Ranges:          rooms,
 			Sort:            sort,
 			Filters:         filters,
 			SlowGetAllRooms: slowGetAllRooms,
 			BumpEventTypes:  bumpEventTypes,
+			OpsOnly:         opsOnly,
+			Debug:           debug,
+			CountDelta:      countDelta,
+			Priority:        priority,
+			CoalesceSyncOps: coalesceSyncOps,
+			Indexes:         indexes,
 		}
 	}
 	result.Lists = calculatedLists
@@ -490,12 +767,17 @@ type RequestFilters struct {
 	IsDM           *bool     `json:"is_dm"`
 	IsEncrypted    *bool     `json:"is_encrypted"`
 	IsInvite       *bool     `json:"is_invite"`
+	IsKnock        *bool     `json:"is_knock"`
+	IsIgnoredDM    *bool     `json:"is_ignored_dm"` // DMs with users in m.ignored_user_list
 	IsTombstoned   *bool     `json:"is_tombstoned"` // deprecated
 	RoomTypes      []*string `json:"room_types"`
 	NotRoomTypes   []*string `json:"not_room_types"`
-	RoomNameFilter string    `json:"room_name_like"`
+	RoomNameFilter string    `json:"room_name_like"` // ignores case, diacritics and whitespace: see internal.NormaliseForSearch
 	Tags           []string  `json:"tags"`
 	NotTags        []string  `json:"not_tags"`
+	// Only include rooms whose most recent bump event is at or after this unix timestamp in
+	// milliseconds. Rooms which become active later are inserted into the list. 0 disables this filter.
+	ActiveSince uint64 `json:"active_since,omitempty"`
 
 	// TODO options to control which events should be live-streamed e.g not_types, types from sync v2
 }
@@ -519,13 +801,22 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 	if rf.IsDM != nil && *rf.IsDM != r.IsDM {
 		return false
 	}
-	if rf.IsInvite != nil && *rf.IsInvite != r.IsInvite {
+	// knocks are stored as invites, but are not invites as far as the client is concerned
+	if rf.IsInvite != nil && *rf.IsInvite != (r.IsInvite && !r.IsKnock()) {
 		return false
 	}
-	roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
-	if rf.RoomNameFilter != "" && !strings.Contains(strings.ToLower(roomName), strings.ToLower(rf.RoomNameFilter)) {
+	if rf.IsKnock != nil && *rf.IsKnock != r.IsKnock() {
 		return false
 	}
+	if rf.IsIgnoredDM != nil && *rf.IsIgnoredDM != r.IsIgnoredDM {
+		return false
+	}
+	if rf.RoomNameFilter != "" {
+		roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
+		if !strings.Contains(internal.NormaliseForSearch(roomName), internal.NormaliseForSearch(rf.RoomNameFilter)) {
+			return false
+		}
+	}
 	if len(rf.NotTags) > 0 {
 		for _, t := range rf.NotTags {
 			if _, ok := r.Tags[t]; ok {
@@ -554,9 +845,9 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 		return nullableStringExists(rf.RoomTypes, r.RoomType)
 	}
 	if len(rf.Spaces) > 0 {
-		// ensure this room is a member of one of these spaces
+		// ensure this room is in one of these spaces, or one of their sub-spaces
 		for _, s := range rf.Spaces {
-			if _, ok := r.UserRoomData.Spaces[s]; ok {
+			if _, ok := r.UserRoomData.AncestorSpaces[s]; ok {
 				return true
 			}
 		}
@@ -565,11 +856,68 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 	return true
 }
 
+// includeActivity returns true if the room has had bump-eligible activity in this list since ActiveSince.
+// This needs the list key as bump event types are configured per-list, so cannot live in Include.
+func (rf *RequestFilters) includeActivity(r *RoomConnMetadata, listKey string) bool {
+	if rf.ActiveSince == 0 {
+		return true
+	}
+	return r.GetLastInterestedEventTimestamp(listKey) >= rf.ActiveSince
+}
+
 type RoomSubscription struct {
 	RequiredState   [][2]string       `json:"required_state"`
 	TimelineLimit   int64             `json:"timeline_limit"`
 	IncludeOldRooms *RoomSubscription `json:"include_old_rooms"`
 	Heroes          *bool             `json:"include_heroes"`
+	JoinRules       *bool             `json:"include_join_rules,omitempty"`
+	Create          *bool             `json:"include_create,omitempty"`
+	// If set, only timeline events sent by these users are returned. This is a display filter: the
+	// timeline_limit is applied before filtering, so fewer events may be returned, and prev_batch
+	// still refers to the unfiltered timeline. Any future timeline filters are ANDed with this one.
+	TimelineSenders []string `json:"timeline_senders,omitempty"`
+	// If set, only timeline events in these MSC3440 threads are returned, ANDed with any other
+	// timeline filters. Threads are identified by the event ID of their root, which is in its own
+	// thread. ThreadIDMain is the events not in a thread, which includes the thread roots, so
+	// ["main"] returns the room's timeline without thread replies. Only events with an m.thread
+	// relation are in a thread: edits and reactions to thread replies are in the main timeline.
+	TimelineThreads []string `json:"timeline_threads,omitempty"`
+	// The maximum number of live events to return for this room in a single response. Any more
+	// are returned in subsequent responses. Unset means DefaultLiveEventLimit, and 0 means no limit.
+	LiveEventLimit *int64 `json:"live_event_limit,omitempty"`
+	// If true, summarise the targets of relations (edits, reactions, etc) in the timeline which are
+	// not themselves in the timeline, so clients can apply them without fetching the target.
+	RelationTargets *bool `json:"include_relation_targets,omitempty"`
+	// If true, return the parsed room topic. Implied if required_state asks for m.room.topic.
+	Topic     *bool `json:"include_topic,omitempty"`
+	ServerACL *bool `json:"include_server_acl,omitempty"`
+	Widgets   *bool `json:"include_widgets,omitempty"`
+	// If true, return whether the room is published in the room directory. This is looked up from
+	// the homeserver and cached, so may be briefly out of date.
+	DirectoryVisibility *bool `json:"include_directory_visibility,omitempty"`
+	// If set, return the current membership of these users, e.g to show a hovercard. This is
+	// cheaper than loading all members via required_state.
+	MemberQuery []string `json:"member_query,omitempty"`
+	// If true, embed the sender's current displayname and avatar in the unsigned section of each
+	// timeline event under SenderProfileKey, so clients needn't look up the sender's membership.
+	// This is the profile when the response is made, not when the event was sent.
+	SenderProfile *bool `json:"embed_sender_profile,omitempty"`
+	// If true, return the user's effective notification level for the room as worked out from
+	// their push rules: see NotificationLevelAll, NotificationLevelMentionsOnly and
+	// NotificationLevelMute. Updated when the user's push rules change.
+	NotificationLevel *bool `json:"include_notification_level,omitempty"`
+	// If true, set MentionsKey in the unsigned section of timeline events which mention the user or
+	// the room in their `m.mentions` content.
+	Mentions *bool `json:"annotate_mentions,omitempty"`
+	// If true, set EncryptedMetadataKey in the unsigned section of encrypted timeline events to
+	// their cleartext metadata.
+	EncryptedMetadata *bool `json:"include_encrypted_metadata,omitempty"`
+	// If true, the required_state of rooms which were already sent on this connection only
+	// includes the state events which changed since, and the room sets required_state_delta. The
+	// client must keep the state of rooms which leave its lists for the lifetime of the connection.
+	RequiredStateDelta *bool `json:"required_state_delta,omitempty"`
+	// If true, return the content of the room's m.room.name event, including custom fields.
+	NameContent *bool `json:"include_name_content,omitempty"`
 }
 
 func (rs RoomSubscription) RequiredStateChanged(other RoomSubscription) bool {
@@ -597,6 +945,132 @@ func (rs RoomSubscription) IncludeHeroes() bool {
 	return rs.Heroes != nil && *rs.Heroes
 }
 
+func (rs RoomSubscription) IncludeJoinRules() bool {
+	return rs.JoinRules != nil && *rs.JoinRules
+}
+
+func (rs RoomSubscription) IncludeCreate() bool {
+	return rs.Create != nil && *rs.Create
+}
+
+func (rs RoomSubscription) IncludeTopic() bool {
+	if rs.Topic != nil && *rs.Topic {
+		return true
+	}
+	for _, tuple := range rs.RequiredState {
+		if tuple[0] == "m.room.topic" {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs RoomSubscription) IncludeServerACL() bool {
+	return rs.ServerACL != nil && *rs.ServerACL
+}
+
+func (rs RoomSubscription) IncludeWidgets() bool {
+	return rs.Widgets != nil && *rs.Widgets
+}
+
+func (rs RoomSubscription) IncludeDirectoryVisibility() bool {
+	return rs.DirectoryVisibility != nil && *rs.DirectoryVisibility
+}
+
+// QueriedMembers returns the deduplicated user IDs in member_query.
+func (rs RoomSubscription) QueriedMembers() []string {
+	if len(rs.MemberQuery) == 0 {
+		return nil
+	}
+	seen := make(map[string]struct{}, len(rs.MemberQuery))
+	userIDs := make([]string, 0, len(rs.MemberQuery))
+	for _, userID := range rs.MemberQuery {
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+		seen[userID] = struct{}{}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs
+}
+
+func (rs RoomSubscription) EmbedSenderProfile() bool {
+	return rs.SenderProfile != nil && *rs.SenderProfile
+}
+
+func (rs RoomSubscription) IncludeNotificationLevel() bool {
+	return rs.NotificationLevel != nil && *rs.NotificationLevel
+}
+
+func (rs RoomSubscription) AnnotateMentions() bool {
+	return rs.Mentions != nil && *rs.Mentions
+}
+
+func (rs RoomSubscription) IncludeEncryptedMetadata() bool {
+	return rs.EncryptedMetadata != nil && *rs.EncryptedMetadata
+}
+
+func (rs RoomSubscription) IncludeNameContent() bool {
+	return rs.NameContent != nil && *rs.NameContent
+}
+
+func (rs RoomSubscription) WantsRequiredStateDelta() bool {
+	return rs.RequiredStateDelta != nil && *rs.RequiredStateDelta
+}
+
+func (rs RoomSubscription) IncludeRelationTargets() bool {
+	return rs.RelationTargets != nil && *rs.RelationTargets
+}
+
+// MaxLiveEvents returns the maximum number of live events to return in a single response, or 0
+// if there is no limit.
+func (rs RoomSubscription) MaxLiveEvents() int64 {
+	if rs.LiveEventLimit == nil {
+		return DefaultLiveEventLimit
+	}
+	if *rs.LiveEventLimit <= 0 {
+		return 0
+	}
+	return *rs.LiveEventLimit
+}
+
+// IncludeTimelineEvent returns true if this event should be in the timeline.
+func (rs RoomSubscription) IncludeTimelineEvent(event json.RawMessage) bool {
+	if len(rs.TimelineSenders) == 0 && len(rs.TimelineThreads) == 0 {
+		return true
+	}
+	fields := gjson.GetManyBytes(event, "sender", "event_id", `content.m\.relates_to.rel_type`, `content.m\.relates_to.event_id`)
+	if len(rs.TimelineSenders) > 0 && !slices.Contains(rs.TimelineSenders, fields[0].Str) {
+		return false
+	}
+	if len(rs.TimelineThreads) > 0 {
+		threadID := ThreadIDMain
+		if fields[2].Str == "m.thread" {
+			threadID = fields[3].Str
+		}
+		// thread roots are in their own thread as well as the one they were sent in
+		if !slices.Contains(rs.TimelineThreads, threadID) && !slices.Contains(rs.TimelineThreads, fields[1].Str) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterTimeline returns the events in the timeline which pass the timeline filters of this
+// subscription.
+func (rs RoomSubscription) FilterTimeline(timeline []json.RawMessage) []json.RawMessage {
+	if len(rs.TimelineSenders) == 0 && len(rs.TimelineThreads) == 0 {
+		return timeline
+	}
+	filtered := make([]json.RawMessage, 0, len(timeline))
+	for _, ev := range timeline {
+		if rs.IncludeTimelineEvent(ev) {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered
+}
+
 // Combine this subcription with another, returning a union of both as a copy.
 func (rs RoomSubscription) Combine(other RoomSubscription) RoomSubscription {
 	return rs.combineRecursive(other, true)
@@ -613,6 +1087,45 @@ func (rs RoomSubscription) combineRecursive(other RoomSubscription, checkOldRoom
 	}
 	// combine together required_state fields, we'll union them later
 	result.RequiredState = append(rs.RequiredState, other.RequiredState...)
+	// include optional fields if either subscription wants them
+	result.Heroes = eitherTrue(rs.Heroes, other.Heroes)
+	result.JoinRules = eitherTrue(rs.JoinRules, other.JoinRules)
+	result.Create = eitherTrue(rs.Create, other.Create)
+	result.RelationTargets = eitherTrue(rs.RelationTargets, other.RelationTargets)
+	result.Topic = eitherTrue(rs.Topic, other.Topic)
+	result.ServerACL = eitherTrue(rs.ServerACL, other.ServerACL)
+	result.Widgets = eitherTrue(rs.Widgets, other.Widgets)
+	result.DirectoryVisibility = eitherTrue(rs.DirectoryVisibility, other.DirectoryVisibility)
+	result.SenderProfile = eitherTrue(rs.SenderProfile, other.SenderProfile)
+	result.NotificationLevel = eitherTrue(rs.NotificationLevel, other.NotificationLevel)
+	result.Mentions = eitherTrue(rs.Mentions, other.Mentions)
+	result.EncryptedMetadata = eitherTrue(rs.EncryptedMetadata, other.EncryptedMetadata)
+	result.NameContent = eitherTrue(rs.NameContent, other.NameContent)
+	result.RequiredStateDelta = eitherTrue(rs.RequiredStateDelta, other.RequiredStateDelta)
+	// query the members either subscription wants
+	if len(rs.MemberQuery) > 0 || len(other.MemberQuery) > 0 {
+		result.MemberQuery = append(append([]string{}, rs.MemberQuery...), other.MemberQuery...)
+	}
+	// choose the max live event limit, where no limit beats any limit. Unset limits mean the
+	// default, so only set one if a subscription did.
+	if rs.LiveEventLimit != nil || other.LiveEventLimit != nil {
+		a, b := rs.MaxLiveEvents(), other.MaxLiveEvents()
+		var limit int64
+		if a > 0 && b > 0 {
+			limit = a
+			if b > a {
+				limit = b
+			}
+		}
+		result.LiveEventLimit = &limit
+	}
+	// only filter the timeline if both subscriptions filter it
+	if len(rs.TimelineSenders) > 0 && len(other.TimelineSenders) > 0 {
+		result.TimelineSenders = append(append([]string{}, rs.TimelineSenders...), other.TimelineSenders...)
+	}
+	if len(rs.TimelineThreads) > 0 && len(other.TimelineThreads) > 0 {
+		result.TimelineThreads = append(append([]string{}, rs.TimelineThreads...), other.TimelineThreads...)
+	}
 
 	if checkOldRooms {
 		// set include_old_rooms if it is unset
@@ -693,3 +1206,17 @@ func nullableStringExists(arr []*string, input *string) bool {
 	}
 	return false
 }
+
+// eitherTrue returns a pointer to true if either a or b is true, else whichever of them is set.
+func eitherTrue(a, b *bool) *bool {
+	if a != nil && *a {
+		return a
+	}
+	if b != nil && *b {
+		return b
+	}
+	if a != nil {
+		return a
+	}
+	return b
+}
@@ -6,6 +6,7 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 )
 
 func TestRoomSubscriptionUnion(t *testing.T) {
@@ -1030,6 +1031,22 @@ func TestSame(t *testing.T) {
 			},
 			expectSame: true,
 		},
+		// Requests only differing in nonce are the same.
+		{
+			a: Request{
+				TxnID:  "txn1",
+				Nonce:  "nonce1",
+				ConnID: "conn",
+				pos:    10,
+			},
+			b: Request{
+				TxnID:  "txn1",
+				Nonce:  "nonce2",
+				ConnID: "conn",
+				pos:    10,
+			},
+			expectSame: true,
+		},
 		// Requests only differing in some other field ConnID are NOT the same.
 		// TODO: would be better to change a more important field like lists rather than
 		// ConnID.
@@ -1131,3 +1148,245 @@ func jsonEqual(t *testing.T, name string, got, want interface{}) {
 func listPtr(l RequestList) *RequestList {
 	return &l
 }
+
+func TestRequestCoalesceWindow(t *testing.T) {
+	ms := func(i int64) *int64 { return &i }
+	max := 500 * time.Millisecond
+	testCases := []struct {
+		name string
+		val  *int64
+		want time.Duration
+	}{
+		{name: "unset", val: nil, want: 0},
+		{name: "zero", val: ms(0), want: 0},
+		{name: "negative", val: ms(-10), want: 0},
+		{name: "within bounds", val: ms(200), want: 200 * time.Millisecond},
+		{name: "clamped", val: ms(99999999999999), want: max},
+	}
+	for _, tc := range testCases {
+		req := Request{CoalesceMSecs: tc.val}
+		if got := req.CoalesceWindow(max); got != tc.want {
+			t.Errorf("%s: got %v want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// coalesce_ms is sticky
+	var prev *Request
+	next, _ := prev.ApplyDelta(&Request{CoalesceMSecs: ms(200)})
+	next, _ = next.ApplyDelta(&Request{})
+	if next.CoalesceMSecs == nil || *next.CoalesceMSecs != 200 {
+		t.Fatalf("coalesce_ms was not sticky: %v", next.CoalesceMSecs)
+	}
+	next, _ = next.ApplyDelta(&Request{CoalesceMSecs: ms(0)})
+	if next.CoalesceWindow(max) != 0 {
+		t.Fatalf("coalesce_ms could not be reset to 0")
+	}
+}
+
+func TestRequestFocusRoom(t *testing.T) {
+	str := func(s string) *string { return &s }
+	var prev *Request
+	next, _ := prev.ApplyDelta(&Request{FocusRoom: str("!a")})
+	next, _ = next.ApplyDelta(&Request{})
+	if got := next.FocusRoomID(); got != "!a" {
+		t.Fatalf("focus_room was not sticky: got %q", got)
+	}
+	next, _ = next.ApplyDelta(&Request{FocusRoom: str("!b")})
+	if got := next.FocusRoomID(); got != "!b" {
+		t.Fatalf("focus_room was not changed: got %q", got)
+	}
+	next, _ = next.ApplyDelta(&Request{FocusRoom: str("")})
+	if got := next.FocusRoomID(); got != "" {
+		t.Fatalf("focus_room could not be cleared: got %q", got)
+	}
+}
+
+func TestRoomSubscriptionTimelineSenders(t *testing.T) {
+	alice := json.RawMessage(`{"type":"m.room.message","sender":"@alice:localhost","event_id":"$a"}`)
+	bob := json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","event_id":"$b"}`)
+	charlie := json.RawMessage(`{"type":"m.room.message","sender":"@charlie:localhost","event_id":"$c"}`)
+	timeline := []json.RawMessage{alice, bob, charlie}
+
+	noFilter := RoomSubscription{}
+	if got := noFilter.FilterTimeline(timeline); !reflect.DeepEqual(got, timeline) {
+		t.Fatalf("no filter: got %s", got)
+	}
+	aliceOnly := RoomSubscription{TimelineSenders: []string{"@alice:localhost"}}
+	if got := aliceOnly.FilterTimeline(timeline); !reflect.DeepEqual(got, []json.RawMessage{alice}) {
+		t.Fatalf("alice only: got %s", got)
+	}
+	noMatches := RoomSubscription{TimelineSenders: []string{"@doris:localhost"}}
+	if got := noMatches.FilterTimeline(timeline); len(got) != 0 {
+		t.Fatalf("no matches: got %s", got)
+	}
+
+	// combining two filters unions the senders
+	combined := aliceOnly.Combine(RoomSubscription{TimelineSenders: []string{"@charlie:localhost"}})
+	if got := combined.FilterTimeline(timeline); !reflect.DeepEqual(got, []json.RawMessage{alice, charlie}) {
+		t.Fatalf("combined: got %s", got)
+	}
+	// combining with an unfiltered subscription removes the filter
+	combined = aliceOnly.Combine(noFilter)
+	if got := combined.FilterTimeline(timeline); !reflect.DeepEqual(got, timeline) {
+		t.Fatalf("combined with unfiltered: got %s", got)
+	}
+}
+
+func TestRoomSubscriptionTimelineThreads(t *testing.T) {
+	root := json.RawMessage(`{"type":"m.room.message","sender":"@alice:localhost","event_id":"$root"}`)
+	reply := json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","event_id":"$reply","content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}}`)
+	other := json.RawMessage(`{"type":"m.room.message","sender":"@alice:localhost","event_id":"$other","content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$otherroot"}}}`)
+	edit := json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","event_id":"$edit","content":{"m.relates_to":{"rel_type":"m.replace","event_id":"$reply"}}}`)
+	timeline := []json.RawMessage{root, reply, other, edit}
+
+	mainOnly := RoomSubscription{TimelineThreads: []string{ThreadIDMain}}
+	if got := mainOnly.FilterTimeline(timeline); !reflect.DeepEqual(got, []json.RawMessage{root, edit}) {
+		t.Fatalf("main only: got %s", got)
+	}
+	thread := RoomSubscription{TimelineThreads: []string{"$root"}}
+	if got := thread.FilterTimeline(timeline); !reflect.DeepEqual(got, []json.RawMessage{root, reply}) {
+		t.Fatalf("thread: got %s", got)
+	}
+	// thread filters are ANDed with sender filters
+	bobInThread := RoomSubscription{TimelineThreads: []string{"$root"}, TimelineSenders: []string{"@bob:localhost"}}
+	if got := bobInThread.FilterTimeline(timeline); !reflect.DeepEqual(got, []json.RawMessage{reply}) {
+		t.Fatalf("bob in thread: got %s", got)
+	}
+	// combining two filters unions the threads
+	combined := thread.Combine(RoomSubscription{TimelineThreads: []string{"$otherroot"}})
+	if got := combined.FilterTimeline(timeline); !reflect.DeepEqual(got, []json.RawMessage{root, reply, other}) {
+		t.Fatalf("combined: got %s", got)
+	}
+	combined = thread.Combine(RoomSubscription{})
+	if got := combined.FilterTimeline(timeline); !reflect.DeepEqual(got, timeline) {
+		t.Fatalf("combined with unfiltered: got %s", got)
+	}
+}
+
+func TestRoomSubscriptionMemberQuery(t *testing.T) {
+	if got := (RoomSubscription{}).QueriedMembers(); got != nil {
+		t.Fatalf("no member query: got %v", got)
+	}
+	alice := RoomSubscription{MemberQuery: []string{"@alice:localhost", "@alice:localhost"}}
+	if got := alice.QueriedMembers(); !reflect.DeepEqual(got, []string{"@alice:localhost"}) {
+		t.Fatalf("duplicates: got %v", got)
+	}
+	// combining subscriptions queries the members of both
+	combined := alice.Combine(RoomSubscription{MemberQuery: []string{"@bob:localhost"}})
+	if got := combined.QueriedMembers(); !reflect.DeepEqual(got, []string{"@alice:localhost", "@bob:localhost"}) {
+		t.Fatalf("combined: got %v", got)
+	}
+	combined = alice.Combine(RoomSubscription{})
+	if got := combined.QueriedMembers(); !reflect.DeepEqual(got, []string{"@alice:localhost"}) {
+		t.Fatalf("combined with no query: got %v", got)
+	}
+}
+
+func TestRoomSubscriptionLiveEventLimit(t *testing.T) {
+	limit := func(i int64) *int64 { return &i }
+	testCases := []struct {
+		name string
+		a    RoomSubscription
+		b    RoomSubscription
+		want int64
+	}{
+		{name: "unset uses the default", want: DefaultLiveEventLimit},
+		{name: "max wins", a: RoomSubscription{LiveEventLimit: limit(5)}, b: RoomSubscription{LiveEventLimit: limit(10)}, want: 10},
+		{name: "unset counts as the default", a: RoomSubscription{LiveEventLimit: limit(5)}, want: DefaultLiveEventLimit},
+		{name: "larger than the default", a: RoomSubscription{LiveEventLimit: limit(100)}, want: 100},
+		{name: "0 means no limit", a: RoomSubscription{LiveEventLimit: limit(0)}, want: 0},
+		{name: "no limit wins", a: RoomSubscription{LiveEventLimit: limit(0)}, b: RoomSubscription{LiveEventLimit: limit(100)}, want: 0},
+		{name: "no limit beats the default", a: RoomSubscription{LiveEventLimit: limit(0)}, b: RoomSubscription{}, want: 0},
+	}
+	for _, tc := range testCases {
+		got := tc.a.Combine(tc.b).MaxLiveEvents()
+		if got != tc.want {
+			t.Errorf("%s: got %d want %d", tc.name, got, tc.want)
+		}
+	}
+
+	// the limit is sticky on lists
+	var r Request
+	next, _ := r.ApplyDelta(&Request{
+		Lists: map[string]RequestList{
+			"a": {RoomSubscription: RoomSubscription{LiveEventLimit: limit(3)}},
+		},
+	})
+	next, _ = next.ApplyDelta(&Request{
+		Lists: map[string]RequestList{
+			"a": {},
+		},
+	})
+	if got := next.Lists["a"].MaxLiveEvents(); got != 3 {
+		t.Fatalf("live_event_limit was not sticky: got %d", got)
+	}
+}
+
+// Test that required_state_delta is sticky, so deltas aren't turned off by requests which leave
+// it out.
+func TestRequestRequiredStateDeltaSticky(t *testing.T) {
+	boolTrue := true
+	var r *Request
+	next, _ := r.ApplyDelta(&Request{
+		Lists: map[string]RequestList{
+			"a": {RoomSubscription: RoomSubscription{RequiredStateDelta: &boolTrue}},
+		},
+	})
+	next, _ = next.ApplyDelta(&Request{
+		Lists: map[string]RequestList{
+			"a": {Ranges: SliceRanges{{0, 10}}},
+		},
+	})
+	if !next.Lists["a"].WantsRequiredStateDelta() {
+		t.Fatalf("required_state_delta was not sticky")
+	}
+}
+
+// Test that every list field which can be left out of a request keeps its previous value, so new
+// fields can't be forgotten in ApplyDelta.
+func TestRequestApplyDeltaKeepsEveryListField(t *testing.T) {
+	// set every field which is unset when it is nil or 0
+	var existing RequestList
+	var setFields func(v reflect.Value, path string)
+	setFields = func(v reflect.Value, path string) {
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			f := v.Field(i)
+			switch f.Kind() {
+			case reflect.Struct:
+				setFields(f, path+field.Name+".")
+			case reflect.Ptr:
+				f.Set(reflect.New(field.Type.Elem()))
+			case reflect.Slice:
+				f.Set(reflect.MakeSlice(field.Type, 1, 1))
+			case reflect.Int64:
+				f.SetInt(1)
+			}
+		}
+	}
+	setFields(reflect.ValueOf(&existing).Elem(), "")
+
+	var r *Request
+	next, _ := r.ApplyDelta(&Request{
+		Lists: map[string]RequestList{"a": existing},
+	})
+	next, _ = next.ApplyDelta(&Request{
+		Lists: map[string]RequestList{"a": {}},
+	})
+	got := next.Lists["a"]
+	var checkFields func(want, got reflect.Value, path string)
+	checkFields = func(want, got reflect.Value, path string) {
+		for i := 0; i < want.NumField(); i++ {
+			field := want.Type().Field(i)
+			switch field.Type.Kind() {
+			case reflect.Struct:
+				checkFields(want.Field(i), got.Field(i), path+field.Name+".")
+			case reflect.Ptr, reflect.Slice, reflect.Int64:
+				if !reflect.DeepEqual(want.Field(i).Interface(), got.Field(i).Interface()) {
+					t.Errorf("%s%s was not kept: got %v want %v", path, field.Name, got.Field(i), want.Field(i))
+				}
+			}
+		}
+	}
+	checkFields(reflect.ValueOf(existing), reflect.ValueOf(got), "")
+}
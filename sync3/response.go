@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"strconv"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/tidwall/gjson"
 )
@@ -15,6 +16,22 @@ const (
 	OpDelete     = "DELETE"
 )
 
+// ResponseSource is how a response was served, for debugging client and server desyncs.
+type ResponseSource string
+
+const (
+	// The response was calculated for this request.
+	ResponseSourceHandler ResponseSource = "handler"
+	// The response was sent before, and is being sent again because the client retried the request
+	// which made it.
+	ResponseSourceRetransmit ResponseSource = "retransmit"
+	// The response was buffered earlier and the client has not received it yet. This request may
+	// still have been processed, if its parameters changed.
+	ResponseSourceBuffered ResponseSource = "buffered"
+	// An empty response, when resuming a connection after a restart or whilst shutting down.
+	ResponseSourceEmpty ResponseSource = "empty"
+)
+
 type Response struct {
 	Lists map[string]ResponseList `json:"lists"`
 
@@ -23,11 +40,55 @@ type Response struct {
 
 	Pos   string `json:"pos"`
 	TxnID string `json:"txn_id,omitempty"`
+	// The nonce of the request this response was sent for. Omitted if the request had none.
+	Nonce string `json:"nonce,omitempty"`
+	// Advisory: the minimum number of milliseconds the client should wait before making its next
+	// request. Omitted if the server has no suggestion.
+	SuggestedPollIntervalMSecs int64 `json:"suggested_poll_interval_ms,omitempty"`
+	// The number of joined rooms which are not in any list because the account is in too many
+	// rooms. These rooms are added to lists when they next have activity. Omitted if 0.
+	UntrackedRooms int `json:"untracked_rooms,omitempty"`
+	// The rooms which are no longer part of the user's account since the previous response because
+	// the user left, was kicked or banned, or rejected an invite. Only set if the request has
+	// `include_rooms_removed: true`. This differs from a DELETE op, which only means the room is no
+	// longer in that list's window e.g it was scrolled out of the range or no longer matches the
+	// filters: the user is still in the room. Sorted by room ID.
+	RoomsRemoved []string `json:"rooms_removed,omitempty"`
+	// The rooms which were left out of this response because it exceeded `max_response_bytes`.
+	// These rooms are sent in full in a later response, replacing any data the client has for
+	// them. Sorted by room ID.
+	TrimmedRooms []string `json:"trimmed_rooms,omitempty"`
+	// What this proxy supports. Only set on the first response for a connection.
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+
+	// How the response was served. Not sent to clients.
+	ServedFrom ResponseSource `json:"-"`
+	// Set by the handler if the response has nothing the client doesn't already have, e.g a long
+	// poll timed out. Such responses are not buffered and keep the client at its current pos, so
+	// idle connections don't fill their buffer. Not sent to clients.
+	NoChange bool `json:"-"`
 }
 
 type ResponseList struct {
 	Ops   []ResponseOp `json:"ops,omitempty"`
 	Count int          `json:"count"`
+	// The change in Count since the previous response on this connection. Only set if the list has
+	// `count_delta: true` and this is not the first response for the list. Count is always set and is
+	// authoritative: clients which are unsure if they missed a delta should use Count instead.
+	CountDelta *int `json:"count_delta,omitempty"`
+	// Room ID -> the index of the room in the full sorted list, for every room in Ops which is
+	// still in the list. Indexes are taken after all Ops are applied, and are not limited to the
+	// list's ranges. Only set if the list has `include_indexes: true`.
+	Indexes map[string]int `json:"indexes,omitempty"`
+	// Only set if the list has `debug: true`
+	Applied *AppliedList `json:"applied,omitempty"`
+}
+
+// AppliedList is the sort and filters which the server applied to a list, after sticky parameters
+// have been resolved and defaults filled in.
+type AppliedList struct {
+	Sort    []string        `json:"sort"`
+	Filters *RequestFilters `json:"filters,omitempty"`
 }
 
 func (r *Response) PosInt() int64 {
@@ -35,6 +96,25 @@ func (r *Response) PosInt() int64 {
 	return p
 }
 
+// ApproxSize returns the approximate size of the response in bytes, without marshalling it. Only
+// events are counted, as they make up the bulk of responses.
+func (r *Response) ApproxSize() int {
+	size := 0
+	for _, room := range r.Rooms {
+		for _, events := range [][]json.RawMessage{room.Timeline, room.RequiredState, room.InviteState} {
+			for _, ev := range events {
+				size += len(ev)
+			}
+		}
+	}
+	if r.Extensions.ToDevice != nil {
+		for _, msg := range r.Extensions.ToDevice.Events {
+			size += len(msg)
+		}
+	}
+	return size
+}
+
 func (r *Response) ListOps() int {
 	num := 0
 	for _, l := range r.Lists {
@@ -57,18 +137,63 @@ func (r *Response) RoomIDsToTimelineEventIDs() map[string][]string {
 	return includedRoomIDs
 }
 
+// ReplaceMalformedEvents replaces any malformed events in the rooms of this response with
+// placeholders of type internal.SkippedEventType, as a single malformed event would otherwise stop
+// the whole response from being JSON encoded. Returns the number of events replaced.
+func (r *Response) ReplaceMalformedEvents() int {
+	numReplaced := 0
+	// copies the events if any are replaced, as they may be shared with caches
+	replace := func(roomID string, events []json.RawMessage) []json.RawMessage {
+		var result []json.RawMessage
+		for i, ev := range events {
+			reason := internal.SkipReason(ev, 0)
+			if reason == "" {
+				continue
+			}
+			if result == nil {
+				result = append([]json.RawMessage{}, events...)
+			}
+			result[i] = internal.NewSkippedEvent(ev, roomID, reason)
+			numReplaced++
+		}
+		if result == nil {
+			return events
+		}
+		return result
+	}
+	for roomID, room := range r.Rooms {
+		room.Timeline = replace(roomID, room.Timeline)
+		room.RequiredState = replace(roomID, room.RequiredState)
+		room.InviteState = replace(roomID, room.InviteState)
+		r.Rooms[roomID] = room
+	}
+	return numReplaced
+}
+
 // Custom unmarshal so we can dynamically create the right ResponseOp for Ops
 func (r *Response) UnmarshalJSON(b []byte) error {
 	temporary := struct {
 		Rooms map[string]Room `json:"rooms"`
 		Lists map[string]struct {
-			Ops   []json.RawMessage `json:"ops"`
-			Count int               `json:"count"`
+			Ops        []json.RawMessage `json:"ops"`
+			Count      int               `json:"count"`
+			CountDelta *int              `json:"count_delta"`
+			Indexes    map[string]int    `json:"indexes"`
+			Applied    *AppliedList      `json:"applied"`
 		} `json:"lists"`
 		Extensions extensions.Response `json:"extensions"`
 
 		Pos   string `json:"pos"`
 		TxnID string `json:"txn_id,omitempty"`
+		Nonce string `json:"nonce,omitempty"`
+
+		SuggestedPollIntervalMSecs int64 `json:"suggested_poll_interval_ms,omitempty"`
+		UntrackedRooms             int   `json:"untracked_rooms,omitempty"`
+
+		RoomsRemoved []string `json:"rooms_removed,omitempty"`
+		TrimmedRooms []string `json:"trimmed_rooms,omitempty"`
+
+		Capabilities *Capabilities `json:"capabilities,omitempty"`
 	}{}
 	if err := json.Unmarshal(b, &temporary); err != nil {
 		return err
@@ -76,12 +201,21 @@ func (r *Response) UnmarshalJSON(b []byte) error {
 	r.Rooms = temporary.Rooms
 	r.Pos = temporary.Pos
 	r.TxnID = temporary.TxnID
+	r.Nonce = temporary.Nonce
+	r.SuggestedPollIntervalMSecs = temporary.SuggestedPollIntervalMSecs
+	r.UntrackedRooms = temporary.UntrackedRooms
+	r.RoomsRemoved = temporary.RoomsRemoved
+	r.TrimmedRooms = temporary.TrimmedRooms
+	r.Capabilities = temporary.Capabilities
 	r.Extensions = temporary.Extensions
 	r.Lists = make(map[string]ResponseList, len(temporary.Lists))
 
 	for listKey, l := range temporary.Lists {
 		var list ResponseList
 		list.Count = l.Count
+		list.CountDelta = l.CountDelta
+		list.Indexes = l.Indexes
+		list.Applied = l.Applied
 		for _, op := range l.Ops {
 			if gjson.GetBytes(op, "range").Exists() {
 				var oper ResponseOpRange
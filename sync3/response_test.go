@@ -0,0 +1,55 @@
+package sync3
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+)
+
+func TestResponseReplaceMalformedEvents(t *testing.T) {
+	goodEvent := json.RawMessage(`{"type":"m.room.message","event_id":"$good","sender":"@alice:localhost","content":{"body":"hi"}}`)
+	badContent := json.RawMessage(`{"type":"m.room.message","event_id":"$bad","sender":"@alice:localhost","content":"nope"}`)
+	invalidJSON := json.RawMessage(`{"type":"m.room.message","event_id":"$invalid"`)
+	timeline := []json.RawMessage{goodEvent, badContent, goodEvent}
+	res := &Response{
+		Rooms: map[string]Room{
+			"!a": {
+				Timeline:      timeline,
+				RequiredState: []json.RawMessage{goodEvent},
+			},
+			"!b": {
+				InviteState: []json.RawMessage{invalidJSON},
+			},
+		},
+	}
+	if _, err := json.Marshal(res); err == nil {
+		t.Fatalf("expected response with invalid JSON to fail to marshal")
+	}
+	if got := res.ReplaceMalformedEvents(); got != 2 {
+		t.Fatalf("ReplaceMalformedEvents: got %d want 2", got)
+	}
+	if _, err := json.Marshal(res); err != nil {
+		t.Fatalf("failed to marshal response after replacing malformed events: %s", err)
+	}
+	// the original timeline may be shared with caches so must not be modified
+	if !reflect.DeepEqual(timeline[1], badContent) {
+		t.Fatalf("ReplaceMalformedEvents modified the original timeline: %s", timeline[1])
+	}
+	roomA := res.Rooms["!a"]
+	if !reflect.DeepEqual(roomA.Timeline[0], goodEvent) || !reflect.DeepEqual(roomA.Timeline[2], goodEvent) {
+		t.Fatalf("ReplaceMalformedEvents modified valid events: %v", roomA.Timeline)
+	}
+	if !reflect.DeepEqual(roomA.RequiredState, []json.RawMessage{goodEvent}) {
+		t.Fatalf("ReplaceMalformedEvents modified valid state: %v", roomA.RequiredState)
+	}
+	placeholder := gjson.ParseBytes(roomA.Timeline[1])
+	if placeholder.Get("type").Str != internal.SkippedEventType || placeholder.Get("event_id").Str != "$bad" {
+		t.Fatalf("got %s want a placeholder for $bad", roomA.Timeline[1])
+	}
+	if gjson.GetBytes(res.Rooms["!b"].InviteState[0], "type").Str != internal.SkippedEventType {
+		t.Fatalf("invalid JSON was not replaced: %s", res.Rooms["!b"].InviteState[0])
+	}
+}
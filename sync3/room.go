@@ -2,28 +2,593 @@ package sync3
 
 import (
 	"encoding/json"
+	"sort"
+	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
 type Room struct {
-	Name              string            `json:"name,omitempty"`
-	AvatarChange      AvatarChange      `json:"avatar,omitempty"`
-	Heroes            []internal.Hero   `json:"heroes,omitempty"`
-	RequiredState     []json.RawMessage `json:"required_state,omitempty"`
-	Timeline          []json.RawMessage `json:"timeline,omitempty"`
-	InviteState       []json.RawMessage `json:"invite_state,omitempty"`
-	NotificationCount int64             `json:"notification_count"`
-	HighlightCount    int64             `json:"highlight_count"`
-	Initial           bool              `json:"initial,omitempty"`
-	IsDM              bool              `json:"is_dm,omitempty"`
-	JoinedCount       int               `json:"joined_count,omitempty"`
-	InvitedCount      *int              `json:"invited_count,omitempty"`
-	PrevBatch         string            `json:"prev_batch,omitempty"`
-	NumLive           int               `json:"num_live,omitempty"`
-	Timestamp         uint64            `json:"timestamp,omitempty"`
+	Name              string             `json:"name,omitempty"`
+	AvatarChange      AvatarChange       `json:"avatar,omitempty"`
+	Heroes            []internal.Hero    `json:"heroes,omitempty"`
+	RequiredState     []json.RawMessage  `json:"required_state,omitempty"`
+	Timeline          []json.RawMessage  `json:"timeline,omitempty"`
+	InviteState       []json.RawMessage  `json:"invite_state,omitempty"`
+	KnockState        []json.RawMessage  `json:"knock_state,omitempty"`
+	NotificationCount int64              `json:"notification_count"`
+	HighlightCount    int64              `json:"highlight_count"`
+	Initial           bool               `json:"initial,omitempty"`
+	IsDM              bool               `json:"is_dm,omitempty"`
+	JoinedCount       int                `json:"joined_count,omitempty"`
+	InvitedCount      *int               `json:"invited_count,omitempty"`
+	PrevBatch         string             `json:"prev_batch,omitempty"`
+	Limited           bool               `json:"limited,omitempty"`
+	NumLive           int                `json:"num_live,omitempty"`
+	Timestamp         uint64             `json:"timestamp,omitempty"`
+	MembershipChanges []MembershipChange `json:"membership_changes,omitempty"`
+	JoinRules         *JoinRules         `json:"join_rules,omitempty"`
+	Create            *RoomCreate        `json:"create,omitempty"`
+	RelationTargets   []RelationTarget   `json:"relation_targets,omitempty"`
+	Topic             *RoomTopic         `json:"topic,omitempty"`
+	ServerACL         *ServerACL         `json:"server_acl,omitempty"`
+	Widgets           *[]Widget          `json:"widgets,omitempty"`
+	Members           []Member           `json:"members,omitempty"`
+	// "public", "private" or "unknown" if the proxy could not find out.
+	DirectoryVisibility string `json:"directory_visibility,omitempty"`
+	// True if the room has so many members that joined_count is approximate and required_state
+	// only includes lazy loaded members and members requested by user ID.
+	LargeRoom bool `json:"large_room,omitempty"`
+	// The user's effective notification level for the room, if include_notification_level is set.
+	// Omitted if the user's push rules are not known.
+	NotificationLevel string `json:"notification_level,omitempty"`
+	// The content of the room's m.room.name event as-is, if include_name_content is set, so clients
+	// can use fields beyond `name` e.g localised names. Omitted if the room has no name event.
+	NameContent json.RawMessage `json:"name_content,omitempty"`
+	// True if required_state only has the state events which changed since the room was last sent
+	// on this connection, to apply to the state the client has. Otherwise it is the full state.
+	RequiredStateDelta bool `json:"required_state_delta,omitempty"`
+	// True if the homeserver skipped events between the events previously sent for this room and
+	// this timeline, so the timeline the client has is stale. Clients should drop it or backfill
+	// the gap from prev_batch. Implies limited.
+	GappyTimeline bool `json:"unstable_gappy_timeline,omitempty"`
+}
+
+const (
+	// Every message in the room notifies.
+	NotificationLevelAll = "all"
+	// Only messages which mention the user notify.
+	NotificationLevelMentionsOnly = "mentions_only"
+	// Nothing in the room notifies, not even mentions.
+	NotificationLevelMute = "mute"
+)
+
+// WidgetEventTypes are the state event types which define widgets, in order of preference.
+var WidgetEventTypes = []string{"m.widget", "im.vector.modular.widgets"}
+
+// Widget is a widget in the room, returned when a subscription sets include_widgets. The room's
+// widgets are always returned in full, so removing the last widget returns an empty list.
+type Widget struct {
+	// The state key of the widget event.
+	ID        string          `json:"id"`
+	EventType string          `json:"event_type"`
+	Sender    string          `json:"sender"`
+	Type      string          `json:"type"`
+	URL       string          `json:"url"`
+	Name      string          `json:"name,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// NewWidgets parses widget state events into a list of widgets sorted by ID. Events with no type
+// or URL are removed widgets and are skipped. If a widget ID is defined by more than one type of
+// event, the type which is earliest in WidgetEventTypes is used.
+func NewWidgets(widgetEvents []json.RawMessage) []Widget {
+	preference := make(map[string]int, len(WidgetEventTypes))
+	for i, evType := range WidgetEventTypes {
+		preference[evType] = i
+	}
+	byID := make(map[string]Widget)
+	for _, ev := range widgetEvents {
+		parsed := gjson.ParseBytes(ev)
+		evType := parsed.Get("type").Str
+		rank, isWidget := preference[evType]
+		if !isWidget || !parsed.Get("state_key").Exists() {
+			continue
+		}
+		id := parsed.Get("state_key").Str
+		if existing, ok := byID[id]; ok && preference[existing.EventType] < rank {
+			continue
+		}
+		content := parsed.Get("content")
+		widget := Widget{
+			ID:        id,
+			EventType: evType,
+			Sender:    parsed.Get("sender").Str,
+			Type:      content.Get("type").Str,
+			URL:       content.Get("url").Str,
+			Name:      content.Get("name").Str,
+		}
+		if data := content.Get("data"); data.IsObject() {
+			widget.Data = json.RawMessage(data.Raw)
+		}
+		if widget.Type == "" || widget.URL == "" {
+			// a removed widget still overrides the same widget in a less preferred event type
+			byID[id] = Widget{EventType: evType}
+			continue
+		}
+		byID[id] = widget
+	}
+	widgets := make([]Widget, 0, len(byID))
+	for _, w := range byID {
+		if w.ID != "" {
+			widgets = append(widgets, w)
+		}
+	}
+	sort.Slice(widgets, func(i, j int) bool {
+		return widgets[i].ID < widgets[j].ID
+	})
+	return widgets
+}
+
+// Member is the current membership of a user asked for via member_query. Users who have no
+// membership event in the room are not returned.
+type Member struct {
+	UserID      string `json:"user_id"`
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	PowerLevel  int64  `json:"power_level"`
+}
+
+// NewMembers parses m.room.member events into a list of members sorted by user ID, using the
+// m.room.power_levels event to work out each member's power level. If there is no power levels
+// event, every member has a power level of 0.
+func NewMembers(memberEvents []json.RawMessage, powerLevelsEvent json.RawMessage) []Member {
+	var usersDefault int64
+	userPowerLevels := make(map[string]int64)
+	if powerLevelsEvent != nil {
+		content := gjson.GetBytes(powerLevelsEvent, "content")
+		usersDefault = content.Get("users_default").Int()
+		content.Get("users").ForEach(func(userID, level gjson.Result) bool {
+			userPowerLevels[userID.Str] = level.Int()
+			return true
+		})
+	}
+	members := make([]Member, 0, len(memberEvents))
+	for _, ev := range memberEvents {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str != "m.room.member" || !parsed.Get("state_key").Exists() {
+			continue
+		}
+		userID := parsed.Get("state_key").Str
+		powerLevel, ok := userPowerLevels[userID]
+		if !ok {
+			powerLevel = usersDefault
+		}
+		members = append(members, Member{
+			UserID:      userID,
+			Membership:  parsed.Get("content.membership").Str,
+			DisplayName: parsed.Get("content.displayname").Str,
+			AvatarURL:   parsed.Get("content.avatar_url").Str,
+			PowerLevel:  powerLevel,
+		})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserID < members[j].UserID
+	})
+	return members
+}
+
+// SenderProfileKey is the key in the unsigned section of timeline events where the sender's
+// profile is embedded, when a subscription sets embed_sender_profile.
+const SenderProfileKey = "org.matrix.sliding_sync.sender_profile"
+
+// SenderProfile is the displayname and avatar of the sender of a timeline event. This is the
+// sender's profile in the room when the response was made, not when the event was sent, so older
+// events show the sender's current name.
+type SenderProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// EmbedSenderProfiles returns a copy of the timeline with the sender's profile embedded in each
+// event, using the senders' m.room.member events. If a sender has no membership event, the profile
+// in the event itself is used if it is the sender's own m.room.member event, else the event is
+// returned unchanged.
+func EmbedSenderProfiles(timeline []json.RawMessage, memberEvents []json.RawMessage) []json.RawMessage {
+	profiles := make(map[string]SenderProfile, len(memberEvents))
+	for _, ev := range memberEvents {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str != "m.room.member" || !parsed.Get("state_key").Exists() {
+			continue
+		}
+		profiles[parsed.Get("state_key").Str] = newSenderProfile(parsed.Get("content"))
+	}
+	result := make([]json.RawMessage, len(timeline))
+	for i, ev := range timeline {
+		result[i] = ev
+		parsed := gjson.ParseBytes(ev)
+		sender := parsed.Get("sender").Str
+		profile, ok := profiles[sender]
+		if !ok {
+			if parsed.Get("type").Str != "m.room.member" || parsed.Get("state_key").Str != sender {
+				continue
+			}
+			profile = newSenderProfile(parsed.Get("content"))
+		}
+		embedded, err := sjson.SetBytes(ev, "unsigned."+strings.ReplaceAll(SenderProfileKey, ".", `\.`), profile)
+		if err != nil {
+			continue
+		}
+		result[i] = embedded
+	}
+	return result
+}
+
+func newSenderProfile(memberContent gjson.Result) SenderProfile {
+	return SenderProfile{
+		DisplayName: memberContent.Get("displayname").Str,
+		AvatarURL:   memberContent.Get("avatar_url").Str,
+	}
+}
+
+// MentionsKey is the key in the unsigned section of timeline events where whether the event
+// mentions the user is embedded, when a subscription sets annotate_mentions.
+const MentionsKey = "org.matrix.sliding_sync.mentions"
+
+// Mentions is whether a timeline event intentionally mentions the user or the whole room, as
+// declared in the event's `m.mentions` content (MSC3952).
+type Mentions struct {
+	User bool `json:"user,omitempty"`
+	Room bool `json:"room,omitempty"`
+}
+
+// AnnotateMentions returns a copy of the timeline where events which mention the user or the room
+// in their `m.mentions` content have MentionsKey set. Events which mention neither are returned
+// unchanged. This does not evaluate push rules, so does not check that the sender is allowed to
+// mention the room, and cannot see `m.mentions` in encrypted events.
+func AnnotateMentions(timeline []json.RawMessage, userID string) []json.RawMessage {
+	result := make([]json.RawMessage, len(timeline))
+	for i, ev := range timeline {
+		result[i] = ev
+		mentionsJSON := gjson.GetBytes(ev, `content.m\.mentions`)
+		if !mentionsJSON.IsObject() {
+			continue
+		}
+		var mentions Mentions
+		mentions.Room = mentionsJSON.Get("room").Type == gjson.True
+		for _, mentioned := range mentionsJSON.Get("user_ids").Array() {
+			if mentioned.Str == userID {
+				mentions.User = true
+				break
+			}
+		}
+		if !mentions.User && !mentions.Room {
+			continue
+		}
+		annotated, err := sjson.SetBytes(ev, "unsigned."+strings.ReplaceAll(MentionsKey, ".", `\.`), mentions)
+		if err != nil {
+			continue
+		}
+		result[i] = annotated
+	}
+	return result
+}
+
+// EncryptedMetadataKey is the key in the unsigned section of encrypted timeline events where their
+// cleartext metadata is embedded, when a subscription sets include_encrypted_metadata.
+const EncryptedMetadataKey = "org.matrix.sliding_sync.encrypted_metadata"
+
+// EncryptedMetadata is the metadata of an m.room.encrypted event which is not encrypted, so clients
+// can order and thread events before they decrypt them. Only fields outside the ciphertext are
+// used: the event's sender and timestamp, the encryption algorithm, and the `m.relates_to` which
+// senders leave in cleartext so servers can aggregate relations. Nothing is inferred from the
+// encrypted payload, and fields which are missing or malformed in the event are omitted.
+type EncryptedMetadata struct {
+	Sender         string `json:"sender"`
+	OriginServerTS int64  `json:"origin_server_ts"`
+	Algorithm      string `json:"algorithm,omitempty"`
+	// The `rel_type` and `event_id` of the cleartext `m.relates_to`.
+	RelType   string `json:"rel_type,omitempty"`
+	RelatesTo string `json:"relates_to,omitempty"`
+	// The event ID in the cleartext `m.relates_to.m.in_reply_to`, if any.
+	InReplyTo string `json:"in_reply_to,omitempty"`
+}
+
+// NewEncryptedMetadata returns the cleartext metadata of an m.room.encrypted event, or nil if the
+// event is not an m.room.encrypted event.
+func NewEncryptedMetadata(ev json.RawMessage) *EncryptedMetadata {
+	parsed := gjson.ParseBytes(ev)
+	if parsed.Get("type").Str != "m.room.encrypted" {
+		return nil
+	}
+	// use .Str and .Num rather than String() and Int() so values of the wrong type are omitted
+	// rather than converted
+	metadata := &EncryptedMetadata{
+		Sender:    parsed.Get("sender").Str,
+		Algorithm: parsed.Get("content.algorithm").Str,
+	}
+	if ts := parsed.Get("origin_server_ts"); ts.Type == gjson.Number {
+		metadata.OriginServerTS = ts.Int()
+	}
+	relatesTo := parsed.Get(`content.m\.relates_to`)
+	if relatesTo.IsObject() {
+		metadata.RelType = relatesTo.Get("rel_type").Str
+		metadata.RelatesTo = relatesTo.Get("event_id").Str
+		metadata.InReplyTo = relatesTo.Get(`m\.in_reply_to.event_id`).Str
+	}
+	return metadata
+}
+
+// EmbedEncryptedMetadata returns a copy of the timeline where m.room.encrypted events have
+// EncryptedMetadataKey set. Other events are returned unchanged.
+func EmbedEncryptedMetadata(timeline []json.RawMessage) []json.RawMessage {
+	result := make([]json.RawMessage, len(timeline))
+	for i, ev := range timeline {
+		result[i] = ev
+		metadata := NewEncryptedMetadata(ev)
+		if metadata == nil {
+			continue
+		}
+		embedded, err := sjson.SetBytes(ev, "unsigned."+strings.ReplaceAll(EncryptedMetadataKey, ".", `\.`), metadata)
+		if err != nil {
+			continue
+		}
+		result[i] = embedded
+	}
+	return result
+}
+
+// ServerACL is the room's m.room.server_acl, returned when a subscription sets
+// include_server_acl. Omitted if the room has no server ACL.
+type ServerACL struct {
+	Allow           []string `json:"allow"`
+	Deny            []string `json:"deny"`
+	AllowIPLiterals bool     `json:"allow_ip_literals"`
+}
+
+// NewServerACL parses an m.room.server_acl event. Entries which are not strings are skipped, and
+// allow_ip_literals defaults to true as per the spec. Returns nil if the event is nil.
+func NewServerACL(aclEvent json.RawMessage) *ServerACL {
+	if aclEvent == nil {
+		return nil
+	}
+	content := gjson.GetBytes(aclEvent, "content")
+	acl := &ServerACL{
+		Allow:           []string{},
+		Deny:            []string{},
+		AllowIPLiterals: true,
+	}
+	for _, server := range content.Get("allow").Array() {
+		if server.Type == gjson.String {
+			acl.Allow = append(acl.Allow, server.Str)
+		}
+	}
+	for _, server := range content.Get("deny").Array() {
+		if server.Type == gjson.String {
+			acl.Deny = append(acl.Deny, server.Str)
+		}
+	}
+	if allowIPLiterals := content.Get("allow_ip_literals"); allowIPLiterals.IsBool() {
+		acl.AllowIPLiterals = allowIPLiterals.Bool()
+	}
+	return acl
+}
+
+// NewNameContent returns the content of an m.room.name event, including any custom fields. Returns
+// nil if the event is nil or its content is not an object.
+func NewNameContent(nameEvent json.RawMessage) json.RawMessage {
+	content := gjson.GetBytes(nameEvent, "content")
+	if !content.IsObject() {
+		return nil
+	}
+	return json.RawMessage(content.Raw)
+}
+
+// RoomTopic is the room's m.room.topic, returned when a subscription sets include_topic.
+type RoomTopic struct {
+	// The plain text topic.
+	Topic string `json:"topic"`
+	// The representations of the topic from `m.topic`, in order of preference. Omitted if the
+	// topic has no rich content.
+	Representations []TopicRepresentation `json:"m.topic,omitempty"`
+}
+
+type TopicRepresentation struct {
+	// Defaults to text/plain if omitted.
+	MimeType string `json:"mimetype,omitempty"`
+	Body     string `json:"body"`
+}
+
+// NewRoomTopic parses an m.room.topic event, handling both the legacy `topic` field and the
+// `m.topic` rich content. If the legacy field is missing, the plain text topic is taken from the
+// first text/plain representation. Returns nil if the event is nil.
+func NewRoomTopic(topicEvent json.RawMessage) *RoomTopic {
+	if topicEvent == nil {
+		return nil
+	}
+	content := gjson.GetBytes(topicEvent, "content")
+	rt := &RoomTopic{}
+	for _, repr := range content.Get(`m\.topic.m\.text`).Array() {
+		body := repr.Get("body")
+		if body.Type != gjson.String {
+			continue
+		}
+		rt.Representations = append(rt.Representations, TopicRepresentation{
+			MimeType: repr.Get("mimetype").Str,
+			Body:     body.Str,
+		})
+	}
+	if topic := content.Get("topic"); topic.Type == gjson.String {
+		rt.Topic = topic.Str
+	} else {
+		for _, repr := range rt.Representations {
+			if repr.MimeType == "" || repr.MimeType == "text/plain" {
+				rt.Topic = repr.Body
+				break
+			}
+		}
+	}
+	return rt
+}
+
+// RelationTarget is the minimal information about the target of a relation in the timeline when
+// the target is not in the timeline, returned when a subscription sets include_relation_targets.
+type RelationTarget struct {
+	EventID string `json:"event_id"`
+	Type    string `json:"type"`
+}
+
+// MissingRelationTargets returns the event IDs of the targets of relations in the timeline which
+// are not themselves in the timeline, in timeline order without duplicates.
+func MissingRelationTargets(timeline []json.RawMessage) []string {
+	inTimeline := make(map[string]struct{}, len(timeline))
+	for _, ev := range timeline {
+		inTimeline[gjson.GetBytes(ev, "event_id").Str] = struct{}{}
+	}
+	var targets []string
+	for _, ev := range timeline {
+		relatesTo := gjson.GetBytes(ev, `content.m\.relates_to`)
+		targetID := relatesTo.Get("event_id").Str
+		// replies use m.in_reply_to rather than a rel_type, and are not relations we aggregate
+		if targetID == "" || relatesTo.Get("rel_type").Str == "" {
+			continue
+		}
+		if _, ok := inTimeline[targetID]; ok {
+			continue
+		}
+		inTimeline[targetID] = struct{}{}
+		targets = append(targets, targetID)
+	}
+	return targets
+}
+
+// RoomCreate is a summary of the room's m.room.create event, returned when a subscription sets
+// include_create. Defaults from the spec are filled in when the event omits a field.
+type RoomCreate struct {
+	RoomVersion string `json:"room_version"`
+	Creator     string `json:"creator"`
+	// The room type e.g "m.space". Omitted for rooms without a type.
+	Type      string `json:"type,omitempty"`
+	Federated bool   `json:"m.federate"`
+}
+
+// NewRoomCreate parses an m.room.create event. Returns nil if the event is nil.
+func NewRoomCreate(createEvent json.RawMessage) *RoomCreate {
+	if createEvent == nil {
+		return nil
+	}
+	ev := gjson.ParseBytes(createEvent)
+	content := ev.Get("content")
+	rc := &RoomCreate{
+		// rooms without a room_version are v1 rooms
+		RoomVersion: "1",
+		// room versions prior to v11 have a `creator` field, from v11 onwards the sender is the creator.
+		Creator:   ev.Get("sender").Str,
+		Type:      content.Get("type").Str,
+		Federated: true,
+	}
+	if roomVersion := content.Get("room_version"); roomVersion.Type == gjson.String && roomVersion.Str != "" {
+		rc.RoomVersion = roomVersion.Str
+	}
+	if creator := content.Get("creator"); creator.Type == gjson.String && creator.Str != "" {
+		rc.Creator = creator.Str
+	}
+	if federate := content.Get(`m\.federate`); federate.IsBool() {
+		rc.Federated = federate.Bool()
+	}
+	return rc
+}
+
+// JoinRules is the parsed content of the room's m.room.join_rules event, returned when a
+// subscription sets include_join_rules.
+type JoinRules struct {
+	JoinRule string `json:"join_rule"`
+	// The conditions under which a user can join a restricted room. Only set for
+	// join rules which use allow conditions, e.g "restricted" and "knock_restricted".
+	Allow []JoinRuleAllow `json:"allow,omitempty"`
+}
+
+type JoinRuleAllow struct {
+	Type string `json:"type"`
+	// Set for m.room_membership conditions: a member of this room can join.
+	RoomID string `json:"room_id,omitempty"`
+}
+
+// NewJoinRules parses an m.room.join_rules event. Returns nil if the event is nil. Allow
+// conditions which are not objects are skipped.
+func NewJoinRules(joinRulesEvent json.RawMessage) *JoinRules {
+	if joinRulesEvent == nil {
+		return nil
+	}
+	content := gjson.GetBytes(joinRulesEvent, "content")
+	jr := &JoinRules{
+		JoinRule: content.Get("join_rule").Str,
+	}
+	for _, allow := range content.Get("allow").Array() {
+		if !allow.IsObject() {
+			continue
+		}
+		jr.Allow = append(jr.Allow, JoinRuleAllow{
+			Type:   allow.Get("type").Str,
+			RoomID: allow.Get("room_id").Str,
+		})
+	}
+	return jr
+}
+
+// MembershipChange is a structured form of an m.room.member event in the room timeline, so
+// clients do not need to parse the event to show e.g. why someone was kicked or banned.
+type MembershipChange struct {
+	EventID    string `json:"event_id"`
+	Sender     string `json:"sender"`
+	UserID     string `json:"user_id"`
+	Membership string `json:"membership"`
+	// The reason given by the sender. Omitted if the event has no reason, or the reason is
+	// not a non-empty string.
+	Reason string `json:"reason,omitempty"`
+	// Set if this membership is the result of a third party invite.
+	ThirdPartyInvite *MembershipThirdPartyInvite `json:"third_party_invite,omitempty"`
+}
+
+type MembershipThirdPartyInvite struct {
+	DisplayName string `json:"display_name"`
+}
+
+// MembershipChangesFromTimeline returns a MembershipChange for every m.room.member event in the
+// timeline, in timeline order. Returns nil if there are none.
+func MembershipChangesFromTimeline(timeline []json.RawMessage) []MembershipChange {
+	var changes []MembershipChange
+	for _, ev := range timeline {
+		parsed := gjson.ParseBytes(ev)
+		if parsed.Get("type").Str != "m.room.member" {
+			continue
+		}
+		stateKey := parsed.Get("state_key")
+		if !stateKey.Exists() {
+			continue
+		}
+		change := MembershipChange{
+			EventID:    parsed.Get("event_id").Str,
+			Sender:     parsed.Get("sender").Str,
+			UserID:     stateKey.Str,
+			Membership: parsed.Get("content.membership").Str,
+		}
+		if reason := parsed.Get("content.reason"); reason.Type == gjson.String {
+			change.Reason = reason.Str
+		}
+		if tpi := parsed.Get("content.third_party_invite"); tpi.IsObject() {
+			change.ThirdPartyInvite = &MembershipThirdPartyInvite{
+				DisplayName: tpi.Get("display_name").Str,
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes
 }
 
 // RoomConnMetadata represents a room as seen by one specific connection (hence one
@@ -63,9 +628,10 @@ func (r *RoomConnMetadata) SameRoomAvatar(next *RoomConnMetadata) bool {
 	if next.IsDM {
 		// the avatar is the same IF:
 		// - the m.room.avatar event is the same AND
-		// - the heroes haven't changed AND
-		// - the number of heroes is 1
-		return sameRoomAvatar && sameHeroAvatars(r.Heroes, next.Heroes) && len(next.Heroes) == 1
+		// - the heroes haven't changed
+		// The number of heroes matters too, as only DMs with 1 hero use their avatar, but a change
+		// in the number of heroes is a change in the heroes.
+		return sameRoomAvatar && sameHeroAvatars(r.Heroes, next.Heroes)
 	}
 	// the avatar is the same IF:
 	// - the m.room.avatar event is the same
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 	"reflect"
 	"testing"
 )
@@ -72,3 +73,371 @@ func TestAvatarChangeMarshalling(t *testing.T) {
 		})
 	}
 }
+
+func TestMembershipChangesFromTimeline(t *testing.T) {
+	timeline := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.message","event_id":"$msg","sender":"@alice:localhost","content":{"body":"hi"}}`),
+		json.RawMessage(`{"type":"m.room.member","event_id":"$ban","sender":"@alice:localhost","state_key":"@bob:localhost","content":{"membership":"ban","reason":"spam"}}`),
+		json.RawMessage(`{"type":"m.room.member","event_id":"$kick","sender":"@alice:localhost","state_key":"@charlie:localhost","content":{"membership":"leave"}}`),
+		json.RawMessage(`{"type":"m.room.member","event_id":"$bad","sender":"@alice:localhost","state_key":"@doris:localhost","content":{"membership":"leave","reason":42}}`),
+		json.RawMessage(`{"type":"m.room.member","event_id":"$3pid","sender":"@alice:localhost","state_key":"@eve:localhost","content":{"membership":"invite","third_party_invite":{"display_name":"eve@example.com","signed":{}}}}`),
+	}
+	got := MembershipChangesFromTimeline(timeline)
+	want := []MembershipChange{
+		{EventID: "$ban", Sender: "@alice:localhost", UserID: "@bob:localhost", Membership: "ban", Reason: "spam"},
+		{EventID: "$kick", Sender: "@alice:localhost", UserID: "@charlie:localhost", Membership: "leave"},
+		{EventID: "$bad", Sender: "@alice:localhost", UserID: "@doris:localhost", Membership: "leave"},
+		{
+			EventID: "$3pid", Sender: "@alice:localhost", UserID: "@eve:localhost", Membership: "invite",
+			ThirdPartyInvite: &MembershipThirdPartyInvite{DisplayName: "eve@example.com"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v\nwant %+v", got, want)
+	}
+
+	// the reason is omitted entirely when absent
+	b, err := json.Marshal(got[1])
+	if err != nil {
+		t.Fatalf("failed to marshal: %s", err)
+	}
+	if gjson.GetBytes(b, "reason").Exists() {
+		t.Fatalf("reason should be omitted when absent: %s", string(b))
+	}
+
+	if changes := MembershipChangesFromTimeline(timeline[:1]); changes != nil {
+		t.Fatalf("expected no changes, got %+v", changes)
+	}
+}
+
+func TestNewJoinRules(t *testing.T) {
+	if jr := NewJoinRules(nil); jr != nil {
+		t.Fatalf("expected nil join rules for a missing event, got %+v", jr)
+	}
+	got := NewJoinRules(json.RawMessage(`{"type":"m.room.join_rules","state_key":"","content":{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!space:localhost"},{"type":"m.future"},"bad"]}}`))
+	want := &JoinRules{
+		JoinRule: "restricted",
+		Allow: []JoinRuleAllow{
+			{Type: "m.room_membership", RoomID: "!space:localhost"},
+			{Type: "m.future"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+}
+
+func TestNewRoomCreate(t *testing.T) {
+	testCases := []struct {
+		name  string
+		event string
+		want  *RoomCreate
+	}{
+		{
+			name:  "v1 room without room_version",
+			event: `{"type":"m.room.create","state_key":"","sender":"@alice:localhost","content":{"creator":"@alice:localhost"}}`,
+			want:  &RoomCreate{RoomVersion: "1", Creator: "@alice:localhost", Federated: true},
+		},
+		{
+			name:  "v10 room uses content.creator",
+			event: `{"type":"m.room.create","state_key":"","sender":"@sender:localhost","content":{"creator":"@alice:localhost","room_version":"10","m.federate":false}}`,
+			want:  &RoomCreate{RoomVersion: "10", Creator: "@alice:localhost", Federated: false},
+		},
+		{
+			name:  "v11 space uses the sender",
+			event: `{"type":"m.room.create","state_key":"","sender":"@bob:localhost","content":{"room_version":"11","type":"m.space"}}`,
+			want:  &RoomCreate{RoomVersion: "11", Creator: "@bob:localhost", Type: "m.space", Federated: true},
+		},
+	}
+	for _, tc := range testCases {
+		got := NewRoomCreate(json.RawMessage(tc.event))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+	if got := NewRoomCreate(nil); got != nil {
+		t.Errorf("expected nil for a missing create event, got %+v", got)
+	}
+}
+
+func TestMissingRelationTargets(t *testing.T) {
+	timeline := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.message","event_id":"$original","content":{"body":"hi"}}`),
+		// edit of an event in the timeline
+		json.RawMessage(`{"type":"m.room.message","event_id":"$edit1","content":{"m.relates_to":{"rel_type":"m.replace","event_id":"$original"}}}`),
+		// edit of an event outside the timeline
+		json.RawMessage(`{"type":"m.room.message","event_id":"$edit2","content":{"m.relates_to":{"rel_type":"m.replace","event_id":"$old"}}}`),
+		// reactions
+		json.RawMessage(`{"type":"m.reaction","event_id":"$react1","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$old","key":"👍"}}}`),
+		json.RawMessage(`{"type":"m.reaction","event_id":"$react2","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$older","key":"👍"}}}`),
+		// replies are not relations
+		json.RawMessage(`{"type":"m.room.message","event_id":"$reply","content":{"m.relates_to":{"m.in_reply_to":{"event_id":"$oldest"}}}}`),
+	}
+	got := MissingRelationTargets(timeline)
+	want := []string{"$old", "$older"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got := MissingRelationTargets(timeline[:2]); got != nil {
+		t.Fatalf("got %v want nil", got)
+	}
+}
+
+func TestNewRoomTopic(t *testing.T) {
+	if rt := NewRoomTopic(nil); rt != nil {
+		t.Fatalf("expected nil topic for a missing event, got %+v", rt)
+	}
+	testCases := []struct {
+		name  string
+		event string
+		want  *RoomTopic
+	}{
+		{
+			name:  "legacy plain topic",
+			event: `{"type":"m.room.topic","state_key":"","content":{"topic":"plain"}}`,
+			want:  &RoomTopic{Topic: "plain"},
+		},
+		{
+			name:  "rich topic with legacy fallback",
+			event: `{"type":"m.room.topic","state_key":"","content":{"topic":"fallback","m.topic":{"m.text":[{"mimetype":"text/html","body":"<b>rich</b>"},{"body":"rich"}]}}}`,
+			want: &RoomTopic{Topic: "fallback", Representations: []TopicRepresentation{
+				{MimeType: "text/html", Body: "<b>rich</b>"},
+				{Body: "rich"},
+			}},
+		},
+		{
+			name:  "rich topic without legacy fallback",
+			event: `{"type":"m.room.topic","state_key":"","content":{"m.topic":{"m.text":[{"mimetype":"text/html","body":"<b>rich</b>"},{"mimetype":"text/plain","body":"rich"},{"body":5}]}}}`,
+			want: &RoomTopic{Topic: "rich", Representations: []TopicRepresentation{
+				{MimeType: "text/html", Body: "<b>rich</b>"},
+				{MimeType: "text/plain", Body: "rich"},
+			}},
+		},
+		{
+			name:  "topic removed",
+			event: `{"type":"m.room.topic","state_key":"","content":{}}`,
+			want:  &RoomTopic{},
+		},
+	}
+	for _, tc := range testCases {
+		got := NewRoomTopic(json.RawMessage(tc.event))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewServerACL(t *testing.T) {
+	if acl := NewServerACL(nil); acl != nil {
+		t.Fatalf("expected nil ACL for a missing event, got %+v", acl)
+	}
+	got := NewServerACL(json.RawMessage(`{"type":"m.room.server_acl","state_key":"","content":{"allow":["*"],"deny":["evil.example.com",5]}}`))
+	want := &ServerACL{Allow: []string{"*"}, Deny: []string{"evil.example.com"}, AllowIPLiterals: true}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+	got = NewServerACL(json.RawMessage(`{"type":"m.room.server_acl","state_key":"","content":{"allow_ip_literals":false}}`))
+	want = &ServerACL{Allow: []string{}, Deny: []string{}, AllowIPLiterals: false}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+}
+
+func TestNewWidgets(t *testing.T) {
+	if got := NewWidgets(nil); got == nil || len(got) != 0 {
+		t.Fatalf("expected an empty list of widgets, got %+v", got)
+	}
+	got := NewWidgets([]json.RawMessage{
+		json.RawMessage(`{"type":"im.vector.modular.widgets","state_key":"b","sender":"@alice:localhost","content":{"type":"jitsi","url":"https://legacy.example.com","name":"Legacy","data":{"conferenceId":"abc"}}}`),
+		json.RawMessage(`{"type":"m.widget","state_key":"a","sender":"@bob:localhost","content":{"type":"m.etherpad","url":"https://pad.example.com"}}`),
+		// the same widget ID in both event types prefers m.widget
+		json.RawMessage(`{"type":"im.vector.modular.widgets","state_key":"c","sender":"@alice:localhost","content":{"type":"custom","url":"https://old.example.com"}}`),
+		json.RawMessage(`{"type":"m.widget","state_key":"c","sender":"@alice:localhost","content":{"type":"custom","url":"https://new.example.com"}}`),
+		// removed widgets are skipped, even if they are still defined by a legacy event
+		json.RawMessage(`{"type":"im.vector.modular.widgets","state_key":"d","sender":"@alice:localhost","content":{"type":"custom","url":"https://removed.example.com"}}`),
+		json.RawMessage(`{"type":"m.widget","state_key":"d","sender":"@alice:localhost","content":{}}`),
+	})
+	want := []Widget{
+		{ID: "a", EventType: "m.widget", Sender: "@bob:localhost", Type: "m.etherpad", URL: "https://pad.example.com"},
+		{ID: "b", EventType: "im.vector.modular.widgets", Sender: "@alice:localhost", Type: "jitsi", URL: "https://legacy.example.com", Name: "Legacy", Data: json.RawMessage(`{"conferenceId":"abc"}`)},
+		{ID: "c", EventType: "m.widget", Sender: "@alice:localhost", Type: "custom", URL: "https://new.example.com"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+}
+
+func TestNewMembers(t *testing.T) {
+	if got := NewMembers(nil, nil); got == nil || len(got) != 0 {
+		t.Fatalf("expected an empty list of members, got %+v", got)
+	}
+	members := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.member","state_key":"@bob:localhost","content":{"membership":"join"}}`),
+		json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","content":{"membership":"join","displayname":"Alice","avatar_url":"mxc://localhost/alice"}}`),
+		json.RawMessage(`{"type":"m.room.member","state_key":"@charlie:localhost","content":{"membership":"leave"}}`),
+		// not a member event
+		json.RawMessage(`{"type":"m.room.name","state_key":"","content":{"name":"Room"}}`),
+	}
+	powerLevels := json.RawMessage(`{"type":"m.room.power_levels","state_key":"","content":{"users_default":10,"users":{"@alice:localhost":100}}}`)
+	want := []Member{
+		{UserID: "@alice:localhost", Membership: "join", DisplayName: "Alice", AvatarURL: "mxc://localhost/alice", PowerLevel: 100},
+		{UserID: "@bob:localhost", Membership: "join", PowerLevel: 10},
+		{UserID: "@charlie:localhost", Membership: "leave", PowerLevel: 10},
+	}
+	if got := NewMembers(members, powerLevels); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v want %+v", got, want)
+	}
+	// no power levels means everyone has a power level of 0
+	got := NewMembers(members, nil)
+	for _, m := range got {
+		if m.PowerLevel != 0 {
+			t.Fatalf("got power level %d for %s want 0", m.PowerLevel, m.UserID)
+		}
+	}
+}
+
+func TestEmbedSenderProfiles(t *testing.T) {
+	profilePath := "unsigned.org\\.matrix\\.sliding_sync\\.sender_profile"
+	members := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","content":{"membership":"join","displayname":"Alice","avatar_url":"mxc://localhost/alice"}}`),
+		json.RawMessage(`{"type":"m.room.member","state_key":"@bob:localhost","content":{"membership":"leave"}}`),
+	}
+	timeline := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.message","sender":"@alice:localhost","content":{"body":"hi"},"unsigned":{"age":5}}`),
+		// bob's current membership has no profile
+		json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"bye"}}`),
+		// charlie has no membership, and this is not charlie's own member event
+		json.RawMessage(`{"type":"m.room.message","sender":"@charlie:localhost","content":{"body":"?"}}`),
+		// doris has no membership, but the profile in her own member event is used
+		json.RawMessage(`{"type":"m.room.member","state_key":"@doris:localhost","sender":"@doris:localhost","content":{"membership":"join","displayname":"Doris"}}`),
+		// alice's current profile is used over the profile in her old member event
+		json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","sender":"@alice:localhost","content":{"membership":"join","displayname":"Old Alice"}}`),
+	}
+	original := append([]json.RawMessage{}, timeline...)
+	got := EmbedSenderProfiles(timeline, members)
+	if !reflect.DeepEqual(timeline, original) {
+		t.Fatalf("timeline was modified")
+	}
+	want := []string{
+		`{"displayname":"Alice","avatar_url":"mxc://localhost/alice"}`,
+		`{}`,
+		``,
+		`{"displayname":"Doris"}`,
+		`{"displayname":"Alice","avatar_url":"mxc://localhost/alice"}`,
+	}
+	for i := range want {
+		if profile := gjson.GetBytes(got[i], profilePath).Raw; profile != want[i] {
+			t.Errorf("event %d: got profile %s want %s", i, profile, want[i])
+		}
+	}
+	if age := gjson.GetBytes(got[0], "unsigned.age").Int(); age != 5 {
+		t.Errorf("unsigned.age was lost: got %d", age)
+	}
+}
+
+func TestAnnotateMentions(t *testing.T) {
+	mentionsPath := "unsigned.org\\.matrix\\.sliding_sync\\.mentions"
+	userID := "@alice:localhost"
+	timeline := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hi Alice","m.mentions":{"user_ids":["@charlie:localhost","@alice:localhost"]}},"unsigned":{"age":5}}`),
+		json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hi all","m.mentions":{"room":true}}}`),
+		json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hi everyone","m.mentions":{"room":true,"user_ids":["@alice:localhost"]}}}`),
+		// mentions someone else
+		json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hi Charlie","m.mentions":{"user_ids":["@charlie:localhost"]}}}`),
+		// explicitly mentions nobody
+		json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hi","m.mentions":{}}}`),
+		// the display name in the body is not an intentional mention
+		json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"@alice:localhost"}}`),
+		// room must be exactly true
+		json.RawMessage(`{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hi","m.mentions":{"room":"true"}}}`),
+	}
+	original := append([]json.RawMessage{}, timeline...)
+	got := AnnotateMentions(timeline, userID)
+	if !reflect.DeepEqual(timeline, original) {
+		t.Fatalf("timeline was modified")
+	}
+	want := []string{
+		`{"user":true}`,
+		`{"room":true}`,
+		`{"user":true,"room":true}`,
+		``,
+		``,
+		``,
+		``,
+	}
+	for i := range want {
+		if mentions := gjson.GetBytes(got[i], mentionsPath).Raw; mentions != want[i] {
+			t.Errorf("event %d: got mentions %s want %s", i, mentions, want[i])
+		}
+		if want[i] == "" && string(got[i]) != string(timeline[i]) {
+			t.Errorf("event %d was modified: %s", i, string(got[i]))
+		}
+	}
+	if age := gjson.GetBytes(got[0], "unsigned.age").Int(); age != 5 {
+		t.Errorf("unsigned.age was lost: got %d", age)
+	}
+}
+
+func TestEmbedEncryptedMetadata(t *testing.T) {
+	metadataPath := "unsigned.org\\.matrix\\.sliding_sync\\.encrypted_metadata"
+	timeline := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.encrypted","event_id":"$a","sender":"@bob:localhost","origin_server_ts":1000,"content":{"algorithm":"m.megolm.v1.aes-sha2","ciphertext":"AwgAEnAC","session_id":"ses","sender_key":"key","device_id":"DEV"},"unsigned":{"age":5}}`),
+		// thread replies keep m.relates_to in cleartext
+		json.RawMessage(`{"type":"m.room.encrypted","event_id":"$b","sender":"@bob:localhost","origin_server_ts":2000,"content":{"algorithm":"m.megolm.v1.aes-sha2","ciphertext":"AwgAEnAC","m.relates_to":{"rel_type":"m.thread","event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$a"}}}}`),
+		// malformed cleartext fields are omitted rather than converted
+		json.RawMessage(`{"type":"m.room.encrypted","event_id":"$c","sender":"@bob:localhost","origin_server_ts":"3000","content":{"algorithm":7,"ciphertext":"AwgAEnAC","m.relates_to":{"rel_type":["m.thread"],"event_id":{"id":"$root"}}}}`),
+		// not encrypted
+		json.RawMessage(`{"type":"m.room.message","event_id":"$d","sender":"@bob:localhost","origin_server_ts":4000,"content":{"body":"hi","m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}}`),
+	}
+	original := append([]json.RawMessage{}, timeline...)
+	got := EmbedEncryptedMetadata(timeline)
+	if !reflect.DeepEqual(timeline, original) {
+		t.Fatalf("timeline was modified")
+	}
+	want := []string{
+		`{"sender":"@bob:localhost","origin_server_ts":1000,"algorithm":"m.megolm.v1.aes-sha2"}`,
+		`{"sender":"@bob:localhost","origin_server_ts":2000,"algorithm":"m.megolm.v1.aes-sha2","rel_type":"m.thread","relates_to":"$root","in_reply_to":"$a"}`,
+		`{"sender":"@bob:localhost","origin_server_ts":0}`,
+		``,
+	}
+	for i := range want {
+		if metadata := gjson.GetBytes(got[i], metadataPath).Raw; metadata != want[i] {
+			t.Errorf("event %d: got encrypted metadata %s want %s", i, metadata, want[i])
+		}
+		// the rest of the event is unchanged
+		withoutMetadata, err := sjson.DeleteBytes(got[i], metadataPath)
+		if err != nil {
+			t.Fatalf("event %d: failed to remove metadata: %s", i, err)
+		}
+		if want[i] != "" && !gjson.GetBytes(timeline[i], "unsigned").Exists() {
+			withoutMetadata, _ = sjson.DeleteBytes(withoutMetadata, "unsigned")
+		}
+		if string(withoutMetadata) != string(timeline[i]) {
+			t.Errorf("event %d: got %s want %s", i, string(withoutMetadata), string(timeline[i]))
+		}
+	}
+}
+
+func TestNewNameContent(t *testing.T) {
+	testCases := []struct {
+		name  string
+		event json.RawMessage
+		want  string
+	}{
+		{name: "missing event", event: nil, want: ""},
+		{name: "plain name", event: json.RawMessage(`{"type":"m.room.name","state_key":"","content":{"name":"Room"}}`), want: `{"name":"Room"}`},
+		{
+			name:  "custom fields are passed through",
+			event: json.RawMessage(`{"type":"m.room.name","state_key":"","content":{"name":"Room","org.example.localised":{"de":"Raum","fr":"Salle"},"org.example.emoji":"🏠"}}`),
+			want:  `{"name":"Room","org.example.localised":{"de":"Raum","fr":"Salle"},"org.example.emoji":"🏠"}`,
+		},
+		{name: "removed name", event: json.RawMessage(`{"type":"m.room.name","state_key":"","content":{}}`), want: `{}`},
+		{name: "malformed content", event: json.RawMessage(`{"type":"m.room.name","state_key":"","content":"Room"}`), want: ""},
+	}
+	for _, tc := range testCases {
+		got := NewNameContent(tc.event)
+		if string(got) != tc.want {
+			t.Errorf("%s: got %s want %s", tc.name, string(got), tc.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package sync3
+
+// roomTree is an ordered sequence of room IDs, stored as a treap keyed on position: every node
+// knows the size of its subtree, so rooms can be found, inserted and removed by index in O(log n).
+// Nodes know their parent too, so finding the index of a room is also O(log n).
+//
+// The tree does not know how rooms are sorted, it only keeps them in the order they are
+// inserted. See SortableRooms.
+type roomTree struct {
+	root  *roomTreeNode
+	nodes map[string]*roomTreeNode // room_id -> node
+	// state of the xorshift generator for node priorities. Deterministic, as the priorities only
+	// need to be spread out to keep the tree balanced.
+	seed uint32
+}
+
+type roomTreeNode struct {
+	roomID              string
+	priority            uint32
+	size                int // number of nodes in this subtree, including this one
+	left, right, parent *roomTreeNode
+}
+
+func newRoomTree(roomIDs []string) *roomTree {
+	t := &roomTree{
+		nodes: make(map[string]*roomTreeNode, len(roomIDs)),
+		seed:  2463534242,
+	}
+	t.rebuild(roomIDs)
+	return t
+}
+
+func (t *roomTree) nextPriority() uint32 {
+	t.seed ^= t.seed << 13
+	t.seed ^= t.seed >> 17
+	t.seed ^= t.seed << 5
+	return t.seed
+}
+
+// rebuild replaces the rooms in the tree with these rooms, in this order. Rooms which are given
+// more than once are only kept the first time. Takes O(n).
+func (t *roomTree) rebuild(roomIDs []string) {
+	nodes := make(map[string]*roomTreeNode, len(roomIDs))
+	uniqueRoomIDs := make([]string, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if _, exists := nodes[roomID]; exists {
+			continue
+		}
+		// reuse nodes, as rebuilding happens every time the list is sorted
+		n := t.nodes[roomID]
+		if n == nil {
+			n = &roomTreeNode{roomID: roomID}
+		}
+		nodes[roomID] = n
+		uniqueRoomIDs = append(uniqueRoomIDs, roomID)
+	}
+	t.nodes = nodes
+	t.root = t.build(uniqueRoomIDs)
+	if t.root != nil {
+		t.root.parent = nil
+	}
+}
+
+// build a balanced tree of these rooms, then sift priorities down so that the tree is a treap.
+func (t *roomTree) build(roomIDs []string) *roomTreeNode {
+	if len(roomIDs) == 0 {
+		return nil
+	}
+	mid := len(roomIDs) / 2
+	n := t.nodes[roomIDs[mid]]
+	n.priority = t.nextPriority()
+	n.left = t.build(roomIDs[:mid])
+	n.right = t.build(roomIDs[mid+1:])
+	n.update()
+	// both subtrees are treaps, so swapping priorities down the tree makes this one a treap as well.
+	// The shape doesn't change, so neither does the order of the rooms.
+	for p := n; ; {
+		highest := p
+		if p.left != nil && p.left.priority > highest.priority {
+			highest = p.left
+		}
+		if p.right != nil && p.right.priority > highest.priority {
+			highest = p.right
+		}
+		if highest == p {
+			break
+		}
+		p.priority, highest.priority = highest.priority, p.priority
+		p = highest
+	}
+	return n
+}
+
+func (n *roomTreeNode) update() {
+	n.size = 1 + n.left.len() + n.right.len()
+	if n.left != nil {
+		n.left.parent = n
+	}
+	if n.right != nil {
+		n.right.parent = n
+	}
+}
+
+func (n *roomTreeNode) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// split the tree into the first k nodes and the rest.
+func split(n *roomTreeNode, k int) (left, right *roomTreeNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if k <= n.left.len() {
+		left, n.left = split(n.left, k)
+		n.update()
+		return left, n
+	}
+	n.right, right = split(n.right, k-n.left.len()-1)
+	n.update()
+	return n, right
+}
+
+// merge two trees, with all the nodes of left before the nodes of right.
+func merge(left, right *roomTreeNode) *roomTreeNode {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+	if left.priority > right.priority {
+		left.right = merge(left.right, right)
+		left.update()
+		return left
+	}
+	right.left = merge(left, right.left)
+	right.update()
+	return right
+}
+
+func (t *roomTree) setRoot(n *roomTreeNode) {
+	t.root = n
+	if n != nil {
+		n.parent = nil
+	}
+}
+
+func (t *roomTree) len() int {
+	return t.root.len()
+}
+
+// indexOf returns the index of the room, or false if it is not in the tree.
+func (t *roomTree) indexOf(roomID string) (int, bool) {
+	n, ok := t.nodes[roomID]
+	if !ok {
+		return 0, false
+	}
+	index := n.left.len()
+	for ; n.parent != nil; n = n.parent {
+		if n == n.parent.right {
+			index += n.parent.left.len() + 1
+		}
+	}
+	return index, true
+}
+
+// get returns the room at this index, which must be within the tree.
+func (t *roomTree) get(index int) string {
+	n := t.root
+	for {
+		leftLen := n.left.len()
+		if index < leftLen {
+			n = n.left
+		} else if index == leftLen {
+			return n.roomID
+		} else {
+			index -= leftLen + 1
+			n = n.right
+		}
+	}
+}
+
+// insert the room at this index, moving the rooms at and after it along one.
+func (t *roomTree) insert(index int, roomID string) {
+	n := &roomTreeNode{
+		roomID:   roomID,
+		priority: t.nextPriority(),
+		size:     1,
+	}
+	t.nodes[roomID] = n
+	left, right := split(t.root, index)
+	t.setRoot(merge(merge(left, n), right))
+}
+
+// remove the room, returning the index it was at. Returns -1 if it is not in the tree.
+func (t *roomTree) remove(roomID string) int {
+	index, ok := t.indexOf(roomID)
+	if !ok {
+		return -1
+	}
+	delete(t.nodes, roomID)
+	left, rest := split(t.root, index)
+	n, right := split(rest, 1)
+	n.left, n.right, n.parent = nil, nil, nil
+	t.setRoot(merge(left, right))
+	return index
+}
+
+// search returns the first index whose room isn't before the room being inserted, according to
+// isBefore, which is given each room and its index. isBefore must be true for a prefix of the tree
+// and false for the rest. Takes O(log n) calls to isBefore.
+func (t *roomTree) search(isBefore func(roomID string, index int) bool) int {
+	result := 0
+	offset := 0
+	for n := t.root; n != nil; {
+		index := offset + n.left.len()
+		if isBefore(n.roomID, index) {
+			result = index + 1
+			offset = index + 1
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return result
+}
+
+// slice returns the rooms from index i up to but not including j, in order. Takes O(log n + j-i).
+func (t *roomTree) slice(i, j int) []string {
+	roomIDs := make([]string, 0, j-i)
+	var walk func(n *roomTreeNode, offset int)
+	walk = func(n *roomTreeNode, offset int) {
+		if n == nil || offset >= j || offset+n.size <= i {
+			return
+		}
+		index := offset + n.left.len()
+		walk(n.left, offset)
+		if index >= i && index < j {
+			roomIDs = append(roomIDs, n.roomID)
+		}
+		walk(n.right, index+1)
+	}
+	walk(t.root, 0)
+	return roomIDs
+}
@@ -0,0 +1,57 @@
+package sync3
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Test that the tree behaves like a slice of room IDs after lots of random inserts and removals.
+func TestRoomTree(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	var want []string
+	for i := 0; i < 50; i++ {
+		want = append(want, fmt.Sprintf("!%d", i))
+	}
+	tree := newRoomTree(want)
+	next := len(want)
+	for i := 0; i < 2000; i++ {
+		if len(want) == 0 || rng.Intn(2) == 0 {
+			index := rng.Intn(len(want) + 1)
+			roomID := fmt.Sprintf("!%d", next)
+			next++
+			tree.insert(index, roomID)
+			want = append(want[:index], append([]string{roomID}, want[index:]...)...)
+		} else {
+			index := rng.Intn(len(want))
+			if got := tree.remove(want[index]); got != index {
+				t.Fatalf("remove %s: got index %d want %d", want[index], got, index)
+			}
+			want = append(want[:index], want[index+1:]...)
+		}
+		if tree.len() != len(want) {
+			t.Fatalf("got len %d want %d", tree.len(), len(want))
+		}
+	}
+	if got := tree.slice(0, tree.len()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got rooms %v want %v", got, want)
+	}
+	for i, roomID := range want {
+		if got, ok := tree.indexOf(roomID); !ok || got != i {
+			t.Errorf("indexOf %s: got %d %v want %d", roomID, got, ok, i)
+		}
+		if got := tree.get(i); got != roomID {
+			t.Errorf("get %d: got %s want %s", i, got, roomID)
+		}
+	}
+	if got := tree.slice(3, 7); !reflect.DeepEqual(got, want[3:7]) {
+		t.Errorf("slice: got %v want %v", got, want[3:7])
+	}
+	if _, ok := tree.indexOf("!unknown"); ok {
+		t.Errorf("indexOf unknown room: got ok")
+	}
+	if got := tree.remove("!unknown"); got != -1 {
+		t.Errorf("remove unknown room: got %d want -1", got)
+	}
+}
@@ -11,85 +11,70 @@ type RoomFinder interface {
 	ReadOnlyRoom(roomID string) *RoomConnMetadata
 }
 
-// SortableRooms represents a list of rooms which can be sorted and updated. Maintains mappings of
-// room IDs to current index positions after sorting.
+// SortableRooms represents a list of rooms which can be sorted and updated. Rooms are kept in an
+// order-statistic tree, so that the index of a room, and the rooms in a range, can be found in
+// O(log n), and a room which changed can be moved to its new position in O(log n). This matters
+// for accounts with tens of thousands of rooms, whose lists change on every live update.
 type SortableRooms struct {
-	finder        RoomFinder
-	listKey       string
-	roomIDs       []string
-	roomIDToIndex map[string]int // room_id -> index in rooms
+	finder  RoomFinder
+	listKey string
+	rooms   *roomTree
+	sortBy  []string // the sort order which was last successfully applied
+	// true if rooms may be out of order since the list was sorted: see MarkUnsorted
+	unsorted bool
+	// the comparators for sortBy
+	comparators []func(ri, rj *RoomConnMetadata) int
 }
 
 func NewSortableRooms(finder RoomFinder, listKey string, rooms []string) *SortableRooms {
 	return &SortableRooms{
-		roomIDs:       rooms,
-		finder:        finder,
-		listKey:       listKey,
-		roomIDToIndex: make(map[string]int),
+		rooms:   newRoomTree(rooms),
+		finder:  finder,
+		listKey: listKey,
 	}
 }
 
 func (s *SortableRooms) IndexOf(roomID string) (int, bool) {
-	index, ok := s.roomIDToIndex[roomID]
-	return index, ok
+	return s.rooms.indexOf(roomID)
 }
 
 func (s *SortableRooms) RoomIDs() []string {
-	roomIDs := make([]string, len(s.roomIDs))
-	for i := range s.roomIDs {
-		roomIDs[i] = s.roomIDs[i]
-	}
-	return roomIDs
+	return s.rooms.slice(0, s.rooms.len())
 }
 
-// Add a room to the list. Returns true if the room was added.
+// Add a room to the end of the list. Returns true if the room was added.
 func (s *SortableRooms) Add(roomID string) bool {
-	_, exists := s.roomIDToIndex[roomID]
-	if exists {
+	if _, exists := s.rooms.indexOf(roomID); exists {
 		return false
 	}
-	s.roomIDs = append(s.roomIDs, roomID)
-	s.roomIDToIndex[roomID] = len(s.roomIDs) - 1
+	s.rooms.insert(s.rooms.len(), roomID)
 	return true
 }
 
 func (s *SortableRooms) Get(index int) string {
 	// TODO: find a way to plumb a context into this assert
-	internal.Assert(fmt.Sprintf("index is within len(rooms) %v < %v", index, len(s.roomIDs)), index < len(s.roomIDs))
-	return s.roomIDs[index]
+	internal.Assert(fmt.Sprintf("index is within len(rooms) %v < %v", index, s.rooms.len()), index < s.rooms.len())
+	return s.rooms.get(index)
 }
 
 func (s *SortableRooms) Remove(roomID string) int {
-	index, ok := s.roomIDToIndex[roomID]
-	if !ok {
-		return -1
-	}
-	delete(s.roomIDToIndex, roomID)
-	// splice out index
-	s.roomIDs = append(s.roomIDs[:index], s.roomIDs[index+1:]...)
-	// re-update the map
-	for i := index; i < len(s.roomIDs); i++ {
-		s.roomIDToIndex[s.roomIDs[i]] = i
-	}
-	return index
+	return s.rooms.remove(roomID)
 }
 
 func (s *SortableRooms) Len() int64 {
-	return int64(len(s.roomIDs))
+	return int64(s.rooms.len())
 }
 func (s *SortableRooms) Subslice(i, j int64) Subslicer {
 	// TODO: find a way to plumb a context.Context through to this assert
-	internal.Assert("i < j and are within len(rooms)", i < j && i < int64(len(s.roomIDs)) && j <= int64(len(s.roomIDs)))
-	return &SortableRooms{
-		roomIDs:       s.roomIDs[i:j],
-		roomIDToIndex: s.roomIDToIndex,
-	}
+	internal.Assert("i < j and are within len(rooms)", i < j && i < s.Len() && j <= s.Len())
+	return SortableRoomsSubslice(s.rooms.slice(int(i), int(j)))
 }
 
+// Sort the whole list. This is O(n log n), so use SortRoom when only one room has changed.
 func (s *SortableRooms) Sort(sortBy []string) error {
 	// TODO: find a way to plumb a context into this assert
 	internal.Assert("sortBy is not empty", len(sortBy) != 0)
-	comparators := []func(i, j int) int{}
+	comparators := []func(ri, rj *RoomConnMetadata) int{}
 	for _, sort := range sortBy {
 		switch sort {
 		case SortByHighlightCount:
@@ -102,40 +87,143 @@ func (s *SortableRooms) Sort(sortBy []string) error {
 			comparators = append(comparators, s.comparatorSortByRecency)
 		case SortByNotificationLevel:
 			comparators = append(comparators, s.comparatorSortByNotificationLevel)
+		case SortByTag:
+			comparators = append(comparators, s.comparatorSortByTag)
 		default:
 			return fmt.Errorf("unknown sort order: %s", sort)
 		}
 	}
-	sort.SliceStable(s.roomIDs, func(i, j int) bool {
-		for _, fn := range comparators {
-			val := fn(i, j)
-			if val == 1 {
-				return true
-			} else if val == -1 {
-				return false
-			}
-			// continue to next comparator as these are equal
+	s.comparators = comparators
+	// resolve every room once, rather than on every comparison
+	roomIDs := s.RoomIDs()
+	rooms := make([]*RoomConnMetadata, len(roomIDs))
+	for i := range roomIDs {
+		rooms[i] = s.finder.ReadOnlyRoom(roomIDs[i])
+	}
+	sort.Stable(&roomsByComparators{
+		roomIDs: roomIDs,
+		rooms:   rooms,
+		compare: s.compare,
+	})
+	s.rooms.rebuild(roomIDs)
+	s.sortBy = sortBy
+	s.unsorted = false
+
+	return nil
+}
+
+// SortRoom moves this room to where it belongs in the list, after its sort values have changed
+// or it was just added. The rest of the list must already be sorted by sortBy, so this is only
+// O(log n). The room ends up where Sort would put it: rooms it ties with keep their order relative
+// to it. Sorts the whole list if it isn't already sorted by sortBy.
+func (s *SortableRooms) SortRoom(roomID string, sortBy []string) error {
+	if s.unsorted || !sortOrdersEqual(sortBy, s.sortBy) {
+		return s.Sort(sortBy)
+	}
+	fromIndex := s.rooms.remove(roomID)
+	if fromIndex == -1 {
+		return nil
+	}
+	r := s.finder.ReadOnlyRoom(roomID)
+	toIndex := s.rooms.search(func(otherRoomID string, index int) bool {
+		switch s.compare(r, s.finder.ReadOnlyRoom(otherRoomID)) {
+		case 1:
+			return false
+		case -1:
+			return true
 		}
-		// the two items are identical
-		return false
+		// the rooms are equal, so keep them in the same order as before
+		return index < fromIndex
 	})
-	for i := range s.roomIDs {
-		s.roomIDToIndex[s.roomIDs[i]] = i
+	s.rooms.insert(toIndex, roomID)
+	return nil
+}
+
+func sortOrdersEqual(a, b []string) bool {
+	if len(a) != len(b) || a == nil || b == nil {
+		return false
 	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
 
-	return nil
+// compare returns 1 if ri is sorted before rj, -1 if rj is sorted before ri, or 0 if they are equal.
+func (s *SortableRooms) compare(ri, rj *RoomConnMetadata) int {
+	for _, fn := range s.comparators {
+		if val := fn(ri, rj); val != 0 {
+			return val
+		}
+		// continue to next comparator as these are equal
+	}
+	// the two items are identical
+	return 0
 }
 
-// Comparator functions: -1 = false, +1 = true, 0 = match
+// MarkUnsorted records that rooms may be out of order e.g because rooms were added to the end of
+// the list, or their sort values changed, without sorting it. The next SortRoom sorts the whole
+// list.
+func (s *SortableRooms) MarkUnsorted() {
+	s.unsorted = true
+}
+
+// IsUnsorted returns true if MarkUnsorted was called since the list was last sorted by SortBy.
+func (s *SortableRooms) IsUnsorted() bool {
+	return s.unsorted && s.sortBy != nil
+}
+
+// SortBy returns the sort order which was last successfully applied to this list. Returns nil if
+// the list has never been sorted e.g because the requested sort order was invalid.
+func (s *SortableRooms) SortBy() []string {
+	return s.sortBy
+}
+
+// roomsByComparators sorts room IDs along with their rooms, for SortableRooms.Sort.
+type roomsByComparators struct {
+	roomIDs []string
+	rooms   []*RoomConnMetadata
+	compare func(ri, rj *RoomConnMetadata) int
+}
+
+func (r *roomsByComparators) Len() int {
+	return len(r.roomIDs)
+}
+
+func (r *roomsByComparators) Less(i, j int) bool {
+	return r.compare(r.rooms[i], r.rooms[j]) == 1
+}
+
+func (r *roomsByComparators) Swap(i, j int) {
+	r.roomIDs[i], r.roomIDs[j] = r.roomIDs[j], r.roomIDs[i]
+	r.rooms[i], r.rooms[j] = r.rooms[j], r.rooms[i]
+}
+
+// SortableRoomsSubslice is the room IDs in a range of a SortableRooms, in list order.
+type SortableRoomsSubslice []string
+
+func (s SortableRoomsSubslice) Len() int64 {
+	return int64(len(s))
+}
 
-func (s *SortableRooms) resolveRooms(i, j int) (ri, rj *RoomConnMetadata) {
-	ri = s.finder.ReadOnlyRoom(s.roomIDs[i])
-	rj = s.finder.ReadOnlyRoom(s.roomIDs[j])
-	return
+func (s SortableRoomsSubslice) Subslice(i, j int64) Subslicer {
+	// TODO: find a way to plumb a context.Context through to this assert
+	internal.Assert("i < j and are within len(rooms)", i < j && i < s.Len() && j <= s.Len())
+	return s[i:j]
+}
+
+// RoomIDs returns a copy of the room IDs.
+func (s SortableRoomsSubslice) RoomIDs() []string {
+	roomIDs := make([]string, len(s))
+	copy(roomIDs, s)
+	return roomIDs
 }
 
-func (s *SortableRooms) comparatorSortByName(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+// Comparator functions: -1 = false, +1 = true, 0 = match
+
+func (s *SortableRooms) comparatorSortByName(ri, rj *RoomConnMetadata) int {
 	if ri.CanonicalisedName == rj.CanonicalisedName {
 		return 0
 	}
@@ -145,8 +233,7 @@ func (s *SortableRooms) comparatorSortByName(i, j int) int {
 	return -1
 }
 
-func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func (s *SortableRooms) comparatorSortByRecency(ri, rj *RoomConnMetadata) int {
 	tsRi := ri.GetLastInterestedEventTimestamp(s.listKey)
 	tsRj := rj.GetLastInterestedEventTimestamp(s.listKey)
 	if tsRi == tsRj {
@@ -158,8 +245,7 @@ func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
 	return -1
 }
 
-func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func (s *SortableRooms) comparatorSortByHighlightCount(ri, rj *RoomConnMetadata) int {
 	if ri.HighlightCount == rj.HighlightCount {
 		return 0
 	}
@@ -169,8 +255,7 @@ func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
 	return -1
 }
 
-func (s *SortableRooms) comparatorSortByNotificationLevel(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func (s *SortableRooms) comparatorSortByNotificationLevel(ri, rj *RoomConnMetadata) int {
 	// highlight rooms come first
 	if ri.HighlightCount > 0 && rj.HighlightCount > 0 {
 		return 0
@@ -202,8 +287,7 @@ func (s *SortableRooms) comparatorSortByNotificationLevel(i, j int) int {
 	return 0
 }
 
-func (s *SortableRooms) comparatorSortByNotificationCount(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func (s *SortableRooms) comparatorSortByNotificationCount(ri, rj *RoomConnMetadata) int {
 	if ri.NotificationCount == rj.NotificationCount {
 		return 0
 	}
@@ -213,6 +297,45 @@ func (s *SortableRooms) comparatorSortByNotificationCount(i, j int) int {
 	return -1
 }
 
+// tagGroup returns the group a room is sorted into by tag: favourites first, then untagged rooms,
+// then low priority rooms. Rooms which are both favourite and low priority are favourites.
+// Returns the tag the room is ordered by within its group, or "" if it is untagged.
+func tagGroup(r *RoomConnMetadata) (group int, tag string) {
+	if _, ok := r.Tags["m.favourite"]; ok {
+		return 0, "m.favourite"
+	}
+	if _, ok := r.Tags["m.lowpriority"]; ok {
+		return 2, "m.lowpriority"
+	}
+	return 1, ""
+}
+
+// comparatorSortByTag sorts favourites to the top and low priority rooms to the bottom. Rooms in
+// these groups are sorted by the order of their tag, lowest first, with rooms whose tag has no order
+// last.
+func (s *SortableRooms) comparatorSortByTag(ri, rj *RoomConnMetadata) int {
+	groupI, tag := tagGroup(ri)
+	groupJ, _ := tagGroup(rj)
+	if groupI != groupJ {
+		if groupI < groupJ {
+			return 1
+		}
+		return -1
+	}
+	if tag == "" {
+		return 0
+	}
+	orderI := ri.Tags[tag]
+	orderJ := rj.Tags[tag]
+	if orderI == orderJ {
+		return 0
+	}
+	if orderI < orderJ {
+		return 1
+	}
+	return -1
+}
+
 // FilteredSortableRooms is SortableRooms but where rooms are filtered before being added to the list.
 // Updates to room metadata may result in rooms being added/removed.
 type FilteredSortableRooms struct {
@@ -227,7 +350,7 @@ func NewFilteredSortableRooms(finder RoomFinder, listKey string, roomIDs []strin
 	}
 	for _, roomID := range roomIDs {
 		r := finder.ReadOnlyRoom(roomID)
-		if filter.Include(r, finder) {
+		if filter.Include(r, finder) && filter.includeActivity(r, listKey) {
 			filteredRooms = append(filteredRooms, roomID)
 		}
 	}
@@ -237,9 +360,14 @@ func NewFilteredSortableRooms(finder RoomFinder, listKey string, roomIDs []strin
 	}
 }
 
+// Include returns true if this room should be in this list.
+func (f *FilteredSortableRooms) Include(r *RoomConnMetadata) bool {
+	return f.filter.Include(r, f.finder) && f.filter.includeActivity(r, f.listKey)
+}
+
 func (f *FilteredSortableRooms) Add(roomID string) bool {
 	r := f.finder.ReadOnlyRoom(roomID)
-	if !f.filter.Include(r, f.finder) {
+	if !f.Include(r) {
 		return false
 	}
 	return f.SortableRooms.Add(roomID)
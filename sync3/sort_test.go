@@ -1,6 +1,8 @@
 package sync3
 
 import (
+	"fmt"
+	"math/rand"
 	"reflect"
 	"strings"
 	"testing"
@@ -99,10 +101,7 @@ func TestSortBySingleOperation(t *testing.T) {
 	sr := NewSortableRooms(f, listKey, f.roomIDs)
 	for sortBy, wantOrder := range wantMap {
 		sr.Sort(strings.Split(sortBy, " "))
-		var gotRoomIDs []string
-		for i := range sr.roomIDs {
-			gotRoomIDs = append(gotRoomIDs, sr.roomIDs[i])
-		}
+		gotRoomIDs := sr.RoomIDs()
 		for i := range wantOrder {
 			if wantOrder[i] != gotRoomIDs[i] {
 				t.Errorf("Sort: %s got %v want %v", sortBy, gotRoomIDs, wantOrder)
@@ -188,10 +187,7 @@ func TestSortByMultipleOperations(t *testing.T) {
 	sr := NewSortableRooms(f, listKey, f.roomIDs)
 	for _, tc := range testCases {
 		sr.Sort(tc.SortBy)
-		var gotRoomIDs []string
-		for i := range sr.roomIDs {
-			gotRoomIDs = append(gotRoomIDs, sr.roomIDs[i])
-		}
+		gotRoomIDs := sr.RoomIDs()
 		for i := range tc.WantRooms {
 			if tc.WantRooms[i] != gotRoomIDs[i] {
 				t.Errorf("Sort: %v got %v want %v", tc.SortBy, gotRoomIDs, tc.WantRooms)
@@ -365,10 +361,7 @@ func TestSortByNotificationLevel(t *testing.T) {
 	if err := sr.Sort([]string{SortByNotificationLevel, SortByRecency}); err != nil {
 		t.Fatalf("Sort: %s", err)
 	}
-	var gotRoomIDs []string
-	for i := range sr.roomIDs {
-		gotRoomIDs = append(gotRoomIDs, sr.roomIDs[i])
-	}
+	gotRoomIDs := sr.RoomIDs()
 	// we expect the rooms to be grouped in this order:
 	// HIGHLIGHT COUNT > 0
 	// ENCRYPTED, NOTIF COUNT > 0
@@ -387,3 +380,120 @@ func TestSortByNotificationLevel(t *testing.T) {
 		t.Errorf("want: %v", wantRoomIDs)
 	}
 }
+
+func TestSortByTag(t *testing.T) {
+	const listKey = "my_list"
+	newRoom := func(roomID string, tags map[string]float64, notifCount int, ts uint64) *RoomConnMetadata {
+		return &RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomID,
+			},
+			UserRoomData: caches.UserRoomData{
+				Tags:              tags,
+				NotificationCount: notifCount,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: ts},
+		}
+	}
+	rooms := []*RoomConnMetadata{
+		newRoom("!untagged-old", nil, 0, 1),
+		newRoom("!low-unordered", map[string]float64{"m.lowpriority": caches.TagOrderUnset}, 0, 2),
+		newRoom("!fav-0.5", map[string]float64{"m.favourite": 0.5}, 0, 3),
+		newRoom("!untagged-notif", nil, 5, 4),
+		newRoom("!fav-unordered", map[string]float64{"m.favourite": caches.TagOrderUnset}, 0, 5),
+		newRoom("!low-0.1", map[string]float64{"m.lowpriority": 0.1}, 0, 6),
+		newRoom("!fav-0.2-and-low", map[string]float64{"m.favourite": 0.2, "m.lowpriority": 0}, 0, 7),
+		newRoom("!untagged-new", map[string]float64{"u.work": 0}, 0, 8),
+		newRoom("!fav-0.5-new", map[string]float64{"m.favourite": 0.5}, 0, 9),
+	}
+	f := newFinder(rooms)
+	sr := NewSortableRooms(f, listKey, f.roomIDs)
+	assertOrder := func(wantRoomIDs ...string) {
+		t.Helper()
+		if err := sr.Sort([]string{SortByTag, SortByNotificationCount, SortByRecency}); err != nil {
+			t.Fatalf("Sort: %s", err)
+		}
+		if !reflect.DeepEqual(sr.RoomIDs(), wantRoomIDs) {
+			t.Errorf("got:  %v", sr.RoomIDs())
+			t.Errorf("want: %v", wantRoomIDs)
+		}
+	}
+	// favourites by order, then the rest by notification count and recency, then low priority
+	// rooms by order. Ties within a tag's order fall through to the next sort.
+	assertOrder(
+		"!fav-0.2-and-low", "!fav-0.5-new", "!fav-0.5", "!fav-unordered",
+		"!untagged-notif", "!untagged-new", "!untagged-old",
+		"!low-0.1", "!low-unordered",
+	)
+
+	// tagging a room moves it when the list is sorted again
+	f.rooms["!untagged-old"].Tags = map[string]float64{"m.favourite": 0.1}
+	delete(f.rooms["!fav-0.5"].Tags, "m.favourite")
+	assertOrder(
+		"!untagged-old", "!fav-0.2-and-low", "!fav-0.5-new", "!fav-unordered",
+		"!untagged-notif", "!untagged-new", "!fav-0.5",
+		"!low-0.1", "!low-unordered",
+	)
+}
+
+// Test that moving one room which changed puts it in the same place as sorting the whole list,
+// including when it ties with other rooms.
+func TestSortableRoomsSortRoom(t *testing.T) {
+	const listKey = "my_list"
+	rng := rand.New(rand.NewSource(42))
+	var rooms []*RoomConnMetadata
+	for i := 0; i < 100; i++ {
+		rooms = append(rooms, &RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: fmt.Sprintf("!%d:localhost", i),
+			},
+			UserRoomData: caches.UserRoomData{
+				// few values, so there are lots of ties
+				NotificationCount: rng.Intn(3),
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: uint64(rng.Intn(20))},
+		})
+	}
+	f := newFinder(rooms)
+	sortBy := []string{SortByNotificationCount, SortByRecency}
+	sr := NewSortableRooms(f, listKey, f.roomIDs)
+	if err := sr.Sort(sortBy); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	for i := 0; i < 500; i++ {
+		r := rooms[rng.Intn(len(rooms))]
+		r.NotificationCount = rng.Intn(3)
+		r.LastInterestedEventTimestamps[listKey] = uint64(rng.Intn(20))
+		// Sort is stable, so sorting the list as it was gives the order SortRoom should give
+		sorted := NewSortableRooms(f, listKey, sr.RoomIDs())
+		if err := sorted.Sort(sortBy); err != nil {
+			t.Fatalf("Sort: %s", err)
+		}
+		if err := sr.SortRoom(r.RoomID, sortBy); err != nil {
+			t.Fatalf("SortRoom: %s", err)
+		}
+		if !reflect.DeepEqual(sr.RoomIDs(), sorted.RoomIDs()) {
+			t.Fatalf("SortRoom %s: got %v want %v", r.RoomID, sr.RoomIDs(), sorted.RoomIDs())
+		}
+	}
+	// added rooms go after the rooms they tie with, as if they were appended and then sorted
+	newRoom := &RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID: "!new:localhost",
+		},
+		UserRoomData:                  caches.UserRoomData{NotificationCount: 1},
+		LastInterestedEventTimestamps: map[string]uint64{listKey: 10},
+	}
+	f.rooms[newRoom.RoomID] = newRoom
+	sorted := NewSortableRooms(f, listKey, append(sr.RoomIDs(), newRoom.RoomID))
+	if err := sorted.Sort(sortBy); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	sr.Add(newRoom.RoomID)
+	if err := sr.SortRoom(newRoom.RoomID, sortBy); err != nil {
+		t.Fatalf("SortRoom: %s", err)
+	}
+	if !reflect.DeepEqual(sr.RoomIDs(), sorted.RoomIDs()) {
+		t.Fatalf("SortRoom new room: got %v want %v", sr.RoomIDs(), sorted.RoomIDs())
+	}
+}
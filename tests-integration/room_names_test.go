@@ -136,6 +136,8 @@ func TestRoomNames(t *testing.T) {
 	checkRoomNameFilter("my room name", []roomEvents{allRooms[1]})
 	// partial matching
 	checkRoomNameFilter("room na", []roomEvents{allRooms[1]})
+	// matching ignores diacritics and extra whitespace
+	checkRoomNameFilter("  Róom   Ñame ", []roomEvents{allRooms[1]})
 	// multiple matches
 	checkRoomNameFilter("bob", []roomEvents{allRooms[0], allRooms[3]})
 }
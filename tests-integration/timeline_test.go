@@ -1066,6 +1066,70 @@ func TestPrevBatchInTimeline(t *testing.T) {
 	}
 }
 
+// Test that when the homeserver skips events in a gappy v2 timeline, the live timeline starts again
+// from the gap and the room is marked as having a gappy timeline, with the prev_batch to backfill the
+// gap from.
+func TestGappyLiveTimeline(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	roomID := "!gappy:localhost"
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				state:  createRoomState(t, alice, time.Now()),
+			}),
+		},
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		RoomSubscriptions: map[string]sync3.RoomSubscription{
+			roomID: {TimelineLimit: 10},
+		},
+	})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID))
+
+	beforeGap := testutils.NewMessageEvent(t, alice, "before the gap")
+	afterGap := testutils.NewMessageEvent(t, alice, "after the gap")
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{beforeGap},
+			}),
+		},
+	})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: map[string]sync2.SyncV2JoinResponse{
+				roomID: {
+					Timeline: sync2.TimelineResponse{
+						Events:    []json.RawMessage{afterGap},
+						Limited:   true,
+						PrevBatch: "gap",
+					},
+				},
+			},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscription(roomID,
+		m.MatchRoomTimeline([]json.RawMessage{afterGap}),
+		m.MatchRoomPrevBatch("gap"),
+		func(r sync3.Room) error {
+			if !r.Limited || !r.GappyTimeline {
+				return fmt.Errorf("got limited=%v unstable_gappy_timeline=%v want both true", r.Limited, r.GappyTimeline)
+			}
+			return nil
+		},
+	))
+}
+
 // Test that you can get a window with timeline_limit: 1, then increase the limit to 3 and get the
 // room timeline changes only (without any req_state or list ops sent). Likewise, do the same
 // but for required_state (initially empty, then set stuff and only get that)
@@ -22,6 +22,8 @@ import (
 	_ "github.com/matrix-org/sliding-sync/state/migrations"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/sync3/handler"
 	"github.com/pressly/goose/v3"
 	"github.com/rs/zerolog"
@@ -40,8 +42,9 @@ var Version string
 type Opts struct {
 	AddPrometheusMetrics bool
 	// The max number of events the client is eligible to read (unfiltered) which we are willing to
-	// buffer on this connection. Too large and we consume lots of memory. Too small and busy accounts
-	// will trip the connection knifing. Customisable as tests might want to test filling the buffer.
+	// buffer for a connection. Connections on the same device share one buffer. Too large and we
+	// consume lots of memory. Too small and busy accounts will trip the connection knifing.
+	// Customisable as tests might want to test filling the buffer.
 	MaxPendingEventUpdates int
 	// if true, publishing messages will block until the consumer has consumed it.
 	// Assumes a single producer and a single consumer.
@@ -50,9 +53,134 @@ type Opts struct {
 	// confirmation of an event's transaction_id before sending it to its sender.
 	// Set to 0 to disable this delay mechanism entirely.
 	MaxTransactionIDDelay time.Duration
+	// MaxCoalesceWindow is the longest amount of time a client can ask us to wait for more live
+	// updates after the first one arrives, via `coalesce_ms`. Set to 0 to disable coalescing.
+	MaxCoalesceWindow time.Duration
+	// MinPollInterval is the suggested_poll_interval_ms returned to clients. Set to 0 to not
+	// suggest an interval.
+	MinPollInterval time.Duration
+	// PollLoadThreshold is the number of requests per second above which the suggested poll
+	// interval is scaled up. Set to 0 to always suggest MinPollInterval.
+	PollLoadThreshold int
+	// MaxTrackedRooms is the maximum number of joined rooms to track per connection. Users in more
+	// rooms have their least recently active rooms left out of lists until they get activity.
+	// This only bounds the memory and work of each connection: the poller still syncs, and the
+	// caches still hold, every room the user is joined to. Set to 0 for no limit.
+	MaxTrackedRooms int
+	// Homeservers maps the server names of the homeservers to serve to the base URLs of their
+	// client-server APIs, for serving users of more than one homeserver. Empty base URLs are looked
+	// up with .well-known. Unknown access tokens are identified by the homeserver whose server name
+	// matches the host the client connected to. If empty, the homeserver given to Setup is served.
+	Homeservers map[string]string
+	// Appservice is an application service, e.g a bridge, whose transactions update the rooms of
+	// the users in its namespace instead of polling them. If nil, every user is polled.
+	Appservice *handler2.Appservice
+	// Authenticator identifies access tokens which the proxy has not seen before. If nil, the
+	// upstream homeserver is asked via /account/whoami.
+	Authenticator handler.Authenticator
+	// AuthCacheTTL is how long to remember access tokens validated by the Authenticator. Cached
+	// tokens are forgotten early if the pollers find them to be invalid. Set to 0 to disable caching.
+	AuthCacheTTL time.Duration
+	// PollTimelineLimit is the timeline limit the pollers request from the upstream homeserver.
+	// Set to 0 to use sync2.DefaultTimelineLimit.
+	PollTimelineLimit int
+	// Presence makes the pollers ask the upstream homeserver for presence, to serve the presence
+	// extension. If false, the presence extension never returns any presence.
+	Presence bool
+	// EventRetention is how long to keep timeline events for before they are purged. The most
+	// recent events in each room and all state events are always kept. Set to 0 to keep events forever.
+	EventRetention time.Duration
+	// MaxEventsPerRoom is the number of timeline events to keep per room before older events are
+	// purged. Set to 0 for no limit.
+	MaxEventsPerRoom int
+	// RoomRetention overrides EventRetention and MaxEventsPerRoom for some rooms, keyed by room ID.
+	RoomRetention map[string]state.RetentionPolicy
+	// ToDeviceRetention is how long to keep to-device messages for, whether or not they have been
+	// sent. Set to 0 to keep them until the device acknowledges them.
+	ToDeviceRetention time.Duration
+	// MaxToDeviceMessages is the number of to-device messages to keep per device before older
+	// messages are purged. Set to 0 for no limit.
+	MaxToDeviceMessages int
+	// Backfill serves timeline history older than the proxy has stored, by fetching it from the
+	// homeserver's /messages as the user.
+	Backfill bool
+	// BackfillRetention is how long to keep history fetched for Backfill. Set to 0 to keep it forever.
+	BackfillRetention time.Duration
+	// MaxEventSize is the size in bytes above which timeline events are replaced with placeholders.
+	// Set to 0 to use internal.DefaultMaxEventSize, or less than 0 for no limit.
+	MaxEventSize int
+	// ExtensionSizeLimits caps the size of extension payloads in each response. The zero value
+	// means no limits.
+	ExtensionSizeLimits extensions.SizeLimits
+	// LargeRoomThreshold is the number of joined members at which rooms are handled in a degraded
+	// mode which avoids loading their membership. Set to 0 to use caches.DefaultLargeRoomThreshold,
+	// or less than 0 to never treat rooms as large.
+	LargeRoomThreshold int
+	// CountUpdateThrottle is how long to hold live updates which only change unread counts before
+	// returning them, for users joined to at least CountUpdateThrottleMinRooms rooms. Count changes
+	// which add highlights are returned immediately. Set to 0 to disable throttling.
+	CountUpdateThrottle         time.Duration
+	CountUpdateThrottleMinRooms int
+	// ConnBufferLimits caps the responses buffered for clients which are not acknowledging them.
+	// The zero value means no limits.
+	ConnBufferLimits sync3.BufferLimits
+	// FeatureGates enables gated features for only some devices. The zero value enables every
+	// feature for every device.
+	FeatureGates sync3.FeatureGates
+	// ConnSetupRate is the number of new connections to set up per second. Setups over the rate
+	// wait for up to ConnSetupMaxWait before the client is told to retry later. Set to 0 for no limit.
+	ConnSetupRate    float64
+	ConnSetupMaxWait time.Duration
+	// ConnRateLimit limits how often each connection can make requests. The zero value means no
+	// limit.
+	ConnRateLimit sync3.RateLimit
+	// UserConnSetupRateLimit and DeviceConnSetupRateLimit limit how often each user and each device
+	// can set up new connections. Setups over the limit are told to retry later. The zero value
+	// means no limit.
+	UserConnSetupRateLimit   sync3.RateLimit
+	DeviceConnSetupRateLimit sync3.RateLimit
+	// MaxConcurrentInitialSyncs caps the number of initial syncs calculated at once. Initial syncs
+	// over the cap wait for up to InitialSyncMaxWait before the client is told to retry later. Set
+	// to 0 for no limit.
+	MaxConcurrentInitialSyncs int
+	InitialSyncMaxWait        time.Duration
+	// WarmUpWorkers is the number of users whose caches are loaded at once in the background after
+	// their first poll, so that their first request doesn't have to. Set to 0 to not warm up users.
+	WarmUpWorkers int
+	// ConnDebugResponses is the number of responses to summarise for each connection, which users can
+	// see with their connections' lists and room subscriptions on handler.ConnDebugPath. Set to 0 to
+	// not serve it.
+	ConnDebugResponses int
+	// ResponseFilter redacts, drops or annotates the events and rooms sent to clients, for
+	// deployments which embed the proxy. If nil, responses are not filtered.
+	ResponseFilter handler.ResponseFilter
+	// CompressBufferedResponses makes connections hold the responses they buffer compressed, apart
+	// from the first, to use less memory per connection.
+	CompressBufferedResponses bool
+	// ConnTimeoutLimits clamps the long-poll timeout clients ask for. The zero value means clients
+	// can ask for any timeout, and requests without one wait for 10s.
+	ConnTimeoutLimits sync3.TimeoutLimits
+	// OnConnPanic is called when handling a request on a connection panics, e.g to forward it to
+	// an error tracker. Panics are always logged and reported to Sentry.
+	OnConnPanic func(connID sync3.ConnID, req *sync3.Request, stack []byte)
+	// ConnStore saves connection positions so clients can resume their connections after a restart.
+	// If nil, clients must start new connections after a restart, unless PersistConnPositions is set.
+	ConnStore sync3.ConnStore
+	// PersistConnPositions saves connection positions and buffered responses in the database, if
+	// ConnStore is nil.
+	PersistConnPositions bool
+	// CompressResponses gzips responses for clients which accept it.
+	CompressResponses bool
+	// ConnExpiry decides when idle or old connections are expired. The zero value expires
+	// connections after 30 minutes without a request.
+	ConnExpiry sync3.ExpiryPolicy
 
 	DBMaxConns        int
 	DBConnMaxIdleTime time.Duration
+	// DBReadReplicaURI is the connection string of a read-only streaming replica of the database,
+	// which timeline and room state loads are sent to once it has replayed the WAL up to the events
+	// they need. If empty, all reads go to the database.
+	DBReadReplicaURI string
 
 	// HTTPTimeout is used for "normal" HTTP requests
 	HTTPTimeout time.Duration
@@ -87,16 +215,7 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 }
 
 // Setup the proxy
-func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Handler, http.Handler) {
-	// Setup shared DB and HTTP client
-	v2Client := sync2.NewHTTPClient(opts.HTTPTimeout, opts.HTTPLongTimeout, destHomeserver)
-
-	// Sanity check that we can contact the upstream homeserver.
-	_, err := v2Client.Versions(context.Background())
-	if err != nil {
-		logger.Warn().Err(err).Str("dest", destHomeserver).Msg("Could not contact upstream homeserver. Is SYNCV3_SERVER set correctly?")
-	}
-
+func openDB(postgresURI string, opts Opts) *sqlx.DB {
 	db, err := sqlx.Open("postgres", postgresURI)
 	if err != nil {
 		sentry.CaptureException(err)
@@ -114,12 +233,57 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	if opts.DBConnMaxIdleTime > 0 {
 		db.SetConnMaxIdleTime(opts.DBConnMaxIdleTime)
 	}
+	return db
+}
+
+func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Handler, http.Handler) {
+	// Setup shared DB and HTTP client
+	newV2Client := func(destination string) *sync2.HTTPClient {
+		client := sync2.NewHTTPClient(opts.HTTPTimeout, opts.HTTPLongTimeout, destination)
+		client.TimelineLimit = opts.PollTimelineLimit
+		client.Presence = opts.Presence
+		return client
+	}
+	var v2Client sync2.Client
+	var multiClient *sync2.MultiHomeserverClient
+	if len(opts.Homeservers) > 0 {
+		multiClient = sync2.NewMultiHomeserverClient(opts.Homeservers, opts.HTTPTimeout, newV2Client)
+		v2Client = multiClient
+		// Sanity check that we can contact the upstream homeservers.
+		for _, serverName := range multiClient.ServerNames() {
+			_, err := v2Client.Versions(sync2.WithServerName(context.Background(), serverName))
+			if err != nil {
+				logger.Warn().Err(err).Str("server_name", serverName).Msg("Could not contact upstream homeserver. Is SYNCV3_HOMESERVERS set correctly?")
+			}
+		}
+	} else {
+		v2Client = newV2Client(destHomeserver)
+		// Sanity check that we can contact the upstream homeserver.
+		_, err := v2Client.Versions(context.Background())
+		if err != nil {
+			logger.Warn().Err(err).Str("dest", destHomeserver).Msg("Could not contact upstream homeserver. Is SYNCV3_SERVER set correctly?")
+		}
+	}
+
+	db := openDB(postgresURI, opts)
 	store := state.NewStorageWithDB(db, opts.AddPrometheusMetrics)
+	if opts.DBReadReplicaURI != "" {
+		store.SetReadReplica(openDB(opts.DBReadReplicaURI, opts))
+	}
+	store.EventRetention = opts.EventRetention
+	store.MaxEventsPerRoom = opts.MaxEventsPerRoom
+	store.RoomRetention = opts.RoomRetention
+	store.ToDeviceRetention = opts.ToDeviceRetention
+	store.MaxToDeviceMessages = opts.MaxToDeviceMessages
+	store.BackfillRetention = opts.BackfillRetention
+	if opts.MaxEventSize != 0 {
+		store.Accumulator.MaxEventSize = opts.MaxEventSize
+	}
 	storev2 := sync2.NewStoreWithDB(db, secret)
 
 	// Automatically execute migrations
 	goose.SetBaseFS(EmbedMigrations)
-	err = goose.Up(db.DB, "state/migrations", goose.WithAllowMissing())
+	err := goose.Up(db.DB, "state/migrations", goose.WithAllowMissing())
 	if err != nil {
 		logger.Panic().Err(err).Msg("failed to execute migrations")
 	}
@@ -142,12 +306,52 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 		panic(err)
 	}
 	pMap.SetCallbacks(h2)
+	if opts.Appservice != nil {
+		h2.SetAppservice(opts.Appservice)
+	}
 
 	// create v3 handler
-	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay)
+	h3, err := handler.NewSync3Handler(store, storev2, v2Client, secret, pubSub, pubSub, opts.AddPrometheusMetrics, opts.MaxPendingEventUpdates, opts.MaxTransactionIDDelay, opts.MaxCoalesceWindow,
+		opts.MinPollInterval, opts.PollLoadThreshold, opts.MaxTrackedRooms,
+	)
 	if err != nil {
 		panic(err)
 	}
+	auth := opts.Authenticator
+	if auth == nil {
+		auth = &handler.UpstreamAuthenticator{Client: v2Client}
+	}
+	h3.SetAuthenticator(auth, opts.AuthCacheTTL)
+	if multiClient != nil {
+		h3.SetServerNameForHost(multiClient.ServerNameForHost)
+	}
+	h3.Extensions.SizeLimits = opts.ExtensionSizeLimits
+	h3.SetCountUpdateThrottle(opts.CountUpdateThrottle, opts.CountUpdateThrottleMinRooms)
+	h3.ConnMap.SetBufferLimits(opts.ConnBufferLimits)
+	h3.ConnMap.SetRateLimit(opts.ConnRateLimit)
+	h3.ConnMap.SetCompressBufferedResponses(opts.CompressBufferedResponses)
+	h3.ConnMap.SetTimeoutLimits(opts.ConnTimeoutLimits)
+	if opts.OnConnPanic != nil {
+		h3.ConnMap.SetOnPanic(opts.OnConnPanic)
+	}
+	if opts.ConnStore != nil {
+		h3.ConnMap.SetConnStore(opts.ConnStore)
+	} else if opts.PersistConnPositions {
+		h3.ConnMap.SetConnStore(handler.NewPostgresConnStore(store.ConnPositionsTable))
+	}
+	h3.ConnMap.SetExpiryPolicy(opts.ConnExpiry)
+	h3.SetCompressResponses(opts.CompressResponses)
+	h3.SetBackfill(opts.Backfill)
+	h3.SetFeatureGates(opts.FeatureGates)
+	h3.SetConnSetupRate(opts.ConnSetupRate, opts.ConnSetupMaxWait)
+	h3.SetConnSetupRateLimits(opts.UserConnSetupRateLimit, opts.DeviceConnSetupRateLimit)
+	h3.SetMaxConcurrentInitialSyncs(opts.MaxConcurrentInitialSyncs, opts.InitialSyncMaxWait)
+	h3.SetWarmUp(opts.WarmUpWorkers)
+	h3.SetConnDebug(opts.ConnDebugResponses)
+	h3.SetResponseFilter(opts.ResponseFilter)
+	if opts.LargeRoomThreshold != 0 {
+		h3.GlobalCache.SetLargeRoomThreshold(opts.LargeRoomThreshold)
+	}
 	storeSnapshot, err := store.GlobalSnapshot()
 	if err != nil {
 		panic(err)
@@ -161,12 +365,24 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	return h2, h3
 }
 
-// RunSyncV3Server is the main entry point to the server
-func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) {
+// RunSyncV3Server is the main entry point to the server. admin serves the admin endpoints
+// handler2.AdminPollerPath and handler.AdminConnsPath. If admin is nil, admin endpoints are not served.
+// appservice serves handler2.AppserviceTransactionsPath, and is not served if nil.
+// Requests are served in the background until the returned server is shut down.
+func RunSyncV3Server(h http.Handler, admin http.Handler, appservice http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) *http.Server {
 	// HTTP path routing
 	r := mux.NewRouter()
 	r.Handle("/_matrix/client/v3/sync", allowCORS(h))
 	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", allowCORS(h))
+	r.Handle(handler.MessagesPath, allowCORS(h))
+	r.PathPrefix(handler.ConnDebugPath).HandlerFunc(allowCORS(h))
+	if admin != nil {
+		r.Handle(handler2.AdminPollerPath, admin)
+		r.Handle(handler.AdminConnsPath, admin)
+	}
+	if appservice != nil {
+		r.PathPrefix(handler2.AppserviceTransactionsPath).Handler(appservice)
+	}
 
 	serverJSON, _ := json.Marshal(struct {
 		Server  string `json:"server"`
@@ -217,26 +433,37 @@ func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey str
 		final: r,
 	}
 
-	// Block forever
-	var err error
+	httpServer := &http.Server{Handler: srv}
+	var listener net.Listener
 	if internal.IsUnixSocket(bindAddr) {
 		logger.Info().Msgf("listening on unix socket %s", bindAddr)
-		listener := unixSocketListener(bindAddr)
-		err = http.Serve(listener, srv)
+		listener = unixSocketListener(bindAddr)
 	} else {
+		var err error
+		listener, err = net.Listen("tcp", bindAddr)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("failed to listen")
+		}
 		if tlsCert != "" && tlsKey != "" {
 			logger.Info().Msgf("listening TLS on %s", bindAddr)
-			err = http.ListenAndServeTLS(bindAddr, tlsCert, tlsKey, srv)
 		} else {
 			logger.Info().Msgf("listening on %s", bindAddr)
-			err = http.ListenAndServe(bindAddr, srv)
 		}
 	}
-	if err != nil {
-		sentry.CaptureException(err)
-		// TODO: Fatal() calls os.Exit. Will that give time for sentry.Flush() to run?
-		logger.Fatal().Err(err).Msg("failed to listen and serve")
-	}
+	go func() {
+		var err error
+		if tlsCert != "" && tlsKey != "" && !internal.IsUnixSocket(bindAddr) {
+			err = httpServer.ServeTLS(listener, tlsCert, tlsKey)
+		} else {
+			err = httpServer.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			sentry.CaptureException(err)
+			// TODO: Fatal() calls os.Exit. Will that give time for sentry.Flush() to run?
+			logger.Fatal().Err(err).Msg("failed to listen and serve")
+		}
+	}()
+	return httpServer
 }
 
 func unixSocketListener(bindAddr string) net.Listener {